@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// This file is what the packages below pkg/ build on. Like the commands, the functions
+// take containers by ID; ResolveContainer turns a name or ID prefix into one.
+
+// waitPollInterval is how often WaitContainer looks at the state of a running container
+const waitPollInterval = 50 * time.Millisecond
+
+// PullOptions configure PullImage
+type PullOptions struct {
+	// Platform selects the image of a multi-platform image, e.g. linux/arm64, instead of
+	// the host's
+	Platform string
+	// Username and Password authenticate to the registry. Without them the credentials
+	// stored by docker login are used, if there are any.
+	Username string
+	Password string
+	// SHA256 is the checksum an image given as the URL of a root filesystem tarball must have
+	SHA256 string
+}
+
+// PullImage downloads an image from the registry into the local store, like the pull
+// command, and returns it as stored. The URL of a root filesystem tarball is stored as an
+// image of a single layer.
+func PullImage(ctx context.Context, ref string, opts PullOptions) (*StoredImage, error) {
+	if isTarballURL(ref) {
+		img, err := pullTarballImage(ctx, DefaultImageStore(), ref, opts.SHA256, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull %s: %w", ref, err)
+		}
+		return img, nil
+	}
+
+	var credentials *registryCredentials
+	if opts.Username != "" {
+		credentials = &registryCredentials{Username: opts.Username, Password: opts.Password}
+	}
+
+	dl, err := NewDockerImageDownloader(ref, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image downloader: %w", err)
+	}
+	if opts.Platform != "" {
+		p, err := ParsePlatform(opts.Platform)
+		if err != nil {
+			return nil, err
+		}
+		dl.platform = &p
+	}
+
+	store := DefaultImageStore()
+	if err := dl.Pull(ctx, store); err != nil {
+		return nil, fmt.Errorf("failed to pull %s: %w", ref, err)
+	}
+
+	return store.lookup(dl.image, dl.tag)
+}
+
+// DefaultImageStore returns the store the commands pull into and create containers from
+func DefaultImageStore() *ImageStore {
+	return NewImageStore(imageStoreDir)
+}
+
+// ImageConfig is the part of an image's config that containers are created from
+type ImageConfig struct {
+	Created      time.Time
+	OS           string
+	Architecture string
+	Variant      string
+	Entrypoint   []string
+	Cmd          []string
+	User         string
+	Labels       map[string]string
+}
+
+// ImageConfig returns the config of a stored image
+func (s *ImageStore) ImageConfig(img *StoredImage) (ImageConfig, error) {
+	config, err := s.Config(img)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+
+	return ImageConfig{
+		Created:      config.Created,
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		User:         config.Config.User,
+		Labels:       config.Config.Labels,
+	}, nil
+}
+
+// CreateContainer creates a container like the create command and returns its ID. Network
+// and IPC modes that aren't set get the command's defaults. Cancelling ctx stops pulling the
+// image and undoes what was set up.
+func CreateContainer(ctx context.Context, opts RunOptions) (string, error) {
+	network, err := ParseNetworkMode(string(opts.Network))
+	if err != nil {
+		return "", err
+	}
+	opts.Network = network
+
+	ipc, err := ParseIPCMode(string(opts.IPC))
+	if err != nil {
+		return "", err
+	}
+	opts.IPC = ipc
+
+	env, err := NewContainerEnvironment(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return env.id, nil
+}
+
+// StartContainer starts a created or exited container in the background
+func StartContainer(id string) error {
+	return startContainer(id)
+}
+
+// WaitContainer waits until the container isn't running anymore and returns its exit code
+func WaitContainer(ctx context.Context, id string) (int, error) {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, err := loadContainerState(id)
+		if err != nil {
+			return 0, err
+		}
+		if state.Status != statusRunning || (!state.running() && !processAlive(state.ShimPid)) {
+			return state.ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// StopContainer sends the container SIGTERM and kills it once timeout has passed
+func StopContainer(id string, timeout time.Duration) error {
+	return stopContainer(id, timeout)
+}
+
+// KillContainer kills the container's processes
+func KillContainer(id string) error {
+	return killContainer(id)
+}
+
+// SignalContainer sends sig to the container's init, or with all to each of its processes,
+// without waiting for it to exit
+func SignalContainer(id string, sig syscall.Signal, all bool) error {
+	return signalContainerProcesses(id, sig, all)
+}
+
+// ParseSignal parses a signal name like HUP or SIGHUP, or a number, checking that the
+// platform has it
+func ParseSignal(s string) (syscall.Signal, error) {
+	return parseSignal(s)
+}
+
+// RemoveContainer removes a container and its root filesystem. Running containers are only
+// removed with force, which kills them first.
+func RemoveContainer(id string, force bool) error {
+	return removeContainer(id, force)
+}
+
+// ResolveContainer returns the ID of the container with the given name, ID or ID prefix
+func ResolveContainer(ref string) (string, error) {
+	return resolveContainer(ref)
+}
+
+// InspectContainer returns the recorded state of a container
+func InspectContainer(id string) (*ContainerState, error) {
+	return loadContainerState(id)
+}
+
+// ListContainers returns the state of every container
+func ListContainers() ([]*ContainerState, error) {
+	return listContainerStates()
+}
+
+// Reference returns the reference the image is looked up by in its store
+func (img *StoredImage) Reference() string {
+	return formatImageReference(img.Name, img.Tag)
+}
@@ -0,0 +1,403 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// attachSocketFile is the unix socket in a container's state directory that the shim serves
+// attach on
+const attachSocketFile = "attach.sock"
+
+// Kinds of the frames sent over the attach socket. Like the stream multiplexing of Docker's
+// attach, every frame starts with a header of its kind and the length of its payload.
+const (
+	attachFrameStdin  = 0
+	attachFrameStdout = 1
+	attachFrameStderr = 2
+	// attachFrameResize carries the rows and columns of the client's terminal
+	attachFrameResize = 3
+	// attachFrameExit carries the exit code of the container, sent before the shim hangs up
+	attachFrameExit = 4
+)
+
+const (
+	attachHeaderSize = 8
+	// attachMaxFrame bounds the payload the shim accepts, input comes in small reads anyway
+	attachMaxFrame = 1 << 20
+	// attachWriteTimeout is how long a client gets to take output before the shim drops it,
+	// so that a stalled client doesn't stall the container's output
+	attachWriteTimeout = time.Second
+)
+
+// errNotAttachable is returned for a container whose output goes to the command that ran it
+var errNotAttachable = errors.New("only containers running in the background or with a terminal can be attached to")
+
+// attachSocketPath returns where the shim of a container serves attach
+func attachSocketPath(id string) string {
+	return filepath.Join(containerDir(id), attachSocketFile)
+}
+
+// writeAttachFrame writes a frame of the given kind
+func writeAttachFrame(w io.Writer, kind byte, payload []byte) error {
+	frame := make([]byte, attachHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[4:attachHeaderSize], uint32(len(payload)))
+	copy(frame[attachHeaderSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readAttachFrame reads the next frame
+func readAttachFrame(r io.Reader) (byte, []byte, error) {
+	var header [attachHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > attachMaxFrame {
+		return 0, nil, fmt.Errorf("attach frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// attachServer is the shim's end of attach. It passes the output of the container on to every
+// client besides its log, and their input to the container's terminal or stdin.
+type attachServer struct {
+	listener *net.UnixListener
+	// input is the container's terminal or the pipe to its stdin, nil when nothing reads input
+	input *os.File
+	// pty is the container's terminal, which resize frames change the size of
+	pty *os.File
+
+	mu      sync.Mutex
+	clients map[*net.UnixConn]struct{}
+}
+
+// listenAttach serves attach on the container's socket, replacing one left by an earlier run
+func (env *ContainerEnvironment) listenAttach(input, pty *os.File) (*attachServer, error) {
+	path := attachSocketPath(env.id)
+	os.Remove(path)
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for attach: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen for attach: %w", err)
+	}
+
+	s := &attachServer{listener: listener, input: input, pty: pty, clients: map[*net.UnixConn]struct{}{}}
+	go s.serve()
+
+	return s, nil
+}
+
+// serve accepts clients until the server is closed
+func (s *attachServer) serve() {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.clients == nil {
+			// Closed meanwhile
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// handle passes on what a client sends until it hangs up
+func (s *attachServer) handle(conn *net.UnixConn) {
+	defer s.drop(conn)
+
+	for {
+		kind, payload, err := readAttachFrame(conn)
+		if err != nil {
+			return
+		}
+
+		switch kind {
+		case attachFrameStdin:
+			if s.input != nil {
+				s.input.Write(payload)
+			}
+		case attachFrameResize:
+			if s.pty != nil && len(payload) == 4 {
+				ws := winsize{Row: binary.BigEndian.Uint16(payload), Col: binary.BigEndian.Uint16(payload[2:])}
+				ioctl(s.pty.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+			}
+		}
+	}
+}
+
+// drop hangs up on a client
+func (s *attachServer) drop(conn *net.UnixConn) {
+	s.mu.Lock()
+	delete(s.clients, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// broadcast sends a frame to every client, dropping those that don't take it in time
+func (s *attachServer) broadcast(kind byte, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.clients {
+		conn.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+		if err := writeAttachFrame(conn, kind, payload); err != nil {
+			delete(s.clients, conn)
+			conn.Close()
+		}
+	}
+}
+
+// output returns a writer that sends what the container writes to the given log stream to
+// every client
+func (s *attachServer) output(stream string) io.Writer {
+	kind := byte(attachFrameStdout)
+	if stream == logStreamStderr {
+		kind = attachFrameStderr
+	}
+
+	return attachOutput{server: s, kind: kind}
+}
+
+type attachOutput struct {
+	server *attachServer
+	kind   byte
+}
+
+func (o attachOutput) Write(p []byte) (int, error) {
+	o.server.broadcast(o.kind, p)
+	return len(p), nil
+}
+
+// close tells every client the container's exit code, if it exited, and stops serving
+func (s *attachServer) close(exitCode *int) {
+	s.listener.Close()
+
+	if exitCode != nil {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(int32(*exitCode)))
+		s.broadcast(attachFrameExit, payload[:])
+	}
+
+	s.mu.Lock()
+	for conn := range s.clients {
+		conn.Close()
+	}
+	s.clients = nil
+	s.mu.Unlock()
+}
+
+// openStdin points our stdin, which launch passes on to the container, at a pipe and returns
+// its other end, so that input of attached clients reaches a container without a terminal
+func openStdin() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	defer r.Close()
+
+	if err := syscall.Dup3(int(r.Fd()), 0, 0); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("failed to redirect stdin: %w", err)
+	}
+
+	return w, nil
+}
+
+// attachOptions are the flags of attach
+type attachOptions struct {
+	// detachKeys replaces the container's detach sequence when set
+	detachKeys string
+	noStdin    bool
+	sigProxy   bool
+}
+
+// attachContainer connects our terminal to a running container until it exits, which returns
+// its exit code, or until the detach sequence is typed. Like docker attach's --sig-proxy, our
+// signals can be passed on to a container without a terminal, one with a terminal gets them as
+// keys.
+func attachContainer(id string, opts attachOptions) (int, error) {
+	state, err := loadContainerState(id)
+	if err != nil {
+		return 0, err
+	}
+	if !state.running() {
+		return 0, fmt.Errorf("cannot attach to %s: the container is not running, start it first", shortID(id))
+	}
+
+	keys := opts.detachKeys
+	if keys == "" {
+		keys = state.Config.DetachKeys
+	}
+	if keys == "" {
+		keys = defaultDetachKeys
+	}
+	detachKeys, err := ParseDetachKeys(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	interactive := state.Config.Interactive && !opts.noStdin
+	tty := state.Config.TTY
+	if tty && interactive && !isTerminal(os.Stdin) {
+		return 0, errors.New("the input device is not a TTY")
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: attachSocketPath(id), Net: "unix"})
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+		return 0, fmt.Errorf("cannot attach to %s: %w", shortID(id), errNotAttachable)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to attach to %s: %w", shortID(id), err)
+	}
+	defer conn.Close()
+
+	client := &attachClient{conn: conn}
+	if tty {
+		defer client.syncTerminal(interactive)()
+	} else if opts.sigProxy {
+		defer proxySignals(state.Pid)()
+	}
+
+	exited := make(chan int, 1)
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		for {
+			kind, payload, err := readAttachFrame(conn)
+			if err != nil {
+				return
+			}
+			switch kind {
+			case attachFrameStdout:
+				os.Stdout.Write(payload)
+			case attachFrameStderr:
+				os.Stderr.Write(payload)
+			case attachFrameExit:
+				if len(payload) == 4 {
+					exited <- int(int32(binary.BigEndian.Uint32(payload)))
+				}
+			}
+		}
+	}()
+
+	detached := make(chan struct{})
+	if interactive {
+		go func() {
+			input := io.Reader(os.Stdin)
+			if tty {
+				input = newEscapeProxy(os.Stdin, detachKeys)
+			}
+			if _, err := io.Copy(client, input); errors.Is(err, errDetached) {
+				close(detached)
+			}
+		}()
+	}
+
+	select {
+	case <-outputDone:
+		select {
+		case code := <-exited:
+			return code, nil
+		default:
+			return 0, fmt.Errorf("lost the connection to %s", shortID(id))
+		}
+	case <-detached:
+		return 0, nil
+	}
+}
+
+// attachClient is our end of attach, writes to it are input of the container
+type attachClient struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+func (c *attachClient) Write(p []byte) (int, error) {
+	if err := c.send(attachFrameStdin, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *attachClient) send(kind byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return writeAttachFrame(c.conn, kind, payload)
+}
+
+// syncTerminal has the container's terminal sized like ours and kept in sync, like
+// setupTerminal does for a pty we hold. Interactive sessions put our terminal into raw mode.
+// The returned function undoes the setup.
+func (c *attachClient) syncTerminal(interactive bool) func() {
+	if !isTerminal(os.Stdin) {
+		return func() {}
+	}
+
+	resize := func() {
+		var ws winsize
+		if err := ioctl(os.Stdin.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+			return
+		}
+		var payload [4]byte
+		binary.BigEndian.PutUint16(payload[:], ws.Row)
+		binary.BigEndian.PutUint16(payload[2:], ws.Col)
+		c.send(attachFrameResize, payload[:])
+	}
+	resize()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+
+	var state *syscall.Termios
+	if interactive {
+		var err error
+		if state, err = makeRaw(os.Stdin); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	}
+
+	return func() {
+		signal.Stop(winch)
+		if state != nil {
+			restoreTerminal(os.Stdin, state)
+		}
+	}
+}
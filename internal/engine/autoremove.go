@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// autoremovePolicyPath keeps how long the host keeps exited containers, which applies to every
+// container without a --ttl of its own
+const autoremovePolicyPath = "/var/lib/your-docker/autoremove.json"
+
+// autoremoveRecheckInterval is how often a shim waiting to remove its container looks again,
+// so policy changes and removals in the meantime are noticed
+const autoremoveRecheckInterval = time.Minute
+
+// autoremovePolicy is the file at autoremovePolicyPath
+type autoremovePolicy struct {
+	// TTL is how long exited containers are kept, forever when zero
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// readAutoremovePolicy returns the host's policy, keeping containers forever if none was set
+func readAutoremovePolicy() (autoremovePolicy, error) {
+	var policy autoremovePolicy
+
+	data, err := os.ReadFile(autoremovePolicyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return policy, nil
+	}
+	if err != nil {
+		return policy, fmt.Errorf("failed to read autoremove policy: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse %s: %w", autoremovePolicyPath, err)
+	}
+
+	return policy, nil
+}
+
+// writeAutoremovePolicy replaces the host's policy. Shims read it without a lock, so it is
+// replaced atomically.
+func writeAutoremovePolicy(policy autoremovePolicy) error {
+	if err := os.MkdirAll(filepath.Dir(autoremovePolicyPath), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(autoremovePolicyPath), err)
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to encode autoremove policy: %w", err)
+	}
+
+	if err := os.WriteFile(autoremovePolicyPath+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write autoremove policy: %w", err)
+	}
+	if err := os.Rename(autoremovePolicyPath+".tmp", autoremovePolicyPath); err != nil {
+		return fmt.Errorf("failed to write autoremove policy: %w", err)
+	}
+
+	return nil
+}
+
+// removalDue returns when an exited container is to be removed: its --ttl after it exited, or
+// the host policy's without one. Containers that aren't exited or are kept forever aren't due.
+func (s *ContainerState) removalDue() (time.Time, bool) {
+	if s.Status != statusExited || s.Finished.IsZero() {
+		return time.Time{}, false
+	}
+
+	ttl := s.Config.TTL
+	if ttl == 0 {
+		policy, err := readAutoremovePolicy()
+		if err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+		ttl = policy.TTL
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+
+	return s.Finished.Add(ttl), true
+}
+
+// awaitRemoval keeps the shim around after the container exited until the container is due for
+// removal, then removes it. It gives up once the container is removed or started again.
+func (env *ContainerEnvironment) awaitRemoval() {
+	finished := env.state.Finished
+	for {
+		state, err := loadContainerState(env.id)
+		if err != nil || !state.Finished.Equal(finished) {
+			return
+		}
+
+		due, ok := state.removalDue()
+		if !ok {
+			return
+		}
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(min(wait, autoremoveRecheckInterval))
+			continue
+		}
+
+		if err := removeExpiredContainer(env.id, finished); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+		return
+	}
+}
+
+// removeExpiredContainers removes the exited containers that are due, whose shims are gone or
+// haven't woken up yet. It runs at the start of every command, like the watchdog.
+func removeExpiredContainers() {
+	states, err := listContainerStates()
+	if err != nil {
+		return
+	}
+
+	for _, state := range states {
+		if due, ok := state.removalDue(); !ok || time.Now().Before(due) {
+			continue
+		}
+		if err := removeExpiredContainer(state.ID, state.Finished); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	}
+}
+
+// removeExpiredContainer removes a container that exited at finished, unless it was started
+// again since. The state lock keeps a concurrent start from running it while it goes.
+func removeExpiredContainer(id string, finished time.Time) error {
+	lock, err := lockState(id)
+	if errors.Is(err, errContainerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if errors.Is(err, errContainerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if state.Status != statusExited || !state.Finished.Equal(finished) {
+		return nil
+	}
+
+	env := &ContainerEnvironment{id: state.ID, state: state, rootPath: state.RootPath, layers: state.Layers}
+	if err := env.Remove(); err != nil {
+		return fmt.Errorf("failed to remove expired container %s: %w", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1045 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventActionBuild is published for the image a build produces
+const eventActionBuild = "build"
+
+// buildRepository is the reserved repository the image of every build step is tagged in by
+// digest, so that the containers of the following steps can be created from it. The tags are
+// removed once the build is done, except for the final image of a build without -t.
+const buildRepository = "localhost/your-docker-build"
+
+// buildOptions are those of the build command
+type buildOptions struct {
+	// Dockerfile is the path of the Dockerfile, <context>/Dockerfile by default
+	Dockerfile string
+	// Tags are the name:tag references the built image is tagged as
+	Tags []string
+	// NoCache runs every step instead of taking unchanged ones from the build cache
+	NoCache bool
+	// BuildArgs are the values of --build-arg by name
+	BuildArgs map[string]string
+	// Compression is how the layers of the steps are compressed
+	Compression layerCompression
+}
+
+// builder runs the instructions of a Dockerfile
+type builder struct {
+	ctx     context.Context
+	store   *ImageStore
+	context *buildContext
+	out     io.Writer
+	// image is the image of the current stage's steps so far, and config its config
+	image  *StoredImage
+	config imageConfig
+	// stages are those started by FROM so far, the last one being built
+	stages []buildStage
+	// buildArgs are the --build-arg values, globalArgs the args declared before the first
+	// FROM and consumedArgs the names of all args an ARG declared
+	buildArgs    map[string]string
+	globalArgs   map[string]string
+	consumedArgs map[string]bool
+	// cmdSet is set once CMD was given, which ENTRYPOINT then keeps
+	cmdSet bool
+	// noCache runs every step even if the cache has its image
+	noCache bool
+	// compression is how the layers of the steps are compressed
+	compression layerCompression
+	// steps are the tags of the step images in buildRepository
+	steps []string
+	// tmp holds downloads and extracted archives of ADD until the build is done
+	tmp string
+}
+
+// buildImage builds the Dockerfile with the files of the context directory and returns the
+// image, printing the steps like docker build does
+func buildImage(ctx context.Context, contextDir string, opts buildOptions) (*StoredImage, error) {
+	type reference struct{ name, tag string }
+	var tags []reference
+	for _, t := range opts.Tags {
+		name, tag, err := parseImageReference(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", t, err)
+		}
+		if isTarballURL(t) || pinnedDigest(tag) != "" || name == buildRepository {
+			return nil, fmt.Errorf("invalid tag %q: expected a name with an optional tag", t)
+		}
+		tags = append(tags, reference{name, tag})
+	}
+
+	dockerfile := opts.Dockerfile
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, "Dockerfile")
+	}
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %w", err)
+	}
+	instructions, err := parseDockerfile(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buildContext, err := loadBuildContext(contextDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{
+		ctx:          ctx,
+		store:        NewImageStore(imageStoreDir),
+		context:      buildContext,
+		out:          os.Stdout,
+		noCache:      opts.NoCache,
+		compression:  opts.Compression,
+		buildArgs:    opts.BuildArgs,
+		globalArgs:   map[string]string{},
+		consumedArgs: map[string]bool{},
+	}
+	// Nothing keeps prune from removing a step image between storing and tagging it otherwise
+	lock, err := b.store.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	built := false
+	defer func() { b.cleanup(built && len(tags) == 0) }()
+
+	for i, inst := range instructions {
+		if err := ctx.Err(); err != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		fmt.Fprintf(b.out, "Step %d/%d : %s\n", i+1, len(instructions), inst.original)
+		if err := b.dispatch(inst); err != nil {
+			return nil, err
+		}
+		// An ARG before the first FROM has no image yet
+		if b.image != nil {
+			fmt.Fprintf(b.out, " ---> %s\n", shortDigest(b.image.Manifest.Config.Digest))
+		}
+	}
+	if names := b.unconsumedArgs(); len(names) > 0 {
+		warnf(eventTypeImage, "one or more build args were not consumed: %s", strings.Join(names, ", "))
+	}
+
+	img := b.image
+	built = true
+	fmt.Fprintf(b.out, "Successfully built %s\n", shortDigest(img.Manifest.Config.Digest))
+	for _, t := range tags {
+		if _, err := b.store.tag(t.name, t.tag, img.Digest); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(b.out, "Successfully tagged %s\n", formatImageReference(t.name, t.tag))
+	}
+	if len(tags) > 0 {
+		if img, err = b.store.lookup(tags[0].name, tags[0].tag); err != nil {
+			return nil, err
+		}
+	}
+
+	bus.Publish(Event{
+		Type:       eventTypeImage,
+		Action:     eventActionBuild,
+		ID:         img.Reference(),
+		Attributes: map[string]string{"digest": img.Digest},
+	})
+
+	return img, nil
+}
+
+// cleanup removes the step images' tags, except for the final image when keepFinal is set for
+// a successful build without -t, and ADD's temporary files. The blobs stay until system prune,
+// like Docker's dangling images.
+func (b *builder) cleanup(keepFinal bool) {
+	for _, tag := range b.steps {
+		if keepFinal && b.image != nil && tag == b.image.Tag {
+			continue
+		}
+		if err := b.store.untag(buildRepository, tag, pinnedDigest(tag)); err != nil {
+			warnf(eventTypeImage, "failed to remove build step image %s: %v", shortDigest(pinnedDigest(tag)), err)
+		}
+	}
+
+	if b.tmp != "" {
+		os.RemoveAll(b.tmp)
+	}
+}
+
+// dispatch runs an instruction, leaving its image in b.image. The image of a step that ran
+// on the same image before, with the same files for COPY and ADD, is taken from the cache.
+func (b *builder) dispatch(inst *instruction) error {
+	switch inst.cmd {
+	case "FROM":
+		return b.from(inst)
+	case "ARG":
+		return b.arg(inst)
+	}
+
+	var step func() error
+	content := ""
+	switch inst.cmd {
+	case "RUN":
+		step = func() error { return b.run(inst) }
+	case "COPY", "ADD":
+		var err error
+		if step, content, err = b.copyStep(inst); err != nil {
+			return err
+		}
+	default:
+		step = func() error { return b.commitConfig(inst, b.configChange(inst)) }
+	}
+
+	// The images of steps hold their layers in one compression, so builds with another one
+	// don't share them
+	if c := b.compression.String(); c != compressionGzip {
+		content += "\ncompression " + c
+	}
+	key := buildCacheKey(b.image.Manifest.Config.Digest, inst.original, b.argsCacheKey(), content)
+	var err error
+	if digest, ok := b.store.cachedBuildStep(key); ok && !b.noCache {
+		fmt.Fprintln(b.out, " ---> Using cache")
+		err = b.setImage(digest)
+	} else if err = step(); err == nil {
+		// Builds with --no-cache still leave their steps for the next one
+		err = b.store.cacheBuildStep(key, b.image.Digest)
+	}
+	b.cmdSet = b.cmdSet || inst.cmd == "CMD"
+
+	return err
+}
+
+// configChange returns how a step that doesn't add a layer changes the config entry
+func (b *builder) configChange(inst *instruction) func(config map[string]json.RawMessage) error {
+	return func(config map[string]json.RawMessage) error {
+		switch inst.cmd {
+		case "ENV":
+			return b.env(inst, config)
+		case "WORKDIR":
+			return b.workdir(inst, config)
+		case "CMD", "ENTRYPOINT":
+			return b.command(inst, config)
+		case "HEALTHCHECK":
+			return b.healthcheck(inst, config)
+		default:
+			return b.expose(inst, config)
+		}
+	}
+}
+
+// from starts a stage of the build from a stored image, which is pulled if it isn't yet, or
+// from the image of an earlier stage. FROM <image> AS <name> names the stage.
+func (b *builder) from(inst *instruction) error {
+	if _, err := inst.flagValues(); err != nil {
+		return err
+	}
+	words, err := shellWords(inst.args, b.lookupGlobalArg)
+	if err != nil {
+		return inst.errorf("%v", err)
+	}
+	name := ""
+	switch {
+	case len(words) == 3 && strings.EqualFold(words[1], "AS"):
+		if name, err = b.stageName(words[2]); err != nil {
+			return inst.errorf("%v", err)
+		}
+	case len(words) != 1:
+		return inst.errorf("FROM requires exactly one image, optionally followed by AS <name>")
+	}
+	ref := words[0]
+
+	img, ok := b.namedStage(ref)
+	if !ok {
+		if ref == "scratch" {
+			return inst.errorf("FROM scratch isn't supported: the steps need a shell from the base image")
+		}
+		if img, err = b.baseImage(ref); err != nil {
+			return fmt.Errorf("failed to get base image %s: %w", ref, err)
+		}
+	}
+
+	// Every stage starts from the config of its image, CMD included
+	b.stages = append(b.stages, buildStage{name: name, args: map[string]string{}})
+	b.cmdSet = false
+
+	// The base is tagged like the steps, so a pull retagging it meanwhile changes nothing
+	return b.setImage(img.Digest)
+}
+
+// baseImage returns a stored image, pulling it if it isn't stored yet
+func (b *builder) baseImage(ref string) (*StoredImage, error) {
+	img, _, err := storedImage(b.store, ref, nil)
+	if errors.Is(err, errImageNotFound) && !isTarballURL(ref) {
+		img, err = b.pull(ref)
+	}
+
+	return img, err
+}
+
+// pull downloads the base image of the build, showing its progress between the steps
+func (b *builder) pull(ref string) (*StoredImage, error) {
+	dl, err := NewDockerImageDownloader(ref, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := newProgressRenderer(b.out)
+	unsubscribe := bus.Subscribe(progress)
+	err = dl.Pull(b.ctx, b.store)
+	unsubscribe()
+	progress.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.store.Lookup(ref)
+}
+
+// setImage makes the image with the manifest digest that of the build's current stage
+func (b *builder) setImage(digest string) error {
+	img, err := b.stepImage(digest)
+	if err != nil {
+		return err
+	}
+	config, err := b.store.Config(img)
+	if err != nil {
+		return err
+	}
+	b.image, b.config = img, config
+	b.stages[len(b.stages)-1].image = img
+
+	return nil
+}
+
+// stepImage tags the manifest digest in buildRepository, so that containers can be created
+// from it whatever happens to the tags it was found by, and returns the image
+func (b *builder) stepImage(digest string) (*StoredImage, error) {
+	tag := "@" + digest
+	changed, err := b.store.tag(buildRepository, tag, digest)
+	if err != nil {
+		return nil, err
+	}
+	// A tag kept from an earlier build stays
+	if changed {
+		b.steps = append(b.steps, tag)
+	}
+
+	return b.store.lookup(buildRepository, tag)
+}
+
+// commit stores the image of a step: the current image with config and, unless diffID is
+// empty, layer on top of its layers
+func (b *builder) commit(inst *instruction, config []byte, layer layerEntry, diffID string) error {
+	config, err := committedConfig(config, diffID, commitOptions{CreatedBy: inst.original})
+	if err != nil {
+		return err
+	}
+
+	layers := b.image.Manifest.Layers
+	if diffID != "" {
+		layers = append(append([]layerEntry{}, layers...), layer)
+	}
+	digest, err := b.store.writeImage(b.image, config, layers)
+	if err != nil {
+		return err
+	}
+
+	return b.setImage(digest)
+}
+
+// commitConfig stores the image of a step that only changes the config the image's
+// containers run with, its config entry
+func (b *builder) commitConfig(inst *instruction, change func(config map[string]json.RawMessage) error) error {
+	data, err := b.store.readBlob(b.image.Manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(data, &image); err != nil {
+		return fmt.Errorf("failed to parse image config: %w", err)
+	}
+	config := map[string]json.RawMessage{}
+	if raw, ok := image["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return fmt.Errorf("failed to parse image config: %w", err)
+		}
+	}
+
+	if err := change(config); err != nil {
+		return err
+	}
+
+	if image["config"], err = json.Marshal(config); err != nil {
+		return fmt.Errorf("failed to encode image config: %w", err)
+	}
+	if data, err = json.Marshal(image); err != nil {
+		return fmt.Errorf("failed to encode image config: %w", err)
+	}
+
+	return b.commit(inst, data, layerEntry{}, "")
+}
+
+// setConfig sets a key of a config entry
+func setConfig(config map[string]json.RawMessage, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode image config: %w", err)
+	}
+	config[key] = data
+
+	return nil
+}
+
+// lookupEnv returns the value of a variable the arguments of ENV, WORKDIR, COPY, ADD, EXPOSE
+// and ARG are expanded with: from the image's environment, or else an arg in scope or a
+// predefined one given with --build-arg
+func (b *builder) lookupEnv(name string) (string, bool) {
+	if value, ok := b.lookupImageEnv(name); ok {
+		return value, true
+	}
+	if value, ok := b.args()[name]; ok {
+		return value, true
+	}
+	if predefinedBuildArgs[name] {
+		value, ok := b.buildArgs[name]
+		return value, ok
+	}
+
+	return "", false
+}
+
+// lookupImageEnv looks up a variable in the environment of the image so far
+func (b *builder) lookupImageEnv(name string) (string, bool) {
+	for _, e := range b.config.Config.Env {
+		if value, ok := strings.CutPrefix(e, name+"="); ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// env sets variables in the environment, given as name=value pairs or a single legacy
+// name value
+func (b *builder) env(inst *instruction, config map[string]json.RawMessage) error {
+	env := append([]string{}, b.config.Config.Env...)
+	set := func(name, value string) error {
+		if name == "" || validateEnv(name+"="+value) != nil {
+			return inst.errorf("invalid environment variable name %q", name)
+		}
+		for i, e := range env {
+			if strings.HasPrefix(e, name+"=") {
+				env[i] = name + "=" + value
+				return nil
+			}
+		}
+		env = append(env, name+"="+value)
+		return nil
+	}
+
+	name, rest, _ := strings.Cut(inst.args, " ")
+	if !strings.Contains(name, "=") {
+		// Variables in the value are those from before the instruction, like with pairs
+		value, err := shellWord(strings.TrimSpace(rest), b.lookupEnv)
+		if err != nil {
+			return inst.errorf("%v", err)
+		}
+		if err := set(name, value); err != nil {
+			return err
+		}
+	} else {
+		words, err := shellWords(inst.args, b.lookupEnv)
+		if err != nil {
+			return inst.errorf("%v", err)
+		}
+		for _, word := range words {
+			name, value, ok := strings.Cut(word, "=")
+			if !ok {
+				return inst.errorf("ENV names must be followed by =value, got %q", word)
+			}
+			if err := set(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return setConfig(config, "Env", env)
+}
+
+// workdir sets the working directory, relative to the previous one
+func (b *builder) workdir(inst *instruction, config map[string]json.RawMessage) error {
+	dir, err := shellWord(inst.args, b.lookupEnv)
+	if err != nil {
+		return inst.errorf("%v", err)
+	}
+
+	return setConfig(config, "WorkingDir", b.containerPath(dir))
+}
+
+// containerPath makes a path in the image absolute from the working directory. A trailing /,
+// which COPY and ADD tell directories by, is kept and added to . and .. for the same reason.
+func (b *builder) containerPath(p string) string {
+	dir := strings.HasSuffix(p, "/") || path.Base(p) == "." || path.Base(p) == ".."
+	if !path.IsAbs(p) {
+		wd := b.config.Config.WorkingDir
+		if wd == "" {
+			wd = "/"
+		}
+		p = path.Join(wd, p)
+	}
+	p = path.Clean(p)
+	if dir && p != "/" {
+		p += "/"
+	}
+
+	return p
+}
+
+// command sets CMD or ENTRYPOINT. The shell form runs under /bin/sh -c, and an ENTRYPOINT
+// drops the CMD of the base image, which was meant for another entrypoint.
+func (b *builder) command(inst *instruction, config map[string]json.RawMessage) error {
+	argv := inst.exec
+	if !inst.isExec {
+		argv = []string{"/bin/sh", "-c", inst.args}
+	}
+
+	if inst.cmd == "CMD" {
+		return setConfig(config, "Cmd", argv)
+	}
+	if !b.cmdSet {
+		delete(config, "Cmd")
+	}
+	return setConfig(config, "Entrypoint", argv)
+}
+
+// healthcheck sets how containers of the image check its health: HEALTHCHECK NONE turns off
+// that of the base image, HEALTHCHECK CMD runs a command in either form, with --interval,
+// --timeout, --start-period and --retries saying how
+func (b *builder) healthcheck(inst *instruction, config map[string]json.RawMessage) error {
+	flags, err := inst.flagValues("interval", "timeout", "start-period", "retries")
+	if err != nil {
+		return err
+	}
+
+	kind, rest, _ := strings.Cut(inst.args, " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToUpper(kind) {
+	case healthTestNone:
+		if len(flags) > 0 || rest != "" {
+			return inst.errorf("HEALTHCHECK NONE takes no other arguments")
+		}
+		return setConfig(config, "Healthcheck", HealthConfig{Test: []string{healthTestNone}})
+	case healthTestCmd:
+	default:
+		return inst.errorf("HEALTHCHECK must be followed by NONE or CMD, got %s", kind)
+	}
+	if rest == "" {
+		return inst.errorf("HEALTHCHECK CMD requires a command")
+	}
+
+	hc := HealthConfig{Test: []string{healthTestCmdShell, rest}}
+	var argv []string
+	if strings.HasPrefix(rest, "[") && json.Unmarshal([]byte(rest), &argv) == nil {
+		if len(argv) == 0 {
+			return inst.errorf("HEALTHCHECK CMD requires a command")
+		}
+		hc.Test = append([]string{healthTestCmd}, argv...)
+	}
+
+	for name, value := range flags {
+		if name == "retries" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return inst.errorf("invalid --retries %q: must be a positive number", value)
+			}
+			hc.Retries = n
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return inst.errorf("invalid --%s %q: must be a duration like 30s", name, value)
+		}
+		switch name {
+		case "interval":
+			hc.Interval = d
+		case "timeout":
+			hc.Timeout = d
+		default:
+			hc.StartPeriod = d
+		}
+	}
+
+	return setConfig(config, "Healthcheck", hc)
+}
+
+// expose adds ports, port/protocol or ranges of them, to those the image documents
+func (b *builder) expose(inst *instruction, config map[string]json.RawMessage) error {
+	ports := map[string]struct{}{}
+	if raw, ok := config["ExposedPorts"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &ports); err != nil {
+			return fmt.Errorf("failed to parse image config: %w", err)
+		}
+	}
+
+	words, err := shellWords(inst.args, b.lookupEnv)
+	if err != nil {
+		return inst.errorf("%v", err)
+	}
+	for _, word := range words {
+		spec, proto, _ := strings.Cut(strings.ToLower(word), "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		if proto != "tcp" && proto != "udp" && proto != "sctp" {
+			return inst.errorf("invalid protocol in EXPOSE %s: expected tcp, udp or sctp", word)
+		}
+
+		first, last, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			last = first
+		}
+		start, err := strconv.Atoi(first)
+		end, endErr := strconv.Atoi(last)
+		if err != nil || endErr != nil || start < 1 || end > 65535 || start > end {
+			return inst.errorf("invalid port in EXPOSE %s", word)
+		}
+		for port := start; port <= end; port++ {
+			ports[fmt.Sprintf("%d/%s", port, proto)] = struct{}{}
+		}
+	}
+
+	return setConfig(config, "ExposedPorts", ports)
+}
+
+// run runs a command in a container of the current image and stores what it changed
+func (b *builder) run(inst *instruction) error {
+	command, args := "/bin/sh", []string{"-c", inst.args}
+	if inst.isExec {
+		if len(inst.exec) == 0 {
+			return inst.errorf("RUN requires at least one argument")
+		}
+		command, args = inst.exec[0], inst.exec[1:]
+	}
+
+	return b.inContainer(inst, RunOptions{Command: command, Args: args, Env: b.runEnv()}, func(env *ContainerEnvironment) error {
+		code, err := env.Run()
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("the command '%s' returned a non-zero code: %d", strings.Join(append([]string{command}, args...), " "), code)
+		}
+		return nil
+	})
+}
+
+// inContainer creates a container of the current image with opts, lets step change it and
+// stores the changes as the layer of the step's image. The container is removed again.
+func (b *builder) inContainer(inst *instruction, opts RunOptions, step func(env *ContainerEnvironment) error) error {
+	env, err := b.createContainer(b.image, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, " ---> Running in %s\n", shortID(env.id))
+	defer func() {
+		if err := removeContainer(env.id, true); err != nil {
+			warnf(eventTypeContainer, "failed to remove intermediate container %s: %v", shortID(env.id), err)
+			return
+		}
+		fmt.Fprintf(b.out, "Removing intermediate container %s\n", shortID(env.id))
+	}()
+
+	if err := step(env); err != nil {
+		return err
+	}
+
+	lock, err := lockState(env.id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	state, err := loadContainerState(env.id)
+	if err != nil {
+		return err
+	}
+	base, layer, diffID, err := commitLayer(b.store, state, b.compression)
+	if err != nil {
+		return err
+	}
+	config, err := b.store.readBlob(base.Manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	return b.commit(inst, config, layer, diffID)
+}
+
+// createContainer creates a container of an image tagged by stepImage, with the same
+// defaults as run
+func (b *builder) createContainer(img *StoredImage, opts RunOptions) (*ContainerEnvironment, error) {
+	opts.Image = formatImageReference(buildRepository, img.Tag)
+	network, err := ParseNetworkMode("")
+	if err != nil {
+		return nil, err
+	}
+	ipc, err := ParseIPCMode("")
+	if err != nil {
+		return nil, err
+	}
+	opts.Network, opts.IPC, opts.Quiet = network, ipc, true
+
+	return NewContainerEnvironment(b.ctx, opts)
+}
+
+// copyStep returns the step of a COPY or ADD and the digest of what it copies for the cache
+// key. COPY --from copies from an earlier stage or an image, whose digest stands for its
+// files.
+func (b *builder) copyStep(inst *instruction) (func() error, string, error) {
+	known := []string{}
+	if inst.cmd == "COPY" {
+		known = append(known, "from")
+	}
+	flags, err := inst.flagValues(known...)
+	if err != nil {
+		return nil, "", err
+	}
+	srcs, dest, err := b.copyArgs(inst)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ref, ok := flags["from"]; ok {
+		img, err := b.fromImage(inst, ref)
+		if err != nil {
+			return nil, "", err
+		}
+		return func() error { return b.copyFrom(inst, img, srcs, dest) }, "from " + img.Digest, nil
+	}
+
+	sources, err := b.contextSources(inst, srcs, dest)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := sourcesDigest(sources, b.context.includes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return func() error { return b.copy(inst, sources, dest) }, content, nil
+}
+
+// copyArgs returns the sources of a COPY or ADD as written and its destination. Like with
+// Docker the last argument is the destination.
+func (b *builder) copyArgs(inst *instruction) ([]string, string, error) {
+	var words []string
+	var err error
+	if inst.isExec {
+		for _, arg := range inst.exec {
+			word, err := shellWord(arg, b.lookupEnv)
+			if err != nil {
+				return nil, "", inst.errorf("%v", err)
+			}
+			words = append(words, word)
+		}
+	} else if words, err = shellWords(inst.args, b.lookupEnv); err != nil {
+		return nil, "", inst.errorf("%v", err)
+	}
+	if len(words) < 2 {
+		return nil, "", inst.errorf("%s requires at least two arguments: the source and the destination", inst.cmd)
+	}
+
+	return words[:len(words)-1], b.containerPath(words[len(words)-1]), nil
+}
+
+// contextSources returns the sources of a COPY or ADD in the build context. ADD downloads
+// URLs right away, their contents decide whether the cache applies.
+func (b *builder) contextSources(inst *instruction, srcs []string, dest string) ([]buildSource, error) {
+	var sources []buildSource
+	for _, src := range srcs {
+		if inst.cmd == "ADD" && isRemoteSource(src) {
+			path, err := b.download(src)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, buildSource{path: path, url: src})
+			continue
+		}
+		paths, err := b.context.sources(src)
+		if err != nil {
+			return nil, inst.errorf("%v", err)
+		}
+		for _, p := range paths {
+			sources = append(sources, buildSource{path: p, extract: inst.cmd == "ADD" && isArchive(p)})
+		}
+	}
+
+	return sources, checkCopyDest(inst, sources, dest)
+}
+
+// checkCopyDest checks that the destination ends in / when there are several sources, like
+// Docker requires
+func checkCopyDest(inst *instruction, sources []buildSource, dest string) error {
+	if len(sources) > 1 && !strings.HasSuffix(dest, "/") {
+		return inst.errorf("when copying more than one source the destination must be a directory ending in /")
+	}
+
+	return nil
+}
+
+// copy copies the sources of a COPY or ADD into the image, the contents of directories
+// rather than themselves
+func (b *builder) copy(inst *instruction, sources []buildSource, dest string) error {
+	return b.inContainer(inst, RunOptions{NoCommand: true}, func(env *ContainerEnvironment) error {
+		root, _, release, err := openContainerPath(env.id, "/")
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		for _, src := range sources {
+			if err := b.copySource(root, src, dest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// buildSource is a source of COPY or ADD
+type buildSource struct {
+	// path is a file or directory in the context, which is extracted if it is an archive
+	// given to ADD, or the download of url
+	path    string
+	extract bool
+	url     string
+	// image is set for the files of an image copied by COPY --from, which .dockerignore
+	// doesn't apply to
+	image bool
+}
+
+// isRemoteSource reports whether an ADD source is a URL
+func isRemoteSource(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// copySource copies a source to dest in a container's root filesystem
+func (b *builder) copySource(root copyEndpoint, src buildSource, dest string) error {
+	opts := copyOptions{include: b.context.includes}
+	switch {
+	case src.url != "" || src.image:
+		opts.include = nil
+	case src.extract:
+		dir, err := b.extract(src.path)
+		if err != nil {
+			return err
+		}
+		// The owners are those in the archive
+		src.path, opts = dir, copyOptions{archive: true}
+	}
+
+	info, err := os.Lstat(src.path)
+	if err != nil {
+		return err
+	}
+	dst := root
+	dst.path = dest
+	if !info.IsDir() {
+		parent := path.Dir(dest)
+		if strings.HasSuffix(dest, "/") {
+			parent = dest
+		}
+		if err := makeContainerDirs(root, parent); err != nil {
+			return err
+		}
+		return copyFiles(copyEndpoint{path: src.path}, dst, opts)
+	}
+
+	// Copying the entries one by one leaves the destination directory's owner and mode alone
+	if err := makeContainerDirs(root, dest); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(src.path, entry.Name())
+		if opts.include != nil && !opts.include(p) {
+			continue
+		}
+		if err := copyFiles(copyEndpoint{path: p}, dst, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeContainerDirs creates a directory in a container's root filesystem along with the
+// parents it is missing, owned by root in the container
+func makeContainerDirs(root copyEndpoint, dir string) error {
+	uid := 0
+	if root.userns {
+		uid = userNamespaceHostID
+	}
+
+	current := "/"
+	for _, part := range strings.Split(path.Clean("/"+dir), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+
+		target, err := root.resolve(current)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(target, 0755); err == nil {
+			if err := os.Lchown(target, uid, uid); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create %s: %w", current, err)
+		}
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			return fmt.Errorf("failed to create %s: not a directory", current)
+		}
+	}
+
+	return nil
+}
+
+// tempDir returns a new directory for a download or archive of ADD
+func (b *builder) tempDir() (string, error) {
+	if b.tmp == "" {
+		dir, err := os.MkdirTemp("", "your-docker-build-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		b.tmp = dir
+	}
+
+	return os.MkdirTemp(b.tmp, "")
+}
+
+// download fetches the file of an ADD URL. Like with Docker it is named after the last
+// element of the URL's path, readable only by its owner and dated by Last-Modified.
+func (b *builder) download(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %s: %w", rawURL, err)
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("cannot determine a file name from %s", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+
+	dir, err := b.tempDir()
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, name)
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			return "", err
+		}
+	}
+
+	return file, nil
+}
+
+// isArchive reports whether a file is a tar archive, compressed or not, which ADD extracts
+func isArchive(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	r, err := decompressLayer(f)
+	if err != nil {
+		return false
+	}
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(string(header[257:]), "ustar")
+}
+
+// extract unpacks an ADD archive into a temporary directory with the host's tar, like image
+// layers are
+func (b *builder) extract(file string) (string, error) {
+	dir, err := b.tempDir()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := decompressLayer(f)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(b.ctx, "tar", "-C", dir, "-xf", "-")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to extract %s: %w", filepath.Base(file), err)
+	}
+	debugf(eventTypeImage, "extracted build archive", "file", file, "duration", time.Since(start).Round(time.Millisecond))
+
+	return dir, nil
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// predefinedBuildArgs can be given with --build-arg without an ARG declaring them, like with
+// Docker. They reach the environment of RUN but not the cache key, so that building behind
+// another proxy still hits the cache.
+var predefinedBuildArgs = map[string]bool{
+	"HTTP_PROXY":  true,
+	"http_proxy":  true,
+	"HTTPS_PROXY": true,
+	"https_proxy": true,
+	"FTP_PROXY":   true,
+	"ftp_proxy":   true,
+	"NO_PROXY":    true,
+	"no_proxy":    true,
+	"ALL_PROXY":   true,
+	"all_proxy":   true,
+}
+
+// parseBuildArgs parses --build-arg values: NAME=value, or NAME alone, which takes the value
+// from our environment and is left out if it isn't set there
+func parseBuildArgs(values []string) (map[string]string, error) {
+	args := map[string]string{}
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid build arg %q: expected NAME=value or NAME", v)
+		}
+		if !ok {
+			if value, ok = os.LookupEnv(name); !ok {
+				continue
+			}
+		}
+		args[name] = value
+	}
+
+	return args, nil
+}
+
+// arg runs an ARG, declaring one or more name[=default] in the current stage or, before the
+// first FROM, for the FROM lines. A --build-arg takes precedence over the default; without
+// either, an ARG in a stage takes the value of the global ARG of the same name, if any.
+func (b *builder) arg(inst *instruction) error {
+	words, err := shellWords(inst.args, b.lookupEnv)
+	if err != nil {
+		return inst.errorf("%v", err)
+	}
+
+	scope := b.args()
+	for _, word := range words {
+		name, def, hasDefault := strings.Cut(word, "=")
+		if name == "" {
+			return inst.errorf("invalid ARG %q: expected NAME or NAME=default", word)
+		}
+		b.consumedArgs[name] = true
+
+		value, ok := b.buildArgs[name]
+		if !ok && hasDefault {
+			value, ok = def, true
+		}
+		if !ok && len(b.stages) > 0 {
+			value, ok = b.globalArgs[name]
+		}
+		if ok {
+			scope[name] = value
+		} else {
+			delete(scope, name)
+		}
+	}
+
+	return nil
+}
+
+// args returns the args in scope with their values: those the current stage declared, or the
+// global ones before the first FROM
+func (b *builder) args() map[string]string {
+	if len(b.stages) == 0 {
+		return b.globalArgs
+	}
+
+	return b.stages[len(b.stages)-1].args
+}
+
+// lookupGlobalArg looks up an arg declared before the first FROM, the only ones FROM can use
+func (b *builder) lookupGlobalArg(name string) (string, bool) {
+	value, ok := b.globalArgs[name]
+	return value, ok
+}
+
+// runEnv returns the args RUN gets as environment variables. Like with Docker, ENV takes
+// precedence over ARG, and the args aren't kept in the image.
+func (b *builder) runEnv() []string {
+	values := map[string]string{}
+	for name, value := range b.buildArgs {
+		if predefinedBuildArgs[name] {
+			values[name] = value
+		}
+	}
+	for name, value := range b.args() {
+		values[name] = value
+	}
+
+	var env []string
+	for _, name := range sortedArgNames(values) {
+		if _, ok := b.lookupImageEnv(name); !ok {
+			env = append(env, name+"="+values[name])
+		}
+	}
+
+	return env
+}
+
+// argsCacheKey returns the args of the current stage for the cache key of its steps, so that
+// a step runs again when one of them changed
+func (b *builder) argsCacheKey() string {
+	var key strings.Builder
+	args := b.args()
+	for _, name := range sortedArgNames(args) {
+		fmt.Fprintf(&key, "%s=%s\n", name, args[name])
+	}
+
+	return key.String()
+}
+
+// unconsumedArgs returns the build args no ARG declared, except for the predefined ones
+func (b *builder) unconsumedArgs() []string {
+	var names []string
+	for name := range b.buildArgs {
+		if !b.consumedArgs[name] && !predefinedBuildArgs[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// sortedArgNames returns the names of args in order
+func sortedArgNames(args map[string]string) []string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
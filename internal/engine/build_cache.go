@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildCacheDir is the directory of the store that maps build steps to the images they
+// produced, one file per step named by its cache key and holding the image's manifest digest
+const buildCacheDir = "build-cache"
+
+// buildCacheKey identifies a build step by the image it runs on, the instruction as written,
+// the args in scope and, for COPY and ADD, the digest of the files it copies. The image's
+// config covers everything earlier steps set, like ENV and WORKDIR.
+func buildCacheKey(parentID, instruction, args, content string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s", parentID, instruction, args, content)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedBuildStep returns the manifest digest of the image a step with key produced, if it
+// is still complete in the store: system prune removes the blobs of step images, which
+// aren't tagged once their build is done
+func (s *ImageStore) cachedBuildStep(key string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(s.root, buildCacheDir, key))
+	if err != nil {
+		return "", false
+	}
+	digest := strings.TrimSpace(string(data))
+
+	img, err := s.imageByDigest(digest)
+	if err != nil || !s.hasBlob(img.Manifest.Config.Digest) {
+		return "", false
+	}
+	for _, layer := range img.Manifest.Layers {
+		if !s.hasBlob(layer.Digest) {
+			return "", false
+		}
+	}
+
+	return digest, true
+}
+
+// cacheBuildStep records the image a step with key produced. The entry is renamed into
+// place, so concurrent builds of the same step don't see half of it.
+func (s *ImageStore) cacheBuildStep(key, digest string) error {
+	dir := filepath.Join(s.root, buildCacheDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create build cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to write build cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(digest + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write build cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write build cache: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, key)); err != nil {
+		return fmt.Errorf("failed to write build cache: %w", err)
+	}
+
+	return nil
+}
+
+// pruneBuildCache removes the entries whose images system prune has removed blobs of. The
+// caller holds the store lock exclusively.
+func (s *ImageStore) pruneBuildCache() error {
+	entries, err := os.ReadDir(filepath.Join(s.root, buildCacheDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read build cache: %w", err)
+	}
+
+	for _, entry := range entries {
+		if _, ok := s.cachedBuildStep(entry.Name()); ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.root, buildCacheDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to prune build cache: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sourcesDigest hashes what COPY or ADD copies from each source: the names, types, modes,
+// symlink targets and contents of the files below it that are copied. Times and owners are
+// left out, like Docker does, so a fresh checkout of the same files still hits the cache.
+func sourcesDigest(sources []buildSource, include func(path string) bool) (string, error) {
+	h := sha256.New()
+	for _, src := range sources {
+		fmt.Fprintf(h, "source %s\n", filepath.Base(src.path))
+
+		err := filepath.WalkDir(src.path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if src.url == "" && path != src.path && !include(path) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(src.path, path)
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(h, "%s %v %d\n", rel, info.Mode(), info.Size())
+			switch {
+			case info.Mode()&fs.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "-> %s\n", link)
+			case info.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to checksum %s: %w", filepath.Base(src.path), err)
+		}
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dockerignoreName is the file in a build context listing what is left out of it
+const dockerignoreName = ".dockerignore"
+
+// buildContext is the directory COPY and ADD take their sources from, without what its
+// .dockerignore excludes
+type buildContext struct {
+	dir string
+	// included are the paths relative to dir that can be copied, along with the directories
+	// leading to them. A directory is walked when something below it is included, even if the
+	// directory itself is excluded; only the included entries are copied from it.
+	included map[string]bool
+}
+
+// loadBuildContext reads the .dockerignore of a build context and works out which files are
+// left in it
+func loadBuildContext(dir string) (*buildContext, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build context: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("build context %s is not a directory", dir)
+	}
+
+	patterns, err := readDockerignore(filepath.Join(dir, dockerignoreName))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &buildContext{dir: dir, included: map[string]bool{".": true}}
+	exceptions := false
+	for _, p := range patterns {
+		exceptions = exceptions || p.exception
+	}
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if ignoredPath(patterns, filepath.ToSlash(rel)) {
+			// Without exceptions nothing below an excluded directory can be included again
+			if entry.IsDir() && !exceptions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		for p := rel; p != "."; p = filepath.Dir(p) {
+			c.included[p] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build context: %w", err)
+	}
+
+	return c, nil
+}
+
+// includes reports whether a host path in the context is left in it by .dockerignore
+func (c *buildContext) includes(path string) bool {
+	rel, err := filepath.Rel(c.dir, path)
+	return err == nil && c.included[rel]
+}
+
+// sources returns the host paths a COPY or ADD source in the context names. Like with Docker
+// it is relative to the context even if it starts with /, can't lead out of it and may have
+// wildcards.
+func (c *buildContext) sources(src string) ([]string, error) {
+	rel := strings.TrimPrefix(filepath.Clean("/"+src), "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	if !strings.ContainsAny(rel, "*?[") {
+		if _, err := os.Lstat(filepath.Join(c.dir, rel)); err != nil || !c.included[rel] {
+			return nil, fmt.Errorf("%s: not found in the build context or excluded by %s", src, dockerignoreName)
+		}
+		return []string{filepath.Join(c.dir, rel)}, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(c.dir, rel))
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s: %w", src, err)
+	}
+	var paths []string
+	for _, match := range matches {
+		if c.includes(match) {
+			paths = append(paths, match)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no files in the build context match", src)
+	}
+
+	return paths, nil
+}
+
+// ignorePattern is a line of a .dockerignore
+type ignorePattern struct {
+	re *regexp.Regexp
+	// exception is set for patterns starting with !, which include what earlier ones excluded
+	exception bool
+}
+
+// readDockerignore parses a .dockerignore, which needn't exist. Each line is a pattern in
+// filepath.Match syntax relative to the context, where ** also matches any number of
+// directories; # starts a comment line and ! makes the pattern an exception.
+func readDockerignore(path string) ([]ignorePattern, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dockerignoreName, err)
+	}
+	defer f.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if rest, ok := strings.CutPrefix(line, "!"); ok {
+			p.exception, line = true, strings.TrimSpace(rest)
+		}
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+line)), "/")
+		if line == "" {
+			// / and . are the whole context
+			line = "**"
+		}
+
+		if p.re, err = ignoreRegexp(line); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", dockerignoreName, line, err)
+		}
+		patterns = append(patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dockerignoreName, err)
+	}
+
+	return patterns, nil
+}
+
+// ignoreRegexp translates a .dockerignore pattern into a regular expression matching the
+// whole path
+func ignoreRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				i++
+				if strings.HasPrefix(pattern[i+1:], "/") {
+					// **/ matches no directory too
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+				continue
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, filepath.ErrBadPattern
+			}
+			// Character classes, negated with ^, mean the same in both
+			re.WriteString("[" + pattern[i+1:i+1+end] + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+// ignoredPath reports whether the last pattern matching path, or a directory above it, is an
+// exclusion rather than an exception
+func ignoredPath(patterns []ignorePattern, path string) bool {
+	ignored := false
+	for _, p := range patterns {
+		if p.matches(path) {
+			ignored = !p.exception
+		}
+	}
+
+	return ignored
+}
+
+// matches reports whether the pattern matches path or one of its parent directories, which
+// excludes or includes everything below it
+func (p ignorePattern) matches(path string) bool {
+	for {
+		if p.re.MatchString(path) {
+			return true
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			return false
+		}
+		path = path[:i]
+	}
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// stageNamePattern is what Docker allows as the name of a stage
+var stageNamePattern = regexp.MustCompile(`^[a-z][a-z0-9._-]*$`)
+
+// buildStage is a stage of a multi-stage build, started by a FROM
+type buildStage struct {
+	// name is given by FROM <image> AS <name>, in lower case like Docker compares it
+	name string
+	// image is that of the stage's steps so far
+	image *StoredImage
+	// args are the args the stage declared with ARG that have a value
+	args map[string]string
+}
+
+// stageName validates the name of a new stage
+func (b *builder) stageName(name string) (string, error) {
+	name = strings.ToLower(name)
+	if !stageNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid stage name %q: it must start with a letter and hold only letters, digits, '.', '_' and '-'", name)
+	}
+	if _, ok := b.namedStage(name); ok {
+		return "", fmt.Errorf("duplicate stage name %q", name)
+	}
+
+	return name, nil
+}
+
+// namedStage returns the image of the stage with the name, ignoring case
+func (b *builder) namedStage(name string) (*StoredImage, bool) {
+	name = strings.ToLower(name)
+	for _, stage := range b.stages {
+		if stage.name != "" && stage.name == name {
+			return stage.image, true
+		}
+	}
+
+	return nil, false
+}
+
+// fromImage returns the image COPY --from copies from: an earlier stage by name or index,
+// or else an image, which is pulled if it isn't stored yet
+func (b *builder) fromImage(inst *instruction, ref string) (*StoredImage, error) {
+	current := len(b.stages) - 1
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 0 || n >= current {
+			return nil, inst.errorf("invalid stage index %d for --from: only earlier stages can be copied from", n)
+		}
+		return b.stages[n].image, nil
+	}
+	if b.stages[current].name != "" && b.stages[current].name == strings.ToLower(ref) {
+		return nil, inst.errorf("stage %s can't copy from itself", ref)
+	}
+	if img, ok := b.namedStage(ref); ok {
+		return img, nil
+	}
+
+	img, err := b.baseImage(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %s for --from: %w", ref, err)
+	}
+	// Tagged like the base image, the copy's container can still be created if it is retagged
+	return b.stepImage(img.Digest)
+}
+
+// copyFrom copies files of an image into the current one for COPY --from. They are read from
+// a container of the image, which is removed again.
+func (b *builder) copyFrom(inst *instruction, img *StoredImage, srcs []string, dest string) error {
+	env, err := b.createContainer(img, RunOptions{NoCommand: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := removeContainer(env.id, true); err != nil {
+			warnf(eventTypeContainer, "failed to remove container %s of --from image: %v", shortID(env.id), err)
+		}
+	}()
+
+	root, _, release, err := openContainerPath(env.id, "/")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	sources, err := imageSources(root, srcs)
+	if err != nil {
+		return inst.errorf("%v", err)
+	}
+	if err := checkCopyDest(inst, sources, dest); err != nil {
+		return err
+	}
+
+	return b.copy(inst, sources, dest)
+}
+
+// imageSources returns the host paths of COPY --from sources in an image's root filesystem.
+// Symlinks are followed within it, and the last element of a source may have wildcards.
+func imageSources(root copyEndpoint, srcs []string) ([]buildSource, error) {
+	var sources []buildSource
+	for _, src := range srcs {
+		clean := path.Clean("/" + src)
+		dir, pattern := path.Split(clean)
+		if strings.ContainsAny(dir, "*?[") {
+			return nil, fmt.Errorf("%s: wildcards are only supported in the last element of --from sources", src)
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			p, err := root.resolve(clean)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Lstat(p); err != nil {
+				return nil, fmt.Errorf("%s: not found in the --from image", src)
+			}
+			sources = append(sources, buildSource{path: p, image: true})
+			continue
+		}
+
+		parent, err := root.resolve(dir)
+		if err != nil {
+			return nil, err
+		}
+		matches, err := filepath.Glob(filepath.Join(parent, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %s: %w", src, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no files in the --from image match", src)
+		}
+		for _, match := range matches {
+			sources = append(sources, buildSource{path: match, image: true})
+		}
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readImageList reads the images of a bundle from a file with one reference per line. Blank
+// lines and everything after a # are ignored, and an image listed twice is bundled once.
+func readImageList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image list: %w", err)
+	}
+	defer f.Close()
+
+	var refs []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		ref, _, _ := strings.Cut(scanner.Text(), "#")
+		if ref = strings.TrimSpace(ref); ref == "" {
+			continue
+		}
+
+		// Loading keeps images by tag, those without one wouldn't be installed
+		if isTarballURL(ref) {
+			return nil, fmt.Errorf("%s:%d: %s: tarball URLs can't be bundled, pull it and tag it instead", path, line, ref)
+		}
+		name, tag, err := parseImageReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if pinnedDigest(tag) != "" {
+			return nil, fmt.Errorf("%s:%d: %s is pinned by digest, bundles keep images by tag", path, line, ref)
+		}
+
+		if key := formatImageReference(name, tag); !seen[key] {
+			seen[key] = true
+			refs = append(refs, ref)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read image list: %w", err)
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("%s lists no images", path)
+	}
+
+	return refs, nil
+}
+
+// bundleImages returns the stored images of refs for the platform asked for, pulling those
+// that aren't in the store yet
+func bundleImages(ctx context.Context, store *ImageStore, refs []string, want *Platform) ([]*StoredImage, error) {
+	images := make([]*StoredImage, 0, len(refs))
+	for _, ref := range refs {
+		img, _, err := storedImage(store, ref, want)
+		if errors.Is(err, errImageNotFound) {
+			dl, derr := NewDockerImageDownloader(ref, nil)
+			if derr != nil {
+				return nil, fmt.Errorf("failed to create image downloader: %w", derr)
+			}
+			dl.platform = want
+
+			if err := dl.Pull(ctx, store); err != nil {
+				if ctx.Err() != nil {
+					return nil, context.Cause(ctx)
+				}
+				return nil, fmt.Errorf("failed to pull %s: %w", ref, err)
+			}
+			img, _, err = storedImage(store, ref, want)
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+
+	return images, nil
+}
+
+// writeBundle writes images to path as a tarball of an OCI image layout, which load and
+// bundle install read, gzipped if path ends in .gz or .tgz. The bundle is written under a
+// temporary name first, so an interrupted one never passes for complete.
+func (s *ImageStore) writeBundle(path string, images []*StoredImage) error {
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	w := io.Writer(out)
+	var zw *gzip.Writer
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+	if err := s.writeOCIArchive(w, images); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+
+	if err := out.Chmod(0644); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	return nil
+}
+
+// writeOCIArchive writes images to w as a tarball of the OCI image layout SaveOCILayout
+// writes to a directory, with each blob once however many images share it
+func (s *ImageStore) writeOCIArchive(w io.Writer, images []*StoredImage) error {
+	lock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: time.Unix(0, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{}}
+	written := map[string]bool{}
+	for _, img := range images {
+		descriptor, err := s.ociDescriptor(img)
+		if err != nil {
+			return fmt.Errorf("failed to bundle %s: %w", img.Reference(), err)
+		}
+
+		for _, digest := range imageBlobs(img) {
+			if written[digest] {
+				continue
+			}
+			if err := s.writeBlobEntry(tw, digest); err != nil {
+				return fmt.Errorf("failed to bundle %s: %w", img.Reference(), err)
+			}
+			written[digest] = true
+		}
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+
+	// The index goes last, like SaveOCILayout writes it
+	layout, err := json.Marshal(ociLayout{ImageLayoutVersion: ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", ociIndexFile, err)
+	}
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{ociLayoutFile, layout}, {ociIndexFile, data}} {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: 0644, Size: int64(len(file.data)), ModTime: time.Unix(0, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return fmt.Errorf("failed to write bundle: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	return nil
+}
+
+// writeBlobEntry adds a stored blob to an archive as blobs/sha256/<hash>
+func (s *ImageStore) writeBlobEntry(tw *tar.Writer, digest string) error {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", shortDigest(digest), err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", shortDigest(digest), err)
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:"),
+		Mode:     0644,
+		Size:     info.Size(),
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	// Like loading, only layers are worth a progress bar
+	r := io.Reader(f)
+	if info.Size() >= 1<<20 {
+		r = newProgressReader(f, layerEntry{Digest: digest, Size: info.Size()}, "Bundling")
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to bundle blob %s: %w", shortDigest(digest), err)
+	}
+
+	return nil
+}
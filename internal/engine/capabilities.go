@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of prctl(2) and capset(2) that the syscall package doesn't have everywhere
+const (
+	prCapBSetDrop           = 24
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// capabilityNames are the capabilities of capabilities(7) by number
+var capabilityNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER", "CAP_FSETID",
+	"CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST", "CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK",
+	"CAP_IPC_OWNER", "CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE", "CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD", "CAP_LEASE", "CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL", "CAP_SETFCAP", "CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG",
+	"CAP_WAKE_ALARM", "CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// allCapabilities is what --cap-add ALL grants
+var allCapabilities = capabilitySet(1)<<len(capabilityNames) - 1
+
+// capabilitySet is a set of capabilities as a bit mask by number, like the kernel keeps them
+type capabilitySet uint64
+
+// defaultCapabilities returns dockerDefaultCapabilities as a set
+func defaultCapabilities() capabilitySet {
+	var set capabilitySet
+	for _, name := range dockerDefaultCapabilities {
+		n, _ := parseCapability(name)
+		set |= 1 << n
+	}
+
+	return set
+}
+
+// parseCapability returns the number of a capability given by name, with or without the
+// CAP_ prefix and in any case, like Docker's --cap-add
+func parseCapability(name string) (int, error) {
+	normalized := strings.ToUpper(name)
+	if !strings.HasPrefix(normalized, "CAP_") {
+		normalized = "CAP_" + normalized
+	}
+	for n, c := range capabilityNames {
+		if c == normalized {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid capability %q: expected a name like NET_ADMIN or CAP_NET_ADMIN, or ALL", name)
+}
+
+// has reports whether the set has the capability with the given name
+func (s capabilitySet) has(name string) bool {
+	n, err := parseCapability(name)
+	return err == nil && s&(1<<n) != 0
+}
+
+// apply drops and then adds capabilities, so that dropping ALL and adding one leaves only
+// that one
+func (s capabilitySet) apply(add, drop []string) (capabilitySet, error) {
+	for _, name := range drop {
+		if strings.EqualFold(name, "ALL") {
+			s = 0
+			continue
+		}
+		n, err := parseCapability(name)
+		if err != nil {
+			return 0, err
+		}
+		s &^= 1 << n
+	}
+
+	for _, name := range add {
+		if strings.EqualFold(name, "ALL") {
+			s = allCapabilities
+			continue
+		}
+		n, err := parseCapability(name)
+		if err != nil {
+			return 0, err
+		}
+		s |= 1 << n
+	}
+
+	return s, nil
+}
+
+// names returns the capabilities of the set sorted by name
+func (s capabilitySet) names() []string {
+	names := make([]string, 0, bits.OnesCount64(uint64(s)))
+	for n, name := range capabilityNames {
+		if s&(1<<n) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// containerCapabilities returns the capabilities a container's processes keep: Docker's
+// default set, changed by what the security policy decided for its image and then by
+// --cap-add and --cap-drop
+func containerCapabilities(opts RunOptions) (capabilitySet, error) {
+	set := defaultCapabilities()
+	if opts.Policy != nil {
+		var err error
+		if set, err = capabilitySet(0).apply(opts.Policy.Capabilities, nil); err != nil {
+			return 0, fmt.Errorf("invalid security policy: %w", err)
+		}
+	}
+
+	return set.apply(opts.CapAdd, opts.CapDrop)
+}
+
+// capUserHeader and capUserData are the arguments of capset(2), version 3
+type capUserHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capUserData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// restrictCapabilities limits the calling thread, which goes on to exec the command, to the
+// capabilities of keep. The others are dropped from the bounding set, so that no setuid
+// binary gets them back, and from the ambient, effective and permitted sets. Like Docker
+// nowadays, none are inheritable.
+func restrictCapabilities(keep capabilitySet) error {
+	header := capUserHeader{version: linuxCapabilityVersion3}
+	var data [2]capUserData
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to get capabilities: %w", errno)
+	}
+	// What we don't have ourselves, e.g. capabilities newer than the kernel, can't be kept
+	permitted := capabilitySet(data[0].permitted) | capabilitySet(data[1].permitted)<<32
+	keep &= permitted
+
+	// Numbers past the kernel's last capability fail with EINVAL, nothing is left to drop
+	for n := 0; n < 64; n++ {
+		if keep&(1<<n) != 0 {
+			continue
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(n), 0); errno != 0 {
+			if errno == syscall.EINVAL {
+				break
+			}
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", n, errno)
+		}
+	}
+
+	// Kernels before 4.3 have no ambient set, so there is nothing to clear either
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", errno)
+	}
+
+	for i := range data {
+		mask := uint32(keep >> (32 * i))
+		data[i] = capUserData{effective: mask, permitted: mask}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %w", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupRoot        = "/sys/fs/cgroup"
+	cgroupParentName  = "your-docker"
+	cgroup2SuperMagic = 0x63677270
+	cpuPeriodMicros   = 100000
+	// accessWriteOK is W_OK for access(2), which the syscall package doesn't define
+	accessWriteOK = 0x2
+)
+
+// cpuBurstMinKernel is the first kernel release with cpu.max.burst
+const cpuBurstMinKernel = "5.14"
+
+// ResourceLimits are the cgroup limits applied to a container
+type ResourceLimits struct {
+	Memory    int64   `json:"memory,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	PidsLimit int64   `json:"pidsLimit,omitempty"`
+	// CPUBurst lets a CPU-limited container save up unused quota and spend it in one period
+	CPUBurst time.Duration `json:"cpuBurst,omitempty"`
+}
+
+// IsZero reports whether no limit is set
+func (l ResourceLimits) IsZero() bool {
+	return l.Memory == 0 && l.CPUs == 0 && l.PidsLimit == 0 && l.CPUBurst == 0
+}
+
+// validate checks limits that depend on each other or on the running kernel
+func (l ResourceLimits) validate() error {
+	if l.CPUBurst == 0 {
+		return nil
+	}
+
+	if l.CPUs == 0 {
+		return errors.New("--cpu-burst requires --cpus")
+	}
+
+	// The kernel rejects a burst larger than the quota of a single period
+	quota := time.Duration(l.CPUs*cpuPeriodMicros) * time.Microsecond
+	if l.CPUBurst > quota {
+		return fmt.Errorf("--cpu-burst %s exceeds the CPU quota of %s per %s period", l.CPUBurst, quota, cpuPeriodMicros*time.Microsecond)
+	}
+
+	kernel, err := kernelVersion()
+	if err != nil {
+		return err
+	}
+	if !kernelAtLeast(kernel, cpuBurstMinKernel) {
+		return fmt.Errorf("--cpu-burst requires Linux %s or newer, running %d.%d", cpuBurstMinKernel, kernel[0], kernel[1])
+	}
+
+	return nil
+}
+
+// ParseByteSize parses sizes like 512m, 1g or 1048576 into bytes
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "b")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			value = value[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a positive number with an optional k, m, g or t suffix", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// ParseCPUs parses a fractional number of CPUs such as 0.5 or 2
+func ParseCPUs(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid number of CPUs %q: expected a positive number", s)
+	}
+
+	return n, nil
+}
+
+// ParseCPUBurst parses a burst duration such as 20ms
+func ParseCPUBurst(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid CPU burst %q: expected a positive duration such as 20ms", s)
+	}
+
+	return d, nil
+}
+
+// containerCgroup is the cgroup v2 directory holding a container's processes
+type containerCgroup struct {
+	path string
+}
+
+// newContainerCgroup creates a cgroup for the container and writes its limits. It is created
+// below parent if one is given, otherwise below our own cgroup.
+func newContainerCgroup(name, parent string, limits ResourceLimits) (*containerCgroup, error) {
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &fs); err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", cgroupRoot, err)
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return nil, errors.New("resource limits require cgroup v2 mounted at " + cgroupRoot)
+	}
+
+	if parent == "" {
+		parent = filepath.Join(cgroupRoot, cgroupParentName)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cgroup %s: %w", parent, err)
+		}
+
+		// Controllers have to be enabled on every level above the container's cgroup
+		for _, dir := range []string{cgroupRoot, parent} {
+			if err := enableControllers(dir, "cpu", "memory", "pids"); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// The levels above belong to whoever manages the parent, only the parent itself is ours
+		// to change
+		if err := checkCgroupDelegation(parent, limits.controllers()); err != nil {
+			return nil, err
+		}
+		if err := enableControllers(parent, limits.controllers()...); err != nil {
+			return nil, err
+		}
+	}
+
+	cg := &containerCgroup{path: filepath.Join(parent, name)}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup %s: %w", cg.path, err)
+	}
+
+	if err := cg.apply(limits); err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// merge returns the limits with those set in changes replaced
+func (l ResourceLimits) merge(changes ResourceLimits) ResourceLimits {
+	if changes.Memory > 0 {
+		l.Memory = changes.Memory
+	}
+	if changes.CPUs > 0 {
+		l.CPUs = changes.CPUs
+	}
+	if changes.PidsLimit > 0 {
+		l.PidsLimit = changes.PidsLimit
+	}
+	if changes.CPUBurst > 0 {
+		l.CPUBurst = changes.CPUBurst
+	}
+
+	return l
+}
+
+// controllers returns the cgroup controllers enforcing the limits
+func (l ResourceLimits) controllers() []string {
+	var controllers []string
+	if l.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.Memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.PidsLimit > 0 {
+		controllers = append(controllers, "pids")
+	}
+
+	return controllers
+}
+
+// ParseCgroupParent resolves a --cgroup-parent to its directory. A systemd slice like
+// user-1000.slice is found where systemd nests it, user.slice/user-1000.slice; anything else is
+// a path below the cgroup root.
+func ParseCgroupParent(s string) (string, error) {
+	name := strings.Trim(s, "/")
+	if name == "" {
+		return "", fmt.Errorf("invalid cgroup parent %q: expected a path or a systemd slice", s)
+	}
+
+	if !strings.Contains(name, "/") && strings.HasSuffix(name, ".slice") && name != "-.slice" {
+		unit := strings.TrimSuffix(name, ".slice")
+		if strings.HasPrefix(unit, "-") || strings.HasSuffix(unit, "-") || strings.Contains(unit, "--") {
+			return "", fmt.Errorf("invalid cgroup parent %q: malformed slice name", s)
+		}
+
+		var dirs []string
+		parts := strings.Split(unit, "-")
+		for i := range parts {
+			dirs = append(dirs, strings.Join(parts[:i+1], "-")+".slice")
+		}
+		name = filepath.Join(dirs...)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == "." {
+			return "", fmt.Errorf("invalid cgroup parent %q: must not contain %q", s, part)
+		}
+	}
+
+	return filepath.Join(cgroupRoot, name), nil
+}
+
+// checkCgroupDelegation makes sure we can create cgroups below a parent we didn't create and
+// enable the given controllers for them: the parent has to exist, be writable, have the
+// controllers delegated to it, and hold no processes of its own if controllers need enabling.
+func checkCgroupDelegation(parent string, controllers []string) error {
+	info, err := os.Stat(parent)
+	if err != nil {
+		return fmt.Errorf("invalid cgroup parent: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid cgroup parent: %s is not a cgroup", parent)
+	}
+
+	if err := syscall.Access(parent, accessWriteOK); err != nil {
+		return fmt.Errorf("cgroup parent %s is not delegated to us: %w", parent, err)
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	if err := syscall.Access(filepath.Join(parent, "cgroup.subtree_control"), accessWriteOK); err != nil {
+		return fmt.Errorf("cgroup parent %s does not delegate its controllers: %w", parent, err)
+	}
+
+	available, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of %s: %w", parent, err)
+	}
+	enabled, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("failed to read subtree controllers of %s: %w", parent, err)
+	}
+
+	needed := false
+	for _, c := range controllers {
+		if !containsString(strings.Fields(string(available)), c) {
+			return fmt.Errorf("cgroup controller %q is not delegated to %s, enable it in the cgroup above", c, parent)
+		}
+		if !containsString(strings.Fields(string(enabled)), c) {
+			needed = true
+		}
+	}
+
+	// Controllers can only be enabled for the children of a cgroup without processes
+	if needed {
+		procs, err := os.ReadFile(filepath.Join(parent, "cgroup.procs"))
+		if err != nil {
+			return fmt.Errorf("failed to read processes of %s: %w", parent, err)
+		}
+		if len(strings.TrimSpace(string(procs))) > 0 {
+			return fmt.Errorf("cgroup parent %s has processes of its own, so the controllers for the limits can't be enabled in it", parent)
+		}
+	}
+
+	return nil
+}
+
+// enableControllers turns on the given controllers for the children of dir
+func enableControllers(dir string, controllers ...string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of %s: %w", dir, err)
+	}
+
+	enabled, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("failed to read subtree controllers of %s: %w", dir, err)
+	}
+
+	var changes []string
+	for _, c := range controllers {
+		if !containsString(strings.Fields(string(available)), c) {
+			return fmt.Errorf("cgroup controller %q is not available in %s", c, dir)
+		}
+		if !containsString(strings.Fields(string(enabled)), c) {
+			changes = append(changes, "+"+c)
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(changes, " "))
+}
+
+// apply writes the limits into the cgroup's interface files
+func (cg *containerCgroup) apply(limits ResourceLimits) error {
+	if limits.Memory > 0 {
+		if err := writeCgroupFile(cg.path, "memory.max", strconv.FormatInt(limits.Memory, 10)); err != nil {
+			return err
+		}
+	}
+
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriodMicros)
+		if err := writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriodMicros)); err != nil {
+			return err
+		}
+	}
+
+	if limits.CPUBurst > 0 {
+		if err := writeCgroupFile(cg.path, "cpu.max.burst", strconv.FormatInt(limits.CPUBurst.Microseconds(), 10)); err != nil {
+			return err
+		}
+	}
+
+	if limits.PidsLimit > 0 {
+		if err := writeCgroupFile(cg.path, "pids.max", strconv.FormatInt(limits.PidsLimit, 10)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update rewrites the limits of a cgroup whose container is running. Controllers that the
+// container didn't need until now are enabled in the parent first, which a --cgroup-parent
+// has to allow.
+func (cg *containerCgroup) update(limits ResourceLimits) error {
+	parent := filepath.Dir(cg.path)
+	if parent != filepath.Join(cgroupRoot, cgroupParentName) {
+		if err := checkCgroupDelegation(parent, limits.controllers()); err != nil {
+			return err
+		}
+	}
+	if err := enableControllers(parent, limits.controllers()...); err != nil {
+		return err
+	}
+
+	// The kernel refuses a quota smaller than the burst, which apply writes again afterwards
+	burst := filepath.Join(cg.path, "cpu.max.burst")
+	if _, err := os.Stat(burst); err == nil && limits.CPUs > 0 {
+		if err := writeCgroupFile(cg.path, "cpu.max.burst", "0"); err != nil {
+			return err
+		}
+	}
+
+	return cg.apply(limits)
+}
+
+// addProcess moves a process into the cgroup
+func (cg *containerCgroup) addProcess(pid int) error {
+	return writeCgroupFile(cg.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// readCgroupOOMKills returns how many processes of a cgroup the kernel killed for running out
+// of memory, which is 0 when the memory controller isn't enabled for it
+func readCgroupOOMKills(dir string) int64 {
+	data, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			return n
+		}
+	}
+
+	return 0
+}
+
+// remove deletes the cgroup once its processes have exited
+func (cg *containerCgroup) remove() error {
+	var err error
+	// The kernel may take a moment to notice exited processes
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return fmt.Errorf("failed to remove cgroup %s: %w", cg.path, err)
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", value, filepath.Join(dir, file), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// cleanupSignals are the signals that end a process that is setting up a container, which
+// would otherwise take it down without undoing anything
+var cleanupSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// interruptedError is the cause of a setup cancelled by one of cleanupSignals
+type interruptedError struct {
+	signal syscall.Signal
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("interrupted by %v", e.signal)
+}
+
+func (e *interruptedError) Unwrap() error {
+	return context.Canceled
+}
+
+// exitCode is what a shell reports for a process the signal ended
+func (e *interruptedError) exitCode() int {
+	return 128 + int(e.signal)
+}
+
+// interruptContext returns a context that one of cleanupSignals cancels with an
+// interruptedError, for commands that have nothing to undo
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, cleanupSignals...)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(&interruptedError{signal: sig.(syscall.Signal)})
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// cleanupStack holds the undo functions of what a container acquired on the host while it is
+// set up. They run most recent first when the setup fails, panics or is interrupted, and are
+// forgotten once the container's state takes over the resources.
+type cleanupStack struct {
+	mu    sync.Mutex
+	undos []func()
+	// unwound is set once the stack has run, so whatever is acquired after an interruption
+	// is undone right away
+	unwound bool
+}
+
+// push registers the undo function of a resource that has just been acquired
+func (s *cleanupStack) push(undo func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unwound {
+		undo()
+		return
+	}
+	s.undos = append(s.undos, undo)
+}
+
+// run undoes everything pushed so far, most recent first
+func (s *cleanupStack) run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.undos) > 0 {
+		undo := s.undos[len(s.undos)-1]
+		s.undos = s.undos[:len(s.undos)-1]
+		undo()
+	}
+	s.unwound = true
+}
+
+// forget drops the undo functions, the resources now outlive the setup
+func (s *cleanupStack) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.undos = nil
+}
+
+// onPanic is deferred by the setup steps: a panic undoes everything before it carries on
+func (s *cleanupStack) onPanic() {
+	if r := recover(); r != nil {
+		s.run()
+		panic(r)
+	}
+}
+
+// onSignal undoes everything if one of cleanupSignals arrives before the returned function
+// is called, then lets the signal end the process as it would have. With cancel, the first
+// signal only cancels the setup, which undoes itself as it fails; a second one is needed for
+// setup steps that don't stop. Calling the returned function again does nothing. In the
+// daemon, which owns the signals, nothing is done: its shutdown cancels the setup instead.
+func (s *cleanupStack) onSignal(cancel context.CancelCauseFunc) func() {
+	if ownsSignals {
+		return func() {}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, cleanupSignals...)
+
+	done := make(chan struct{})
+	go func() {
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-done:
+			return
+		}
+
+		if cancel != nil {
+			warnf(eventTypeContainer, "interrupted by %v, cancelling the container's setup", sig)
+			cancel(&interruptedError{signal: sig.(syscall.Signal)})
+			select {
+			case sig = <-signals:
+			case <-done:
+				return
+			}
+		}
+
+		warnf(eventTypeContainer, "interrupted by %v, undoing the container's setup", sig)
+		s.run()
+		signal.Reset(sig)
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+		// The signal may have been ignored when we were started, still don't carry on
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+
+	return sync.OnceFunc(func() {
+		signal.Stop(signals)
+		close(done)
+	})
+}
@@ -0,0 +1,631 @@
+package engine
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// stringList is a flag.Value that collects every occurrence of a repeatable flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Init runs what the program was re-executed as: the init, shim or core collector of a
+// container, which don't return. Otherwise it sets up logging and the events log and returns.
+// Every program using the runtime must call it first thing in main.
+func Init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) > 1 && os.Args[1] == containerInitArg {
+		runContainerInit()
+		os.Exit(0)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == execInitArg {
+		runExecInit()
+		os.Exit(0)
+	}
+
+	// Before the events log takes the lowest free descriptor
+	recordInheritedFds()
+
+	// The inits run inside the container and report to their parent instead
+	bus.Subscribe(logSink{})
+	bus.Subscribe(newEventLogSink(eventsLogPath))
+
+	if len(os.Args) > 1 && os.Args[1] == containerShimArg {
+		runContainerShim()
+		os.Exit(0)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == coreCollectorArg {
+		runCoreCollector()
+		os.Exit(0)
+	}
+}
+
+// Main runs the command line interface, usage: your_docker.sh [global options] <command>
+// [options] [arguments]. It doesn't return.
+func Main() {
+	args, err := parseGlobalOptions(os.Args[1:])
+	if err != nil {
+		exitWithError(err, "", 1)
+	}
+	globalArgs = os.Args[1 : len(os.Args)-len(args)]
+	if err := applyUserConfig(); err != nil {
+		exitWithError(err, "", 1)
+	}
+
+	if len(args) < 1 {
+		exitWithError(errors.New(commandsUsage()), "", 1)
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		exitWithError(fmt.Errorf("%w %q\n%s", errUnknownCommand, args[0], commandsUsage()), args[0], 1)
+	}
+
+	sweepLeftovers()
+	removeExpiredContainers()
+
+	code, err := cmd.run(args[1:])
+	if err != nil {
+		var interrupted *interruptedError
+		switch {
+		case errors.As(err, &interrupted):
+			exitWithError(err, cmd.name, interrupted.exitCode())
+		case cmd.runsContainer:
+			exitWithError(err, cmd.name, setupExitCode(err))
+		}
+		exitWithError(err, cmd.name, 1)
+	}
+	os.Exit(code)
+}
+
+// globalArgs are the global options the program was run with, which the daemon passes on to
+// the commands it runs jobs with
+var globalArgs []string
+
+// parseGlobalOptions applies the options before the command, which scripts use to ask for
+// the diagnosis of failures, people for more logging and corporate networks for reaching the
+// registry, and returns the rest. The config file is applied afterwards, where they leave it
+// room.
+func parseGlobalOptions(args []string) ([]string, error) {
+	for len(args) > 0 {
+		name, value, hasValue := strings.Cut(args[0], "=")
+		// The value of an option is either after = or the next argument
+		optionValue := func(what string) (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if len(args) < 2 {
+				return "", fmt.Errorf("%w %s: needs %s", errInvalidGlobalOption, name, what)
+			}
+			value, args = args[1], args[1:]
+			return value, nil
+		}
+
+		switch {
+		case args[0] == errorJSONArg:
+			errorJSON = true
+		case args[0] == debugArg:
+			logLevel.Set(slog.LevelDebug)
+			logLevelFlag = true
+		case name == logLevelArg:
+			value, err := optionValue("a level, debug, info, warn or error")
+			if err != nil {
+				return nil, err
+			}
+			level, err := parseLogLevel(value)
+			if err != nil {
+				return nil, err
+			}
+			logLevel.Set(level)
+			logLevelFlag = true
+		case name == configArg:
+			value, err := optionValue("a YAML or JSON file")
+			if err != nil {
+				return nil, err
+			}
+			configFile = value
+		case name == registryCAArg:
+			value, err := optionValue("a PEM file")
+			if err != nil {
+				return nil, err
+			}
+			registryCAFiles = append(registryCAFiles, value)
+		case name == insecureRegistryArg:
+			value, err := optionValue("a registry host")
+			if err != nil {
+				return nil, err
+			}
+			if err := addInsecureRegistry(value); err != nil {
+				return nil, err
+			}
+		case name == registryMirrorArg:
+			value, err := optionValue("a mirror URL")
+			if err != nil {
+				return nil, err
+			}
+			if err := addRegistryMirror(value); err != nil {
+				return nil, err
+			}
+		default:
+			return args, nil
+		}
+		args = args[1:]
+	}
+
+	return args, nil
+}
+
+// exitWithError reports the error a command failed with, as an errorDiagnosis with
+// --error-json, and exits with code
+func exitWithError(err error, command string, code int) {
+	d := diagnose(err, command, code)
+	switch {
+	case errorJSON:
+		writeErrorJSON(os.Stderr, d)
+	case d.Subsystem == subsystemCLI:
+		// Usage is for reading as it is
+		fmt.Fprintln(os.Stderr, err)
+	case command == "":
+		logger.Error(err.Error(), "code", d.Code)
+	default:
+		logger.Error(err.Error(), "command", command, "code", d.Code)
+	}
+	os.Exit(code)
+}
+
+// parseRunOptions parses the flags and positional arguments of the run command.
+// Values from a -f definition file are used as defaults that flags can override.
+func parseRunOptions(args []string) (RunOptions, error) {
+	fs := newFlagSet("run", runUsage)
+	flags := defineRunFlags(fs, runUsage)
+	if err := fs.Parse(withDefaultRunFlags(args)); err != nil {
+		return RunOptions{}, err
+	}
+
+	return flags.options(fs.Args())
+}
+
+// runFlags holds the flags shared by every command that starts a container
+type runFlags struct {
+	usage        string
+	file         *string
+	name         *string
+	platform     *string
+	sha256       *string
+	securityOpts stringList
+	capAdd       stringList
+	capDrop      stringList
+	network      *string
+	ipc          *string
+	envs         stringList
+	volumes      stringList
+	memory       *string
+	cpus         *string
+	cpuBurst     *string
+	pidsLimit    *int64
+	cgroupParent *string
+	sharedRootfs *bool
+	readOnly     *bool
+	ttl          *time.Duration
+	timeout      *time.Duration
+	autoRemove   *bool
+	restart      *string
+	coreDumps    *bool
+	init         *bool
+	strictImage  *bool
+	hostname     *string
+	dns          stringList
+	dnsSearch    stringList
+	extraHosts   stringList
+	labels       stringList
+	user         *string
+	workdir      *string
+	hostCA       *bool
+	identity     *bool
+	tty          *bool
+	interactive  *bool
+	ttyAndStdin  *bool
+	detachedTTY  *bool
+	detachKeys   *string
+	detach       *bool
+	quiet        *bool
+	preserveFds  *int
+	// requireHostPorts, requireSockets and requireMounts are the host dependencies to wait
+	// for, no longer than requireTimeout
+	requireHostPorts stringList
+	requireSockets   stringList
+	requireMounts    stringList
+	requireTimeout   *time.Duration
+	// The --health-* flags replace what they set of the image's healthcheck
+	healthCmd         *string
+	healthInterval    *time.Duration
+	healthTimeout     *time.Duration
+	healthStartPeriod *time.Duration
+	healthRetries     *int
+	noHealthcheck     *bool
+}
+
+// defineRunFlags registers the container flags on fs
+func defineRunFlags(fs *flag.FlagSet, usage string) *runFlags {
+	f := &runFlags{usage: usage}
+	f.file = fs.String("f", "", "container definition file (YAML or JSON)")
+	f.name = fs.String("name", "", "name of the container instead of a generated one")
+	f.platform = fs.String("platform", "", "platform of a multi-platform image to run, e.g. linux/arm64 or linux/arm/v7")
+	f.sha256 = fs.String("sha256", "", "checksum the image must have when it is the URL of a root filesystem tarball")
+	fs.Var(&f.securityOpts, "security-opt", "security options, e.g. seccomp=unconfined or seccomp=/path/to/profile.json")
+	fs.Var(&f.capAdd, "cap-add", "add a capability to the default set, e.g. NET_ADMIN, or ALL (repeatable)")
+	fs.Var(&f.capDrop, "cap-drop", "drop a capability from the default set, e.g. NET_RAW, or ALL (repeatable)")
+	f.network = fs.String("network", "", "network mode: none, host, bridge, ns:<path> or macvlan:<host interface> with a DHCP address (default host)")
+	f.ipc = fs.String("ipc", "", "IPC mode: private, shareable, host, or container:<name|id> to join a shareable container's shared memory and semaphores (default private)")
+	fs.Var(&f.envs, "e", "set an environment variable (NAME=value)")
+	fs.Var(&f.envs, "env", "set an environment variable (NAME=value)")
+	fs.Var(&f.volumes, "v", "bind mount a host path (src:dst[:ro])")
+	fs.Var(&f.volumes, "volume", "bind mount a host path (src:dst[:ro])")
+	f.memory = fs.String("memory", "", "memory limit, e.g. 512m")
+	f.cpus = fs.String("cpus", "", "number of CPUs, e.g. 1.5")
+	f.cpuBurst = fs.String("cpu-burst", "", "CPU time the container may burst above its --cpus quota per period, e.g. 20ms")
+	f.pidsLimit = fs.Int64("pids-limit", 0, "maximum number of processes")
+	f.cgroupParent = fs.String("cgroup-parent", "", "create the container's cgroup below this cgroup path or systemd slice")
+	f.sharedRootfs = fs.Bool("shared-rootfs", false, "run on a shared read-only copy of the image with a tmpfs overlay")
+	f.readOnly = fs.Bool("read-only", false, "mount the root filesystem read-only, with tmpfs on /tmp and /run")
+	f.init = fs.Bool("init", true, "run the command under an init that reaps zombies and forwards signals; --init=false makes the command PID 1")
+	f.ttl = fs.Duration("ttl", 0, "remove the container this long after it exits, e.g. 1h, instead of following the host's autoremove policy")
+	f.timeout = fs.Duration("timeout", 0, "stop the container once it has run this long, e.g. 30s: SIGTERM, then SIGKILL, and exit code 124")
+	f.autoRemove = fs.Bool("rm", false, "remove the container and its root filesystem as soon as it exits")
+	f.restart = fs.String("restart", "", "restart the container when it exits: no, always, unless-stopped or on-failure[:max-retries] (default no)")
+	f.coreDumps = fs.Bool("core-dumps", false, "capture core dumps of crashing processes, see the cores command")
+	f.strictImage = fs.Bool("strict", false, "fail instead of warning when the image fails the compatibility check or an optional setup step fails")
+	f.hostname = fs.String("hostname", "", "container hostname")
+	fs.Var(&f.dns, "dns", "set a custom DNS server")
+	fs.Var(&f.dnsSearch, "dns-search", "set a custom DNS search domain")
+	fs.Var(&f.extraHosts, "add-host", "add a custom host-to-IP mapping (host:ip)")
+	fs.Var(&f.labels, "l", "set a label on the container (key=value), e.g. "+autoUpdateLabel+"=true (repeatable)")
+	fs.Var(&f.labels, "label", "set a label on the container (key=value), e.g. "+autoUpdateLabel+"=true (repeatable)")
+	f.user = fs.String("u", "", "user to run the command as, name or ID with an optional group (user[:group]), default the image's USER")
+	fs.StringVar(f.user, "user", "", "user to run the command as, name or ID with an optional group (user[:group]), default the image's USER")
+	f.workdir = fs.String("w", "", "working directory of the command, default the image's WORKDIR or /")
+	fs.StringVar(f.workdir, "workdir", "", "working directory of the command, default the image's WORKDIR or /")
+	f.hostCA = fs.Bool("host-ca", false, "mount the host's CA bundle into images that have none, for TLS inside the container")
+	f.identity = fs.Bool("identity", false, "mount a short-lived signed token of the container's identity at "+identityTokenTarget+"/"+identityTokenFile)
+	f.tty = fs.Bool("t", false, "allocate a pseudo-terminal")
+	fs.BoolVar(f.tty, "tty", false, "allocate a pseudo-terminal")
+	f.interactive = fs.Bool("i", false, "keep stdin attached")
+	fs.BoolVar(f.interactive, "interactive", false, "keep stdin attached")
+	f.ttyAndStdin = fs.Bool("it", false, "shorthand for -i -t")
+	f.detachedTTY = fs.Bool("dit", false, "shorthand for -d -i -t")
+	f.detach = fs.Bool("d", false, "run the container in the background and print its ID")
+	fs.BoolVar(f.detach, "detach", false, "run the container in the background and print its ID")
+	f.quiet = fs.Bool("q", false, "don't show the progress of downloading the image")
+	fs.BoolVar(f.quiet, "quiet", false, "don't show the progress of downloading the image")
+	f.preserveFds = fs.Int("preserve-fds", 0, "pass this many additional file descriptors, 3 and up, on to the container, e.g. listening sockets")
+	f.detachKeys = fs.String("detach-keys", "", "key sequence for detaching from a -it container (default \""+defaultDetachKeys+"\")")
+	fs.Var(&f.requireHostPorts, "require-host-port", "wait before starting the command until [host:]port on the host accepts connections, localhost by default (repeatable)")
+	fs.Var(&f.requireSockets, "require-socket", "wait before starting the command until the unix socket at this host path accepts connections (repeatable)")
+	fs.Var(&f.requireMounts, "require-mount", "wait before starting the command until something is mounted on this host path (repeatable)")
+	f.requireTimeout = fs.Duration("require-timeout", 0, "how long to wait for the --require-* dependencies before failing (default 1m)")
+	f.healthCmd = fs.String("health-cmd", "", "command line run with /bin/sh -c in the container to check its health, instead of the image's HEALTHCHECK")
+	f.healthInterval = fs.Duration("health-interval", 0, "time between runs of the healthcheck (default 30s)")
+	f.healthTimeout = fs.Duration("health-timeout", 0, "time a single run of the healthcheck may take before it counts as failed (default 30s)")
+	f.healthStartPeriod = fs.Duration("health-start-period", 0, "time after starting during which failed healthchecks don't count, until one succeeds")
+	f.healthRetries = fs.Int("health-retries", 0, "consecutive failed healthchecks that make the container unhealthy (default 3)")
+	f.noHealthcheck = fs.Bool("no-healthcheck", false, "don't run the image's HEALTHCHECK")
+
+	return f
+}
+
+// options combines the parsed flags, the positional arguments and the -f definition
+func (f *runFlags) options(rest []string) (RunOptions, error) {
+	var opts RunOptions
+	if *f.file != "" {
+		spec, err := LoadContainerSpec(*f.file)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts = spec.RunOptions()
+	}
+
+	if len(rest) > 0 {
+		opts.Image = rest[0]
+	}
+	if len(rest) > 1 {
+		opts.Command, opts.Args = rest[1], rest[2:]
+	}
+	if opts.Image == "" {
+		return RunOptions{}, errors.New(f.usage)
+	}
+
+	if *f.name != "" {
+		if err := validateContainerName(*f.name); err != nil {
+			return RunOptions{}, err
+		}
+		opts.Name = *f.name
+	}
+
+	if *f.platform != "" {
+		p, err := ParsePlatform(*f.platform)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Platform = p.String()
+	}
+
+	if *f.sha256 != "" {
+		if !isTarballURL(opts.Image) {
+			return RunOptions{}, errors.New("--sha256 is only for images given as the URL of a tarball")
+		}
+		if _, err := parseSHA256Option(*f.sha256); err != nil {
+			return RunOptions{}, err
+		}
+		opts.ImageSHA256 = *f.sha256
+	}
+
+	opts.SecurityOpts = append(opts.SecurityOpts, f.securityOpts...)
+	opts.CapAdd = append(opts.CapAdd, f.capAdd...)
+	opts.CapDrop = append(opts.CapDrop, f.capDrop...)
+	if _, err := defaultCapabilities().apply(opts.CapAdd, opts.CapDrop); err != nil {
+		return RunOptions{}, err
+	}
+	opts.Env = append(opts.Env, f.envs...)
+	opts.ExtraHosts = append(opts.ExtraHosts, f.extraHosts...)
+	labels, err := parseLabels(opts.Labels, f.labels)
+	if err != nil {
+		return RunOptions{}, err
+	}
+	opts.Labels = labels
+
+	// DNS settings replace the definition's rather than extending them, like the host's resolv.conf
+	if len(f.dns) > 0 {
+		opts.DNS = f.dns
+	}
+	if len(f.dnsSearch) > 0 {
+		opts.DNSSearch = f.dnsSearch
+	}
+	if *f.sharedRootfs {
+		opts.SharedRootfs = true
+	}
+	if *f.readOnly {
+		opts.ReadOnlyRootfs = true
+	}
+	if *f.ttl < 0 {
+		return RunOptions{}, fmt.Errorf("invalid --ttl %s: must not be negative", *f.ttl)
+	}
+	if *f.ttl > 0 {
+		opts.TTL = *f.ttl
+	}
+	if *f.timeout < 0 {
+		return RunOptions{}, fmt.Errorf("invalid --timeout %s: must not be negative", *f.timeout)
+	}
+	if *f.timeout > 0 {
+		opts.Timeout = *f.timeout
+	}
+	if *f.autoRemove {
+		opts.AutoRemove = true
+	}
+	if opts.AutoRemove && opts.TTL > 0 {
+		return RunOptions{}, errors.New("conflicting options: --rm and --ttl")
+	}
+	if *f.restart != "" {
+		policy, err := ParseRestartPolicy(*f.restart)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Restart = policy
+	}
+	if opts.AutoRemove && opts.Restart.enabled() {
+		return RunOptions{}, errors.New("conflicting options: --rm and --restart")
+	}
+	if *f.coreDumps {
+		opts.CoreDumps = true
+	}
+	if !*f.init {
+		opts.NoInit = true
+	}
+	if *f.strictImage {
+		opts.StrictImage = true
+	}
+	if *f.hostname != "" {
+		opts.Hostname = *f.hostname
+	}
+	if *f.user != "" {
+		if err := validateUser(*f.user); err != nil {
+			return RunOptions{}, err
+		}
+		opts.User = *f.user
+	}
+	if *f.workdir != "" {
+		opts.WorkingDir = *f.workdir
+	}
+	if *f.hostCA {
+		opts.HostCA = true
+	}
+	if *f.identity {
+		opts.Identity = true
+	}
+	if *f.tty || *f.ttyAndStdin || *f.detachedTTY {
+		opts.TTY = true
+	}
+	if *f.interactive || *f.ttyAndStdin || *f.detachedTTY {
+		opts.Interactive = true
+	}
+	if *f.quiet {
+		opts.Quiet = true
+	}
+	if *f.preserveFds != 0 {
+		opts.PreserveFds = *f.preserveFds
+	}
+	if *f.detach || *f.detachedTTY {
+		opts.Detach = true
+	}
+	if *f.detachKeys != "" {
+		if _, err := ParseDetachKeys(*f.detachKeys); err != nil {
+			return RunOptions{}, err
+		}
+		opts.DetachKeys = *f.detachKeys
+	}
+
+	for _, v := range f.volumes {
+		m, err := ParseVolume(v)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Mounts = append(opts.Mounts, m)
+	}
+
+	if *f.network != "" || opts.Network == "" {
+		mode, err := ParseNetworkMode(*f.network)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Network = mode
+	}
+
+	if *f.ipc != "" {
+		mode, err := ParseIPCMode(*f.ipc)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.IPC = mode
+	}
+
+	if *f.memory != "" {
+		n, err := ParseByteSize(*f.memory)
+		if err != nil {
+			return RunOptions{}, fmt.Errorf("invalid --memory: %w", err)
+		}
+		opts.Limits.Memory = n
+	}
+
+	if *f.cpus != "" {
+		n, err := ParseCPUs(*f.cpus)
+		if err != nil {
+			return RunOptions{}, fmt.Errorf("invalid --cpus: %w", err)
+		}
+		opts.Limits.CPUs = n
+	}
+
+	if *f.cpuBurst != "" {
+		d, err := ParseCPUBurst(*f.cpuBurst)
+		if err != nil {
+			return RunOptions{}, fmt.Errorf("invalid --cpu-burst: %w", err)
+		}
+		opts.Limits.CPUBurst = d
+	}
+
+	if *f.pidsLimit < 0 {
+		return RunOptions{}, errors.New("invalid --pids-limit: must be a positive number")
+	}
+	if *f.pidsLimit > 0 {
+		opts.Limits.PidsLimit = *f.pidsLimit
+	}
+
+	for _, p := range f.requireHostPorts {
+		d, err := ParseHostPortDependency(p)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Requires = append(opts.Requires, d)
+	}
+	for _, p := range f.requireSockets {
+		d, err := ParsePathDependency(hostDependencySocket, p)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Requires = append(opts.Requires, d)
+	}
+	for _, p := range f.requireMounts {
+		d, err := ParsePathDependency(hostDependencyMount, p)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.Requires = append(opts.Requires, d)
+	}
+	if *f.requireTimeout < 0 {
+		return RunOptions{}, fmt.Errorf("invalid --require-timeout %s: must not be negative", *f.requireTimeout)
+	}
+	if *f.requireTimeout > 0 {
+		if len(opts.Requires) == 0 {
+			return RunOptions{}, errors.New("--require-timeout needs a --require-host-port, --require-socket or --require-mount")
+		}
+		opts.RequireTimeout = *f.requireTimeout
+	}
+
+	if err := f.applyHealthcheck(&opts); err != nil {
+		return RunOptions{}, err
+	}
+
+	if *f.cgroupParent != "" {
+		opts.CgroupParent = *f.cgroupParent
+	}
+	if opts.CgroupParent != "" {
+		dir, err := ParseCgroupParent(opts.CgroupParent)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		opts.CgroupParent = dir
+	}
+
+	return opts, nil
+}
+
+// applyHealthcheck sets what the --health-* flags give of the container's healthcheck, the
+// rest is left to the image's
+func (f *runFlags) applyHealthcheck(opts *RunOptions) error {
+	if *f.healthInterval < 0 || *f.healthTimeout < 0 || *f.healthStartPeriod < 0 {
+		return errors.New("invalid --health-*: durations must not be negative")
+	}
+	if *f.healthRetries < 0 {
+		return errors.New("invalid --health-retries: must not be negative")
+	}
+
+	set := *f.healthCmd != "" || *f.healthInterval > 0 || *f.healthTimeout > 0 || *f.healthStartPeriod > 0 || *f.healthRetries > 0
+	if *f.noHealthcheck {
+		if set {
+			return errors.New("conflicting options: --no-healthcheck and --health-*")
+		}
+		opts.Healthcheck = &HealthConfig{Test: []string{healthTestNone}}
+		return nil
+	}
+	if !set {
+		return nil
+	}
+
+	hc := HealthConfig{}
+	if opts.Healthcheck != nil {
+		hc = *opts.Healthcheck
+	}
+	if *f.healthCmd != "" {
+		hc.Test = []string{healthTestCmdShell, *f.healthCmd}
+	}
+	if *f.healthInterval > 0 {
+		hc.Interval = *f.healthInterval
+	}
+	if *f.healthTimeout > 0 {
+		hc.Timeout = *f.healthTimeout
+	}
+	if *f.healthStartPeriod > 0 {
+		hc.StartPeriod = *f.healthStartPeriod
+	}
+	if *f.healthRetries > 0 {
+		hc.Retries = *f.healthRetries
+	}
+	opts.Healthcheck = &hc
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxClockSkew is how far the host clock may drift from the registry's or an image's before
+// it is reported. TLS starts to fail once the skew reaches the validity of a certificate.
+const maxClockSkew = 5 * time.Minute
+
+// caBundlePaths are where distributions keep their CA bundle, the same files Go looks for.
+// The first is where --host-ca mounts the host's.
+var caBundlePaths = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// clockHint is appended to clock warnings, as the fix lies with the host's time sync
+const clockHint = "check the host's time synchronisation, e.g. chronyc tracking or timedatectl"
+
+// checkClock looks for signs that the host clock is off, which containers notice as TLS
+// certificates that have expired or aren't valid yet: an image built in the future, or a CA
+// bundle in the image most of whose certificates aren't valid now
+func checkClock(root string, config imageConfig, now time.Time) []string {
+	var problems []string
+
+	if skew := config.Created.Sub(now); skew > maxClockSkew {
+		problems = append(problems, fmt.Sprintf("the image was built at %s, %s after the host clock says it is: TLS in the container may fail with certificates that aren't valid yet; %s",
+			config.Created.UTC().Format(time.RFC3339), skew.Round(time.Second), clockHint))
+	}
+
+	bundle := findCABundle(root)
+	if bundle == "" {
+		return problems
+	}
+	path, err := secureJoin(root, bundle)
+	if err != nil {
+		return problems
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return problems
+	}
+
+	var valid, notYet, expired int
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		switch {
+		case now.Before(cert.NotBefore):
+			notYet++
+		case now.After(cert.NotAfter):
+			expired++
+		default:
+			valid++
+		}
+	}
+
+	// Bundles always hold a few certificates that are about to expire or were just added
+	switch {
+	case notYet > valid:
+		problems = append(problems, fmt.Sprintf("most certificates in the image's %s aren't valid yet at %s, the host clock is probably behind; %s",
+			bundle, now.UTC().Format(time.RFC3339), clockHint))
+	case expired > valid:
+		problems = append(problems, fmt.Sprintf("most certificates in the image's %s have expired at %s: the image's CA bundle is outdated or the host clock is ahead; %s",
+			bundle, now.UTC().Format(time.RFC3339), clockHint))
+	}
+
+	return problems
+}
+
+// findCABundle returns the path of the CA bundle of the image at root, or "" if it has none
+func findCABundle(root string) string {
+	for _, bundle := range caBundlePaths {
+		path, err := secureJoin(root, bundle)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+			return bundle
+		}
+	}
+
+	return ""
+}
+
+// hostCABundle returns the host's CA bundle, with symlinks resolved so that later starts
+// mount the same file
+func hostCABundle() (string, error) {
+	if bundle := findCABundle("/"); bundle != "" {
+		return filepath.EvalSymlinks(bundle)
+	}
+
+	return "", errors.New("the host has no CA bundle")
+}
+
+// clockCheckingTransport compares the host clock with the Date of the registry's first
+// answer, and explains certificate validity errors that a wrong host clock would cause
+type clockCheckingTransport struct {
+	base    http.RoundTripper
+	checked sync.Once
+}
+
+func (t *clockCheckingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		var invalid x509.CertificateInvalidError
+		if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+			return nil, fmt.Errorf("%w (the host clock says %s, if that is wrong %s)", err, time.Now().UTC().Format(time.RFC3339), clockHint)
+		}
+		return nil, err
+	}
+
+	t.checked.Do(func() {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return
+		}
+		// The registry stamped its answer some time between sending and receiving, and
+		// Date only has seconds
+		received := time.Now()
+		switch {
+		case date.After(received.Add(maxClockSkew)):
+			warnf(eventTypeImage, "the host clock is %s behind %s: TLS in containers may fail with certificates that aren't valid yet; %s",
+				date.Sub(received).Round(time.Second), req.URL.Host, clockHint)
+		case date.Before(sent.Add(-maxClockSkew)):
+			warnf(eventTypeImage, "the host clock is %s ahead of %s: TLS in containers may fail with certificates that have expired; %s",
+				sent.Sub(date).Round(time.Second), req.URL.Host, clockHint)
+		}
+	})
+
+	return resp, nil
+}
@@ -0,0 +1,1782 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// errNotImplemented is returned by commands that are recognised but not supported yet
+var errNotImplemented = errors.New("not implemented yet")
+
+// command is a subcommand of the CLI with its own flags
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) (int, error)
+	// runsContainer marks commands that run a command in a container. Like Docker, they exit
+	// with setupFailedExitCode when they fail themselves, so that the exit codes of the
+	// command remain distinguishable.
+	runsContainer bool
+}
+
+var commands = []command{
+	{name: "run", summary: "Run a command in a new container", run: runCmd, runsContainer: true},
+	{name: "create", summary: "Create a new container without starting it", run: createCmd},
+	{name: "start", summary: "Start created or stopped containers in the background", run: startCmd},
+	{name: "attach", summary: "Connect to the input and output of a running container", run: attachCmd},
+	{name: "stop", summary: "Stop running containers", run: stopCmd},
+	{name: "kill", summary: "Kill running containers", run: killCmd},
+	{name: "update", summary: "Change the resource limits of containers", run: updateCmd},
+	{name: "pipe", summary: "Run containers connected by pipes, like a shell pipeline", run: pipeCmd, runsContainer: true},
+	{name: "pull", summary: "Download an image without running it", run: pullCmd},
+	{name: "push", summary: "Upload a stored image to a registry", run: pushCmd},
+	{name: "images", summary: "List locally stored images", run: imagesCmd},
+	{name: "rmi", summary: "Remove locally stored images", run: rmiCmd},
+	{name: "save", summary: "Write stored images to an OCI image layout directory", run: saveCmd},
+	{name: "load", summary: "Load images from a docker save or OCI archive", run: loadCmd},
+	{name: "bundle", summary: "Pack listed images into one archive for air-gapped machines, and install it", run: bundleCmd},
+	{name: "image", summary: "Show which containers were created from an image", run: imageCmd},
+	{name: "inspect", summary: "Show low-level information about containers and images", run: inspectCmd},
+	{name: "ps", summary: "List containers", run: psCmd},
+	{name: "stats", summary: "Show the live resource usage of running containers", run: statsCmd},
+	{name: "top", summary: "List the processes running in a container", run: topCmd},
+	{name: "logs", summary: "Print the output of a detached container", run: logsCmd},
+	{name: "events", summary: "Print lifecycle events of containers and images as they happen", run: eventsCmd},
+	{name: "cores", summary: "List core dumps captured from a container", run: coresCmd},
+	{name: "rm", summary: "Remove containers", run: rmCmd},
+	{name: "exec", summary: "Run a command in a running container", run: execCmd, runsContainer: true},
+	{name: "cp", summary: "Copy files between a container and the host", run: cpCmd},
+	{name: "commit", summary: "Create an image from a container's changes", run: commitCmd},
+	{name: "build", summary: "Build an image from a Dockerfile", run: buildCmd},
+	{name: "sandbox", summary: "Run untrusted code in a locked-down container", run: sandboxCmd, runsContainer: true},
+	{name: "network", summary: "List networks and configure their DNS and hosts policy", run: networkCmd},
+	{name: "identity", summary: "Show the key that signs containers' identity tokens, and verify tokens", run: identityCmd},
+	{name: "system", summary: "Configure host-wide policies, such as removing exited containers", run: systemCmd},
+	{name: "compose", summary: "Run the services of a compose file together", run: composeCmd},
+	{name: "daemon", summary: "Serve a subset of the Docker Engine API on a unix socket", run: daemonCmd},
+	{name: "dev", summary: "Run a container with host paths synced into it, restarting it on changes", run: devCmd, runsContainer: true},
+}
+
+const (
+	runUsage = "Usage: your_docker.sh run [options] <image> [<command> <arg1> <arg2> ...]\n" +
+		"       your_docker.sh run -f container.yaml [options] [<image> [<command> <arg1> ...]]"
+	createUsage = "Usage: your_docker.sh create [options] <image> [<command> <arg1> <arg2> ...]\n" +
+		"       your_docker.sh create -f container.yaml [options] [<image> [<command> <arg1> ...]]"
+	startUsage   = "Usage: your_docker.sh start <container> [<container> ...]"
+	attachUsage  = "Usage: your_docker.sh attach [--detach-keys <keys>] [--no-stdin] [--sig-proxy=false] <container>"
+	stopUsage    = "Usage: your_docker.sh stop [options] <container> [<container> ...]"
+	killUsage    = "Usage: your_docker.sh kill [-s <signal>] [--all] <container> [<container> ...] | kill -l"
+	updateUsage  = "Usage: your_docker.sh update [--memory <size>] [--cpus <n>] [--cpu-burst <duration>] [--pids-limit <n>] <container> [<container> ...]"
+	pipeUsage    = "Usage: your_docker.sh pipe [--pipefail] '[options] <image> [<command> [args...]] | [options] <image> [<command> [args...]] ...'"
+	pullUsage    = "Usage: your_docker.sh pull [-q] [--format text|json] [--platform os/arch] [-u <user> --password-stdin] [--sha256 <checksum>] <image|tarball URL>"
+	pushUsage    = "Usage: your_docker.sh push [-q] [--format text|json] [-u <user> --password-stdin] <image>"
+	imagesUsage  = "Usage: your_docker.sh images [--format table|json]"
+	rmiUsage     = "Usage: your_docker.sh rmi [-f] <image> [<image> ...]"
+	saveUsage    = "Usage: your_docker.sh save -o <dir> <image> [<image> ...]"
+	loadUsage    = "Usage: your_docker.sh load [-q] [-i <archive>]"
+	bundleUsage  = "Usage: your_docker.sh bundle create -f <images.txt> -o <bundle.tar> [-q] [--platform os/arch] | install [-q] <bundle.tar>"
+	imageUsage   = "Usage: your_docker.sh image containers [-q] [--no-trunc] [--format table|json] <image>"
+	inspectUsage = "Usage: your_docker.sh inspect [--type container|image] [-s] [-f <template>] <container|image> [<container|image> ...]"
+	psUsage      = "Usage: your_docker.sh ps [-a] [-q] [-s] [--no-trunc] [--format table|json]"
+	statsUsage   = "Usage: your_docker.sh stats [--no-stream] [<container> ...]"
+	topUsage     = "Usage: your_docker.sh top [--format table|json] <container>"
+	logsUsage    = "Usage: your_docker.sh logs [options] <container>"
+	eventsUsage  = "Usage: your_docker.sh events [--since <time>] [--until <time>] [--filter <key>=<value> ...] [--format text|json]"
+	coresUsage   = "Usage: your_docker.sh cores <container>"
+	rmUsage      = "Usage: your_docker.sh rm [options] <container> [<container> ...]"
+	execUsage    = "Usage: your_docker.sh exec [options] <container> <command> <arg1> <arg2> ..."
+	commitUsage  = "Usage: your_docker.sh commit [-m <message>] [-a <author>] [--compression <compression>] <container> <repository>[:<tag>]"
+	buildUsage   = "Usage: your_docker.sh build [-t <name>[:<tag>] ...] [-f <Dockerfile>] [--build-arg <name>[=<value>] ...] [--no-cache] [--compression <compression>] <context directory>"
+	cpUsage      = "Usage: your_docker.sh cp [-a] <container>:<path> <host path> | cp [-a] <host path> <container>:<path>"
+	sandboxUsage = "Usage: your_docker.sh sandbox run [options] <image> [<command> <arg1> <arg2> ...]"
+	networkUsage = "Usage: your_docker.sh network ls [--format table|json] | inspect <network> | dns [options] <network>"
+	systemUsage  = "Usage: your_docker.sh system autoremove [--ttl <duration>] | prune [-f] | migrate --to overlay|copy [<container> ...]"
+	composeUsage = "Usage: your_docker.sh compose [-f <compose.yaml>] [-p <project>] up [-d] | down [-t <seconds>]"
+	daemonUsage  = "Usage: your_docker.sh daemon [-H <socket path>] [--max-concurrent-jobs <n>] [--webhook-token <token> [--webhook-addr <host:port>]]"
+	devUsage     = "Usage: your_docker.sh dev --sync <src>:<dst> [--sync ...] [--restart-on-change] [options] <image> [<command> <arg1> ...]"
+
+	identityUsage = "Usage: your_docker.sh identity key [--format pem|jwks] | verify [<token>]"
+)
+
+// findCommand returns the subcommand with the given name, or nil
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+
+	return nil
+}
+
+// commandsUsage describes the available subcommands
+func commandsUsage() string {
+	var b strings.Builder
+	b.WriteString("Usage: your_docker.sh [--error-json] [--debug | --log-level <level>] [--registry-ca <file>] [--insecure-registry <host>] [--registry-mirror <url>] [--config <file>] <command> [options] [arguments]\n\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "\n  %-8s %s", c.name, c.summary)
+	}
+
+	return b.String()
+}
+
+// newFlagSet creates the flag set of a subcommand
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flagErrorHandling)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// flagErrorHandling is what the flag sets of subcommands do with a flag they can't parse
+var flagErrorHandling = flag.ExitOnError
+
+// parseArgs parses a subcommand's flags and checks that at least min positional arguments remain
+func parseArgs(fs *flag.FlagSet, usage string, args []string, min int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() < min {
+		return nil, errors.New(usage)
+	}
+
+	return fs.Args(), nil
+}
+
+// runCmd runs a command in a new container and returns its exit code
+func runCmd(args []string) (int, error) {
+	opts, err := parseRunOptions(args)
+	if err != nil {
+		return 0, err
+	}
+
+	return runCmdWith(opts)
+}
+
+// runCmdWith creates a container with the given options, runs it in the foreground and
+// returns its exit code. The exited container is kept unless it is removed automatically.
+// Detached containers are started in the background and their ID is printed instead.
+func runCmdWith(opts RunOptions) (int, error) {
+	env, err := NewContainerEnvironment(context.Background(), opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.Detach {
+		if err := env.start(); err != nil {
+			return 0, err
+		}
+		fmt.Println(env.id)
+		return 0, nil
+	}
+	// It appears that we cannot test previous stages once on the final stage of the challenge.
+	// When we are asked to fetch and run a docker image, I don't know how we determine if we need to copy a binary
+	// from the host fs or if the binary will be present in the image. For now, don't bother with trying to copy a
+	// binary from the host fs.
+	/*	err := env.CopyFile()
+		if err != nil {
+			log.Fatal(err)
+		}*/
+	return env.Run()
+}
+
+// createCmd creates a container and prints its ID
+func createCmd(args []string) (int, error) {
+	fs := newFlagSet("create", createUsage)
+	flags := defineRunFlags(fs, createUsage)
+	if err := fs.Parse(withDefaultRunFlags(args)); err != nil {
+		return 0, err
+	}
+
+	opts, err := flags.options(fs.Args())
+	if err != nil {
+		return 0, err
+	}
+	// The descriptors are ours, a later start runs in another process
+	if opts.PreserveFds > 0 {
+		return 0, errors.New("--preserve-fds only applies to run")
+	}
+
+	env, err := NewContainerEnvironment(context.Background(), opts)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Println(env.id)
+
+	return 0, nil
+}
+
+// startCmd starts containers in the background
+func startCmd(args []string) (int, error) {
+	ids, err := parseArgs(newFlagSet("start", startUsage), startUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return forEachContainer(ids, startContainer)
+}
+
+// stopCmd stops containers, killing those that don't exit within the timeout
+func stopCmd(args []string) (int, error) {
+	fs := newFlagSet("stop", stopUsage)
+	seconds := fs.Int("t", int(defaultStopTimeout/time.Second), "seconds to wait before killing the container")
+	fs.IntVar(seconds, "time", int(defaultStopTimeout/time.Second), "seconds to wait before killing the container")
+	ids, err := parseArgs(fs, stopUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if *seconds < 0 {
+		return 0, errors.New("invalid --time: must not be negative")
+	}
+
+	return forEachContainer(ids, func(id string) error {
+		return stopContainer(id, time.Duration(*seconds)*time.Second)
+	})
+}
+
+// killCmd kills running containers, or sends them another signal
+func killCmd(args []string) (int, error) {
+	fs := newFlagSet("kill", killUsage)
+	name := fs.String("s", "KILL", "signal to send, by name or number")
+	fs.StringVar(name, "signal", "KILL", "signal to send, by name or number")
+	all := fs.Bool("all", false, "signal every process in the container, not just its init")
+	list := fs.Bool("l", false, "list the signal names")
+	fs.BoolVar(list, "list", false, "list the signal names")
+	if err := fs.Parse(args); err != nil {
+		return 0, err
+	}
+	if *list {
+		printSignals(os.Stdout)
+		return 0, nil
+	}
+	if fs.NArg() < 1 {
+		return 0, errors.New(killUsage)
+	}
+
+	sig, err := parseSignal(*name)
+	if err != nil {
+		return 0, err
+	}
+
+	return forEachContainer(fs.Args(), func(id string) error {
+		return signalContainerProcesses(id, sig, *all)
+	})
+}
+
+// updateCmd changes the limits of containers, running or not. Limits that aren't given are kept.
+func updateCmd(args []string) (int, error) {
+	fs := newFlagSet("update", updateUsage)
+	memory := fs.String("memory", "", "memory limit, e.g. 512m")
+	cpus := fs.String("cpus", "", "number of CPUs, e.g. 1.5")
+	cpuBurst := fs.String("cpu-burst", "", "CPU time the container may burst above its --cpus quota per period, e.g. 20ms")
+	pidsLimit := fs.Int64("pids-limit", 0, "maximum number of processes")
+	ids, err := parseArgs(fs, updateUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	var changes ResourceLimits
+	if *memory != "" {
+		if changes.Memory, err = ParseByteSize(*memory); err != nil {
+			return 0, fmt.Errorf("invalid --memory: %w", err)
+		}
+	}
+	if *cpus != "" {
+		if changes.CPUs, err = ParseCPUs(*cpus); err != nil {
+			return 0, fmt.Errorf("invalid --cpus: %w", err)
+		}
+	}
+	if *cpuBurst != "" {
+		if changes.CPUBurst, err = ParseCPUBurst(*cpuBurst); err != nil {
+			return 0, fmt.Errorf("invalid --cpu-burst: %w", err)
+		}
+	}
+	if *pidsLimit < 0 {
+		return 0, errors.New("invalid --pids-limit: must be a positive number")
+	}
+	changes.PidsLimit = *pidsLimit
+
+	if changes.IsZero() {
+		return 0, errors.New("update needs at least one of --memory, --cpus, --cpu-burst or --pids-limit")
+	}
+
+	return forEachContainer(ids, func(id string) error {
+		return updateContainer(id, changes)
+	})
+}
+
+// forEachContainer applies op to every container, given by ID, name or ID prefix, printing
+// the ones that succeeded as they were given like Docker does. Failures are reported and turn
+// the exit code to 1.
+func forEachContainer(refs []string, op func(id string) error) (int, error) {
+	code := 0
+	for _, ref := range refs {
+		id, err := resolveContainer(ref)
+		if err == nil {
+			err = op(id)
+		}
+		if err != nil {
+			if errorJSON {
+				writeErrorJSON(os.Stderr, diagnose(err, "", 1))
+			} else {
+				errorf(eventTypeContainer, "%v", err)
+			}
+			code = 1
+			continue
+		}
+		fmt.Println(ref)
+	}
+
+	return code, nil
+}
+
+// sandboxCmd runs a command with the sandbox preset: a user namespace, no network, the strict
+// seccomp profile, a read-only rootfs, tight limits and a wall-clock timeout
+func sandboxCmd(args []string) (int, error) {
+	if len(args) == 0 || args[0] != "run" {
+		return 0, errors.New(sandboxUsage)
+	}
+
+	fs := newFlagSet("sandbox run", sandboxUsage)
+	flags := defineRunFlags(fs, sandboxUsage)
+	// Unlike run, the sandbox always has a timeout
+	*flags.timeout = sandboxTimeout
+	if err := fs.Parse(args[1:]); err != nil {
+		return 0, err
+	}
+
+	opts, err := flags.options(fs.Args())
+	if err != nil {
+		return 0, err
+	}
+	if opts.Timeout <= 0 {
+		return 0, errors.New("invalid --timeout: must be positive")
+	}
+	if *flags.network != "" || len(opts.SecurityOpts) > 0 {
+		return 0, errors.New("sandbox run doesn't allow --network or --security-opt")
+	}
+	applySandboxPreset(&opts, opts.Timeout)
+
+	return runCmdWith(opts)
+}
+
+// pipeCmd runs a pipeline of containers and returns the exit code of its last stage
+func pipeCmd(args []string) (int, error) {
+	fs := newFlagSet("pipe", pipeUsage)
+	pipefail := fs.Bool("pipefail", false, "return the exit code of the last stage that failed")
+	rest, err := parseArgs(fs, pipeUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(pipeUsage)
+	}
+
+	pipeline, err := parsePipeline(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return runPipeline(pipeline, *pipefail)
+}
+
+// devCmd runs a container with host paths synced into it until it exits
+func devCmd(args []string) (int, error) {
+	fs := newFlagSet("dev", devUsage)
+	flags := defineRunFlags(fs, devUsage)
+	var syncs stringList
+	fs.Var(&syncs, "sync", "sync a host path into the container (src:dst)")
+	// Not --restart, which is the restart policy of run's flags
+	restart := fs.Bool("restart-on-change", false, "restart the container when a synced file changes")
+	if err := fs.Parse(withDefaultRunFlags(args)); err != nil {
+		return 0, err
+	}
+
+	opts, err := flags.options(fs.Args())
+	if err != nil {
+		return 0, err
+	}
+	if opts.TTY || opts.Detach {
+		return 0, errors.New("-t and -d can't be used with dev")
+	}
+	if len(syncs) == 0 {
+		return 0, errors.New(devUsage)
+	}
+
+	dev := devOptions{run: opts, restart: *restart}
+	for _, s := range syncs {
+		m, err := ParseVolume(s)
+		if err != nil {
+			return 0, err
+		}
+		if m.ReadOnly {
+			return 0, fmt.Errorf("invalid --sync %q: synced paths can't be read-only", s)
+		}
+		dev.syncs = append(dev.syncs, m)
+	}
+
+	return runDev(dev)
+}
+
+// pullCmd downloads an image into the local store so later runs work offline
+func pullCmd(args []string) (int, error) {
+	fs := newFlagSet("pull", pullUsage)
+	format := fs.String("format", "text", "progress format: text or json")
+	quiet := fs.Bool("q", false, "only print the image name once it is pulled")
+	fs.BoolVar(quiet, "quiet", false, "only print the image name once it is pulled")
+	username := fs.String("u", "", "username to authenticate to the registry as")
+	fs.StringVar(username, "username", "", "username to authenticate to the registry as")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	platform := fs.String("platform", "", "platform of a multi-platform image to pull, e.g. linux/arm64")
+	checksum := fs.String("sha256", "", "checksum the image must have when it is the URL of a root filesystem tarball")
+	rest, err := parseArgs(fs, pullUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(pullUsage)
+	}
+
+	credentials, err := readCredentials(*username, *passwordStdin)
+	if err != nil {
+		return 0, err
+	}
+
+	var sink EventSink
+	switch *format {
+	case "text":
+		sink = newProgressRenderer(os.Stdout)
+	case "json":
+		sink = newJSONStreamSink(os.Stdout)
+	default:
+		return 0, fmt.Errorf("invalid --format %q: expected text or json", *format)
+	}
+	if !*quiet {
+		defer bus.Subscribe(sink)()
+	}
+
+	// Interrupted downloads are kept, pulling again resumes them
+	ctx, stop := interruptContext()
+	defer stop()
+
+	var want *Platform
+	if *platform != "" {
+		p, err := ParsePlatform(*platform)
+		if err != nil {
+			return 0, err
+		}
+		want = &p
+	}
+
+	if isTarballURL(rest[0]) {
+		img, err := pullTarballImage(ctx, NewImageStore(imageStoreDir), rest[0], *checksum, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, context.Cause(ctx)
+			}
+			return 0, fmt.Errorf("failed to pull %s: %w", rest[0], err)
+		}
+		if *quiet {
+			fmt.Println(img.Name)
+		}
+		return 0, nil
+	}
+	if *checksum != "" {
+		return 0, errors.New("--sha256 is only for images given as the URL of a tarball")
+	}
+
+	dl, err := NewDockerImageDownloader(rest[0], credentials)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create image downloader: %w", err)
+	}
+	dl.platform = want
+	if *format == "text" && !*quiet {
+		dl.stats = newPullStats()
+	}
+
+	if err := dl.Pull(ctx, NewImageStore(imageStoreDir)); err != nil {
+		if ctx.Err() != nil {
+			return 0, context.Cause(ctx)
+		}
+		return 0, fmt.Errorf("failed to pull %s: %w", rest[0], err)
+	}
+	if *quiet {
+		fmt.Println(dl.ref.String())
+	}
+	if dl.stats != nil {
+		fmt.Println()
+		if err := dl.stats.write(os.Stdout); err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, nil
+}
+
+// readCredentials returns the credentials given with --username and --password-stdin, or nil
+// without them. Like docker login, the password is only taken from stdin so it stays out of ps
+// and history.
+func readCredentials(username string, passwordStdin bool) (*registryCredentials, error) {
+	if passwordStdin != (username != "") {
+		return nil, errors.New("--username and --password-stdin must be used together")
+	}
+	if !passwordStdin {
+		return nil, nil
+	}
+
+	password, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+
+	return &registryCredentials{Username: username, Password: strings.TrimRight(string(password), "\r\n")}, nil
+}
+
+// pushCmd uploads a stored image to the registry its name is on
+func pushCmd(args []string) (int, error) {
+	fs := newFlagSet("push", pushUsage)
+	format := fs.String("format", "text", "progress format: text or json")
+	quiet := fs.Bool("q", false, "only print the image name once it is pushed")
+	fs.BoolVar(quiet, "quiet", false, "only print the image name once it is pushed")
+	username := fs.String("u", "", "username to authenticate to the registry as")
+	fs.StringVar(username, "username", "", "username to authenticate to the registry as")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	rest, err := parseArgs(fs, pushUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(pushUsage)
+	}
+
+	credentials, err := readCredentials(*username, *passwordStdin)
+	if err != nil {
+		return 0, err
+	}
+
+	var sink EventSink
+	switch *format {
+	case "text":
+		sink = newProgressRenderer(os.Stdout)
+	case "json":
+		sink = newJSONStreamSink(os.Stdout)
+	default:
+		return 0, fmt.Errorf("invalid --format %q: expected text or json", *format)
+	}
+	if !*quiet {
+		defer bus.Subscribe(sink)()
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	up, err := NewDockerImageUploader(rest[0], credentials)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create image uploader: %w", err)
+	}
+	if err := up.Push(ctx, NewImageStore(imageStoreDir)); err != nil {
+		if ctx.Err() != nil {
+			return 0, context.Cause(ctx)
+		}
+		return 0, fmt.Errorf("failed to push %s: %w", rest[0], err)
+	}
+	if *quiet {
+		fmt.Println(up.ref.String())
+	}
+
+	return 0, nil
+}
+
+// imagesCmd lists the images in the local store
+func imagesCmd(args []string) (int, error) {
+	fs := newFlagSet("images", imagesUsage)
+	format := fs.String("format", "table", "output format: table or json")
+	if _, err := parseArgs(fs, imagesUsage, args, 0); err != nil {
+		return 0, err
+	}
+
+	images, err := NewImageStore(imageStoreDir).List()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	if err := printImages(os.Stdout, images, *format); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// rmiCmd untags images, refusing those containers were created from unless forced. Like
+// forEachContainer, failures are reported and the remaining images still removed.
+func rmiCmd(args []string) (int, error) {
+	fs := newFlagSet("rmi", rmiUsage)
+	force := fs.Bool("f", false, "remove images that containers were created from")
+	fs.BoolVar(force, "force", false, "remove images that containers were created from")
+	refs, err := parseArgs(fs, rmiUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	store := NewImageStore(imageStoreDir)
+	code := 0
+	for _, ref := range refs {
+		if err := removeImage(store, ref, *force); err != nil {
+			if errorJSON {
+				writeErrorJSON(os.Stderr, diagnose(err, "rmi", 1))
+			} else {
+				errorf(eventTypeImage, "%v", err)
+			}
+			code = 1
+			continue
+		}
+		fmt.Println("Untagged:", ref)
+	}
+
+	return code, nil
+}
+
+// saveCmd writes stored images to an OCI image layout, for skopeo, podman or an archive
+func saveCmd(args []string) (int, error) {
+	fs := newFlagSet("save", saveUsage)
+	output := fs.String("o", "", "directory to write the OCI image layout to")
+	fs.StringVar(output, "output", "", "directory to write the OCI image layout to")
+	refs, err := parseArgs(fs, saveUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if *output == "" {
+		return 0, errors.New(saveUsage)
+	}
+
+	store := NewImageStore(imageStoreDir)
+	images := make([]*StoredImage, 0, len(refs))
+	for _, ref := range refs {
+		img, err := store.Lookup(ref)
+		if err != nil {
+			return 0, err
+		}
+		images = append(images, img)
+	}
+
+	if err := store.SaveOCILayout(*output, images); err != nil {
+		return 0, err
+	}
+	for _, img := range images {
+		fmt.Printf("Saved: %s\n", img.Reference())
+	}
+
+	return 0, nil
+}
+
+// loadCmd stores the images of a docker save or OCI archive, read from stdin without -i
+func loadCmd(args []string) (int, error) {
+	fs := newFlagSet("load", loadUsage)
+	input := fs.String("i", "", "archive to read instead of stdin")
+	fs.StringVar(input, "input", "", "archive to read instead of stdin")
+	quiet := fs.Bool("q", false, "don't show progress")
+	fs.BoolVar(quiet, "quiet", false, "don't show progress")
+	rest, err := parseArgs(fs, loadUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 0 {
+		return 0, errors.New(loadUsage)
+	}
+
+	r := io.Reader(os.Stdin)
+	if *input != "" && *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer f.Close()
+		r = f
+	} else if isTerminal(os.Stdin) {
+		return 0, errors.New("requested load from stdin, but stdin is a terminal; use -i <archive> or pipe an archive in")
+	}
+
+	if !*quiet {
+		defer bus.Subscribe(newProgressRenderer(os.Stdout))()
+	}
+	images, err := NewImageStore(imageStoreDir).LoadArchive(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load images: %w", err)
+	}
+	if *quiet {
+		for _, img := range images {
+			fmt.Printf("Loaded image: %s\n", img.Reference())
+		}
+	}
+
+	return 0, nil
+}
+
+// bundleCmd runs the bundle subcommands
+func bundleCmd(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New(bundleUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		return bundleCreateCmd(args[1:])
+	case "install":
+		return bundleInstallCmd(args[1:])
+	}
+
+	return 0, fmt.Errorf("unknown bundle command %q\n%s", args[0], bundleUsage)
+}
+
+// bundleCreateCmd writes the images of a list to a single archive, pulling those that aren't
+// stored yet, for bundle install to load on a machine without access to the registry
+func bundleCreateCmd(args []string) (int, error) {
+	fs := newFlagSet("bundle create", bundleUsage)
+	file := fs.String("f", "", "file listing the images to bundle, one per line")
+	fs.StringVar(file, "file", "", "file listing the images to bundle, one per line")
+	output := fs.String("o", "", "archive to write, gzipped if it ends in .gz or .tgz")
+	fs.StringVar(output, "output", "", "archive to write, gzipped if it ends in .gz or .tgz")
+	quiet := fs.Bool("q", false, "don't show progress")
+	fs.BoolVar(quiet, "quiet", false, "don't show progress")
+	platform := fs.String("platform", "", "platform to bundle multi-platform images for, e.g. linux/arm64")
+	rest, err := parseArgs(fs, bundleUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 0 || *file == "" || *output == "" {
+		return 0, errors.New(bundleUsage)
+	}
+
+	refs, err := readImageList(*file)
+	if err != nil {
+		return 0, err
+	}
+	want, err := parsePlatformOption(*platform)
+	if err != nil {
+		return 0, err
+	}
+
+	// stdout is for the list of what was bundled
+	if !*quiet {
+		defer bus.Subscribe(newProgressRenderer(os.Stderr))()
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	store := NewImageStore(imageStoreDir)
+	images, err := bundleImages(ctx, store, refs, want)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.writeBundle(*output, images); err != nil {
+		return 0, err
+	}
+	for _, img := range images {
+		fmt.Printf("Bundled: %s\n", img.Reference())
+	}
+
+	return 0, nil
+}
+
+// bundleInstallCmd stores the images of a bundle, like load
+func bundleInstallCmd(args []string) (int, error) {
+	fs := newFlagSet("bundle install", bundleUsage)
+	quiet := fs.Bool("q", false, "don't show progress")
+	fs.BoolVar(quiet, "quiet", false, "don't show progress")
+	rest, err := parseArgs(fs, bundleUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(bundleUsage)
+	}
+
+	f, err := os.Open(rest[0])
+	if err != nil {
+		return 0, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+
+	if !*quiet {
+		defer bus.Subscribe(newProgressRenderer(os.Stdout))()
+	}
+	images, err := NewImageStore(imageStoreDir).LoadArchive(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to install bundle: %w", err)
+	}
+	if *quiet {
+		for _, img := range images {
+			fmt.Printf("Loaded image: %s\n", img.Reference())
+		}
+	}
+
+	return 0, nil
+}
+
+// imageCmd runs the image subcommands
+func imageCmd(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New(imageUsage)
+	}
+
+	switch args[0] {
+	case "containers":
+		return imageContainersCmd(args[1:])
+	}
+
+	return 0, fmt.Errorf("unknown image command %q\n%s", args[0], imageUsage)
+}
+
+// imageContainersCmd lists the containers, running or not, created from an image like ps -a
+func imageContainersCmd(args []string) (int, error) {
+	fs := newFlagSet("image containers", imageUsage)
+	opts := psOptions{all: true}
+	fs.BoolVar(&opts.quiet, "q", false, "only print container IDs")
+	fs.BoolVar(&opts.quiet, "quiet", false, "only print container IDs")
+	fs.BoolVar(&opts.noTrunc, "no-trunc", false, "show full container IDs and commands")
+	fs.StringVar(&opts.format, "format", "table", "output format: table or json")
+	rest, err := parseArgs(fs, imageUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(imageUsage)
+	}
+
+	img, err := NewImageStore(imageStoreDir).Lookup(rest[0])
+	if err != nil {
+		return 0, err
+	}
+	opts.match = func(state *ContainerState) bool { return usesImage(state, img) }
+
+	containers, err := listContainers(opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	return 0, printContainers(os.Stdout, containers, opts)
+}
+
+// inspectCmd prints what is known about containers and images as a JSON array like docker
+// inspect, or formatted with a template. Like rmiCmd, objects that can't be found are
+// reported and the others still printed.
+func inspectCmd(args []string) (int, error) {
+	fs := newFlagSet("inspect", inspectUsage)
+	format := fs.String("f", "", "format the output with a Go template, e.g. '{{.State.Pid}}' or '{{json .Config}}'")
+	fs.StringVar(format, "format", "", "format the output with a Go template, e.g. '{{.State.Pid}}' or '{{json .Config}}'")
+	kind := fs.String("type", "", "only look for a container or an image")
+	size := fs.Bool("s", false, "show how much each container has written and its total size")
+	fs.BoolVar(size, "size", false, "show how much each container has written and its total size")
+	refs, err := parseArgs(fs, inspectUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if *kind != "" && *kind != inspectTypeContainer && *kind != inspectTypeImage {
+		return 0, fmt.Errorf("invalid --type %q: expected container or image", *kind)
+	}
+
+	store := NewImageStore(imageStoreDir)
+	code := 0
+	objects := []any{}
+	for _, ref := range refs {
+		obj, err := inspectObject(store, ref, *kind, *size)
+		if err != nil {
+			if errorJSON {
+				writeErrorJSON(os.Stderr, diagnose(err, "inspect", 1))
+			} else {
+				errorf(eventTypeContainer, "%v", err)
+			}
+			code = 1
+			continue
+		}
+		objects = append(objects, obj)
+	}
+
+	if err := printInspected(os.Stdout, objects, *format); err != nil {
+		return 0, err
+	}
+
+	return code, nil
+}
+
+// psCmd lists containers
+func psCmd(args []string) (int, error) {
+	fs := newFlagSet("ps", psUsage)
+	var opts psOptions
+	fs.BoolVar(&opts.all, "a", false, "show all containers, not only running ones")
+	fs.BoolVar(&opts.all, "all", false, "show all containers, not only running ones")
+	fs.BoolVar(&opts.size, "s", false, "show how much each container has written and its total size")
+	fs.BoolVar(&opts.size, "size", false, "show how much each container has written and its total size")
+	fs.BoolVar(&opts.quiet, "q", false, "only print container IDs")
+	fs.BoolVar(&opts.quiet, "quiet", false, "only print container IDs")
+	fs.BoolVar(&opts.noTrunc, "no-trunc", false, "show full container IDs and commands")
+	fs.StringVar(&opts.format, "format", "table", "output format: table or json")
+	if _, err := parseArgs(fs, psUsage, args, 0); err != nil {
+		return 0, err
+	}
+
+	containers, err := listContainers(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := printContainers(os.Stdout, containers, opts); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// statsCmd shows the resource usage of running containers, or of those given, refreshed
+// every second until interrupted, or once as JSON with --no-stream
+func statsCmd(args []string) (int, error) {
+	fs := newFlagSet("stats", statsUsage)
+	noStream := fs.Bool("no-stream", false, "print the usage once, as JSON, instead of a refreshing table")
+	rest, err := parseArgs(fs, statsUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	collector := &statsCollector{}
+	for _, ref := range rest {
+		id, err := resolveContainer(ref)
+		if err != nil {
+			return 0, err
+		}
+		state, err := loadContainerState(id)
+		if err != nil {
+			return 0, err
+		}
+		if !state.running() {
+			return 0, fmt.Errorf("container %s is not running", ref)
+		}
+		collector.ids = append(collector.ids, id)
+	}
+
+	// CPU usage is measured between two samples
+	if _, err := collector.collect(); err != nil {
+		return 0, err
+	}
+	clear := isTerminal(os.Stdout)
+	for {
+		time.Sleep(statsInterval)
+		stats, err := collector.collect()
+		if err != nil {
+			return 0, err
+		}
+		if *noStream {
+			return 0, printStatsJSON(os.Stdout, stats)
+		}
+
+		if clear {
+			fmt.Print("\033[2J\033[H")
+		}
+		if err := printStatsTable(os.Stdout, stats); err != nil {
+			return 0, err
+		}
+		// Once the containers asked for have exited there is nothing left to show
+		if collector.ids != nil && len(collector.samples) == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// topCmd lists the processes in a running container's PID namespace
+func topCmd(args []string) (int, error) {
+	fs := newFlagSet("top", topUsage)
+	format := fs.String("format", "table", "output format: table or json")
+	rest, err := parseArgs(fs, topUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(topUsage)
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+	state, err := loadContainerState(id)
+	if err != nil {
+		return 0, err
+	}
+	processes, err := listContainerProcesses(state)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, printContainerProcesses(os.Stdout, processes, *format)
+}
+
+// logsCmd prints the logged output of a container
+func logsCmd(args []string) (int, error) {
+	fs := newFlagSet("logs", logsUsage)
+	follow := fs.Bool("f", false, "keep printing new output until the container exits")
+	fs.BoolVar(follow, "follow", false, "keep printing new output until the container exits")
+	tail := fs.String("tail", "all", "number of lines to print from the end of the log")
+	since := fs.String("since", "", "only print output since a timestamp or a duration before now, e.g. 10m")
+	rest, err := parseArgs(fs, logsUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(logsUsage)
+	}
+
+	opts := logsOptions{follow: *follow}
+	if opts.tail, err = parseLogsTail(*tail); err != nil {
+		return 0, err
+	}
+	if opts.since, err = parseLogsSince(*since, time.Now()); err != nil {
+		return 0, err
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	if err := printContainerLogs(id, opts, os.Stdout, os.Stderr); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// attachCmd connects our terminal to a running container and returns its exit code, unless we
+// detach from it first
+func attachCmd(args []string) (int, error) {
+	fs := newFlagSet("attach", attachUsage)
+	detachKeys := fs.String("detach-keys", "", "key sequence for detaching from a container with a terminal (default: the container's)")
+	noStdin := fs.Bool("no-stdin", false, "do not pass our input to the container")
+	sigProxy := fs.Bool("sig-proxy", true, "pass the signals we receive on to a container without a terminal")
+	rest, err := parseArgs(fs, attachUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(attachUsage)
+	}
+	if *detachKeys != "" {
+		if _, err := ParseDetachKeys(*detachKeys); err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return attachContainer(id, attachOptions{detachKeys: *detachKeys, noStdin: *noStdin, sigProxy: *sigProxy})
+}
+
+// eventsCmd prints the recorded events that pass the filters, following new ones until it is
+// interrupted or --until is reached
+func eventsCmd(args []string) (int, error) {
+	fs := newFlagSet("events", eventsUsage)
+	since := fs.String("since", "", "print events since a timestamp or a duration before now, e.g. 10m")
+	until := fs.String("until", "", "stop at a timestamp or a duration before now instead of following new events")
+	var filterValues stringList
+	fs.Var(&filterValues, "filter", "only print matching events, "+strings.Join(eventFilterKeys, ", ")+"=<value>, can be repeated")
+	fs.Var(&filterValues, "f", "shorthand for --filter")
+	format := fs.String("format", "text", "output format: text or json")
+	rest, err := parseArgs(fs, eventsUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 0 {
+		return 0, errors.New(eventsUsage)
+	}
+	if *format != "text" && *format != "json" {
+		return 0, fmt.Errorf("invalid --format %q: expected text or json", *format)
+	}
+
+	now := time.Now()
+	opts := eventsOptions{json: *format == "json"}
+	if opts.since, err = parseTimeFlag("--since", *since, now); err != nil {
+		return 0, err
+	}
+	if opts.until, err = parseTimeFlag("--until", *until, now); err != nil {
+		return 0, err
+	}
+	if opts.filters, err = parseEventFilters(filterValues); err != nil {
+		return 0, err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	if err := printEvents(ctx, opts, os.Stdout); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// coresCmd lists the core dumps captured from a container
+func coresCmd(args []string) (int, error) {
+	rest, err := parseArgs(newFlagSet("cores", coresUsage), coresUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(coresUsage)
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	dumps, err := listCoreDumps(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := printCoreDumps(os.Stdout, dumps); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// rmCmd removes containers
+func rmCmd(args []string) (int, error) {
+	fs := newFlagSet("rm", rmUsage)
+	force := fs.Bool("f", false, "kill and remove running containers")
+	fs.BoolVar(force, "force", false, "kill and remove running containers")
+	ids, err := parseArgs(fs, rmUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return forEachContainer(ids, func(id string) error {
+		return removeContainer(id, *force)
+	})
+}
+
+// cpCmd copies files from a container to the host or the other way around
+func cpCmd(args []string) (int, error) {
+	fs := newFlagSet("cp", cpUsage)
+	var opts copyOptions
+	fs.BoolVar(&opts.archive, "a", false, "keep the owners of the copied files")
+	fs.BoolVar(&opts.archive, "archive", false, "keep the owners of the copied files")
+	rest, err := parseArgs(fs, cpUsage, args, 2)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 2 {
+		return 0, errors.New(cpUsage)
+	}
+
+	if rest[0] == "-" || rest[1] == "-" {
+		return 0, errors.New("cp doesn't stream tar archives: give a path on the host instead of -")
+	}
+	srcRef, srcPath := splitCopyArg(rest[0])
+	dstRef, dstPath := splitCopyArg(rest[1])
+	if (srcRef == "") == (dstRef == "") {
+		return 0, errors.New("cp copies between a container and the host: exactly one path must be <container>:<path>")
+	}
+	src := copyEndpoint{path: srcPath}
+	dst := copyEndpoint{path: dstPath}
+
+	ref, endpoint := srcRef, &src
+	if dstRef != "" {
+		ref, endpoint = dstRef, &dst
+	}
+	id, err := resolveContainer(ref)
+	if err != nil {
+		return 0, err
+	}
+	container, writable, release, err := openContainerPath(id, endpoint.path)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if dstRef != "" && !writable {
+		return 0, fmt.Errorf("cannot copy into stopped container %s: a --shared-rootfs container only has a writable root while it runs", ref)
+	}
+	*endpoint = container
+
+	return 0, copyFiles(src, dst, opts)
+}
+
+// commitCmd stores a container's changes as a new image and prints its ID
+func commitCmd(args []string) (int, error) {
+	fs := newFlagSet("commit", commitUsage)
+	var opts commitOptions
+	fs.StringVar(&opts.Message, "m", "", "commit message, recorded in the image's history")
+	fs.StringVar(&opts.Message, "message", "", "commit message, recorded in the image's history")
+	fs.StringVar(&opts.Author, "a", "", "author of the image, e.g. \"Jane Doe <jane@example.com>\"")
+	fs.StringVar(&opts.Author, "author", "", "author of the image, e.g. \"Jane Doe <jane@example.com>\"")
+	compression := fs.String("compression", compressionGzip, "compression of the layer: gzip[:1-9], zstd[:1-19] or none")
+	rest, err := parseArgs(fs, commitUsage, args, 2)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 2 {
+		return 0, errors.New(commitUsage)
+	}
+	if opts.Compression, err = parseLayerCompression(*compression); err != nil {
+		return 0, err
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+	img, err := commitContainer(id, rest[1], opts)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Println(img.Manifest.Config.Digest)
+
+	return 0, nil
+}
+
+// buildCmd builds an image from a Dockerfile and the files of a context directory
+func buildCmd(args []string) (int, error) {
+	fs := newFlagSet("build", buildUsage)
+	var opts buildOptions
+	var tags stringList
+	fs.Var(&tags, "t", "name and optionally tag of the image, name:tag, can be repeated")
+	fs.Var(&tags, "tag", "name and optionally tag of the image, name:tag, can be repeated")
+	fs.StringVar(&opts.Dockerfile, "f", "", "path of the Dockerfile, default <context>/Dockerfile")
+	fs.StringVar(&opts.Dockerfile, "file", "", "path of the Dockerfile, default <context>/Dockerfile")
+	fs.BoolVar(&opts.NoCache, "no-cache", false, "run every step instead of using the images of unchanged ones from earlier builds")
+	var buildArgs stringList
+	fs.Var(&buildArgs, "build-arg", "set a build arg, NAME=value or NAME to take its value from the environment, can be repeated")
+	compression := fs.String("compression", compressionGzip, "compression of the layers: gzip[:1-9], zstd[:1-19] or none")
+	rest, err := parseArgs(fs, buildUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(buildUsage)
+	}
+	opts.Tags = tags
+	if opts.BuildArgs, err = parseBuildArgs(buildArgs); err != nil {
+		return 0, err
+	}
+	if opts.Compression, err = parseLayerCompression(*compression); err != nil {
+		return 0, err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	if _, err := buildImage(ctx, rest[0], opts); err != nil {
+		if ctx.Err() != nil {
+			return 0, context.Cause(ctx)
+		}
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// execCmd runs a command in a running container and returns its exit code
+func execCmd(args []string) (int, error) {
+	fs := newFlagSet("exec", execUsage)
+	var envs stringList
+	fs.Var(&envs, "e", "set an environment variable (NAME=value)")
+	fs.Var(&envs, "env", "set an environment variable (NAME=value)")
+	tty := fs.Bool("t", false, "allocate a pseudo-terminal")
+	fs.BoolVar(tty, "tty", false, "allocate a pseudo-terminal")
+	interactive := fs.Bool("i", false, "keep stdin attached")
+	fs.BoolVar(interactive, "interactive", false, "keep stdin attached")
+	ttyAndStdin := fs.Bool("it", false, "shorthand for -i -t")
+	user := fs.String("u", "", "user to run the command as (user[:group]), default the container's user")
+	fs.StringVar(user, "user", "", "user to run the command as (user[:group]), default the container's user")
+	rest, err := parseArgs(fs, execUsage, args, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := resolveContainer(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	return execInContainer(id, ExecOptions{
+		Command:     rest[1],
+		Args:        rest[2:],
+		Env:         envs,
+		User:        *user,
+		TTY:         *tty || *ttyAndStdin,
+		Interactive: *interactive || *ttyAndStdin,
+	})
+}
+
+// networkCmd lists networks, shows their settings or changes how their containers resolve
+// names. Settings take effect when a container is started.
+func networkCmd(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New(networkUsage)
+	}
+
+	switch args[0] {
+	case "ls":
+		fs := newFlagSet("network ls", networkUsage)
+		format := fs.String("format", "table", "output format: table or json")
+		if _, err := parseArgs(fs, networkUsage, args[1:], 0); err != nil {
+			return 0, err
+		}
+
+		networks, err := listNetworks()
+		if err != nil {
+			return 0, err
+		}
+		return 0, printNetworks(os.Stdout, networks, *format)
+	case "inspect":
+		rest, err := parseArgs(newFlagSet("network inspect", networkUsage), networkUsage, args[1:], 1)
+		if err != nil {
+			return 0, err
+		}
+
+		mode, err := ParseNetworkMode(rest[0])
+		if err != nil {
+			return 0, err
+		}
+		config, err := networkDNSConfig(mode)
+		if err != nil {
+			return 0, err
+		}
+		return 0, printNetworkDNSConfig(os.Stdout, networkSummary{Name: string(mode), Config: config})
+	case "dns":
+		return networkDNSCmd(args[1:])
+	}
+
+	return 0, fmt.Errorf("unknown network command %q\n%s", args[0], networkUsage)
+}
+
+// networkDNSCmd changes the DNS and hosts settings of a network. Only the settings given are
+// replaced, --reset goes back to the defaults first.
+func networkDNSCmd(args []string) (int, error) {
+	fs := newFlagSet("network dns", networkUsage)
+	policy := fs.String("policy", "", "where nameservers come from: host, static or embedded")
+	hosts := fs.String("hosts", "", "what /etc/hosts starts from: host or private")
+	reset := fs.Bool("reset", false, "go back to the default settings before applying the others")
+	var servers, search, options, extraHosts stringList
+	fs.Var(&servers, "dns", "nameserver of the static policy or upstream of the embedded resolver (repeatable)")
+	fs.Var(&search, "dns-search", "DNS search domain (repeatable)")
+	fs.Var(&options, "dns-option", "resolv.conf option, e.g. ndots:2 (repeatable)")
+	fs.Var(&extraHosts, "add-host", "add a name:ip entry to /etc/hosts (repeatable)")
+	rest, err := parseArgs(fs, networkUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	mode, err := ParseNetworkMode(rest[0])
+	if err != nil {
+		return 0, err
+	}
+
+	config, err := updateNetworkDNSConfig(mode, func(c *NetworkDNSConfig) error {
+		if *reset {
+			*c = NetworkDNSConfig{}
+		}
+		if *policy != "" {
+			c.Policy = DNSPolicy(*policy)
+		}
+		if *hosts != "" {
+			c.Hosts = HostsPolicy(*hosts)
+		}
+		if len(servers) > 0 {
+			c.Servers = servers
+		}
+		if len(search) > 0 {
+			c.Search = search
+		}
+		if len(options) > 0 {
+			c.Options = options
+		}
+		if len(extraHosts) > 0 {
+			c.ExtraHosts = extraHosts
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to configure %s network: %w", mode, err)
+	}
+
+	return 0, printNetworkDNSConfig(os.Stdout, networkSummary{Name: string(mode), Config: config})
+}
+
+// identityCmd runs the identity subcommands
+func identityCmd(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New(identityUsage)
+	}
+
+	switch args[0] {
+	case "key":
+		return identityKeyCmd(args[1:])
+	case "verify":
+		return identityVerifyCmd(args[1:])
+	}
+
+	return 0, fmt.Errorf("unknown identity command %q\n%s", args[0], identityUsage)
+}
+
+// identityKeyCmd prints the public key that identity tokens are verified with, creating the
+// signing key if no container has asked for a token yet
+func identityKeyCmd(args []string) (int, error) {
+	fs := newFlagSet("identity key", identityUsage)
+	format := fs.String("format", "pem", "output format: pem or jwks")
+	if _, err := parseArgs(fs, identityUsage, args, 0); err != nil {
+		return 0, err
+	}
+
+	key, err := loadIdentityKey()
+	if err != nil {
+		return 0, err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+
+	var data []byte
+	switch *format {
+	case "pem":
+		data, err = identityPublicKeyPEM(pub)
+	case "jwks":
+		data, err = identityJWKS(pub)
+		data = append(data, '\n')
+	default:
+		return 0, fmt.Errorf("invalid --format %q: expected pem or jwks", *format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	os.Stdout.Write(data)
+
+	return 0, nil
+}
+
+// identityVerifyCmd checks a token of this host, read from stdin if none is given, and
+// prints its claims
+func identityVerifyCmd(args []string) (int, error) {
+	fs := newFlagSet("identity verify", identityUsage)
+	rest, err := parseArgs(fs, identityUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 1 {
+		return 0, errors.New(identityUsage)
+	}
+
+	token := ""
+	if len(rest) == 1 && rest[0] != "-" {
+		token = rest[0]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read token: %w", err)
+		}
+		token = string(data)
+	}
+
+	key, err := loadIdentityKey()
+	if err != nil {
+		return 0, err
+	}
+	claims, err := verifyIdentityToken(key.Public().(ed25519.PublicKey), strings.TrimSpace(token), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	fmt.Println(string(data))
+
+	return 0, nil
+}
+
+// composeCmd loads the compose file, the one in the current directory without -f, and runs
+// up or down on its services
+func composeCmd(args []string) (int, error) {
+	fs := newFlagSet("compose", composeUsage)
+	file := fs.String("f", "", "compose file, default compose.yaml or docker-compose.yml in the current directory")
+	fs.StringVar(file, "file", "", "compose file, default compose.yaml or docker-compose.yml in the current directory")
+	project := fs.String("p", "", "project name the containers are named after, default the file's name field or its directory")
+	fs.StringVar(project, "project-name", "", "project name the containers are named after, default the file's name field or its directory")
+	rest, err := parseArgs(fs, composeUsage, args, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	path := *file
+	if path == "" {
+		if path, err = findComposeFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	switch rest[0] {
+	case "up":
+		fs := newFlagSet("compose up", composeUsage)
+		detach := fs.Bool("d", false, "start the services in the background instead of printing their output")
+		fs.BoolVar(detach, "detach", false, "start the services in the background instead of printing their output")
+		if _, err := parseArgs(fs, composeUsage, rest[1:], 0); err != nil {
+			return 0, err
+		}
+		if fs.NArg() > 0 {
+			return 0, errors.New(composeUsage)
+		}
+		p, err := loadComposeProject(path, *project)
+		if err != nil {
+			return 0, err
+		}
+
+		ctx, stop := interruptContext()
+		defer stop()
+		return 0, composeUp(ctx, p, *detach, os.Stdout, os.Stderr)
+	case "down":
+		fs := newFlagSet("compose down", composeUsage)
+		seconds := fs.Int("t", int(defaultStopTimeout/time.Second), "seconds to wait for a container to stop before killing it, instead of its stop_grace_period")
+		fs.IntVar(seconds, "timeout", int(defaultStopTimeout/time.Second), "seconds to wait for a container to stop before killing it, instead of its stop_grace_period")
+		if _, err := parseArgs(fs, composeUsage, rest[1:], 0); err != nil {
+			return 0, err
+		}
+		if fs.NArg() > 0 {
+			return 0, errors.New(composeUsage)
+		}
+		if *seconds < 0 {
+			return 0, errors.New("invalid --timeout: must not be negative")
+		}
+		p, err := loadComposeProject(path, *project)
+		if err != nil {
+			return 0, err
+		}
+
+		// Without --timeout, every service gets its own stop_grace_period
+		timeout := time.Duration(-1)
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "t" || f.Name == "timeout" {
+				timeout = time.Duration(*seconds) * time.Second
+			}
+		})
+		return 0, composeDown(p, timeout, os.Stderr)
+	}
+
+	return 0, fmt.Errorf("unknown compose command %q\n%s", rest[0], composeUsage)
+}
+
+// daemonCmd serves the API until it is interrupted
+func daemonCmd(args []string) (int, error) {
+	fs := newFlagSet("daemon", daemonUsage)
+	host := fs.String("H", defaultDaemonSocket, "unix socket to listen on, a path or unix:// URL")
+	fs.StringVar(host, "host", defaultDaemonSocket, "unix socket to listen on, a path or unix:// URL")
+	maxJobs := fs.Int("max-concurrent-jobs", defaultMaxConcurrentJobs, "how many pulls and builds run at once, the others wait in the queue")
+	webhookToken := fs.String("webhook-token", "", "serve POST /webhooks/registry to requests with Authorization: Bearer <this token>, which replaces the running containers labelled "+autoUpdateLabel+"=true when their image is pushed")
+	webhookAddr := fs.String("webhook-addr", "", "also serve the registry webhook, and only it, on this TCP address, e.g. :9090")
+	rest, err := parseArgs(fs, daemonUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(rest) > 0 {
+		return 0, errors.New(daemonUsage)
+	}
+
+	path := strings.TrimPrefix(*host, "unix://")
+	if !filepath.IsAbs(path) {
+		return 0, fmt.Errorf("invalid -H %q: expected the absolute path of a unix socket", *host)
+	}
+	if *maxJobs < 1 {
+		return 0, fmt.Errorf("invalid --max-concurrent-jobs %d: expected at least 1", *maxJobs)
+	}
+
+	if *webhookAddr != "" && *webhookToken == "" {
+		return 0, errors.New("--webhook-addr needs a --webhook-token")
+	}
+
+	if err := serveDaemon(path, *maxJobs, *webhookToken, *webhookAddr); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// systemCmd dispatches the host-wide subcommands
+func systemCmd(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, errors.New(systemUsage)
+	}
+
+	switch args[0] {
+	case "autoremove":
+		return systemAutoremoveCmd(args[1:])
+	case "prune":
+		return systemPruneCmd(args[1:])
+	case "migrate":
+		return systemMigrateCmd(args[1:])
+	}
+
+	return 0, fmt.Errorf("unknown system command %q\n%s", args[0], systemUsage)
+}
+
+// systemPruneCmd removes the containers that aren't running and the image data nothing uses
+// anymore, after asking unless -f is given
+func systemPruneCmd(args []string) (int, error) {
+	fs := newFlagSet("system prune", systemUsage)
+	force := fs.Bool("f", false, "don't prompt for confirmation")
+	fs.BoolVar(force, "force", false, "don't prompt for confirmation")
+	if _, err := parseArgs(fs, systemUsage, args, 0); err != nil {
+		return 0, err
+	}
+
+	if !*force {
+		fmt.Print("WARNING! This will remove:\n" +
+			"  - all stopped containers\n" +
+			"  - all image blobs and cached layers no tagged image or container uses\n" +
+			"Are you sure you want to continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return 0, nil
+		}
+	}
+
+	report, err := pruneSystem(NewImageStore(imageStoreDir))
+	printPruneReport(os.Stdout, report)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// systemMigrateCmd converts the root filesystems of containers that aren't running to another
+// layout, all of them unless some are given. Without containers the images are converted
+// too: their layers are cached for overlay, and cached layers no container uses anymore are
+// removed for copy.
+func systemMigrateCmd(args []string) (int, error) {
+	fs := newFlagSet("system migrate", systemUsage)
+	to := fs.String("to", "", "layout to convert to, overlay or copy")
+	refs, err := parseArgs(fs, systemUsage, args, 0)
+	if err != nil {
+		return 0, err
+	}
+	if *to != storageOverlay && *to != storageCopy {
+		return 0, fmt.Errorf("invalid --to %q: expected %s or %s", *to, storageOverlay, storageCopy)
+	}
+	if *to == storageOverlay && !hasFilesystem("overlay") {
+		return 0, errors.New("overlayfs isn't available on this host")
+	}
+
+	var ids []string
+	if len(refs) == 0 {
+		states, err := listContainerStates()
+		if err != nil {
+			return 0, err
+		}
+		for _, state := range states {
+			ids = append(ids, state.ID)
+		}
+	}
+	for _, ref := range refs {
+		id, err := resolveContainer(ref)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+
+	code := 0
+	for i, id := range ids {
+		fmt.Printf("[%d/%d] %s: migrating to %s\n", i+1, len(ids), shortID(id), *to)
+		m, err := migrateContainer(id, *to)
+		switch {
+		case errors.Is(err, errAlreadyMigrated):
+			fmt.Printf("[%d/%d] %s: already uses %s\n", i+1, len(ids), shortID(id), *to)
+		case err != nil:
+			errorf(eventTypeContainer, "%v, left as it was", err)
+			code = 1
+		case *to == storageOverlay:
+			fmt.Printf("[%d/%d] %s: %d changed files, %d deleted, %s -> %s\n", i+1, len(ids), shortID(id), m.files, m.whiteouts, formatSize(m.before), formatSize(m.after))
+		default:
+			fmt.Printf("[%d/%d] %s: %d files copied, %s -> %s\n", i+1, len(ids), shortID(id), m.files, formatSize(m.before), formatSize(m.after))
+		}
+	}
+	if len(refs) > 0 {
+		return code, nil
+	}
+
+	store := NewImageStore(imageStoreDir)
+	if *to == storageOverlay {
+		n, err := cacheStoredImages(store, false)
+		fmt.Printf("Cached the layers of %d images\n", n)
+		if err != nil {
+			return 0, err
+		}
+		return code, nil
+	}
+
+	states, err := listContainerStates()
+	if err != nil {
+		return 0, err
+	}
+	mounted := map[string]bool{}
+	for _, state := range states {
+		for _, dir := range state.Layers {
+			mounted[dir] = true
+		}
+	}
+	pruned, freed, err := pruneLayers(nil, mounted)
+	fmt.Printf("Removed %d cached layers, reclaimed %s\n", len(pruned), formatSize(freed))
+	if err != nil {
+		return 0, err
+	}
+
+	return code, nil
+}
+
+// systemAutoremoveCmd shows or, with --ttl, sets how long exited containers are kept. A
+// container's own --ttl takes precedence.
+func systemAutoremoveCmd(args []string) (int, error) {
+	fs := newFlagSet("system autoremove", systemUsage)
+	ttl := fs.String("ttl", "", "remove exited containers this long after they exit, e.g. 24h; 0 keeps them")
+	if _, err := parseArgs(fs, systemUsage, args, 0); err != nil {
+		return 0, err
+	}
+
+	policy, err := readAutoremovePolicy()
+	if err != nil {
+		return 0, err
+	}
+
+	if *ttl != "" {
+		d, err := time.ParseDuration(*ttl)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid --ttl %q: expected a duration such as 24h, or 0", *ttl)
+		}
+		policy.TTL = d
+		if err := writeAutoremovePolicy(policy); err != nil {
+			return 0, err
+		}
+	}
+
+	if policy.TTL == 0 {
+		fmt.Println("Exited containers are kept until they are removed")
+	} else {
+		fmt.Printf("Exited containers are removed %s after they exit\n", policy.TTL)
+	}
+
+	return 0, nil
+}
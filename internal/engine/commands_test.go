@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Every subcommand defines its flags before parsing -h, so asking each for help catches a
+// flag defined twice, which panics
+func TestCommandFlagSets(t *testing.T) {
+	saved := flagErrorHandling
+	flagErrorHandling = flag.ContinueOnError
+	t.Cleanup(func() { flagErrorHandling = saved })
+	// Help goes to stderr
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { devNull.Close() })
+	stderr := os.Stderr
+	os.Stderr = devNull
+	t.Cleanup(func() { os.Stderr = stderr })
+
+	// Commands that dispatch to subcommands with flag sets of their own. Those of compose
+	// come after reading the compose file.
+	subcommands := map[string][]string{
+		"bundle":   {"create", "install"},
+		"image":    {"containers"},
+		"sandbox":  {"run"},
+		"network":  {"ls", "inspect", "dns"},
+		"identity": {"key", "verify"},
+		"system":   {"autoremove", "prune", "migrate"},
+	}
+	var tests [][]string
+	for _, cmd := range commands {
+		if subs, ok := subcommands[cmd.name]; ok {
+			for _, sub := range subs {
+				tests = append(tests, []string{cmd.name, sub, "-h"})
+			}
+			continue
+		}
+		tests = append(tests, []string{cmd.name, "-h"})
+	}
+
+	for _, args := range tests {
+		t.Run(strings.Join(args[:len(args)-1], " "), func(t *testing.T) {
+			var run func([]string) (int, error)
+			for _, cmd := range commands {
+				if cmd.name == args[0] {
+					run = cmd.run
+				}
+			}
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("defining the flags panicked: %v", r)
+				}
+			}()
+			if _, err := run(args[1:]); !errors.Is(err, flag.ErrHelp) {
+				t.Errorf("error = %v, want %v", err, flag.ErrHelp)
+			}
+		})
+	}
+}
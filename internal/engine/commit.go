@@ -0,0 +1,587 @@
+package engine
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// eventActionCommit is published for the image a container is committed to
+const eventActionCommit = "commit"
+
+// Media types of the layer commit adds, matching the manifest flavour of the image below it
+const (
+	mediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// commitExcluded are the files of a root filesystem that belong to the container rather than
+// its image: the init writes them for every start, so they are left out of committed layers
+var commitExcluded = map[string]bool{
+	"etc/hostname":    true,
+	"etc/hosts":       true,
+	"etc/resolv.conf": true,
+}
+
+// commitOptions describe the image a container is committed to
+type commitOptions struct {
+	// Message and Author are recorded in the history and config of the image
+	Message string
+	Author  string
+	// CreatedBy is the command the history entry names, your_docker.sh commit by default
+	CreatedBy string
+	// Compression is how the layer is compressed
+	Compression layerCompression
+}
+
+// commitContainer stores the changes the container made to its image's files as a new layer
+// on top of the image, tagged ref. The changes of an overlay rootfs are its upper directory;
+// those of a copy are worked out against the image's layers like migrating it to an overlay
+// would. A running container is committed as it is, without pausing it.
+func commitContainer(id, ref string, opts commitOptions) (*StoredImage, error) {
+	name, tag, err := parseImageReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	if isTarballURL(ref) || pinnedDigest(tag) != "" {
+		return nil, fmt.Errorf("invalid image reference %q: expected a name with an optional tag", ref)
+	}
+
+	lock, err := lockState(id)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewImageStore(imageStoreDir)
+	storeLock, err := store.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Close()
+
+	base, layer, diffID, err := commitLayer(store, state, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	baseConfig, err := store.readBlob(base.Manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config, err := committedConfig(baseConfig, diffID, opts)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := store.writeImage(base, config, append(append([]layerEntry{}, base.Manifest.Layers...), layer))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := store.tag(name, tag, digest); err != nil {
+		return nil, err
+	}
+
+	img, err := store.lookup(name, tag)
+	if err != nil {
+		return nil, err
+	}
+	bus.Publish(Event{
+		Type:       eventTypeImage,
+		Action:     eventActionCommit,
+		ID:         img.Reference(),
+		Attributes: map[string]string{"digest": digest, "container": id},
+	})
+
+	return img, nil
+}
+
+// commitLayer writes what a container changed on top of its image as a layer compressed
+// with compression, and returns the container's image, the layer and the digest of the
+// layer's uncompressed contents. The caller holds the container's state lock and the store
+// lock.
+func commitLayer(store *ImageStore, state *ContainerState, compression layerCompression) (*StoredImage, layerEntry, string, error) {
+	id := state.ID
+	if state.LowerDir != "" {
+		return nil, layerEntry{}, "", fmt.Errorf("cannot commit %s: its --shared-rootfs writes are in a tmpfs only the container sees", shortID(id))
+	}
+	if state.ImageDigest == "" {
+		return nil, layerEntry{}, "", fmt.Errorf("cannot commit %s: it wasn't created from a stored image, so its layers aren't known", shortID(id))
+	}
+
+	base, err := store.imageByDigest(state.ImageDigest)
+	if err != nil {
+		return nil, layerEntry{}, "", fmt.Errorf("failed to read the image of %s: %w", shortID(id), err)
+	}
+
+	upper, release, err := containerChanges(store, state, base)
+	if err != nil {
+		return nil, layerEntry{}, "", fmt.Errorf("failed to collect the changes of %s: %w", shortID(id), err)
+	}
+	defer release()
+	merged := ""
+	if len(state.Layers) > 0 {
+		merged = overlayMergedDir(state.RootPath)
+	}
+
+	layer, diffID, err := store.writeLayer(upper, merged, state.Config.UserNamespace, compression)
+	if err != nil {
+		return nil, layerEntry{}, "", fmt.Errorf("failed to write the layer of %s: %w", shortID(id), err)
+	}
+	layer.MediaType = compression.mediaType(base.Manifest.Config.MediaType == mediaTypeDockerConfig)
+
+	return base, layer, diffID, nil
+}
+
+// writeImage stores an image with config and layers in the manifest flavour of base, the
+// image it was made from, and returns the digest of its manifest. Docker's manifests have no
+// media type for zstd or uncompressed layers, so an image with one is written as an OCI
+// image, whose media types then replace Docker's ones of the other layers too.
+func (s *ImageStore) writeImage(base *StoredImage, config []byte, layers []layerEntry) (string, error) {
+	configDigest, err := s.writeBlob(config)
+	if err != nil {
+		return "", err
+	}
+
+	docker := base.Manifest.Config.MediaType == mediaTypeDockerConfig
+	for _, layer := range layers {
+		if _, ok := ociLayerMediaTypes[layer.MediaType]; !ok {
+			docker = false
+		}
+	}
+	if !docker {
+		layers = slices.Clone(layers)
+		for i, layer := range layers {
+			if mediaType, ok := ociLayerMediaTypes[layer.MediaType]; ok {
+				layers[i].MediaType = mediaType
+			}
+		}
+	}
+
+	manifest := tarballManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        layerEntry{MediaType: mediaTypeOCIConfig, Digest: configDigest, Size: int64(len(config))},
+		Layers:        layers,
+	}
+	if docker {
+		manifest.MediaType = mediaTypeDockerManifest
+		manifest.Config.MediaType = mediaTypeDockerConfig
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode image manifest: %w", err)
+	}
+
+	return s.writeBlob(data)
+}
+
+// containerChanges returns a directory holding what the container changed in the overlay
+// format. That of an overlay rootfs is its upper directory; for a copy, one is built in a
+// temporary directory that the returned function removes.
+func containerChanges(store *ImageStore, state *ContainerState, base *StoredImage) (string, func(), error) {
+	if len(state.Layers) > 0 {
+		// Renamed directories are read from the merged view, which stays mounted until the
+		// container is removed, unless the host rebooted
+		if err := mountOverlayRootfs(state.RootPath, state.Layers); err != nil {
+			return "", nil, err
+		}
+		return overlayUpperDir(state.RootPath), func() {}, nil
+	}
+
+	layers, err := store.layerDirs(base, state.Config.UserNamespace, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(state.RootPath), "commit-")
+	if err != nil {
+		return "", nil, err
+	}
+	lower, unmount, err := mountLowerView(layers, tmp+".lower")
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", nil, err
+	}
+	release := func() {
+		unmount()
+		os.RemoveAll(tmp)
+	}
+
+	upper := overlayUpperDir(tmp)
+	if err := os.Mkdir(upper, 0755); err != nil {
+		release()
+		return "", nil, err
+	}
+	if err := copyDirMetadata(state.RootPath, upper); err != nil {
+		release()
+		return "", nil, err
+	}
+	d := &upperDiff{copy: state.RootPath, lower: lower, upper: upper, made: map[string]bool{}}
+	if err := d.addChanges(); err != nil {
+		release()
+		return "", nil, err
+	}
+	if err := d.addWhiteouts(); err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return upper, release, nil
+}
+
+// writeLayer stores the changes in upper, an overlay upper directory, as a layer blob
+// compressed with compression and returns it with the digest of its uncompressed tar stream.
+// Directories renamed in the overlay are taken from merged as a whole.
+func (s *ImageStore) writeLayer(upper, merged string, userns bool, compression layerCompression) (layerEntry, string, error) {
+	tmp, err := s.tempBlob()
+	if err != nil {
+		return layerEntry{}, "", err
+	}
+	defer os.Remove(tmp)
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return layerEntry{}, "", err
+	}
+	defer out.Close()
+
+	compressed := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, compressed)}
+	zw := compression.newWriter(counter)
+	uncompressed := sha256.New()
+	w := &layerWriter{tw: tar.NewWriter(io.MultiWriter(zw, uncompressed)), userns: userns, links: map[[2]uint64]string{}}
+
+	if err := w.addUpper(upper, merged); err != nil {
+		return layerEntry{}, "", err
+	}
+	if err := w.tw.Close(); err != nil {
+		return layerEntry{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return layerEntry{}, "", err
+	}
+	if err := out.Close(); err != nil {
+		return layerEntry{}, "", err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(compressed.Sum(nil))
+	if err := s.commitBlob(digest, tmp); err != nil {
+		return layerEntry{}, "", err
+	}
+
+	return layerEntry{Digest: digest, Size: counter.n}, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// layerWriter writes files into a layer tarball
+type layerWriter struct {
+	tw *tar.Writer
+	// userns shifts owners back out of the user namespace's range, like the image had them
+	userns bool
+	// links are the names files with several links were first written under
+	links map[[2]uint64]string
+}
+
+// addUpper writes an overlay upper directory as a layer, turning its whiteouts back into
+// the .wh. files of layer tarballs
+func (w *layerWriter) addUpper(upper, merged string) error {
+	return filepath.WalkDir(upper, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if commitExcluded[rel] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to stat %s", rel)
+		}
+
+		// A 0:0 character device deletes the file below
+		if info.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			return w.addWhiteout(filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel)), info)
+		}
+		if err := w.add(path, rel, info); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		switch {
+		case rel == "dev":
+			// The devices the container gets are created for every start
+			return fs.SkipDir
+		case merged != "" && hasXattr(path, "trusted.overlay.redirect"):
+			// A renamed directory only holds what changed since, relative to where it was
+			if err := w.addWhiteout(filepath.Join(rel, whiteoutOpaque), info); err != nil {
+				return err
+			}
+			return w.addTree(filepath.Join(merged, rel), rel)
+		case hasXattr(path, "trusted.overlay.opaque"):
+			return w.addWhiteout(filepath.Join(rel, whiteoutOpaque), info)
+		}
+		return nil
+	})
+}
+
+// addTree writes everything below dir under the name rel
+func (w *layerWriter) addTree(dir, rel string) error {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		sub, err := filepath.Rel(dir, path)
+		if err != nil || sub == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return w.add(path, filepath.Join(rel, sub), info)
+	})
+	if err != nil {
+		return err
+	}
+
+	return fs.SkipDir
+}
+
+// add writes the file at path under the name rel, with its extended attributes other than
+// the overlay's own
+func (w *layerWriter) add(path, rel string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSocket != 0 {
+		// Sockets only mean something to the process listening on them
+		return nil
+	}
+	st := info.Sys().(*syscall.Stat_t)
+
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", rel, err)
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid, hdr.Gid = w.owner(int(st.Uid)), w.owner(int(st.Gid))
+	hdr.Uname, hdr.Gname = "", ""
+	// The writer would round to the nearest second, which can be in the future to tar
+	hdr.ModTime = info.ModTime().Truncate(time.Second)
+
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		if first, ok := w.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return w.tw.WriteHeader(hdr)
+		}
+		w.links[key] = hdr.Name
+	}
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		if err := addXattrRecords(hdr, path); err != nil {
+			return fmt.Errorf("failed to read extended attributes of %s: %w", rel, err)
+		}
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(w.tw, f); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", rel, err)
+	}
+
+	return nil
+}
+
+// addWhiteout writes an empty whiteout file, owned like the entry it stands for
+func (w *layerWriter) addWhiteout(name string, info fs.FileInfo) error {
+	return w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Mode:     0644,
+		ModTime:  info.ModTime().Truncate(time.Second),
+	})
+}
+
+// owner returns the ID a file owned by id on the host has in the image
+func (w *layerWriter) owner(id int) int {
+	if w.userns && id >= userNamespaceHostID && id < userNamespaceHostID+userNamespaceSize {
+		return id - userNamespaceHostID
+	}
+
+	return id
+}
+
+// addXattrRecords adds the extended attributes of path to hdr as PAX records, leaving out the
+// trusted ones overlayfs keeps its own bookkeeping in
+func addXattrRecords(hdr *tar.Header, path string) error {
+	size, err := syscall.Listxattr(path, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.") {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return err
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+	if hdr.PAXRecords != nil {
+		hdr.Format = tar.FormatPAX
+	}
+
+	return nil
+}
+
+// getXattr returns the value of an extended attribute of path
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(path, name, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// hasXattr reports whether path has an extended attribute, like overlayfs sets
+// trusted.overlay.opaque to y on directories that hide the layers below
+func hasXattr(path, name string) bool {
+	_, err := syscall.Getxattr(path, name, nil)
+	return err == nil
+}
+
+// committedConfig returns the config of the image a container is committed to: that of its
+// image with the new layer and a history entry added. Without a diff ID the entry is marked as
+// one that didn't add a layer, like those of build steps that only change the config.
+func committedConfig(base []byte, diffID string, opts commitOptions) ([]byte, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(base, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+
+	var rootfs struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	}
+	if data, ok := config["rootfs"]; ok {
+		if err := json.Unmarshal(data, &rootfs); err != nil {
+			return nil, fmt.Errorf("failed to parse image config: %w", err)
+		}
+	}
+	rootfs.Type = "layers"
+	if diffID != "" {
+		rootfs.DiffIDs = append(rootfs.DiffIDs, diffID)
+	}
+
+	var history []json.RawMessage
+	if data, ok := config["history"]; ok {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return nil, fmt.Errorf("failed to parse image config: %w", err)
+		}
+	}
+	now := time.Now().UTC()
+	createdBy := opts.CreatedBy
+	if createdBy == "" {
+		createdBy = "your_docker.sh commit"
+	}
+	entry, err := json.Marshal(struct {
+		Created    time.Time `json:"created"`
+		CreatedBy  string    `json:"created_by"`
+		Author     string    `json:"author,omitempty"`
+		Comment    string    `json:"comment,omitempty"`
+		EmptyLayer bool      `json:"empty_layer,omitempty"`
+	}{now, createdBy, opts.Author, opts.Message, diffID == ""})
+	if err != nil {
+		return nil, err
+	}
+	history = append(history, entry)
+
+	fields := map[string]any{"created": now, "rootfs": rootfs, "history": history}
+	if opts.Author != "" {
+		fields["author"] = opts.Author
+	}
+	for key, value := range fields {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image config: %w", err)
+		}
+		config[key] = data
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image config: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,636 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// composeFileNames are looked for in the current directory when compose gets no -f, in the
+// order docker compose looks for them
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// composeHealthPollInterval is how often up looks at the health of a dependency it waits for
+const composeHealthPollInterval = 250 * time.Millisecond
+
+// Conditions of depends_on that up waits for before starting a service
+const (
+	composeServiceStarted = "service_started"
+	composeServiceHealthy = "service_healthy"
+)
+
+// composeProject is an app of services loaded from a compose file
+type composeProject struct {
+	name string
+	// services are in the order they are started in, each after those it depends on
+	services []*composeService
+}
+
+// composeService is a service of a compose file, which runs as a single container
+type composeService struct {
+	name      string
+	opts      RunOptions
+	dependsOn []composeDependency
+	// stopSignal asks the container to exit, SIGTERM unless stop_signal is set
+	stopSignal syscall.Signal
+	// stopGracePeriod is how long the container gets to exit before it is killed, 0 for
+	// defaultStopTimeout
+	stopGracePeriod time.Duration
+}
+
+// composeDependency is a service that has to be started, or healthy, before another
+type composeDependency struct {
+	service string
+	healthy bool
+}
+
+// containerName returns the name of the service's container, <project>-<service>-1 like
+// docker compose names them
+func (p *composeProject) containerName(s *composeService) string {
+	return p.name + "-" + s.name + "-1"
+}
+
+// findComposeFile returns the compose file in the current directory
+func findComposeFile() (string, error) {
+	for _, name := range composeFileNames {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no compose file found: expected one of %s in the current directory, or -f", strings.Join(composeFileNames, ", "))
+}
+
+// loadComposeProject reads a compose file. The project is named name, or else by the file's
+// name field or its directory.
+func loadComposeProject(path, name string) (*composeProject, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+
+	root, err := parseSpecDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &specDecoder{file: path, dir: filepath.Dir(abs)}
+	p, err := d.composeProject(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = p.name
+	}
+	if name == "" {
+		name = filepath.Base(d.dir)
+	}
+	if p.name, err = composeProjectName(name); err != nil {
+		return nil, err
+	}
+	for _, s := range p.services {
+		s.opts.Name = p.containerName(s)
+		if err := validateContainerName(s.opts.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// composeProjectName normalizes a project name like docker compose does: lower case, with only
+// letters, digits, dashes and underscores
+func composeProjectName(name string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || (r == '-' || r == '_') && b.Len() > 0 {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("invalid project name %q: must contain a letter or digit", name)
+	}
+
+	return b.String(), nil
+}
+
+// composeProject validates the top-level mapping of a compose file
+func (d *specDecoder) composeProject(root *specNode) (*composeProject, error) {
+	if root.kind != mappingNode {
+		return nil, d.errorf(root, "", "expected a mapping at the top level, found %s", root.describe())
+	}
+
+	p := &composeProject{}
+	var services *specNode
+	for i, key := range root.keys {
+		value := root.values[i]
+		var err error
+
+		switch key.value {
+		case "services":
+			services = value
+		case "name":
+			p.name, err = d.string(value, "name")
+		case "version":
+			// Obsolete, docker compose ignores it too
+		default:
+			err = d.errorf(key, "", "unknown field %q", key.value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if services == nil {
+		return nil, d.errorf(root, "", "missing required field \"services\"")
+	}
+	if services.kind != mappingNode || len(services.keys) == 0 {
+		return nil, d.errorf(services, "services", "expected a mapping of services, found %s", services.describe())
+	}
+
+	byName := map[string]*composeService{}
+	var declared []*composeService
+	for i, key := range services.keys {
+		if !containerNamePattern.MatchString(key.value) {
+			return nil, d.errorf(key, "services", "invalid service name %q", key.value)
+		}
+		s, err := d.composeService(key.value, services.values[i], "services."+key.value)
+		if err != nil {
+			return nil, err
+		}
+		byName[s.name] = s
+		declared = append(declared, s)
+	}
+
+	for i, s := range declared {
+		for _, dep := range s.dependsOn {
+			if byName[dep.service] == nil {
+				return nil, d.errorf(services.values[i], "services."+s.name+".depends_on", "unknown service %q", dep.service)
+			}
+		}
+	}
+
+	// Each service after those it depends on, otherwise in the order of the file
+	visiting := map[string]bool{}
+	added := map[string]bool{}
+	var visit func(s *composeService, path []string) error
+	visit = func(s *composeService, path []string) error {
+		if added[s.name] {
+			return nil
+		}
+		path = append(path, s.name)
+		if visiting[s.name] {
+			return fmt.Errorf("%s: services depend on each other in a cycle: %s", d.file, strings.Join(path, " -> "))
+		}
+		visiting[s.name] = true
+		for _, dep := range s.dependsOn {
+			if err := visit(byName[dep.service], path); err != nil {
+				return err
+			}
+		}
+		added[s.name] = true
+		p.services = append(p.services, s)
+		return nil
+	}
+	for _, s := range declared {
+		if err := visit(s, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// composeService validates a service: its image, command, environment, volumes, ports and
+// the services it depends on
+func (d *specDecoder) composeService(name string, n *specNode, path string) (*composeService, error) {
+	if n.kind != mappingNode {
+		return nil, d.errorf(n, path, "expected a mapping, found %s", n.describe())
+	}
+
+	s := &composeService{name: name, stopSignal: syscall.SIGTERM}
+	for i, key := range n.keys {
+		value := n.values[i]
+		fieldPath := path + "." + key.value
+		var err error
+
+		switch key.value {
+		case "image":
+			s.opts.Image, err = d.string(value, fieldPath)
+		case "command":
+			var command []string
+			if command, err = d.command(value, fieldPath); err == nil && len(command) > 0 {
+				s.opts.Command, s.opts.Args = command[0], command[1:]
+			}
+		case "environment", "env":
+			s.opts.Env, err = d.env(value, fieldPath)
+		case "volumes":
+			if err = d.checkBindVolumes(value, fieldPath); err == nil {
+				s.opts.Mounts, err = d.mounts(value, fieldPath)
+			}
+		case "ports":
+			err = d.composePorts(value, fieldPath)
+		case "depends_on":
+			s.dependsOn, err = d.composeDependencies(value, fieldPath)
+		case "labels":
+			s.opts.Labels, err = d.labels(value, fieldPath)
+		case "stop_signal":
+			s.stopSignal, err = d.signal(value, fieldPath)
+		case "stop_grace_period":
+			s.stopGracePeriod, err = d.duration(value, fieldPath)
+		default:
+			err = d.errorf(key, path, "unknown field %q", key.value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.opts.Image == "" {
+		return nil, d.errorf(n, path, "missing required field \"image\"")
+	}
+
+	return s, nil
+}
+
+// checkBindVolumes rejects named volumes, whose source isn't a path. Only bind mounts of host
+// paths, relative to the compose file, are supported.
+func (d *specDecoder) checkBindVolumes(n *specNode, path string) error {
+	if n.kind != sequenceNode {
+		return nil
+	}
+
+	for i, item := range n.items {
+		if item.kind != scalarNode {
+			continue
+		}
+		source, _, _ := strings.Cut(item.value, ":")
+		if !strings.HasPrefix(source, ".") && !strings.HasPrefix(source, "/") {
+			return d.errorf(item, fmt.Sprintf("%s[%d]", path, i), "named volume %q isn't supported, use a path like ./%s", source, source)
+		}
+	}
+
+	return nil
+}
+
+// composePorts checks the ports of a service. Containers share the host's network, so a port
+// can only be published as itself, which it already is.
+func (d *specDecoder) composePorts(n *specNode, path string) error {
+	if n.kind != sequenceNode {
+		return d.errorf(n, path, "expected a list, found %s", n.describe())
+	}
+
+	for i, item := range n.items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		s, err := d.string(item, itemPath)
+		if err != nil {
+			return err
+		}
+
+		spec, _, _ := strings.Cut(s, "/")
+		parts := strings.Split(spec, ":")
+		container := parts[len(parts)-1]
+		if _, err := strconv.ParseUint(container, 10, 16); err != nil {
+			return d.errorf(item, itemPath, "invalid port %q: expected [[host_ip:]host_port:]container_port[/protocol]", s)
+		}
+		if len(parts) > 1 && parts[len(parts)-2] != container {
+			return d.errorf(item, itemPath, "can't publish port %s as %s: containers use the host's network, so their ports are the host's", container, parts[len(parts)-2])
+		}
+	}
+
+	return nil
+}
+
+// labels accepts a mapping of keys to values or a list of key=value entries
+func (d *specDecoder) labels(n *specNode, path string) (map[string]string, error) {
+	if n.kind == sequenceNode {
+		list, err := d.stringList(n, path)
+		if err != nil {
+			return nil, err
+		}
+		labels := map[string]string{}
+		for i, entry := range list {
+			if _, err := parseLabels(labels, []string{entry}); err != nil {
+				return nil, d.errorf(n.items[i], fmt.Sprintf("%s[%d]", path, i), "%v", err)
+			}
+		}
+		return labels, nil
+	}
+
+	if n.kind != mappingNode {
+		return nil, d.errorf(n, path, "expected a mapping or list, found %s", n.describe())
+	}
+
+	labels := make(map[string]string, len(n.keys))
+	for i, key := range n.keys {
+		value, err := d.string(n.values[i], path+"."+key.value)
+		if err != nil {
+			return nil, err
+		}
+		labels[key.value] = value
+	}
+
+	return labels, nil
+}
+
+// signal accepts a signal by name, such as SIGINT or INT, or by number
+func (d *specDecoder) signal(n *specNode, path string) (syscall.Signal, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return 0, err
+	}
+
+	sig, err := parseSignal(s)
+	if err != nil {
+		return 0, d.errorf(n, path, "%v", err)
+	}
+
+	return sig, nil
+}
+
+// composeDependencies accepts a list of services, or a mapping of services to their
+// condition: service_started or service_healthy
+func (d *specDecoder) composeDependencies(n *specNode, path string) ([]composeDependency, error) {
+	if n.kind == sequenceNode {
+		names, err := d.stringList(n, path)
+		if err != nil {
+			return nil, err
+		}
+		deps := make([]composeDependency, 0, len(names))
+		for _, name := range names {
+			deps = append(deps, composeDependency{service: name})
+		}
+		return deps, nil
+	}
+
+	if n.kind != mappingNode {
+		return nil, d.errorf(n, path, "expected a list or mapping, found %s", n.describe())
+	}
+
+	deps := make([]composeDependency, 0, len(n.keys))
+	for i, key := range n.keys {
+		value := n.values[i]
+		depPath := path + "." + key.value
+		dep := composeDependency{service: key.value}
+		if value.kind != mappingNode {
+			return nil, d.errorf(value, depPath, "expected a mapping, found %s", value.describe())
+		}
+		for j, field := range value.keys {
+			if field.value != "condition" {
+				return nil, d.errorf(field, depPath, "unknown field %q", field.value)
+			}
+			condition, err := d.string(value.values[j], depPath+".condition")
+			if err != nil {
+				return nil, err
+			}
+			switch condition {
+			case composeServiceStarted:
+			case composeServiceHealthy:
+				dep.healthy = true
+			default:
+				return nil, d.errorf(value.values[j], depPath+".condition", "expected %s or %s, found %q", composeServiceStarted, composeServiceHealthy, condition)
+			}
+		}
+		deps = append(deps, dep)
+	}
+
+	return deps, nil
+}
+
+// composeUp starts the services of a project, each once those it depends on are started or
+// healthy. Containers of a previous up are started again as they are, rather than recreated.
+// Unless detached, it then prints their output, prefixed by their names, until they exit or
+// ctx is cancelled, which stops them.
+func composeUp(ctx context.Context, p *composeProject, detach bool, stdout, stderr io.Writer) error {
+	started := time.Now()
+	ids := map[string]string{}
+	for _, s := range p.services {
+		for _, dep := range s.dependsOn {
+			if dep.healthy {
+				if err := waitUntilHealthy(ctx, ids[dep.service]); err != nil {
+					return fmt.Errorf("dependency %s of %s failed to start: %w", dep.service, s.name, err)
+				}
+			}
+		}
+
+		name := s.opts.Name
+		id, err := resolveContainer(name)
+		if errors.Is(err, errContainerNotFound) {
+			if id, err = CreateContainer(ctx, s.opts); err == nil {
+				fmt.Fprintf(stderr, "Container %s Created\n", name)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", s.name, err)
+		}
+		ids[s.name] = id
+
+		state, err := loadContainerState(id)
+		if err != nil {
+			return err
+		}
+		if state.running() {
+			fmt.Fprintf(stderr, "Container %s Running\n", name)
+			continue
+		}
+		if err := StartContainer(id); err != nil {
+			return fmt.Errorf("failed to start %s: %w", s.name, err)
+		}
+		fmt.Fprintf(stderr, "Container %s Started\n", name)
+	}
+
+	if detach {
+		return nil
+	}
+
+	width := 0
+	for _, s := range p.services {
+		width = max(width, len(p.containerName(s)))
+	}
+
+	var mu sync.Mutex
+	var following sync.WaitGroup
+	for _, s := range p.services {
+		prefix := fmt.Sprintf("%-*s | ", width, p.containerName(s))
+		out := &prefixWriter{mu: &mu, out: stdout, prefix: prefix}
+		following.Add(1)
+		go func(id string) {
+			defer following.Done()
+			// The output is complete once the container has exited
+			defer out.flush()
+			if err := printContainerLogs(id, logsOptions{follow: true, tail: -1, since: started}, out, out); err != nil {
+				warnf(eventTypeContainer, "%v", err)
+			}
+		}(ids[s.name])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		following.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	fmt.Fprintln(stderr, "Gracefully stopping...")
+	err := composeStop(p, -1, stderr)
+	<-done
+
+	return err
+}
+
+// waitUntilHealthy waits until the container's healthcheck passes, failing if it turns
+// unhealthy or the container exits first
+func waitUntilHealthy(ctx context.Context, id string) error {
+	ticker := time.NewTicker(composeHealthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, err := loadContainerState(id)
+		if err != nil {
+			return err
+		}
+		switch {
+		case state.Config.Healthcheck.disabled():
+			return fmt.Errorf("container %s has no healthcheck", state.Name)
+		case !state.running() && !state.restarting():
+			return fmt.Errorf("container %s exited (%d)", state.Name, state.ExitCode)
+		case state.Health != nil && state.Health.Status == healthHealthy:
+			return nil
+		case state.Health != nil && state.Health.Status == healthUnhealthy:
+			return fmt.Errorf("container %s is unhealthy", state.Name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopTimeout returns how long the service's container gets to exit before it is killed:
+// timeout unless it is negative, else its stop_grace_period
+func (s *composeService) stopTimeout(timeout time.Duration) time.Duration {
+	switch {
+	case timeout >= 0:
+		return timeout
+	case s.stopGracePeriod > 0:
+		return s.stopGracePeriod
+	default:
+		return defaultStopTimeout
+	}
+}
+
+// composeStop stops the running containers of a project, each before those it depends on,
+// so that a service has exited before what it uses goes away. Each gets its stop_signal and,
+// unless timeout isn't negative, its stop_grace_period before it is killed.
+func composeStop(p *composeProject, timeout time.Duration, stderr io.Writer) error {
+	var errs []error
+	for i := len(p.services) - 1; i >= 0; i-- {
+		s := p.services[i]
+		name := s.opts.Name
+		id, err := resolveContainer(name)
+		if errors.Is(err, errContainerNotFound) {
+			continue
+		}
+		if err == nil {
+			err = stopContainerWithSignal(id, s.stopSignal, s.stopTimeout(timeout))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop %s: %w", name, err))
+			continue
+		}
+		fmt.Fprintf(stderr, "Container %s Stopped\n", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// composeDown stops and removes the containers of a project, each before those it depends on,
+// stopping them like composeStop
+func composeDown(p *composeProject, timeout time.Duration, stderr io.Writer) error {
+	var errs []error
+	for i := len(p.services) - 1; i >= 0; i-- {
+		s := p.services[i]
+		name := s.opts.Name
+		id, err := resolveContainer(name)
+		if errors.Is(err, errContainerNotFound) {
+			continue
+		}
+		if err == nil {
+			err = stopContainerWithSignal(id, s.stopSignal, s.stopTimeout(timeout))
+		}
+		if err == nil {
+			err = removeContainer(id, false)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", name, err))
+			continue
+		}
+		fmt.Fprintf(stderr, "Container %s Removed\n", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// prefixWriter writes every line with a prefix, the name of the container it came from. The
+// writers of a project share mu, so their lines don't interleave.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	// partial is the start of a line whose end hasn't been written yet
+	partial []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// flush writes a last line that didn't end in a newline
+func (w *prefixWriter) flush() {
+	if len(w.partial) > 0 {
+		w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
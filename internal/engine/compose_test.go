@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeComposeFile writes a compose file into a temporary directory and returns its path
+func writeComposeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "compose.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestComposeStopSettings(t *testing.T) {
+	path := writeComposeFile(t, `
+name: shop
+services:
+  app:
+    image: shop-app
+    depends_on: [db]
+  db:
+    image: postgres:16
+    stop_signal: SIGINT
+    stop_grace_period: 1m30s
+`)
+	p, err := loadComposeProject(path, "")
+	if err != nil {
+		t.Fatalf("loadComposeProject() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		wantSignal     syscall.Signal
+		wantTimeout    time.Duration
+		wantOverridden time.Duration
+	}{
+		// Started first, so it is stopped last
+		{name: "db", wantSignal: syscall.SIGINT, wantTimeout: 90 * time.Second, wantOverridden: 5 * time.Second},
+		{name: "app", wantSignal: syscall.SIGTERM, wantTimeout: defaultStopTimeout, wantOverridden: 5 * time.Second},
+	}
+	if len(p.services) != len(tests) {
+		t.Fatalf("got %d services, want %d", len(p.services), len(tests))
+	}
+	for i, tt := range tests {
+		s := p.services[i]
+		if s.name != tt.name {
+			t.Errorf("service %d = %s, want %s", i, s.name, tt.name)
+			continue
+		}
+		if s.stopSignal != tt.wantSignal {
+			t.Errorf("%s stop signal = %v, want %v", s.name, s.stopSignal, tt.wantSignal)
+		}
+		if got := s.stopTimeout(-1); got != tt.wantTimeout {
+			t.Errorf("%s stopTimeout(-1) = %v, want %v", s.name, got, tt.wantTimeout)
+		}
+		if got := s.stopTimeout(5 * time.Second); got != tt.wantOverridden {
+			t.Errorf("%s stopTimeout(5s) = %v, want %v", s.name, got, tt.wantOverridden)
+		}
+	}
+}
+
+func TestComposeStopSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		wantErr string
+	}{
+		{name: "unknown signal", service: "stop_signal: SIGNOPE", wantErr: `services.db.stop_signal: invalid signal "SIGNOPE"`},
+		{name: "signal number out of range", service: "stop_signal: 99", wantErr: "no such signal number"},
+		{name: "grace period without unit", service: "stop_grace_period: 10", wantErr: `services.db.stop_grace_period: expected a positive duration such as 90s or 1h, found "10"`},
+		{name: "negative grace period", service: "stop_grace_period: -5s", wantErr: "expected a positive duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeComposeFile(t, "services:\n  db:\n    image: postgres:16\n    "+tt.service+"\n")
+			_, err := loadComposeProject(path, "shop")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadComposeProject() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,1311 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RunOptions holds the settings for a single container run
+type RunOptions struct {
+	Image string `json:"image"`
+	// Name is the name the container is given instead of a generated one
+	Name string `json:"name,omitempty"`
+	// Platform selects the image of a multi-platform image, e.g. linux/arm64
+	Platform string `json:"platform,omitempty"`
+	// ImageSHA256 is the checksum an image given as a tarball URL must have
+	ImageSHA256  string         `json:"imageSha256,omitempty"`
+	Command      string         `json:"command"`
+	Args         []string       `json:"args,omitempty"`
+	SecurityOpts []string       `json:"securityOpts,omitempty"`
+	CapAdd       []string       `json:"capAdd,omitempty"`
+	CapDrop      []string       `json:"capDrop,omitempty"`
+	Network      NetworkMode    `json:"network"`
+	IPC          IPCMode        `json:"ipc,omitempty"`
+	Env          []string       `json:"env,omitempty"`
+	Mounts       []Mount        `json:"mounts,omitempty"`
+	Limits       ResourceLimits `json:"limits,omitempty"`
+	SharedRootfs bool           `json:"sharedRootfs,omitempty"`
+	CoreDumps    bool           `json:"coreDumps,omitempty"`
+	// NoInit execs the command as the container's PID 1 instead of running it under our init
+	NoInit bool `json:"noInit,omitempty"`
+	// StrictImage refuses to create containers that fail the image compatibility check or an
+	// optional setup step, instead of warning
+	StrictImage bool     `json:"strictImage,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	DNS         []string `json:"dns,omitempty"`
+	DNSSearch   []string `json:"dnsSearch,omitempty"`
+	ExtraHosts  []string `json:"extraHosts,omitempty"`
+	// User is the user[:group] the command runs as, by name or ID, the image's USER by default
+	User string `json:"user,omitempty"`
+	// WorkingDir is where the command starts, the image's WORKDIR by default and / without one
+	WorkingDir string `json:"workingDir,omitempty"`
+	// HostCA mounts the host's CA bundle into images that don't have one
+	HostCA bool `json:"hostCA,omitempty"`
+	// Identity mounts a signed token of the container's identity, which it can show the
+	// services it calls
+	Identity bool `json:"identity,omitempty"`
+	// Policy is what the host's security policy decided for the image, set on creation
+	Policy *PolicyDefaults `json:"policy,omitempty"`
+	// Labels are metadata of the container, such as autoUpdateLabel
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// UserNamespace maps container root onto an unprivileged host ID range
+	UserNamespace  bool         `json:"userns,omitempty"`
+	ReadOnlyRootfs bool         `json:"readOnly,omitempty"`
+	Tmpfs          []TmpfsMount `json:"tmpfs,omitempty"`
+	Rlimits        []Rlimit     `json:"rlimits,omitempty"`
+	// CgroupParent is the directory the container's cgroup is created in instead of ours
+	CgroupParent string `json:"cgroupParent,omitempty"`
+	// Timeout kills the container once it has run for this long
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// AutoRemove deletes the container as soon as it exits
+	AutoRemove bool `json:"autoRemove,omitempty"`
+	// Restart is the policy by which the shim restarts the container once it exits
+	Restart RestartPolicy `json:"restart"`
+	// TTL removes the container this long after it exits, instead of the host's autoremove
+	// policy
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Requires are the host dependencies starting the container waits for, no longer than
+	// RequireTimeout
+	Requires       []HostDependency `json:"requires,omitempty"`
+	RequireTimeout time.Duration    `json:"requireTimeout,omitempty"`
+	// Healthcheck replaces what it sets of the image's HEALTHCHECK, and is the two combined
+	// once the container is created
+	Healthcheck *HealthConfig `json:"healthcheck,omitempty"`
+
+	TTY         bool   `json:"tty,omitempty"`
+	Interactive bool   `json:"interactive,omitempty"`
+	DetachKeys  string `json:"detachKeys,omitempty"`
+	// Detach makes run start the container in the background. It isn't part of the
+	// container, later starts are always in the background.
+	Detach bool `json:"-"`
+	// Quiet hides the progress of downloading and unpacking the image while creating
+	Quiet bool `json:"-"`
+	// NoCommand creates a container without a command, which build only copies files into
+	NoCommand bool `json:"-"`
+	// PreserveFds passes this many of our file descriptors from 3 on to the container at the
+	// same numbers. Like Detach, they only exist for this run.
+	PreserveFds int `json:"-"`
+}
+
+// ContainerEnvironment represents the environment for running a containerized command
+type ContainerEnvironment struct {
+	id       string
+	state    *ContainerState
+	command  string
+	args     []string
+	rootPath string
+	env      []string
+	user     string
+	mounts   []Mount
+	seccomp  []syscall.SockFilter
+	network  *containerNetwork
+	ipc      IPCMode
+	// workingDir is created if the image doesn't have it, like Docker does
+	workingDir string
+	// capabilities are those the container's processes keep
+	capabilities capabilitySet
+	// ipcJoin is the IPC of the shareable container a starting container joins, and ipcShm
+	// the host directory mounted as /dev/shm for an IPC that isn't private
+	ipcJoin  *ipcConnection
+	ipcShm   string
+	cgroup   *containerCgroup
+	hostname string
+	etcFiles map[string]string
+	// dnsUpstreams are forwarded to by the embedded resolver, the network's DNS policy
+	// decides whether there is one
+	dnsUpstreams []string
+	resolver     *embeddedResolver
+	lowerDir     string
+	// hostCA is the host's CA bundle, mounted into an image without one
+	hostCA string
+	// layers are the lower directories of an overlay rootfs mounted at rootPath/merged
+	layers   []string
+	userns   bool
+	readOnly bool
+	tmpfs    []TmpfsMount
+	rlimits  []Rlimit
+	timeout  time.Duration
+	// coreDumps captures core dumps into the state directory
+	coreDumps bool
+	// init runs the command under a PID 1 that reaps zombies and forwards signals
+	init bool
+	// steps decides which failed setup steps fail the container's creation
+	steps *setupSteps
+
+	tty         bool
+	interactive bool
+	detachKeys  []byte
+	// preservedFds are passed on to the container after its standard streams
+	preservedFds []*os.File
+
+	// cleanups undo what creating or starting the container has acquired so far
+	cleanups cleanupStack
+}
+
+// NewContainerEnvironment creates a container: the root filesystem is prepared and the
+// container is recorded in the state store, ready to be started. Cancelling ctx, or ctrl-c,
+// stops a download in progress and undoes the setup.
+func NewContainerEnvironment(ctx context.Context, opts RunOptions) (*ContainerEnvironment, error) {
+	env, err := newEnvironment(opts)
+	if err != nil {
+		return nil, err
+	}
+	// Relative mount sources are resolved now, starting may happen from another directory
+	opts.Mounts = env.mounts
+
+	// The IPC owner is remembered by ID, like the mounts are by absolute path
+	if ref, ok := opts.IPC.container(); ok {
+		id, err := resolveContainer(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPC mode %q: %w", opts.IPC, err)
+		}
+		opts.IPC = IPCMode(ipcContainerPrefix + id)
+		env.ipc = opts.IPC
+	}
+
+	if opts.Name != "" {
+		if err := validateContainerName(opts.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.id, err = newContainerID(); err != nil {
+		return nil, err
+	}
+
+	// Until the state is saved, nothing else tells the root filesystem from a leftover
+	lock, err := lockCreation()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	// Don't leave a half-prepared root filesystem or state behind when setup fails
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer env.cleanups.onPanic()
+	defer env.cleanups.onSignal(cancel)()
+	env.cleanups.push(func() { os.RemoveAll(containerDir(env.id)) })
+
+	name, err := nameContainer(env.id, opts.Name)
+	if err != nil {
+		env.cleanups.run()
+		return nil, err
+	}
+	env.cleanups.push(func() { releaseContainerName(name, env.id) })
+
+	if err := env.initFS(); err != nil {
+		env.cleanups.run()
+		return nil, err
+	}
+	env.cleanups.push(func() {
+		if err := env.removeRootfs(); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	})
+
+	env.state = &ContainerState{
+		ID:       env.id,
+		Name:     name,
+		Status:   statusCreated,
+		Config:   opts,
+		RootPath: env.rootPath,
+		Created:  time.Now().UTC(),
+	}
+
+	err = env.create(ctx, opts)
+	if ctx.Err() != nil {
+		// Also when a step that didn't notice finished anyway
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		env.cleanups.run()
+		return nil, err
+	}
+	// The saved state has the container's resources now, rm removes them
+	env.cleanups.forget()
+
+	containerEvent(eventActionCreate, env.id, map[string]string{"image": opts.Image, "name": name})
+
+	return env, nil
+}
+
+// newEnvironment validates the options and fills in the settings that don't depend on the
+// container's resources, so creating and restarting a container check them the same way
+func newEnvironment(opts RunOptions) (*ContainerEnvironment, error) {
+	// The command may still come from the image, which create checks once it is unpacked
+	if opts.Image == "" {
+		return nil, errors.New("insufficient arguments: need at least an image")
+	}
+
+	for _, e := range opts.Env {
+		if err := validateEnv(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.User != "" {
+		if err := validateUser(opts.User); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateWorkingDir(opts.WorkingDir); err != nil {
+		return nil, err
+	}
+	if err := validateHealthConfig(opts.Healthcheck); err != nil {
+		return nil, err
+	}
+
+	mounts, err := validateMounts(opts.Mounts)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities, seccomp, err := securitySettings(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPreservedFds(opts.PreserveFds); err != nil {
+		return nil, err
+	}
+
+	if opts.DetachKeys == "" {
+		opts.DetachKeys = defaultDetachKeys
+	}
+	detachKeys, err := ParseDetachKeys(opts.DetachKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	ipc, err := ParseIPCMode(string(opts.IPC))
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultTmpfs []TmpfsMount
+	if !ipc.ownsShm() {
+		defaultTmpfs = append(defaultTmpfs, devShmTmpfs)
+	}
+	if opts.ReadOnlyRootfs {
+		defaultTmpfs = append(defaultTmpfs, readOnlyTmpfs...)
+	}
+	tmpfs := withDefaultTmpfs(opts.Tmpfs, mounts, defaultTmpfs)
+
+	rlimits := opts.Rlimits
+	if opts.CoreDumps {
+		rlimits = coreDumpRlimits(rlimits)
+	}
+
+	return &ContainerEnvironment{
+		command:  opts.Command,
+		args:     opts.Args,
+		env:      opts.Env,
+		user:     opts.User,
+		mounts:   mounts,
+		seccomp:  seccomp,
+		ipc:      ipc,
+		userns:   opts.UserNamespace,
+		readOnly: opts.ReadOnlyRootfs,
+		tmpfs:    tmpfs,
+		rlimits:  rlimits,
+		timeout:  opts.Timeout,
+
+		coreDumps: opts.CoreDumps,
+		init:      !opts.NoInit,
+
+		tty:         opts.TTY,
+		interactive: opts.Interactive,
+		detachKeys:  detachKeys,
+
+		capabilities: capabilities,
+		preservedFds: preservedFiles(preservedFdsStart, opts.PreserveFds),
+		workingDir:   opts.WorkingDir,
+
+		steps: &setupSteps{strict: opts.StrictImage},
+	}, nil
+}
+
+// loadContainerEnvironment rebuilds the environment of a created container from its state
+func loadContainerEnvironment(id string) (*ContainerEnvironment, error) {
+	state, err := loadContainerState(id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := newEnvironment(state.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	env.id = state.ID
+	env.state = state
+	env.rootPath = state.RootPath
+	env.lowerDir = state.LowerDir
+	env.layers = state.Layers
+	env.hostname = state.Hostname
+	env.hostCA = state.HostCA
+
+	return env, nil
+}
+
+// create populates the root filesystem and records the container
+func (env *ContainerEnvironment) create(ctx context.Context, opts RunOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	// Until the state is saved with its layers, nothing keeps prune from removing them
+	lock, err := NewImageStore(imageStoreDir).lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	root, config, err := env.unpack(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	env.state.ImageDigest = storedImageDigest(opts.Image, opts.Platform)
+
+	if err := env.applySecurityPolicy(opts, config); err != nil {
+		return err
+	}
+
+	// Measured now, before the container writes to it
+	if env.state.ImageSize, err = env.measureImage(root); err != nil {
+		return err
+	}
+
+	if opts.Command == "" && !opts.NoCommand {
+		argv := imageCommand(config)
+		if len(argv) == 0 {
+			return errors.New("no command specified and the image has no default command")
+		}
+		opts.Command, opts.Args = argv[0], argv[1:]
+		env.command, env.args = opts.Command, opts.Args
+		env.state.Config.Command, env.state.Config.Args = opts.Command, opts.Args
+	}
+
+	// Like Docker, the command runs with the image's environment and PATH, or the default
+	// PATH, unless the container sets its own
+	for _, e := range config.Config.Env {
+		name, _, _ := strings.Cut(e, "=")
+		if name != "PATH" && validateEnv(e) == nil && !hasEnv(env.env, name) {
+			env.env = append(env.env, e)
+		}
+	}
+	if !hasEnv(env.env, "PATH") {
+		env.env = append(env.env, "PATH="+containerPath(config.Config.Env))
+	}
+	env.state.Config.Env = env.env
+
+	if opts.User == "" && config.Config.User != "" {
+		if err := validateUser(config.Config.User); err != nil {
+			return fmt.Errorf("image has an invalid USER: %w", err)
+		}
+		env.user, env.state.Config.User = config.Config.User, config.Config.User
+	}
+	if opts.WorkingDir == "" && config.Config.WorkingDir != "" {
+		if err := validateWorkingDir(config.Config.WorkingDir); err != nil {
+			return fmt.Errorf("image has an invalid WORKDIR: %w", err)
+		}
+		env.workingDir, env.state.Config.WorkingDir = config.Config.WorkingDir, config.Config.WorkingDir
+	}
+	if err := validateHealthConfig(config.Config.Healthcheck); err != nil {
+		return fmt.Errorf("image has an invalid HEALTHCHECK: %w", err)
+	}
+	env.state.Config.Healthcheck = mergeHealthConfig(config.Config.Healthcheck, opts.Healthcheck)
+
+	if problems := checkImageCompatibility(root, config, opts.Command, containerPath(env.env)); len(problems) > 0 {
+		if opts.StrictImage {
+			return fmt.Errorf("%w: %s", errImageIncompatible, strings.Join(problems, "; "))
+		}
+		for _, problem := range problems {
+			warnf(eventTypeImage, "%s", problem)
+		}
+	}
+	for _, problem := range checkClock(root, config, time.Now()) {
+		warnf(eventTypeImage, "%s", problem)
+	}
+
+	// The shared copy of the image is the same for every container, whatever it may need
+	if !opts.SharedRootfs {
+		if err := env.setupFeatureDevices(root, config); err != nil {
+			return err
+		}
+	}
+
+	if opts.HostCA {
+		if bundle := findCABundle(root); bundle != "" {
+			warnf(eventTypeImage, "the image has its own CA bundle %s, the host's isn't mounted", bundle)
+		} else if env.hostCA, err = hostCABundle(); err != nil {
+			return fmt.Errorf("failed to mount the host's CA bundle: %w", err)
+		}
+	}
+
+	if env.hostname, err = containerHostname(opts.Hostname, opts.Network, env.id); err != nil {
+		return err
+	}
+
+	env.state.LowerDir = env.lowerDir
+	env.state.Layers = env.layers
+	env.state.Hostname = env.hostname
+	env.state.HostCA = env.hostCA
+	env.state.SkippedSetup = env.steps.skipped
+
+	return env.state.save()
+}
+
+// unpack mounts the image's cached layers as the root filesystem, fills it with a copy of the
+// image where overlayfs can't be used, or prepares the shared copy of it, and returns the
+// directory holding the image's files along with its config
+func (env *ContainerEnvironment) unpack(ctx context.Context, opts RunOptions) (string, imageConfig, error) {
+	// stdout belongs to the container, and to the ID printed by create and run -d
+	if !opts.Quiet {
+		progress := newProgressRenderer(os.Stderr)
+		defer progress.finish()
+		defer bus.Subscribe(progress)()
+	}
+
+	// Tarballs go into the store first, from where they are run like any other image
+	if isTarballURL(opts.Image) {
+		if _, err := pullTarballImage(ctx, NewImageStore(imageStoreDir), opts.Image, opts.ImageSHA256, false); err != nil {
+			return "", imageConfig{}, fmt.Errorf("failed to pull image: %w", err)
+		}
+	}
+
+	if opts.SharedRootfs {
+		// The image is unpacked once and the init mounts an overlay over it, leaving rootPath
+		// as an empty mountpoint on the host
+		lowerDir, config, err := env.prepareSharedRootfs(ctx, opts.Image, opts.Platform, env.userns)
+		if err != nil {
+			return "", imageConfig{}, fmt.Errorf("failed to prepare shared rootfs: %w", err)
+		}
+		env.lowerDir = lowerDir
+		return lowerDir, config, nil
+	}
+
+	config, err := env.prepareStaticRootfs(ctx, opts)
+	if err == nil {
+		return env.rootPath, config, nil
+	}
+	if !errors.Is(err, errNotStaticImage) {
+		return "", imageConfig{}, err
+	}
+
+	if hasFilesystem("overlay") {
+		config, err := env.prepareOverlayRootfs(ctx, opts.Image, opts.Platform)
+		if err == nil {
+			return env.rootfs(), config, nil
+		}
+		if !errors.Is(err, errOverlayUnavailable) {
+			return "", imageConfig{}, err
+		}
+		warnf(eventTypeContainer, "%v, copying the image instead", err)
+	}
+
+	if err := env.setupDevices(env.rootPath); err != nil {
+		return "", imageConfig{}, err
+	}
+
+	config, err = unpackImage(ctx, opts.Image, opts.Platform, env.rootPath, env.steps)
+	if err != nil {
+		return "", imageConfig{}, err
+	}
+
+	if env.userns {
+		if err := shiftOwnership(env.rootPath); err != nil {
+			return "", imageConfig{}, fmt.Errorf("failed to prepare rootfs for the user namespace: %w", err)
+		}
+	}
+
+	return env.rootPath, config, nil
+}
+
+// measureImage returns the disk usage of the image's files in the root filesystem. Shared
+// copies and cached layers are measured once, whoever uses them first.
+func (env *ContainerEnvironment) measureImage(root string) (int64, error) {
+	if env.lowerDir != "" {
+		return cachedDirSize(env.lowerDir)
+	}
+	if len(env.layers) == 0 {
+		return dirSize(root)
+	}
+
+	var total int64
+	for _, layer := range env.layers {
+		n, err := cachedDirSize(layer)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// rootfs returns the directory the container's root filesystem is in on the host. With
+// --shared-rootfs that is an empty mountpoint until the init mounts over it.
+func (env *ContainerEnvironment) rootfs() string {
+	if len(env.layers) > 0 {
+		return overlayMergedDir(env.rootPath)
+	}
+
+	return env.rootPath
+}
+
+// imageCommand returns the command an image runs by default: its entrypoint followed by the
+// arguments in Cmd, or Cmd alone
+func imageCommand(config imageConfig) []string {
+	return append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+}
+
+// allocate sets up what a running container holds on the host: its root filesystem mount,
+// shared memory, network, /etc files and cgroup. They are recorded in the state so they can be
+// released even if the shim dies.
+func (env *ContainerEnvironment) allocate() error {
+	opts := env.state.Config
+
+	// Mounted when the container was created, but whatever unmounted it since is undone
+	if len(env.layers) > 0 {
+		if err := mountOverlayRootfs(env.rootPath, env.layers); err != nil {
+			return err
+		}
+	}
+
+	if env.ipc == IPCHost {
+		env.ipcShm = hostShmDir
+	}
+	if env.ipc == IPCShareable {
+		dir, err := mountShareableShm(env.id)
+		if err != nil {
+			return err
+		}
+		env.ipcShm, env.state.IPCShm = dir, dir
+	}
+	if owner, ok := env.ipc.container(); ok {
+		conn, err := joinIPC(owner)
+		if err != nil {
+			return err
+		}
+		env.ipcJoin, env.ipcShm = conn, conn.shm
+	}
+
+	network, err := newContainerNetwork(opts.Network)
+	if err != nil {
+		return fmt.Errorf("failed to set up %s network: %w", opts.Network, err)
+	}
+	env.network = network
+	env.state.Network = networkState{LeasePath: network.leasePath, HostVeth: network.hostVeth}
+	if network.address != nil {
+		env.state.Network.Address = network.address.String()
+	}
+
+	if env.etcFiles, err = env.buildEtcFiles(opts); err != nil {
+		return err
+	}
+
+	if env.coreDumps {
+		if err := installCoreCollector(); err != nil {
+			return err
+		}
+	}
+
+	// With a parent, the container gets a cgroup even without limits so the parent accounts for it
+	if !opts.Limits.IsZero() || opts.CgroupParent != "" {
+		cg, err := newContainerCgroup(env.id, opts.CgroupParent, opts.Limits)
+		if err != nil {
+			return fmt.Errorf("failed to apply resource limits: %w", err)
+		}
+		env.cgroup = cg
+		env.state.Cgroup = cg.path
+	}
+
+	return nil
+}
+
+// release frees the network and cgroup of a container that has exited
+func (env *ContainerEnvironment) release() {
+	if env.state == nil {
+		return
+	}
+
+	if env.resolver != nil {
+		env.resolver.Close()
+		env.resolver = nil
+	}
+	env.network.stopDHCP()
+
+	env.state.releaseResources()
+	env.network = nil
+	env.cgroup = nil
+	env.ipcJoin.close()
+	env.ipcJoin = nil
+}
+
+// releaseResources frees the host resources recorded in the state
+func (s *ContainerState) releaseResources() {
+	if s.Cgroup != "" {
+		cg := &containerCgroup{path: s.Cgroup}
+		if err := cg.remove(); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	}
+
+	n := &containerNetwork{leasePath: s.Network.LeasePath, hostVeth: s.Network.HostVeth}
+	if ip, subnet, err := net.ParseCIDR(s.Network.Address); err == nil {
+		n.address = &net.IPNet{IP: ip, Mask: subnet.Mask}
+	}
+	if err := n.release(); err != nil {
+		warnf(eventTypeContainer, "%v", err)
+	}
+
+	if s.IPCShm != "" {
+		if err := unmountShareableShm(s.IPCShm); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	}
+
+	s.Cgroup = ""
+	s.Network = networkState{}
+	s.IPCShm = ""
+}
+
+// initFS initializes the container filesystem
+func (env *ContainerEnvironment) initFS() error {
+	tmpDir, err := os.MkdirTemp(rootfsParentDir(), "container-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	// MkdirTemp creates the directory as 0700, which would keep a non-root user of the container
+	// out of its own root. Layers extracted into it change the mode to their root's.
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		os.Remove(tmpDir)
+		return fmt.Errorf("failed to change permissions of %s: %w", tmpDir, err)
+	}
+
+	env.rootPath = tmpDir
+	return nil
+}
+
+// CopyFile copies a file from the host to the container
+func (env *ContainerEnvironment) CopyFile() error {
+	// Validate command exists
+	if env.command == "" {
+		return errors.New("empty command provided")
+	}
+
+	dst := filepath.Join(env.rootfs(), strings.TrimLeft(env.command, "/"))
+	dir := filepath.Dir(dst)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	src, err := os.Open(env.command)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %s: %w", env.command, err)
+	}
+	defer src.Close()
+
+	dest, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file %s: %w", dst, err)
+	}
+	defer dest.Close()
+
+	if _, err := io.Copy(dest, src); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	stat, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get source file stats: %w", err)
+	}
+
+	if err := dest.Chmod(stat.Mode()); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+
+	return nil
+}
+
+// Remove deletes the container's root filesystem and state. The container must not be running.
+func (env *ContainerEnvironment) Remove() error {
+	if err := env.remove(); err != nil {
+		return err
+	}
+
+	containerEvent(eventActionDestroy, env.id, nil)
+
+	return nil
+}
+
+// remove is Remove without announcing it, for containers that failed to be created
+func (env *ContainerEnvironment) remove() error {
+	env.release()
+
+	if err := env.removeRootfs(); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(containerDir(env.id)); err != nil {
+		return fmt.Errorf("failed to remove state of %s: %w", env.id, err)
+	}
+
+	if env.state != nil {
+		releaseContainerName(env.state.Name, env.id)
+	}
+
+	return nil
+}
+
+// removeRootfs deletes the container's root filesystem
+func (env *ContainerEnvironment) removeRootfs() error {
+	if env.rootPath == "" {
+		return nil
+	}
+
+	// Deleting through a mounted overlay would only fill its upper directory with whiteouts
+	if len(env.layers) > 0 {
+		if err := unmountOverlayRootfs(env.rootPath); err != nil {
+			return fmt.Errorf("failed to remove root filesystem of %s: %w", env.id, err)
+		}
+	}
+	if err := os.RemoveAll(env.rootPath); err != nil {
+		return fmt.Errorf("failed to remove root filesystem of %s: %w", env.id, err)
+	}
+
+	return nil
+}
+
+// initConfig builds the configuration handed to the container init
+func (env *ContainerEnvironment) initConfig() containerInitConfig {
+	return containerInitConfig{
+		RootPath: env.rootfs(),
+		Command:  env.command,
+		Args:     env.args,
+		Env:      env.env,
+		User:     env.user,
+		Mounts:   env.initMounts(),
+
+		Seccomp:  env.seccomp,
+		Network:  env.network.initConfig(),
+		Hostname: env.hostname,
+		EtcFiles: env.etcFiles,
+		LowerDir: env.lowerDir,
+		UserNS:   env.userns,
+		ReadOnly: env.readOnly,
+		Tmpfs:    env.tmpfs,
+		Rlimits:  env.rlimits,
+		Init:     env.init,
+		TTY:      env.tty,
+		JoinIPC:  env.ipcJoin != nil,
+
+		Capabilities: env.capabilities,
+		PreservedFds: len(env.preservedFds),
+		WorkingDir:   env.workingDir,
+	}
+}
+
+// initMounts returns the bind mounts of the container, the /dev/shm it shares with the host
+// or other containers, the host's CA bundle and the identity token included
+func (env *ContainerEnvironment) initMounts() []Mount {
+	mounts := append([]Mount{}, env.mounts...)
+	if env.ipcShm != "" {
+		mounts = append(mounts, Mount{Source: env.ipcShm, Target: devShmTmpfs.Target})
+	}
+	if env.hostCA != "" {
+		mounts = append(mounts, Mount{Source: env.hostCA, Target: caBundlePaths[0], ReadOnly: true})
+	}
+	if env.state.Config.Identity {
+		mounts = append(mounts, Mount{Source: identityTokenDir(env.id), Target: identityTokenTarget, ReadOnly: true})
+	}
+
+	return mounts
+}
+
+// containerHostname picks the container's hostname. Containers on the host network keep the
+// host's name, others are named after their short ID like in Docker.
+func containerHostname(requested string, mode NetworkMode, id string) (string, error) {
+	if requested != "" {
+		if len(requested) > 64 || strings.ContainsAny(requested, " \t/") {
+			return "", fmt.Errorf("invalid hostname %q", requested)
+		}
+		return requested, nil
+	}
+
+	if mode == NetworkHost {
+		return os.Hostname()
+	}
+
+	return shortID(id), nil
+}
+
+// defaultContainerPath is the PATH of containers whose image and options set none, Docker's
+const defaultContainerPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// containerPath returns the PATH the container's command is looked up in and runs with: the
+// one of the container's environment, never the host's
+func containerPath(env []string) string {
+	path := defaultContainerPath
+	for _, e := range env {
+		if value, ok := strings.CutPrefix(e, "PATH="); ok {
+			path = value
+		}
+	}
+
+	return path
+}
+
+// parseLabels parses the --label values of a container, key=value or just key for an empty
+// value, on top of the labels it already has
+func parseLabels(labels map[string]string, entries []string) (map[string]string, error) {
+	for _, entry := range entries {
+		key, value, _ := strings.Cut(entry, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", entry)
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[key] = value
+	}
+
+	return labels, nil
+}
+
+// validateEnv checks that an environment entry has the NAME=value form
+func validateEnv(entry string) error {
+	name, _, ok := strings.Cut(entry, "=")
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid environment variable %q: expected NAME=value", entry)
+	}
+
+	return nil
+}
+
+// securitySettings returns the capabilities a container keeps and the seccomp program it runs
+// under, following its options and what the security policy decided for its image
+func securitySettings(opts RunOptions) (capabilitySet, []syscall.SockFilter, error) {
+	capabilities, err := containerCapabilities(opts)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var policySeccomp string
+	if opts.Policy != nil {
+		policySeccomp = opts.Policy.Seccomp
+	}
+	seccomp, err := compileSecurityOpts(opts.SecurityOpts, policySeccomp, capabilities)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return capabilities, seccomp, nil
+}
+
+// applySecurityPolicy evaluates the host's security policy for the unpacked image and records
+// what it decided, which later starts and execs of the container follow as well
+func (env *ContainerEnvironment) applySecurityPolicy(opts RunOptions, config imageConfig) error {
+	policy, err := readSecurityPolicy()
+	if err != nil || policy == nil {
+		return err
+	}
+
+	opts.Policy = policy.evaluate(opts.Image, config)
+	if opts.Policy == nil {
+		return nil
+	}
+	debugf(eventTypeContainer, "security policy matched", "rules", strings.Join(opts.Policy.Rules, ","), "capabilities", strings.Join(opts.Policy.Capabilities, ","), "seccomp", opts.Policy.Seccomp)
+
+	if env.capabilities, env.seccomp, err = securitySettings(opts); err != nil {
+		return err
+	}
+	env.state.Config.Policy = opts.Policy
+
+	return nil
+}
+
+// compileSecurityOpts parses --security-opt values and returns the seccomp program to install,
+// the policy's profile unless they set one. Rules gated on capabilities are evaluated against
+// those the container keeps. A nil program means seccomp is disabled.
+func compileSecurityOpts(securityOpts []string, policySeccomp string, capabilities capabilitySet) ([]syscall.SockFilter, error) {
+	profile := defaultSeccompProfile()
+	if policySeccomp != "" {
+		p, err := ParseSeccompOption(policySeccomp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid security policy: %w", err)
+		}
+		profile = p
+	}
+
+	for _, opt := range securityOpts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			// Docker also accepts the colon separator for compatibility
+			key, value, ok = strings.Cut(opt, ":")
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid --security-opt %q: expected key=value", opt)
+		}
+
+		switch key {
+		case "seccomp":
+			p, err := ParseSeccompOption(value)
+			if err != nil {
+				return nil, err
+			}
+			profile = p
+		default:
+			return nil, fmt.Errorf("unsupported --security-opt %q", key)
+		}
+	}
+
+	if profile == nil {
+		return nil, nil
+	}
+
+	filter, err := profile.compile(capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile seccomp profile: %w", err)
+	}
+
+	return filter, nil
+}
+
+// timeoutExitCode is returned when a container is killed for exceeding its timeout, like timeout(1)
+const timeoutExitCode = 124
+
+// timeoutKillDelay is how long a container that reached its timeout gets to exit after
+// SIGTERM before it is killed
+const timeoutKillDelay = 2 * time.Second
+
+// launch starts the container init on the shim's standard streams. It returns once the init
+// is in its cgroup, attached to its network and has started the command. What it
+// acquired on the way is on the cleanup stack until the shim has recorded the container.
+func (env *ContainerEnvironment) launch() (*exec.Cmd, error) {
+	// Whatever allocate got to record in the state, release frees
+	env.cleanups.push(env.release)
+	if err := env.allocate(); err != nil {
+		return nil, err
+	}
+
+	configR, configW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config pipe: %w", err)
+	}
+	defer configW.Close()
+
+	failuresR, failuresW, err := os.Pipe()
+	if err != nil {
+		configR.Close()
+		return nil, fmt.Errorf("failed to create init pipe: %w", err)
+	}
+	defer failuresR.Close()
+
+	// Re-execute ourselves as the container init inside new PID, mount, UTS and network namespaces
+	cmd := exec.Command("/proc/self/exe", containerInitArg)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// Not the host's environment: an init that stays PID 1 keeps the one it started with, which
+	// exec reads the container's from
+	cmd.Env = withDefaultEnv(env.env, env.hostname, env.tty)
+	cmd.ExtraFiles = []*os.File{configR, failuresW}
+	if env.ipcJoin != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, env.ipcJoin.namespace)
+	}
+	if len(env.preservedFds) > 0 {
+		// They follow the IPC namespace's slot, which stays closed without one
+		if env.ipcJoin == nil {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, env.preservedFds...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | env.network.cloneFlags() | env.ipc.cloneFlags(),
+	}
+	if env.userns {
+		// The other namespaces are created inside the user namespace and owned by it
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = userNamespaceMappings()
+		cmd.SysProcAttr.GidMappings = userNamespaceMappings()
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		// Our host root isn't mapped, switch to the namespace's root before the init runs
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+	if env.tty {
+		// Stdin is the pty, make it the controlling terminal so ctrl-c and job control work inside
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	}
+
+	err = cmd.Start()
+	configR.Close()
+	failuresW.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	env.ipcJoin.close()
+	debugf(eventTypeContainer, "started container init", "id", env.id, "pid", cmd.Process.Pid,
+		"namespaces", namespaceNames(cmd.SysProcAttr.Cloneflags), "network", env.network.mode, "ipc", env.ipc)
+	env.cleanups.push(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	// The init blocks on the config pipe, so nothing runs before it is in the cgroup
+	if env.cgroup != nil {
+		if err := env.cgroup.addProcess(cmd.Process.Pid); err != nil {
+			return nil, fmt.Errorf("failed to apply resource limits: %w", err)
+		}
+	}
+
+	if err := env.network.attach(cmd.Process.Pid); err != nil {
+		return nil, fmt.Errorf("failed to attach container network: %w", err)
+	}
+	if env.network.dhcp != nil {
+		if err := env.useLeaseDNS(env.network.dhcp.lease); err != nil {
+			return nil, fmt.Errorf("failed to configure DNS: %w", err)
+		}
+	}
+
+	// Up before the init is let go, so the command's first lookup already gets an answer
+	if len(env.dnsUpstreams) > 0 {
+		nsPath, ok := env.network.mode.namespacePath()
+		if !ok {
+			nsPath = fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid)
+		}
+		if env.resolver, err = startEmbeddedResolver(nsPath, env.dnsUpstreams); err != nil {
+			return nil, fmt.Errorf("failed to start embedded DNS resolver: %w", err)
+		}
+	}
+
+	cfg := env.initConfig()
+	for _, m := range cfg.Mounts {
+		debugf(eventTypeContainer, "mount for the init", "id", env.id, "source", m.Source, "target", m.Target, "readOnly", m.ReadOnly)
+	}
+	if err := json.NewEncoder(configW).Encode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to send container configuration: %w", err)
+	}
+	env.closePreservedFds()
+
+	// A command that can't be found or run is reported like a failed setup, not as its exit
+	if err := awaitCommandStart(failuresR); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// namespaceNames lists the namespaces clone flags create, for debug events
+func namespaceNames(flags uintptr) string {
+	var names []string
+	for _, ns := range []struct {
+		flag uintptr
+		name string
+	}{
+		{syscall.CLONE_NEWUSER, "user"},
+		{syscall.CLONE_NEWPID, "pid"},
+		{syscall.CLONE_NEWNS, "mount"},
+		{syscall.CLONE_NEWUTS, "uts"},
+		{syscall.CLONE_NEWIPC, "ipc"},
+		{syscall.CLONE_NEWNET, "net"},
+	} {
+		if flags&ns.flag != 0 {
+			names = append(names, ns.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Run starts the container attached to our terminal or standard streams, waits for it to
+// exit and returns its exit code
+func (env *ContainerEnvironment) Run() (int, error) {
+	if env.tty && env.interactive && !isTerminal(os.Stdin) {
+		return 0, errors.New("the input device is not a TTY")
+	}
+
+	var stdio [3]*os.File
+	var pty, stdout, stderr *os.File
+	var err error
+	if env.tty {
+		var slave *os.File
+		if pty, slave, err = openPty(); err != nil {
+			return 0, fmt.Errorf("failed to allocate a terminal: %w", err)
+		}
+		defer pty.Close()
+		stdio = [3]*os.File{slave, slave, slave}
+	} else {
+		if env.interactive {
+			stdio[0] = os.Stdin
+		}
+
+		// Set up pipes for stdout and stderr
+		if stdout, stdio[1], err = os.Pipe(); err != nil {
+			return 0, fmt.Errorf("failed to create stdout pipe: %w", err)
+		}
+		if stderr, stdio[2], err = os.Pipe(); err != nil {
+			return 0, fmt.Errorf("failed to create stderr pipe: %w", err)
+		}
+	}
+
+	shim, err := env.startShim(stdio, pty, true)
+	for _, f := range stdio[1:] {
+		f.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if env.tty {
+		return env.attachTerminal(shim, pty)
+	}
+
+	stop := proxySignals(shim.pid)
+	defer stop()
+
+	// Capture output
+	stdoutCh := make(chan []byte)
+	stderrCh := make(chan []byte)
+
+	go func() {
+		data, _ := io.ReadAll(stdout)
+		stdoutCh <- data
+	}()
+
+	go func() {
+		data, _ := io.ReadAll(stderr)
+		stderrCh <- data
+	}()
+
+	// Get command output
+	stdoutData := <-stdoutCh
+	stderrData := <-stderrCh
+
+	exitCode, err := env.wait(shim)
+
+	// Write output to stdout and stderr
+	fmt.Print(string(stdoutData))
+	fmt.Fprint(os.Stderr, string(stderrData))
+
+	return exitCode, err
+}
+
+// wait waits for the shim to report the container's exit and returns its exit code
+func (env *ContainerEnvironment) wait(shim *shimClient) (int, error) {
+	ev, err := shim.wait()
+	if err != nil {
+		return 0, err
+	}
+
+	if ev.TimedOut {
+		warnf(eventTypeContainer, "container exceeded its %s timeout and was stopped", env.timeout)
+	}
+
+	return ev.ExitCode, nil
+}
+
+// attachTerminal connects our terminal to the container's pty until the container exits or
+// the user types the detach sequence
+func (env *ContainerEnvironment) attachTerminal(shim *shimClient, pty *os.File) (int, error) {
+	defer setupTerminal(pty, env.interactive)()
+
+	outputDone := make(chan struct{})
+	go func() {
+		// Reads fail with EIO once no process in the container holds the terminal anymore
+		io.Copy(os.Stdout, pty)
+		close(outputDone)
+	}()
+
+	detached := make(chan struct{})
+	if env.interactive {
+		go func() {
+			if _, err := io.Copy(pty, newEscapeProxy(os.Stdin, env.detachKeys)); errors.Is(err, errDetached) {
+				close(detached)
+			}
+		}()
+	}
+
+	select {
+	case <-outputDone:
+		return env.wait(shim)
+	case <-detached:
+		// The shim keeps the container running and takes over its terminal
+		shim.detach()
+		return 0, nil
+	}
+}
+
+// setupTerminal sizes the pty like our terminal and keeps it in sync. Interactive sessions
+// put our terminal into raw mode. The returned function undoes the setup.
+func setupTerminal(pty *os.File, interactive bool) func() {
+	if !isTerminal(os.Stdin) {
+		return func() {}
+	}
+
+	if err := copyWindowSize(os.Stdin, pty); err != nil {
+		warnf(eventTypeContainer, "failed to set terminal size: %v", err)
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			copyWindowSize(os.Stdin, pty)
+		}
+	}()
+
+	// The container's terminal does the echoing and line editing
+	var state *syscall.Termios
+	if interactive {
+		var err error
+		if state, err = makeRaw(os.Stdin); err != nil {
+			warnf(eventTypeContainer, "%v", err)
+		}
+	}
+
+	return func() {
+		signal.Stop(winch)
+		if state != nil {
+			restoreTerminal(os.Stdin, state)
+		}
+	}
+}
+
+// proxySignals forwards the signals we receive to the container's init, like docker run's
+// --sig-proxy. The returned function stops forwarding.
+func proxySignals(pid int) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, proxiedSignals()...)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				syscall.Kill(pid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"os"
+	"testing"
+)
+
+// The root of a container has to be searchable by every user, or a container run with --user
+// can't start its command
+func TestInitFSRootIsSearchableByNonRoot(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	saved := diskRootfsDir
+	diskRootfsDir = t.TempDir()
+	t.Cleanup(func() { diskRootfsDir = saved })
+
+	env := &ContainerEnvironment{}
+	if err := env.initFS(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(env.rootPath) })
+
+	info, err := os.Stat(env.rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0755 {
+		t.Errorf("root of the container has mode %o, want 755", mode)
+	}
+}
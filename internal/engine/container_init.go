@@ -0,0 +1,359 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// containerInitArg is the hidden subcommand used to re-execute this binary inside the
+// container's namespaces, where it finishes the setup and then execs the user command
+const containerInitArg = "init"
+
+// File descriptors of the container and exec inits
+const (
+	// containerInitConfigFd is the one the init reads its configuration from
+	containerInitConfigFd = 3
+	// containerInitFailureFd is where the init reports why it couldn't start the command.
+	// It is closed on exec, so its reader sees EOF once the command runs.
+	containerInitFailureFd = 4
+)
+
+// Exit codes of the inits when the command can't be run, which Docker uses as well
+const (
+	// setupFailedExitCode is returned when the container couldn't be set up
+	setupFailedExitCode = 125
+	// cannotExecuteExitCode is returned when the command exists but can't be executed
+	cannotExecuteExitCode = 126
+	// notFoundExitCode is returned when the command doesn't exist in the image
+	notFoundExitCode = 127
+)
+
+// containerInitConfig is sent from the runtime to the container init process
+type containerInitConfig struct {
+	RootPath string               `json:"rootPath"`
+	Command  string               `json:"command"`
+	Args     []string             `json:"args"`
+	Env      []string             `json:"env,omitempty"`
+	Mounts   []Mount              `json:"mounts,omitempty"`
+	Seccomp  []syscall.SockFilter `json:"seccomp,omitempty"`
+	Network  initNetworkConfig    `json:"network"`
+	Hostname string               `json:"hostname"`
+	EtcFiles map[string]string    `json:"etcFiles,omitempty"`
+	LowerDir string               `json:"lowerDir,omitempty"`
+	UserNS   bool                 `json:"userns,omitempty"`
+	ReadOnly bool                 `json:"readOnly,omitempty"`
+	Tmpfs    []TmpfsMount         `json:"tmpfs,omitempty"`
+	Rlimits  []Rlimit             `json:"rlimits,omitempty"`
+	// Init keeps us as PID 1 and runs the command as our child
+	Init bool `json:"init,omitempty"`
+	TTY  bool `json:"tty,omitempty"`
+	// User is the user[:group] the command runs as, root when empty
+	User string `json:"user,omitempty"`
+	// WorkingDir is where the command starts, / when empty
+	WorkingDir string `json:"workingDir,omitempty"`
+	// PreservedFds is how many descriptors from containerInitPreservedFd on the command gets
+	// from preservedFdsStart on
+	PreservedFds int `json:"preservedFds,omitempty"`
+	// JoinIPC enters the IPC namespace passed at ipcNamespaceFd
+	JoinIPC bool `json:"joinIPC,omitempty"`
+	// Capabilities are those the command keeps, the others are dropped before it runs
+	Capabilities capabilitySet `json:"capabilities"`
+}
+
+// initFailure is a failure of the init to set up the container or start its command,
+// reported to the runtime instead of mixed into the container's output
+type initFailure struct {
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+func (f *initFailure) Error() string {
+	return f.Message
+}
+
+// Unwrap returns what the exit code tells of the failure, for its diagnosis
+func (f *initFailure) Unwrap() error {
+	switch f.ExitCode {
+	case notFoundExitCode:
+		return errExecutableNotFound
+	case cannotExecuteExitCode:
+		return errNotExecutable
+	}
+
+	return nil
+}
+
+// initFailures is where initFatalf reports to, nil once the command runs
+var initFailures *os.File
+
+// openInitFailures makes initFatalf report to the runtime through containerInitFailureFd
+func openInitFailures() {
+	syscall.CloseOnExec(containerInitFailureFd)
+	initFailures = os.NewFile(containerInitFailureFd, "init-failures")
+}
+
+// closeInitFailures tells the runtime that the command runs, when the init doesn't exec it
+func closeInitFailures() {
+	if initFailures != nil {
+		initFailures.Close()
+		initFailures = nil
+	}
+}
+
+// awaitCommandStart waits until the init has started the command and returns the failure it
+// reported instead. An init that dies without a word is left to be waited for as usual.
+func awaitCommandStart(failures *os.File) error {
+	var failure initFailure
+	if err := json.NewDecoder(failures).Decode(&failure); err != nil {
+		return nil
+	}
+
+	return &failure
+}
+
+// setupExitCode returns the exit code of a command that failed to run a container with err:
+// Docker's for a command that can't be found or executed, setupFailedExitCode otherwise
+func setupExitCode(err error) int {
+	var failure *initFailure
+	if errors.As(err, &failure) && failure.ExitCode != 0 {
+		return failure.ExitCode
+	}
+	var remote *shimError
+	if errors.As(err, &remote) && remote.diagnosis != nil && remote.diagnosis.ExitCode != 0 {
+		return remote.diagnosis.ExitCode
+	}
+
+	return setupFailedExitCode
+}
+
+// runContainerInit is the entrypoint of the init process. It only returns on failure.
+func runContainerInit() {
+	// Namespaces joined with setns only apply to the calling thread, which must be the one
+	// that finally execs the command
+	runtime.LockOSThread()
+	openInitFailures()
+
+	// The runtime writes the configuration once the host side is ready, so reading it
+	// also waits for the network to be attached
+	configFile := os.NewFile(containerInitConfigFd, "init-config")
+	var cfg containerInitConfig
+	if err := json.NewDecoder(configFile).Decode(&cfg); err != nil {
+		initFatalf(setupFailedExitCode, "failed to read container configuration: %v", err)
+	}
+	configFile.Close()
+	preserved := preservedFiles(containerInitPreservedFd, cfg.PreservedFds)
+
+	if err := cfg.prepare(); err != nil {
+		initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+	}
+
+	// The command is looked up in the container's PATH, never in the host's
+	searchPath := containerPath(cfg.Env)
+
+	if err := applyRlimits(cfg.Rlimits); err != nil {
+		initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+	}
+
+	cred, err := cfg.credential()
+	if err != nil {
+		initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+	}
+
+	environ := cfg.commandEnv()
+
+	path, err := lookPathInRoot("/", cfg.Command, searchPath)
+	if err != nil {
+		initFatalf(commandExitCode(err), "failed to start command: %v", err)
+	}
+
+	// After the setup that needs them, but while we are still root to change them
+	if err := restrictCapabilities(cfg.Capabilities); err != nil {
+		initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+	}
+
+	// Under the init only the command runs as the user, we stay root to reap and signal it
+	if cred != nil && !cfg.Init {
+		if err := switchCredential(cred); err != nil {
+			initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+		}
+	}
+
+	// Install the seccomp filter last so the setup above isn't subject to it
+	if cfg.Seccomp != nil {
+		if err := installSeccompFilter(cfg.Seccomp); err != nil {
+			initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+		}
+	}
+
+	argv := append([]string{cfg.Command}, cfg.Args...)
+	if cfg.Init {
+		code, err := runAsPid1(path, argv, environ, cfg.TTY, cred, preserved, closeInitFailures)
+		if err != nil {
+			initFatalf(commandExitCode(err), "failed to start command: %v", err)
+		}
+		os.Exit(code)
+	}
+
+	if err := movePreservedFds(preserved); err != nil {
+		initFatalf(setupFailedExitCode, "failed to prepare container environment: %v", err)
+	}
+	if err := syscall.Exec(path, argv, environ); err != nil {
+		initFatalf(commandExitCode(err), "failed to start command: %v", err)
+	}
+}
+
+// initFatalf reports a failure of the init to the runtime, or logs it once the command runs,
+// and exits with code
+func initFatalf(code int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if initFailures != nil {
+		json.NewEncoder(initFailures).Encode(initFailure{Message: message, ExitCode: code})
+	} else {
+		log.Output(2, message)
+	}
+	os.Exit(code)
+}
+
+// commandExitCode returns the exit code for a command that failed to start with err
+func commandExitCode(err error) int {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, errExecutableNotFound), errors.Is(err, errNoSuchExecutable),
+		errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ENOTDIR):
+		return notFoundExitCode
+	case errors.Is(err, errNotExecutable), errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EPERM), errors.Is(err, syscall.ENOEXEC), errors.Is(err, syscall.EISDIR):
+		return cannotExecuteExitCode
+	}
+
+	return setupFailedExitCode
+}
+
+// credential resolves the user the command runs as in the container's root, nil for root.
+// The user's home becomes HOME unless the container sets it.
+func (cfg *containerInitConfig) credential() (*syscall.Credential, error) {
+	if cfg.User == "" {
+		return nil, nil
+	}
+
+	u, err := resolveUser(cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserNS {
+		if err := u.mapped(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasEnv(cfg.Env, "HOME") {
+		cfg.Env = append(cfg.Env, "HOME="+u.home)
+	}
+
+	return u.credential(0), nil
+}
+
+// commandEnv returns the environment the command runs with: the container's and the defaults
+// for what it leaves unset, with HOME being root's unless credential set the user's. None of
+// the environment the init inherited is passed on.
+func (cfg *containerInitConfig) commandEnv() []string {
+	environ := withDefaultEnv(cfg.Env, cfg.Hostname, cfg.TTY)
+	if !hasEnv(environ, "HOME") {
+		environ = append(environ, "HOME=/root")
+	}
+
+	return environ
+}
+
+// withDefaultEnv returns a container's environment with Docker's defaults added for what it
+// leaves unset: the PATH, HOSTNAME and, with a terminal, TERM
+func withDefaultEnv(env []string, hostname string, tty bool) []string {
+	environ := append([]string{}, env...)
+	if !hasEnv(environ, "PATH") {
+		environ = append(environ, "PATH="+containerPath(env))
+	}
+	if !hasEnv(environ, "HOSTNAME") && hostname != "" {
+		environ = append(environ, "HOSTNAME="+hostname)
+	}
+	if tty && !hasEnv(environ, "TERM") {
+		environ = append(environ, "TERM=xterm")
+	}
+
+	return environ
+}
+
+// prepare performs all preparatory steps inside the namespaces before running the command
+func (cfg *containerInitConfig) prepare() error {
+	if cfg.JoinIPC {
+		ns := os.NewFile(ipcNamespaceFd, "ipc-namespace")
+		err := joinNamespace(ns, syscall.CLONE_NEWIPC)
+		ns.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+
+	if err := configureContainerNetwork(cfg.Network); err != nil {
+		return fmt.Errorf("network setup failed: %w", err)
+	}
+
+	// Keep our mounts from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	if cfg.LowerDir != "" {
+		root, err := mountSharedRootfs(cfg.RootPath, cfg.LowerDir)
+		if err != nil {
+			return err
+		}
+		cfg.RootPath = root
+	}
+
+	// Written before the volumes so bind mounts over these files take precedence
+	if err := writeEtcFiles(cfg.RootPath, cfg.EtcFiles); err != nil {
+		return err
+	}
+
+	if err := mountDevices(cfg.RootPath, cfg.UserNS); err != nil {
+		return err
+	}
+
+	// Before the volumes, so those below a tmpfs, like a socket in /run, aren't hidden by it
+	if err := mountTmpfs(cfg.RootPath, cfg.Tmpfs); err != nil {
+		return err
+	}
+
+	if len(cfg.Mounts) > 0 {
+		if err := mountVolumes(cfg.RootPath, cfg.Mounts); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ReadOnly {
+		if err := makeRootReadOnly(cfg.RootPath); err != nil {
+			return err
+		}
+	}
+
+	// Change root to container filesystem
+	if err := syscall.Chroot(cfg.RootPath); err != nil {
+		return fmt.Errorf("chroot failed: %w", err)
+	}
+
+	// Change directory to root within the new filesystem
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir failed: %w", err)
+	}
+
+	return enterWorkingDir(cfg.WorkingDir)
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// containerSize is the disk usage of a container: what it wrote itself, and that plus the
+// image files it sees
+type containerSize struct {
+	RW     int64 `json:"SizeRw"`
+	RootFs int64 `json:"SizeRootFs"`
+}
+
+// String formats the size like docker ps --size
+func (s containerSize) String() string {
+	return fmt.Sprintf("%s (virtual %s)", formatSize(s.RW), formatSize(s.RootFs))
+}
+
+// measureContainerSize works out how much a container has written. A copied rootfs is
+// measured as a whole and compared with its size right after unpacking, which create records.
+// The writes of a --shared-rootfs container are all in the tmpfs under its overlay, whose
+// usage is read from inside the container's mount namespace; nothing is left of them once it
+// has exited. Over cached layers, everything written is in the container's upper directory.
+func measureContainerSize(state *ContainerState) (containerSize, error) {
+	size := containerSize{RootFs: state.ImageSize}
+
+	if state.LowerDir != "" {
+		if !state.running() {
+			return size, nil
+		}
+
+		used, err := tmpfsUsageInNamespace(state.Pid, state.RootPath)
+		if err != nil {
+			return containerSize{}, err
+		}
+		size.RW = used
+		size.RootFs += used
+		return size, nil
+	}
+
+	if len(state.Layers) > 0 {
+		used, err := dirSize(overlayUpperDir(state.RootPath))
+		if err != nil {
+			return containerSize{}, err
+		}
+		size.RW = used
+		size.RootFs += used
+		return size, nil
+	}
+
+	total, err := dirSize(state.RootPath)
+	if err != nil {
+		return containerSize{}, err
+	}
+	size.RootFs = total
+	// Deleting image files can make the rootfs smaller than the image
+	size.RW = max(total-state.ImageSize, 0)
+
+	return size, nil
+}
+
+// dirSize returns the disk space the files below dir take up, counting hard links once, like
+// du does. Files removed while walking are skipped.
+func dirSize(dir string) (int64, error) {
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]bool)
+
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				return nil
+			}
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		if st.Nlink > 1 && !d.IsDir() {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		// st_blocks is always in 512-byte units
+		total += int64(st.Blocks) * 512
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", dir, err)
+	}
+
+	return total, nil
+}
+
+// cachedDirSize returns the size of a directory that never changes, such as a shared rootfs,
+// measuring it only the first time
+func cachedDirSize(dir string) (int64, error) {
+	cache := dir + ".size"
+	if data, err := os.ReadFile(cache); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+
+	n, err := dirSize(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only an optimisation, measuring again next time is fine
+	_ = os.WriteFile(cache, []byte(strconv.FormatInt(n, 10)+"\n"), 0644)
+
+	return n, nil
+}
+
+// tmpfsUsageInNamespace returns the space used on the tmpfs mounted at path in the mount
+// namespace of pid. The namespace is joined from a locked thread that is terminated afterwards
+// instead of being reused by the rest of the program.
+func tmpfsUsageInNamespace(pid int, path string) (int64, error) {
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/mnt", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open mount namespace of container: %w", err)
+	}
+	defer ns.Close()
+
+	type result struct {
+		used int64
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// Never unlocked, the thread is left in the container's namespace
+		runtime.LockOSThread()
+
+		// A thread sharing its filesystem attributes with others can't change mount namespace
+		if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+			done <- result{err: fmt.Errorf("failed to unshare filesystem attributes: %w", err)}
+			return
+		}
+		if err := joinNamespace(ns, syscall.CLONE_NEWNS); err != nil {
+			done <- result{err: err}
+			return
+		}
+
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(path, &st); err != nil {
+			done <- result{err: fmt.Errorf("failed to inspect %s: %w", path, err)}
+			return
+		}
+		done <- result{used: int64(st.Blocks-st.Bfree) * int64(st.Bsize)}
+	}()
+
+	r := <-done
+	return r.used, r.err
+}
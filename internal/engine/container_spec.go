@@ -0,0 +1,509 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerSpec is a container definition loaded with `run -f`
+type ContainerSpec struct {
+	Image        string
+	Name         string
+	Command      []string
+	Env          []string
+	Mounts       []Mount
+	Limits       ResourceLimits
+	CgroupParent string
+	Network      NetworkMode
+	IPC          IPCMode
+	SecurityOpts []string
+	SharedRootfs bool
+	ReadOnly     bool
+	TTL          time.Duration
+	AutoRemove   bool
+	Restart      RestartPolicy
+	CoreDumps    bool
+	NoInit       bool
+	StrictImage  bool
+	Hostname     string
+	DNS          []string
+	DNSSearch    []string
+	ExtraHosts   []string
+	User         string
+	HostCA       bool
+	Identity     bool
+	TTY          bool
+	Interactive  bool
+}
+
+// RunOptions converts the definition into options for NewContainerEnvironment
+func (s *ContainerSpec) RunOptions() RunOptions {
+	opts := RunOptions{
+		Image:          s.Image,
+		Name:           s.Name,
+		Env:            s.Env,
+		Mounts:         s.Mounts,
+		Limits:         s.Limits,
+		CgroupParent:   s.CgroupParent,
+		Network:        s.Network,
+		IPC:            s.IPC,
+		SecurityOpts:   s.SecurityOpts,
+		SharedRootfs:   s.SharedRootfs,
+		ReadOnlyRootfs: s.ReadOnly,
+		TTL:            s.TTL,
+		AutoRemove:     s.AutoRemove,
+		Restart:        s.Restart,
+		CoreDumps:      s.CoreDumps,
+		NoInit:         s.NoInit,
+		StrictImage:    s.StrictImage,
+		Hostname:       s.Hostname,
+		DNS:            s.DNS,
+		DNSSearch:      s.DNSSearch,
+		ExtraHosts:     s.ExtraHosts,
+		User:           s.User,
+		HostCA:         s.HostCA,
+		Identity:       s.Identity,
+		TTY:            s.TTY,
+		Interactive:    s.Interactive,
+	}
+
+	if len(s.Command) > 0 {
+		opts.Command, opts.Args = s.Command[0], s.Command[1:]
+	}
+
+	return opts
+}
+
+// specDecoder converts parsed nodes into a ContainerSpec, reporting errors with positions
+type specDecoder struct {
+	file string
+	dir  string
+}
+
+// LoadContainerSpec reads and validates a YAML or JSON container definition
+func LoadContainerSpec(path string) (*ContainerSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container definition: %w", err)
+	}
+
+	root, err := parseSpecDocument(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &specDecoder{file: path, dir: filepath.Dir(abs)}
+	return d.decode(root)
+}
+
+func (d *specDecoder) errorf(n *specNode, path, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if path != "" {
+		msg = path + ": " + msg
+	}
+
+	return &specError{file: d.file, line: n.line, col: n.col, msg: msg}
+}
+
+// decode validates the top-level mapping
+func (d *specDecoder) decode(root *specNode) (*ContainerSpec, error) {
+	if root.kind != mappingNode {
+		return nil, d.errorf(root, "", "expected a mapping at the top level, found %s", root.describe())
+	}
+
+	spec := &ContainerSpec{}
+	var imageNode *specNode
+	for i, key := range root.keys {
+		value := root.values[i]
+		var err error
+
+		switch key.value {
+		case "image":
+			imageNode = value
+			spec.Image, err = d.string(value, "image")
+		case "command":
+			spec.Command, err = d.command(value, "command")
+		case "env", "environment":
+			spec.Env, err = d.env(value, key.value)
+		case "mounts", "volumes":
+			spec.Mounts, err = d.mounts(value, key.value)
+		case "limits", "resources":
+			spec.Limits, err = d.limits(value, key.value)
+		case "cgroupParent", "cgroup_parent":
+			spec.CgroupParent, err = d.string(value, key.value)
+		case "network":
+			spec.Network, err = d.network(value, "network")
+		case "ipc":
+			spec.IPC, err = d.ipc(value, "ipc")
+		case "securityOpt", "security_opt":
+			spec.SecurityOpts, err = d.stringList(value, key.value)
+		case "sharedRootfs", "shared_rootfs":
+			spec.SharedRootfs, err = d.bool(value, key.value)
+		case "readOnly", "read_only":
+			spec.ReadOnly, err = d.bool(value, key.value)
+		case "ttl":
+			spec.TTL, err = d.duration(value, "ttl")
+		case "rm", "autoRemove", "auto_remove":
+			spec.AutoRemove, err = d.bool(value, key.value)
+		case "restart":
+			spec.Restart, err = d.restart(value, "restart")
+		case "coreDumps", "core_dumps":
+			spec.CoreDumps, err = d.bool(value, key.value)
+		case "init":
+			var init bool
+			init, err = d.bool(value, "init")
+			spec.NoInit = !init
+		case "strict":
+			spec.StrictImage, err = d.bool(value, "strict")
+		case "hostname":
+			spec.Hostname, err = d.string(value, "hostname")
+		case "dns":
+			spec.DNS, err = d.stringList(value, "dns")
+		case "dnsSearch", "dns_search":
+			spec.DNSSearch, err = d.stringList(value, key.value)
+		case "extraHosts", "extra_hosts":
+			spec.ExtraHosts, err = d.stringList(value, key.value)
+		case "name", "container_name":
+			spec.Name, err = d.string(value, key.value)
+		case "user":
+			spec.User, err = d.string(value, "user")
+		case "hostCA", "host_ca":
+			spec.HostCA, err = d.bool(value, key.value)
+		case "identity":
+			spec.Identity, err = d.bool(value, "identity")
+		case "tty":
+			spec.TTY, err = d.bool(value, "tty")
+		case "interactive", "stdin_open":
+			spec.Interactive, err = d.bool(value, key.value)
+		default:
+			err = d.errorf(key, "", "unknown field %q", key.value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if spec.Image == "" {
+		if imageNode != nil {
+			return nil, d.errorf(imageNode, "image", "must not be empty")
+		}
+		return nil, d.errorf(root, "", "missing required field \"image\"")
+	}
+
+	return spec, nil
+}
+
+func (d *specDecoder) string(n *specNode, path string) (string, error) {
+	if n.kind != scalarNode || n.null {
+		return "", d.errorf(n, path, "expected a string, found %s", n.describe())
+	}
+
+	return n.value, nil
+}
+
+func (d *specDecoder) stringList(n *specNode, path string) ([]string, error) {
+	if n.kind != sequenceNode {
+		return nil, d.errorf(n, path, "expected a list, found %s", n.describe())
+	}
+
+	list := make([]string, 0, len(n.items))
+	for i, item := range n.items {
+		s, err := d.string(item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// command accepts either a list of arguments or a string split like a shell would
+func (d *specDecoder) command(n *specNode, path string) ([]string, error) {
+	if n.kind == sequenceNode {
+		return d.stringList(n, path)
+	}
+
+	s, err := d.string(n, path)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := splitShellWords(s)
+	if err != nil {
+		return nil, d.errorf(n, path, "%v", err)
+	}
+
+	return args, nil
+}
+
+// env accepts a mapping of names to values or a list of NAME=value entries
+func (d *specDecoder) env(n *specNode, path string) ([]string, error) {
+	if n.kind == sequenceNode {
+		list, err := d.stringList(n, path)
+		if err != nil {
+			return nil, err
+		}
+		for i, e := range list {
+			if err := validateEnv(e); err != nil {
+				return nil, d.errorf(n.items[i], fmt.Sprintf("%s[%d]", path, i), "%v", err)
+			}
+		}
+		return list, nil
+	}
+
+	if n.kind != mappingNode {
+		return nil, d.errorf(n, path, "expected a mapping or list, found %s", n.describe())
+	}
+
+	list := make([]string, 0, len(n.keys))
+	for i, key := range n.keys {
+		value := n.values[i]
+		if value.kind != scalarNode {
+			return nil, d.errorf(value, path+"."+key.value, "expected a string, found %s", value.describe())
+		}
+		entry := key.value + "=" + value.value
+		if err := validateEnv(entry); err != nil {
+			return nil, d.errorf(key, path+"."+key.value, "%v", err)
+		}
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+// mounts accepts short "src:dst[:ro]" strings or mappings with source, target and readOnly
+func (d *specDecoder) mounts(n *specNode, path string) ([]Mount, error) {
+	if n.kind != sequenceNode {
+		return nil, d.errorf(n, path, "expected a list, found %s", n.describe())
+	}
+
+	var mounts []Mount
+	for i, item := range n.items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		var m Mount
+
+		switch item.kind {
+		case scalarNode:
+			var err error
+			if m, err = ParseVolume(item.value); err != nil {
+				return nil, d.errorf(item, itemPath, "%v", err)
+			}
+		case mappingNode:
+			for j, key := range item.keys {
+				value := item.values[j]
+				fieldPath := itemPath + "." + key.value
+				var err error
+				switch key.value {
+				case "source":
+					m.Source, err = d.string(value, fieldPath)
+				case "target", "destination":
+					m.Target, err = d.string(value, fieldPath)
+				case "readOnly", "read_only":
+					m.ReadOnly, err = d.bool(value, fieldPath)
+				default:
+					err = d.errorf(key, itemPath, "unknown field %q", key.value)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if m.Source == "" || m.Target == "" {
+				return nil, d.errorf(item, itemPath, "both source and target are required")
+			}
+			if !filepath.IsAbs(m.Target) {
+				return nil, d.errorf(item, itemPath+".target", "must be an absolute path")
+			}
+		default:
+			return nil, d.errorf(item, itemPath, "expected a string or mapping, found %s", item.describe())
+		}
+
+		// Relative sources are resolved against the definition file's directory
+		if !filepath.IsAbs(m.Source) {
+			m.Source = filepath.Join(d.dir, m.Source)
+		}
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+func (d *specDecoder) limits(n *specNode, path string) (ResourceLimits, error) {
+	var limits ResourceLimits
+	if n.kind != mappingNode {
+		return limits, d.errorf(n, path, "expected a mapping, found %s", n.describe())
+	}
+
+	for i, key := range n.keys {
+		value := n.values[i]
+		fieldPath := path + "." + key.value
+		if !containsString([]string{"memory", "cpus", "pids", "cpuBurst", "cpu_burst"}, key.value) {
+			return limits, d.errorf(key, path, "unknown field %q", key.value)
+		}
+
+		s, err := d.string(value, fieldPath)
+		if err != nil {
+			return limits, err
+		}
+
+		switch key.value {
+		case "memory":
+			limits.Memory, err = ParseByteSize(s)
+		case "cpus":
+			limits.CPUs, err = ParseCPUs(s)
+		case "cpuBurst", "cpu_burst":
+			limits.CPUBurst, err = ParseCPUBurst(s)
+		case "pids":
+			limits.PidsLimit, err = strconv.ParseInt(s, 10, 64)
+			if err == nil && limits.PidsLimit <= 0 {
+				err = fmt.Errorf("must be a positive number")
+			}
+		}
+
+		if err != nil {
+			return limits, d.errorf(value, fieldPath, "%v", err)
+		}
+	}
+
+	return limits, nil
+}
+
+func (d *specDecoder) ipc(n *specNode, path string) (IPCMode, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return "", err
+	}
+
+	mode, err := ParseIPCMode(s)
+	if err != nil {
+		return "", d.errorf(n, path, "%v", err)
+	}
+
+	return mode, nil
+}
+
+// restart accepts a restart policy like --restart does
+func (d *specDecoder) restart(n *specNode, path string) (RestartPolicy, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return RestartPolicy{}, err
+	}
+
+	policy, err := ParseRestartPolicy(s)
+	if err != nil {
+		return RestartPolicy{}, d.errorf(n, path, "%v", err)
+	}
+
+	return policy, nil
+}
+
+// network accepts a bare mode or a mapping with a mode field
+func (d *specDecoder) network(n *specNode, path string) (NetworkMode, error) {
+	modeNode := n
+	if n.kind == mappingNode {
+		modeNode = nil
+		for i, key := range n.keys {
+			if key.value != "mode" {
+				return "", d.errorf(key, path, "unknown field %q", key.value)
+			}
+			modeNode = n.values[i]
+		}
+		if modeNode == nil {
+			return "", d.errorf(n, path, "missing required field \"mode\"")
+		}
+		path += ".mode"
+	}
+
+	s, err := d.string(modeNode, path)
+	if err != nil {
+		return "", err
+	}
+
+	mode, err := ParseNetworkMode(s)
+	if err != nil {
+		return "", d.errorf(modeNode, path, "%v", err)
+	}
+
+	return mode, nil
+}
+
+func (d *specDecoder) bool(n *specNode, path string) (bool, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+
+	return false, d.errorf(n, path, "expected a boolean, found %q", s)
+}
+
+// duration accepts a positive Go duration such as 90s or 1h30m
+func (d *specDecoder) duration(n *specNode, path string) (time.Duration, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil || v <= 0 {
+		return 0, d.errorf(n, path, "expected a positive duration such as 90s or 1h, found %q", s)
+	}
+
+	return v, nil
+}
+
+// splitShellWords splits a command line on whitespace, honouring single and double quotes
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
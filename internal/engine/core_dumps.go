@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// coreCollectorArg is the hidden argument the kernel runs the binary with to deliver a core
+// dump on its stdin
+const coreCollectorArg = "core-collector"
+
+// The kernel runs the collector from core_pattern long after the command that installed it
+// has exited, so it gets a copy of the binary that isn't deleted like the build output
+const (
+	corePatternPath   = "/proc/sys/kernel/core_pattern"
+	coreCollectorPath = "/var/lib/your-docker/core-collector"
+)
+
+// corePatternBackup keeps the host's own core_pattern for crashes outside containers. Like
+// core_pattern itself it is gone after a reboot.
+var corePatternBackup = filepath.Join(containerStateDir, "core_pattern")
+
+// coreSpecifiers are the core_pattern specifiers passed to the collector, in order. The
+// command name is read from /proc instead, since it may contain spaces.
+var coreSpecifiers = []byte{'P', 'p', 'i', 'I', 's', 't', 'c', 'u', 'g', 'h', 'd'}
+
+// CoreDump describes a core dump captured from a container
+type CoreDump struct {
+	File    string    `json:"file"`
+	Pid     int       `json:"pid"`
+	HostPid int       `json:"hostPid"`
+	Signal  int       `json:"signal"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+}
+
+// coreDumpRlimits returns limits with core dumps unlimited, replacing any core limit set
+// before, e.g. by the sandbox preset
+func coreDumpRlimits(limits []Rlimit) []Rlimit {
+	var out []Rlimit
+	for _, l := range limits {
+		if l.Resource != syscall.RLIMIT_CORE {
+			out = append(out, l)
+		}
+	}
+
+	return append(out, Rlimit{Resource: syscall.RLIMIT_CORE, Soft: ^uint64(0), Hard: ^uint64(0)})
+}
+
+// installCoreCollector points the kernel's core_pattern at the collector. The pattern is
+// global, so the host's is saved and crashes outside containers are passed on to it.
+func installCoreCollector() error {
+	current, err := os.ReadFile(corePatternPath)
+	if err != nil {
+		return fmt.Errorf("failed to read core_pattern: %w", err)
+	}
+
+	pattern := "|" + coreCollectorPath + " " + coreCollectorArg
+	for _, c := range coreSpecifiers {
+		pattern += " %" + string(c)
+	}
+
+	if strings.TrimSpace(string(current)) == pattern {
+		return nil
+	}
+
+	if err := copyExecutable(coreCollectorPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(containerStateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", containerStateDir, err)
+	}
+	if err := os.WriteFile(corePatternBackup, current, 0600); err != nil {
+		return fmt.Errorf("failed to save core_pattern: %w", err)
+	}
+
+	if err := os.WriteFile(corePatternPath, []byte(pattern), 0644); err != nil {
+		return fmt.Errorf("failed to install core dump collector: %w", err)
+	}
+
+	return nil
+}
+
+// copyExecutable installs a copy of the running binary at path
+func copyExecutable(path string) error {
+	self, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return fmt.Errorf("failed to open executable: %w", err)
+	}
+	defer self.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to install core dump collector: %w", err)
+	}
+
+	if _, err := io.Copy(out, self); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install core dump collector: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install core dump collector: %w", err)
+	}
+
+	// Renaming keeps a collector the kernel is running at the moment intact
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install core dump collector: %w", err)
+	}
+
+	return nil
+}
+
+// runCoreCollector receives a core dump from the kernel. Dumps of container processes go to
+// the container's state directory, others are handled by the host's core_pattern.
+func runCoreCollector() {
+	// There is nobody to report to, the kernel discards our output
+	if f, err := os.OpenFile(filepath.Join(containerStateDir, "core-collector.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+		log.SetOutput(f)
+	}
+
+	values := map[byte]string{}
+	for i, c := range coreSpecifiers {
+		if 2+i < len(os.Args) {
+			values[c] = os.Args[2+i]
+		}
+	}
+
+	// /proc/<pid> of the crashing process stays around until we've read its dump
+	hostPid := values['P']
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%s/comm", hostPid)); err == nil {
+		values['e'] = strings.TrimSpace(string(comm))
+	}
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%s/exe", hostPid)); err == nil {
+		values['E'] = strings.ReplaceAll(exe, "/", "!")
+	}
+
+	var err error
+	if id := crashedContainer(hostPid); id != "" {
+		err = captureCoreDump(id, values, os.Stdin)
+	} else {
+		err = forwardCoreDump(values, os.Stdin)
+	}
+	if err != nil {
+		warnf(eventTypeContainer, "%v", err)
+		os.Exit(1)
+	}
+}
+
+// crashedContainer returns the ID of the running container whose PID namespace the process
+// is in, or "" for processes outside containers
+func crashedContainer(hostPid string) string {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%s/ns/pid", hostPid))
+	if err != nil {
+		return ""
+	}
+
+	states, err := listContainerStates()
+	if err != nil {
+		warnf(eventTypeContainer, "%v", err)
+		return ""
+	}
+
+	for _, state := range states {
+		if !state.running() {
+			continue
+		}
+		if initNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", state.Pid)); err == nil && initNs == ns {
+			return state.ID
+		}
+	}
+
+	return ""
+}
+
+// coreLimit parses the crashing process's RLIMIT_CORE as passed for %c
+func coreLimit(values map[byte]string) int64 {
+	limit, err := strconv.ParseUint(values['c'], 10, 64)
+	if err != nil || limit > 1<<62 {
+		return 1 << 62
+	}
+
+	return int64(limit)
+}
+
+// captureCoreDump stores a dump in the container's state directory, along with what `cores`
+// lists about it
+func captureCoreDump(id string, values map[byte]string, core io.Reader) error {
+	limit := coreLimit(values)
+	if limit == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(containerDir(id), "cores")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	dump := CoreDump{File: fmt.Sprintf("core.%s.%s", values['p'], values['t']), Command: values['e'], Time: time.Now().UTC()}
+	dump.Pid, _ = strconv.Atoi(values['p'])
+	dump.HostPid, _ = strconv.Atoi(values['P'])
+	dump.Signal, _ = strconv.Atoi(values['s'])
+	if t, err := strconv.ParseInt(values['t'], 10, 64); err == nil {
+		dump.Time = time.Unix(t, 0).UTC()
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, dump.File), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save core dump of %s: %w", id, err)
+	}
+	defer f.Close()
+
+	if dump.Size, err = io.CopyN(f, core, limit); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to save core dump of %s: %w", id, err)
+	}
+
+	data, err := json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, dump.File+".json"), data, 0600); err != nil {
+		return fmt.Errorf("failed to save core dump of %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// forwardCoreDump handles a dump the way the host's saved core_pattern would: piped to its
+// helper, or written to the file it names relative to the process's working directory
+func forwardCoreDump(values map[byte]string, core io.Reader) error {
+	data, err := os.ReadFile(corePatternBackup)
+	if err != nil {
+		return fmt.Errorf("failed to read the host's core_pattern: %w", err)
+	}
+
+	pattern := strings.TrimSpace(string(data))
+	if helper, ok := strings.CutPrefix(pattern, "|"); ok {
+		args := strings.Fields(helper)
+		if len(args) == 0 {
+			return nil
+		}
+		for i := range args {
+			args[i] = expandCorePattern(args[i], values)
+		}
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = core
+		return cmd.Run()
+	}
+
+	limit := coreLimit(values)
+	if limit == 0 {
+		return nil
+	}
+
+	if pattern == "" {
+		pattern = "core"
+	}
+	if usesPid, err := os.ReadFile("/proc/sys/kernel/core_uses_pid"); err == nil && strings.TrimSpace(string(usesPid)) != "0" && !strings.Contains(pattern, "%p") {
+		pattern += ".%p"
+	}
+
+	path := expandCorePattern(pattern, values)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/proc", values['P'], "cwd", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write core dump: %w", err)
+	}
+	defer f.Close()
+
+	// The dump belongs to the crashed process's owner, like one written by the kernel
+	uid, _ := strconv.Atoi(values['u'])
+	gid, _ := strconv.Atoi(values['g'])
+	if err := f.Chown(uid, gid); err != nil {
+		return fmt.Errorf("failed to write core dump: %w", err)
+	}
+
+	if _, err := io.CopyN(f, core, limit); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to write core dump: %w", err)
+	}
+
+	return nil
+}
+
+// expandCorePattern replaces core_pattern specifiers like %p with their values
+func expandCorePattern(pattern string, values map[byte]string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+
+		i++
+		if pattern[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		// Like the kernel, unknown specifiers are dropped
+		b.WriteString(values[pattern[i]])
+	}
+
+	return b.String()
+}
+
+// listCoreDumps returns the core dumps captured from a container, oldest first
+func listCoreDumps(id string) ([]CoreDump, error) {
+	if _, err := loadContainerState(id); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(containerDir(id), "cores")
+	paths, err := filepath.Glob(filepath.Join(dir, "core.*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var dumps []CoreDump
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read core dump info: %w", err)
+		}
+
+		var dump CoreDump
+		if err := json.Unmarshal(data, &dump); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		dump.File = filepath.Join(dir, dump.File)
+		dumps = append(dumps, dump)
+	}
+
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].Time.Before(dumps[j].Time) })
+
+	return dumps, nil
+}
+
+// printCoreDumps writes the core dump listing as a table
+func printCoreDumps(w io.Writer, dumps []CoreDump) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tPID\tSIGNAL\tCOMMAND\tSIZE\tFILE")
+	for _, d := range dumps {
+		signal := strconv.Itoa(d.Signal)
+		if name := signalName(syscall.Signal(d.Signal)); name != "" {
+			signal = name
+		}
+		fmt.Fprintf(tw, "%s ago\t%d\t%s\t%s\t%s\t%s\n", humanDuration(time.Since(d.Time)), d.Pid, signal, d.Command, formatSize(d.Size), d.File)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,365 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// copyOptions are those of cp
+type copyOptions struct {
+	// archive keeps the owners of the copied files instead of giving them to root in the
+	// container, or to the user running cp on the host
+	archive bool
+	// include, when set, leaves out the source paths it returns false for, like the files a
+	// build's .dockerignore excludes
+	include func(path string) bool
+}
+
+// copyEndpoint is one side of a copy: a path on the host, or in a container's root filesystem
+type copyEndpoint struct {
+	// root is the container's root filesystem as seen from the host, empty for the host
+	root string
+	path string
+	// userns is set for containers whose IDs are shifted by the user namespace
+	userns bool
+}
+
+// resolve returns the host path of a path below the endpoint's path. Symlinks are resolved
+// within the container's root filesystem, so they can't lead out of it.
+func (e copyEndpoint) resolve(rel string) (string, error) {
+	if e.root == "" {
+		return filepath.Join(e.path, rel), nil
+	}
+
+	return secureJoin(e.root, filepath.Join(e.path, rel))
+}
+
+// String returns the path the user gave
+func (e copyEndpoint) String() string {
+	return e.path
+}
+
+// splitCopyArg splits a cp argument into a container reference and the path in it, like
+// docker cp: container:path. Paths starting with / or . are on the host even if they contain
+// a colon.
+func splitCopyArg(arg string) (ref, path string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+
+	ref, path, ok := strings.Cut(arg, ":")
+	if !ok {
+		return "", arg
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	return ref, path
+}
+
+// openContainerPath returns the endpoint of path in a container, and whether files can be
+// copied into it. A running container is reached through its init's root, which includes its
+// volumes and tmpfs mounts. A stopped container has its rootfs on disk, except with
+// --shared-rootfs, whose writes went to a tmpfs gone with it; only the image is left to copy
+// from. The returned function releases the state lock that keeps a stopped container from
+// being started or removed while it is copied to or from.
+func openContainerPath(id, path string) (copyEndpoint, bool, func(), error) {
+	lock, err := lockState(id)
+	if err != nil {
+		return copyEndpoint{}, false, nil, err
+	}
+	release := func() { lock.Close() }
+
+	state, err := loadContainerState(id)
+	if err != nil {
+		release()
+		return copyEndpoint{}, false, nil, err
+	}
+	endpoint := copyEndpoint{root: state.RootPath, path: path, userns: state.Config.UserNamespace}
+
+	switch {
+	case state.running():
+		// The copy fails cleanly if the container exits meanwhile, so it needn't hold the lock
+		release()
+		endpoint.root = fmt.Sprintf("/proc/%d/root", state.Pid)
+		return endpoint, true, func() {}, nil
+	case state.LowerDir != "":
+		endpoint.root = state.LowerDir
+		return endpoint, false, release, nil
+	case len(state.Layers) > 0:
+		// The overlay stays mounted until the container is removed, unless the host rebooted
+		if err := mountOverlayRootfs(state.RootPath, state.Layers); err != nil {
+			release()
+			return copyEndpoint{}, false, nil, err
+		}
+		endpoint.root = overlayMergedDir(state.RootPath)
+	}
+
+	return endpoint, true, release, nil
+}
+
+// copyFiles copies the file or directory at src to dst like docker cp: into dst if that is
+// an existing directory, otherwise to dst itself, whose parent must exist. A source ending in
+// /. copies the directory's contents instead of the directory.
+func copyFiles(src, dst copyEndpoint, opts copyOptions) error {
+	contents := strings.HasSuffix(src.path, "/.") || src.path == "."
+	srcPath := src.path
+	var err error
+	switch {
+	case src.root != "" && contents:
+		srcPath, err = src.resolve("")
+	case src.root != "":
+		// The last element is copied as it is, even if it is a symlink
+		srcPath, err = src.resolveParent()
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, noSuchPath(err))
+	}
+	if contents && !info.IsDir() {
+		return fmt.Errorf("failed to copy %s: not a directory", src)
+	}
+
+	dstPath, err := dst.resolve("")
+	if err != nil {
+		return err
+	}
+	target := dst
+	switch dstInfo, err := os.Stat(dstPath); {
+	case err == nil && dstInfo.IsDir():
+		if !contents {
+			target.path = filepath.Join(dst.path, filepath.Base(src.path))
+		}
+	case err == nil:
+		if info.IsDir() {
+			return fmt.Errorf("failed to copy %s: cannot copy a directory to file %s", src, dst)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if strings.HasSuffix(dst.path, "/") && !info.IsDir() {
+			return fmt.Errorf("failed to copy %s: destination directory %s does not exist", src, dst)
+		}
+		if _, err := os.Stat(filepath.Dir(dstPath)); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", src, noSuchPath(err))
+		}
+	default:
+		return fmt.Errorf("failed to copy to %s: %w", dst, err)
+	}
+
+	c := &fileCopier{dst: target, opts: opts, toContainer: dst.root != "", userns: src.userns || dst.userns}
+	if err := c.copyTree(srcPath); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+
+	return nil
+}
+
+// resolveParent returns the host path of the endpoint's path with only its directory resolved
+// within the root, so that a symlink at the end is the symlink itself
+func (e copyEndpoint) resolveParent() (string, error) {
+	dir, err := secureJoin(e.root, filepath.Dir(filepath.Clean("/"+e.path)))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, filepath.Base(filepath.Clean("/"+e.path))), nil
+}
+
+// noSuchPath rewords the error for a missing path without the host path it was looked up at
+func noSuchPath(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no such file or directory")
+	}
+
+	return err
+}
+
+// fileCopier copies a tree of files to a copy endpoint
+type fileCopier struct {
+	dst         copyEndpoint
+	opts        copyOptions
+	toContainer bool
+	userns      bool
+}
+
+// copyTree copies src and everything below it. Directories get their mode and times once
+// they are filled, since adding files changes their modification time.
+func (c *fileCopier) copyTree(src string) error {
+	type dir struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []dir
+
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if c.opts.include != nil && path != src && !c.opts.include(path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to stat %s", rel)
+		}
+
+		// Every path is resolved on its own, so symlinks already in a container can't take
+		// later files out of it
+		target, err := c.dst.resolve(rel)
+		if err != nil {
+			return err
+		}
+		uid, gid := c.owner(st)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); errors.Is(err, os.ErrExist) {
+				if st, err := os.Stat(target); err != nil || !st.IsDir() {
+					return fmt.Errorf("cannot overwrite non-directory %s with a directory", filepath.Join(c.dst.path, rel))
+				}
+			} else if err != nil {
+				return err
+			}
+			if err := os.Lchown(target, uid, gid); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir{target, info})
+			return nil
+		case mode.IsRegular():
+			return copyFileContents(path, target, info, uid, gid)
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := replaceWith(target, func() error { return os.Symlink(link, target) }); err != nil {
+				return err
+			}
+			return os.Lchown(target, uid, gid)
+		case mode&fs.ModeSocket != 0:
+			// Sockets only mean something to the process listening on them
+			return nil
+		}
+
+		// Devices and FIFOs
+		if err := replaceWith(target, func() error { return syscall.Mknod(target, st.Mode, int(st.Rdev)) }); err != nil {
+			return fmt.Errorf("failed to create %s: %w", rel, err)
+		}
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// Chown clears the setgid bit, which is why the mode is set after it
+		if err := os.Chmod(dirs[i].path, dirs[i].info.Mode()&(fs.ModePerm|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].info.ModTime(), dirs[i].info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// owner returns who a copy of a file with st is owned by on the host: root in the container or
+// the user running cp, or with --archive the owner of the original, shifted into or out of the
+// user namespace's range like shiftOwnership does
+func (c *fileCopier) owner(st *syscall.Stat_t) (int, int) {
+	if !c.opts.archive && !c.toContainer {
+		return os.Getuid(), os.Getgid()
+	}
+
+	uid, gid := int(st.Uid), int(st.Gid)
+	if !c.opts.archive {
+		uid, gid = 0, 0
+	}
+	if !c.userns {
+		return uid, gid
+	}
+
+	shift := func(id int) int {
+		if c.toContainer && id < userNamespaceSize {
+			return id + userNamespaceHostID
+		}
+		if !c.toContainer && id >= userNamespaceHostID && id < userNamespaceHostID+userNamespaceSize {
+			return id - userNamespaceHostID
+		}
+		// IDs outside the range stay unmapped
+		return id
+	}
+	return shift(uid), shift(gid)
+}
+
+// copyFileContents copies the regular file src over dst, which is replaced if it isn't a
+// regular file itself
+func copyFileContents(src, dst string, info fs.FileInfo, uid, gid int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if st, err := os.Lstat(dst); err == nil && !st.Mode().IsRegular() {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	// Chown clears the setuid bits, so it goes first
+	if err := out.Chown(uid, gid); err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// replaceWith creates path with create, removing a file or empty directory in its way first
+func replaceWith(path string, create func() error) error {
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return create()
+}
@@ -0,0 +1,697 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemonAPIVersion is the version of the Docker Engine API whose subset the daemon serves
+const daemonAPIVersion = "1.43"
+
+// daemonShutdownTimeout is how long requests in progress get to finish once the daemon is
+// interrupted, before their connections are closed
+const daemonShutdownTimeout = 5 * time.Second
+
+// Conditions of POST /containers/{id}/wait
+const (
+	waitConditionNotRunning = "not-running"
+	waitConditionNextExit   = "next-exit"
+	waitConditionRemoved    = "removed"
+)
+
+// defaultDaemonSocket is where the daemon listens unless -H says otherwise
+var defaultDaemonSocket = filepath.Join(containerStateDir, "docker.sock")
+
+// apiVersionPrefix matches the version clients put in front of paths, as in /v1.43/_ping
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)?/`)
+
+// reapShims makes startShim wait for the shims it starts, as the daemon outlives them instead
+// of leaving them to be reparented
+var reapShims bool
+
+// ownsSignals is set by the daemon, which shuts down gracefully on cleanupSignals. Setups in
+// progress are then cancelled through their requests rather than by a signal handler of their
+// own, which would end the daemon with them.
+var ownsSignals bool
+
+// errBadRequest marks errors in a request rather than in serving it
+var errBadRequest = errors.New("invalid request")
+
+// serveDaemon serves the API on a unix socket until one of cleanupSignals shuts it down,
+// running at most maxJobs pulls and builds at once. With a webhookToken, it also serves
+// POST /webhooks/registry for requests with that bearer token, on webhookAddr as well if
+// one is given.
+func serveDaemon(path string, maxJobs int, webhookToken, webhookAddr string) error {
+	// A socket left by a daemon that is gone is replaced, one that is still served isn't
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	jobs, err := newJobQueue(daemonJobsDir, maxJobs)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	reapShims, ownsSignals = true, true
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, cleanupSignals...)
+	defer signal.Stop(signals)
+
+	var updater *autoUpdater
+	if webhookToken != "" {
+		updater = newAutoUpdater(webhookToken, jobs)
+	}
+	// Registries can't reach a unix socket, so the webhook alone is also served on TCP
+	var webhookSrv *http.Server
+	if webhookAddr != "" {
+		webhookListener, err := net.Listen("tcp", webhookAddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %w", webhookAddr, err)
+		}
+		webhookSrv = &http.Server{Handler: updater.handler(), ReadHeaderTimeout: 10 * time.Second}
+		go webhookSrv.Serve(webhookListener)
+		fmt.Fprintf(os.Stderr, "Registry webhook listening on %s\n", webhookListener.Addr())
+	}
+
+	// Requests get a context of their own that shutting down cancels once it stops waiting
+	// for them, so that containers being set up are undone rather than left half-made
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	var handlers sync.WaitGroup
+	handler := newDaemonHandler(jobs, updater)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context { return requests },
+	}
+	enableUnencryptedHTTP2(srv)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer jobs.wait()
+	defer stopJobs()
+	jobs.start(jobsCtx)
+	fmt.Fprintf(os.Stderr, "API listening on %s\n", path)
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve the API: %w", err)
+	case sig := <-signals:
+		fmt.Fprintf(os.Stderr, "Received %v, shutting down\n", sig)
+	}
+
+	// Running jobs are interrupted and queued again for the next daemon. Requests in progress
+	// get to finish, unless a second signal says not to wait. Waits and followed logs only end
+	// with their containers, they are cut off.
+	stopJobs()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), daemonShutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-shutdownCtx.Done():
+		}
+	}()
+	if webhookSrv != nil {
+		if err := webhookSrv.Shutdown(shutdownCtx); err != nil {
+			webhookSrv.Close()
+		}
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		cancelRequests()
+		srv.Close()
+	}
+	handlers.Wait()
+	if updater != nil {
+		updater.stop()
+	}
+	jobs.wait()
+
+	return nil
+}
+
+// newDaemonHandler routes the endpoints of the API, with or without a version in front. Pulls
+// and builds take one of the slots of jobs. The registry webhook is only served with an
+// updater.
+func newDaemonHandler(jobs *jobQueue, updater *autoUpdater) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_ping", handlePing)
+	mux.HandleFunc("HEAD /_ping", handlePing)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+	mux.HandleFunc("POST /grpc.health.v1.Health/Check", handleGRPCHealthCheck)
+	mux.HandleFunc("POST /grpc.health.v1.Health/Watch", handleGRPCHealthWatch)
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateContainer(w, r, jobs)
+	})
+	mux.HandleFunc("POST /containers/{id}/start", handleStartContainer)
+	mux.HandleFunc("POST /containers/{id}/wait", handleWaitContainer)
+	mux.HandleFunc("GET /containers/{id}/logs", handleContainerLogs)
+	mux.HandleFunc("POST /images/create", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateImage(w, r, jobs)
+	})
+	mux.HandleFunc("POST /jobs/pull", jobs.handleCreateJob(jobKindPull))
+	mux.HandleFunc("POST /jobs/build", jobs.handleCreateJob(jobKindBuild))
+	mux.HandleFunc("GET /jobs", jobs.handleListJobs)
+	mux.HandleFunc("GET /jobs/{id}", jobs.handleInspectJob)
+	mux.HandleFunc("GET /jobs/{id}/log", jobs.handleJobLog)
+	mux.HandleFunc("POST /jobs/{id}/cancel", jobs.handleCancelJob)
+	mux.HandleFunc("DELETE /jobs/{id}", jobs.handleRemoveJob)
+	if updater != nil {
+		mux.HandleFunc("POST /webhooks/registry", updater.handleWebhook)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("page not found: %s %s", r.Method, r.URL.Path))
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", daemonAPIVersion)
+		if loc := apiVersionPrefix.FindStringIndex(r.URL.Path); loc != nil {
+			r.URL.Path = r.URL.Path[loc[1]-1:]
+			r.URL.RawPath = ""
+		}
+		debugf(eventTypeContainer, "API request", "method", r.Method, "path", r.URL.Path)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON responds with v as JSON
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError responds with an error the way Docker does, as a JSON message
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"message": err.Error()})
+}
+
+// writeEngineError responds with an error of the engine, with the status Docker gives it
+func writeEngineError(w http.ResponseWriter, err error) {
+	var conflict *nameConflictError
+	var jobConflict *jobConflictError
+	switch {
+	case errors.Is(err, errBadRequest):
+		writeAPIError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errContainerNotFound), errors.Is(err, errImageNotFound), errors.Is(err, errJobNotFound):
+		writeAPIError(w, http.StatusNotFound, err)
+	case errors.As(err, &conflict), errors.As(err, &jobConflict):
+		writeAPIError(w, http.StatusConflict, err)
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// queryBool reads a boolean query parameter the way Docker does, which takes 1 and true
+func queryBool(r *http.Request, name string) bool {
+	v := r.URL.Query().Get(name)
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// flush sends what has been written of a streamed response
+func flush(w http.ResponseWriter) {
+	http.NewResponseController(w).Flush()
+}
+
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	io.WriteString(w, "OK")
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"Version":       "your-docker",
+		"ApiVersion":    daemonAPIVersion,
+		"MinAPIVersion": daemonAPIVersion,
+		"Os":            runtime.GOOS,
+		"Arch":          runtime.GOARCH,
+		"GoVersion":     runtime.Version(),
+	})
+}
+
+// apiContainerConfig is the body of POST /containers/create, with the fields of Docker's that
+// containers here have. Others are ignored, like Docker ignores those it doesn't know.
+type apiContainerConfig struct {
+	Hostname    string
+	User        string
+	Env         []string
+	Cmd         []string
+	Entrypoint  []string
+	Image       string
+	WorkingDir  string
+	Tty         bool
+	OpenStdin   bool
+	Healthcheck *HealthConfig
+	Labels      map[string]string
+	HostConfig  apiHostConfig
+}
+
+// apiHostConfig is the part of apiContainerConfig about the host
+type apiHostConfig struct {
+	Binds          []string
+	NetworkMode    string
+	AutoRemove     bool
+	RestartPolicy  RestartPolicy
+	Memory         int64
+	NanoCpus       int64
+	PidsLimit      *int64
+	ReadonlyRootfs bool
+	CapAdd         []string
+	CapDrop        []string
+	Dns            []string
+	DnsSearch      []string
+	ExtraHosts     []string
+	SecurityOpt    []string
+}
+
+// command returns the command of the container, merged with the image's the way Docker does:
+// Cmd alone is arguments to the image's entrypoint, an Entrypoint replaces both the image's
+// entrypoint and Cmd, and an empty one only clears the entrypoint
+func (c apiContainerConfig) command(image imageConfig) []string {
+	entrypoint, cmd := c.Entrypoint, c.Cmd
+	// Docker's CLI sends --entrypoint "" as a single empty string
+	if len(entrypoint) == 1 && entrypoint[0] == "" {
+		entrypoint = []string{}
+	}
+
+	if len(entrypoint) == 0 {
+		if len(cmd) == 0 {
+			cmd = image.Config.Cmd
+		}
+		if entrypoint == nil {
+			entrypoint = image.Config.Entrypoint
+		}
+	}
+
+	return append(append([]string{}, entrypoint...), cmd...)
+}
+
+// runOptions converts the config to the options of a container created from image, whose
+// config the command is merged with
+func (c apiContainerConfig) runOptions(name string, image imageConfig) (RunOptions, error) {
+	if c.Image == "" {
+		return RunOptions{}, fmt.Errorf("%w: config has no Image", errBadRequest)
+	}
+	argv := c.command(image)
+	if len(argv) == 0 {
+		return RunOptions{}, fmt.Errorf("%w: no command specified", errBadRequest)
+	}
+
+	opts := RunOptions{
+		Image:          c.Image,
+		Name:           name,
+		Env:            c.Env,
+		User:           c.User,
+		WorkingDir:     c.WorkingDir,
+		Hostname:       c.Hostname,
+		TTY:            c.Tty,
+		Interactive:    c.OpenStdin,
+		Healthcheck:    c.Healthcheck,
+		Labels:         c.Labels,
+		AutoRemove:     c.HostConfig.AutoRemove,
+		Restart:        c.HostConfig.RestartPolicy,
+		ReadOnlyRootfs: c.HostConfig.ReadonlyRootfs,
+		CapAdd:         c.HostConfig.CapAdd,
+		CapDrop:        c.HostConfig.CapDrop,
+		DNS:            c.HostConfig.Dns,
+		DNSSearch:      c.HostConfig.DnsSearch,
+		ExtraHosts:     c.HostConfig.ExtraHosts,
+		SecurityOpts:   c.HostConfig.SecurityOpt,
+		// Nobody watches the daemon pull
+		Quiet: true,
+	}
+	opts.Command, opts.Args = argv[0], argv[1:]
+
+	for _, bind := range c.HostConfig.Binds {
+		m, err := ParseVolume(bind)
+		if err != nil {
+			return RunOptions{}, fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		opts.Mounts = append(opts.Mounts, m)
+	}
+	// Docker's clients ask for its default network, which is ours as well
+	if c.HostConfig.NetworkMode != "default" {
+		opts.Network = NetworkMode(c.HostConfig.NetworkMode)
+	}
+
+	opts.Limits.Memory = c.HostConfig.Memory
+	opts.Limits.CPUs = float64(c.HostConfig.NanoCpus) / 1e9
+	if c.HostConfig.PidsLimit != nil && *c.HostConfig.PidsLimit > 0 {
+		opts.Limits.PidsLimit = *c.HostConfig.PidsLimit
+	}
+
+	return opts, nil
+}
+
+func handleCreateContainer(w http.ResponseWriter, r *http.Request, jobs *jobQueue) {
+	var config apiContainerConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid container config: %w", err))
+		return
+	}
+
+	// The command is merged with the image's config, so an image that isn't stored yet is
+	// pulled first
+	store := DefaultImageStore()
+	_, image, err := storedImage(store, config.Image, nil)
+	if errors.Is(err, errImageNotFound) {
+		if _, err = jobs.pullImage(r.Context(), config.Image, PullOptions{}); err == nil {
+			_, image, err = storedImage(store, config.Image, nil)
+		}
+	}
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	opts, err := config.runOptions(r.URL.Query().Get("name"), image)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	id, err := CreateContainer(r.Context(), opts)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{"Id": id, "Warnings": []string{}})
+}
+
+func handleStartContainer(w http.ResponseWriter, r *http.Request) {
+	id, err := ResolveContainer(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	state, err := InspectContainer(id)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	if state.running() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if err := StartContainer(id); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWaitContainer responds once the container meets the condition. Like Docker, the status
+// is sent right away, so a client can start the container after it knows the wait is set up.
+func handleWaitContainer(w http.ResponseWriter, r *http.Request) {
+	condition := r.URL.Query().Get("condition")
+	switch condition {
+	case "":
+		condition = waitConditionNotRunning
+	case waitConditionNotRunning, waitConditionNextExit, waitConditionRemoved:
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid condition %q: expected not-running, next-exit or removed", condition))
+		return
+	}
+
+	id, err := ResolveContainer(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	response := map[string]any{}
+	code, err := waitContainerCondition(r.Context(), id, condition)
+	response["StatusCode"] = code
+	if err != nil {
+		response["Error"] = map[string]string{"Message": err.Error()}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// waitContainerCondition waits until the container doesn't run anymore, exits after it has
+// run again or is removed, and returns its exit code. A removed container's is that of its
+// last die event, as its state is gone.
+func waitContainerCondition(ctx context.Context, id, condition string) (int, error) {
+	first, err := loadContainerState(id)
+	if err != nil {
+		return 0, err
+	}
+	wasRunning := first.running()
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		state, err := loadContainerState(id)
+		switch {
+		case errors.Is(err, errContainerNotFound) && condition != waitConditionNotRunning:
+			return lastExitCode(id)
+		case err != nil:
+			return 0, err
+		}
+
+		exited := !state.running() && !state.restarting()
+		switch condition {
+		case waitConditionNotRunning:
+			if exited {
+				return state.ExitCode, nil
+			}
+		case waitConditionNextExit:
+			if exited && (wasRunning || state.Started.After(first.Started)) {
+				return state.ExitCode, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// lastExitCode returns the exit code of the container's last die event in the events log
+func lastExitCode(id string) (int, error) {
+	f, err := os.Open(eventsLogPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the exit code of %s: %w", shortID(id), err)
+	}
+	defer f.Close()
+
+	code, found := 0, false
+	if _, _, err := readEvents(bufio.NewReader(f), nil, func(ev Event) bool {
+		if ev.Type == eventTypeContainer && ev.Action == eventActionDie && ev.ID == id {
+			if n, err := strconv.Atoi(ev.Attributes["exitCode"]); err == nil {
+				code, found = n, true
+			}
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("failed to find the exit code of %s: it has no die event", shortID(id))
+	}
+
+	return code, nil
+}
+
+// handleContainerLogs streams a container's log. Like Docker, the stdout and stderr of a
+// container without a terminal are multiplexed into frames, which have the same header as
+// those of attach.
+func handleContainerLogs(w http.ResponseWriter, r *http.Request) {
+	id, err := ResolveContainer(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	state, err := InspectContainer(id)
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	stdout, stderr := queryBool(r, "stdout"), queryBool(r, "stderr")
+	if !stdout && !stderr {
+		writeAPIError(w, http.StatusBadRequest, errors.New("bad parameters: you must choose at least one stream"))
+		return
+	}
+
+	opts := logsOptions{follow: queryBool(r, "follow"), tail: -1}
+	if tail := r.URL.Query().Get("tail"); tail != "" {
+		if opts.tail, err = parseLogsTail(tail); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if opts.since, err = parseLogsSince(r.URL.Query().Get("since"), time.Now()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var out, errOut io.Writer
+	if state.Config.TTY {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		out, errOut = logsStream{w: w}, logsStream{w: w}
+	} else {
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		out, errOut = logsStream{w: w, kind: attachFrameStdout, framed: true}, logsStream{w: w, kind: attachFrameStderr, framed: true}
+	}
+	if !stdout {
+		out = io.Discard
+	}
+	if !stderr {
+		errOut = io.Discard
+	}
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	if err := printContainerLogs(id, opts, out, errOut); err != nil {
+		warnf(eventTypeContainer, "failed to stream logs of %s: %v", shortID(id), err)
+	}
+}
+
+// logsStream writes a stream of a container's log to the response, framed unless the
+// container has a terminal
+type logsStream struct {
+	w      http.ResponseWriter
+	kind   byte
+	framed bool
+}
+
+func (s logsStream) Write(p []byte) (int, error) {
+	if s.framed {
+		if err := writeAttachFrame(s.w, s.kind, p); err != nil {
+			return 0, err
+		}
+	} else if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	flush(s.w)
+
+	return len(p), nil
+}
+
+// handleCreateImage pulls an image like POST /images/create?fromImage=, streaming its status
+// as JSON messages. Like Docker, a failed pull is reported in the stream, which has already
+// started.
+func handleCreateImage(w http.ResponseWriter, r *http.Request, jobs *jobQueue) {
+	query := r.URL.Query()
+	if query.Get("fromSrc") != "" {
+		writeAPIError(w, http.StatusNotImplemented, errors.New("importing images with fromSrc is not supported, only pulling with fromImage"))
+		return
+	}
+	ref := query.Get("fromImage")
+	if ref == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("fromImage is required"))
+		return
+	}
+	if tag := query.Get("tag"); tag != "" {
+		if strings.HasPrefix(tag, "sha256:") {
+			ref += "@" + tag
+		} else {
+			ref += ":" + tag
+		}
+	}
+
+	opts := PullOptions{Platform: query.Get("platform")}
+	if auth := r.Header.Get("X-Registry-Auth"); auth != "" {
+		username, password, err := decodeRegistryAuth(auth)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts.Username, opts.Password = username, password
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]string{"status": "Pulling " + ref})
+	flush(w)
+
+	img, err := jobs.pullImage(r.Context(), ref, opts)
+	if err != nil {
+		enc.Encode(map[string]any{"errorDetail": map[string]string{"message": err.Error()}, "error": err.Error()})
+		return
+	}
+	if img.Digest != "" {
+		enc.Encode(map[string]string{"status": "Digest: " + img.Digest})
+	}
+	enc.Encode(map[string]string{"status": "Status: Pulled " + img.Reference()})
+}
+
+// decodeRegistryAuth reads the credentials of an X-Registry-Auth header, base64 encoded JSON
+// that clients encode with either alphabet
+func decodeRegistryAuth(header string) (string, string, error) {
+	// Clients differ in the alphabet and in whether they pad
+	var data []byte
+	var err error
+	for _, encoding := range []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding, base64.StdEncoding, base64.RawStdEncoding} {
+		if data, err = encoding.DecodeString(header); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("invalid X-Registry-Auth: %w", err)
+	}
+
+	var auth struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return "", "", fmt.Errorf("invalid X-Registry-Auth: %w", err)
+	}
+
+	return auth.Username, auth.Password, nil
+}
@@ -0,0 +1,14 @@
+//go:build go1.24
+
+package engine
+
+import "net/http"
+
+// enableUnencryptedHTTP2 lets the server speak HTTP/2 without TLS next to HTTP/1, which gRPC
+// clients of the health service connect with
+func enableUnencryptedHTTP2(srv *http.Server) {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	srv.Protocols = &protocols
+}
@@ -0,0 +1,10 @@
+//go:build !go1.24
+
+package engine
+
+import "net/http"
+
+// enableUnencryptedHTTP2 is left to Go 1.24's net/http, which is the first that serves HTTP/2
+// without TLS. Built with an older Go, the daemon only speaks HTTP/1 and gRPC clients can't
+// reach the health service.
+func enableUnencryptedHTTP2(srv *http.Server) {}
@@ -0,0 +1,67 @@
+//go:build go1.24
+
+package engine
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A gRPC client reaches the health service over HTTP/2 without TLS
+func TestGRPCHealthCheckOverHTTP2(t *testing.T) {
+	stubReadiness(t)
+
+	jobs, err := newJobQueue(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(newDaemonHandler(jobs, nil))
+	enableUnencryptedHTTP2(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	tests := []struct {
+		service    string
+		wantStatus string
+		wantBody   []byte
+	}{
+		{service: "network", wantStatus: "0", wantBody: grpcMessage([]byte{0x08, grpcHealthServing})},
+		{service: "", wantStatus: "0", wantBody: grpcMessage([]byte{0x08, grpcHealthNotServing})},
+		{service: "gpu", wantStatus: "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			request := []byte{0x0a, byte(len(tt.service))}
+			request = append(request, tt.service...)
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/grpc.health.v1.Health/Check", bytes.NewReader(grpcMessage(request)))
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ProtoMajor != 2 {
+				t.Errorf("served over %s, want HTTP/2", resp.Proto)
+			}
+			if got := resp.Trailer.Get("Grpc-Status"); got != tt.wantStatus {
+				t.Errorf("grpc-status = %q, want %q", got, tt.wantStatus)
+			}
+			if !bytes.Equal(body, tt.wantBody) {
+				t.Errorf("body = %v, want %v", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readyMinFreeSpace is the free space below which storage isn't ready, as pulls and new
+// containers would fail to write
+const readyMinFreeSpace = 100 << 20
+
+// Statuses of readiness checks
+const (
+	readinessOK     = "ok"
+	readinessFailed = "failed"
+)
+
+// Serving statuses of grpc.health.v1.HealthCheckResponse
+const (
+	grpcHealthServing    = 1
+	grpcHealthNotServing = 2
+)
+
+// gRPC status codes the health service responds with
+const (
+	grpcCodeOK            = 0
+	grpcCodeInvalidArg    = 3
+	grpcCodeNotFound      = 5
+	grpcCodeUnimplemented = 12
+)
+
+// readinessCheck is the status of one of the subsystems the daemon needs
+type readinessCheck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// readinessChecks are the subsystems /readyz and the gRPC health service report on, each
+// returning what it found or why it isn't ready. They are also the services the gRPC health
+// service knows, besides the empty name for all of them.
+var readinessChecks = []struct {
+	name  string
+	check func() (string, error)
+}{
+	{name: "storage", check: checkStorageReadiness},
+	{name: "network", check: checkNetworkReadiness},
+	{name: "cgroups", check: checkCgroupReadiness},
+}
+
+// checkReadiness runs the checks of the named subsystem, or of all of them for "", and tells
+// whether they passed. known is false for names of no subsystem.
+func checkReadiness(name string) (checks map[string]readinessCheck, ready, known bool) {
+	checks, ready = map[string]readinessCheck{}, true
+	for _, c := range readinessChecks {
+		if name != "" && c.name != name {
+			continue
+		}
+		known = true
+
+		message, err := c.check()
+		if err != nil {
+			checks[c.name] = readinessCheck{Status: readinessFailed, Message: err.Error()}
+			ready = false
+			continue
+		}
+		checks[c.name] = readinessCheck{Status: readinessOK, Message: message}
+	}
+
+	return checks, ready, known || name == ""
+}
+
+// checkStorageReadiness makes sure images can be pulled and containers created: their
+// directories must be writable and have room left
+func checkStorageReadiness() (string, error) {
+	var found []string
+	for _, dir := range []string{imageStoreDir, containerStateDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+		if err := syscall.Access(dir, accessWriteOK); err != nil {
+			return "", fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(dir, &fs); err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", dir, err)
+		}
+		free := int64(uint64(fs.Bavail) * uint64(fs.Bsize))
+		if free < readyMinFreeSpace {
+			return "", fmt.Errorf("%s has only %s free", dir, formatSize(free))
+		}
+		found = append(found, fmt.Sprintf("%s has %s free", dir, formatSize(free)))
+	}
+
+	return strings.Join(found, ", "), nil
+}
+
+// checkNetworkReadiness makes sure containers can get the default network: we need
+// CAP_NET_ADMIN to create their interfaces, and the bridge, which the first container
+// creates, must be up with forwarding enabled once it exists
+func checkNetworkReadiness() (string, error) {
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return "", err
+	}
+	if !caps.has("CAP_NET_ADMIN") {
+		return "", errors.New("CAP_NET_ADMIN is missing, so container networks can't be set up")
+	}
+
+	bridge, err := net.InterfaceByName(bridgeName)
+	if err != nil {
+		return fmt.Sprintf("bridge %s is created with the first container", bridgeName), nil
+	}
+	if bridge.Flags&net.FlagUp == 0 {
+		return "", fmt.Errorf("bridge %s is down", bridgeName)
+	}
+	forward, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return "", fmt.Errorf("failed to read whether IP forwarding is enabled: %w", err)
+	}
+	if strings.TrimSpace(string(forward)) != "1" {
+		return "", fmt.Errorf("IP forwarding is disabled, so containers on %s can't reach other networks", bridgeName)
+	}
+
+	return fmt.Sprintf("bridge %s is up", bridgeName), nil
+}
+
+// checkCgroupReadiness makes sure resource limits can be applied: cgroup v2 must be mounted
+// with the controllers they need and writable
+func checkCgroupReadiness() (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &fs); err != nil {
+		return "", fmt.Errorf("failed to inspect %s: %w", cgroupRoot, err)
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return "", errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	if err := syscall.Access(cgroupRoot, accessWriteOK); err != nil {
+		return "", fmt.Errorf("%s is not writable: %w", cgroupRoot, err)
+	}
+
+	available, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read controllers of %s: %w", cgroupRoot, err)
+	}
+	for _, c := range []string{"cpu", "memory", "pids"} {
+		if !containsString(strings.Fields(string(available)), c) {
+			return "", fmt.Errorf("cgroup controller %q is not available in %s", c, cgroupRoot)
+		}
+	}
+
+	return "cgroup v2 with the cpu, memory and pids controllers", nil
+}
+
+// effectiveCapabilities returns the capabilities we have
+func effectiveCapabilities() (capabilitySet, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read our capabilities: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read our capabilities: %w", err)
+			}
+			return capabilitySet(caps), nil
+		}
+	}
+
+	return 0, errors.New("failed to read our capabilities: /proc/self/status has no CapEff")
+}
+
+// handleReadyz reports whether the daemon can serve containers, 503 if it can't
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks, ready, _ := checkReadiness("")
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// handleGRPCHealthCheck serves grpc.health.v1.Health/Check for the subsystem named by the
+// service of the request, or all of them for the empty service
+func handleGRPCHealthCheck(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeGRPCStatus(w, grpcCodeInvalidArg, err.Error())
+		return
+	}
+	msg, err := readGRPCMessage(body)
+	if err != nil {
+		writeGRPCStatus(w, grpcCodeInvalidArg, err.Error())
+		return
+	}
+	service, err := parseHealthCheckRequest(msg)
+	if err != nil {
+		writeGRPCStatus(w, grpcCodeInvalidArg, err.Error())
+		return
+	}
+
+	_, ready, known := checkReadiness(service)
+	if !known {
+		writeGRPCStatus(w, grpcCodeNotFound, "unknown service "+service)
+		return
+	}
+	status := byte(grpcHealthServing)
+	if !ready {
+		status = grpcHealthNotServing
+	}
+
+	// HealthCheckResponse has the serving status as its field 1, a varint
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	w.Write(grpcMessage([]byte{0x08, status}))
+	setGRPCStatus(w, grpcCodeOK, "")
+}
+
+// handleGRPCHealthWatch answers grpc.health.v1.Health/Watch, which is left out, like the
+// spec allows
+func handleGRPCHealthWatch(w http.ResponseWriter, r *http.Request) {
+	writeGRPCStatus(w, grpcCodeUnimplemented, "Watch is not supported, poll Check instead")
+}
+
+// writeGRPCStatus responds with a gRPC status and no message
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	setGRPCStatus(w, code, message)
+}
+
+// setGRPCStatus sends the status of a gRPC call in the trailers of its response
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+	}
+}
+
+// readGRPCMessage returns the message of a gRPC request body holding one, which must not be
+// compressed as we don't offer any compression
+func readGRPCMessage(body []byte) ([]byte, error) {
+	if len(body) < 5 {
+		return nil, errors.New("truncated gRPC message")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	if n := binary.BigEndian.Uint32(body[1:5]); uint64(n) != uint64(len(body)-5) {
+		return nil, fmt.Errorf("gRPC message of %d bytes has %d", n, len(body)-5)
+	}
+
+	return body[5:], nil
+}
+
+// grpcMessage frames an uncompressed gRPC message
+func grpcMessage(msg []byte) []byte {
+	framed := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:5], uint32(len(msg)))
+
+	return append(framed, msg...)
+}
+
+// parseHealthCheckRequest returns the service of a protobuf HealthCheckRequest, its field 1,
+// skipping fields it doesn't know
+func parseHealthCheckRequest(msg []byte) (string, error) {
+	errInvalid := errors.New("invalid HealthCheckRequest")
+
+	var service string
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errInvalid
+		}
+		msg = msg[n:]
+
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return "", errInvalid
+			}
+			msg = msg[n:]
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return "", errInvalid
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return "", errInvalid
+			}
+			if key>>3 == 1 {
+				service = string(msg[n : n+int(size)])
+			}
+			msg = msg[n+int(size):]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return "", errInvalid
+			}
+			msg = msg[4:]
+		default:
+			return "", errInvalid
+		}
+	}
+
+	return service, nil
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubReadiness replaces the readiness checks for the test, the storage one failing
+func stubReadiness(t *testing.T) {
+	saved := readinessChecks
+	readinessChecks = []struct {
+		name  string
+		check func() (string, error)
+	}{
+		{name: "storage", check: func() (string, error) { return "", errors.New("disk full") }},
+		{name: "network", check: func() (string, error) { return "bridge is up", nil }},
+	}
+	t.Cleanup(func() { readinessChecks = saved })
+}
+
+func TestParseHealthCheckRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", msg: nil, want: ""},
+		{name: "service", msg: []byte{0x0a, 7, 's', 't', 'o', 'r', 'a', 'g', 'e'}, want: "storage"},
+		{name: "unknown fields", msg: []byte{0x10, 0x96, 0x01, 0x1d, 1, 2, 3, 4, 0x0a, 2, 'n', 'o', 0x22, 1, 'x'}, want: "no"},
+		{name: "truncated string", msg: []byte{0x0a, 7, 's'}, wantErr: true},
+		{name: "truncated varint", msg: []byte{0x10, 0x96}, wantErr: true},
+		{name: "invalid wire type", msg: []byte{0x0f}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHealthCheckRequest(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("service = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGRPCMessage(t *testing.T) {
+	msg, err := readGRPCMessage(grpcMessage([]byte{0x08, 1}))
+	if err != nil || string(msg) != "\x08\x01" {
+		t.Errorf("readGRPCMessage() = %q, %v, want the framed message", msg, err)
+	}
+
+	for _, body := range [][]byte{{0, 0, 0}, {1, 0, 0, 0, 0}, {0, 0, 0, 0, 3, 1}} {
+		if _, err := readGRPCMessage(body); err == nil {
+			t.Errorf("readGRPCMessage(%v) succeeded", body)
+		}
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	stubReadiness(t)
+
+	tests := []struct {
+		service   string
+		checks    int
+		wantReady bool
+		wantKnown bool
+	}{
+		{service: "", checks: 2, wantReady: false, wantKnown: true},
+		{service: "network", checks: 1, wantReady: true, wantKnown: true},
+		{service: "storage", checks: 1, wantReady: false, wantKnown: true},
+		{service: "gpu", checks: 0, wantReady: true, wantKnown: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			checks, ready, known := checkReadiness(tt.service)
+			if len(checks) != tt.checks || ready != tt.wantReady || known != tt.wantKnown {
+				t.Errorf("checkReadiness() = %v, %v, %v, want %d checks, %v, %v", checks, ready, known, tt.checks, tt.wantReady, tt.wantKnown)
+			}
+		})
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	stubReadiness(t)
+
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Status string
+		Checks map[string]readinessCheck
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "not ready" || body.Checks["storage"] != (readinessCheck{Status: readinessFailed, Message: "disk full"}) ||
+		body.Checks["network"].Status != readinessOK {
+		t.Errorf("body = %+v, want storage failing and network ok", body)
+	}
+}
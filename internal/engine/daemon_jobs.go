@@ -0,0 +1,727 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Statuses of daemon jobs
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusSucceeded = "succeeded"
+	jobStatusFailed    = "failed"
+	jobStatusCancelled = "cancelled"
+)
+
+// Kinds of daemon jobs, named after the commands that run them
+const (
+	jobKindPull  = "pull"
+	jobKindBuild = "build"
+)
+
+// defaultMaxConcurrentJobs is how many pulls and builds the daemon runs at once unless
+// --max-concurrent-jobs says otherwise, like the concurrent downloads of Docker's daemon
+const defaultMaxConcurrentJobs = 3
+
+// jobRetention is how long finished jobs are kept for their status to be looked up
+const jobRetention = 24 * time.Hour
+
+// jobStopTimeout is how long an interrupted job gets to undo what it did before it is killed
+const jobStopTimeout = 10 * time.Second
+
+// daemonJobsDir holds the record and the output of every job of the daemon, so that queued
+// ones survive it being restarted
+var daemonJobsDir = filepath.Join(containerStateDir, "jobs")
+
+// errJobNotFound is returned for IDs without a job
+var errJobNotFound = errors.New("no such job")
+
+// errJobCancelled is the cause of a job cancelled through the API
+var errJobCancelled = errors.New("job cancelled")
+
+// daemonJob is a pull or build the daemon runs in the background, as a command of its own
+type daemonJob struct {
+	ID       string        `json:"id"`
+	Kind     string        `json:"kind"`
+	Status   string        `json:"status"`
+	Pull     *pullJobSpec  `json:"pull,omitempty"`
+	Build    *buildJobSpec `json:"build,omitempty"`
+	Created  time.Time     `json:"created"`
+	Started  time.Time     `json:"started,omitempty"`
+	Finished time.Time     `json:"finished,omitempty"`
+	Progress jobProgress   `json:"progress"`
+	// Image is the reference of the pulled or built image once the job succeeded
+	Image string `json:"image,omitempty"`
+	// Error and ErrorCode are the message and the --error-json code of a failed job
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// pullJobSpec is what POST /jobs/pull pulls
+type pullJobSpec struct {
+	Image    string `json:"image"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// buildJobSpec is what POST /jobs/build builds, with the options of the build command
+type buildJobSpec struct {
+	// Context is the absolute path of the context directory, Dockerfile is relative to it
+	// unless it is absolute as well
+	Context    string            `json:"context"`
+	Dockerfile string            `json:"dockerfile,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	BuildArgs  map[string]string `json:"buildArgs,omitempty"`
+	NoCache    bool              `json:"noCache,omitempty"`
+	// Compression is a --compression value, gzip by default
+	Compression string `json:"compression,omitempty"`
+}
+
+// jobProgress is how far along a running job is
+type jobProgress struct {
+	// Status is the last status line, e.g. of the layer being downloaded or the build step
+	Status string `json:"status,omitempty"`
+	// Current and Total are the bytes downloaded so far of the layers a pull has started on
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+
+	layers map[string]EventProgress
+}
+
+// active tells whether the job is still to finish
+func (j *daemonJob) active() bool {
+	return j.Status == jobStatusQueued || j.Status == jobStatusRunning
+}
+
+// args are the arguments of the command that runs the job. Its failure is reported with
+// --error-json, for the job's error code.
+func (j *daemonJob) args() []string {
+	args := append(append([]string{}, globalArgs...), errorJSONArg)
+
+	switch j.Kind {
+	case jobKindPull:
+		args = append(args, "pull", "--format", "json")
+		if j.Pull.Platform != "" {
+			args = append(args, "--platform", j.Pull.Platform)
+		}
+		return append(args, "--", j.Pull.Image)
+	case jobKindBuild:
+		args = append(args, "build")
+		for _, tag := range j.Build.Tags {
+			args = append(args, "-t", tag)
+		}
+		if j.Build.Dockerfile != "" {
+			dockerfile := j.Build.Dockerfile
+			if !filepath.IsAbs(dockerfile) {
+				dockerfile = filepath.Join(j.Build.Context, dockerfile)
+			}
+			args = append(args, "-f", dockerfile)
+		}
+		names := make([]string, 0, len(j.Build.BuildArgs))
+		for name := range j.Build.BuildArgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			args = append(args, "--build-arg", name+"="+j.Build.BuildArgs[name])
+		}
+		if j.Build.NoCache {
+			args = append(args, "--no-cache")
+		}
+		if j.Build.Compression != "" {
+			args = append(args, "--compression", j.Build.Compression)
+		}
+		return append(args, "--", j.Build.Context)
+	}
+
+	return nil
+}
+
+// validate checks the spec of a job before it is queued, rather than when it runs
+func (j *daemonJob) validate() error {
+	switch j.Kind {
+	case jobKindPull:
+		if j.Pull.Image == "" {
+			return fmt.Errorf("%w: image is required", errBadRequest)
+		}
+		if j.Pull.Platform != "" {
+			if _, err := ParsePlatform(j.Pull.Platform); err != nil {
+				return fmt.Errorf("%w: %v", errBadRequest, err)
+			}
+		}
+	case jobKindBuild:
+		if !filepath.IsAbs(j.Build.Context) {
+			return fmt.Errorf("%w: context must be an absolute path, got %q", errBadRequest, j.Build.Context)
+		}
+		for _, tag := range j.Build.Tags {
+			if _, _, err := parseImageReference(tag); err != nil {
+				return fmt.Errorf("%w: invalid tag %q: %v", errBadRequest, tag, err)
+			}
+		}
+		for name := range j.Build.BuildArgs {
+			if name == "" || strings.Contains(name, "=") {
+				return fmt.Errorf("%w: invalid build arg name %q", errBadRequest, name)
+			}
+		}
+		if j.Build.Compression != "" {
+			if _, err := parseLayerCompression(j.Build.Compression); err != nil {
+				return fmt.Errorf("%w: %v", errBadRequest, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// jobQueue runs the daemon's jobs in the order they were queued. It shares its slots with
+// pulls of the API that aren't jobs, so that no burst of requests downloads more at once.
+type jobQueue struct {
+	dir string
+	// slots holds a token for every pull or build in progress
+	slots chan struct{}
+	// wake tells the dispatcher that a job was queued
+	wake chan struct{}
+
+	mu      sync.Mutex
+	jobs    map[string]*daemonJob
+	pending []*daemonJob
+	cancels map[string]context.CancelCauseFunc
+
+	running sync.WaitGroup
+}
+
+// newJobQueue loads the jobs kept in dir. Those that were queued or running when the daemon
+// last stopped are queued again, pulls resuming what they downloaded, and finished ones
+// older than jobRetention are removed.
+func newJobQueue(dir string, maxJobs int) (*jobQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+
+	q := &jobQueue{
+		dir:     dir,
+		slots:   make(chan struct{}, maxJobs),
+		wake:    make(chan struct{}, 1),
+		jobs:    map[string]*daemonJob{},
+		cancels: map[string]context.CancelCauseFunc{},
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job %s: %w", id, err)
+		}
+		var job daemonJob
+		if err := json.Unmarshal(data, &job); err != nil || job.ID != id {
+			warnf(eventTypeImage, "ignoring the invalid record of job %s", id)
+			continue
+		}
+
+		switch {
+		case job.active():
+			job.Status, job.Started = jobStatusQueued, time.Time{}
+			q.pending = append(q.pending, &job)
+		case time.Since(job.Finished) > jobRetention:
+			q.removeFiles(id)
+			continue
+		}
+		q.jobs[id] = &job
+	}
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].Created.Before(q.pending[j].Created) })
+
+	return q, nil
+}
+
+// start runs queued jobs until ctx is cancelled, which interrupts the running ones and queues
+// them again for the next daemon
+func (q *jobQueue) start(ctx context.Context) {
+	q.running.Add(1)
+	go func() {
+		defer q.running.Done()
+		q.dispatch(ctx)
+	}()
+}
+
+// wait waits until the jobs interrupted by cancelling start's context have stopped
+func (q *jobQueue) wait() {
+	q.running.Wait()
+}
+
+func (q *jobQueue) dispatch(ctx context.Context) {
+	for {
+		release, err := q.acquire(ctx)
+		if err != nil {
+			return
+		}
+		job, jobCtx := q.next(ctx)
+		if job == nil {
+			release()
+			return
+		}
+
+		q.running.Add(1)
+		go func() {
+			defer q.running.Done()
+			defer release()
+			q.finish(job, jobCtx, q.run(jobCtx, job))
+		}()
+	}
+}
+
+// acquire waits for a free slot, which the returned function gives back
+func (q *jobQueue) acquire(ctx context.Context) (func(), error) {
+	select {
+	case q.slots <- struct{}{}:
+		return func() { <-q.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pullImage pulls an image for a request, once a slot is free
+func (q *jobQueue) pullImage(ctx context.Context, ref string, opts PullOptions) (*StoredImage, error) {
+	release, err := q.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return PullImage(ctx, ref, opts)
+}
+
+// next waits for the oldest queued job and marks it running, with a context that
+// cancelling the job cancels
+func (q *jobQueue) next(ctx context.Context) (*daemonJob, context.Context) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			jobCtx, cancel := context.WithCancelCause(ctx)
+			q.cancels[job.ID] = cancel
+			job.Status, job.Started = jobStatusRunning, time.Now().UTC()
+			job.Progress, job.Error, job.ErrorCode = jobProgress{}, "", ""
+			q.save(job)
+			q.mu.Unlock()
+			return job, jobCtx
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// run runs the job's command with its output appended to the job's log. The command is
+// interrupted rather than killed when ctx is cancelled, so that it undoes what it did.
+func (q *jobQueue) run(ctx context.Context, job *daemonJob) error {
+	log, err := os.OpenFile(q.logPath(job.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the log of job %s: %w", job.ID, err)
+	}
+	defer log.Close()
+
+	stdout := &jobOutput{q: q, job: job, log: log, handle: q.handleOutput}
+	stderr := &jobOutput{q: q, job: job, log: log, handle: q.handleErrorOutput}
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", job.args()...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// Signals sent to the daemon's process group are for it alone, it decides what to stop
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGINT)
+	}
+	cmd.WaitDelay = jobStopTimeout
+
+	err = cmd.Run()
+	stdout.flush()
+	stderr.flush()
+
+	return err
+}
+
+// finish records how the job ended. One interrupted by the daemon shutting down is queued
+// again instead.
+func (q *jobQueue) finish(job *daemonJob, ctx context.Context, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	defer delete(q.cancels, job.ID)
+	defer q.cancels[job.ID](nil)
+
+	switch {
+	case errors.Is(context.Cause(ctx), errJobCancelled):
+		job.Status, job.Error, job.ErrorCode = jobStatusCancelled, "", ""
+	case ctx.Err() != nil:
+		job.Status, job.Started, job.Progress = jobStatusQueued, time.Time{}, jobProgress{}
+		q.save(job)
+		return
+	case err != nil:
+		job.Status = jobStatusFailed
+		if job.Error == "" {
+			job.Error = err.Error()
+		}
+	default:
+		job.Status, job.Error, job.ErrorCode = jobStatusSucceeded, "", ""
+	}
+	job.Finished = time.Now().UTC()
+	q.save(job)
+}
+
+// handleOutput follows the progress of a job in a line of its command's output: the JSON
+// events of a pull, or the steps a build prints
+func (q *jobQueue) handleOutput(job *daemonJob, line string) {
+	switch job.Kind {
+	case jobKindPull:
+		var ev Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type != eventTypeImage {
+			return
+		}
+
+		switch ev.Action {
+		case eventActionProgress:
+			job.Progress.Status = ev.Message
+			if ev.ID != "" {
+				job.Progress.Status = ev.ID + ": " + ev.Message
+			}
+			if ev.Progress == nil || ev.Message != "Downloading" {
+				return
+			}
+			if job.Progress.layers == nil {
+				job.Progress.layers = map[string]EventProgress{}
+			}
+			job.Progress.layers[ev.ID] = *ev.Progress
+			job.Progress.Current, job.Progress.Total = 0, 0
+			for _, p := range job.Progress.layers {
+				job.Progress.Current += p.Current
+				job.Progress.Total += p.Total
+			}
+		case eventActionPull:
+			job.Progress.Status, job.Image = ev.Message, ev.ID
+		}
+	case jobKindBuild:
+		switch {
+		case strings.HasPrefix(line, "Step "):
+			job.Progress.Status = line
+		case strings.HasPrefix(line, "Successfully built "):
+			// The image is known by its first tag, if it has one
+			job.Progress.Status = line
+			if len(job.Build.Tags) == 0 {
+				job.Image = strings.TrimPrefix(line, "Successfully built ")
+			}
+		case strings.HasPrefix(line, "Successfully tagged "):
+			if job.Image == "" {
+				job.Image = strings.TrimPrefix(line, "Successfully tagged ")
+			}
+		}
+	}
+}
+
+// handleErrorOutput takes the job's error from the diagnosis its command fails with
+func (q *jobQueue) handleErrorOutput(job *daemonJob, line string) {
+	var d errorDiagnosis
+	if err := json.Unmarshal([]byte(line), &d); err != nil || d.Code == "" {
+		return
+	}
+	job.Error, job.ErrorCode = d.Error, d.Code
+}
+
+// jobOutput appends the output of a job's command to its log a line at a time, handing each
+// line to handle while the queue is locked
+type jobOutput struct {
+	q       *jobQueue
+	job     *daemonJob
+	log     io.Writer
+	handle  func(job *daemonJob, line string)
+	partial []byte
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.line(o.partial[:i+1])
+		o.partial = o.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// flush handles what the command wrote after its last newline
+func (o *jobOutput) flush() {
+	if len(o.partial) > 0 {
+		o.line(append(o.partial, '\n'))
+		o.partial = nil
+	}
+}
+
+func (o *jobOutput) line(line []byte) {
+	o.q.mu.Lock()
+	defer o.q.mu.Unlock()
+
+	// A job whose log can't be written still runs, it just isn't kept
+	o.log.Write(line)
+	o.handle(o.job, strings.TrimRight(string(line), "\r\n"))
+}
+
+// queue adds a job and wakes the dispatcher
+func (q *jobQueue) queue(job *daemonJob) error {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate job ID: %w", err)
+	}
+	job.ID, job.Status, job.Created = hex.EncodeToString(id), jobStatusQueued, time.Now().UTC()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.save(job); err != nil {
+		return err
+	}
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// get returns a copy of a job, which the queue goes on changing
+func (q *jobQueue) get(id string) (daemonJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return daemonJob{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+
+	return *job, nil
+}
+
+// list returns copies of every job, oldest first
+func (q *jobQueue) list() []daemonJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]daemonJob, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	return jobs
+}
+
+// cancel takes a queued job off the queue, or interrupts a running one. A running job is
+// cancelled once its command has stopped.
+func (q *jobQueue) cancel(id string) (daemonJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return daemonJob{}, fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+
+	switch job.Status {
+	case jobStatusQueued:
+		for i, pending := range q.pending {
+			if pending == job {
+				q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		job.Status, job.Finished = jobStatusCancelled, time.Now().UTC()
+		q.save(job)
+	case jobStatusRunning:
+		q.cancels[id](errJobCancelled)
+	default:
+		return daemonJob{}, &jobConflictError{id: id, status: job.Status, action: "cancel"}
+	}
+
+	return *job, nil
+}
+
+// remove forgets a finished job and its log
+func (q *jobQueue) remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", errJobNotFound, id)
+	}
+	if job.active() {
+		return &jobConflictError{id: id, status: job.Status, action: "remove"}
+	}
+
+	delete(q.jobs, id)
+	q.removeFiles(id)
+
+	return nil
+}
+
+// jobConflictError is returned for changes a job's status doesn't allow
+type jobConflictError struct {
+	id, status, action string
+}
+
+func (e *jobConflictError) Error() string {
+	return fmt.Sprintf("cannot %s job %s: it is %s", e.action, e.id, e.status)
+}
+
+func (q *jobQueue) recordPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *jobQueue) logPath(id string) string {
+	return filepath.Join(q.dir, id+".log")
+}
+
+// save writes the job's record atomically. The queue must be locked.
+func (q *jobQueue) save(job *daemonJob) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %w", job.ID, err)
+	}
+
+	tmp := q.recordPath(job.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err == nil {
+		err = os.Rename(tmp, q.recordPath(job.ID))
+	}
+	if err != nil {
+		// The job goes on, but is lost if the daemon stops
+		warnf(eventTypeImage, "failed to save job %s: %v", job.ID, err)
+		return fmt.Errorf("failed to save job %s: %w", job.ID, err)
+	}
+
+	return nil
+}
+
+func (q *jobQueue) removeFiles(id string) {
+	os.Remove(q.recordPath(id))
+	os.Remove(q.logPath(id))
+}
+
+// handleCreateJob queues a job of the kind with the spec in the request body
+func (q *jobQueue) handleCreateJob(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := &daemonJob{Kind: kind}
+		var spec any
+		switch kind {
+		case jobKindPull:
+			job.Pull = &pullJobSpec{}
+			spec = job.Pull
+		case jobKindBuild:
+			job.Build = &buildJobSpec{}
+			spec = job.Build
+		}
+		if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid %s job: %w", kind, err))
+			return
+		}
+		if err := job.validate(); err != nil {
+			writeEngineError(w, err)
+			return
+		}
+
+		if err := q.queue(job); err != nil {
+			writeEngineError(w, err)
+			return
+		}
+		queued, _ := q.get(job.ID)
+		writeJSON(w, http.StatusAccepted, queued)
+	}
+}
+
+func (q *jobQueue) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, q.list())
+}
+
+func (q *jobQueue) handleInspectJob(w http.ResponseWriter, r *http.Request) {
+	job, err := q.get(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleJobLog responds with the output of the job's command so far
+func (q *jobQueue) handleJobLog(w http.ResponseWriter, r *http.Request) {
+	job, err := q.get(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	f, err := os.Open(q.logPath(job.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		// Queued jobs haven't written anything yet
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return
+	}
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, f)
+}
+
+func (q *jobQueue) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, err := q.cancel(r.PathValue("id"))
+	if err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if job.Status == jobStatusRunning {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, job)
+}
+
+func (q *jobQueue) handleRemoveJob(w http.ResponseWriter, r *http.Request) {
+	if err := q.remove(r.PathValue("id")); err != nil {
+		writeEngineError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
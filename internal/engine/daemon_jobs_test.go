@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemonJobArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		job  daemonJob
+		want []string
+	}{
+		{
+			name: "pull",
+			job:  daemonJob{Kind: jobKindPull, Pull: &pullJobSpec{Image: "alpine:3.19", Platform: "linux/arm64"}},
+			want: []string{errorJSONArg, "pull", "--format", "json", "--platform", "linux/arm64", "--", "alpine:3.19"},
+		},
+		{
+			name: "build",
+			job: daemonJob{Kind: jobKindBuild, Build: &buildJobSpec{
+				Context:     "/src/app",
+				Dockerfile:  "docker/Dockerfile",
+				Tags:        []string{"app:1", "app:latest"},
+				BuildArgs:   map[string]string{"VERSION": "1", "BASE": "alpine"},
+				NoCache:     true,
+				Compression: "zstd:9",
+			}},
+			want: []string{errorJSONArg, "build", "-t", "app:1", "-t", "app:latest", "-f", "/src/app/docker/Dockerfile",
+				"--build-arg", "BASE=alpine", "--build-arg", "VERSION=1", "--no-cache", "--compression", "zstd:9", "--", "/src/app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.args(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobQueueFollowsOutput(t *testing.T) {
+	q := &jobQueue{}
+
+	pull := &daemonJob{Kind: jobKindPull, Pull: &pullJobSpec{Image: "alpine"}}
+	for _, ev := range []Event{
+		{Type: eventTypeImage, Action: eventActionProgress, ID: "aaa", Message: "Downloading", Progress: &EventProgress{Current: 10, Total: 100}},
+		{Type: eventTypeImage, Action: eventActionProgress, ID: "bbb", Message: "Downloading", Progress: &EventProgress{Current: 5, Total: 50}},
+		{Type: eventTypeImage, Action: eventActionProgress, ID: "aaa", Message: "Downloading", Progress: &EventProgress{Current: 100, Total: 100}},
+		{Type: eventTypeImage, Action: eventActionProgress, ID: "aaa", Message: "Extracting", Progress: &EventProgress{Current: 3, Total: 100}},
+	} {
+		line, _ := json.Marshal(ev)
+		q.handleOutput(pull, string(line))
+	}
+	if pull.Progress.Current != 105 || pull.Progress.Total != 150 || pull.Progress.Status != "aaa: Extracting" {
+		t.Errorf("pull progress = %+v, want 105 of 150 downloaded and the last status", pull.Progress)
+	}
+	line, _ := json.Marshal(Event{Type: eventTypeImage, Action: eventActionPull, ID: "alpine:latest", Message: "Status: Downloaded newer image for alpine:latest"})
+	q.handleOutput(pull, string(line))
+	if pull.Image != "alpine:latest" {
+		t.Errorf("pulled image = %q, want alpine:latest", pull.Image)
+	}
+
+	build := &daemonJob{Kind: jobKindBuild, Build: &buildJobSpec{Context: "/src", Tags: []string{"app:1", "app:2"}}}
+	for _, line := range []string{"Step 1/2 : FROM alpine", " ---> 08483af15d69", "Step 2/2 : RUN make", "Successfully built 20f290bbb5c9", "Successfully tagged app:1", "Successfully tagged app:2"} {
+		q.handleOutput(build, line)
+	}
+	if build.Image != "app:1" || build.Progress.Status != "Successfully built 20f290bbb5c9" {
+		t.Errorf("build = %q with progress %+v, want app:1 successfully built", build.Image, build.Progress)
+	}
+
+	q.handleErrorOutput(build, "level=WARN msg=\"not a diagnosis\"")
+	q.handleErrorOutput(build, `{"error":"failed to read Dockerfile","code":"build_failed","subsystem":"image","exitCode":1}`)
+	if build.Error != "failed to read Dockerfile" || build.ErrorCode != "build_failed" {
+		t.Errorf("error = %q, %q, want the diagnosis", build.Error, build.ErrorCode)
+	}
+}
+
+func TestNewJobQueueRequeuesUnfinishedJobs(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	records := []daemonJob{
+		{ID: "running", Status: jobStatusRunning, Created: now.Add(-2 * time.Minute), Started: now},
+		{ID: "queued", Status: jobStatusQueued, Created: now.Add(-3 * time.Minute)},
+		{ID: "recent", Status: jobStatusSucceeded, Created: now.Add(-time.Hour), Finished: now.Add(-time.Hour)},
+		{ID: "expired", Status: jobStatusFailed, Created: now.Add(-48 * time.Hour), Finished: now.Add(-2 * jobRetention)},
+	}
+	for _, job := range records {
+		data, _ := json.Marshal(job)
+		if err := os.WriteFile(filepath.Join(dir, job.ID+".json"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "expired.log"), []byte("output"), 0600)
+
+	q, err := newJobQueue(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pending []string
+	for _, job := range q.pending {
+		pending = append(pending, job.ID+"="+job.Status)
+	}
+	if want := []string{"queued=queued", "running=queued"}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("pending = %q, want %q", pending, want)
+	}
+	if _, err := q.get("recent"); err != nil {
+		t.Errorf("recent finished job is gone: %v", err)
+	}
+	if _, err := q.get("expired"); err == nil {
+		t.Error("expired job is still listed")
+	}
+	for _, name := range []string{"expired.json", "expired.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s of the expired job is still there", name)
+		}
+	}
+}
+
+func TestDaemonJobEndpoints(t *testing.T) {
+	q, err := newJobQueue(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newDaemonHandler(q, nil)
+	request := func(method, path, body string) (int, daemonJob) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var job daemonJob
+		json.Unmarshal(rec.Body.Bytes(), &job)
+		return rec.Code, job
+	}
+
+	if code, _ := request(http.MethodPost, "/jobs/build", `{"context": "relative"}`); code != http.StatusBadRequest {
+		t.Errorf("relative build context: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Nothing dispatches, so the job stays queued
+	code, job := request(http.MethodPost, "/v1.43/jobs/pull", `{"image": "alpine:3.19"}`)
+	if code != http.StatusAccepted || job.Status != jobStatusQueued || job.ID == "" {
+		t.Fatalf("queueing: status %d and job %+v, want a queued job", code, job)
+	}
+	if code, _ := request(http.MethodDelete, "/jobs/"+job.ID, ""); code != http.StatusConflict {
+		t.Errorf("removing a queued job: status %d, want %d", code, http.StatusConflict)
+	}
+	if code, got := request(http.MethodPost, "/jobs/"+job.ID+"/cancel", ""); code != http.StatusOK || got.Status != jobStatusCancelled {
+		t.Errorf("cancelling: status %d and job status %q, want cancelled", code, got.Status)
+	}
+	if len(q.pending) != 0 {
+		t.Errorf("cancelled job is still queued")
+	}
+	if code, _ := request(http.MethodPost, "/jobs/"+job.ID+"/cancel", ""); code != http.StatusConflict {
+		t.Errorf("cancelling again: status %d, want %d", code, http.StatusConflict)
+	}
+	if code, _ := request(http.MethodDelete, "/jobs/"+job.ID, ""); code != http.StatusNoContent {
+		t.Errorf("removing: status %d, want %d", code, http.StatusNoContent)
+	}
+	if code, _ := request(http.MethodGet, "/jobs/"+job.ID, ""); code != http.StatusNotFound {
+		t.Errorf("inspecting a removed job: status %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAPIContainerConfigCommand(t *testing.T) {
+	var image imageConfig
+	image.Config.Entrypoint = []string{"/entrypoint.sh"}
+	image.Config.Cmd = []string{"serve"}
+
+	// Decoded from JSON like the daemon does, so that [] and null differ as they do for clients
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{name: "image defaults", config: `{}`, want: []string{"/entrypoint.sh", "serve"}},
+		{name: "cmd keeps the entrypoint", config: `{"Cmd": ["migrate"]}`, want: []string{"/entrypoint.sh", "migrate"}},
+		{name: "null entrypoint is the image's", config: `{"Entrypoint": null, "Cmd": ["migrate"]}`, want: []string{"/entrypoint.sh", "migrate"}},
+		{name: "entrypoint replaces the image's cmd", config: `{"Entrypoint": ["/bin/sh"]}`, want: []string{"/bin/sh"}},
+		{name: "entrypoint and cmd", config: `{"Entrypoint": ["/bin/sh", "-c"], "Cmd": ["true"]}`, want: []string{"/bin/sh", "-c", "true"}},
+		{name: "empty entrypoint keeps the image's cmd", config: `{"Entrypoint": []}`, want: []string{"serve"}},
+		{name: "empty entrypoint and cmd", config: `{"Entrypoint": [], "Cmd": ["/bin/tool", "id"]}`, want: []string{"/bin/tool", "id"}},
+		{name: "empty string entrypoint", config: `{"Entrypoint": [""], "Cmd": ["/bin/tool"]}`, want: []string{"/bin/tool"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config apiContainerConfig
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			if got := config.command(image); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("command() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIContainerConfigRunOptionsWithoutCommand(t *testing.T) {
+	config := apiContainerConfig{Image: "scratch", Entrypoint: []string{}}
+	if _, err := config.runOptions("", imageConfig{}); err == nil {
+		t.Error("runOptions() succeeded without a command")
+	}
+}
+
+func TestDecodeRegistryAuth(t *testing.T) {
+	// Encoded, this has a + in the standard alphabet where the URL one has a -, and padding
+	// that the raw encodings leave off
+	auth := `{"username":"me","password":"s3cr?t>"}`
+
+	tests := []struct {
+		name     string
+		encoding *base64.Encoding
+	}{
+		{name: "url", encoding: base64.URLEncoding},
+		{name: "raw url", encoding: base64.RawURLEncoding},
+		{name: "std", encoding: base64.StdEncoding},
+		{name: "raw std", encoding: base64.RawStdEncoding},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, err := decodeRegistryAuth(tt.encoding.EncodeToString([]byte(auth)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != "me" || password != "s3cr?t>" {
+				t.Errorf("decodeRegistryAuth() = %q, %q, want me, s3cr?t>", username, password)
+			}
+		})
+	}
+
+	if _, _, err := decodeRegistryAuth("not base64!"); err == nil {
+		t.Error("decodeRegistryAuth() accepted an invalid header")
+	}
+}
@@ -0,0 +1,326 @@
+package engine
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of containers the daemon replaces when a registry webhook reports a push of their
+// image
+const (
+	// autoUpdateLabel set to true opts a container in
+	autoUpdateLabel = "your-docker.auto-update"
+	// autoUpdateStrategyLabel is updateStopFirst, the default, or updateStartFirst
+	autoUpdateStrategyLabel = "your-docker.auto-update.strategy"
+)
+
+// Strategies of replacing a container with one of the new image
+const (
+	// updateStopFirst stops the old container before starting the new one, so that they never
+	// run at once, at the cost of the time in between
+	updateStopFirst = "stop-first"
+	// updateStartFirst starts the new container before stopping the old one, for services that
+	// can run twice for a moment, such as ones listening with SO_REUSEPORT
+	updateStartFirst = "start-first"
+)
+
+// maxWebhookSize bounds the body of a webhook request
+const maxWebhookSize = 1 << 20
+
+// autoUpdater serves POST /webhooks/registry: it pulls the images a registry reports pushes
+// of and replaces the running containers labelled with autoUpdateLabel that use them
+type autoUpdater struct {
+	// token must be the bearer token of every webhook request
+	token string
+	jobs  *jobQueue
+
+	// ctx is cancelled when the daemon shuts down, which interrupts pulls
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu makes updates run one at a time, so that two pushes of an image don't replace the
+	// same container twice at once
+	mu      sync.Mutex
+	updates sync.WaitGroup
+}
+
+// newAutoUpdater returns an updater that pulls with the slots of jobs
+func newAutoUpdater(token string, jobs *jobQueue) *autoUpdater {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &autoUpdater{token: token, jobs: jobs, ctx: ctx, cancel: cancel}
+}
+
+// handler routes only the webhook, for the TCP listener registries reach the daemon on
+func (u *autoUpdater) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhooks/registry", u.handleWebhook)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("page not found: %s %s", r.Method, r.URL.Path))
+	})
+
+	return mux
+}
+
+// stop interrupts the pulls of updates in progress and waits for them. Containers being
+// replaced are finished, so that none is left stopped without its replacement.
+func (u *autoUpdater) stop() {
+	u.cancel()
+	u.updates.Wait()
+}
+
+// handleWebhook queues an update of the images the webhook reports pushes of, and responds
+// with them right away, before anything is pulled, as registries don't wait long
+func (u *autoUpdater) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	// The token is taken from a header rather than the URL, which access logs record
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(u.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, errors.New("invalid or missing webhook token: expected it as an Authorization: Bearer header"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > maxWebhookSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("webhook body exceeds %d bytes", maxWebhookSize))
+		return
+	}
+	refs, err := parseRegistryWebhook(body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, ref := range refs {
+		u.updates.Add(1)
+		go func() {
+			defer u.updates.Done()
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			u.update(ref)
+		}()
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"images": nonNil(refs)})
+}
+
+// update pulls ref for the running containers that opted in to auto-update and use it, and
+// replaces those whose image changed. Nothing is pulled for an image no such container uses.
+func (u *autoUpdater) update(ref string) {
+	want, err := ParseReference(ref)
+	if err != nil {
+		errorf(eventTypeImage, "failed to update %s: %v", ref, err)
+		return
+	}
+	states, err := listContainerStates()
+	if err != nil {
+		errorf(eventTypeImage, "failed to update %s: %v", ref, err)
+		return
+	}
+
+	pulled := map[string]*StoredImage{}
+	for _, state := range states {
+		if state.Config.Labels[autoUpdateLabel] != "true" || !state.running() && !state.restarting() {
+			continue
+		}
+		if have, err := ParseReference(state.Config.Image); err != nil || have.String() != want.String() {
+			continue
+		}
+
+		// Containers may run the image of another platform than the host's
+		platform := state.Config.Platform
+		img, ok := pulled[platform]
+		if !ok {
+			if img, err = u.jobs.pullImage(u.ctx, ref, PullOptions{Platform: platform}); err != nil {
+				errorf(eventTypeImage, "failed to update %s: %v", ref, err)
+				return
+			}
+			pulled[platform] = img
+		}
+		if usesImage(state, img) {
+			debugf(eventTypeContainer, "container is up to date", "container", state.Name, "image", ref)
+			continue
+		}
+
+		id, err := replaceContainer(context.WithoutCancel(u.ctx), state, hostContainerOps)
+		if err != nil {
+			errorf(eventTypeContainer, "failed to update %s: %v", state.Name, err)
+			continue
+		}
+		containerEvent(eventActionUpdate, id, map[string]string{"name": state.Name, "image": ref, "digest": img.Digest, "replaced": state.ID})
+	}
+}
+
+// containerOps are the operations replaceContainer runs a replacement with, which tests
+// swap for ones that record the order they are called in
+type containerOps struct {
+	create func(ctx context.Context, opts RunOptions) (string, error)
+	start  func(id string) error
+	stop   func(id string, timeout time.Duration) error
+	remove func(id string, force bool) error
+	rename func(id, name string) error
+	// ports returns the ports the processes of a running container listen on
+	ports func(state *ContainerState) ([]string, error)
+}
+
+// hostContainerOps are the operations on the containers of this host
+var hostContainerOps = containerOps{
+	create: CreateContainer,
+	start:  StartContainer,
+	stop:   stopContainer,
+	remove: removeContainer,
+	rename: renameContainer,
+	ports:  listeningPorts,
+}
+
+// replaceContainer recreates a container with the options it was created with, which now
+// name a newer image, and gives the new container its name. The new one is created under a
+// generated name first, so that the old one is kept if that fails, and started again if it
+// was stopped for a replacement that fails to start.
+func replaceContainer(ctx context.Context, old *ContainerState, ops containerOps) (string, error) {
+	strategy := cmp.Or(old.Config.Labels[autoUpdateStrategyLabel], updateStopFirst)
+	if strategy != updateStopFirst && strategy != updateStartFirst {
+		return "", fmt.Errorf("invalid label %s=%s: expected %s or %s", autoUpdateStrategyLabel, strategy, updateStopFirst, updateStartFirst)
+	}
+	if strategy == updateStartFirst {
+		if ports := sharedPorts(old, ops); len(ports) > 0 {
+			warnf(eventTypeContainer, "replacing %s stop-first, as its replacement would listen on %s too", old.Name, strings.Join(ports, ", "))
+			strategy = updateStopFirst
+		}
+	}
+
+	opts := old.Config
+	opts.Name, opts.Quiet = "", true
+	id, err := ops.create(ctx, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to create its replacement: %w", err)
+	}
+
+	if strategy == updateStopFirst {
+		if err := ops.stop(old.ID, defaultStopTimeout); err != nil {
+			ops.remove(id, true)
+			return "", err
+		}
+	}
+	if err := ops.start(id); err != nil {
+		ops.remove(id, true)
+		if strategy == updateStopFirst && !old.Config.AutoRemove {
+			if err := ops.start(old.ID); err != nil {
+				warnf(eventTypeContainer, "failed to start %s again: %v", old.Name, err)
+			}
+		}
+		return "", fmt.Errorf("failed to start its replacement: %w", err)
+	}
+	if strategy == updateStartFirst {
+		if err := ops.stop(old.ID, defaultStopTimeout); err != nil {
+			return id, err
+		}
+	}
+
+	// A container run with --rm is gone once stopped
+	if err := ops.remove(old.ID, false); err != nil && !errors.Is(err, errContainerNotFound) {
+		return id, err
+	}
+	if err := ops.rename(id, old.Name); err != nil {
+		return id, err
+	}
+
+	return id, nil
+}
+
+// sharedPorts returns the ports a container listens on in a network namespace its
+// replacement would join too, the host's or a pre-created one, where the replacement
+// couldn't bind them while it runs. Containers with a namespace of their own have none.
+func sharedPorts(state *ContainerState, ops containerOps) []string {
+	// Options saved without a network mode got the default one, the host's
+	mode := cmp.Or(state.Config.Network, NetworkHost)
+	if _, joined := mode.namespacePath(); mode != NetworkHost && !joined {
+		return nil
+	}
+	ports, err := ops.ports(state)
+	if err != nil {
+		debugf(eventTypeContainer, "failed to list listening ports", "container", state.Name, "error", err)
+		return nil
+	}
+
+	return ports
+}
+
+// parseRegistryWebhook returns the tagged images a webhook reports pushes of, in the order it
+// lists them. It takes the notifications of registries built on Docker's distribution, such
+// as registry:2, Harbor or GitLab, and the webhooks of Docker Hub.
+func parseRegistryWebhook(body []byte) ([]string, error) {
+	var payload struct {
+		// Events are distribution's notifications, which name the registry by the host its
+		// client pushed to
+		Events []struct {
+			Action string `json:"action"`
+			Target struct {
+				Repository string `json:"repository"`
+				Tag        string `json:"tag"`
+			} `json:"target"`
+			Request struct {
+				Host string `json:"host"`
+			} `json:"request"`
+		} `json:"events"`
+		// PushData and Repository are Docker Hub's
+		PushData *struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid webhook: %w", err)
+	}
+
+	var refs []string
+	add := func(ref string) error {
+		parsed, err := ParseReference(ref)
+		if err != nil {
+			return fmt.Errorf("invalid webhook: %w", err)
+		}
+		if ref = parsed.FamiliarString(); !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+		return nil
+	}
+
+	switch {
+	case payload.Events != nil:
+		for _, ev := range payload.Events {
+			// Blobs are pushed before the manifest, and a manifest pushed by digest has no tag
+			if ev.Action != "push" || ev.Target.Tag == "" {
+				continue
+			}
+			ref := ev.Target.Repository + ":" + ev.Target.Tag
+			if ev.Request.Host != "" {
+				ref = ev.Request.Host + "/" + ref
+			}
+			if err := add(ref); err != nil {
+				return nil, err
+			}
+		}
+	case payload.PushData != nil:
+		if err := add(payload.Repository.RepoName + ":" + cmp.Or(payload.PushData.Tag, defaultTag)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid webhook: expected registry notifications with events or a Docker Hub webhook with push_data")
+	}
+
+	return refs, nil
+}
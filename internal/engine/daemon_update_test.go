@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRegistryWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "distribution push",
+			body: `{"events": [
+				{"action": "push", "target": {"repository": "team/app", "digest": "sha256:1a7e"}, "request": {"host": "registry.example.com:5000"}},
+				{"action": "push", "target": {"repository": "team/app", "tag": "1.0"}, "request": {"host": "registry.example.com:5000"}},
+				{"action": "pull", "target": {"repository": "team/db", "tag": "16"}, "request": {"host": "registry.example.com:5000"}},
+				{"action": "push", "target": {"repository": "team/app", "tag": "1.0"}, "request": {"host": "registry.example.com:5000"}}
+			]}`,
+			want: []string{"registry.example.com:5000/team/app:1.0"},
+		},
+		{
+			// Blobs and manifests pushed by digest don't say which tag changed
+			name: "distribution push without a tag",
+			body: `{"events": [{"action": "push", "target": {"repository": "team/app", "digest": "sha256:1a7e"}}]}`,
+			want: []string{},
+		},
+		{
+			name: "Docker Hub push",
+			body: `{"push_data": {"tag": "3.19"}, "repository": {"repo_name": "library/alpine"}}`,
+			want: []string{"alpine:3.19"},
+		},
+		{
+			name: "Docker Hub push without a tag",
+			body: `{"push_data": {}, "repository": {"repo_name": "team/app"}}`,
+			want: []string{"team/app:latest"},
+		},
+		{name: "neither", body: `{"repository": {"repo_name": "team/app"}}`, wantErr: "expected registry notifications with events"},
+		{name: "invalid JSON", body: `{"events": [`, wantErr: "invalid webhook"},
+		{
+			name:    "invalid repository",
+			body:    `{"push_data": {"tag": "1.0"}, "repository": {"repo_name": "Team/App"}}`,
+			wantErr: "invalid webhook",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRegistryWebhook([]byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRegistryWebhook() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRegistryWebhook() error = %v", err)
+			}
+			if got := nonNil(got); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRegistryWebhook() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookToken(t *testing.T) {
+	u := newAutoUpdater("secret", nil)
+	defer u.stop()
+	// No tagged push, so that nothing is updated
+	const body = `{"events": [{"action": "push", "target": {"repository": "team/app", "digest": "sha256:1a7e"}}]}`
+
+	tests := []struct {
+		name string
+		path string
+		auth string
+		want int
+	}{
+		{name: "absent", path: "/webhooks/registry", want: http.StatusUnauthorized},
+		{name: "wrong", path: "/webhooks/registry", auth: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "not a bearer token", path: "/webhooks/registry", auth: "Basic secret", want: http.StatusUnauthorized},
+		// A token in the URL would end up in access logs
+		{name: "in the query", path: "/webhooks/registry?token=secret", want: http.StatusUnauthorized},
+		{name: "valid", path: "/webhooks/registry", auth: "Bearer secret", want: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, handler := range []http.Handler{newDaemonHandler(nil, u), u.handler()} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(body))
+				if tt.auth != "" {
+					req.Header.Set("Authorization", tt.auth)
+				}
+				handler.ServeHTTP(rec, req)
+				if rec.Code != tt.want {
+					t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+				}
+			}
+		})
+	}
+
+	// The TCP listener serves nothing but the webhook
+	rec := httptest.NewRecorder()
+	u.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/containers/create", strings.NewReader("{}")))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("creating a container through the webhook listener: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// recordingOps returns operations that append what they are called for to calls, and fail
+// to start the container failStart
+func recordingOps(calls *[]string, ports []string, failStart string) containerOps {
+	return containerOps{
+		create: func(ctx context.Context, opts RunOptions) (string, error) {
+			*calls = append(*calls, "create "+opts.Image)
+			return "new", nil
+		},
+		start: func(id string) error {
+			*calls = append(*calls, "start "+id)
+			if id == failStart {
+				return errors.New("exec format error")
+			}
+			return nil
+		},
+		stop: func(id string, timeout time.Duration) error {
+			*calls = append(*calls, "stop "+id)
+			return nil
+		},
+		remove: func(id string, force bool) error {
+			*calls = append(*calls, "remove "+id)
+			return nil
+		},
+		rename: func(id, name string) error {
+			*calls = append(*calls, "rename "+id+" "+name)
+			return nil
+		},
+		ports: func(state *ContainerState) ([]string, error) {
+			*calls = append(*calls, "ports "+state.ID)
+			return ports, nil
+		},
+	}
+}
+
+func TestReplaceContainer(t *testing.T) {
+	tests := []struct {
+		name      string
+		strategy  string
+		network   NetworkMode
+		ports     []string
+		failStart string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:    "stop-first by default",
+			network: NetworkHost,
+			want:    []string{"create app:1.0", "stop old", "start new", "remove old", "rename new web"},
+		},
+		{
+			name:     "start-first",
+			strategy: updateStartFirst,
+			network:  NetworkHost,
+			want:     []string{"ports old", "create app:1.0", "start new", "stop old", "remove old", "rename new web"},
+		},
+		{
+			// The replacement couldn't bind the same ports of the host while the old one runs
+			name:     "start-first with ports of the host",
+			strategy: updateStartFirst,
+			network:  NetworkHost,
+			ports:    []string{"0.0.0.0:8080/tcp"},
+			want:     []string{"ports old", "create app:1.0", "stop old", "start new", "remove old", "rename new web"},
+		},
+		{
+			name:     "start-first with ports of a namespace of its own",
+			strategy: updateStartFirst,
+			network:  NetworkBridge,
+			ports:    []string{"0.0.0.0:8080/tcp"},
+			want:     []string{"create app:1.0", "start new", "stop old", "remove old", "rename new web"},
+		},
+		{
+			name:      "replacement fails to start",
+			network:   NetworkHost,
+			failStart: "new",
+			want:      []string{"create app:1.0", "stop old", "start new", "remove new", "start old"},
+			wantErr:   "failed to start its replacement: exec format error",
+		},
+		{
+			name:      "start-first replacement fails to start",
+			strategy:  updateStartFirst,
+			network:   NetworkBridge,
+			failStart: "new",
+			want:      []string{"create app:1.0", "start new", "remove new"},
+			wantErr:   "failed to start its replacement",
+		},
+		{name: "unknown strategy", strategy: "blue-green", wantErr: "expected stop-first or start-first"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &ContainerState{ID: "old", Name: "web", Status: statusRunning, Config: RunOptions{
+				Image:   "app:1.0",
+				Network: tt.network,
+				Labels:  map[string]string{autoUpdateLabel: "true"},
+			}}
+			if tt.strategy != "" {
+				old.Config.Labels[autoUpdateStrategyLabel] = tt.strategy
+			}
+
+			var calls []string
+			id, err := replaceContainer(context.Background(), old, recordingOps(&calls, tt.ports, tt.failStart))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("replaceContainer() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil || id != "new" {
+				t.Fatalf("replaceContainer() = %q, %v, want the new container", id, err)
+			}
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("calls = %q, want %q", calls, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// devSettleTime is how long dev waits for changes to stop coming before it restarts, so that
+// saving many files at once restarts the container only once
+const devSettleTime = 300 * time.Millisecond
+
+// devStopTimeout is how long the command gets to exit after SIGTERM before a restart kills it
+const devStopTimeout = 2 * time.Second
+
+// inotify events that mean a file or directory under a synced path has changed
+const devWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// devOptions describe a dev container: it is run like with run, with the synced host paths
+// bind-mounted into it
+type devOptions struct {
+	run     RunOptions
+	syncs   []Mount
+	restart bool
+}
+
+// runDev runs a container with the synced paths mounted and returns its exit code. Changes on
+// the host are visible in the container right away; with restart, the container is also
+// restarted whenever something under a synced path changes. The container is removed once
+// dev returns.
+func runDev(opts devOptions) (int, error) {
+	opts.run.Mounts = append(opts.run.Mounts, opts.syncs...)
+	env, err := NewContainerEnvironment(context.Background(), opts.run)
+	if err != nil {
+		return 0, err
+	}
+	id := env.id
+	defer func() {
+		if err := removeContainer(id, true); err != nil {
+			warnf(eventTypeContainer, "failed to remove dev container: %v", err)
+		}
+	}()
+
+	var changes <-chan string
+	if opts.restart {
+		// The mounts were resolved to absolute paths when the container was created
+		w, err := newSyncWatcher(env.mounts[len(env.mounts)-len(opts.syncs):])
+		if err != nil {
+			return 0, err
+		}
+		defer w.Close()
+		changes = w.changes
+	}
+
+	var stdin *os.File
+	if opts.run.Interactive {
+		stdin = os.Stdin
+	}
+
+	type exit struct {
+		code int
+		err  error
+	}
+
+	for {
+		shim, err := env.startShim([3]*os.File{stdin, os.Stdout, os.Stderr}, nil, true)
+		if err != nil {
+			return 0, err
+		}
+		stop := proxySignals(shim.pid)
+
+		exited := make(chan exit, 1)
+		go func() {
+			code, err := env.wait(shim)
+			exited <- exit{code, err}
+		}()
+
+		var e exit
+		restart := false
+		select {
+		case e = <-exited:
+		case path := <-changes:
+			fmt.Fprintf(os.Stderr, "%s changed, restarting %s\n", path, id)
+			restart = true
+			e.err = stopContainer(id, devStopTimeout)
+			if stopped := <-exited; e.err == nil {
+				e.err = stopped.err
+			}
+		}
+		stop()
+		shim.detach()
+
+		// A container that exits on its own ends dev, like run
+		if !restart || e.err != nil {
+			return e.code, e.err
+		}
+
+		containerEvent(eventActionRestart, id, nil)
+		if env, err = loadContainerEnvironment(id); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// syncWatcher watches synced host paths with inotify and reports changes below them, one per
+// burst of changes
+type syncWatcher struct {
+	inotify *os.File
+	changes chan string
+
+	// dirs maps watch descriptors to the directories they watch
+	dirs map[int32]string
+	// trees are the watches of directories that are synced themselves. The others only watch
+	// a directory for changes of the synced files in it, which are listed in files.
+	trees map[int32]bool
+	files map[string]bool
+}
+
+// newSyncWatcher starts watching the sources of the given mounts, including every directory
+// below them
+func newSyncWatcher(syncs []Mount) (*syncWatcher, error) {
+	// Non-blocking, so that closing the file ends a pending read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch synced paths: %w", err)
+	}
+
+	w := &syncWatcher{
+		inotify: os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string),
+		dirs:    make(map[int32]string),
+		trees:   make(map[int32]bool),
+		files:   make(map[string]bool),
+	}
+
+	for _, m := range syncs {
+		info, err := os.Stat(m.Source)
+		if err == nil && !info.IsDir() {
+			// Files are watched through their directory, since editors often replace them
+			w.files[m.Source] = true
+			_, err = w.watch(filepath.Dir(m.Source))
+		} else if err == nil {
+			err = w.watchTree(m.Source)
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	events := make(chan string)
+	go w.read(events)
+	go w.settle(events)
+
+	return w, nil
+}
+
+// watch adds an inotify watch for a single directory and returns its descriptor
+func (w *syncWatcher) watch(dir string) (int32, error) {
+	wd, err := syscall.InotifyAddWatch(int(w.inotify.Fd()), dir, devWatchMask)
+	if err != nil {
+		return 0, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	w.dirs[int32(wd)] = dir
+
+	return int32(wd), nil
+}
+
+// watchTree watches root and every directory below it
+func (w *syncWatcher) watchTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while walking, its parent's watch reports that
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := w.watch(path)
+		w.trees[wd] = true
+		return err
+	})
+}
+
+// read decodes inotify events and sends the paths that changed to events until the inotify
+// file is closed
+func (w *syncWatcher) read(events chan<- string) {
+	defer close(events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			dir, ok := w.dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+			path := dir
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if len(name) > 0 {
+				path = filepath.Join(dir, string(name))
+			}
+
+			if !w.trees[ev.Wd] && !w.files[path] {
+				continue
+			}
+			// New directories are watched as well, so changes inside them are noticed
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := w.watchTree(path); err != nil {
+					warnf(eventTypeContainer, "%v", err)
+				}
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+				delete(w.trees, ev.Wd)
+			}
+
+			events <- path
+		}
+	}
+}
+
+// settle sends the first path of every burst of events once no more events have come for
+// devSettleTime
+func (w *syncWatcher) settle(events <-chan string) {
+	var first string
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				return
+			}
+			if first == "" {
+				first = path
+			}
+			timer.Reset(devSettleTime)
+		case <-timer.C:
+			w.changes <- first
+			first = ""
+		}
+	}
+}
+
+// Close stops watching
+func (w *syncWatcher) Close() error {
+	return w.inotify.Close()
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// device is a character device every container gets in /dev
+type device struct {
+	name         string
+	major, minor uint32
+}
+
+// containerDevices are the devices Docker creates in every container
+var containerDevices = []device{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// featureDevices are the devices of the kernel features images can declare they need, see
+// kernelFeaturesAnnotation, which their containers get on top of containerDevices
+var featureDevices = map[string]device{
+	"fuse": {"fuse", 10, 229},
+}
+
+// deviceLinks are the symlinks in /dev, from the link to its target. The standard streams
+// resolve through /proc, the pseudo terminal multiplexer through the container's own devpts.
+var deviceLinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
+
+// mkdev creates a device number from major and minor numbers
+func (env *ContainerEnvironment) mkdev(major, minor uint32) uint64 {
+	return (uint64(major) << 8) | uint64(minor)
+}
+
+// setupDevices creates the device files, symlinks and mountpoints of /dev in the container
+// root. Those the image brings along are kept.
+func (env *ContainerEnvironment) setupDevices(root string) error {
+	devPath := filepath.Join(root, "dev")
+	for _, dir := range []string{devPath, filepath.Join(devPath, "pts"), filepath.Join(devPath, "shm")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	for _, d := range containerDevices {
+		if err := env.createDevice(devPath, d); err != nil {
+			return err
+		}
+	}
+
+	for _, link := range deviceLinks {
+		err := os.Symlink(link[1], filepath.Join(devPath, link[0]))
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create /dev/%s: %w", link[0], err)
+		}
+	}
+
+	return nil
+}
+
+// createDevice creates a device file in devPath unless the image brings it along
+func (env *ContainerEnvironment) createDevice(devPath string, d device) error {
+	path := filepath.Join(devPath, d.name)
+	err := syscall.Mknod(path, syscall.S_IFCHR|0666, int(env.mkdev(d.major, d.minor)))
+	if errors.Is(err, syscall.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create /dev/%s: %w", d.name, err)
+	}
+	// mknod applies the umask
+	if err := os.Chmod(path, 0666); err != nil {
+		return fmt.Errorf("failed to change permissions of /dev/%s: %w", d.name, err)
+	}
+
+	return nil
+}
+
+// setupFeatureDevices creates the devices of the kernel features the image declares it needs
+// in the root filesystem. The compatibility check already warns about features the host
+// lacks, so the devices are an optional step.
+func (env *ContainerEnvironment) setupFeatureDevices(root string, config imageConfig) error {
+	for _, feature := range imageKernelFeatures(config) {
+		d, ok := featureDevices[feature]
+		if !ok {
+			continue
+		}
+
+		var err error
+		if env.userns {
+			// mountDevices would have to bind the host's, like those of every container
+			err = errors.New("device files don't work in a user namespace")
+		} else {
+			err = env.createDevice(filepath.Join(root, "dev"), d)
+		}
+		if err := env.steps.optional("creating /dev/"+d.name, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mountDevices mounts a devpts instance of its own at /dev/pts, so the container sees none of
+// the host's terminals. Device nodes don't work on filesystems mounted inside a user
+// namespace, so those containers get bind mounts of the host's devices instead.
+func mountDevices(root string, userns bool) error {
+	if userns {
+		for _, d := range containerDevices {
+			if err := bindHostDevice(root, "/dev/"+d.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	target, err := secureJoin(root, "/dev/pts")
+	if err != nil {
+		return err
+	}
+	if err := createMountpoint(target, true); err != nil {
+		return err
+	}
+
+	// gid 5 is the tty group, which owns terminals in every distribution
+	data := "newinstance,ptmxmode=0666,mode=0620,gid=5"
+	if err := syscall.Mount("devpts", target, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, data); err != nil {
+		return fmt.Errorf("failed to mount devpts on /dev/pts: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,617 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	// A request is sent this many times, waiting twice as long for an answer each time
+	dhcpAttempts       = 4
+	dhcpInitialTimeout = time.Second
+
+	// dhcpMinRetry is the shortest wait between renewal attempts, from RFC 2131
+	dhcpMinRetry = time.Minute
+	// dhcpRetryInterval is how long to wait before looking for a server again after the lease
+	// was lost
+	dhcpRetryInterval = 30 * time.Second
+)
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+)
+
+// DHCP options the client sends or understands
+const (
+	dhcpOptPad            = 0
+	dhcpOptSubnetMask     = 1
+	dhcpOptRouter         = 3
+	dhcpOptDNS            = 6
+	dhcpOptDomainName     = 15
+	dhcpOptRequestedIP    = 50
+	dhcpOptLeaseTime      = 51
+	dhcpOptMessageType    = 53
+	dhcpOptServerID       = 54
+	dhcpOptParameters     = 55
+	dhcpOptRenewalTime    = 58
+	dhcpOptRebindingTime  = 59
+	dhcpOptClientID       = 61
+	dhcpOptClasslessRoute = 121
+	dhcpOptEnd            = 255
+)
+
+// dhcpMagicCookie starts the options of every DHCP message
+const dhcpMagicCookie = 0x63825363
+
+// dhcpInfiniteLease is the lease time of addresses that never expire
+const dhcpInfiniteLease = 0xffffffff
+
+var (
+	errDHCPTimeout = errors.New("no answer from a DHCP server")
+	errDHCPNak     = errors.New("the DHCP server refused the address")
+	errDHCPExpired = errors.New("the DHCP lease expired")
+	errDHCPStopped = errors.New("the DHCP client was stopped")
+)
+
+var dhcpBroadcast = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+
+// dhcpRoute is a route handed out with a lease. A gateway of 0.0.0.0 means dst is on the link.
+type dhcpRoute struct {
+	dst     *net.IPNet
+	gateway net.IP
+}
+
+// dhcpLease is an address leased from a DHCP server and the settings that came with it
+type dhcpLease struct {
+	address  *net.IPNet
+	server   net.IP
+	routes   []dhcpRoute
+	dns      []net.IP
+	domain   string
+	acquired time.Time
+	// duration is zero for infinite leases, renew and rebind are T1 and T2
+	duration time.Duration
+	renew    time.Duration
+	rebind   time.Duration
+}
+
+func (l *dhcpLease) renewAt() time.Time   { return l.acquired.Add(l.renew) }
+func (l *dhcpLease) rebindAt() time.Time  { return l.acquired.Add(l.rebind) }
+func (l *dhcpLease) expiresAt() time.Time { return l.acquired.Add(l.duration) }
+
+// dhcpMessage is a decoded DHCP message
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	yiaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+// dhcpClient leases the address of an interface in a container's network namespace and keeps
+// it for as long as the container runs
+type dhcpClient struct {
+	iface string
+	mac   net.HardwareAddr
+	conn  *net.UDPConn
+	// lease is the first lease, the client goroutine owns the lease from then on
+	lease *dhcpLease
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startDHCPClient leases an address for iface in the network namespace at nsPath and configures
+// the interface with it. The client runs on a thread of its own in the namespace, which lets
+// it reconfigure the interface when the lease changes later.
+func startDHCPClient(nsPath, iface string) (*dhcpClient, error) {
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer ns.Close()
+
+	c := &dhcpClient{iface: iface, stop: make(chan struct{}), done: make(chan struct{})}
+	ready := make(chan error, 1)
+	go func() {
+		// Never unlocked, the thread is left in the container's namespace
+		runtime.LockOSThread()
+
+		if err := c.open(ns); err != nil {
+			ready <- err
+			return
+		}
+
+		lease, err := c.acquire()
+		if err == nil {
+			err = c.configure(nil, lease)
+		}
+		if err != nil {
+			c.conn.Close()
+			ready <- err
+			return
+		}
+
+		c.lease = lease
+		ready <- nil
+		c.run(lease)
+	}()
+	if err := <-ready; err != nil {
+		return nil, fmt.Errorf("failed to lease an address for %s: %w", iface, err)
+	}
+
+	return c, nil
+}
+
+// open joins the namespace, brings the interface up and binds the client's socket to it
+func (c *dhcpClient) open(ns *os.File) error {
+	if err := joinNamespace(ns, syscall.CLONE_NEWNET); err != nil {
+		return err
+	}
+	if err := setLinkUp(c.iface); err != nil {
+		return err
+	}
+
+	iface, err := net.InterfaceByName(c.iface)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %w", c.iface, err)
+	}
+	c.mac = iface.HardwareAddr
+
+	// Bound to the interface, broadcasts go out of it before it has an address
+	lc := net.ListenConfig{Control: func(network, address string, raw syscall.RawConn) error {
+		var serr error
+		err := raw.Control(func(fd uintptr) {
+			if serr = syscall.BindToDevice(int(fd), c.iface); serr == nil {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", dhcpClientPort))
+	if err != nil {
+		return fmt.Errorf("failed to open DHCP client socket: %w", err)
+	}
+	c.conn = conn.(*net.UDPConn)
+
+	return nil
+}
+
+// close releases the lease and stops the client once the container exited
+func (c *dhcpClient) close() {
+	if c == nil {
+		return
+	}
+
+	close(c.stop)
+	// Wakes up a client waiting for an answer
+	c.conn.SetReadDeadline(time.Now())
+	<-c.done
+}
+
+// stopped reports whether close was called
+func (c *dhcpClient) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, or returns false early once the client is stopped
+func (c *dhcpClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-c.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// run keeps the lease until the client is stopped: it renews it with its server from T1 and
+// with any server from T2, and looks for a new one once it was lost
+func (c *dhcpClient) run(lease *dhcpLease) {
+	defer close(c.done)
+	defer c.conn.Close()
+
+	for {
+		if lease == nil {
+			next, err := c.acquire()
+			if c.stopped() {
+				return
+			}
+			if err == nil {
+				err = c.configure(nil, next)
+			}
+			if err != nil {
+				warnf(eventTypeNetwork, "failed to lease an address for %s: %v", c.iface, err)
+				if !c.sleep(dhcpRetryInterval) {
+					return
+				}
+				continue
+			}
+			lease = next
+		}
+
+		if lease.duration == 0 {
+			<-c.stop
+			c.release(lease)
+			return
+		}
+		if !c.sleep(time.Until(lease.renewAt())) {
+			c.release(lease)
+			return
+		}
+
+		next, err := c.extend(lease)
+		if errors.Is(err, errDHCPStopped) {
+			c.release(lease)
+			return
+		}
+		if err != nil {
+			warnf(eventTypeNetwork, "lost the address %s of %s: %v", lease.address, c.iface, err)
+			if err := deleteAddress(c.iface, lease.address); err != nil {
+				warnf(eventTypeNetwork, "%v", err)
+			}
+			lease = nil
+			continue
+		}
+
+		if err := c.configure(lease, next); err != nil {
+			warnf(eventTypeNetwork, "%v", err)
+		}
+		lease = next
+	}
+}
+
+// acquire leases an address: it broadcasts a DISCOVER and requests the address of the first
+// OFFER, starting over if the server refuses it after all
+func (c *dhcpClient) acquire() (*dhcpLease, error) {
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		xid, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+
+		offer, err := c.exchange(c.message(dhcpDiscover, xid, nil), dhcpBroadcast, xid, func(m *dhcpMessage) bool {
+			return m.messageType() == dhcpOffer && len(m.options[dhcpOptServerID]) == 4
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		server := offer.options[dhcpOptServerID]
+		request := c.message(dhcpRequest, xid, nil,
+			dhcpOption(dhcpOptRequestedIP, offer.yiaddr.To4()),
+			dhcpOption(dhcpOptServerID, server),
+		)
+		reply, err := c.exchange(request, dhcpBroadcast, xid, func(m *dhcpMessage) bool {
+			t := m.messageType()
+			return (t == dhcpAck || t == dhcpNak) && bytes.Equal(m.options[dhcpOptServerID], server)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if reply.messageType() == dhcpAck {
+			return parseDHCPLease(reply, time.Now())
+		}
+	}
+
+	return nil, errDHCPNak
+}
+
+// extend renews the lease, with its server until T2 and then by broadcasting to any server,
+// until it is acknowledged, refused or expired
+func (c *dhcpClient) extend(lease *dhcpLease) (*dhcpLease, error) {
+	for {
+		if !time.Now().Before(lease.expiresAt()) {
+			return nil, errDHCPExpired
+		}
+
+		dst, until := &net.UDPAddr{IP: lease.server, Port: dhcpServerPort}, lease.rebindAt()
+		if !time.Now().Before(until) {
+			dst, until = dhcpBroadcast, lease.expiresAt()
+		}
+
+		xid, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+		sent := time.Now()
+		reply, err := c.exchange(c.message(dhcpRequest, xid, lease.address.IP), dst, xid, func(m *dhcpMessage) bool {
+			t := m.messageType()
+			return t == dhcpAck || t == dhcpNak
+		})
+		if err == nil {
+			if reply.messageType() == dhcpNak {
+				return nil, errDHCPNak
+			}
+			// The lease runs from when it was requested
+			return parseDHCPLease(reply, sent)
+		}
+		if !errors.Is(err, errDHCPTimeout) {
+			return nil, err
+		}
+
+		// RFC 2131 retries after half of the time left until the next phase
+		wait := min(max(time.Until(until)/2, dhcpMinRetry), time.Until(until))
+		if !c.sleep(wait) {
+			return nil, errDHCPStopped
+		}
+	}
+}
+
+// release gives the address back to the server once the container exited, without waiting
+// for it, as servers don't answer
+func (c *dhcpClient) release(lease *dhcpLease) {
+	xid, err := newTransactionID()
+	if err != nil {
+		return
+	}
+
+	msg := c.message(dhcpRelease, xid, lease.address.IP, dhcpOption(dhcpOptServerID, lease.server.To4()))
+	c.conn.WriteToUDP(msg, &net.UDPAddr{IP: lease.server, Port: dhcpServerPort})
+}
+
+// exchange sends msg until an answer to it that accept takes arrives, retransmitting with an
+// exponential backoff
+func (c *dhcpClient) exchange(msg []byte, dst *net.UDPAddr, xid uint32, accept func(*dhcpMessage) bool) (*dhcpMessage, error) {
+	buf := make([]byte, 1500)
+	timeout := dhcpInitialTimeout
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		if _, err := c.conn.WriteToUDP(msg, dst); err != nil {
+			return nil, fmt.Errorf("failed to send DHCP message: %w", err)
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+		for !c.stopped() {
+			n, _, err := c.conn.ReadFromUDP(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to receive DHCP message: %w", err)
+			}
+
+			reply, ok := parseDHCPMessage(buf[:n])
+			if ok && reply.op == 2 && reply.xid == xid && bytes.Equal(reply.chaddr, c.mac) && accept(reply) {
+				return reply, nil
+			}
+		}
+		if c.stopped() {
+			return nil, errDHCPStopped
+		}
+
+		timeout *= 2
+	}
+
+	return nil, errDHCPTimeout
+}
+
+// configure replaces the address and routes of the previous lease with those of the next. A
+// renewed lease of the same address leaves the interface alone.
+func (c *dhcpClient) configure(previous, next *dhcpLease) error {
+	if previous != nil {
+		if previous.address.String() == next.address.String() {
+			return nil
+		}
+		if err := deleteAddress(c.iface, previous.address); err != nil {
+			return err
+		}
+	}
+
+	if err := addAddress(c.iface, next.address); err != nil {
+		return err
+	}
+	for _, r := range next.routes {
+		if err := addRoute(c.iface, r.dst, r.gateway); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// message encodes a DHCP message from the client. Without an address of its own the client
+// asks for broadcast answers, which it can receive before the interface is configured.
+func (c *dhcpClient) message(msgType byte, xid uint32, ciaddr net.IP, options ...[]byte) []byte {
+	msg := make([]byte, 240)
+	msg[0] = 1 // BOOTREQUEST
+	msg[1] = 1 // Ethernet
+	msg[2] = byte(len(c.mac))
+	binary.BigEndian.PutUint32(msg[4:8], xid)
+	if ciaddr == nil {
+		binary.BigEndian.PutUint16(msg[10:12], 0x8000)
+	} else {
+		copy(msg[12:16], ciaddr.To4())
+	}
+	copy(msg[28:44], c.mac)
+	binary.BigEndian.PutUint32(msg[236:240], dhcpMagicCookie)
+
+	msg = append(msg, dhcpOption(dhcpOptMessageType, []byte{msgType})...)
+	msg = append(msg, dhcpOption(dhcpOptClientID, append([]byte{1}, c.mac...))...)
+	if msgType == dhcpDiscover || msgType == dhcpRequest {
+		msg = append(msg, dhcpOption(dhcpOptParameters, []byte{
+			dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptDomainName, dhcpOptLeaseTime,
+			dhcpOptRenewalTime, dhcpOptRebindingTime, dhcpOptClasslessRoute,
+		})...)
+	}
+	for _, o := range options {
+		msg = append(msg, o...)
+	}
+	msg = append(msg, dhcpOptEnd)
+
+	// Some servers ignore messages shorter than the minimum BOOTP message
+	for len(msg) < 300 {
+		msg = append(msg, dhcpOptPad)
+	}
+
+	return msg
+}
+
+// dhcpOption encodes an option
+func dhcpOption(code byte, data []byte) []byte {
+	return append([]byte{code, byte(len(data))}, data...)
+}
+
+// newTransactionID returns a random xid that matches answers to their request
+func newTransactionID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate DHCP transaction ID: %w", err)
+	}
+
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// parseDHCPMessage decodes a message, reporting whether it is one
+func parseDHCPMessage(data []byte) (*dhcpMessage, bool) {
+	if len(data) < 240 || binary.BigEndian.Uint32(data[236:240]) != dhcpMagicCookie || data[2] > 16 {
+		return nil, false
+	}
+
+	m := &dhcpMessage{
+		op:      data[0],
+		xid:     binary.BigEndian.Uint32(data[4:8]),
+		yiaddr:  net.IP(slices.Clone(data[16:20])),
+		chaddr:  net.HardwareAddr(slices.Clone(data[28 : 28+int(data[2])])),
+		options: map[byte][]byte{},
+	}
+
+	// Options that appear more than once are concatenated, as RFC 3396 asks
+	for opts := data[240:]; len(opts) > 0; {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, false
+		}
+		m.options[code] = append(m.options[code], opts[2:2+int(opts[1])]...)
+		opts = opts[2+int(opts[1]):]
+	}
+
+	return m, true
+}
+
+// messageType returns the DHCP message type, 0 for plain BOOTP
+func (m *dhcpMessage) messageType() byte {
+	if t := m.options[dhcpOptMessageType]; len(t) == 1 {
+		return t[0]
+	}
+
+	return 0
+}
+
+// parseDHCPLease reads the lease of an ACK, which runs from acquired
+func parseDHCPLease(ack *dhcpMessage, acquired time.Time) (*dhcpLease, error) {
+	ip := ack.yiaddr.To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, errors.New("the DHCP server acknowledged no address")
+	}
+	server := net.IP(ack.options[dhcpOptServerID]).To4()
+	if server == nil {
+		return nil, errors.New("the DHCP server didn't identify itself")
+	}
+
+	mask := ip.DefaultMask()
+	if m := ack.options[dhcpOptSubnetMask]; len(m) == 4 {
+		mask = net.IPMask(m)
+	}
+
+	lease := &dhcpLease{
+		address:  &net.IPNet{IP: ip, Mask: mask},
+		server:   server,
+		domain:   string(bytes.TrimRight(ack.options[dhcpOptDomainName], "\x00")),
+		acquired: acquired,
+	}
+
+	for dns := ack.options[dhcpOptDNS]; len(dns) >= 4; dns = dns[4:] {
+		lease.dns = append(lease.dns, net.IP(dns[:4]))
+	}
+
+	// Classless routes replace the router option when both are given, as RFC 3442 asks
+	routes, err := parseClasslessRoutes(ack.options[dhcpOptClasslessRoute])
+	if err != nil {
+		return nil, err
+	}
+	if routes == nil {
+		if router := ack.options[dhcpOptRouter]; len(router) >= 4 {
+			routes = []dhcpRoute{{dst: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, gateway: net.IP(router[:4])}}
+		}
+	}
+	lease.routes = routes
+
+	seconds := func(code byte) (time.Duration, bool) {
+		if v := ack.options[code]; len(v) == 4 {
+			return time.Duration(binary.BigEndian.Uint32(v)) * time.Second, true
+		}
+		return 0, false
+	}
+	if v := ack.options[dhcpOptLeaseTime]; len(v) == 4 && binary.BigEndian.Uint32(v) == dhcpInfiniteLease {
+		return lease, nil
+	}
+	var ok bool
+	if lease.duration, ok = seconds(dhcpOptLeaseTime); !ok || lease.duration == 0 {
+		return nil, errors.New("the DHCP server gave no lease time")
+	}
+	if lease.renew, ok = seconds(dhcpOptRenewalTime); !ok || lease.renew >= lease.duration {
+		lease.renew = lease.duration / 2
+	}
+	if lease.rebind, ok = seconds(dhcpOptRebindingTime); !ok || lease.rebind >= lease.duration || lease.rebind < lease.renew {
+		lease.rebind = lease.duration * 7 / 8
+	}
+
+	return lease, nil
+}
+
+// parseClasslessRoutes decodes option 121, where each route is a prefix length, the
+// significant octets of the destination and the router
+func parseClasslessRoutes(data []byte) ([]dhcpRoute, error) {
+	var routes []dhcpRoute
+	for len(data) > 0 {
+		ones := int(data[0])
+		octets := (ones + 7) / 8
+		if ones > 32 || len(data) < 1+octets+4 {
+			return nil, errors.New("invalid classless static routes from the DHCP server")
+		}
+
+		dst := make(net.IP, 4)
+		copy(dst, data[1:1+octets])
+		gateway := net.IP(slices.Clone(data[1+octets : 1+octets+4]))
+		routes = append(routes, dhcpRoute{dst: &net.IPNet{IP: dst, Mask: net.CIDRMask(ones, 32)}, gateway: gateway})
+		data = data[1+octets+4:]
+	}
+
+	return routes, nil
+}
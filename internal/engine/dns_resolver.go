@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// embeddedResolverAddress is where containers find the embedded resolver, the address Docker
+// uses for its own
+const embeddedResolverAddress = "127.0.0.11"
+
+// dnsForwardTimeout bounds how long an upstream gets to answer before the next one is tried
+const dnsForwardTimeout = 2 * time.Second
+
+// embeddedResolver answers the DNS queries of a container by forwarding them to upstream
+// servers. It listens inside the container's network namespace but forwards from the shim's,
+// so upstreams only reachable from the host, like a systemd-resolved stub, work as well.
+type embeddedResolver struct {
+	udp       net.PacketConn
+	tcp       net.Listener
+	upstreams []string
+}
+
+// startEmbeddedResolver starts a resolver on embeddedResolverAddress in the network namespace
+// at nsPath. Several containers may share a namespace, so each binds its own sockets with
+// SO_REUSEPORT and the kernel spreads the queries over those left.
+func startEmbeddedResolver(nsPath string, upstreams []string) (*embeddedResolver, error) {
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer ns.Close()
+
+	r := &embeddedResolver{upstreams: upstreams}
+	done := make(chan error, 1)
+	go func() {
+		// Never unlocked, the thread is left in the container's namespace
+		runtime.LockOSThread()
+
+		if err := joinNamespace(ns, syscall.CLONE_NEWNET); err != nil {
+			done <- err
+			return
+		}
+
+		// The init brings up loopback too, but only once the resolver is listening. Bound to
+		// an address that isn't up yet, replies would come from 127.0.0.1 and be dropped.
+		if err := setLinkUp("lo"); err != nil {
+			done <- err
+			return
+		}
+
+		lc := net.ListenConfig{Control: reusePort}
+		addr := net.JoinHostPort(embeddedResolverAddress, "53")
+		if r.udp, err = lc.ListenPacket(context.Background(), "udp4", addr); err != nil {
+			done <- err
+			return
+		}
+		if r.tcp, err = lc.Listen(context.Background(), "tcp4", addr); err != nil {
+			r.udp.Close()
+			done <- err
+			return
+		}
+		done <- nil
+	}()
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", embeddedResolverAddress, err)
+	}
+
+	go r.serveUDP()
+	go r.serveTCP()
+
+	return r, nil
+}
+
+// reusePort lets the sockets share the address with the resolvers of other containers in the
+// namespace
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. It is 15 everywhere
+// but on a few architectures this doesn't run on.
+const soReusePort = 0xf
+
+// Close stops the resolver, queries in flight are dropped
+func (r *embeddedResolver) Close() {
+	r.udp.Close()
+	r.tcp.Close()
+}
+
+// serveUDP answers each query datagram with the first answer an upstream gives
+func (r *embeddedResolver) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := r.udp.ReadFrom(buf)
+		if err != nil {
+			// Closed when the container exits
+			return
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			answer, err := r.exchange(query)
+			if err != nil {
+				// The client retries or gives up on its own, like with an unreachable server
+				return
+			}
+			r.udp.WriteTo(answer, client)
+		}()
+	}
+}
+
+// exchange sends a query to the upstreams in turn until one answers
+func (r *embeddedResolver) exchange(query []byte) ([]byte, error) {
+	var lastErr error
+	for _, upstream := range r.upstreams {
+		conn, err := net.DialTimeout("udp", net.JoinHostPort(upstream, "53"), dnsForwardTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+		answer := make([]byte, 65535)
+		_, err = conn.Write(query)
+		n := 0
+		if err == nil {
+			n, err = conn.Read(answer)
+		}
+		conn.Close()
+		if err == nil {
+			return answer[:n], nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// serveTCP relays DNS over TCP connections, used for answers too large for a datagram
+func (r *embeddedResolver) serveTCP() {
+	for {
+		client, err := r.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go r.relayTCP(client)
+	}
+}
+
+// relayTCP connects a client to the first upstream that accepts the connection and copies the
+// length-prefixed messages both ways until either side is done
+func (r *embeddedResolver) relayTCP(client net.Conn) {
+	defer client.Close()
+
+	for _, upstream := range r.upstreams {
+		server, err := net.DialTimeout("tcp", net.JoinHostPort(upstream, "53"), dnsForwardTimeout)
+		if err != nil {
+			continue
+		}
+		defer server.Close()
+
+		go func() {
+			io.Copy(server, client)
+			server.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(client, server)
+		return
+	}
+}
@@ -0,0 +1,866 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dockerHubRegistry is the registry images without a registry host are pulled from
+const dockerHubRegistry = "https://registry.hub.docker.com"
+
+// Retries of interrupted layer downloads. The delay doubles with every attempt that made no
+// progress, up to maxLayerRetryDelay.
+const (
+	maxLayerAttempts   = 5
+	layerRetryDelay    = time.Second
+	maxLayerRetryDelay = 30 * time.Second
+)
+
+// DockerImageDownloader handles fetching and extracting Docker images
+type DockerImageDownloader struct {
+	client *http.Client
+	ref    Reference
+	// image and tag are what the store keeps the image under, see parseImageReference
+	image     string
+	tag       string
+	token     string
+	tokenExp  time.Time
+	userAgent string
+
+	// credentials authenticate to the token endpoint, pulls are anonymous without them
+	credentials *registryCredentials
+	// upstream is the registry the image is on, the only one tokens are sent to
+	upstream string
+	// challenge is how a registry other than Docker Hub asked to be authenticated to, once
+	// pinged is set; nil if it didn't ask
+	challenge *authChallenge
+	pinged    bool
+	// platform selects the image of a multi-platform manifest list, the host's by default
+	platform *Platform
+	// steps are those of the container the image is unpacked for
+	steps *setupSteps
+	// sources are the registry mirrors followed by upstream, source the one requests go to
+	// until it fails
+	sources []string
+	source  int
+	// received counts the bytes of layers downloaded, stats records the layers of a pull
+	// for its summary when set
+	received int64
+	stats    *pullStats
+}
+
+// tokenResponse represents the authentication token from Docker registry
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// manifestEntry represents an entry in a Docker manifest list
+type manifestEntry struct {
+	Digest    string   `json:"digest"`
+	MediaType string   `json:"mediaType"`
+	Size      int      `json:"size"`
+	Platform  Platform `json:"platform"`
+}
+
+// manifestList represents a Docker manifest list
+type manifestList struct {
+	Manifests []manifestEntry `json:"manifests"`
+}
+
+// layerEntry represents a layer in a Docker image
+type layerEntry struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// layersList represents the layers in a Docker image
+type layersList struct {
+	Config      layerEntry        `json:"config"`
+	Layers      []layerEntry      `json:"layers"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NewDockerImageDownloader creates a new Docker image downloader. Without credentials, the
+// ones stored by docker login are used if there are any.
+func NewDockerImageDownloader(imageAndTag string, credentials *registryCredentials) (*DockerImageDownloader, error) {
+	ref, err := ParseReference(imageAndTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if credentials == nil {
+		// Public images can still be pulled without them
+		if credentials, err = lookupRegistryCredentials(registryServers(ref.Domain)); err != nil {
+			warnf(eventTypeImage, "%v, pulling anonymously", err)
+		}
+	}
+
+	transport, err := newRegistryTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	// Mirrors are of Docker Hub, like Docker's
+	upstream := dockerHubRegistry
+	var mirrors []string
+	if ref.Domain == defaultDomain {
+		if mirrors, err = registryMirrors(); err != nil {
+			return nil, err
+		}
+	} else {
+		upstream = "https://" + ref.Domain
+	}
+
+	dl := &DockerImageDownloader{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &clockCheckingTransport{base: &rateLimitTransport{base: loggingTransport{base: transport}}},
+		},
+		ref:         ref,
+		image:       ref.FamiliarName(),
+		tag:         ref.storeTag(),
+		userAgent:   "go-docker-client/1.0",
+		credentials: credentials,
+		upstream:    upstream,
+		sources:     append(append([]string{}, mirrors...), upstream),
+	}
+	// A pull from a mirror may not need Docker Hub at all
+	if len(mirrors) > 0 {
+		return dl, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := dl.refreshToken(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+
+	return dl, nil
+}
+
+// parseImageReference splits an image reference into the familiar name and tag the store
+// keeps it under, defaulting to the latest tag. An image pinned with image@sha256:<hash> gets
+// "@sha256:<hash>" as its tag, which is stored and looked up like one; a tag next to the digest
+// is ignored like Docker does. Tarball images are kept under their URL without a tag.
+func parseImageReference(imageAndTag string) (image, tag string, err error) {
+	if isTarballURL(imageAndTag) {
+		name, err := parseTarballURL(imageAndTag)
+		return name, "", err
+	}
+
+	ref, err := ParseReference(imageAndTag)
+	if err != nil {
+		return "", "", err
+	}
+
+	return ref.FamiliarName(), ref.storeTag(), nil
+}
+
+// validateDigest checks that a digest is a sha256 content digest, the only kind registries use
+func validateDigest(digest string) error {
+	hash, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hash) != sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("expected sha256:<64 hex digits> as digest, got %q", digest)
+	}
+
+	return nil
+}
+
+// pinnedDigest returns the digest of an image pinned by digest, or "" for a tag
+func pinnedDigest(tag string) string {
+	digest, _ := strings.CutPrefix(tag, "@")
+	if digest == tag {
+		return ""
+	}
+
+	return digest
+}
+
+// formatImageReference joins an image name and a tag from parseImageReference again
+func formatImageReference(image, tag string) string {
+	if pinnedDigest(tag) != "" || tag == "" {
+		return image + tag
+	}
+
+	return image + ":" + tag
+}
+
+// verifyManifest checks that a manifest fetched by digest is the content the digest names
+func verifyManifest(data []byte, digest string) error {
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); actual != digest {
+		return fmt.Errorf("expected %s, got %s", digest, actual)
+	}
+
+	return nil
+}
+
+// repository returns the path of the image on the registry. Official images live under
+// library/, those of users and organizations under their name.
+func (dl *DockerImageDownloader) repository() string {
+	return dl.ref.Path
+}
+
+// refreshToken gets a new authentication token for pulling the repository, unless the
+// registry doesn't use tokens
+func (dl *DockerImageDownloader) refreshToken(ctx context.Context) error {
+	// Only refresh if token is expired or not set
+	if dl.token != "" && time.Now().Before(dl.tokenExp) {
+		return nil
+	}
+
+	url, err := dl.tokenURL(ctx)
+	if err != nil || url == "" {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", dl.userAgent)
+	if dl.credentials != nil {
+		req.SetBasicAuth(dl.credentials.Username, dl.credentials.Password)
+	}
+
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && dl.credentials != nil {
+		return fmt.Errorf("authentication as %s failed: incorrect username or password", dl.credentials.Username)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &registryStatusError{op: "authentication failed", code: resp.StatusCode, status: resp.Status}
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	dl.token = token.Token
+	if dl.token == "" {
+		dl.token = token.AccessToken
+	}
+	// If ExpiresIn is available, set expiration time
+	if token.ExpiresIn > 0 {
+		dl.tokenExp = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	} else {
+		// Default to 1 hour if not specified
+		dl.tokenExp = time.Now().Add(1 * time.Hour)
+	}
+
+	return nil
+}
+
+// tokenURL returns where tokens for pulling the repository come from: Docker Hub's token
+// endpoint, or the realm another registry names in its challenge. It is "" for a registry
+// that doesn't use tokens.
+func (dl *DockerImageDownloader) tokenURL(ctx context.Context) (string, error) {
+	if dl.upstream == dockerHubRegistry {
+		return fmt.Sprintf("https://auth.docker.io/token?service=registry.docker.io&scope=repository:%s:pull", dl.repository()), nil
+	}
+
+	if !dl.pinged {
+		if err := dl.ping(ctx); err != nil {
+			return "", err
+		}
+	}
+	if dl.challenge == nil || dl.challenge.scheme != "bearer" {
+		return "", nil
+	}
+
+	realm, err := url.Parse(dl.challenge.params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("invalid realm %q", dl.challenge.params["realm"])
+	}
+	query := realm.Query()
+	if service := dl.challenge.params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", dl.repository()))
+	realm.RawQuery = query.Encode()
+
+	return realm.String(), nil
+}
+
+// ping learns how a registry other than Docker Hub wants to be authenticated to from the
+// challenge it answers /v2/ with
+func (dl *DockerImageDownloader) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.upstream+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", dl.userAgent)
+
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		dl.pinged = true
+		return nil
+	case http.StatusUnauthorized:
+	default:
+		return &registryStatusError{op: "registry check failed", code: resp.StatusCode, status: resp.Status}
+	}
+
+	challenge, err := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return fmt.Errorf("failed to authenticate to %s: %w", registryHost(dl.upstream), err)
+	}
+	dl.challenge, dl.pinged = challenge, true
+
+	return nil
+}
+
+// getDigests retrieves the layers of the Docker image along with the raw manifest
+func (dl *DockerImageDownloader) getDigests(ctx context.Context) (layersList, []byte, error) {
+	reference := dl.tag
+	digest := pinnedDigest(dl.tag)
+	if digest != "" {
+		reference = digest
+	}
+
+	mismatch := fmt.Sprintf("manifest of %s doesn't match its pinned digest", formatImageReference(dl.image, dl.tag))
+	bodyBytes, contentType, err := dl.getManifest(ctx, reference, "failed to get manifest", mismatch)
+	if err != nil {
+		return layersList{}, nil, err
+	}
+
+	mediaType, err := manifestMediaType(bodyBytes, contentType)
+	if err != nil {
+		return layersList{}, nil, err
+	}
+
+	if isManifestList(mediaType) {
+		var manifests manifestList
+		if err := json.Unmarshal(bodyBytes, &manifests); err != nil {
+			return layersList{}, nil, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		want, explicit := hostPlatform(), dl.platform != nil
+		if explicit {
+			want = *dl.platform
+		}
+		manifest, err := selectManifest(manifests.Manifests, want, explicit)
+		if err != nil {
+			return layersList{}, nil, err
+		}
+		return dl.getLayers(ctx, manifest.Digest)
+	}
+
+	layers, err := decodeManifest(bodyBytes, mediaType)
+	if err != nil {
+		return layersList{}, nil, err
+	}
+
+	return layers, bodyBytes, nil
+}
+
+// getLayers retrieves the layers of a specific manifest along with the raw manifest
+func (dl *DockerImageDownloader) getLayers(ctx context.Context, digest string) (layersList, []byte, error) {
+	raw, contentType, err := dl.getManifest(ctx, digest, "failed to get layers", "manifest for this platform doesn't match the manifest list")
+	if err != nil {
+		return layersList{}, nil, err
+	}
+
+	mediaType, err := manifestMediaType(raw, contentType)
+	if err != nil {
+		return layersList{}, nil, err
+	}
+	if isManifestList(mediaType) {
+		return layersList{}, nil, fmt.Errorf("manifest list entry %s is another manifest list", shortDigest(digest))
+	}
+
+	list, err := decodeManifest(raw, mediaType)
+	if err != nil {
+		return layersList{}, nil, err
+	}
+
+	return list, raw, nil
+}
+
+// getManifest fetches a manifest by tag or digest and returns it with its content type. One
+// fetched by digest is verified against it, failing with mismatch if it doesn't match. A
+// mirror that fails the request is given up for the next one, and Docker Hub last.
+func (dl *DockerImageDownloader) getManifest(ctx context.Context, reference, op, mismatch string) ([]byte, string, error) {
+	for {
+		registry := dl.registry()
+		data, contentType, err := dl.fetchManifest(ctx, registry, reference, op, mismatch)
+		if err == nil {
+			return data, contentType, nil
+		}
+
+		if !dl.fallBack(ctx, err) {
+			return nil, "", err
+		}
+	}
+}
+
+// fetchManifest fetches a manifest from one registry
+func (dl *DockerImageDownloader) fetchManifest(ctx context.Context, registry, reference, op, mismatch string) ([]byte, string, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", registry, dl.repository(), reference)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := dl.authorize(ctx, req, registry); err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	req.Header.Set("User-Agent", dl.userAgent)
+
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &registryStatusError{op: op, code: resp.StatusCode, status: resp.Status}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.HasPrefix(reference, "sha256:") {
+		if err := verifyManifest(data, reference); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", mismatch, err)
+		}
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// authorize adds the token, or the credentials of a registry that asked for basic
+// authentication, to a request for the image's registry. Mirrors are pulled from anonymously,
+// they have no use for them.
+func (dl *DockerImageDownloader) authorize(ctx context.Context, req *http.Request, registry string) error {
+	if registry != dl.upstream {
+		return nil
+	}
+
+	if err := dl.refreshToken(ctx); err != nil {
+		return err
+	}
+	switch {
+	case dl.token != "":
+		req.Header.Set("Authorization", "Bearer "+dl.token)
+	case dl.challenge != nil && dl.challenge.scheme == "basic" && dl.credentials != nil:
+		req.SetBasicAuth(dl.credentials.Username, dl.credentials.Password)
+	}
+
+	return nil
+}
+
+// DownloadAndUnpackLayers downloads and extracts all layers of the Docker image and returns
+// its config
+func (dl *DockerImageDownloader) DownloadAndUnpackLayers(ctx context.Context, destDir string) (imageConfig, error) {
+	imageProgress(strings.TrimPrefix(dl.tag, "@"), "Pulling from %s", dl.repository())
+
+	layers, _, err := dl.getDigests(ctx)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed to get image digests: %w", err)
+	}
+
+	// The config comes first, so an image for another platform is refused before its layers
+	// are downloaded
+	config, err := dl.fetchConfig(ctx, layers, destDir)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed to download image config: %w", err)
+	}
+	if err := dl.checkPlatform(config); err != nil {
+		return imageConfig{}, err
+	}
+
+	// Layers are downloaded one at a time, each only once those below are applied
+	err = applyLayers(destDir, layers.Layers, dl.steps, func(layer layerEntry) (string, func(), error) {
+		_, hex, _ := strings.Cut(layer.Digest, ":")
+		tarballPath := filepath.Join(destDir, layerDownloadPrefix+hex)
+		if err := dl.fetchLayer(ctx, layer, tarballPath); err != nil {
+			return "", nil, fmt.Errorf("failed to download layer %s: %w", shortDigest(layer.Digest), err)
+		}
+
+		return tarballPath, func() {
+			imageProgress(shortDigest(layer.Digest), "Pull complete")
+			if err := os.Remove(tarballPath); err != nil {
+				warnf(eventTypeImage, "failed to remove temporary tarball %s: %v", tarballPath, err)
+			}
+		}, nil
+	})
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	return config, nil
+}
+
+// checkPlatform refuses an image that isn't for the platform asked for with --platform. A
+// manifest list was already matched against it, but a plain manifest can be for anything.
+func (dl *DockerImageDownloader) checkPlatform(config imageConfig) error {
+	if dl.platform == nil || config.Architecture == "" {
+		return nil
+	}
+
+	actual := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if !dl.platform.matches(actual) {
+		return fmt.Errorf("image %s is for %s, not the requested %s", formatImageReference(dl.image, dl.tag), actual, dl.platform)
+	}
+
+	return nil
+}
+
+// fetchConfig downloads the image config of a manifest, using dir for the download. Images
+// without a config, like old schema 1 manifests, get an empty one.
+func (dl *DockerImageDownloader) fetchConfig(ctx context.Context, manifest layersList, dir string) (imageConfig, error) {
+	if manifest.Config.Digest == "" {
+		return imageConfig{Annotations: manifest.Annotations}, nil
+	}
+
+	path := filepath.Join(dir, ".image-config.json")
+	if err := dl.fetchLayer(ctx, manifest.Config, path); err != nil {
+		return imageConfig{}, err
+	}
+	defer os.Remove(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	return parseImageConfig(data, manifest)
+}
+
+// digestMismatchError reports a blob whose content doesn't match its digest
+type digestMismatchError struct {
+	digest string
+	actual string
+	source string
+}
+
+func (e *digestMismatchError) Error() string {
+	return fmt.Sprintf("blob %s from %s failed digest verification (got %s)", e.digest, e.source, e.actual)
+}
+
+// downloadStatusError reports a blob download the registry answered with an unexpected status
+type downloadStatusError struct {
+	code   int
+	status string
+}
+
+func (e *downloadStatusError) Error() string {
+	return fmt.Sprintf("download failed with status: %d %s", e.code, e.status)
+}
+
+// loggingTransport publishes a debug event for every registry request
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		debugf(eventTypeImage, "registry request failed", "method", req.Method, "url", req.URL.Redacted(), "error", err)
+		return nil, err
+	}
+
+	debugf(eventTypeImage, "registry request", "method", req.Method, "url", req.URL.Redacted(), "status", resp.StatusCode,
+		"length", resp.ContentLength, "duration", time.Since(start).Round(time.Millisecond))
+	return resp, nil
+}
+
+// registryStatusError reports a registry request other than a blob download answered with an
+// unexpected status
+type registryStatusError struct {
+	op     string
+	code   int
+	status string
+	// message is the explanation the registry sent along, if any
+	message string
+}
+
+func (e *registryStatusError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("%s with status: %d %s: %s", e.op, e.code, e.status, e.message)
+	}
+	return fmt.Sprintf("%s with status: %d %s", e.op, e.code, e.status)
+}
+
+// retryableDownloadError reports whether a failed download is worth retrying: the connection
+// failed or the registry is having trouble, rather than refusing the request
+func retryableDownloadError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// The transport has waited as long as it is worth it already
+	var rateLimited *rateLimitError
+	if errors.As(err, &rateLimited) {
+		return false
+	}
+
+	var status *downloadStatusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests || status.code == http.StatusRequestTimeout
+	}
+
+	// Failing to write the download locally won't get better by downloading it again
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr)
+}
+
+// fetchLayer downloads a layer and verifies its digest. Interrupted downloads are retried with
+// exponential backoff and resume where they stopped, until maxLayerAttempts attempts in a row
+// made no progress. Corrupt data is retried once from scratch before the pull is failed.
+func (dl *DockerImageDownloader) fetchLayer(ctx context.Context, layer layerEntry, tarballPath string) error {
+	var corrupt *digestMismatchError
+	failures := 0
+	for {
+		registry := dl.registry()
+		before := fileSize(tarballPath)
+		err := dl.downloadLayer(ctx, registry, layer, tarballPath)
+		if err == nil {
+			return nil
+		}
+
+		var mismatch *digestMismatchError
+		if errors.As(err, &mismatch) {
+			if corrupt != nil {
+				return fmt.Errorf("%w; first attempt from %s returned %s", err, corrupt.source, corrupt.actual)
+			}
+			corrupt = mismatch
+			// A mirror serving corrupt data isn't trusted with the rest of the pull
+			if !dl.fallBackToUpstream(ctx, err) {
+				warnf(eventTypeImage, "%v, retrying from %s", err, registryHost(registry))
+			}
+
+			// There is no telling which part is corrupt, so nothing of it can be resumed
+			if err := os.Truncate(tarballPath, 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Blobs are the same wherever they come from, so the next source resumes what a
+		// failed mirror left
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) && dl.fallBack(ctx, err) {
+			failures = 0
+			continue
+		}
+		if !retryableDownloadError(err) {
+			return err
+		}
+		if fileSize(tarballPath) > before {
+			failures = 0
+		}
+		failures++
+		if failures >= maxLayerAttempts {
+			return fmt.Errorf("%w (giving up after %d attempts without progress)", err, failures)
+		}
+
+		delay := min(layerRetryDelay<<(failures-1), maxLayerRetryDelay)
+		warnf(eventTypeImage, "downloading %s failed: %v, retrying in %s", shortDigest(layer.Digest), err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// downloadLayer downloads a single layer from the given registry and verifies its digest. The
+// download is appended to what tarballPath already holds from an interrupted attempt, which
+// the registry is asked to skip with a Range request.
+func (dl *DockerImageDownloader) downloadLayer(ctx context.Context, registry string, layer layerEntry, tarballPath string) error {
+	algorithm, expected, ok := strings.Cut(layer.Digest, ":")
+	if !ok || algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest %q", layer.Digest)
+	}
+
+	out, err := os.OpenFile(tarballPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Hashing what is already there also leaves the file positioned at its end
+	hash := sha256.New()
+	offset, err := io.Copy(hash, out)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", registry, dl.repository(), layer.Digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := dl.authorize(ctx, req, registry); err != nil {
+		return err
+	}
+	req.Header.Set("Accept", layer.MediaType)
+	req.Header.Set("User-Agent", dl.userAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := dl.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Nothing is left to download, the digest tells whether the blob is complete
+		resp.Body = http.NoBody
+	case resp.StatusCode == http.StatusOK:
+		// The registry doesn't support ranges, so start over
+		if offset > 0 {
+			if err := out.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			hash.Reset()
+			offset = 0
+		}
+	default:
+		return &downloadStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	body := newProgressReader(resp.Body, layer, "Downloading")
+	body.done = offset
+
+	n, err := io.Copy(io.MultiWriter(out, hash), body)
+	dl.received += n
+	if err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return &digestMismatchError{
+			digest: layer.Digest,
+			actual: "sha256:" + actual,
+			source: registryHost(registry),
+		}
+	}
+
+	return nil
+}
+
+// fileSize returns the size of the file at path, or 0 if it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// registryHost strips the scheme from a registry URL for use in messages
+func registryHost(registry string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+}
+
+// Magic numbers that start compressed layers
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressLayer returns the tar stream of a layer that is gzip or zstd compressed or not
+// compressed at all. The compression is recognized from the first bytes rather than the media
+// type, which registries and image tools don't always set consistently.
+func decompressLayer(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress layer: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		return newZstdReader(br), nil
+	default:
+		return br, nil
+	}
+}
+
+// extractTarball extracts the tarball of a layer to the destination directory, publishing how
+// much of it has been read. Extended attributes the destination can't take are an optional
+// step of steps.
+func extractTarball(destDir, tarballPath string, layer layerEntry, steps *setupSteps) error {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	layer.Size = info.Size()
+
+	tarball, err := decompressLayer(newProgressReader(f, layer, "Extracting"))
+	if err != nil {
+		return err
+	}
+
+	xattrs := newLayerXattrs()
+	cmd := exec.Command("tar", "-C", destDir, "-xf", "-")
+	cmd.Stdin = io.TeeReader(tarball, xattrs)
+	cmd.Stderr = os.Stderr
+
+	debugf(eventTypeImage, "extracting layer", "digest", layer.Digest, "size", layer.Size, "dir", destDir)
+	start := time.Now()
+	err = cmd.Run()
+	xattrs.wait()
+	if err != nil {
+		return err
+	}
+	debugf(eventTypeImage, "extracted layer", "digest", layer.Digest, "duration", time.Since(start).Round(time.Millisecond))
+
+	return steps.optional("preserving the extended attributes of layer "+shortDigest(layer.Digest), xattrs.apply(destDir))
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A registry other than Docker Hub is pulled from directly, with a token from the realm its
+// challenge names
+func TestDownloaderPullsFromOtherRegistries(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:c0ff", "size": 2},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:1a7e", "size": 3}]}`
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			if r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:team/app:pull" {
+				t.Errorf("token requested for %s", r.URL.RawQuery)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token": "secret", "expires_in": 300}`))
+		case "/v2/team/app/manifests/1.0":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Write([]byte(manifest))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// The test server speaks plain HTTP, which only insecure registries fall back to
+	host := strings.TrimPrefix(srv.URL, "http://")
+	saved := insecureRegistries
+	insecureRegistries = []string{host}
+	t.Cleanup(func() { insecureRegistries = saved })
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	dl, err := NewDockerImageDownloader(host+"/team/app:1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dl.image; got != host+"/team/app" {
+		t.Errorf("image is stored as %q, want %q", got, host+"/team/app")
+	}
+
+	layers, _, err := dl.getDigests(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers.Layers) != 1 || layers.Layers[0].Digest != "sha256:1a7e" {
+		t.Errorf("layers = %+v, want the one of the manifest", layers.Layers)
+	}
+}
+
+// A mirror that serves a corrupt blob isn't trusted, and neither are the mirrors after it,
+// which may well cache the same blob: the layer is downloaded again from upstream
+func TestDownloaderFallsBackToUpstreamOnCorruptBlob(t *testing.T) {
+	const content = "layer contents"
+	sum := sha256.Sum256([]byte(content))
+	layer := layerEntry{MediaType: mediaTypeOCILayer, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+
+	// blobServer serves body as every blob and counts the requests for them
+	blobServer := func(body string, hits *atomic.Int32) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/blobs/") {
+				hits.Add(1)
+				w.Write([]byte(body))
+			}
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	var corruptHits, secondHits, upstreamHits atomic.Int32
+	corrupt := blobServer("layer c0ntents", &corruptHits)
+	second := blobServer("layer c0ntents", &secondHits)
+	upstream := blobServer(content, &upstreamHits)
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	saved := insecureRegistries
+	insecureRegistries = []string{host}
+	t.Cleanup(func() { insecureRegistries = saved })
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	dl, err := NewDockerImageDownloader(host+"/team/app:1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.sources = append([]string{corrupt.URL, second.URL}, dl.sources...)
+
+	path := filepath.Join(t.TempDir(), "layer.tar.gz")
+	if err := dl.fetchLayer(context.Background(), layer, path); err != nil {
+		t.Fatalf("fetchLayer() error = %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != content {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+	if corruptHits.Load() != 1 || secondHits.Load() != 0 || upstreamHits.Load() != 1 {
+		t.Errorf("blob requests: %d to the corrupt mirror, %d to the next one and %d upstream, want 1, 0 and 1",
+			corruptHits.Load(), secondHits.Load(), upstreamHits.Load())
+	}
+	if dl.registry() != dl.upstream {
+		t.Errorf("the rest of the pull goes to %s, want upstream %s", dl.registry(), dl.upstream)
+	}
+}
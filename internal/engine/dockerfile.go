@@ -0,0 +1,382 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// buildInstructions are the Dockerfile instructions build runs
+var buildInstructions = map[string]bool{
+	"FROM":        true,
+	"ARG":         true,
+	"RUN":         true,
+	"COPY":        true,
+	"ADD":         true,
+	"ENV":         true,
+	"WORKDIR":     true,
+	"CMD":         true,
+	"ENTRYPOINT":  true,
+	"EXPOSE":      true,
+	"HEALTHCHECK": true,
+}
+
+// unsupportedInstructions are Dockerfile instructions Docker knows that build doesn't run,
+// rejected rather than skipped since the image would silently differ
+var unsupportedInstructions = map[string]bool{
+	"LABEL":      true,
+	"USER":       true,
+	"VOLUME":     true,
+	"STOPSIGNAL": true,
+	"SHELL":      true,
+	"ONBUILD":    true,
+	"MAINTAINER": true,
+}
+
+// instruction is one instruction of a Dockerfile
+type instruction struct {
+	// cmd is the instruction's name in upper case
+	cmd string
+	// original is the instruction as written, with its continuation lines joined
+	original string
+	line     int
+	// flags are the --name=value options in front of the arguments
+	flags []string
+	// args is everything after the flags
+	args string
+	// exec holds the arguments of the JSON form, like RUN ["echo", "hi"]
+	exec []string
+	// isExec is set for the JSON form, which may be empty
+	isExec bool
+}
+
+// errorf returns an error about the instruction that names its line
+func (i *instruction) errorf(format string, a ...any) error {
+	return fmt.Errorf("Dockerfile line %d: %s", i.line, fmt.Sprintf(format, a...))
+}
+
+// parseDockerfile splits a Dockerfile into its instructions. Like Docker, a backslash at the
+// end of a line continues it, and lines starting with # are comments, also between
+// continuation lines.
+func parseDockerfile(r io.Reader) ([]*instruction, error) {
+	var instructions []*instruction
+	var current strings.Builder
+	start := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			start = n
+			line = trimmed
+		}
+
+		if body, ok := strings.CutSuffix(line, "\\"); ok {
+			current.WriteString(body)
+			continue
+		}
+		current.WriteString(line)
+
+		inst, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %w", err)
+	}
+	if current.Len() > 0 {
+		inst, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+	}
+
+	if len(instructions) == 0 {
+		return nil, errors.New("the Dockerfile has no instructions")
+	}
+	// Only ARGs for the FROM lines can come before the first FROM
+	for _, inst := range instructions {
+		if inst.cmd == "FROM" {
+			break
+		}
+		if inst.cmd != "ARG" {
+			return nil, inst.errorf("the first instruction must be FROM, got %s", inst.cmd)
+		}
+	}
+	if !slices.ContainsFunc(instructions, func(inst *instruction) bool { return inst.cmd == "FROM" }) {
+		return nil, errors.New("the Dockerfile has no FROM")
+	}
+
+	return instructions, nil
+}
+
+// parseInstruction splits a line into the instruction, its flags and arguments
+func parseInstruction(text string, line int) (*instruction, error) {
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, args = text[:i], text[i+1:]
+	}
+	inst := &instruction{cmd: strings.ToUpper(name), original: text, line: line}
+	args = strings.TrimSpace(args)
+
+	switch {
+	case unsupportedInstructions[inst.cmd]:
+		return nil, inst.errorf("%s isn't supported by build", inst.cmd)
+	case !buildInstructions[inst.cmd]:
+		return nil, inst.errorf("unknown instruction: %s", name)
+	}
+
+	if inst.cmd == "COPY" || inst.cmd == "ADD" || inst.cmd == "FROM" || inst.cmd == "HEALTHCHECK" {
+		for strings.HasPrefix(args, "--") {
+			flag, rest, _ := strings.Cut(args, " ")
+			inst.flags = append(inst.flags, flag)
+			args = strings.TrimSpace(rest)
+		}
+	}
+	inst.args = args
+
+	switch inst.cmd {
+	case "RUN", "CMD", "ENTRYPOINT", "COPY", "ADD":
+		// Arguments that aren't a valid JSON array are the shell form, like with Docker
+		if strings.HasPrefix(args, "[") && json.Unmarshal([]byte(args), &inst.exec) == nil {
+			inst.isExec = true
+		}
+	}
+	if args == "" && inst.cmd != "CMD" && inst.cmd != "ENTRYPOINT" {
+		return nil, inst.errorf("%s requires at least one argument", inst.cmd)
+	}
+
+	return inst, nil
+}
+
+// flagValues returns the instruction's --name=value flags by name, rejecting those that
+// aren't in known
+func (i *instruction) flagValues(known ...string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, f := range i.flags {
+		name, value, ok := strings.Cut(strings.TrimPrefix(f, "--"), "=")
+		if !ok || !slices.Contains(known, name) {
+			return nil, i.errorf("unknown flag for %s: %s", i.cmd, f)
+		}
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// shellWords splits the arguments of an instruction into words the way Docker does for the
+// instructions that take several: at unquoted whitespace, after removing quotes and
+// backslash escapes and expanding $VAR, ${VAR}, ${VAR:-default} and ${VAR:+alternative}
+// with lookup
+func shellWords(s string, lookup func(string) (string, bool)) ([]string, error) {
+	return newWordExpander(s, lookup).words(true)
+}
+
+// shellWord is shellWords for instructions that take a single word, like WORKDIR or the
+// value of the legacy ENV name value form, in which whitespace is kept
+func shellWord(s string, lookup func(string) (string, bool)) (string, error) {
+	words, err := newWordExpander(s, lookup).words(false)
+	if err != nil || len(words) == 0 {
+		return "", err
+	}
+
+	return words[0], nil
+}
+
+// wordExpander walks over the arguments of an instruction
+type wordExpander struct {
+	s      []rune
+	pos    int
+	lookup func(string) (string, bool)
+}
+
+func newWordExpander(s string, lookup func(string) (string, bool)) *wordExpander {
+	return &wordExpander{s: []rune(s), lookup: lookup}
+}
+
+// words returns the expanded words, or with split unset everything as a single word
+func (w *wordExpander) words(split bool) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	// inWord is set once something, even an empty "", started the word
+	inWord := false
+
+	for w.pos < len(w.s) {
+		c := w.s[w.pos]
+		w.pos++
+
+		switch {
+		case split && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\'':
+			end := w.indexFrom('\'')
+			if end < 0 {
+				return nil, errors.New("unexpected end of statement while looking for matching single-quote")
+			}
+			word.WriteString(string(w.s[w.pos:end]))
+			w.pos = end + 1
+		case c == '"':
+			if err := w.doubleQuoted(&word); err != nil {
+				return nil, err
+			}
+		case c == '\\' && w.pos < len(w.s):
+			word.WriteRune(w.s[w.pos])
+			w.pos++
+		case c == '$':
+			value, err := w.variable()
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(value)
+		default:
+			word.WriteRune(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// doubleQuoted adds what is between double quotes to word, where variables are still expanded
+// and backslashes only escape $, ", \ and `
+func (w *wordExpander) doubleQuoted(word *strings.Builder) error {
+	for w.pos < len(w.s) {
+		c := w.s[w.pos]
+		w.pos++
+
+		switch {
+		case c == '"':
+			return nil
+		case c == '\\' && w.pos < len(w.s) && strings.ContainsRune("$\"\\`", w.s[w.pos]):
+			word.WriteRune(w.s[w.pos])
+			w.pos++
+		case c == '$':
+			value, err := w.variable()
+			if err != nil {
+				return err
+			}
+			word.WriteString(value)
+		default:
+			word.WriteRune(c)
+		}
+	}
+
+	return errors.New("unexpected end of statement while looking for matching double-quote")
+}
+
+// variable expands the variable after a $. A $ that doesn't start a name stays as it is.
+func (w *wordExpander) variable() (string, error) {
+	if w.pos >= len(w.s) {
+		return "$", nil
+	}
+
+	if w.s[w.pos] != '{' {
+		name := w.name()
+		if name == "" {
+			return "$", nil
+		}
+		value, _ := w.lookup(name)
+		return value, nil
+	}
+
+	w.pos++
+	name := w.name()
+	if name == "" || w.pos >= len(w.s) {
+		return "", errors.New("invalid variable substitution: missing name in ${}")
+	}
+	value, set := w.lookup(name)
+	if w.s[w.pos] == '}' {
+		w.pos++
+		return value, nil
+	}
+
+	if w.s[w.pos] != ':' || w.pos+1 >= len(w.s) || (w.s[w.pos+1] != '-' && w.s[w.pos+1] != '+') {
+		return "", fmt.Errorf("unsupported modifier in ${%s...}: only :- and :+ are supported", name)
+	}
+	modifier := w.s[w.pos+1]
+	w.pos += 2
+
+	// The word may hold quotes and variables of its own
+	var word strings.Builder
+	for {
+		if w.pos >= len(w.s) {
+			return "", fmt.Errorf("missing closing } in ${%s", name)
+		}
+		c := w.s[w.pos]
+		w.pos++
+		if c == '}' {
+			break
+		}
+		switch c {
+		case '$':
+			nested, err := w.variable()
+			if err != nil {
+				return "", err
+			}
+			word.WriteString(nested)
+		case '"':
+			if err := w.doubleQuoted(&word); err != nil {
+				return "", err
+			}
+		default:
+			word.WriteRune(c)
+		}
+	}
+
+	if modifier == '-' {
+		if !set || value == "" {
+			return word.String(), nil
+		}
+		return value, nil
+	}
+	if set && value != "" {
+		return word.String(), nil
+	}
+	return "", nil
+}
+
+// name reads a variable name: letters, digits and underscores
+func (w *wordExpander) name() string {
+	start := w.pos
+	for w.pos < len(w.s) {
+		c := w.s[w.pos]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			break
+		}
+		w.pos++
+	}
+
+	return string(w.s[start:w.pos])
+}
+
+// indexFrom returns the index of the next c from the current position, or -1
+func (w *wordExpander) indexFrom(c rune) int {
+	for i := w.pos; i < len(w.s); i++ {
+		if w.s[i] == c {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	dockerfile := `# syntax is ignored
+ARG BASE=alpine
+FROM $BASE AS build
+
+run apk add \
+    # comments between continuation lines are dropped
+    curl \
+    git
+COPY --from=build --chown=1000 ["a b", "/dst/"]
+RUN ["echo", "exec form"]
+CMD [not json
+ENTRYPOINT
+HEALTHCHECK --interval=5s CMD curl -f localhost
+`
+
+	instructions, err := parseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []instruction{
+		{cmd: "ARG", original: "ARG BASE=alpine", line: 2, args: "BASE=alpine"},
+		{cmd: "FROM", original: "FROM $BASE AS build", line: 3, args: "$BASE AS build"},
+		{cmd: "RUN", original: "run apk add     curl     git", line: 5, args: "apk add     curl     git"},
+		{cmd: "COPY", original: `COPY --from=build --chown=1000 ["a b", "/dst/"]`, line: 9, flags: []string{"--from=build", "--chown=1000"}, args: `["a b", "/dst/"]`, exec: []string{"a b", "/dst/"}, isExec: true},
+		{cmd: "RUN", original: `RUN ["echo", "exec form"]`, line: 10, args: `["echo", "exec form"]`, exec: []string{"echo", "exec form"}, isExec: true},
+		{cmd: "CMD", original: "CMD [not json", line: 11, args: "[not json"},
+		{cmd: "ENTRYPOINT", original: "ENTRYPOINT", line: 12},
+		{cmd: "HEALTHCHECK", original: "HEALTHCHECK --interval=5s CMD curl -f localhost", line: 13, flags: []string{"--interval=5s"}, args: "CMD curl -f localhost"},
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("parsed %d instructions, want %d", len(instructions), len(want))
+	}
+	for i, inst := range instructions {
+		if !reflect.DeepEqual(*inst, want[i]) {
+			t.Errorf("instruction %d = %+v, want %+v", i, *inst, want[i])
+		}
+	}
+}
+
+func TestParseDockerfileErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		wantErr    string
+	}{
+		{name: "empty", dockerfile: "# only a comment\n", wantErr: "the Dockerfile has no instructions"},
+		{name: "no FROM", dockerfile: "ARG A=1\n", wantErr: "the Dockerfile has no FROM"},
+		{name: "instruction before FROM", dockerfile: "RUN true\nFROM alpine\n", wantErr: "Dockerfile line 1: the first instruction must be FROM, got RUN"},
+		{name: "unknown instruction", dockerfile: "FROM alpine\nFOO bar\n", wantErr: "Dockerfile line 2: unknown instruction: FOO"},
+		{name: "unsupported instruction", dockerfile: "FROM alpine\nVOLUME /data\n", wantErr: "Dockerfile line 2: VOLUME isn't supported by build"},
+		{name: "missing argument", dockerfile: "FROM alpine\nWORKDIR\n", wantErr: "Dockerfile line 2: WORKDIR requires at least one argument"},
+		{name: "continued instruction at its first line", dockerfile: "FROM alpine\n\nRUN echo \\\n  a \\\n  b\nBOGUS\n", wantErr: "Dockerfile line 6: unknown instruction: BOGUS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDockerfile(strings.NewReader(tt.dockerfile))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstructionFlagValues(t *testing.T) {
+	inst, err := parseInstruction("COPY --from=build --chmod=755 a /b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := inst.flagValues("from", "chmod", "chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"from": "build", "chmod": "755"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("flagValues() = %v, want %v", values, want)
+	}
+
+	if _, err := inst.flagValues("from"); err == nil || !strings.Contains(err.Error(), "unknown flag for COPY: --chmod=755") {
+		t.Errorf("flagValues() error = %v, want the unknown --chmod", err)
+	}
+}
+
+func TestShellWords(t *testing.T) {
+	vars := map[string]string{"NAME": "app", "EMPTY": "", "SPACED": "a b"}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{in: "a  b\tc", want: []string{"a", "b", "c"}},
+		{in: `"a b" 'c d' e\ f`, want: []string{"a b", "c d", "e f"}},
+		{in: `"" x`, want: []string{"", "x"}},
+		{in: "$NAME ${NAME}.conf /$UNSET/", want: []string{"app", "app.conf", "//"}},
+		{in: "$SPACED", want: []string{"a b"}},
+		{in: `'$NAME' "$NAME" \$NAME`, want: []string{"$NAME", "app", "$NAME"}},
+		{in: `"a \"q\" \n"`, want: []string{`a "q" \n`}},
+		{in: "${UNSET:-default} ${EMPTY:-empty} ${NAME:-unused}", want: []string{"default", "empty", "app"}},
+		{in: "${NAME:+set} ${EMPTY:+set} ${UNSET:+set}x", want: []string{"set", "", "x"}},
+		{in: `${UNSET:-"a b"} ${UNSET:-$NAME}`, want: []string{"a b", "app"}},
+		{in: "a$-b $", want: []string{"a$-b", "$"}},
+		{in: "'open", wantErr: "matching single-quote"},
+		{in: `"open`, wantErr: "matching double-quote"},
+		{in: "${}", wantErr: "missing name"},
+		{in: "${NAME", wantErr: "missing name"},
+		{in: "${NAME:-x", wantErr: "missing closing }"},
+		{in: "${NAME#x}", wantErr: "unsupported modifier"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := shellWords(tt.in, lookup)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shellWords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellWord(t *testing.T) {
+	got, err := shellWord(`/srv/$NAME  "keeps  spaces"`, func(name string) (string, bool) { return "app", true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/srv/app  keeps  spaces"; got != want {
+		t.Errorf("shellWord() = %q, want %q", got, want)
+	}
+}
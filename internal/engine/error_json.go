@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// errorJSONArg comes before the command and turns its error message into an errorDiagnosis
+const errorJSONArg = "--error-json"
+
+// errorJSON is set by errorJSONArg
+var errorJSON bool
+
+// subsystemHost is the subsystem of failures of the host rather than of one of ours, like
+// a full disk or a missing privilege
+const subsystemHost = "host"
+
+// subsystemCLI is the subsystem of failures to use the command line
+const subsystemCLI = "cli"
+
+// errUnknownCommand is returned for a command that doesn't exist
+var errUnknownCommand = errors.New("unknown command")
+
+// errorDiagnosis describes why a command failed, for scripts that need to tell failures
+// apart without matching messages. Codes and remediations are stable, messages aren't.
+type errorDiagnosis struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	Subsystem string `json:"subsystem"`
+	// Errno is the system call error underneath, if there is one
+	Errno     int    `json:"errno,omitempty"`
+	ErrnoName string `json:"errnoName,omitempty"`
+	// Remediation names what usually fixes this failure, see the README
+	Remediation string `json:"remediation,omitempty"`
+	Command     string `json:"command,omitempty"`
+	ExitCode    int    `json:"exitCode"`
+}
+
+// errnoNames are the names of the errors system calls of ours commonly fail with
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.ESRCH:        "ESRCH",
+	syscall.EINTR:        "EINTR",
+	syscall.EIO:          "EIO",
+	syscall.EBADF:        "EBADF",
+	syscall.EAGAIN:       "EAGAIN",
+	syscall.ENOMEM:       "ENOMEM",
+	syscall.EACCES:       "EACCES",
+	syscall.EBUSY:        "EBUSY",
+	syscall.EEXIST:       "EEXIST",
+	syscall.EXDEV:        "EXDEV",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.EISDIR:       "EISDIR",
+	syscall.EINVAL:       "EINVAL",
+	syscall.EMFILE:       "EMFILE",
+	syscall.ENOSPC:       "ENOSPC",
+	syscall.EROFS:        "EROFS",
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ENOTEMPTY:    "ENOTEMPTY",
+	syscall.ELOOP:        "ELOOP",
+	syscall.EDQUOT:       "EDQUOT",
+	syscall.ENODEV:       "ENODEV",
+	syscall.EOPNOTSUPP:   "EOPNOTSUPP",
+	syscall.EADDRINUSE:   "EADDRINUSE",
+	syscall.ENETUNREACH:  "ENETUNREACH",
+	syscall.ECONNREFUSED: "ECONNREFUSED",
+	syscall.ETIMEDOUT:    "ETIMEDOUT",
+}
+
+// commandSubsystems are the subsystems failures of a command belong to unless they say
+// otherwise, containers for the rest
+var commandSubsystems = map[string]string{
+	"pull":    eventTypeImage,
+	"images":  eventTypeImage,
+	"rmi":     eventTypeImage,
+	"image":   eventTypeImage,
+	"network": eventTypeNetwork,
+}
+
+// diagnose classifies the error a command failed with
+func diagnose(err error, command string, exitCode int) errorDiagnosis {
+	d := errorDiagnosis{Error: err.Error(), Command: command, ExitCode: exitCode}
+	d.Code, d.Subsystem, d.Remediation = classifyError(err)
+	if d.Subsystem == "" {
+		d.Subsystem = eventTypeContainer
+		if s, ok := commandSubsystems[command]; ok {
+			d.Subsystem = s
+		}
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		d.Errno, d.ErrnoName = int(errno), errnoNames[errno]
+	}
+
+	var remote *shimError
+	if errors.As(err, &remote) && remote.diagnosis != nil && d.Code == "failed" {
+		d.Code, d.Subsystem, d.Remediation = remote.diagnosis.Code, remote.diagnosis.Subsystem, remote.diagnosis.Remediation
+		d.Errno, d.ErrnoName = remote.diagnosis.Errno, remote.diagnosis.ErrnoName
+	}
+
+	return d
+}
+
+// classifyError returns the code, subsystem and remediation of an error. The subsystem is
+// empty where the command decides.
+func classifyError(err error) (code, subsystem, remediation string) {
+	var status *registryStatusError
+	var download *downloadStatusError
+	var conflict *nameConflictError
+	var spec *specError
+	var digest *digestMismatchError
+	var rateLimited *rateLimitError
+	var certInvalid x509.CertificateInvalidError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var errno syscall.Errno
+
+	statusCode := 0
+	if errors.As(err, &status) {
+		statusCode = status.code
+	} else if errors.As(err, &download) {
+		statusCode = download.code
+	}
+
+	switch {
+	case errors.Is(err, errUnknownCommand):
+		return "unknown_command", subsystemCLI, "see-usage"
+	case strings.HasPrefix(err.Error(), "Usage: "), errors.Is(err, errInvalidGlobalOption):
+		return "usage", subsystemCLI, "see-usage"
+	case errors.Is(err, errNotImplemented):
+		return "not_implemented", subsystemCLI, ""
+	case errors.As(err, &spec):
+		return "invalid_definition", eventTypeContainer, "fix-definition"
+	case errors.Is(err, errContainerNotFound):
+		return "container_not_found", eventTypeContainer, "check-container"
+	case errors.As(err, &conflict):
+		return "name_conflict", eventTypeContainer, "remove-or-rename"
+	case errors.Is(err, errImageNotFound):
+		return "image_not_found", eventTypeImage, "pull-image"
+	case errors.Is(err, errImageInUse):
+		return "image_in_use", eventTypeImage, "remove-containers"
+	case errors.Is(err, errImageIncompatible):
+		return "image_incompatible", eventTypeImage, "check-image"
+	case errors.Is(err, errSetupStepFailed):
+		return "setup_step_failed", eventTypeContainer, "check-host"
+	case errors.Is(err, errHostDependencyUnavailable):
+		return "host_dependency_unavailable", subsystemHost, "start-host-service"
+	case errors.Is(err, errExecutableNotFound), errors.Is(err, errNoSuchExecutable):
+		return "command_not_found", eventTypeImage, "check-command"
+	case errors.Is(err, errNotExecutable):
+		return "command_not_executable", eventTypeImage, "check-command"
+	case errors.As(err, &digest):
+		return "digest_mismatch", eventTypeImage, "retry-later"
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return "registry_unauthorized", eventTypeImage, "login"
+	case statusCode == http.StatusNotFound:
+		return "registry_not_found", eventTypeImage, "check-image-reference"
+	case statusCode == http.StatusTooManyRequests, errors.As(err, &rateLimited):
+		return "registry_rate_limited", eventTypeImage, "retry-later"
+	case statusCode >= 500:
+		return "registry_unavailable", eventTypeImage, "retry-later"
+	case statusCode != 0:
+		return "registry_refused", eventTypeImage, ""
+	case errors.As(err, &certInvalid), errors.As(err, &unknownAuthority), errors.As(err, &hostname):
+		return "tls_certificate", eventTypeImage, "check-clock-and-ca"
+	case errors.As(err, &dnsErr), errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect"):
+		return "registry_unreachable", eventTypeImage, "check-connectivity"
+	case errors.Is(err, errDHCPTimeout), errors.Is(err, errDHCPNak), errors.Is(err, errDHCPExpired):
+		return "dhcp_failed", eventTypeNetwork, "check-dhcp-server"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout", "", "retry-later"
+	case errors.Is(err, context.Canceled):
+		return "interrupted", "", ""
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.EPERM, syscall.EACCES:
+			return "permission_denied", subsystemHost, "run-as-root"
+		case syscall.ENOSPC, syscall.EDQUOT:
+			return "no_space", subsystemHost, "free-disk-space"
+		case syscall.ENOSYS, syscall.EOPNOTSUPP, syscall.ENODEV:
+			return "unsupported_kernel", subsystemHost, "check-kernel"
+		}
+	}
+
+	return "failed", "", ""
+}
+
+// writeErrorJSON writes the diagnosis as a single line of JSON
+func writeErrorJSON(w io.Writer, d errorDiagnosis) {
+	json.NewEncoder(w).Encode(d)
+}
+
+// shimError is a failure the shim reported, diagnosed where its cause was still known
+type shimError struct {
+	message   string
+	diagnosis *errorDiagnosis
+}
+
+func (e *shimError) Error() string {
+	return e.message
+}
+
+// shimFailure is the event reporting that the shim failed with err
+func shimFailure(err error) shimEvent {
+	d := diagnose(err, "", setupExitCode(err))
+	return shimEvent{Error: err.Error(), Diagnosis: &d}
+}
+
+// err returns the failure a shim event reports
+func (ev shimEvent) err() error {
+	return &shimError{message: ev.Error, diagnosis: ev.Diagnosis}
+}
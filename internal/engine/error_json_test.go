@@ -0,0 +1,27 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClassifyCommandErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "missing", err: fmt.Errorf("/bin/app: %w", errNoSuchExecutable), want: "command_not_found"},
+		{name: "not executable", err: fmt.Errorf("/bin/app: %w", errNotExecutable), want: "command_not_executable"},
+		{name: "init failed to find it", err: &initFailure{Message: "failed to start command", ExitCode: notFoundExitCode}, want: "command_not_found"},
+		{name: "init failed to execute it", err: &initFailure{Message: "failed to start command", ExitCode: cannotExecuteExitCode}, want: "command_not_executable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _, _ := classifyError(tt.err); code != tt.want {
+				t.Errorf("classifyError() = %q, want %q", code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	hostResolvConf     = "/etc/resolv.conf"
+	resolvedResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// defaultNameservers are used when the host only has local resolvers the container can't reach
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// extraHost is an --add-host entry
+type extraHost struct {
+	name string
+	ip   string
+}
+
+// parseExtraHost parses a host:ip value. The special address host-gateway resolves to the
+// bridge gateway address.
+func parseExtraHost(value string, gateway net.IP) (extraHost, error) {
+	name, ip, ok := strings.Cut(value, ":")
+	if !ok || name == "" || ip == "" {
+		return extraHost{}, fmt.Errorf("invalid --add-host %q: expected host:ip", value)
+	}
+
+	if ip == "host-gateway" {
+		if gateway == nil {
+			return extraHost{}, fmt.Errorf("invalid --add-host %q: host-gateway requires the bridge network", value)
+		}
+		ip = gateway.String()
+	}
+
+	if net.ParseIP(ip) == nil {
+		return extraHost{}, fmt.Errorf("invalid --add-host %q: %q is not an IP address", value, ip)
+	}
+
+	return extraHost{name: name, ip: ip}, nil
+}
+
+// buildEtcFiles generates resolv.conf, hosts and hostname for the container's /etc. The init
+// writes them once the root filesystem is mounted.
+func (env *ContainerEnvironment) buildEtcFiles(opts RunOptions) (map[string]string, error) {
+	netDNS, err := networkDNSConfig(env.network.mode)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvConf, upstreams, err := buildResolvConf(env.network.mode, netDNS, opts.DNS, opts.DNSSearch)
+	if err != nil {
+		return nil, err
+	}
+	env.dnsUpstreams = upstreams
+
+	var hosts []extraHost
+	// The network's entries come first, so a container's own can override them
+	for _, h := range append(append([]string{}, netDNS.ExtraHosts...), opts.ExtraHosts...) {
+		entry, err := parseExtraHost(h, env.network.gateway)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, entry)
+	}
+
+	hostsFile, err := env.buildHosts(netDNS.hostsPolicy(env.network.mode), hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"resolv.conf": string(resolvConf),
+		"hosts":       string(hostsFile),
+		"hostname":    env.hostname + "\n",
+	}, nil
+}
+
+// useLeaseDNS regenerates resolv.conf with the nameservers and domain of a DHCP lease. They
+// take the place of the host's, so the network's static or embedded policy and the
+// container's --dns and --dns-search still win.
+func (env *ContainerEnvironment) useLeaseDNS(lease *dhcpLease) error {
+	netDNS, err := networkDNSConfig(env.network.mode)
+	if err != nil {
+		return err
+	}
+	if netDNS.policy() != DNSPolicyHost || len(lease.dns) == 0 {
+		return nil
+	}
+
+	dns, search := env.state.Config.DNS, env.state.Config.DNSSearch
+	if len(dns) == 0 {
+		for _, ip := range lease.dns {
+			dns = append(dns, ip.String())
+		}
+	}
+	if len(search) == 0 && len(netDNS.Search) == 0 && lease.domain != "" {
+		search = []string{lease.domain}
+	}
+
+	resolvConf, _, err := buildResolvConf(env.network.mode, netDNS, dns, search)
+	if err != nil {
+		return err
+	}
+	env.etcFiles["resolv.conf"] = string(resolvConf)
+
+	return nil
+}
+
+// writeEtcFiles writes the generated files into /etc of the root filesystem
+func writeEtcFiles(root string, files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	etc, err := secureJoin(root, "/etc")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return fmt.Errorf("failed to create /etc: %w", err)
+	}
+
+	for name, content := range files {
+		if err := writeEtcFile(etc, name, []byte(content)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeEtcFile replaces a file in /etc. Images often ship these as symlinks, which must be
+// replaced rather than followed.
+func writeEtcFile(etc, name string, content []byte) error {
+	path := filepath.Join(etc, name)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to replace /etc/%s: %w", name, err)
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write /etc/%s: %w", name, err)
+	}
+
+	return nil
+}
+
+// buildResolvConf generates the container's resolv.conf following the DNS policy of its
+// network. With the embedded policy it also returns the upstreams the resolver forwards to.
+// The container's --dns and --dns-search replace what the network gives it.
+func buildResolvConf(mode NetworkMode, netDNS NetworkDNSConfig, dns, dnsSearch []string) ([]byte, []string, error) {
+	for _, ns := range dns {
+		if net.ParseIP(ns) == nil {
+			return nil, nil, fmt.Errorf("invalid --dns %q: not an IP address", ns)
+		}
+	}
+
+	var nameservers, search, options, upstreams []string
+	switch netDNS.policy() {
+	case DNSPolicyStatic:
+		nameservers = netDNS.Servers
+	case DNSPolicyEmbedded:
+		upstreams = netDNS.Servers
+		if len(upstreams) == 0 {
+			// The resolver runs in the host's namespace, where even local nameservers work
+			host, err := readHostResolvConf()
+			if err != nil {
+				return nil, nil, err
+			}
+			upstreams, search, options = parseResolvConf(host)
+		}
+		if len(upstreams) == 0 {
+			upstreams = defaultNameservers
+		}
+		nameservers = []string{embeddedResolverAddress}
+	default:
+		var err error
+		if nameservers, search, options, err = hostNameservers(mode); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(netDNS.Search) > 0 {
+		search = netDNS.Search
+	}
+	if len(netDNS.Options) > 0 {
+		options = netDNS.Options
+	}
+
+	if len(dns) > 0 {
+		// Explicit servers are used directly, the resolver isn't needed
+		nameservers, upstreams = dns, nil
+	}
+	if len(nameservers) == 0 {
+		nameservers = defaultNameservers
+	}
+	if len(dnsSearch) > 0 {
+		search = dnsSearch
+	}
+
+	var buf bytes.Buffer
+	for _, ns := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ns)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(options, " "))
+	}
+
+	return buf.Bytes(), upstreams, nil
+}
+
+// readHostResolvConf returns the host's resolv.conf, which may not exist
+func readHostResolvConf() ([]byte, error) {
+	host, err := os.ReadFile(hostResolvConf)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", hostResolvConf, err)
+	}
+
+	return host, nil
+}
+
+// hostNameservers derives the settings of the host policy from the host's resolv.conf,
+// dropping nameservers that only work in the host's network namespace
+func hostNameservers(mode NetworkMode) (nameservers, search, options []string, err error) {
+	host, err := readHostResolvConf()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nameservers, search, options = parseResolvConf(host)
+
+	// A systemd-resolved stub is useless outside the host namespace, but it keeps the real
+	// upstream servers in a separate file
+	if mode != NetworkHost && onlyLocalNameservers(nameservers) {
+		if upstream, err := os.ReadFile(resolvedResolvConf); err == nil {
+			nameservers, search, options = parseResolvConf(upstream)
+		}
+	}
+
+	if mode != NetworkHost {
+		var reachable []string
+		for _, ns := range nameservers {
+			if ip := net.ParseIP(ns); ip != nil && !ip.IsLoopback() {
+				reachable = append(reachable, ns)
+			}
+		}
+		nameservers = reachable
+	}
+
+	return nameservers, search, options, nil
+}
+
+// parseResolvConf extracts nameserver, search and options entries from a resolv.conf
+func parseResolvConf(data []byte) (nameservers, search, options []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			nameservers = append(nameservers, fields[1])
+		case "search", "domain":
+			search = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+
+	return nameservers, search, options
+}
+
+// onlyLocalNameservers reports whether every nameserver is a loopback address
+func onlyLocalNameservers(nameservers []string) bool {
+	for _, ns := range nameservers {
+		if ip := net.ParseIP(ns); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+
+	return len(nameservers) > 0
+}
+
+// buildHosts generates /etc/hosts. With the host policy, the default on the host network,
+// containers see the host's entries.
+func (env *ContainerEnvironment) buildHosts(policy HostsPolicy, extra []extraHost) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if policy == HostsPolicyHost {
+		host, err := os.ReadFile("/etc/hosts")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read /etc/hosts: %w", err)
+		}
+		buf.Write(host)
+		if len(host) > 0 && host[len(host)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+		buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buf.WriteString("fe00::0\tip6-localnet\n")
+		buf.WriteString("ff00::0\tip6-mcastprefix\n")
+		buf.WriteString("ff02::1\tip6-allnodes\n")
+		buf.WriteString("ff02::2\tip6-allrouters\n")
+	}
+
+	for _, h := range extra {
+		fmt.Fprintf(&buf, "%s\t%s\n", h.ip, h.name)
+	}
+
+	switch {
+	case env.network.address != nil:
+		fmt.Fprintf(&buf, "%s\t%s\n", env.network.address.IP, env.hostname)
+	case env.network.mode != NetworkHost:
+		fmt.Fprintf(&buf, "127.0.0.1\t%s\n", env.hostname)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,469 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types, named after the subsystem publishing them
+const (
+	eventTypeImage     = "image"
+	eventTypeContainer = "container"
+	eventTypeNetwork   = "network"
+)
+
+// Event actions. Progress events describe an operation that is still going on and aren't
+// recorded in the events log.
+const (
+	eventActionProgress = "progress"
+	eventActionPull     = "pull"
+	eventActionCreate   = "create"
+	eventActionStart    = "start"
+	eventActionKill     = "kill"
+	eventActionDie      = "die"
+	eventActionOOM      = "oom"
+	eventActionStop     = "stop"
+	eventActionRestart  = "restart"
+	eventActionUpdate   = "update"
+	eventActionRename   = "rename"
+	eventActionDestroy  = "destroy"
+)
+
+// Event levels. Warnings and errors are problems worth telling the user about that don't
+// fail the command, debug events show what a command is doing step by step.
+const (
+	eventLevelDebug   = "debug"
+	eventLevelInfo    = "info"
+	eventLevelWarning = "warning"
+	eventLevelError   = "error"
+)
+
+// eventsLogPath is where lifecycle events of all commands are appended as JSON lines
+var eventsLogPath = filepath.Join(containerStateDir, "events.log")
+
+// Event is something a subsystem reports to whoever is listening
+type Event struct {
+	Time       time.Time         `json:"time"`
+	Type       string            `json:"type"`
+	Action     string            `json:"action"`
+	Level      string            `json:"level"`
+	ID         string            `json:"id,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Progress   *EventProgress    `json:"progress,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Source is the file and line that published a warning or error
+	Source string `json:"source,omitempty"`
+}
+
+// EventProgress is how far along a transfer is
+type EventProgress struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// EventSink receives every event published on a bus. Handle is called synchronously and
+// one event at a time, so sinks don't need locking of their own.
+type EventSink interface {
+	Handle(ev Event)
+}
+
+// EventBus fans events out to the sinks subscribed to it
+type EventBus struct {
+	mu    sync.Mutex
+	sinks []EventSink
+}
+
+// bus is what every subsystem publishes to. main subscribes the sinks the command needs.
+var bus = NewEventBus()
+
+// NewEventBus returns a bus delivering to sinks
+func NewEventBus(sinks ...EventSink) *EventBus {
+	return &EventBus{sinks: sinks}
+}
+
+// Subscribe adds a sink and returns a function that removes it again
+func (b *EventBus) Subscribe(sink EventSink) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sinks = append(b.sinks, sink)
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, s := range b.sinks {
+			if s == sink {
+				b.sinks = append(b.sinks[:i:i], b.sinks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers an event to every sink
+func (b *EventBus) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	if ev.Level == "" {
+		ev.Level = eventLevelInfo
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sink := range b.sinks {
+		sink.Handle(ev)
+	}
+}
+
+// warnf publishes a warning about the subsystem typ
+func warnf(typ, format string, args ...any) {
+	bus.Publish(Event{Type: typ, Action: eventLevelWarning, Level: eventLevelWarning, Message: fmt.Sprintf(format, args...), Source: caller()})
+}
+
+// errorf publishes an error that doesn't fail the command, e.g. one of several operations
+func errorf(typ, format string, args ...any) {
+	bus.Publish(Event{Type: typ, Action: eventLevelError, Level: eventLevelError, Message: fmt.Sprintf(format, args...), Source: caller()})
+}
+
+// debugf publishes what a subsystem is doing, with attrs as alternating keys and values. It
+// is skipped unless --debug or --log-level debug asked for it.
+func debugf(typ, msg string, attrs ...any) {
+	if logLevel.Level() > slog.LevelDebug {
+		return
+	}
+
+	ev := Event{Type: typ, Action: eventLevelDebug, Level: eventLevelDebug, Message: msg, Source: caller()}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if ev.Attributes == nil {
+			ev.Attributes = map[string]string{}
+		}
+		ev.Attributes[fmt.Sprint(attrs[i])] = fmt.Sprint(attrs[i+1])
+	}
+	bus.Publish(ev)
+}
+
+// caller returns the file and line that called debugf, warnf or errorf
+func caller() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+}
+
+// containerEvent publishes a lifecycle event of a container
+func containerEvent(action, id string, attributes map[string]string) {
+	bus.Publish(Event{Type: eventTypeContainer, Action: action, ID: id, Attributes: attributes})
+}
+
+// jsonStreamSink writes every event as a line of JSON, for scripts that follow a command
+type jsonStreamSink struct {
+	enc *json.Encoder
+}
+
+func newJSONStreamSink(out io.Writer) *jsonStreamSink {
+	return &jsonStreamSink{enc: json.NewEncoder(out)}
+}
+
+func (s *jsonStreamSink) Handle(ev Event) {
+	s.enc.Encode(ev)
+}
+
+// eventLogSink appends lifecycle events to a file shared by all commands. Warnings and
+// progress are left out, they only matter to whoever is watching the command.
+type eventLogSink struct {
+	path string
+}
+
+func newEventLogSink(path string) *eventLogSink {
+	return &eventLogSink{path: path}
+}
+
+func (s *eventLogSink) Handle(ev Event) {
+	if ev.Level != eventLevelInfo || ev.Action == eventActionProgress {
+		return
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return
+	}
+
+	// Appends of a single line don't interleave between processes
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
+
+// eventFilterKeys are the keys events --filter accepts, event being Docker's name for the action
+var eventFilterKeys = []string{"type", "event", "container", "image"}
+
+// eventFilters are the values given per --filter key. Like Docker, an event has to match one
+// value of every key.
+type eventFilters map[string][]string
+
+// parseEventFilters parses --filter values of the form key=value
+func parseEventFilters(values []string) (eventFilters, error) {
+	filters := eventFilters{}
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid --filter %q: expected key=value", value)
+		}
+		if !containsString(eventFilterKeys, key) {
+			return nil, fmt.Errorf("invalid --filter %q: unknown key %q, expected one of %s", value, key, strings.Join(eventFilterKeys, ", "))
+		}
+		// A container still around is matched by every way to refer to it
+		if key == "container" {
+			if id, err := resolveContainer(v); err == nil {
+				v = id
+			}
+		}
+		filters[key] = append(filters[key], v)
+	}
+
+	return filters, nil
+}
+
+// match reports whether an event passes the filters
+func (f eventFilters) match(ev Event) bool {
+	for key, values := range f {
+		matched := false
+		for _, v := range values {
+			switch key {
+			case "type":
+				matched = ev.Type == v
+			case "event":
+				matched = ev.Action == v
+			case "container":
+				matched = ev.Type == eventTypeContainer && (strings.HasPrefix(ev.ID, v) || ev.Attributes["name"] == v)
+			case "image":
+				matched = ev.Attributes["image"] == v || (ev.Type == eventTypeImage && ev.ID == v)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// eventsOptions are the flags of events
+type eventsOptions struct {
+	since, until time.Time
+	filters      eventFilters
+	json         bool
+}
+
+// printEvents writes the events recorded in the events log since opts.since. Like docker
+// events, it keeps printing new ones until ctx is done, unless opts.until ends the stream.
+func printEvents(ctx context.Context, opts eventsOptions, out io.Writer) error {
+	show := func(ev Event) bool {
+		if !opts.until.IsZero() && ev.Time.After(opts.until) {
+			return false
+		}
+		if ev.Time.Before(opts.since) || !opts.filters.match(ev) {
+			return true
+		}
+
+		if opts.json {
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(out, "%s\n", data)
+		} else {
+			fmt.Fprintln(out, formatEvent(ev))
+		}
+		return true
+	}
+
+	// Without --since, only the events from now on are printed
+	var r *bufio.Reader
+	if f, err := os.Open(eventsLogPath); err == nil {
+		defer f.Close()
+		if opts.since.IsZero() {
+			if _, err := f.Seek(0, io.SeekEnd); err != nil {
+				return fmt.Errorf("failed to read events log: %w", err)
+			}
+		}
+		r = bufio.NewReader(f)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to open events log: %w", err)
+	}
+
+	var partial []byte
+	for {
+		if r == nil {
+			// The first event of the host creates the log
+			if f, err := os.Open(eventsLogPath); err == nil {
+				defer f.Close()
+				r = bufio.NewReader(f)
+			}
+		}
+		if r != nil {
+			var more bool
+			var err error
+			if partial, more, err = readEvents(r, partial, show); err != nil || !more {
+				return err
+			}
+		}
+		if !opts.until.IsZero() && time.Now().After(opts.until) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logFollowInterval):
+		}
+	}
+}
+
+// readEvents calls fn for every event up to the end of the events log, until fn returns false.
+// A line that is still being written is returned, to be completed by the next call. Lines
+// that aren't events are skipped, as the log may be written by older or newer versions.
+func readEvents(r *bufio.Reader, partial []byte, fn func(Event) bool) ([]byte, bool, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		partial = append(partial, line...)
+		if errors.Is(err, io.EOF) {
+			return partial, true, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read events log: %w", err)
+		}
+
+		var ev Event
+		err = json.Unmarshal(partial, &ev)
+		partial = nil
+		if err == nil && !fn(ev) {
+			return nil, false, nil
+		}
+	}
+}
+
+// formatEvent describes an event on one line like docker events, with the attributes sorted
+func formatEvent(ev Event) string {
+	line := fmt.Sprintf("%s %s %s", ev.Time.Format(time.RFC3339Nano), ev.Type, ev.Action)
+	if ev.ID != "" {
+		line += " " + ev.ID
+	}
+
+	if len(ev.Attributes) > 0 {
+		keys := make([]string, 0, len(ev.Attributes))
+		for k := range ev.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		attrs := make([]string, len(keys))
+		for i, k := range keys {
+			attrs[i] = k + "=" + ev.Attributes[k]
+		}
+		line += " (" + strings.Join(attrs, ", ") + ")"
+	}
+
+	return line
+}
+
+// progressRenderer prints image events the way the Docker CLI shows a pull. Terminals get a
+// progress bar per layer that is redrawn in place; other outputs only see the final status
+// of each layer to keep logs readable.
+type progressRenderer struct {
+	out io.Writer
+	tty bool
+	// drawing is the layer whose progress line is on screen
+	drawing string
+	last    time.Time
+}
+
+// progressBarWidth is the width of the bar between the brackets, as in the Docker CLI
+const progressBarWidth = 50
+
+func newProgressRenderer(out io.Writer) *progressRenderer {
+	f, ok := out.(*os.File)
+	return &progressRenderer{out: out, tty: ok && isTerminal(f)}
+}
+
+func (r *progressRenderer) Handle(ev Event) {
+	if ev.Type != eventTypeImage || ev.Level != eventLevelInfo {
+		return
+	}
+
+	if ev.Progress != nil {
+		if !r.tty || (r.drawing == ev.ID && time.Since(r.last) < 100*time.Millisecond) {
+			return
+		}
+		r.last = time.Now()
+		r.drawing = ev.ID
+		fmt.Fprintf(r.out, "\r%s: %s %s %s/%s\x1b[K", ev.ID, ev.Message, progressBar(*ev.Progress), formatSize(ev.Progress.Current), formatSize(ev.Progress.Total))
+		return
+	}
+
+	line := ev.Message
+	if ev.ID != "" && ev.Action == eventActionProgress {
+		line = ev.ID + ": " + line
+	}
+
+	// A final status replaces the progress line
+	if r.drawing != "" {
+		fmt.Fprint(r.out, "\r")
+		line += "\x1b[K"
+		r.drawing = ""
+	}
+	fmt.Fprintln(r.out, line)
+}
+
+// finish clears a progress line that no final status replaced, so whatever is printed next
+// starts on a clean line
+func (r *progressRenderer) finish() {
+	if r.drawing != "" {
+		fmt.Fprint(r.out, "\r\x1b[K")
+		r.drawing = ""
+	}
+}
+
+// progressBar draws how far along a transfer is like [=====>    ]. Transfers of unknown size
+// get an empty bar.
+func progressBar(p EventProgress) string {
+	filled := 0
+	if p.Total > 0 {
+		filled = int(min(p.Current, p.Total) * progressBarWidth / p.Total)
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		if filled > 0 {
+			bar = bar[:filled-1] + ">"
+		}
+		bar += strings.Repeat(" ", progressBarWidth-filled)
+	}
+
+	return "[" + bar + "]"
+}
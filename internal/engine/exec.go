@@ -0,0 +1,476 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// execInitArg is the hidden subcommand that enters a running container and execs the command
+// given to exec, like the container init does for the container's command
+const execInitArg = "exec-init"
+
+// execInitConfigFd is the file descriptor the exec init reads its configuration from
+const execInitConfigFd = 3
+
+// Event actions of processes started in a running container
+const (
+	eventActionExecStart = "exec_start"
+	eventActionExecDie   = "exec_die"
+)
+
+// clone flag of cgroup namespaces, which the syscall package doesn't define
+const cloneNewCgroup = 0x02000000
+
+// execNamespace is a namespace of the container that exec joins
+type execNamespace struct {
+	name string
+	flag int
+}
+
+// execNamespaces are joined by the exec init in this order. The mount namespace comes last,
+// since joining it leaves the host's /proc behind. The PID namespace only applies to
+// children, so the exec init is started in it instead.
+var execNamespaces = []execNamespace{
+	{"ipc", syscall.CLONE_NEWIPC},
+	{"uts", syscall.CLONE_NEWUTS},
+	{"net", syscall.CLONE_NEWNET},
+	{"cgroup", cloneNewCgroup},
+	{"mnt", syscall.CLONE_NEWNS},
+}
+
+// ExecOptions describe a process to run in a running container
+type ExecOptions struct {
+	Command string
+	Args    []string
+	Env     []string
+	// User overrides the container's user
+	User        string
+	TTY         bool
+	Interactive bool
+}
+
+// execInitConfig is sent to the exec init once it is in the container's cgroup
+type execInitConfig struct {
+	Pid     int                  `json:"pid"`
+	Command string               `json:"command"`
+	Args    []string             `json:"args"`
+	Env     []string             `json:"env"`
+	Seccomp []syscall.SockFilter `json:"seccomp,omitempty"`
+	UserNS  bool                 `json:"userns,omitempty"`
+	Rlimits []Rlimit             `json:"rlimits,omitempty"`
+	User    string               `json:"user,omitempty"`
+	// WorkingDir is the container's, where the command starts
+	WorkingDir string `json:"workingDir,omitempty"`
+	// SetHome makes the user's home HOME, unless the container or the exec set it
+	SetHome bool `json:"setHome,omitempty"`
+	// Capabilities are those the command keeps, those of the container
+	Capabilities capabilitySet `json:"capabilities"`
+}
+
+// execInContainer runs a process in the namespaces of a running container, confined like its
+// init, and returns its exit code once it exits
+func execInContainer(id string, opts ExecOptions) (int, error) {
+	if opts.TTY && opts.Interactive && !isTerminal(os.Stdin) {
+		return 0, errors.New("the input device is not a TTY")
+	}
+	for _, e := range opts.Env {
+		if err := validateEnv(e); err != nil {
+			return 0, err
+		}
+	}
+	if opts.User != "" {
+		if err := validateUser(opts.User); err != nil {
+			return 0, err
+		}
+	}
+
+	env, err := loadContainerEnvironment(id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Holding the pidfd keeps the init's pid from being reused while we enter the container
+	pidfd, err := openContainerPidfd(env.state)
+	if err != nil {
+		return 0, err
+	}
+	defer pidfd.Close()
+
+	environ, err := processEnv(env.state.Pid)
+	if err != nil {
+		return 0, err
+	}
+	// Containers started before their init was given the container's environment have the
+	// host's in it, which the container's own has to win over
+	environ = mergeEnv(environ, env.env)
+
+	var stdio [3]*os.File
+	var pty *os.File
+	if opts.TTY {
+		var slave *os.File
+		if pty, slave, err = openPty(); err != nil {
+			return 0, fmt.Errorf("failed to allocate a terminal: %w", err)
+		}
+		defer pty.Close()
+		stdio = [3]*os.File{slave, slave, slave}
+	} else {
+		stdio = [3]*os.File{nil, os.Stdout, os.Stderr}
+		if opts.Interactive {
+			stdio[0] = os.Stdin
+		}
+	}
+
+	cmd, err := env.startExecInit(opts, mergeEnv(environ, opts.Env), stdio)
+	// Only the process holds the terminal from now on, so reads fail once it is gone
+	if pty != nil {
+		stdio[0].Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	containerEvent(eventActionExecStart, id, map[string]string{"command": strings.Join(append([]string{opts.Command}, opts.Args...), " ")})
+
+	if pty != nil {
+		defer setupTerminal(pty, opts.Interactive)()
+
+		outputDone := make(chan struct{})
+		go func() {
+			io.Copy(os.Stdout, pty)
+			close(outputDone)
+		}()
+		if opts.Interactive {
+			go io.Copy(pty, os.Stdin)
+		}
+		<-outputDone
+	} else {
+		stop := proxySignals(cmd.Process.Pid)
+		defer stop()
+	}
+
+	exitCode, err := exitCodeOf(cmd.Wait())
+	if err != nil {
+		return 0, err
+	}
+	containerEvent(eventActionExecDie, id, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+
+	return exitCode, nil
+}
+
+// startExecInit starts the exec init in the container's PID namespace and cgroup and sends it
+// its configuration. Like the container init, it blocks on the configuration until it is
+// confined.
+func (env *ContainerEnvironment) startExecInit(opts ExecOptions, environ []string, stdio [3]*os.File) (*exec.Cmd, error) {
+	configR, configW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config pipe: %w", err)
+	}
+	defer configW.Close()
+
+	failuresR, failuresW, err := os.Pipe()
+	if err != nil {
+		configR.Close()
+		return nil, fmt.Errorf("failed to create exec pipe: %w", err)
+	}
+	defer failuresR.Close()
+
+	cmd := exec.Command("/proc/self/exe", execInitArg)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdio[0], stdio[1], stdio[2]
+	cmd.ExtraFiles = []*os.File{configR, failuresW}
+	// Like the init of a container with a terminal, the process gets its own session
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: opts.TTY, Setctty: opts.TTY}
+
+	err = startInPidNamespace(cmd, env.state.Pid)
+	configR.Close()
+	failuresW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (*exec.Cmd, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	if env.state.Cgroup != "" {
+		cg := &containerCgroup{path: env.state.Cgroup}
+		if err := cg.addProcess(cmd.Process.Pid); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Like Docker, exec runs as the container's user unless told otherwise
+	user := env.user
+	if opts.User != "" {
+		user = opts.User
+	}
+
+	config := execInitConfig{
+		Pid:     env.state.Pid,
+		Command: opts.Command,
+		Args:    opts.Args,
+		Env:     environ,
+		Seccomp: env.seccomp,
+		UserNS:  env.userns,
+		Rlimits: env.rlimits,
+		User:    user,
+		SetHome: user != "" && !hasEnv(env.env, "HOME") && !hasEnv(opts.Env, "HOME"),
+
+		Capabilities: env.capabilities,
+		WorkingDir:   env.workingDir,
+	}
+	if err := json.NewEncoder(configW).Encode(config); err != nil {
+		return fail(fmt.Errorf("failed to send exec configuration: %w", err))
+	}
+	if err := awaitCommandStart(failuresR); err != nil {
+		cmd.Wait()
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// startInPidNamespace starts cmd in the PID namespace of pid. Joining it only affects the
+// children of the calling thread, so that is done from a locked thread that is terminated
+// afterwards instead of being reused by the rest of the program.
+func startInPidNamespace(cmd *exec.Cmd, pid int) error {
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return fmt.Errorf("failed to open pid namespace of container: %w", err)
+	}
+	defer ns.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		// Never unlocked, the thread is left in the container's namespace
+		runtime.LockOSThread()
+
+		if err := joinNamespace(ns, syscall.CLONE_NEWPID); err != nil {
+			done <- err
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			done <- fmt.Errorf("failed to start exec init: %w", err)
+			return
+		}
+		done <- nil
+	}()
+
+	return <-done
+}
+
+// joinNamespace moves the calling thread into the namespace behind f
+func joinNamespace(f *os.File, flag int) error {
+	// The syscall package doesn't define SYS_SETNS everywhere, but the seccomp tables do
+	nr, ok := seccompSyscallNumbers["setns"]
+	if !ok {
+		return errors.New("joining a namespace is not supported on this architecture")
+	}
+
+	if _, _, errno := syscall.RawSyscall(uintptr(nr), f.Fd(), uintptr(flag), 0); errno != 0 {
+		return fmt.Errorf("failed to join namespace %s: %w", f.Name(), errno)
+	}
+
+	return nil
+}
+
+// runExecInit is the entrypoint of the exec init, which the runtime starts in the container's
+// PID namespace and cgroup. It joins the other namespaces and the root of the container's
+// init, confines itself like the init and execs the command. It only returns on failure.
+func runExecInit() {
+	// Namespaces joined with setns only apply to the calling thread, which must be the one
+	// that finally execs the command
+	runtime.LockOSThread()
+	openInitFailures()
+
+	configFile := os.NewFile(execInitConfigFd, "exec-config")
+	var cfg execInitConfig
+	if err := json.NewDecoder(configFile).Decode(&cfg); err != nil {
+		initFatalf(setupFailedExitCode, "failed to read exec configuration: %v", err)
+	}
+	configFile.Close()
+
+	if err := cfg.enter(); err != nil {
+		initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+	}
+
+	if err := applyRlimits(cfg.Rlimits); err != nil {
+		initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+	}
+
+	cred, err := cfg.credential()
+	if err != nil {
+		initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+	}
+	if !hasEnv(cfg.Env, "HOME") {
+		cfg.Env = append(cfg.Env, "HOME=/root")
+	}
+	if err := restrictCapabilities(cfg.Capabilities); err != nil {
+		initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+	}
+	if cred != nil {
+		if err := switchCredential(cred); err != nil {
+			initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+		}
+	}
+
+	path, err := lookPathInRoot("/", cfg.Command, containerPath(cfg.Env))
+	if err != nil {
+		initFatalf(commandExitCode(err), "failed to start command: %v", err)
+	}
+
+	// Install the seccomp filter last so the setup above isn't subject to it
+	if cfg.Seccomp != nil {
+		if err := installSeccompFilter(cfg.Seccomp); err != nil {
+			initFatalf(setupFailedExitCode, "failed to enter container: %v", err)
+		}
+	}
+
+	argv := append([]string{cfg.Command}, cfg.Args...)
+	if err := syscall.Exec(path, argv, cfg.Env); err != nil {
+		initFatalf(commandExitCode(err), "failed to start command: %v", err)
+	}
+}
+
+// enter joins the namespaces of the container's init and changes into its root
+func (cfg *execInitConfig) enter() error {
+	// Everything is opened through the host's /proc before the mount namespace changes
+	var joins []execNamespace
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, ns := range execNamespaces {
+		path := fmt.Sprintf("/proc/%d/ns/%s", cfg.Pid, ns.name)
+		theirs, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s namespace: %w", ns.name, err)
+		}
+		// Containers on the host network share our network namespace, for one
+		if ours, err := os.Readlink("/proc/self/ns/" + ns.name); err == nil && ours == theirs {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s namespace: %w", ns.name, err)
+		}
+		files = append(files, f)
+		joins = append(joins, ns)
+	}
+
+	root, err := os.Open(fmt.Sprintf("/proc/%d/root", cfg.Pid))
+	if err != nil {
+		return fmt.Errorf("failed to open container root: %w", err)
+	}
+	defer root.Close()
+
+	// Threads share their root and working directory, which keeps them from changing mount
+	// namespace
+	if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+		return fmt.Errorf("failed to unshare filesystem attributes: %w", err)
+	}
+
+	for i, ns := range joins {
+		if err := joinNamespace(files[i], ns.flag); err != nil {
+			return err
+		}
+	}
+
+	// The init chrooted into the container's filesystem within its mount namespace
+	if err := syscall.Fchdir(int(root.Fd())); err != nil {
+		return fmt.Errorf("failed to change into container root: %w", err)
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return fmt.Errorf("chroot failed: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir failed: %w", err)
+	}
+
+	return enterWorkingDir(cfg.WorkingDir)
+}
+
+// credential resolves the user the command runs as in the container's root, nil to stay root
+func (cfg *execInitConfig) credential() (*syscall.Credential, error) {
+	// A multithreaded process can't join a user namespace. Running as the host user the
+	// container's user maps to gives the same file access, without privileges.
+	var offset uint32
+	if cfg.UserNS {
+		offset = userNamespaceHostID
+	}
+
+	if cfg.User == "" {
+		if cfg.UserNS {
+			return &syscall.Credential{Uid: offset, Gid: offset}, nil
+		}
+		return nil, nil
+	}
+
+	u, err := resolveUser(cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserNS {
+		if err := u.mapped(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SetHome {
+		cfg.Env = mergeEnv(cfg.Env, []string{"HOME=" + u.home})
+	}
+
+	return u.credential(offset), nil
+}
+
+// processEnv returns the environment a process was started with
+func processEnv(pid int) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment of container: %w", err)
+	}
+
+	var environ []string
+	for _, e := range bytes.Split(data, []byte{0}) {
+		if len(e) > 0 {
+			environ = append(environ, string(e))
+		}
+	}
+
+	return environ, nil
+}
+
+// mergeEnv returns environ with the entries of overrides replacing those of the same name
+func mergeEnv(environ, overrides []string) []string {
+	merged := make([]string, 0, len(environ)+len(overrides))
+	for _, e := range environ {
+		name, _, _ := strings.Cut(e, "=")
+		replaced := false
+		for _, o := range overrides {
+			if strings.HasPrefix(o, name+"=") {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, e)
+		}
+	}
+
+	return append(merged, overrides...)
+}
@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of healthcheck tests, the first element of HealthConfig.Test as in Docker's image config
+const (
+	healthTestNone     = "NONE"
+	healthTestCmd      = "CMD"
+	healthTestCmdShell = "CMD-SHELL"
+)
+
+// Health statuses of a container with a healthcheck
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// Docker's defaults for what a healthcheck leaves unset
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+const (
+	// healthLogSize is how many of the latest probes are kept, like Docker
+	healthLogSize = 5
+	// healthOutputLimit is how much of a probe's output is kept
+	healthOutputLimit = 4096
+	// healthOutputGrace is how long the output of a probe is read after it exits, in case
+	// something it started still holds the pipe
+	healthOutputGrace = 100 * time.Millisecond
+)
+
+// eventActionHealthStatus is published when the health status of a container changes
+const eventActionHealthStatus = "health_status"
+
+// HealthConfig is how a container's health is probed. It has the field names of the
+// Healthcheck in Docker's image config, which durations are nanoseconds in as well.
+type HealthConfig struct {
+	// Test is NONE, CMD followed by the command, or CMD-SHELL followed by a command line
+	// for /bin/sh -c
+	Test        []string      `json:"Test,omitempty"`
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// healthState is how healthy a running container is
+type healthState struct {
+	Status string `json:"status"`
+	// FailingStreak is the number of consecutive probes that failed
+	FailingStreak int           `json:"failingStreak"`
+	Log           []healthProbe `json:"log,omitempty"`
+}
+
+// healthProbe is the outcome of running the healthcheck once
+type healthProbe struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	Output   string    `json:"output"`
+}
+
+// disabled reports whether there is no healthcheck to run
+func (h *HealthConfig) disabled() bool {
+	return h == nil || len(h.Test) == 0 || h.Test[0] == healthTestNone
+}
+
+// withDefaults returns the healthcheck with Docker's defaults for what it leaves unset
+func (h HealthConfig) withDefaults() HealthConfig {
+	if h.Interval == 0 {
+		h.Interval = defaultHealthInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHealthTimeout
+	}
+	if h.Retries == 0 {
+		h.Retries = defaultHealthRetries
+	}
+
+	return h
+}
+
+// command returns the command line that probes the container
+func (h *HealthConfig) command() (string, []string) {
+	if h.Test[0] == healthTestCmdShell {
+		return "/bin/sh", []string{"-c", strings.Join(h.Test[1:], " ")}
+	}
+
+	return h.Test[1], h.Test[2:]
+}
+
+// validateHealthConfig checks that a healthcheck can be run
+func validateHealthConfig(h *HealthConfig) error {
+	if h == nil {
+		return nil
+	}
+
+	if len(h.Test) > 0 {
+		switch h.Test[0] {
+		case healthTestNone:
+		case healthTestCmd, healthTestCmdShell:
+			if len(h.Test) < 2 || h.Test[1] == "" {
+				return fmt.Errorf("invalid healthcheck: %s needs a command", h.Test[0])
+			}
+		default:
+			return fmt.Errorf("invalid healthcheck test %q: expected NONE, CMD or CMD-SHELL", h.Test[0])
+		}
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 {
+		return errors.New("invalid healthcheck: durations must not be negative")
+	}
+	if h.Retries < 0 {
+		return errors.New("invalid healthcheck: retries must not be negative")
+	}
+
+	return nil
+}
+
+// mergeHealthConfig returns the image's healthcheck with what the container's options set
+// replacing it, like Docker lets --health-interval change the interval of the image's test
+func mergeHealthConfig(image, container *HealthConfig) *HealthConfig {
+	if container == nil {
+		return image
+	}
+
+	merged := *container
+	if image != nil {
+		if len(merged.Test) == 0 {
+			merged.Test = image.Test
+		}
+		if merged.Interval == 0 {
+			merged.Interval = image.Interval
+		}
+		if merged.Timeout == 0 {
+			merged.Timeout = image.Timeout
+		}
+		if merged.StartPeriod == 0 {
+			merged.StartPeriod = image.StartPeriod
+		}
+		if merged.Retries == 0 {
+			merged.Retries = image.Retries
+		}
+	}
+	if merged.disabled() {
+		return &HealthConfig{Test: []string{healthTestNone}}
+	}
+
+	return &merged
+}
+
+// summary describes the health the way docker ps appends it to the status of a container
+func (h *healthState) summary() string {
+	if h.Status == healthStarting {
+		return "health: " + h.Status
+	}
+
+	return h.Status
+}
+
+// monitorHealth runs the container's healthcheck every interval while it runs and records
+// the outcome in its state. It returns a function that stops probing, once a probe in
+// progress is done.
+func (env *ContainerEnvironment) monitorHealth() func() {
+	if env.state.Config.Healthcheck.disabled() {
+		return func() {}
+	}
+	hc := env.state.Config.Healthcheck.withDefaults()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		timer := time.NewTimer(hc.Interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-done:
+				return
+			}
+
+			probe := env.probeHealth(hc)
+			if err := env.recordHealth(hc, probe); err != nil {
+				warnf(eventTypeContainer, "failed to record health of %s: %v", shortID(env.id), err)
+			}
+			timer.Reset(hc.Interval)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// probeHealth runs the healthcheck in the container the way exec runs a command, and kills it
+// once it has been running for longer than its timeout. As the parent of the container's init,
+// the shim doesn't need a pidfd to keep its pid from being reused.
+func (env *ContainerEnvironment) probeHealth(hc HealthConfig) healthProbe {
+	probe := healthProbe{Start: time.Now().UTC()}
+	finish := func(code int, output string) healthProbe {
+		probe.End = time.Now().UTC()
+		probe.ExitCode = code
+		probe.Output = output
+		return probe
+	}
+
+	environ, err := processEnv(env.state.Pid)
+	if err != nil {
+		return finish(-1, err.Error())
+	}
+
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return finish(-1, fmt.Sprintf("failed to create output pipe: %v", err))
+	}
+	defer outR.Close()
+
+	command, args := hc.command()
+	cmd, err := env.startExecInit(ExecOptions{Command: command, Args: args}, mergeEnv(environ, env.env), [3]*os.File{nil, outW, outW})
+	outW.Close()
+	if err != nil {
+		return finish(-1, err.Error())
+	}
+
+	output := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(io.LimitReader(outR, healthOutputLimit))
+		io.Copy(io.Discard, outR)
+		output <- string(data)
+	}()
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(hc.Timeout, func() {
+		timedOut.Store(true)
+		cmd.Process.Kill()
+	})
+	exitCode, err := exitCodeOf(cmd.Wait())
+	timer.Stop()
+
+	outR.SetReadDeadline(time.Now().Add(healthOutputGrace))
+	out := <-output
+	switch {
+	case timedOut.Load():
+		return finish(-1, fmt.Sprintf("Health check exceeded timeout (%s)", hc.Timeout))
+	case err != nil:
+		return finish(-1, err.Error())
+	}
+
+	return finish(exitCode, out)
+}
+
+// recordHealth adds a probe to the health of a container that still runs as we started it.
+// A failure makes it unhealthy after retries of them in a row, not counting those during its
+// start period while it hasn't been healthy yet.
+func (env *ContainerEnvironment) recordHealth(hc HealthConfig, probe healthProbe) error {
+	lock, err := lockState(env.id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(env.id)
+	if err != nil {
+		return err
+	}
+	if state.Status != statusRunning || state.Pid != env.state.Pid {
+		return nil
+	}
+
+	if state.Health == nil {
+		state.Health = &healthState{Status: healthStarting}
+	}
+	health := state.Health
+	previous := health.Status
+
+	health.Log = append(health.Log, probe)
+	if len(health.Log) > healthLogSize {
+		health.Log = health.Log[len(health.Log)-healthLogSize:]
+	}
+
+	switch {
+	case probe.ExitCode == 0:
+		health.Status = healthHealthy
+		health.FailingStreak = 0
+	case health.Status == healthStarting && probe.Start.Sub(state.Started) < hc.StartPeriod:
+	default:
+		health.FailingStreak++
+		if health.FailingStreak >= hc.Retries {
+			health.Status = healthUnhealthy
+		}
+	}
+
+	if err := state.save(); err != nil {
+		return err
+	}
+	if health.Status != previous {
+		containerEvent(eventActionHealthStatus, env.id, map[string]string{"status": health.Status, "exitCode": strconv.Itoa(probe.ExitCode)})
+	}
+
+	return nil
+}
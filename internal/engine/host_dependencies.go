@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of host dependencies
+const (
+	hostDependencyPort   = "port"
+	hostDependencySocket = "socket"
+	hostDependencyMount  = "mount"
+)
+
+// defaultRequireTimeout is how long starting a container waits for its host dependencies
+const defaultRequireTimeout = 60 * time.Second
+
+// hostDependencyPollInterval is how often a missing host dependency is checked again
+const hostDependencyPollInterval = 250 * time.Millisecond
+
+// errHostDependencyUnavailable is returned when a host dependency isn't there in time
+var errHostDependencyUnavailable = errors.New("host dependency unavailable")
+
+// HostDependency is something on the host a container's command needs, such as a database
+// running outside of containers, which starting the container waits for
+type HostDependency struct {
+	// Kind is port, socket or mount
+	Kind string `json:"kind"`
+	// Target is the host:port that must accept connections, the unix socket that must, or
+	// the directory something must be mounted on
+	Target string `json:"target"`
+}
+
+func (d HostDependency) String() string {
+	switch d.Kind {
+	case hostDependencyPort:
+		return "host port " + d.Target
+	case hostDependencySocket:
+		return "socket " + d.Target
+	default:
+		return "mount " + d.Target
+	}
+}
+
+// ParseHostPortDependency parses the [host:]port of --require-host-port, localhost if no host
+// is given
+func ParseHostPortDependency(s string) (HostDependency, error) {
+	host, port := "127.0.0.1", s
+	if strings.Contains(s, ":") {
+		var err error
+		if host, port, err = net.SplitHostPort(s); err != nil {
+			return HostDependency{}, fmt.Errorf("invalid host port %q: expected [host:]port", s)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return HostDependency{}, fmt.Errorf("invalid host port %q: expected [host:]port with a port from 1 to 65535", s)
+	}
+	if host == "" {
+		return HostDependency{}, fmt.Errorf("invalid host port %q: expected [host:]port", s)
+	}
+
+	return HostDependency{Kind: hostDependencyPort, Target: net.JoinHostPort(host, port)}, nil
+}
+
+// ParsePathDependency parses the path of --require-socket or --require-mount, made absolute
+// because the container may be started from another directory
+func ParsePathDependency(kind, path string) (HostDependency, error) {
+	if path == "" {
+		return HostDependency{}, fmt.Errorf("invalid --require-%s: the path must not be empty", kind)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return HostDependency{}, err
+	}
+
+	return HostDependency{Kind: kind, Target: abs}, nil
+}
+
+// check returns why the dependency isn't there yet, nil once it is
+func (d HostDependency) check() error {
+	switch d.Kind {
+	case hostDependencyPort, hostDependencySocket:
+		network := "tcp"
+		if d.Kind == hostDependencySocket {
+			network = "unix"
+		}
+		// A connection, rather than the socket file, tells that something is listening
+		conn, err := net.DialTimeout(network, d.Target, time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case hostDependencyMount:
+		path, err := filepath.EvalSymlinks(d.Target)
+		if err != nil {
+			return err
+		}
+		mounts, err := readMountPoints("/proc/self/mountinfo")
+		if err != nil {
+			return err
+		}
+		for _, m := range mounts {
+			if m == path {
+				return nil
+			}
+		}
+		return fmt.Errorf("nothing is mounted on %s", path)
+	default:
+		return fmt.Errorf("unknown kind of host dependency %q", d.Kind)
+	}
+}
+
+// waitForHostDependencies waits until every dependency is there, failing once timeout has
+// passed with one still missing
+func waitForHostDependencies(deps []HostDependency, timeout time.Duration) error {
+	if len(deps) == 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultRequireTimeout
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, d := range deps {
+		waiting := false
+		for {
+			err := d.check()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: %s, waited %s: %w", errHostDependencyUnavailable, d, timeout, err)
+			}
+			if !waiting {
+				debugf(eventTypeContainer, "waiting for a host dependency", "dependency", d, "error", err)
+				waiting = true
+			}
+			time.Sleep(hostDependencyPollInterval)
+		}
+		debugf(eventTypeContainer, "host dependency available", "dependency", d)
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// identityTokenTarget is the directory of a container's identity token inside it. The
+// directory rather than the file is mounted, so the container sees refreshed tokens.
+const identityTokenTarget = "/run/secrets/your-docker"
+
+// identityTokenFile is the name of the token in identityTokenTarget
+const identityTokenFile = "token"
+
+// identityTokenTTL is how long a token is valid. The shim replaces it halfway through, so
+// a token read from the file is always good for a while longer.
+const identityTokenTTL = 10 * time.Minute
+
+// identityIssuer is the iss of every token
+const identityIssuer = "your-docker"
+
+// errInvalidIdentityToken is returned for tokens that aren't ours, were tampered with or
+// have expired
+var errInvalidIdentityToken = errors.New("invalid identity token")
+
+// identityClaims are what a token says about the container holding it
+type identityClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expiry    int64  `json:"exp"`
+	// Host is the hostname of the machine the container runs on
+	Host          string `json:"host"`
+	ContainerName string `json:"container_name,omitempty"`
+	Image         string `json:"image"`
+	// ImageDigest is the manifest digest of the image, missing for images that weren't
+	// stored before the container was created from them
+	ImageDigest string `json:"image_digest,omitempty"`
+	StartedAt   int64  `json:"started_at"`
+}
+
+// identityHeader is the JOSE header of a token
+type identityHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// identityKeyPath is the host's signing key, created the first time a container asks for
+// a token
+func identityKeyPath() string {
+	return filepath.Join(storageRoot, "identity", "key.pem")
+}
+
+// identityTokenDir is where the shim keeps a container's token on the host
+func identityTokenDir(id string) string {
+	return filepath.Join(containerDir(id), "identity")
+}
+
+// loadIdentityKey reads the host's signing key, generating it if there is none yet
+func loadIdentityKey() (ed25519.PrivateKey, error) {
+	path := identityKeyPath()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = createIdentityKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to read identity key: %s holds no private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to read identity key: %s isn't an Ed25519 key", path)
+	}
+
+	return priv, nil
+}
+
+// createIdentityKey generates a signing key at path and returns it PEM encoded. Containers
+// starting at the same time may both generate one, the first to link it into place wins.
+func createIdentityKey(path string) ([]byte, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "key-*.pem")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Link(tmp.Name(), path); errors.Is(err, os.ErrExist) {
+		return os.ReadFile(path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// identityKeyID names a public key in token headers, so verifiers can tell which host's
+// key to check a token against
+func identityKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signIdentityToken returns claims as a JWT signed with key
+func signIdentityToken(key ed25519.PrivateKey, claims identityClaims) (string, error) {
+	header, err := json.Marshal(identityHeader{Algorithm: "EdDSA", Type: "JWT", KeyID: identityKeyID(key.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyIdentityToken checks that token was signed with key and is valid now, and returns
+// its claims
+func verifyIdentityToken(pub ed25519.PublicKey, token string, now time.Time) (identityClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identityClaims{}, fmt.Errorf("%w: not a JWT", errInvalidIdentityToken)
+	}
+
+	var header identityHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return identityClaims{}, err
+	}
+	if header.Algorithm != "EdDSA" {
+		return identityClaims{}, fmt.Errorf("%w: unexpected algorithm %q", errInvalidIdentityToken, header.Algorithm)
+	}
+	if header.KeyID != identityKeyID(pub) {
+		return identityClaims{}, fmt.Errorf("%w: signed by another key (%s)", errInvalidIdentityToken, header.KeyID)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), signature) {
+		return identityClaims{}, fmt.Errorf("%w: bad signature", errInvalidIdentityToken)
+	}
+
+	var claims identityClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return identityClaims{}, err
+	}
+	if claims.Issuer != identityIssuer {
+		return identityClaims{}, fmt.Errorf("%w: unexpected issuer %q", errInvalidIdentityToken, claims.Issuer)
+	}
+	if now.Unix() < claims.NotBefore {
+		return identityClaims{}, fmt.Errorf("%w: not valid before %s", errInvalidIdentityToken, time.Unix(claims.NotBefore, 0).UTC().Format(time.RFC3339))
+	}
+	if now.Unix() >= claims.Expiry {
+		return identityClaims{}, fmt.Errorf("%w: expired at %s", errInvalidIdentityToken, time.Unix(claims.Expiry, 0).UTC().Format(time.RFC3339))
+	}
+
+	return claims, nil
+}
+
+// decodeTokenPart decodes a base64url JSON part of a token into v
+func decodeTokenPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidIdentityToken, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidIdentityToken, err)
+	}
+
+	return nil
+}
+
+// tokenClaims returns the claims of a token issued at now for the container started at
+// started
+func (env *ContainerEnvironment) tokenClaims(now, started time.Time) (identityClaims, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return identityClaims{}, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return identityClaims{}, err
+	}
+
+	return identityClaims{
+		Issuer:        identityIssuer,
+		Subject:       env.id,
+		ID:            hex.EncodeToString(jti),
+		IssuedAt:      now.Unix(),
+		NotBefore:     now.Unix(),
+		Expiry:        now.Add(identityTokenTTL).Unix(),
+		Host:          host,
+		ContainerName: env.state.Name,
+		Image:         env.state.Config.Image,
+		ImageDigest:   env.state.ImageDigest,
+		StartedAt:     started.Unix(),
+	}, nil
+}
+
+// issueIdentity writes the first token of a container that asked for one, before it starts
+// at started, and returns the key that refreshes it
+func (env *ContainerEnvironment) issueIdentity(started time.Time) (ed25519.PrivateKey, error) {
+	if !env.state.Config.Identity {
+		return nil, nil
+	}
+
+	key, err := loadIdentityKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return key, env.writeIdentityToken(key, started)
+}
+
+// writeIdentityToken mints a token for the container and replaces the one in its token
+// directory, which the container reads through its mount
+func (env *ContainerEnvironment) writeIdentityToken(key ed25519.PrivateKey, started time.Time) error {
+	claims, err := env.tokenClaims(time.Now(), started)
+	if err != nil {
+		return fmt.Errorf("failed to issue identity token: %w", err)
+	}
+	token, err := signIdentityToken(key, claims)
+	if err != nil {
+		return fmt.Errorf("failed to issue identity token: %w", err)
+	}
+
+	dir := identityTokenDir(env.id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to issue identity token: %w", err)
+	}
+	// The container may run as any user, the token is only visible to it and root anyway
+	tmp := filepath.Join(dir, identityTokenFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(token), 0644); err != nil {
+		return fmt.Errorf("failed to issue identity token: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, identityTokenFile)); err != nil {
+		return fmt.Errorf("failed to issue identity token: %w", err)
+	}
+
+	return nil
+}
+
+// refreshIdentityTokens replaces the container's token halfway through its lifetime until
+// the returned function is called
+func (env *ContainerEnvironment) refreshIdentityTokens(key ed25519.PrivateKey, started time.Time) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(identityTokenTTL / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := env.writeIdentityToken(key, started); err != nil {
+					warnf(eventTypeContainer, "%v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// identityPublicKeyPEM returns the public half of the host's signing key PEM encoded
+func identityPublicKeyPEM(pub ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// identityJWKS returns the public half of the host's signing key as a JSON Web Key Set,
+// which most JWT libraries can verify tokens with
+func identityJWKS(pub ed25519.PublicKey) ([]byte, error) {
+	type jwk struct {
+		KeyType   string `json:"kty"`
+		Curve     string `json:"crv"`
+		X         string `json:"x"`
+		KeyID     string `json:"kid"`
+		Use       string `json:"use"`
+		Algorithm string `json:"alg"`
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(pub),
+		KeyID:     identityKeyID(pub),
+		Use:       "sig",
+		Algorithm: "EdDSA",
+	}}}
+
+	return json.MarshalIndent(set, "", "  ")
+}
@@ -0,0 +1,530 @@
+package engine
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// eventActionLoad is published for every image tag an archive is loaded into
+const eventActionLoad = "load"
+
+// dockerArchiveManifest is the file docker save lists the images of its archives in
+const dockerArchiveManifest = "manifest.json"
+
+// maxArchiveMetadata bounds the manifest.json and index.json read into memory
+const maxArchiveMetadata = 16 << 20
+
+// dockerArchiveEntry is an image in the manifest.json of a docker save archive. The paths
+// are those of files in the archive, <id>/layer.tar before Docker 25 and blobs/sha256/<hash>
+// since.
+type dockerArchiveEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveFile is a file of an image archive, kept in a temporary blob until the images that
+// reference it are stored
+type archiveFile struct {
+	digest string
+	size   int64
+	// tmp is "" once the file is committed to the store
+	tmp string
+}
+
+// imageArchive is an image archive read into temporary blobs
+type imageArchive struct {
+	store *ImageStore
+	files map[string]*archiveFile
+	// links are the symbolic and hard links of the archive by path, docker save links the
+	// layers images share
+	links    map[string]string
+	index    []byte
+	manifest []byte
+}
+
+// LoadArchive stores the images of an archive, as docker save writes it or an OCI image layout
+// in a tarball, compressed or not, and returns them by tag. Images that have no name in the
+// archive are skipped, the store keeps images by name.
+func (s *ImageStore) LoadArchive(r io.Reader) ([]*StoredImage, error) {
+	lock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	archive, err := s.readArchive(r)
+	if archive != nil {
+		defer archive.cleanup()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Docker 25 and later write both, index.json has the manifests as the registry served them
+	var images []*StoredImage
+	switch {
+	case archive.index != nil:
+		images, err = archive.loadOCILayout()
+	case archive.manifest != nil:
+		images, err = archive.loadDockerSave()
+	default:
+		return nil, fmt.Errorf("not an image archive: it has neither %s nor %s", ociIndexFile, dockerArchiveManifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, errors.New("archive has no named images to load")
+	}
+
+	for _, img := range images {
+		bus.Publish(Event{
+			Type:       eventTypeImage,
+			Action:     eventActionLoad,
+			ID:         img.Reference(),
+			Message:    "Loaded image: " + img.Reference(),
+			Attributes: map[string]string{"digest": img.Digest},
+		})
+	}
+
+	return images, nil
+}
+
+// readArchive reads every file of an archive into a temporary blob, keeping the index and
+// manifest in memory
+func (s *ImageStore) readArchive(r io.Reader) (*imageArchive, error) {
+	archive := &imageArchive{store: s, files: map[string]*archiveFile{}, links: map[string]string{}}
+
+	dr, err := decompressLayer(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archive, fmt.Errorf("not an image archive: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			archive.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			archive.links[name] = path.Clean(hdr.Linkname)
+		case tar.TypeReg:
+			if name == ociIndexFile || name == dockerArchiveManifest {
+				data, err := io.ReadAll(io.LimitReader(tr, maxArchiveMetadata+1))
+				if err != nil {
+					return archive, fmt.Errorf("failed to read %s: %w", name, err)
+				}
+				if len(data) > maxArchiveMetadata {
+					return archive, fmt.Errorf("%s is larger than %s", name, formatSize(maxArchiveMetadata))
+				}
+				if name == ociIndexFile {
+					archive.index = data
+				} else {
+					archive.manifest = data
+				}
+				continue
+			}
+
+			file, err := s.spoolArchiveFile(tr, name, hdr.Size)
+			if err != nil {
+				return archive, err
+			}
+			archive.files[name] = file
+		}
+	}
+
+	return archive, nil
+}
+
+// spoolArchiveFile copies a file of an archive into a temporary blob, hashing it on the way
+func (s *ImageStore) spoolArchiveFile(r io.Reader, name string, size int64) (*archiveFile, error) {
+	tmp, err := s.tempBlob()
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	defer out.Close()
+
+	// Only layers are worth a progress bar, the JSON files go by in an instant
+	if size >= 1<<20 {
+		r = &progressReader{r: r, id: archiveFileID(name), message: "Loading layer", total: size}
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), r); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return &archiveFile{digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)), size: size, tmp: tmp}, nil
+}
+
+// archiveFileID shortens the path of an archive file for progress, to the short digest of
+// blobs/sha256/<hash> or the short layer ID of <id>/layer.tar
+func archiveFileID(name string) string {
+	if hash, ok := strings.CutPrefix(name, "blobs/sha256/"); ok {
+		return shortDigest("sha256:" + hash)
+	}
+	if id, ok := strings.CutSuffix(name, "/layer.tar"); ok && len(id) > 12 {
+		return id[:12]
+	}
+
+	return name
+}
+
+// cleanup removes the temporary blobs of the files no image was stored with
+func (a *imageArchive) cleanup() {
+	for _, file := range a.files {
+		if file.tmp != "" {
+			os.Remove(file.tmp)
+		}
+	}
+}
+
+// file returns the file at a path of the archive, following links
+func (a *imageArchive) file(name string) (*archiveFile, error) {
+	name = path.Clean(name)
+	for range 16 {
+		if file, ok := a.files[name]; ok {
+			return file, nil
+		}
+		target, ok := a.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+
+	return nil, fmt.Errorf("archive is missing %s", name)
+}
+
+// blob returns the file of an OCI layout blob, checking that it has the digest it is named by
+func (a *imageArchive) blob(digest string) (*archiveFile, error) {
+	if err := validateDigest(digest); err != nil {
+		return nil, err
+	}
+	file, err := a.file("blobs/sha256/" + strings.TrimPrefix(digest, "sha256:"))
+	if err != nil {
+		return nil, fmt.Errorf("archive is missing blob %s", shortDigest(digest))
+	}
+	if file.digest != digest {
+		return nil, &digestMismatchError{digest: digest, actual: file.digest, source: "archive"}
+	}
+
+	return file, nil
+}
+
+// open opens a file of the archive wherever it is kept by now
+func (a *imageArchive) open(file *archiveFile) (*os.File, error) {
+	if file.tmp != "" {
+		return os.Open(file.tmp)
+	}
+	path, err := a.store.blobPath(file.digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// read returns the content of a file of the archive
+func (a *imageArchive) read(file *archiveFile) ([]byte, error) {
+	f, err := a.open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// commit moves a file of the archive into the store under its digest
+func (a *imageArchive) commit(file *archiveFile) error {
+	if file.tmp == "" {
+		return nil
+	}
+	if a.store.hasBlob(file.digest) {
+		os.Remove(file.tmp)
+	} else if err := a.store.commitBlob(file.digest, file.tmp); err != nil {
+		return err
+	}
+	file.tmp = ""
+
+	return nil
+}
+
+// loadOCILayout stores the images of the archive's index.json. Their names come from the
+// annotations save and containerd write, or from manifest.json for images of docker save.
+func (a *imageArchive) loadOCILayout() ([]*StoredImage, error) {
+	var index ociIndex
+	if err := json.Unmarshal(a.index, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ociIndexFile, err)
+	}
+	var entries []dockerArchiveEntry
+	if a.manifest != nil {
+		if err := json.Unmarshal(a.manifest, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", dockerArchiveManifest, err)
+		}
+	}
+
+	var images []*StoredImage
+	for _, descriptor := range index.Manifests {
+		file, manifest, err := a.ociManifest(descriptor.Digest, descriptor.MediaType, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", shortDigest(descriptor.Digest), err)
+		}
+
+		var refs []string
+		if name := ociImageName(descriptor.Annotations); name != "" {
+			refs = append(refs, name)
+		} else {
+			for _, entry := range entries {
+				if config, err := a.file(entry.Config); err == nil && config.digest == manifest.Config.Digest {
+					refs = append(refs, entry.RepoTags...)
+				}
+			}
+		}
+
+		loaded, err := a.storeImage(file, manifest, refs)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, loaded...)
+	}
+
+	return images, nil
+}
+
+// ociImageName returns the reference an image of an OCI layout is named by in its index.
+// The ref.name annotation is usually only a tag, but some tools put the whole reference there.
+func ociImageName(annotations map[string]string) string {
+	if name := annotations[containerdNameAnnotation]; name != "" {
+		return name
+	}
+	if name := annotations[ociRefNameAnnotation]; strings.ContainsAny(name, "/:") {
+		return name
+	}
+
+	return ""
+}
+
+// ociManifest returns the file and content of a manifest of the layout, picking the one for
+// the host from a manifest list like a pull does
+func (a *imageArchive) ociManifest(digest, mediaType string, followList bool) (*archiveFile, layersList, error) {
+	file, err := a.blob(digest)
+	if err != nil {
+		return nil, layersList{}, err
+	}
+	data, err := a.read(file)
+	if err != nil {
+		return nil, layersList{}, err
+	}
+	if mediaType, err = manifestMediaType(data, mediaType); err != nil {
+		return nil, layersList{}, err
+	}
+
+	if isManifestList(mediaType) && followList {
+		var list manifestList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, layersList{}, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		m, err := selectManifest(list.Manifests, hostPlatform(), false)
+		if err != nil {
+			return nil, layersList{}, err
+		}
+		return a.ociManifest(m.Digest, m.MediaType, false)
+	}
+
+	manifest, err := decodeManifest(data, mediaType)
+	if err != nil {
+		return nil, layersList{}, err
+	}
+
+	return file, manifest, nil
+}
+
+// loadDockerSave stores the images of a manifest.json without an index.json, as docker save
+// wrote them before Docker 25. They get an OCI manifest of their config and layers, whose
+// digests are checked against the layer digests of the config.
+func (a *imageArchive) loadDockerSave() ([]*StoredImage, error) {
+	var entries []dockerArchiveEntry
+	if err := json.Unmarshal(a.manifest, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", dockerArchiveManifest, err)
+	}
+
+	var images []*StoredImage
+	for _, entry := range entries {
+		manifest, err := a.dockerSaveManifest(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", entry.Config, err)
+		}
+
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image manifest: %w", err)
+		}
+		tmp, err := a.store.tempBlob()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		file := &archiveFile{digest: fmt.Sprintf("sha256:%x", sha256.Sum256(data)), size: int64(len(data)), tmp: tmp}
+		// Kept with the files of the archive, so cleanup removes it if it isn't stored
+		a.files["@manifest-"+file.digest] = file
+
+		layers := layersList{Config: manifest.Config, Layers: manifest.Layers}
+		loaded, err := a.storeImage(file, layers, entry.RepoTags)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, loaded...)
+	}
+
+	return images, nil
+}
+
+// dockerSaveManifest builds the manifest of an image of manifest.json
+func (a *imageArchive) dockerSaveManifest(entry dockerArchiveEntry) (tarballManifest, error) {
+	config, err := a.file(entry.Config)
+	if err != nil {
+		return tarballManifest{}, err
+	}
+	data, err := a.read(config)
+	if err != nil {
+		return tarballManifest{}, err
+	}
+	var rootfs tarballConfig
+	if err := json.Unmarshal(data, &rootfs); err != nil {
+		return tarballManifest{}, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	diffIDs := rootfs.RootFS.DiffIDs
+	if len(diffIDs) != len(entry.Layers) {
+		return tarballManifest{}, fmt.Errorf("image config lists %d layers, the archive has %d", len(diffIDs), len(entry.Layers))
+	}
+
+	manifest := tarballManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        layerEntry{MediaType: mediaTypeOCIConfig, Digest: config.digest, Size: config.size},
+		Layers:        []layerEntry{},
+	}
+	for i, name := range entry.Layers {
+		layer, err := a.file(name)
+		if err != nil {
+			return tarballManifest{}, err
+		}
+		f, err := a.open(layer)
+		if err != nil {
+			return tarballManifest{}, err
+		}
+		mediaType, err := layerMediaType(f)
+		f.Close()
+		if err != nil {
+			return tarballManifest{}, err
+		}
+		// The config has the digests of the uncompressed layers, which docker save writes
+		if !strings.ContainsRune(mediaType, '+') && layer.digest != diffIDs[i] {
+			return tarballManifest{}, &digestMismatchError{digest: diffIDs[i], actual: layer.digest, source: "archive"}
+		}
+		manifest.Layers = append(manifest.Layers, layerEntry{MediaType: mediaType, Digest: layer.digest, Size: layer.size})
+	}
+
+	return manifest, nil
+}
+
+// storeImage commits the blobs of an image and then its manifest, and tags it with refs. An
+// image without refs is skipped with a warning.
+func (a *imageArchive) storeImage(file *archiveFile, manifest layersList, refs []string) ([]*StoredImage, error) {
+	if len(refs) == 0 {
+		warnf(eventTypeImage, "image %s has no name in the archive, skipping it", shortDigest(file.digest))
+		return nil, nil
+	}
+
+	type namedRef struct{ name, tag string }
+	var names []namedRef
+	for _, ref := range refs {
+		name, tag, err := parseImageReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image name %q in archive: %w", ref, err)
+		}
+		if pinnedDigest(tag) != "" {
+			return nil, fmt.Errorf("invalid image name %q in archive: expected a tag, not a digest", ref)
+		}
+		names = append(names, namedRef{name, tag})
+	}
+
+	config, err := a.byDigest(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := a.read(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseImageConfig(data, manifest); err != nil {
+		return nil, err
+	}
+
+	// The manifest goes in last, so a tag never points at missing blobs
+	blobs := []*archiveFile{config}
+	for _, layer := range manifest.Layers {
+		f, err := a.byDigest(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, f)
+	}
+	for _, blob := range append(blobs, file) {
+		if err := a.commit(blob); err != nil {
+			return nil, err
+		}
+	}
+
+	var images []*StoredImage
+	for _, n := range names {
+		if _, err := a.store.tag(n.name, n.tag, file.digest); err != nil {
+			return nil, err
+		}
+		images = append(images, &StoredImage{Name: n.name, Tag: n.tag, Digest: file.digest, Manifest: manifest})
+	}
+
+	return images, nil
+}
+
+// byDigest returns the file of the archive with the given digest, wherever it is. A blob of
+// an OCI layout that doesn't have the digest it is named by is reported as such.
+func (a *imageArchive) byDigest(digest string) (*archiveFile, error) {
+	for _, file := range a.files {
+		if file.digest == digest {
+			return file, nil
+		}
+	}
+
+	return a.blob(digest)
+}
@@ -0,0 +1,436 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Annotations or labels an image can use to declare what it needs from the kernel
+const (
+	// kernelVersionAnnotation is the oldest usable kernel release, e.g. "5.14"
+	kernelVersionAnnotation = "org.your-docker.kernel.min-version"
+	// kernelFeaturesAnnotation is a comma-separated list of kernelFeatures
+	kernelFeaturesAnnotation = "org.your-docker.kernel.features"
+)
+
+// errImageIncompatible is returned by strict runs of images that failed the compatibility check
+var errImageIncompatible = errors.New("image is not compatible with this host")
+
+// Errors of lookPathInRoot, which decide the exit code when the command can't be run
+var (
+	errExecutableNotFound = errors.New("executable file not found in the image's $PATH")
+	errNoSuchExecutable   = errors.New("no such executable in the image")
+	errNotExecutable      = errors.New("not an executable file")
+)
+
+// kernelFeatures are the features images can require, with a check for each
+var kernelFeatures = map[string]func() bool{
+	"overlay": func() bool { return hasFilesystem("overlay") },
+	"fuse":    func() bool { return hasFilesystem("fuse") },
+	"cgroup2": func() bool { return fileExists("/sys/fs/cgroup/cgroup.controllers") },
+	"userns": func() bool {
+		data, err := os.ReadFile("/proc/sys/user/max_user_namespaces")
+		return err == nil && strings.TrimSpace(string(data)) != "0"
+	},
+	"seccomp": func() bool {
+		data, err := os.ReadFile("/proc/self/status")
+		return err == nil && bytes.Contains(data, []byte("\nSeccomp:"))
+	},
+	"btf": func() bool { return fileExists("/sys/kernel/btf/vmlinux") },
+	"io_uring": func() bool {
+		data, err := os.ReadFile("/proc/sys/kernel/io_uring_disabled")
+		return os.IsNotExist(err) || (err == nil && strings.TrimSpace(string(data)) == "0")
+	},
+}
+
+// elfArchs maps ELF machines to Go architecture names as used in image platforms
+var elfArchs = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+}
+
+// qemuArchs are the names binfmt_misc entries of qemu-user use for each architecture
+var qemuArchs = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i386",
+	"arm64":   "aarch64",
+	"arm":     "arm",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// amd64Levels are the CPU flags each microarchitecture level adds to the one before
+var amd64Levels = map[string][]string{
+	"v2": {"cx16", "lahf_lm", "popcnt", "sse4_1", "sse4_2", "ssse3"},
+	"v3": {"avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave"},
+	"v4": {"avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl"},
+}
+
+// checkImageCompatibility looks for reasons the unpacked image at root can't run command on
+// this host, so they can be reported before the kernel fails the exec with a bare "exec
+// format error". searchPath is the PATH the command is looked up in; without a command only
+// the image is checked.
+func checkImageCompatibility(root string, config imageConfig, command, searchPath string) []string {
+	var problems []string
+
+	if config.OS != "" && config.OS != runtime.GOOS {
+		problems = append(problems, fmt.Sprintf("%s image on %s host", config.OS, runtime.GOOS))
+	}
+	if config.Architecture != "" && !runsNatively(config.Architecture) && !qemuRegistered(config.Architecture) {
+		problems = append(problems, fmt.Sprintf("%s image on %s host, %s", config.Architecture, runtime.GOARCH, qemuHint(config.Architecture)))
+	}
+	if config.Architecture == runtime.GOARCH && config.Variant != "" {
+		if missing := missingVariant(config.Variant); missing != "" {
+			problems = append(problems, fmt.Sprintf("%s/%s image on a CPU without %s", config.Architecture, config.Variant, missing))
+		}
+	}
+
+	problems = append(problems, checkKernelRequirements(config)...)
+
+	if command == "" {
+		return problems
+	}
+	if problem := checkEntrypoint(root, command, searchPath); problem != "" {
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+// imageAnnotation returns an annotation of the manifest, falling back to a config label
+func imageAnnotation(config imageConfig, key string) string {
+	if v, ok := config.Annotations[key]; ok {
+		return v
+	}
+
+	return config.Config.Labels[key]
+}
+
+// checkKernelRequirements compares the kernel requirements the image declares with ours
+func checkKernelRequirements(config imageConfig) []string {
+	var problems []string
+
+	if min := imageAnnotation(config, kernelVersionAnnotation); min != "" {
+		kernel, err := kernelVersion()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("image requires kernel %s, but the running kernel is unknown: %v", min, err))
+		} else if _, err := parseKernelVersion(min); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s annotation %q", kernelVersionAnnotation, min))
+		} else if !kernelAtLeast(kernel, min) {
+			problems = append(problems, fmt.Sprintf("image requires kernel %s, host runs %d.%d", min, kernel[0], kernel[1]))
+		}
+	}
+
+	for _, feature := range imageKernelFeatures(config) {
+		check, ok := kernelFeatures[feature]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("image requires unknown kernel feature %q", feature))
+			continue
+		}
+		if !check() {
+			problems = append(problems, fmt.Sprintf("image requires kernel feature %s, which the host doesn't provide", feature))
+		}
+	}
+
+	return problems
+}
+
+// imageKernelFeatures returns the kernel features the image declares it needs
+func imageKernelFeatures(config imageConfig) []string {
+	var features []string
+	for _, feature := range strings.Split(imageAnnotation(config, kernelFeaturesAnnotation), ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features = append(features, feature)
+		}
+	}
+
+	return features
+}
+
+// checkEntrypoint finds the command in the image and checks that the kernel can execute it:
+// for ELF binaries the architecture and the dynamic loader, for scripts the interpreter. A
+// command that is missing or not executable isn't a problem here: the init fails to start it
+// with the same lookup and reports that as an error.
+func checkEntrypoint(root, command, searchPath string) string {
+	path, err := lookPathInRoot(root, command, searchPath)
+	if err != nil {
+		return ""
+	}
+
+	problem, interpreter := checkExecutable(root, command, path)
+	if problem != "" || interpreter == "" {
+		return problem
+	}
+
+	// The interpreter of a script has to be executable itself
+	interpPath, err := secureJoin(root, interpreter)
+	if err != nil || !fileExists(interpPath) {
+		return fmt.Sprintf("%s is a script for %s, which the image doesn't contain", command, interpreter)
+	}
+
+	problem, _ = checkExecutable(root, interpreter, interpPath)
+	return problem
+}
+
+// checkExecutable checks a file in the image and returns the interpreter it names if it is a
+// script
+func checkExecutable(root, name, path string) (string, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Sprintf("failed to open %s: %v", name, err), ""
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return fmt.Sprintf("%s is too short to be executable", name), ""
+	}
+
+	if bytes.HasPrefix(magic, []byte("#!")) {
+		line, _ := bufio.NewReader(f).ReadString('\n')
+		fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+		if len(fields) == 0 {
+			return fmt.Sprintf("%s is a script without an interpreter", name), ""
+		}
+		return "", fields[0]
+	}
+
+	if string(magic) != elf.ELFMAG {
+		return fmt.Sprintf("%s is neither an ELF binary nor a script", name), ""
+	}
+
+	file, err := elf.NewFile(f)
+	if err != nil {
+		return fmt.Sprintf("%s is not a valid ELF binary: %v", name, err), ""
+	}
+
+	arch, ok := elfArchs[file.Machine]
+	if !ok {
+		arch = file.Machine.String()
+	}
+	if !runsNatively(arch) && !qemuRegistered(arch) {
+		return fmt.Sprintf("%s is built for %s, the host is %s, %s", name, arch, runtime.GOARCH, qemuHint(arch)), ""
+	}
+
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return fmt.Sprintf("failed to read the dynamic loader of %s: %v", name, err), ""
+		}
+
+		loader := string(bytes.TrimRight(data, "\x00"))
+		loaderPath, err := secureJoin(root, loader)
+		if err != nil || !fileExists(loaderPath) {
+			return fmt.Sprintf("%s needs the dynamic loader %s, which the image doesn't contain", name, loader), ""
+		}
+	}
+
+	return "", ""
+}
+
+// lookPathInRoot finds command in searchPath the way exec.LookPath does, but within root:
+// the image's root filesystem from the host, or / from the init once it has pivoted into it
+func lookPathInRoot(root, command, searchPath string) (string, error) {
+	if strings.Contains(command, "/") {
+		path, err := secureJoin(root, command)
+		if err != nil || !fileExists(path) {
+			return "", fmt.Errorf("%s: %w", command, errNoSuchExecutable)
+		}
+		if !isExecutableFile(path) {
+			return "", fmt.Errorf("%s: %w", command, errNotExecutable)
+		}
+		return path, nil
+	}
+
+	var searched []string
+	for _, dir := range filepath.SplitList(searchPath) {
+		if dir == "" || !filepath.IsAbs(dir) {
+			continue
+		}
+		searched = append(searched, dir)
+
+		path, err := secureJoin(root, filepath.Join(dir, command))
+		if err == nil && isExecutableFile(path) {
+			return path, nil
+		}
+	}
+
+	// Which directories were searched tells a wrong PATH from a command the image lacks
+	if len(searched) == 0 {
+		return "", fmt.Errorf("%s: %w, which has no absolute directories", command, errExecutableNotFound)
+	}
+	return "", fmt.Errorf("%s: %w (searched %s)", command, errExecutableNotFound, strings.Join(searched, ", "))
+}
+
+// runsNatively reports whether the kernel executes binaries of arch itself
+func runsNatively(arch string) bool {
+	// 32-bit x86 binaries run on 64-bit kernels with compat support, which is nearly universal
+	return arch == runtime.GOARCH || (runtime.GOARCH == "amd64" && arch == "386")
+}
+
+// qemuRegistered reports whether binfmt_misc runs binaries of arch through qemu-user
+func qemuRegistered(arch string) bool {
+	name, ok := qemuArchs[arch]
+	if !ok {
+		return false
+	}
+
+	data, err := os.ReadFile("/proc/sys/fs/binfmt_misc/qemu-" + name)
+	return err == nil && strings.HasPrefix(string(data), "enabled")
+}
+
+// qemuHint explains that the architecture isn't emulated
+func qemuHint(arch string) string {
+	if name, ok := qemuArchs[arch]; ok {
+		return fmt.Sprintf("no qemu registered for %s in binfmt_misc", name)
+	}
+
+	return "no emulation available"
+}
+
+// missingVariant returns what the CPU lacks to run the architecture variant, or "" if it is
+// supported. Variants we can't check are assumed to work.
+func missingVariant(variant string) string {
+	switch runtime.GOARCH {
+	case "amd64":
+		if variant == "v1" {
+			return ""
+		}
+		if _, ok := amd64Levels[variant]; !ok {
+			return ""
+		}
+
+		flags := cpuFlags()
+		for _, level := range []string{"v2", "v3", "v4"} {
+			for _, flag := range amd64Levels[level] {
+				if !flags[flag] {
+					return flag
+				}
+			}
+			if level == variant {
+				break
+			}
+		}
+	case "arm":
+		want, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+		if err != nil {
+			return ""
+		}
+		if have := armVersion(); have != 0 && have < want {
+			return "ARMv" + strconv.Itoa(want)
+		}
+	}
+
+	return ""
+}
+
+// cpuFlags returns the flags of the first CPU in /proc/cpuinfo
+func cpuFlags() map[string]bool {
+	flags := map[string]bool{}
+
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return flags
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(name) == "flags" {
+			for _, flag := range strings.Fields(value) {
+				flags[flag] = true
+			}
+			break
+		}
+	}
+
+	return flags
+}
+
+// armVersion returns the architecture version of a 32-bit ARM CPU, or 0 if it is unknown
+func armVersion() int {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return 0
+	}
+
+	version, model := 0, ""
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "CPU architecture":
+			if version == 0 {
+				// Old kernels add the extensions, such as 5TEJ, and 64-bit ones may say AArch64
+				v := strings.TrimSpace(value)
+				if strings.EqualFold(v, "aarch64") {
+					v = "8"
+				}
+				digits := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' })
+				if digits >= 0 {
+					v = v[:digits]
+				}
+				version, _ = strconv.Atoi(v)
+			}
+		case "model name":
+			if model == "" {
+				model = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	// The ARM11 of the first Raspberry Pis is an ARMv6 but reports architecture 7
+	if version == 7 && strings.HasPrefix(strings.ToLower(model), "armv6-compatible") {
+		version = 6
+	}
+
+	return version
+}
+
+// hasFilesystem reports whether the kernel supports a filesystem type
+func hasFilesystem(name string) bool {
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileExists reports whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isExecutableFile reports whether path is a regular file with an execute bit set
+func isExecutableFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
@@ -0,0 +1,484 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// imageStoreDir holds pulled images so they can be run without contacting the registry. The
+// storage root of the config file moves it.
+var imageStoreDir = "/var/lib/your-docker/images"
+
+// storeLockName is held shared by whatever adds blobs to the store or uses them before a tag
+// or a container refers to them, such as pulls, loads and creates, and exclusively by system
+// prune, so it never removes what one of them is about to use
+const storeLockName = "store.lock"
+
+// errImageNotFound is returned for images that haven't been pulled into the store
+var errImageNotFound = errors.New("no such image")
+
+// ImageStore keeps pulled manifests, configs and layers as content-addressed blobs plus an
+// index of tags, much like Docker's repositories.json
+type ImageStore struct {
+	root string
+}
+
+// imageIndex maps image names to their tags and the digests of the tagged manifests
+type imageIndex struct {
+	Repositories map[string]map[string]string `json:"repositories"`
+}
+
+// StoredImage is a tagged image in the store
+type StoredImage struct {
+	Name     string
+	Tag      string
+	Digest   string
+	Manifest layersList
+}
+
+// NewImageStore returns the store rooted at root. Nothing is created until the first pull.
+func NewImageStore(root string) *ImageStore {
+	return &ImageStore{root: root}
+}
+
+// lock locks the store, shared or exclusively, until the returned file is closed
+func (s *ImageStore) lock(exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", s.root, err)
+	}
+
+	path := filepath.Join(s.root, storeLockName)
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image store lock: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(lock.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		debugf(eventTypeImage, "waiting for the image store lock", "path", path)
+		err = syscall.Flock(int(lock.Fd()), how)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock image store: %w", err)
+	}
+
+	return lock, nil
+}
+
+// blobPath returns where the blob with the given digest is kept
+func (s *ImageStore) blobPath(digest string) (string, error) {
+	algorithm, hash, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	return filepath.Join(s.root, "blobs", algorithm, hash), nil
+}
+
+// hasBlob reports whether the blob is already stored
+func (s *ImageStore) hasBlob(digest string) bool {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// tempBlob returns a path for downloading a blob before it is verified and committed
+func (s *ImageStore) tempBlob() (string, error) {
+	dir := filepath.Join(s.root, "tmp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary blob: %w", err)
+	}
+	f.Close()
+
+	return f.Name(), nil
+}
+
+// partialBlob returns where a blob is downloaded before it is verified and committed, locked
+// against other pulls of the same blob. The file is kept when a download fails, so the next
+// pull resumes it.
+func (s *ImageStore) partialBlob(digest string) (string, *os.File, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir := filepath.Join(s.root, "tmp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	partial := filepath.Join(dir, filepath.Base(path)+".partial")
+	for {
+		lock, err := os.OpenFile(partial+".lock", os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to lock partial blob: %w", err)
+		}
+
+		if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+			lock.Close()
+			return "", nil, fmt.Errorf("failed to lock partial blob: %w", err)
+		}
+
+		// The holder we waited for removes the lock file when it is done, in which case
+		// another pull may already hold a new one
+		locked, err := lock.Stat()
+		if current, statErr := os.Stat(partial + ".lock"); err == nil && statErr == nil && os.SameFile(locked, current) {
+			return partial, lock, nil
+		}
+		lock.Close()
+	}
+}
+
+// commitBlob moves a verified download into place
+func (s *ImageStore) commitBlob(digest, tmp string) error {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to store blob %s: %w", digest, err)
+	}
+
+	return nil
+}
+
+// writeBlob stores data under its digest
+func (s *ImageStore) writeBlob(data []byte) (string, error) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if s.hasBlob(digest) {
+		return digest, nil
+	}
+
+	tmp, err := s.tempBlob()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write blob %s: %w", digest, err)
+	}
+
+	if err := s.commitBlob(digest, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// readBlob returns the content of a stored blob
+func (s *ImageStore) readBlob(digest string) ([]byte, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", digest, err)
+	}
+
+	return data, nil
+}
+
+// readIndex loads the tag index. A store nothing was pulled into yet has an empty index.
+func (s *ImageStore) readIndex() (imageIndex, error) {
+	index := imageIndex{Repositories: map[string]map[string]string{}}
+
+	data, err := os.ReadFile(filepath.Join(s.root, "repositories.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to parse image index: %w", err)
+	}
+	if index.Repositories == nil {
+		index.Repositories = map[string]map[string]string{}
+	}
+
+	return index, nil
+}
+
+// updateIndex applies update to the tag index while holding the index lock, so concurrent
+// pulls don't lose each other's tags
+func (s *ImageStore) updateIndex(update func(*imageIndex) error) error {
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.root, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(s.root, "repositories.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open image index lock: %w", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock image index: %w", err)
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := update(&index); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode image index: %w", err)
+	}
+
+	// Readers don't take the lock, so replace the file atomically
+	path := filepath.Join(s.root, "repositories.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write image index: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write image index: %w", err)
+	}
+
+	return nil
+}
+
+// tag points name:tag at a stored manifest and reports whether it changed
+func (s *ImageStore) tag(name, tag, digest string) (bool, error) {
+	changed := false
+	err := s.updateIndex(func(index *imageIndex) error {
+		tags := index.Repositories[name]
+		if tags == nil {
+			tags = map[string]string{}
+			index.Repositories[name] = tags
+		}
+
+		changed = tags[tag] != digest
+		tags[tag] = digest
+		return nil
+	})
+
+	return changed, err
+}
+
+// Lookup returns a tagged image by reference or, like with Docker, by its ID, or an error
+// wrapping errImageNotFound if it wasn't pulled
+func (s *ImageStore) Lookup(image string) (*StoredImage, error) {
+	name, tag, err := parseImageReference(image)
+	if err == nil {
+		var img *StoredImage
+		if img, err = s.lookup(name, tag); err == nil {
+			return img, nil
+		}
+	}
+
+	// Image IDs aren't references, so what isn't found as one may still be an ID
+	img, idErr := s.lookupImageID(image)
+	if idErr == nil {
+		return img, nil
+	}
+	if !errors.Is(idErr, errImageNotFound) {
+		return nil, idErr
+	}
+
+	return nil, err
+}
+
+// lookup returns the image a tag points at
+func (s *ImageStore) lookup(name, tag string) (*StoredImage, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, ok := index.Repositories[name][tag]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errImageNotFound, formatImageReference(name, tag))
+	}
+
+	data, err := s.readBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &StoredImage{Name: name, Tag: tag, Digest: digest}
+	if err := json.Unmarshal(data, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", formatImageReference(name, tag), err)
+	}
+
+	return img, nil
+}
+
+// imageByDigest returns the image with the given manifest digest, whether or not a tag still
+// points at it, as long as its manifest is stored
+func (s *ImageStore) imageByDigest(digest string) (*StoredImage, error) {
+	data, err := s.readBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &StoredImage{Digest: digest}
+	if err := json.Unmarshal(data, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", shortDigest(digest), err)
+	}
+
+	return img, nil
+}
+
+// Unpack extracts the image's layers into dir
+func (s *ImageStore) Unpack(img *StoredImage, dir string) error {
+	return s.unpack(img, dir, nil)
+}
+
+// unpack extracts the image's layers into dir for a container with the given setup steps
+func (s *ImageStore) unpack(img *StoredImage, dir string, steps *setupSteps) error {
+	return applyLayers(dir, img.Manifest.Layers, steps, func(layer layerEntry) (string, func(), error) {
+		path, err := s.blobPath(layer.Digest)
+		return path, func() {}, err
+	})
+}
+
+// ImageSummary describes a tagged image for listings
+type ImageSummary struct {
+	Repository string    `json:"Repository"`
+	Tag        string    `json:"Tag"`
+	ID         string    `json:"ID"`
+	Digest     string    `json:"Digest"`
+	CreatedAt  time.Time `json:"CreatedAt"`
+	Size       int64     `json:"Size"`
+}
+
+// imageConfig holds the fields of an image config blob that listings and the compatibility
+// check need
+type imageConfig struct {
+	Created      time.Time `json:"created"`
+	OS           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Variant      string    `json:"variant,omitempty"`
+	Config       struct {
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		User       string            `json:"User,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+		// Healthcheck is the image's HEALTHCHECK, nil if it inherits none
+		Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+	} `json:"config"`
+	// Annotations are those of the manifest, they aren't part of the config blob
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// parseImageConfig decodes a config blob and adds the annotations of its manifest
+func parseImageConfig(data []byte, manifest layersList) (imageConfig, error) {
+	var config imageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return imageConfig{}, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	config.Annotations = manifest.Annotations
+
+	return config, nil
+}
+
+// Config returns the config of a stored image
+func (s *ImageStore) Config(img *StoredImage) (imageConfig, error) {
+	data, err := s.readBlob(img.Manifest.Config.Digest)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	config, err := parseImageConfig(data, img.Manifest)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("%s:%s: %w", img.Name, img.Tag, err)
+	}
+
+	return config, nil
+}
+
+// List returns every tagged image sorted by repository and tag. The size is that of the
+// stored blobs, which are compressed like on the registry.
+func (s *ImageStore) List() ([]ImageSummary, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageSummary
+	for name, tags := range index.Repositories {
+		for tag := range tags {
+			img, err := s.lookup(name, tag)
+			if err != nil {
+				return nil, err
+			}
+
+			// Like Docker, images pulled by digest have no tag, and neither do tarballs
+			if pinnedDigest(tag) != "" || tag == "" {
+				tag = "<none>"
+			}
+
+			summary := ImageSummary{
+				Repository: name,
+				Tag:        tag,
+				ID:         img.Manifest.Config.Digest,
+				Digest:     img.Digest,
+				Size:       img.Manifest.Config.Size,
+			}
+			for _, layer := range img.Manifest.Layers {
+				summary.Size += layer.Size
+			}
+
+			config, err := s.Config(img)
+			if err != nil {
+				return nil, err
+			}
+			summary.CreatedAt = config.Created
+
+			images = append(images, summary)
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Repository != images[j].Repository {
+			return images[i].Repository < images[j].Repository
+		}
+		return images[i].Tag < images[j].Tag
+	})
+
+	return images, nil
+}
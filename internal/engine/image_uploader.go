@@ -0,0 +1,597 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventActionPush is published for every image pushed to a registry
+const eventActionPush = "push"
+
+// pushChunkSize is the size of the chunks blobs larger than it are uploaded in, so a layer of
+// gigabytes isn't one request that a proxy or the registry may refuse
+const pushChunkSize = 16 << 20
+
+// DockerImageUploader pushes images from the store to a registry
+type DockerImageUploader struct {
+	client *http.Client
+	ref    Reference
+	// registry is the URL of the registry the image is pushed to
+	registry  string
+	userAgent string
+
+	// credentials authenticate to the registry or its token endpoint
+	credentials *registryCredentials
+	// challenge is how the registry asked to be authenticated to, nil if it didn't
+	challenge *authChallenge
+	// scopes are the access the token is requested for: pushing to the repository, and
+	// pulling from those blobs are mounted from
+	scopes        []string
+	authorization string
+	tokenExp      time.Time
+}
+
+// authChallenge is a WWW-Authenticate challenge, e.g. Bearer realm="https://auth.docker.io/token",
+// service="registry.docker.io"
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// blobUpload is an upload session the registry opened for a blob
+type blobUpload struct {
+	location *url.URL
+	// minChunk is the smallest chunk the registry takes besides the last, 0 if it didn't say
+	minChunk int64
+}
+
+// NewDockerImageUploader creates an uploader for the stored image imageAndTag names, which is
+// also where it is pushed to. Without credentials, the ones stored by docker login for the
+// registry are used if there are any.
+func NewDockerImageUploader(imageAndTag string, credentials *registryCredentials) (*DockerImageUploader, error) {
+	ref, err := ParseReference(imageAndTag)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest != "" {
+		return nil, fmt.Errorf("cannot push %s: a digest names content already pushed, push a tag instead", imageAndTag)
+	}
+
+	if credentials == nil {
+		if credentials, err = lookupRegistryCredentials(registryServers(ref.Domain)); err != nil {
+			warnf(eventTypeImage, "%v, pushing anonymously", err)
+		}
+	}
+
+	transport, err := newRegistryTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	registry := "https://" + ref.Domain
+	if ref.Domain == defaultDomain {
+		registry = dockerHubRegistry
+	}
+
+	return &DockerImageUploader{
+		// Uploads take as long as the connection needs, interrupting the push cancels them
+		client:      &http.Client{Transport: &clockCheckingTransport{base: &rateLimitTransport{base: loggingTransport{base: transport}}}},
+		ref:         ref,
+		registry:    registry,
+		userAgent:   "go-docker-client/1.0",
+		credentials: credentials,
+		scopes:      []string{fmt.Sprintf("repository:%s:push,pull", ref.Path)},
+	}, nil
+}
+
+// Push uploads the blobs of the image the registry doesn't have yet and then its manifest
+// under the tag. Blobs of other repositories on the same registry are mounted rather than
+// uploaded again when the store has an image from one of them.
+func (up *DockerImageUploader) Push(ctx context.Context, store *ImageStore) error {
+	lock, err := store.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	img, err := store.lookup(up.ref.FamiliarName(), up.ref.Tag)
+	if err != nil {
+		return err
+	}
+	raw, err := store.readBlob(img.Digest)
+	if err != nil {
+		return err
+	}
+	mediaType, err := manifestMediaType(raw, "")
+	if err != nil {
+		return err
+	}
+
+	// The config goes last like with docker push, the manifest refers to all of them
+	blobs := append(append([]layerEntry{}, img.Manifest.Layers...), img.Manifest.Config)
+	sources, err := store.blobSources(up.ref, blobs)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, source := range sources {
+		if !seen[source] {
+			seen[source] = true
+			up.scopes = append(up.scopes, fmt.Sprintf("repository:%s:pull", source))
+		}
+	}
+	sort.Strings(up.scopes[1:])
+
+	imageProgress("", "The push refers to repository [%s]", up.ref.Name())
+	if err := up.ping(ctx); err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		id := shortDigest(blob.Digest)
+		if strings.Contains(blob.MediaType, "foreign") || strings.Contains(blob.MediaType, "nondistributable") {
+			// Registries fetch these from where their license allows them to be, if at all
+			imageProgress(id, "Skipped foreign layer")
+			continue
+		}
+		if err := up.pushBlob(ctx, store, blob, sources[blob.Digest]); err != nil {
+			return fmt.Errorf("failed to push %s: %w", id, err)
+		}
+	}
+
+	if err := up.putManifest(ctx, raw, mediaType, img.Digest); err != nil {
+		return err
+	}
+	imageProgress("", "%s: digest: %s size: %d", up.ref.Tag, img.Digest, len(raw))
+
+	bus.Publish(Event{
+		Type:       eventTypeImage,
+		Action:     eventActionPush,
+		ID:         up.ref.FamiliarString(),
+		Message:    fmt.Sprintf("Pushed %s", up.ref.FamiliarString()),
+		Attributes: map[string]string{"digest": img.Digest},
+	})
+
+	return nil
+}
+
+// blobSources returns for those of the blobs that stored images from the registry ref is on
+// have as well the repository of one of them, which they can be mounted from
+func (s *ImageStore) blobSources(ref Reference, blobs []layerEntry) (map[string]string, error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range index.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	wanted := map[string]bool{}
+	for _, blob := range blobs {
+		wanted[blob.Digest] = true
+	}
+
+	sources := map[string]string{}
+	for _, name := range names {
+		other, err := ParseReference(name)
+		if err != nil || other.Domain != ref.Domain || other.Path == ref.Path {
+			continue
+		}
+		for tag := range index.Repositories[name] {
+			img, err := s.lookup(name, tag)
+			if err != nil {
+				continue
+			}
+			for _, blob := range append(img.Manifest.Layers, img.Manifest.Config) {
+				if _, ok := sources[blob.Digest]; wanted[blob.Digest] && !ok {
+					sources[blob.Digest] = other.Path
+				}
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// pushBlob makes the registry have a stored blob: it may have it already, or mount it from
+// source, otherwise it is uploaded
+func (up *DockerImageUploader) pushBlob(ctx context.Context, store *ImageStore, blob layerEntry, source string) error {
+	id := shortDigest(blob.Digest)
+
+	exists, err := up.blobExists(ctx, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		imageProgress(id, "Layer already exists")
+		return nil
+	}
+
+	path, err := store.blobPath(blob.Digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("blob %s is missing from the store, pull the image again", blob.Digest)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	upload, err := up.startUpload(ctx, blob.Digest, source)
+	if err != nil {
+		return err
+	}
+	if upload == nil {
+		imageProgress(id, "Mounted from %s", source)
+		return nil
+	}
+
+	body := newProgressReader(f, layerEntry{Digest: blob.Digest, Size: info.Size()}, "Pushing")
+	if info.Size() <= max(pushChunkSize, upload.minChunk) {
+		err = up.putBlob(ctx, upload, blob.Digest, body, info.Size())
+	} else {
+		err = up.uploadChunks(ctx, upload, blob.Digest, body, info.Size())
+	}
+	if err != nil {
+		return err
+	}
+	imageProgress(id, "Pushed")
+
+	return nil
+}
+
+// blobExists reports whether the repository has the blob already
+func (up *DockerImageUploader) blobExists(ctx context.Context, digest string) (bool, error) {
+	resp, err := up.do(ctx, http.MethodHead, up.url("blobs/"+digest), nil, 0, "")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, &registryStatusError{op: "blob check failed", code: resp.StatusCode, status: resp.Status}
+}
+
+// startUpload opens an upload session for a blob. With a source repository, the registry is
+// asked to mount the blob from it instead, which needs no session if it can: nil is returned
+// then.
+func (up *DockerImageUploader) startUpload(ctx context.Context, digest, source string) (*blobUpload, error) {
+	u := up.url("blobs/uploads/")
+	if source != "" {
+		u.RawQuery = url.Values{"mount": {digest}, "from": {source}}.Encode()
+	}
+
+	resp, err := up.do(ctx, http.MethodPost, u, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusCreated && source != "":
+		return nil, nil
+	case resp.StatusCode != http.StatusAccepted:
+		// A registry that can't mount the blob opens a session instead
+		return nil, registryError("upload failed", resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: registry sent no upload location: %w", err)
+	}
+	upload := &blobUpload{location: location}
+	if n, err := strconv.ParseInt(resp.Header.Get("OCI-Chunk-Min-Length"), 10, 64); err == nil {
+		upload.minChunk = n
+	}
+
+	return upload, nil
+}
+
+// putBlob uploads a blob in one request, ending the session
+func (up *DockerImageUploader) putBlob(ctx context.Context, upload *blobUpload, digest string, body io.Reader, size int64) error {
+	u := *upload.location
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	resp, err := up.do(ctx, http.MethodPut, &u, body, size, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return registryError("upload failed", resp)
+	}
+
+	return nil
+}
+
+// uploadChunks uploads a blob in chunks of pushChunkSize, or the registry's minimum if that
+// is larger, and then ends the session
+func (up *DockerImageUploader) uploadChunks(ctx context.Context, upload *blobUpload, digest string, body io.Reader, size int64) error {
+	chunk := max(pushChunkSize, upload.minChunk)
+	for offset := int64(0); offset < size; offset += chunk {
+		n := min(chunk, size-offset)
+		req, err := up.newRequest(ctx, http.MethodPatch, upload.location, io.LimitReader(body, n), n, "application/octet-stream")
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+
+		resp, err := up.send(ctx, req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return registryError("upload failed", resp)
+		}
+		// Every chunk is sent to where the registry said the next one goes
+		if upload.location, err = resp.Location(); err != nil {
+			return fmt.Errorf("upload failed: registry sent no upload location: %w", err)
+		}
+	}
+
+	return up.putBlob(ctx, upload, digest, http.NoBody, 0)
+}
+
+// putManifest uploads the manifest under the tag, once the registry has everything it refers to
+func (up *DockerImageUploader) putManifest(ctx context.Context, raw []byte, mediaType, digest string) error {
+	resp, err := up.do(ctx, http.MethodPut, up.url("manifests/"+up.ref.Tag), bytes.NewReader(raw), int64(len(raw)), mediaType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return registryError("manifest upload failed", resp)
+	}
+	if stored := resp.Header.Get("Docker-Content-Digest"); stored != "" && stored != digest {
+		return fmt.Errorf("manifest upload failed: registry stored %s instead of %s", stored, digest)
+	}
+
+	return nil
+}
+
+// url returns the URL of a path below the repository on the registry
+func (up *DockerImageUploader) url(path string) *url.URL {
+	u, _ := url.Parse(fmt.Sprintf("%s/v2/%s/%s", up.registry, up.ref.Path, path))
+	return u
+}
+
+// do sends a request to the registry, see newRequest
+func (up *DockerImageUploader) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := up.newRequest(ctx, method, u, body, size, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return up.send(ctx, req)
+}
+
+// newRequest returns a request with a body of size bytes of the given type, if any
+func (up *DockerImageUploader) newRequest(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, contentType string) (*http.Request, error) {
+	if body == nil {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+// send sends a request with the authorization the registry asked for, renewing the token
+// when it expires
+func (up *DockerImageUploader) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if up.challenge != nil && up.challenge.scheme == "bearer" && time.Now().After(up.tokenExp) {
+		if err := up.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("User-Agent", up.userAgent)
+	if up.authorization != "" {
+		req.Header.Set("Authorization", up.authorization)
+	}
+
+	return up.client.Do(req)
+}
+
+// ping checks that the registry speaks the registry API and learns how to authenticate to it
+// from its challenge
+func (up *DockerImageUploader) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, up.registry+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", up.userAgent)
+
+	resp, err := up.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+	default:
+		return registryError("registry check failed", resp)
+	}
+
+	challenge, err := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return fmt.Errorf("failed to authenticate to %s: %w", registryHost(up.registry), err)
+	}
+	up.challenge = challenge
+
+	return up.authenticate(ctx)
+}
+
+// authenticate gets the authorization the challenge asked for: the credentials themselves for
+// basic authentication, or a token for the scopes from the realm
+func (up *DockerImageUploader) authenticate(ctx context.Context) error {
+	if up.challenge.scheme == "basic" {
+		if up.credentials == nil {
+			return fmt.Errorf("%s requires authentication to push: log in with docker login or pass --username", registryHost(up.registry))
+		}
+		credentials := up.credentials.Username + ":" + up.credentials.Password
+		up.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+		return nil
+	}
+
+	realm, err := url.Parse(up.challenge.params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return fmt.Errorf("failed to get auth token: invalid realm %q", up.challenge.params["realm"])
+	}
+	query := realm.Query()
+	if service := up.challenge.params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	for _, scope := range up.scopes {
+		query.Add("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", up.userAgent)
+	if up.credentials != nil {
+		req.SetBasicAuth(up.credentials.Username, up.credentials.Password)
+	}
+
+	resp, err := up.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get auth token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized && up.credentials != nil:
+		return fmt.Errorf("authentication as %s failed: incorrect username or password", up.credentials.Username)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("%s requires authentication to push: log in with docker login or pass --username", registryHost(up.registry))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get auth token: %w", registryError("authentication failed", resp))
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to get auth token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	up.authorization = "Bearer " + token.Token
+	// Tokens are valid for 60 seconds unless the realm says otherwise
+	expiresIn := 60
+	if token.ExpiresIn > 0 {
+		expiresIn = token.ExpiresIn
+	}
+	up.tokenExp = time.Now().Add(time.Duration(expiresIn)*time.Second - 10*time.Second)
+
+	return nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header of the basic or bearer scheme, whose
+// parameters are comma-separated key="value" pairs
+func parseAuthChallenge(header string) (*authChallenge, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	challenge := &authChallenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	if challenge.scheme != "basic" && challenge.scheme != "bearer" {
+		return nil, fmt.Errorf("unsupported authentication challenge %q", header)
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if unquoted, ok := strings.CutPrefix(value, `"`); ok {
+			end := strings.IndexByte(unquoted, '"')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid authentication challenge %q", header)
+			}
+			challenge.params[key] = unquoted[:end]
+			rest = unquoted[end+1:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			challenge.params[key] = strings.TrimSpace(value)
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	if challenge.scheme == "bearer" && challenge.params["realm"] == "" {
+		return nil, fmt.Errorf("invalid authentication challenge %q: no realm", header)
+	}
+
+	return challenge, nil
+}
+
+// registryError returns the error for an unexpected answer of the registry, with the messages
+// of the errors it sent, such as "requested access to the resource is denied"
+func registryError(op string, resp *http.Response) error {
+	err := &registryStatusError{op: op, code: resp.StatusCode, status: resp.Status}
+
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil {
+		var messages []string
+		for _, e := range body.Errors {
+			if e.Message != "" {
+				messages = append(messages, e.Message)
+			} else if e.Code != "" {
+				messages = append(messages, e.Code)
+			}
+		}
+		err.message = strings.Join(messages, "; ")
+	}
+
+	return err
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errImageInUse is returned by rmi for images that containers were created from
+var errImageInUse = errors.New("image is in use")
+
+// storedImageDigest returns the digest of the stored image a container of image is created
+// from, or "" if it isn't in the store
+func storedImageDigest(image, platform string) string {
+	want, err := parsePlatformOption(platform)
+	if err != nil {
+		return ""
+	}
+
+	img, _, err := storedImage(NewImageStore(imageStoreDir), image, want)
+	if err != nil {
+		return ""
+	}
+
+	return img.Digest
+}
+
+// usesImage reports whether a container was created from img. Containers without a recorded
+// digest, whose image was downloaded straight into their rootfs, go by their reference.
+func usesImage(state *ContainerState, img *StoredImage) bool {
+	if state.ImageDigest != "" {
+		return state.ImageDigest == img.Digest
+	}
+
+	name, tag, err := parseImageReference(state.Config.Image)
+	return err == nil && name == img.Name && tag == img.Tag
+}
+
+// imageUsers returns the states of the containers, running or not, created from img
+func imageUsers(img *StoredImage) ([]*ContainerState, error) {
+	states, err := listContainerStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*ContainerState
+	for _, state := range states {
+		if usesImage(state, img) {
+			users = append(users, state)
+		}
+	}
+
+	return users, nil
+}
+
+// removeImage untags an image. An image containers were created from is only untagged with
+// force, unless another tag still points at it. Its data stays in the store until system
+// prune finds nothing using it.
+func removeImage(store *ImageStore, ref string, force bool) error {
+	img, err := store.Lookup(ref)
+	if err != nil {
+		return err
+	}
+
+	index, err := store.readIndex()
+	if err != nil {
+		return err
+	}
+	if !force && !taggedElsewhere(index, img) {
+		users, err := imageUsers(img)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			ids := make([]string, len(users))
+			for i, state := range users {
+				ids[i] = shortID(state.ID)
+			}
+			return fmt.Errorf("unable to remove %s: %w by container %s, remove them first or use --force", img.Reference(), errImageInUse, strings.Join(ids, ", "))
+		}
+	}
+
+	return store.untag(img.Name, img.Tag, img.Digest)
+}
+
+// taggedElsewhere reports whether another tag points at the same manifest as img
+func taggedElsewhere(index imageIndex, img *StoredImage) bool {
+	for name, tags := range index.Repositories {
+		for tag, digest := range tags {
+			if digest == img.Digest && (name != img.Name || tag != img.Tag) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// untag removes name:tag from the index, unless a concurrent pull has pointed it at another
+// manifest in the meantime
+func (s *ImageStore) untag(name, tag, digest string) error {
+	return s.updateIndex(func(index *imageIndex) error {
+		tags := index.Repositories[name]
+		if tags[tag] != digest {
+			return fmt.Errorf("%s was tagged again while being removed", formatImageReference(name, tag))
+		}
+
+		delete(tags, tag)
+		if len(tags) == 0 {
+			delete(index.Repositories, name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// printImages writes the image listing as a table or, for --format json, one JSON object
+// per line like `docker images --format json`
+func printImages(w io.Writer, images []ImageSummary, format string) error {
+	switch format {
+	case "", "table":
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, img := range images {
+			if err := enc.Encode(img); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid --format %q: expected table or json", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	for _, img := range images {
+		created := "N/A"
+		if !img.CreatedAt.IsZero() {
+			created = humanDuration(time.Since(img.CreatedAt)) + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", img.Repository, img.Tag, shortDigest(img.ID), created, formatSize(img.Size))
+	}
+
+	return tw.Flush()
+}
+
+// humanDuration describes a duration roughly, like the Docker CLI's "2 weeks"
+func humanDuration(d time.Duration) string {
+	seconds := int(d.Seconds())
+	hours := int(d.Hours())
+
+	switch {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	case d.Minutes() < 2:
+		return "About a minute"
+	case d.Minutes() < 60:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	case d.Hours() < 2:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	case hours < 24*7*2:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours < 24*30*2:
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	case hours < 24*365*2:
+		return fmt.Sprintf("%d months", hours/24/30)
+	}
+
+	return fmt.Sprintf("%d years", hours/24/365)
+}
@@ -0,0 +1,522 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Object types inspect is restricted to with --type
+const (
+	inspectTypeContainer = "container"
+	inspectTypeImage     = "image"
+)
+
+// ImageInspect is what inspect shows about an image, with the field names of
+// `docker image inspect`
+type ImageInspect struct {
+	ID           string             `json:"Id"`
+	RepoTags     []string           `json:"RepoTags"`
+	RepoDigests  []string           `json:"RepoDigests"`
+	Created      time.Time          `json:"Created"`
+	Author       string             `json:"Author,omitempty"`
+	Architecture string             `json:"Architecture"`
+	Variant      string             `json:"Variant,omitempty"`
+	Os           string             `json:"Os"`
+	Size         int64              `json:"Size"`
+	Config       inspectImageConfig `json:"Config"`
+	RootFS       inspectRootFS      `json:"RootFS"`
+	// Layers are the digests of the stored, usually compressed, layer blobs, which the
+	// diff IDs of RootFS are the uncompressed counterparts of
+	Layers []string `json:"Layers"`
+}
+
+// inspectImageConfig is the part of an image config that containers run with
+type inspectImageConfig struct {
+	User         string              `json:"User"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env"`
+	Cmd          []string            `json:"Cmd"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	Labels       map[string]string   `json:"Labels"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Healthcheck  *HealthConfig       `json:"Healthcheck,omitempty"`
+}
+
+// inspectRootFS lists the diff IDs of an image's layers, bottom first
+type inspectRootFS struct {
+	Type   string   `json:"Type"`
+	Layers []string `json:"Layers"`
+}
+
+// ContainerInspect is what inspect shows about a container, with the field names of
+// `docker container inspect`
+type ContainerInspect struct {
+	ID              string                 `json:"Id"`
+	Created         time.Time              `json:"Created"`
+	Path            string                 `json:"Path"`
+	Args            []string               `json:"Args"`
+	State           inspectState           `json:"State"`
+	Image           string                 `json:"Image"`
+	Name            string                 `json:"Name"`
+	RestartCount    int                    `json:"RestartCount"`
+	Platform        string                 `json:"Platform"`
+	Mounts          []inspectMount         `json:"Mounts"`
+	Config          inspectContainerConfig `json:"Config"`
+	HostConfig      inspectHostConfig      `json:"HostConfig"`
+	GraphDriver     inspectGraphDriver     `json:"GraphDriver"`
+	NetworkSettings inspectNetwork         `json:"NetworkSettings"`
+	// SkippedSetup are the optional setup steps that failed, which Docker has no field for
+	SkippedSetup []string `json:"SkippedSetup,omitempty"`
+	// SizeRw and SizeRootFs are only there with --size, which measures the container
+	SizeRw     *int64 `json:"SizeRw,omitempty"`
+	SizeRootFs *int64 `json:"SizeRootFs,omitempty"`
+}
+
+// inspectState is the state of a container's process
+type inspectState struct {
+	Status     string    `json:"Status"`
+	Running    bool      `json:"Running"`
+	Paused     bool      `json:"Paused"`
+	Restarting bool      `json:"Restarting"`
+	Dead       bool      `json:"Dead"`
+	Pid        int       `json:"Pid"`
+	ExitCode   int       `json:"ExitCode"`
+	StartedAt  time.Time `json:"StartedAt"`
+	FinishedAt time.Time `json:"FinishedAt"`
+	// Health is only there for containers with a healthcheck
+	Health *inspectHealth `json:"Health,omitempty"`
+}
+
+// inspectHealth is what a container's healthcheck found
+type inspectHealth struct {
+	Status        string               `json:"Status"`
+	FailingStreak int                  `json:"FailingStreak"`
+	Log           []inspectHealthProbe `json:"Log"`
+}
+
+// inspectHealthProbe is the outcome of one run of a healthcheck
+type inspectHealthProbe struct {
+	Start    time.Time `json:"Start"`
+	End      time.Time `json:"End"`
+	ExitCode int       `json:"ExitCode"`
+	Output   string    `json:"Output"`
+}
+
+// inspectMount is a bind mount of a container
+type inspectMount struct {
+	Type        string `json:"Type"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	Mode        string `json:"Mode"`
+	RW          bool   `json:"RW"`
+}
+
+// inspectContainerConfig is what a container was created with that isn't host specific
+type inspectContainerConfig struct {
+	Hostname  string   `json:"Hostname"`
+	User      string   `json:"User"`
+	Tty       bool     `json:"Tty"`
+	OpenStdin bool     `json:"OpenStdin"`
+	Env       []string `json:"Env"`
+	Cmd       []string `json:"Cmd"`
+	Image     string   `json:"Image"`
+	// Labels are the container's own, without those of its image
+	Labels map[string]string `json:"Labels"`
+	// Healthcheck is the image's combined with the container's options
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+}
+
+// inspectHostConfig is how a container uses the host: its limits, namespaces and privileges
+type inspectHostConfig struct {
+	NetworkMode    string   `json:"NetworkMode"`
+	IpcMode        string   `json:"IpcMode"`
+	AutoRemove     bool     `json:"AutoRemove"`
+	ReadonlyRootfs bool     `json:"ReadonlyRootfs"`
+	Init           bool     `json:"Init"`
+	CapAdd         []string `json:"CapAdd"`
+	CapDrop        []string `json:"CapDrop"`
+	SecurityOpt    []string `json:"SecurityOpt"`
+	DNS            []string `json:"Dns"`
+	DNSSearch      []string `json:"DnsSearch"`
+	ExtraHosts     []string `json:"ExtraHosts"`
+	Memory         int64    `json:"Memory"`
+	NanoCPUs       int64    `json:"NanoCpus"`
+	PidsLimit      int64    `json:"PidsLimit"`
+	CgroupParent   string   `json:"CgroupParent"`
+	// RestartPolicy is what --restart set, Docker's "no" without it
+	RestartPolicy inspectRestartPolicy `json:"RestartPolicy"`
+}
+
+// inspectRestartPolicy is when a container is restarted after it exits
+type inspectRestartPolicy struct {
+	Name              string `json:"Name"`
+	MaximumRetryCount int    `json:"MaximumRetryCount"`
+}
+
+// inspectGraphDriver describes the root filesystem of a container
+type inspectGraphDriver struct {
+	Name string            `json:"Name"`
+	Data map[string]string `json:"Data"`
+}
+
+// inspectNetwork is the network of a container, by its mode
+type inspectNetwork struct {
+	Networks map[string]inspectEndpoint `json:"Networks"`
+}
+
+// inspectEndpoint is a container's address on a network, empty for host networking
+type inspectEndpoint struct {
+	IPAddress   string `json:"IPAddress"`
+	IPPrefixLen int    `json:"IPPrefixLen"`
+}
+
+// inspectObject returns the container, or else the image, named by ref. kind restricts the
+// lookup to containers or images. With size, a container's disk usage is measured too.
+func inspectObject(store *ImageStore, ref, kind string, size bool) (any, error) {
+	if kind != inspectTypeImage {
+		id, err := resolveContainer(ref)
+		if err == nil {
+			state, err := loadContainerState(id)
+			if err != nil {
+				return nil, err
+			}
+			return inspectContainer(store, state, size)
+		}
+		if kind == inspectTypeContainer || !errors.Is(err, errContainerNotFound) {
+			return nil, err
+		}
+	}
+
+	img, err := store.Lookup(ref)
+	if err != nil {
+		// Refs that aren't valid are no object rather than an error, an ambiguous ID is one
+		if _, _, refErr := parseImageReference(ref); refErr == nil && !errors.Is(err, errImageNotFound) {
+			return nil, err
+		}
+		if kind == "" {
+			return nil, fmt.Errorf("no such object: %s", ref)
+		}
+		return nil, fmt.Errorf("%w: %s", errImageNotFound, ref)
+	}
+
+	return store.inspectImage(img)
+}
+
+// lookupImageID returns the tagged image whose ID, the digest of its config, starts with id,
+// with or without the sha256: prefix
+func (s *ImageStore) lookupImageID(id string) (*StoredImage, error) {
+	prefix := strings.TrimPrefix(id, "sha256:")
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("%w: %s", errImageNotFound, id)
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(index.Repositories))
+	for name := range index.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The image is returned with its first tag, which rmi removes like any other
+	var found *StoredImage
+	for _, name := range names {
+		tags := make([]string, 0, len(index.Repositories[name]))
+		for tag := range index.Repositories[name] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+
+		for _, tag := range tags {
+			img, err := s.lookup(name, tag)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(strings.TrimPrefix(img.Manifest.Config.Digest, "sha256:"), prefix) {
+				continue
+			}
+			if found == nil {
+				found = img
+			} else if found.Manifest.Config.Digest != img.Manifest.Config.Digest {
+				// Images stored with other manifests, e.g. compressed differently, share the ID
+				return nil, fmt.Errorf("image ID %s is ambiguous, give more of it", id)
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", errImageNotFound, id)
+	}
+
+	return found, nil
+}
+
+// inspectImage describes a stored image, with every tag that points at its manifest
+func (s *ImageStore) inspectImage(img *StoredImage) (*ImageInspect, error) {
+	data, err := s.readBlob(img.Manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Created      time.Time          `json:"created"`
+		Author       string             `json:"author"`
+		OS           string             `json:"os"`
+		Architecture string             `json:"architecture"`
+		Variant      string             `json:"variant"`
+		Config       inspectImageConfig `json:"config"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse image config of %s: %w", shortDigest(img.Digest), err)
+	}
+
+	info := &ImageInspect{
+		ID:           img.Manifest.Config.Digest,
+		RepoTags:     []string{},
+		RepoDigests:  []string{},
+		Created:      config.Created,
+		Author:       config.Author,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		Os:           config.OS,
+		Size:         img.Manifest.Config.Size,
+		Config:       config.Config,
+		RootFS:       inspectRootFS{Type: config.RootFS.Type, Layers: config.RootFS.DiffIDs},
+		Layers:       []string{},
+	}
+	for _, layer := range img.Manifest.Layers {
+		info.Size += layer.Size
+		info.Layers = append(info.Layers, layer.Digest)
+	}
+	if info.RootFS.Layers == nil {
+		info.RootFS.Layers = []string{}
+	}
+
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	for name, tags := range index.Repositories {
+		for tag, digest := range tags {
+			if digest != img.Digest {
+				continue
+			}
+			digested := name + "@" + digest
+			if pinnedDigest(tag) == "" && tag != "" {
+				info.RepoTags = append(info.RepoTags, formatImageReference(name, tag))
+			}
+			if name != "" && !slices.Contains(info.RepoDigests, digested) {
+				info.RepoDigests = append(info.RepoDigests, digested)
+			}
+		}
+	}
+	sort.Strings(info.RepoTags)
+	sort.Strings(info.RepoDigests)
+
+	return info, nil
+}
+
+// inspectContainer describes a container from its state, and with size how much disk it uses
+func inspectContainer(store *ImageStore, state *ContainerState, size bool) (*ContainerInspect, error) {
+	opts := state.Config
+	running := state.running()
+	labels := opts.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	info := &ContainerInspect{
+		ID:      state.ID,
+		Created: state.Created,
+		Path:    opts.Command,
+		Args:    nonNil(opts.Args),
+		State: inspectState{
+			Status:     state.Status,
+			Running:    running,
+			Restarting: state.restarting(),
+			ExitCode:   state.ExitCode,
+			StartedAt:  state.Started,
+			FinishedAt: state.Finished,
+		},
+		Name:         "/" + state.Name,
+		RestartCount: state.RestartCount,
+		Platform:     "linux",
+		Mounts:       []inspectMount{},
+		Config: inspectContainerConfig{
+			Hostname:  state.Hostname,
+			User:      opts.User,
+			Tty:       opts.TTY,
+			OpenStdin: opts.Interactive,
+			Env:       nonNil(opts.Env),
+			Cmd:       append([]string{opts.Command}, opts.Args...),
+			Image:     opts.Image,
+			Labels:    labels,
+
+			Healthcheck: opts.Healthcheck,
+		},
+		HostConfig: inspectHostConfig{
+			NetworkMode:    string(opts.Network),
+			IpcMode:        string(opts.IPC),
+			AutoRemove:     opts.AutoRemove,
+			ReadonlyRootfs: opts.ReadOnlyRootfs,
+			Init:           !opts.NoInit,
+			CapAdd:         nonNil(opts.CapAdd),
+			CapDrop:        nonNil(opts.CapDrop),
+			SecurityOpt:    nonNil(opts.SecurityOpts),
+			DNS:            nonNil(opts.DNS),
+			DNSSearch:      nonNil(opts.DNSSearch),
+			ExtraHosts:     nonNil(opts.ExtraHosts),
+			Memory:         opts.Limits.Memory,
+			NanoCPUs:       int64(opts.Limits.CPUs * 1e9),
+			PidsLimit:      opts.Limits.PidsLimit,
+			CgroupParent:   opts.CgroupParent,
+			RestartPolicy:  inspectRestartPolicy{Name: opts.Restart.Name, MaximumRetryCount: opts.Restart.MaximumRetryCount},
+		},
+		NetworkSettings: inspectNetwork{Networks: map[string]inspectEndpoint{}},
+		SkippedSetup:    state.SkippedSetup,
+	}
+	if running {
+		info.State.Pid = state.Pid
+	} else if state.Status == statusRunning || state.Status == statusRestarting && !info.State.Restarting {
+		// The shim died before it could record the exit or restart the container
+		info.State.Status = statusExited
+	}
+	if state.Health != nil {
+		health := &inspectHealth{Status: state.Health.Status, FailingStreak: state.Health.FailingStreak, Log: []inspectHealthProbe{}}
+		for _, p := range state.Health.Log {
+			health.Log = append(health.Log, inspectHealthProbe{Start: p.Start, End: p.End, ExitCode: p.ExitCode, Output: p.Output})
+		}
+		info.State.Health = health
+	}
+	if info.HostConfig.RestartPolicy.Name == "" {
+		info.HostConfig.RestartPolicy.Name = restartNo
+	}
+	if info.HostConfig.IpcMode == "" {
+		info.HostConfig.IpcMode = "private"
+	}
+
+	if state.ImageDigest != "" {
+		if img, err := store.imageByDigest(state.ImageDigest); err == nil {
+			info.Image = img.Manifest.Config.Digest
+		}
+	}
+
+	for _, m := range opts.Mounts {
+		mount := inspectMount{Type: "bind", Source: m.Source, Destination: m.Target, RW: !m.ReadOnly}
+		if m.ReadOnly {
+			mount.Mode = "ro"
+		}
+		info.Mounts = append(info.Mounts, mount)
+	}
+
+	if len(state.Layers) > 0 {
+		info.GraphDriver = inspectGraphDriver{Name: "overlay", Data: map[string]string{
+			"LowerDir":  strings.Join(state.Layers, ":"),
+			"MergedDir": state.RootPath + "/merged",
+		}}
+	} else {
+		dir := state.RootPath
+		if opts.SharedRootfs {
+			dir = state.LowerDir
+		}
+		info.GraphDriver = inspectGraphDriver{Name: "vfs", Data: map[string]string{"Dir": dir}}
+	}
+
+	endpoint := inspectEndpoint{}
+	if ip, subnet, err := net.ParseCIDR(state.Network.Address); err == nil {
+		endpoint.IPAddress = ip.String()
+		endpoint.IPPrefixLen, _ = subnet.Mask.Size()
+	}
+	info.NetworkSettings.Networks[string(opts.Network)] = endpoint
+
+	if size {
+		size, err := measureContainerSize(state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure %s: %w", state.ID, err)
+		}
+		info.SizeRw, info.SizeRootFs = &size.RW, &size.RootFs
+	}
+
+	return info, nil
+}
+
+// nonNil returns s, or an empty slice instead of nil so that it is encoded like Docker's []
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
+
+// inspectTemplateFuncs are the functions of Docker's --format templates that scripts use most
+var inspectTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join": func(list []any, sep string) string {
+		parts := make([]string, len(list))
+		for i, v := range list {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, sep)
+	},
+	"split": strings.Split,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// printInspected writes the objects as an indented JSON array like Docker, or with format,
+// a Go template, once per object
+func printInspected(w io.Writer, objects []any, format string) error {
+	if format == "" || format == "json" {
+		data, err := json.MarshalIndent(objects, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	tmpl, err := template.New("format").Funcs(inspectTemplateFuncs).Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid --format template: %w", err)
+	}
+	for _, obj := range objects {
+		// Like Docker's, templates see the JSON document, so fields have its names such as
+		// .Id, and numbers aren't turned into floats
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		var doc any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, doc); err != nil {
+			return fmt.Errorf("failed to execute --format template: %w", err)
+		}
+		fmt.Fprintln(w, b.String())
+	}
+
+	return nil
+}
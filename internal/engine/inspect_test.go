@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectContainerSize(t *testing.T) {
+	// A copied rootfs, which has grown by what the container wrote since it was unpacked
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "image-file"), bytes.Repeat([]byte("i"), 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imageSize, err := dirSize(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "written"), bytes.Repeat([]byte("w"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	total, err := dirSize(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &ContainerState{ID: "c0ffee", Name: "web", Status: statusExited, RootPath: root, ImageSize: imageSize}
+
+	for _, size := range []bool{false, true} {
+		info, err := inspectContainer(nil, state, size)
+		if err != nil {
+			t.Fatalf("inspectContainer(size %v) error = %v", size, err)
+		}
+		var out bytes.Buffer
+		if err := printInspected(&out, []any{info}, ""); err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]any
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil || len(got) != 1 {
+			t.Fatalf("output %s isn't an array of one object: %v", out.Bytes(), err)
+		}
+
+		rw, hasRW := got[0]["SizeRw"]
+		rootFs, hasRootFs := got[0]["SizeRootFs"]
+		if !size {
+			if hasRW || hasRootFs {
+				t.Errorf("without --size: SizeRw %v and SizeRootFs %v, want neither", rw, rootFs)
+			}
+			continue
+		}
+		if rw != float64(total-imageSize) || rootFs != float64(total) {
+			t.Errorf("with --size: SizeRw %v and SizeRootFs %v, want %d and %d", rw, rootFs, total-imageSize, total)
+		}
+
+		// Templates see the sizes as the integers they are, not floats such as 1.2288e+04
+		out.Reset()
+		if err := printInspected(&out, []any{info}, "{{.SizeRw}} {{.SizeRootFs}}"); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%d %d\n", total-imageSize, total); out.String() != want {
+			t.Errorf("formatted sizes = %q, want %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// IPCMode selects whose System V IPC objects and POSIX shared memory a container sees
+type IPCMode string
+
+const (
+	// IPCPrivate gives the container an IPC namespace and /dev/shm of its own
+	IPCPrivate IPCMode = "private"
+	// IPCShareable is IPCPrivate, except that other containers may join it
+	IPCShareable IPCMode = "shareable"
+	// IPCHost shares the host's IPC namespace and /dev/shm
+	IPCHost IPCMode = "host"
+)
+
+// hostShmDir is the host's POSIX shared memory, which IPCHost containers mount
+const hostShmDir = "/dev/shm"
+
+// ipcContainerPrefix joins the IPC namespace of a shareable container, e.g. container:db
+const ipcContainerPrefix = "container:"
+
+// ipcNamespaceFd is the file descriptor of the IPC namespace a joining init enters
+const ipcNamespaceFd = 5
+
+// ParseIPCMode validates the value of the --ipc flag
+func ParseIPCMode(value string) (IPCMode, error) {
+	if ref, ok := strings.CutPrefix(value, ipcContainerPrefix); ok {
+		if ref == "" {
+			return "", fmt.Errorf("invalid IPC mode %q: expected container:<name|id>", value)
+		}
+		return IPCMode(value), nil
+	}
+
+	switch mode := IPCMode(value); mode {
+	case IPCPrivate, IPCShareable, IPCHost:
+		return mode, nil
+	case "":
+		// Objects left in the host's namespace could otherwise clash with the host's services
+		return IPCPrivate, nil
+	default:
+		return "", fmt.Errorf("unsupported IPC mode %q: expected private, shareable, host or container:<name|id>", value)
+	}
+}
+
+// container returns the container whose IPC namespace this mode joins
+func (m IPCMode) container() (string, bool) {
+	return strings.CutPrefix(string(m), ipcContainerPrefix)
+}
+
+// ownsShm reports whether /dev/shm is provided for the mode instead of the default tmpfs
+func (m IPCMode) ownsShm() bool {
+	_, joins := m.container()
+	return m == IPCShareable || m == IPCHost || joins
+}
+
+// cloneFlags returns the namespace the init is created in for the mode. Joined namespaces
+// are entered by the init instead.
+func (m IPCMode) cloneFlags() uintptr {
+	if _, joins := m.container(); joins || m == IPCHost {
+		return 0
+	}
+
+	return syscall.CLONE_NEWIPC
+}
+
+// ipcShmDir is where the /dev/shm of a shareable container is mounted on the host, so the
+// containers joining it can mount it too
+func ipcShmDir(id string) string {
+	return filepath.Join(containerDir(id), "shm")
+}
+
+// mountShareableShm mounts the tmpfs that is the /dev/shm of a shareable container
+func mountShareableShm(id string) (string, error) {
+	dir := ipcShmDir(id)
+	if isMountPoint(dir) {
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	data := fmt.Sprintf("mode=1777,size=%d", devShmTmpfs.Size)
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, data); err != nil {
+		return "", fmt.Errorf("failed to mount shared memory of %s: %w", id, err)
+	}
+	debugf(eventTypeContainer, "mounted shareable shm", "target", dir, "options", data)
+
+	return dir, nil
+}
+
+// unmountShareableShm unmounts a shareable container's /dev/shm. Containers still using it
+// keep their mounts of it.
+func unmountShareableShm(dir string) error {
+	if !isMountPoint(dir) {
+		return nil
+	}
+
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// ipcConnection is what a starting container needs to share the IPC of a shareable one
+type ipcConnection struct {
+	// namespace is the owner's IPC namespace, which the init joins
+	namespace *os.File
+	// shm is the owner's /dev/shm on the host
+	shm string
+}
+
+// joinIPC opens the IPC namespace and /dev/shm of the running shareable container id
+func joinIPC(id string) (*ipcConnection, error) {
+	owner, err := loadContainerState(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join IPC namespace: %w", err)
+	}
+	if owner.Config.IPC != IPCShareable {
+		return nil, fmt.Errorf("failed to join IPC namespace of %s: it must be started with --ipc shareable", shortID(id))
+	}
+	if !owner.running() {
+		return nil, fmt.Errorf("failed to join IPC namespace of %s: the container is not running", shortID(id))
+	}
+
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/ipc", owner.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IPC namespace of %s: %w", shortID(id), err)
+	}
+
+	// The pid could have been reused between the check and the open
+	if !owner.running() {
+		ns.Close()
+		return nil, fmt.Errorf("failed to join IPC namespace of %s: the container is not running", shortID(id))
+	}
+
+	return &ipcConnection{namespace: ns, shm: owner.IPCShm}, nil
+}
+
+// close releases the namespace once the init has been started with it
+func (c *ipcConnection) close() {
+	if c != nil {
+		c.namespace.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Compressions of the layers commit and build write
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionNone = "none"
+)
+
+// Media types of zstd and uncompressed layers, which only OCI has
+const (
+	mediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeOCILayerTar  = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// ociLayerMediaTypes are the OCI media types of Docker's layer types, for the layers of an
+// image that is written as an OCI one
+var ociLayerMediaTypes = map[string]string{
+	mediaTypeDockerLayer: mediaTypeOCILayer,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip",
+}
+
+// layerCompression is how commit and build compress the layers they write: with gzip, which
+// every registry and runtime takes, with zstd, which makes smaller layers that unpack faster,
+// or not at all. The zero value is gzip at its default level.
+type layerCompression struct {
+	format string
+	// level is the compression level, 0 for the format's default
+	level int
+}
+
+// parseLayerCompression parses a --compression value: gzip or zstd, optionally followed by
+// :<level>, or none
+func parseLayerCompression(s string) (layerCompression, error) {
+	format, level, hasLevel := strings.Cut(s, ":")
+	var minLevel, maxLevel int
+	switch format {
+	case compressionGzip:
+		minLevel, maxLevel = gzip.BestSpeed, gzip.BestCompression
+	case compressionZstd:
+		minLevel, maxLevel = zstdMinLevel, zstdMaxLevel
+	case compressionNone:
+		if hasLevel {
+			return layerCompression{}, fmt.Errorf("invalid compression %q: none has no level", s)
+		}
+		return layerCompression{format: format}, nil
+	default:
+		return layerCompression{}, fmt.Errorf("invalid compression %q: expected gzip[:level], zstd[:level] or none", s)
+	}
+
+	c := layerCompression{format: format}
+	if hasLevel {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < minLevel || n > maxLevel {
+			return layerCompression{}, fmt.Errorf("invalid compression %q: the level of %s goes from %d to %d", s, format, minLevel, maxLevel)
+		}
+		c.level = n
+	}
+
+	return c, nil
+}
+
+// String returns the compression the way --compression takes it
+func (c layerCompression) String() string {
+	s := cmp.Or(c.format, compressionGzip)
+	if c.level != 0 {
+		s += ":" + strconv.Itoa(c.level)
+	}
+
+	return s
+}
+
+// newWriter returns a writer compressing a layer into w, which the writer's Close leaves
+// open
+func (c layerCompression) newWriter(w io.Writer) io.WriteCloser {
+	switch c.format {
+	case compressionZstd:
+		return newZstdWriter(w, cmp.Or(c.level, zstdDefaultLevel))
+	case compressionNone:
+		return nopWriteCloser{w}
+	default:
+		// Only levels parseLayerCompression refuses make this fail
+		zw, _ := gzip.NewWriterLevel(w, cmp.Or(c.level, gzip.DefaultCompression))
+		return zw
+	}
+}
+
+// mediaType returns the media type of a layer in this compression, Docker's one if docker
+// is set and Docker has one
+func (c layerCompression) mediaType(docker bool) string {
+	switch {
+	case c.format == compressionZstd:
+		return mediaTypeOCILayerZstd
+	case c.format == compressionNone:
+		return mediaTypeOCILayerTar
+	case docker:
+		return mediaTypeDockerLayer
+	default:
+		return mediaTypeOCILayer
+	}
+}
+
+// nopWriteCloser is the writer of uncompressed layers
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLayerCompression(t *testing.T) {
+	tests := []struct {
+		in         string
+		want       string
+		wantDocker string
+		wantOCI    string
+		wantErr    string
+	}{
+		{in: "gzip", want: "gzip", wantDocker: mediaTypeDockerLayer, wantOCI: mediaTypeOCILayer},
+		{in: "gzip:9", want: "gzip:9", wantDocker: mediaTypeDockerLayer, wantOCI: mediaTypeOCILayer},
+		{in: "zstd", want: "zstd", wantDocker: mediaTypeOCILayerZstd, wantOCI: mediaTypeOCILayerZstd},
+		{in: "zstd:19", want: "zstd:19", wantDocker: mediaTypeOCILayerZstd, wantOCI: mediaTypeOCILayerZstd},
+		{in: "none", want: "none", wantDocker: mediaTypeOCILayerTar, wantOCI: mediaTypeOCILayerTar},
+		{in: "gzip:0", wantErr: "the level of gzip goes from 1 to 9"},
+		{in: "zstd:20", wantErr: "the level of zstd goes from 1 to 19"},
+		{in: "zstd:fast", wantErr: "the level of zstd goes from 1 to 19"},
+		{in: "none:1", wantErr: "none has no level"},
+		{in: "lz4", wantErr: "expected gzip[:level], zstd[:level] or none"},
+		{in: "", wantErr: "expected gzip[:level], zstd[:level] or none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseLayerCompression(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseLayerCompression(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLayerCompression(%q) error = %v", tt.in, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("String() = %q, want %q", got.String(), tt.want)
+			}
+			if got := got.mediaType(true); got != tt.wantDocker {
+				t.Errorf("mediaType(true) = %q, want %q", got, tt.wantDocker)
+			}
+			if got := got.mediaType(false); got != tt.wantOCI {
+				t.Errorf("mediaType(false) = %q, want %q", got, tt.wantOCI)
+			}
+		})
+	}
+
+	var zero layerCompression
+	if zero.String() != "gzip" || zero.mediaType(true) != mediaTypeDockerLayer {
+		t.Errorf("zero value = %q with Docker media type %q, want gzip", zero.String(), zero.mediaType(true))
+	}
+}
@@ -0,0 +1,342 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Entries in a root filesystem while its layers are applied. They are gone once the last
+// layer is, so containers never see them.
+const (
+	// layerJournalName records the layers extracted and applied so far
+	layerJournalName = ".your-docker-layers"
+	// layerStagingName is where a layer is extracted before it is moved into place
+	layerStagingName = ".your-docker-staging"
+	// layerDownloadPrefix starts the names of directly downloaded layer tarballs, followed by
+	// the digest so an interrupted download resumes only into the same layer
+	layerDownloadPrefix = ".your-docker-download-"
+)
+
+// Journal actions: a layer's extraction into the staging directory completed, or all its
+// files were moved into the root filesystem
+const (
+	journalExtracted = "extracted"
+	journalApplied   = "applied"
+)
+
+// layerJournal is the record of a root filesystem being assembled from layers, so an
+// interrupted assembly resumes after the last layer that completed. A layer is extracted
+// completely before anything of it is applied, and applying it only moves files, which can be
+// picked up where it stopped; a half-extracted layer is never applied and no layer twice.
+type layerJournal struct {
+	f *os.File
+	// applied are the digests of the layers applied, in order
+	applied []string
+	// extracted is the layer waiting in the staging directory, if any
+	extracted string
+}
+
+// openLayerJournal opens the journal of the root filesystem, creating an empty one
+func openLayerJournal(root string) (*layerJournal, error) {
+	f, err := os.OpenFile(filepath.Join(root, layerJournalName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer journal: %w", err)
+	}
+
+	j := &layerJournal{f: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		action, digest, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			// A line cut short by the interruption, the step it records didn't complete
+			continue
+		}
+		switch action {
+		case journalExtracted:
+			j.extracted = digest
+		case journalApplied:
+			j.applied = append(j.applied, digest)
+			j.extracted = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read layer journal: %w", err)
+	}
+
+	return j, nil
+}
+
+// record appends a completed step and makes sure it is on disk before the next one starts
+func (j *layerJournal) record(action, digest string) error {
+	if _, err := fmt.Fprintf(j.f, "%s %s\n", action, digest); err != nil {
+		return fmt.Errorf("failed to write layer journal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failed to write layer journal: %w", err)
+	}
+
+	switch action {
+	case journalExtracted:
+		j.extracted = digest
+	case journalApplied:
+		j.applied = append(j.applied, digest)
+		j.extracted = ""
+	}
+
+	return nil
+}
+
+// resumes reports whether the layers applied so far are the first ones of layers, so the
+// assembly can go on with the rest
+func (j *layerJournal) resumes(layers []layerEntry) bool {
+	if len(j.applied) > len(layers) {
+		return false
+	}
+	for i, digest := range j.applied {
+		if layers[i].Digest != digest {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reset forgets every step, for a root filesystem that is emptied to start over
+func (j *layerJournal) reset() error {
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset layer journal: %w", err)
+	}
+	j.applied, j.extracted = nil, ""
+
+	return nil
+}
+
+// layerSource returns the tarball of a layer to extract and a function to call once it has
+// been extracted
+type layerSource func(layer layerEntry) (string, func(), error)
+
+// applyLayers assembles the root filesystem from layers, bottom first, resuming where an
+// earlier assembly of the same layers was interrupted. A root filesystem left half-assembled
+// from other layers, e.g. after the tag moved on, is emptied first.
+func applyLayers(root string, layers []layerEntry, steps *setupSteps, source layerSource) error {
+	j, err := openLayerJournal(root)
+	if err != nil {
+		return err
+	}
+	defer j.f.Close()
+
+	if !j.resumes(layers) {
+		warnf(eventTypeImage, "%s was partly assembled from another image, starting over", root)
+		if err := clearDir(root, true); err != nil {
+			return err
+		}
+		if err := j.reset(); err != nil {
+			return err
+		}
+	}
+
+	staging := filepath.Join(root, layerStagingName)
+	for i, layer := range layers {
+		if i < len(j.applied) {
+			imageProgress(shortDigest(layer.Digest), "Already applied")
+			continue
+		}
+
+		if j.extracted != layer.Digest {
+			if err := extractStaged(staging, layer, source, steps); err != nil {
+				return err
+			}
+			if err := j.record(journalExtracted, layer.Digest); err != nil {
+				return err
+			}
+		}
+
+		if err := mergeLayer(staging, root, true); err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+		}
+		if err := j.record(journalApplied, layer.Digest); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(staging); err != nil {
+			return fmt.Errorf("failed to remove staged layer: %w", err)
+		}
+	}
+
+	// Nothing is left to resume, and nothing of the assembly may show up in the container
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return fmt.Errorf("failed to clean up after applying layers: %w", err)
+	}
+	for _, e := range entries {
+		if !reservedLayerEntry(e.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			return fmt.Errorf("failed to clean up after applying layers: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// extractStaged extracts a layer into an empty staging directory, throwing away whatever an
+// interrupted extraction left there
+func extractStaged(staging string, layer layerEntry, source layerSource, steps *setupSteps) error {
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to remove staged layer: %w", err)
+	}
+	if err := os.Mkdir(staging, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	path, done, err := source(layer)
+	if err != nil {
+		return err
+	}
+
+	if err := extractTarball(staging, path, layer, steps); err != nil {
+		return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
+	}
+	done()
+
+	return nil
+}
+
+// reservedLayerEntry reports whether a name at the top of a root filesystem belongs to the
+// assembly rather than the image
+func reservedLayerEntry(name string) bool {
+	return name == layerJournalName || name == layerStagingName || strings.HasPrefix(name, layerDownloadPrefix)
+}
+
+// mergeLayer moves the files of an extracted layer into dst, applying its whiteouts first: a
+// .wh..wh..opq empties the directory it is in, a .wh.<name> deletes name. Every step removes
+// what it is done with from the layer, so running it again after an interruption carries on
+// where it stopped. top is set for the root of the filesystem, whose assembly entries are
+// left alone.
+func mergeLayer(src, dst string, top bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Name() != whiteoutOpaque {
+			continue
+		}
+		if err := clearDir(dst, top); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(src, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if name == whiteoutOpaque || !strings.HasPrefix(name, whiteoutPrefix) {
+			continue
+		}
+		if target := strings.TrimPrefix(name, whiteoutPrefix); !(top && reservedLayerEntry(target)) {
+			if err := os.RemoveAll(filepath.Join(dst, target)); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(filepath.Join(src, name)); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, whiteoutPrefix) || (top && reservedLayerEntry(name)) {
+			continue
+		}
+
+		s, d := filepath.Join(src, name), filepath.Join(dst, name)
+		if !e.IsDir() {
+			if err := os.RemoveAll(d); err != nil {
+				return err
+			}
+			if err := os.Rename(s, d); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Directories are merged rather than moved, so the whiteouts inside are applied
+		// and those of lower layers keep their other files
+		if info, err := os.Lstat(d); err != nil || !info.IsDir() {
+			if err := os.RemoveAll(d); err != nil {
+				return err
+			}
+			if err := os.Mkdir(d, 0755); err != nil {
+				return err
+			}
+		}
+		if err := mergeLayer(s, d, false); err != nil {
+			return err
+		}
+		if err := copyDirMetadata(s, d); err != nil {
+			return err
+		}
+		if err := os.Remove(s); err != nil {
+			return err
+		}
+	}
+
+	if top {
+		return copyDirMetadata(src, dst)
+	}
+
+	return nil
+}
+
+// copyDirMetadata gives dst the owner, mode and modification time of the directory src
+func copyDirMetadata(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, time.Time{}, info.ModTime())
+}
+
+// clearDir removes everything in dir, except for the assembly's own entries at the top of a
+// root filesystem
+func clearDir(dir string, top bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		if top && reservedLayerEntry(e.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
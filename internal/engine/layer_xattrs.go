@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// paxXattrPrefix starts the PAX records tar archives keep extended attributes in, such as
+// the security.capability that lets an unprivileged ping open raw sockets
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileXattr is an extended attribute of a file of a layer
+type fileXattr struct {
+	path  string
+	name  string
+	value string
+}
+
+// layerXattrs reads the extended attributes of a layer's files from its tar stream while tar
+// extracts it. GNU tar only sets them with --xattrs, which busybox tar doesn't know, so they
+// are set afterwards instead.
+type layerXattrs struct {
+	pw    *io.PipeWriter
+	done  chan struct{}
+	attrs []fileXattr
+}
+
+// newLayerXattrs starts reading a tar stream written to the returned layerXattrs
+func newLayerXattrs() *layerXattrs {
+	pr, pw := io.Pipe()
+	x := &layerXattrs{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(x.done)
+		// Whatever is left is drained, so the extraction never blocks on us
+		defer io.Copy(io.Discard, pr)
+
+		tr := tar.NewReader(pr)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return
+			}
+			// Symlinks and devices don't take the attributes images have
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+				continue
+			}
+			for key, value := range hdr.PAXRecords {
+				if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+					x.attrs = append(x.attrs, fileXattr{path: path.Clean(hdr.Name), name: name, value: value})
+				}
+			}
+		}
+	}()
+
+	return x
+}
+
+func (x *layerXattrs) Write(p []byte) (int, error) {
+	return x.pw.Write(p)
+}
+
+// wait ends the stream and waits until it has been read
+func (x *layerXattrs) wait() {
+	x.pw.Close()
+	<-x.done
+}
+
+// apply sets the attributes on the extracted files in root. Filesystems without support for
+// them, and attributes like trusted.* that need privileges we may not have, fail it.
+func (x *layerXattrs) apply(root string) error {
+	var failed []string
+	var firstErr error
+	for _, attr := range x.attrs {
+		target, err := secureJoin(root, attr.path)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				// A later entry of the layer replaced the file with a link
+				continue
+			}
+		}
+		if err == nil {
+			err = syscall.Setxattr(target, attr.name, []byte(attr.value), 0)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s on /%s", attr.name, attr.path))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(failed) == 1:
+		return fmt.Errorf("failed to set %s: %w", failed[0], firstErr)
+	default:
+		return fmt.Errorf("failed to set %s and %d more: %w", failed[0], len(failed)-1, firstErr)
+	}
+}
@@ -0,0 +1,292 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// defaultStopTimeout is how long stop waits after SIGTERM before killing the container
+const defaultStopTimeout = 10 * time.Second
+
+// shimExitTimeout bounds how long we wait for a shim to record a container's exit
+const shimExitTimeout = 10 * time.Second
+
+// startContainer starts a created or exited container in the background
+func startContainer(id string) error {
+	// Keeps an expired container from being removed while it starts again
+	lock, err := lockState(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	env, err := loadContainerEnvironment(id)
+	if err != nil {
+		return err
+	}
+	if env.state.running() {
+		return nil
+	}
+
+	// Started by hand, the restart policy starts over
+	env.state.RestartCount, env.state.RestartDelay, env.state.StoppedByUser = 0, 0, false
+	if err := env.state.save(); err != nil {
+		return err
+	}
+
+	return env.start()
+}
+
+// start runs the container under its shim without attaching to it. A container with a tty
+// still gets one, which the shim drains.
+func (env *ContainerEnvironment) start() error {
+	var err error
+	var stdio [3]*os.File
+	var pty *os.File
+	if env.tty {
+		var slave *os.File
+		if pty, slave, err = openPty(); err != nil {
+			return fmt.Errorf("failed to allocate a terminal: %w", err)
+		}
+		defer pty.Close()
+		defer slave.Close()
+		stdio = [3]*os.File{slave, slave, slave}
+	}
+
+	_, err = env.startShim(stdio, pty, false)
+	return err
+}
+
+// openContainerPidfd returns a pidfd of the container's init, making sure it is still the
+// process recorded in the state
+func openContainerPidfd(state *ContainerState) (*os.File, error) {
+	if !state.running() {
+		return nil, fmt.Errorf("container %s is not running", state.ID)
+	}
+
+	pidfd, err := pidfdOpen(state.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pidfd pins the process, so checking its start time now rules out a reused pid
+	if start, err := processStartTime(state.Pid); err != nil || start != state.PidStartTime {
+		pidfd.Close()
+		return nil, fmt.Errorf("container %s is not running", state.ID)
+	}
+
+	return pidfd, nil
+}
+
+// signalContainer sends sig to the container's init and returns a pidfd to wait on
+func signalContainer(state *ContainerState, sig syscall.Signal) (*os.File, error) {
+	pidfd, err := openContainerPidfd(state)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pidfdSendSignal(pidfd, sig); err != nil {
+		pidfd.Close()
+		return nil, err
+	}
+
+	return pidfd, nil
+}
+
+// stopContainer asks the container to exit with SIGTERM and kills it once timeout has passed.
+// Its restart policy doesn't restart it until it is started again.
+func stopContainer(id string, timeout time.Duration) error {
+	return stopContainerWithSignal(id, syscall.SIGTERM, timeout)
+}
+
+// stopContainerWithSignal stops the container like stopContainer, asking it to exit with sig
+// rather than SIGTERM
+func stopContainerWithSignal(id string, sig syscall.Signal, timeout time.Duration) error {
+	state, err := stopRestarts(id)
+	if err != nil {
+		return err
+	}
+	if state.restarting() {
+		// Its shim records the exit instead of restarting it
+		if _, err := waitForExit(id, shimExitTimeout); err != nil {
+			return err
+		}
+		containerEvent(eventActionStop, id, nil)
+		return nil
+	}
+	if !state.running() {
+		return nil
+	}
+
+	pidfd, err := signalContainer(state, sig)
+	if err != nil {
+		return err
+	}
+	defer pidfd.Close()
+
+	containerEvent(eventActionKill, id, map[string]string{"signal": signalName(sig)})
+
+	exited := false
+	if timeout > 0 {
+		if exited, err = waitForPidfd(pidfd, timeout); err != nil {
+			return err
+		}
+	}
+
+	if !exited {
+		if err := pidfdSendSignal(pidfd, syscall.SIGKILL); err != nil {
+			return err
+		}
+		containerEvent(eventActionKill, id, map[string]string{"signal": "SIGKILL"})
+	}
+
+	if _, err := waitForExit(id, shimExitTimeout); err != nil {
+		return err
+	}
+	containerEvent(eventActionStop, id, nil)
+
+	return nil
+}
+
+// killContainer kills the container's processes and waits until the exit is recorded
+func killContainer(id string) error {
+	return signalContainerProcesses(id, syscall.SIGKILL, false)
+}
+
+// signalContainerProcesses sends sig to the container's init, or with all to every process
+// in its PID namespace, init last. Only SIGKILL waits for the exit to be recorded, other
+// signals may well be handled, like SIGHUP reloading a server's configuration. Like stop,
+// SIGKILL keeps the restart policy from restarting the container.
+func signalContainerProcesses(id string, sig syscall.Signal, all bool) error {
+	var state *ContainerState
+	var err error
+	if sig == syscall.SIGKILL {
+		state, err = stopRestarts(id)
+	} else {
+		state, err = loadContainerState(id)
+	}
+	if err != nil {
+		return err
+	}
+	if sig == syscall.SIGKILL && state.restarting() {
+		_, err = waitForExit(id, shimExitTimeout)
+		return err
+	}
+
+	if all {
+		if err := signalNamespaceProcesses(state, sig); err != nil {
+			return err
+		}
+	}
+
+	pidfd, err := signalContainer(state, sig)
+	if err != nil {
+		return err
+	}
+	pidfd.Close()
+	containerEvent(eventActionKill, id, map[string]string{"signal": signalName(sig)})
+
+	if sig != syscall.SIGKILL {
+		return nil
+	}
+	_, err = waitForExit(id, shimExitTimeout)
+	return err
+}
+
+// signalNamespaceProcesses sends sig to the processes in the container's PID namespace
+// other than its init
+func signalNamespaceProcesses(state *ContainerState, sig syscall.Signal) error {
+	pidfd, err := openContainerPidfd(state)
+	if err != nil {
+		return err
+	}
+	// Pins init, so its namespace can't be mistaken for a later one's
+	defer pidfd.Close()
+
+	pids, err := namespaceProcesses(state.Pid)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if pid == state.Pid {
+			continue
+		}
+		// The process may have exited since
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to signal process %d: %w", pid, err)
+		}
+	}
+
+	return nil
+}
+
+// updateContainer changes the limits of a container to those set in changes. A running
+// container's cgroup is rewritten right away, others get the limits with their next start;
+// either way they are kept in the state.
+func updateContainer(id string, changes ResourceLimits) error {
+	lock, err := lockState(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if err != nil {
+		return err
+	}
+
+	limits := state.Config.Limits.merge(changes)
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	if state.running() {
+		// Moving the processes of a running container into a new cgroup could miss those it
+		// forks meanwhile
+		if state.Cgroup == "" {
+			return fmt.Errorf("container %s was started without a cgroup, stop it to change its limits for the next start", id)
+		}
+		cg := &containerCgroup{path: state.Cgroup}
+		if err := cg.update(limits); err != nil {
+			return fmt.Errorf("failed to update limits of %s: %w", id, err)
+		}
+	}
+
+	state.Config.Limits = limits
+	if err := state.save(); err != nil {
+		return err
+	}
+	containerEvent(eventActionUpdate, id, nil)
+
+	return nil
+}
+
+// removeContainer deletes a container. Running containers are only removed with force, which
+// kills them first.
+func removeContainer(id string, force bool) error {
+	state, err := loadContainerState(id)
+	if err != nil {
+		return err
+	}
+
+	if state.running() || state.restarting() {
+		if !force {
+			return fmt.Errorf("cannot remove %s container %s: stop the container before removing or use -f", state.Status, id)
+		}
+		if err := killContainer(id); err != nil {
+			return err
+		}
+	}
+
+	// Let a shim that is still cleaning up finish before its state goes away
+	if state, err = waitForExit(id, shimExitTimeout); err != nil {
+		return err
+	}
+
+	// Only what's recorded is needed, the options may no longer validate on this host
+	env := &ContainerEnvironment{id: state.ID, state: state, rootPath: state.RootPath, layers: state.Layers}
+	return env.Remove()
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Global options that come before the command and set how much logSink prints
+const (
+	debugArg    = "--debug"
+	logLevelArg = "--log-level"
+)
+
+// errInvalidGlobalOption is returned for a global option that is given wrong
+var errInvalidGlobalOption = errors.New("invalid")
+
+// shimLogLevelEnv hands the log level to the shim, which removes it again before the
+// container inherits its environment
+const shimLogLevelEnv = "_YOUR_DOCKER_LOG_LEVEL"
+
+// logLevel is the least severe level logSink prints, warnings unless asked for more
+var logLevel = func() *slog.LevelVar {
+	v := new(slog.LevelVar)
+	v.Set(slog.LevelWarn)
+	return v
+}()
+
+// logger writes the records of logSink and the failures of commands
+var logger = slog.New(slog.NewTextHandler(logWriter{}, &slog.HandlerOptions{Level: logLevel}))
+
+// parseLogLevel parses the value of --log-level
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("%w %s %q: expected debug, info, warn or error", errInvalidGlobalOption, logLevelArg, value)
+	}
+}
+
+// logWriter writes to the standard logger's output at the time of writing, which the shim
+// points at its log file after the sinks have been subscribed
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// logSink prints events as structured records: warnings and errors by default, what the
+// command does with --log-level info or debug. Progress is left to the progress renderer.
+type logSink struct{}
+
+func (logSink) Handle(ev Event) {
+	var level slog.Level
+	switch ev.Level {
+	case eventLevelDebug:
+		level = slog.LevelDebug
+	case eventLevelInfo:
+		level = slog.LevelInfo
+	case eventLevelWarning:
+		level = slog.LevelWarn
+	case eventLevelError:
+		level = slog.LevelError
+	default:
+		return
+	}
+	if ev.Action == eventActionProgress || !logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	msg := ev.Message
+	if msg == "" {
+		msg = ev.Action
+	}
+
+	r := slog.NewRecord(ev.Time, level, msg, 0)
+	r.AddAttrs(slog.String("type", ev.Type))
+	if ev.ID != "" {
+		r.AddAttrs(slog.String("id", ev.ID))
+	}
+	// The source is that of the publisher, not of this sink
+	if ev.Source != "" {
+		r.AddAttrs(slog.String("source", ev.Source))
+	}
+	keys := make([]string, 0, len(ev.Attributes))
+	for k := range ev.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.AddAttrs(slog.String(k, ev.Attributes[k]))
+	}
+
+	logger.Handler().Handle(context.Background(), r)
+}
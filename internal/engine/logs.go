@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// containerLogFile is the name of the log in a container's state directory. Like Docker's
+// json-file driver, every line of output is a JSON object with its stream and time.
+const containerLogFile = "json.log"
+
+// Streams a log entry can come from
+const (
+	logStreamStdout = "stdout"
+	logStreamStderr = "stderr"
+)
+
+// maxLogLine is how much of a line without a newline is buffered before it is logged anyway
+const maxLogLine = 16 * 1024
+
+// logFollowInterval is how often logs -f checks for new output
+const logFollowInterval = 250 * time.Millisecond
+
+// LogEntry is a line of container output
+type LogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// containerLogPath returns the path of a container's log
+func containerLogPath(id string) string {
+	return filepath.Join(containerDir(id), containerLogFile)
+}
+
+// containerLog appends the output of a container's streams to its log
+type containerLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openContainerLog opens the log of a container for appending, creating it if needed
+func openContainerLog(id string) (*containerLog, error) {
+	f, err := os.OpenFile(containerLogPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open container log: %w", err)
+	}
+
+	return &containerLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// copy logs everything read from r as lines of the given stream until r reaches EOF
+func (l *containerLog) copy(r io.Reader, stream string) {
+	var pending []byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			l.write(pending[:i+1], stream)
+			pending = pending[i+1:]
+		}
+		if len(pending) >= maxLogLine {
+			l.write(pending, stream)
+			pending = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// A last line without a newline
+	if len(pending) > 0 {
+		l.write(pending, stream)
+	}
+}
+
+// write appends a single entry
+func (l *containerLog) write(line []byte, stream string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.enc.Encode(LogEntry{Log: string(line), Stream: stream, Time: time.Now().UTC()})
+}
+
+// Close closes the log file
+func (l *containerLog) Close() error {
+	return l.f.Close()
+}
+
+// logsOptions select what logs prints
+type logsOptions struct {
+	follow bool
+	// tail is the number of lines to print from the end, or -1 for all of them
+	tail  int
+	since time.Time
+}
+
+// parseLogsTail parses --tail, which like Docker's is a number of lines or "all"
+func parseLogsTail(value string) (int, error) {
+	if value == "all" {
+		return -1, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --tail %q: expected a number of lines or all", value)
+	}
+
+	return n, nil
+}
+
+// parseLogsSince parses --since, which is either a timestamp or a duration before now, e.g. 10m
+func parseLogsSince(value string, now time.Time) (time.Time, error) {
+	return parseTimeFlag("--since", value, now)
+}
+
+// parseTimeFlag parses a flag that takes a point in time the way --since does
+func parseTimeFlag(name, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid %s %q: expected a timestamp or a duration like 10m", name, value)
+}
+
+// printContainerLogs writes a container's logged output to stdout and stderr, following it
+// until the container exits if asked to
+func printContainerLogs(id string, opts logsOptions, stdout, stderr io.Writer) error {
+	if _, err := loadContainerState(id); err != nil {
+		return err
+	}
+
+	f, err := os.Open(containerLogPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		// Containers that never ran detached have no log
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open container log: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	show := func(entry LogEntry) {
+		if entry.Time.Before(opts.since) {
+			return
+		}
+		if entry.Stream == logStreamStderr {
+			io.WriteString(stderr, entry.Log)
+		} else {
+			io.WriteString(stdout, entry.Log)
+		}
+	}
+
+	// Only the newest entries are kept until the end of the current log is reached
+	var tail []LogEntry
+	partial, err := readLogEntries(r, nil, func(entry LogEntry) {
+		if opts.tail < 0 {
+			show(entry)
+			return
+		}
+		if entry.Time.Before(opts.since) || opts.tail == 0 {
+			return
+		}
+		if len(tail) == opts.tail {
+			tail = tail[1:]
+		}
+		tail = append(tail, entry)
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range tail {
+		show(entry)
+	}
+
+	if !opts.follow {
+		return nil
+	}
+
+	for {
+		// The shim records the exit only after the last output was logged
+		state, err := loadContainerState(id)
+		running := err == nil && state.running()
+
+		if partial, err = readLogEntries(r, partial, show); err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+
+		time.Sleep(logFollowInterval)
+	}
+}
+
+// readLogEntries calls fn for every entry up to the end of the log. A line that is still
+// being written is returned, to be completed by the next call.
+func readLogEntries(r *bufio.Reader, partial []byte, fn func(LogEntry)) ([]byte, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		partial = append(partial, line...)
+		if errors.Is(err, io.EOF) {
+			return partial, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read container log: %w", err)
+		}
+
+		var entry LogEntry
+		if err := json.Unmarshal(partial, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse container log: %w", err)
+		}
+		partial = nil
+		fn(entry)
+	}
+}
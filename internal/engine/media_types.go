@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Media types of manifests, manifest lists and image configs, in Docker's and OCI's flavour
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+)
+
+// manifestAccept is the Accept header of manifest requests. Registries convert or refuse
+// manifests of types that aren't listed, and a digest may name a manifest list, which can't
+// be converted into a manifest.
+var manifestAccept = strings.Join([]string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}, ", ")
+
+// layerMediaTypes are the tar layers we unpack. The compression isn't taken from the type,
+// decompressLayer detects it from the data.
+var layerMediaTypes = map[string]bool{
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":            true,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+	"application/vnd.oci.image.layer.v1.tar":                       true,
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  true,
+	"application/vnd.oci.image.layer.v1.tar+zstd":                  true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": true,
+}
+
+// manifestMediaType returns the media type of a manifest from its mediaType field, or from
+// the Content-Type the registry sent if it has none, which OCI allows. An OCI index without
+// either is recognised by its manifests.
+func manifestMediaType(data []byte, contentType string) (string, error) {
+	var probe struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return "", fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if probe.MediaType != "" {
+		return probe.MediaType, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != "application/json" {
+		return mediaType, nil
+	}
+	if probe.Manifests != nil {
+		return mediaTypeOCIIndex, nil
+	}
+
+	return mediaTypeOCIManifest, nil
+}
+
+// isManifestList reports whether the media type is that of a manifest list or OCI index
+func isManifestList(mediaType string) bool {
+	return mediaType == mediaTypeDockerManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// decodeManifest parses an image manifest of either flavour, refusing manifests of other
+// artifacts, such as Helm charts, and layers we can't unpack
+func decodeManifest(data []byte, mediaType string) (layersList, error) {
+	if mediaType != mediaTypeDockerManifest && mediaType != mediaTypeOCIManifest {
+		return layersList{}, fmt.Errorf("unsupported manifest media type %s", mediaType)
+	}
+
+	var manifest layersList
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return layersList{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if t := manifest.Config.MediaType; t != mediaTypeDockerConfig && t != mediaTypeOCIConfig {
+		return layersList{}, fmt.Errorf("not a container image: config has media type %s", t)
+	}
+	for _, layer := range manifest.Layers {
+		if !layerMediaTypes[layer.MediaType] {
+			return layersList{}, fmt.Errorf("unsupported media type %s of layer %s", layer.MediaType, shortDigest(layer.Digest))
+		}
+	}
+
+	return manifest, nil
+}
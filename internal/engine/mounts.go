@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinkDepth bounds symlink resolution inside the container root
+const maxSymlinkDepth = 40
+
+// Mount is a host path bind-mounted into the container
+type Mount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// TmpfsMount is a memory-backed filesystem mounted into the container
+type TmpfsMount struct {
+	Target string `json:"target"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// devShmTmpfs is the shared memory every container gets, sized like Docker's
+var devShmTmpfs = TmpfsMount{Target: "/dev/shm", Size: 64 << 20}
+
+// readOnlyTmpfs are the writable directories a read-only root filesystem gets besides
+// /dev/shm, the places programs expect to write to at run time
+var readOnlyTmpfs = []TmpfsMount{
+	{Target: "/tmp"},
+	{Target: "/run"},
+}
+
+// withDefaultTmpfs adds the defaults to the tmpfs mounts of a container, except where the
+// container already mounts something of its own
+func withDefaultTmpfs(tmpfs []TmpfsMount, mounts []Mount, defaults []TmpfsMount) []TmpfsMount {
+	taken := make(map[string]bool)
+	for _, m := range tmpfs {
+		taken[filepath.Clean(m.Target)] = true
+	}
+	for _, m := range mounts {
+		taken[filepath.Clean(m.Target)] = true
+	}
+
+	result := append([]TmpfsMount{}, tmpfs...)
+	for _, m := range defaults {
+		if !taken[m.Target] {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
+
+// statfs f_flags bits, see statfs(2)
+const (
+	stNosuid     = 0x2
+	stNodev      = 0x4
+	stNoexec     = 0x8
+	stNoatime    = 0x400
+	stNodiratime = 0x800
+	stRelatime   = 0x1000
+)
+
+// ParseVolume parses a -v/--volume value of the form src:dst[:ro|rw]
+func ParseVolume(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Mount{}, fmt.Errorf("invalid volume %q: expected src:dst[:ro|rw]", spec)
+	}
+
+	m := Mount{Source: parts[0], Target: parts[1]}
+	if !filepath.IsAbs(m.Target) {
+		return Mount{}, fmt.Errorf("invalid volume %q: destination must be an absolute path", spec)
+	}
+
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return Mount{}, fmt.Errorf("invalid volume %q: unknown mode %q", spec, parts[2])
+		}
+	}
+
+	return m, nil
+}
+
+// validateMounts checks the host side of bind mounts before the container is created
+func validateMounts(mounts []Mount) ([]Mount, error) {
+	resolved := make([]Mount, 0, len(mounts))
+	for _, m := range mounts {
+		src, err := filepath.Abs(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("invalid mount source %s: %w", m.Source, err)
+		}
+		m.Source = src
+		resolved = append(resolved, m)
+	}
+
+	return resolved, nil
+}
+
+// mountVolumes bind-mounts host paths into the root filesystem. It runs inside the
+// container's private mount namespace before chroot.
+func mountVolumes(root string, mounts []Mount) error {
+	for _, m := range mounts {
+		target, err := secureJoin(root, m.Target)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(m.Source)
+		if err != nil {
+			return fmt.Errorf("invalid mount source %s: %w", m.Source, err)
+		}
+
+		if err := createMountpoint(target, info.IsDir()); err != nil {
+			return err
+		}
+
+		if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %w", m.Source, m.Target, err)
+		}
+
+		if m.ReadOnly {
+			if err := remountReadOnly(target); err != nil {
+				return fmt.Errorf("failed to make %s read-only: %w", m.Target, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mountTmpfs mounts a fresh tmpfs at each target in the root filesystem
+func mountTmpfs(root string, mounts []TmpfsMount) error {
+	for _, m := range mounts {
+		target, err := secureJoin(root, m.Target)
+		if err != nil {
+			return err
+		}
+
+		if err := createMountpoint(target, true); err != nil {
+			return err
+		}
+
+		data := "mode=1777"
+		if m.Size > 0 {
+			data += fmt.Sprintf(",size=%d", m.Size)
+		}
+
+		if err := syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+			return fmt.Errorf("failed to mount tmpfs on %s: %w", m.Target, err)
+		}
+	}
+
+	return nil
+}
+
+// makeRootReadOnly turns root into a mount of its own and makes it read-only. The mounts
+// below it are carried over and keep their own flags.
+func makeRootReadOnly(root string) error {
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount root filesystem: %w", err)
+	}
+
+	if err := remountReadOnly(root); err != nil {
+		return fmt.Errorf("failed to make root filesystem read-only: %w", err)
+	}
+
+	return nil
+}
+
+// remountReadOnly makes an existing bind mount read-only. Flags such as nosuid are locked for
+// mounts inherited into a user namespace, so they are carried over or the kernel refuses.
+func remountReadOnly(path string) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return err
+	}
+
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for st, ms := range map[int64]uintptr{
+		stNosuid:     syscall.MS_NOSUID,
+		stNodev:      syscall.MS_NODEV,
+		stNoexec:     syscall.MS_NOEXEC,
+		stNoatime:    syscall.MS_NOATIME,
+		stNodiratime: syscall.MS_NODIRATIME,
+		stRelatime:   syscall.MS_RELATIME,
+	} {
+		if int64(fs.Flags)&st != 0 {
+			flags |= ms
+		}
+	}
+
+	return syscall.Mount("", path, "", flags, "")
+}
+
+// bindHostDevice bind-mounts a device node from the host into the root filesystem
+func bindHostDevice(root, device string) error {
+	target, err := secureJoin(root, device)
+	if err != nil {
+		return err
+	}
+
+	if err := createMountpoint(target, false); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(device, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", device, err)
+	}
+
+	return nil
+}
+
+// createMountpoint creates an empty directory or file to mount over
+func createMountpoint(path string, dir bool) error {
+	if dir {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("failed to create mountpoint %s: %w", path, err)
+		}
+		return nil
+	}
+
+	// Opening an existing device node or FIFO could fail or block, anything can be mounted over
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create mountpoint %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create mountpoint %s: %w", path, err)
+	}
+
+	return f.Close()
+}
+
+// secureJoin joins path onto root, resolving symlinks as if root were "/" so that the
+// result can never point outside of root
+func secureJoin(root, path string) (string, error) {
+	var resolved string
+	remaining := filepath.Clean("/" + path)
+	depth := 0
+
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(strings.TrimPrefix(remaining, "/"), "/")
+		if remaining != "" {
+			remaining = "/" + remaining
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." || resolved == "/" {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := resolved + "/" + part
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			// Not a symlink, or doesn't exist yet
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) && (errors.Is(err, syscall.EINVAL) || errors.Is(err, os.ErrNotExist)) {
+				resolved = next
+				continue
+			}
+			return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+		}
+
+		depth++
+		if depth > maxSymlinkDepth {
+			return "", fmt.Errorf("failed to resolve %s: too many levels of symbolic links", path)
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = target + remaining
+		if !filepath.IsAbs(remaining) {
+			remaining = "/" + remaining
+		}
+	}
+
+	return filepath.Join(root, resolved), nil
+}
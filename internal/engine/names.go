@@ -0,0 +1,319 @@
+package engine
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// containerNamesDir maps every container name to the ID of its container, as a symlink named
+// after the container whose target is the ID. Creating the link reserves the name atomically.
+var containerNamesDir = filepath.Join(containerStateDir, "names")
+
+// containerNamePattern is what Docker accepts as a container name
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// containerIDPattern matches the IDs of containers, which used to be 12 characters long
+var containerIDPattern = regexp.MustCompile(`^[0-9a-f]{12}(?:[0-9a-f]{52})?$`)
+
+// maxNameAttempts bounds how many generated names are tried before giving up
+const maxNameAttempts = 10
+
+// Generated names are an adjective and the surname of a notable scientist or hacker, joined
+// by an underscore like in Docker
+var (
+	nameAdjectives = []string{
+		"admiring", "adoring", "affectionate", "agitated", "amazing", "angry", "awesome",
+		"beautiful", "blissful", "bold", "boring", "brave", "busy", "charming", "clever",
+		"compassionate", "competent", "condescending", "confident", "cool", "cranky", "crazy",
+		"dazzling", "determined", "distracted", "dreamy", "eager", "ecstatic", "elastic",
+		"elated", "elegant", "eloquent", "epic", "exciting", "fervent", "festive", "flamboyant",
+		"focused", "friendly", "frosty", "funny", "gallant", "gifted", "goofy", "gracious",
+		"great", "happy", "hardcore", "heuristic", "hopeful", "hungry", "infallible",
+		"inspiring", "intelligent", "interesting", "jolly", "jovial", "keen", "kind", "laughing",
+		"loving", "lucid", "magical", "modest", "musing", "mystifying", "naughty", "nervous",
+		"nice", "nifty", "nostalgic", "objective", "optimistic", "peaceful", "pedantic",
+		"pensive", "practical", "priceless", "quirky", "quizzical", "recursing", "relaxed",
+		"reverent", "romantic", "sad", "serene", "sharp", "silly", "sleepy", "stoic", "strange",
+		"stupefied", "suspicious", "sweet", "tender", "thirsty", "trusting", "unruffled",
+		"upbeat", "vibrant", "vigilant", "vigorous", "wizardly", "wonderful", "xenodochial",
+		"youthful", "zealous", "zen",
+	}
+	nameSurnames = []string{
+		"agnesi", "albattani", "allen", "almeida", "archimedes", "ardinghelli", "aryabhata",
+		"austin", "babbage", "banach", "bardeen", "bartik", "bassi", "bell", "bhabha",
+		"bhaskara", "black", "blackwell", "bohr", "booth", "borg", "bose", "boyd", "brahmagupta",
+		"brattain", "brown", "burnell", "cannon", "carson", "cartwright", "cerf", "chandrasekhar",
+		"chatelet", "chebyshev", "clarke", "cohen", "colden", "cori", "cray", "curie", "darwin",
+		"davinci", "diffie", "dijkstra", "dirac", "driscoll", "dubinsky", "easley", "edison",
+		"einstein", "elbakyan", "elgamal", "elion", "engelbart", "euclid", "euler", "faraday",
+		"feistel", "fermat", "fermi", "feynman", "franklin", "gagarin", "galileo", "gates",
+		"gauss", "germain", "goldberg", "goldstine", "goldwasser", "goodall", "hamilton",
+		"haslett", "hawking", "heisenberg", "hellman", "hermann", "herschel", "hodgkin",
+		"hofstadter", "hoover", "hopper", "hugle", "hypatia", "jackson", "jang", "jemison",
+		"jennings", "jepsen", "johnson", "joliot", "jones", "kalam", "kapitsa", "keldysh",
+		"keller", "kepler", "khorana", "kilby", "kirch", "knuth", "kowalevski", "lalande",
+		"lamarr", "lamport", "leakey", "leavitt", "lederberg", "lehmann", "lewin", "lichterman",
+		"liskov", "lovelace", "lumiere", "mahavira", "margulis", "matsumoto", "maxwell",
+		"mayer", "mccarthy", "mcclintock", "mclean", "meitner", "mendel", "mendeleev",
+		"merkle", "mestorf", "mirzakhani", "montalcini", "moore", "morse", "moser", "murdock",
+		"napier", "nash", "neumann", "newton", "nightingale", "nobel", "noether", "northcutt",
+		"noyce", "panini", "pare", "pascal", "pasteur", "payne", "perlman", "pike", "poincare",
+		"poitras", "proskuriakova", "ptolemy", "raman", "ramanujan", "rhodes", "ride", "ritchie",
+		"robinson", "roentgen", "rosalind", "rubin", "saha", "sammet", "sanderson", "satoshi",
+		"shamir", "shannon", "shaw", "shirley", "shockley", "shtern", "sinoussi", "snyder",
+		"solomon", "spence", "stonebraker", "sutherland", "swanson", "swartz", "swirles",
+		"taussig", "tesla", "tharp", "thompson", "torvalds", "tu", "turing", "varahamihira",
+		"vaughan", "villani", "visvesvaraya", "volhard", "wescoff", "wilbur", "wiles",
+		"williams", "williamson", "wilson", "wing", "wozniak", "wright", "wu", "yalow",
+		"yonath", "zhukovsky",
+	}
+)
+
+// validateContainerName checks a --name value
+func validateContainerName(name string) error {
+	if !containerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid container name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	return nil
+}
+
+// generateContainerName returns a random name like Docker's, e.g. focused_turing. Retries
+// after a collision add a digit, like Docker does.
+func generateContainerName(retry int) (string, error) {
+	pick := func(words []string) (string, error) {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate container name: %w", err)
+		}
+		return words[n.Int64()], nil
+	}
+
+	for {
+		adjective, err := pick(nameAdjectives)
+		if err != nil {
+			return "", err
+		}
+		surname, err := pick(nameSurnames)
+		if err != nil {
+			return "", err
+		}
+
+		name := adjective + "_" + surname
+		// Steve Wozniak is not boring
+		if name == "boring_wozniak" {
+			continue
+		}
+		if retry > 0 {
+			digit, err := rand.Int(rand.Reader, big.NewInt(10))
+			if err != nil {
+				return "", fmt.Errorf("failed to generate container name: %w", err)
+			}
+			name += digit.String()
+		}
+
+		return name, nil
+	}
+}
+
+// nameContainer reserves the requested name for the container, or a generated one without
+// it, and returns the name. The container's state directory is created first, so the name
+// isn't taken for a leftover while the container is being created.
+func nameContainer(id, requested string) (string, error) {
+	if err := os.MkdirAll(containerDir(id), 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	if requested != "" {
+		return requested, reserveContainerName(requested, id)
+	}
+
+	for attempt := 0; ; attempt++ {
+		name, err := generateContainerName(attempt)
+		if err != nil {
+			return "", err
+		}
+
+		err = reserveContainerName(name, id)
+		if err == nil {
+			return name, nil
+		}
+		var conflict *nameConflictError
+		if !errors.As(err, &conflict) || attempt+1 == maxNameAttempts {
+			return "", err
+		}
+	}
+}
+
+// nameConflictError is returned for names that are already in use
+type nameConflictError struct {
+	name string
+	id   string
+}
+
+func (e *nameConflictError) Error() string {
+	return fmt.Sprintf("Conflict. The container name %q is already in use by container %q. You have to remove (or rename) that container to be able to reuse that name.", e.name, e.id)
+}
+
+// reserveContainerName points name at the container with the given ID, unless another
+// container has it. A name whose container is gone is taken over.
+func reserveContainerName(name, id string) error {
+	if err := validateContainerName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(containerNamesDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", containerNamesDir, err)
+	}
+
+	link := filepath.Join(containerNamesDir, name)
+	for {
+		err := os.Symlink(id, link)
+		if !errors.Is(err, fs.ErrExist) {
+			if err != nil {
+				return fmt.Errorf("failed to reserve container name %s: %w", name, err)
+			}
+			return nil
+		}
+
+		owner, err := os.Readlink(link)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read container name %s: %w", name, err)
+		}
+		if _, err := os.Stat(containerDir(owner)); !errors.Is(err, fs.ErrNotExist) {
+			return &nameConflictError{name: name, id: owner}
+		}
+
+		// Left behind by a container whose removal was interrupted. Renaming the link away
+		// first leaves only one of several racing creates to take it over.
+		stale := link + ".stale-" + id
+		if err := os.Rename(link, stale); err == nil {
+			os.Remove(stale)
+		}
+	}
+}
+
+// releaseContainerName frees the name of a removed container, unless it was taken over since
+func releaseContainerName(name, id string) {
+	if name == "" {
+		return
+	}
+
+	link := filepath.Join(containerNamesDir, name)
+	if owner, err := os.Readlink(link); err == nil && owner == id {
+		os.Remove(link)
+	}
+}
+
+// renameContainer gives a container a name, which must not be another container's, and
+// frees the one it had
+func renameContainer(id, name string) error {
+	lock, err := lockState(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if err != nil {
+		return err
+	}
+	old := state.Name
+	if old == name {
+		return nil
+	}
+	if err := reserveContainerName(name, id); err != nil {
+		return err
+	}
+	state.Name, state.Config.Name = name, name
+	if err := state.save(); err != nil {
+		releaseContainerName(name, id)
+		return err
+	}
+	releaseContainerName(old, id)
+	containerEvent(eventActionRename, id, map[string]string{"oldName": old, "name": name})
+
+	return nil
+}
+
+// resolveContainer returns the ID of the container a command argument refers to: a full ID,
+// a name or a unique prefix of an ID, in that order like in Docker
+func resolveContainer(ref string) (string, error) {
+	if ref == "" || strings.ContainsAny(ref, "/") {
+		return "", fmt.Errorf("%w: %s", errContainerNotFound, ref)
+	}
+
+	if containerIDPattern.MatchString(ref) {
+		if _, err := os.Stat(filepath.Join(containerDir(ref), "state.json")); err == nil {
+			return ref, nil
+		}
+	}
+
+	if id, err := os.Readlink(filepath.Join(containerNamesDir, ref)); err == nil {
+		if _, err := os.Stat(containerDir(id)); err == nil {
+			return id, nil
+		}
+	}
+
+	entries, err := os.ReadDir(containerStateDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var matches []string
+	for _, e := range entries {
+		if e.IsDir() && containerIDPattern.MatchString(e.Name()) && strings.HasPrefix(e.Name(), ref) {
+			matches = append(matches, e.Name())
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", errContainerNotFound, ref)
+	case 1:
+		return matches[0], nil
+	}
+
+	return "", fmt.Errorf("multiple containers match the ID prefix %q, use more of the ID or the name", ref)
+}
+
+// sweepContainerNames removes the names of containers that are gone. Like the other sweeps it
+// runs while no container is being created.
+func sweepContainerNames() {
+	entries, err := os.ReadDir(containerNamesDir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		link := filepath.Join(containerNamesDir, e.Name())
+		id, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(containerDir(id)); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Remove(link); err == nil {
+				warnf(eventTypeContainer, "removed the name %s of removed container %s", e.Name(), shortID(id))
+			}
+		}
+	}
+}
+
+// shortID returns the 12 character form of a container ID that listings show, like Docker
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+
+	return id
+}
@@ -0,0 +1,399 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Netlink attribute types missing from the syscall package
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	vethInfoPeer = 1
+	// macvlanInfoMode is IFLA_MACVLAN_MODE, and macvlanModeBridge lets the macvlans of a
+	// parent talk to each other
+	macvlanInfoMode   = 1
+	macvlanModeBridge = 4
+)
+
+var netlinkSeq uint32
+
+// netlinkRequest is a netlink message under construction
+type netlinkRequest struct {
+	msgType uint16
+	flags   uint16
+	payload []byte
+}
+
+// newNetlinkRequest creates a request that asks the kernel for an acknowledgement
+func newNetlinkRequest(msgType, flags int) *netlinkRequest {
+	return &netlinkRequest{
+		msgType: uint16(msgType),
+		flags:   uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags),
+	}
+}
+
+// add appends raw bytes (a fixed header or attributes) to the payload
+func (r *netlinkRequest) add(data ...[]byte) {
+	for _, d := range data {
+		r.payload = append(r.payload, d...)
+	}
+}
+
+// serialize encodes the request with a netlink header
+func (r *netlinkRequest) serialize(seq uint32) []byte {
+	buf := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(r.payload))
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(syscall.NLMSG_HDRLEN+len(r.payload)))
+	binary.NativeEndian.PutUint16(buf[4:6], r.msgType)
+	binary.NativeEndian.PutUint16(buf[6:8], r.flags)
+	binary.NativeEndian.PutUint32(buf[8:12], seq)
+
+	return append(buf, r.payload...)
+}
+
+// execute sends the request over a fresh NETLINK_ROUTE socket and waits for the ack
+func (r *netlinkRequest) execute() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	if err := syscall.Sendto(fd, r.serialize(seq), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send netlink request: %w", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read netlink response: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse netlink response: %w", err)
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			if m.Header.Type == syscall.NLMSG_DONE {
+				return nil
+			}
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("truncated netlink error message")
+			}
+			if code := int32(binary.NativeEndian.Uint32(m.Data[0:4])); code != 0 {
+				return syscall.Errno(-code)
+			}
+			return nil
+		}
+	}
+}
+
+// netlinkAttr encodes a route attribute, padded to the required alignment
+func netlinkAttr(attrType int, payload []byte) []byte {
+	length := syscall.SizeofRtAttr + len(payload)
+	buf := make([]byte, rtaAlign(length))
+	binary.NativeEndian.PutUint16(buf[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(buf[2:4], uint16(attrType))
+	copy(buf[syscall.SizeofRtAttr:], payload)
+
+	return buf
+}
+
+// netlinkNested encodes an attribute whose payload is a list of attributes
+func netlinkNested(attrType int, children ...[]byte) []byte {
+	var payload []byte
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+
+	return netlinkAttr(attrType, payload)
+}
+
+// netlinkString encodes a NUL-terminated string attribute
+func netlinkString(attrType int, s string) []byte {
+	return netlinkAttr(attrType, append([]byte(s), 0))
+}
+
+// netlinkUint32 encodes a 32-bit integer attribute
+func netlinkUint32(attrType int, v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.NativeEndian.PutUint32(buf, v)
+
+	return netlinkAttr(attrType, buf)
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// ifInfoMsg encodes a struct ifinfomsg
+func ifInfoMsg(index int, flags, change uint32) []byte {
+	buf := make([]byte, syscall.SizeofIfInfomsg)
+	buf[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(buf[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(buf[8:12], flags)
+	binary.NativeEndian.PutUint32(buf[12:16], change)
+
+	return buf
+}
+
+// linkIndex returns the interface index of the named link in the current network namespace
+func linkIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+
+	return iface.Index, nil
+}
+
+// createBridge creates a Linux bridge device
+func createBridge(name string) error {
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.add(
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, name),
+		netlinkNested(syscall.IFLA_LINKINFO, netlinkString(iflaInfoKind, "bridge")),
+	)
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// createVethPair creates a veth pair whose peer end is placed in the network namespace of peerPid
+func createVethPair(name, peerName string, peerPid int) error {
+	peer := append(ifInfoMsg(0, 0, 0), netlinkString(syscall.IFLA_IFNAME, peerName)...)
+	peer = append(peer, netlinkUint32(syscall.IFLA_NET_NS_PID, uint32(peerPid))...)
+
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.add(
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, name),
+		netlinkNested(syscall.IFLA_LINKINFO,
+			netlinkString(iflaInfoKind, "veth"),
+			netlinkNested(iflaInfoData, netlinkAttr(vethInfoPeer, peer)),
+		),
+	)
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to create veth pair %s/%s: %w", name, peerName, err)
+	}
+
+	return nil
+}
+
+// createMacvlan creates a macvlan of parent in the network namespace of pid
+func createMacvlan(name, parent string, pid int) error {
+	parentIndex, err := linkIndex(parent)
+	if err != nil {
+		return err
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.add(
+		ifInfoMsg(0, 0, 0),
+		netlinkString(syscall.IFLA_IFNAME, name),
+		netlinkUint32(syscall.IFLA_LINK, uint32(parentIndex)),
+		netlinkUint32(syscall.IFLA_NET_NS_PID, uint32(pid)),
+		netlinkNested(syscall.IFLA_LINKINFO,
+			netlinkString(iflaInfoKind, "macvlan"),
+			netlinkNested(iflaInfoData, netlinkUint32(macvlanInfoMode, macvlanModeBridge)),
+		),
+	)
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to create macvlan %s of %s: %w", name, parent, err)
+	}
+
+	return nil
+}
+
+// deleteLink removes a network device
+func deleteLink(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	req := newNetlinkRequest(syscall.RTM_DELLINK, 0)
+	req.add(ifInfoMsg(index, 0, 0))
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// setLinkUp brings the named link up
+func setLinkUp(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, 0)
+	req.add(ifInfoMsg(index, syscall.IFF_UP, syscall.IFF_UP))
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// setLinkMaster enslaves the named link to a bridge
+func setLinkMaster(name, master string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	masterIndex, err := linkIndex(master)
+	if err != nil {
+		return err
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, 0)
+	req.add(ifInfoMsg(index, 0, 0), netlinkUint32(syscall.IFLA_MASTER, uint32(masterIndex)))
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to attach %s to %s: %w", name, master, err)
+	}
+
+	return nil
+}
+
+// addAddress assigns an IPv4 address to the named link
+func addAddress(name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("only IPv4 addresses are supported, got %s", addr)
+	}
+	ones, _ := addr.Mask.Size()
+
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(ones)
+	msg[3] = syscall.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+
+	req := newNetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.add(msg, netlinkAttr(syscall.IFA_LOCAL, ip), netlinkAttr(syscall.IFA_ADDRESS, ip))
+
+	if err := req.execute(); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add address %s to %s: %w", addr, name, err)
+	}
+
+	return nil
+}
+
+// deleteAddress removes an IPv4 address from the named link, together with the routes using it
+func deleteAddress(name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	ip := addr.IP.To4()
+	ones, _ := addr.Mask.Size()
+
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(ones)
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+
+	req := newNetlinkRequest(syscall.RTM_DELADDR, 0)
+	req.add(msg, netlinkAttr(syscall.IFA_LOCAL, ip))
+
+	if err := req.execute(); err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("failed to remove address %s from %s: %w", addr, name, err)
+	}
+
+	return nil
+}
+
+// addRoute installs or replaces an IPv4 route to dst out of the named link, via gateway
+// unless it is nil and dst is on the link
+func addRoute(name string, dst *net.IPNet, gateway net.IP) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	ones, _ := dst.Mask.Size()
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(ones)
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_DHCP
+	msg[6] = syscall.RT_SCOPE_LINK
+	msg[7] = syscall.RTN_UNICAST
+
+	attrs := [][]byte{msg, netlinkUint32(syscall.RTA_OIF, uint32(index))}
+	if ones > 0 {
+		attrs = append(attrs, netlinkAttr(syscall.RTA_DST, dst.IP.To4()))
+	}
+	if gw := gateway.To4(); gw != nil && !gw.IsUnspecified() {
+		msg[6] = syscall.RT_SCOPE_UNIVERSE
+		attrs = append(attrs, netlinkAttr(syscall.RTA_GATEWAY, gw))
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE)
+	req.add(attrs...)
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to add route to %s via %s: %w", dst, gateway, err)
+	}
+
+	return nil
+}
+
+// addDefaultRoute installs a default IPv4 route via gateway
+func addDefaultRoute(gateway net.IP) error {
+	gw := gateway.To4()
+	if gw == nil {
+		return fmt.Errorf("only IPv4 gateways are supported, got %s", gateway)
+	}
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = syscall.AF_INET
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	msg[6] = syscall.RT_SCOPE_UNIVERSE
+	msg[7] = syscall.RTN_UNICAST
+
+	req := newNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.add(msg, netlinkAttr(syscall.RTA_GATEWAY, gw))
+
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %w", gateway, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// NetworkMode selects how a container is connected to the network
+type NetworkMode string
+
+const (
+	// NetworkNone gives the container its own network namespace with only loopback
+	NetworkNone NetworkMode = "none"
+	// NetworkHost shares the host's network namespace
+	NetworkHost NetworkMode = "host"
+	// NetworkBridge connects the container to a managed bridge through a veth pair
+	NetworkBridge NetworkMode = "bridge"
+)
+
+// networkNamespacePrefix selects a pre-created network namespace, e.g. ns:/run/netns/sandbox
+const networkNamespacePrefix = "ns:"
+
+// networkMacvlanPrefix puts the container on the LAN of a host interface through a macvlan,
+// with an address from the LAN's DHCP server, e.g. macvlan:eth0
+const networkMacvlanPrefix = "macvlan:"
+
+const (
+	bridgeName         = "mydocker0"
+	bridgeSubnet       = "172.29.0.0/16"
+	containerInterface = "eth0"
+	networkStateDir    = "/run/your-docker/network"
+)
+
+// ParseNetworkMode validates the value of the --network flag
+func ParseNetworkMode(value string) (NetworkMode, error) {
+	if path, ok := strings.CutPrefix(value, networkNamespacePrefix); ok {
+		if !filepath.IsAbs(path) {
+			return "", fmt.Errorf("invalid network mode %q: namespace path must be absolute", value)
+		}
+		return NetworkMode(value), nil
+	}
+	if parent, ok := strings.CutPrefix(value, networkMacvlanPrefix); ok {
+		if parent == "" || len(parent) >= syscall.IFNAMSIZ || strings.ContainsAny(parent, "/ ") {
+			return "", fmt.Errorf("invalid network mode %q: expected macvlan:<host interface>", value)
+		}
+		return NetworkMode(value), nil
+	}
+
+	switch mode := NetworkMode(value); mode {
+	case NetworkNone, NetworkHost, NetworkBridge:
+		return mode, nil
+	case "":
+		// Sharing the host network stays the default so runs work without CAP_NET_ADMIN
+		return NetworkHost, nil
+	default:
+		return "", fmt.Errorf("unsupported network mode %q: expected none, host, bridge, ns:<path> or macvlan:<interface>", value)
+	}
+}
+
+// namespacePath returns the path of the pre-created namespace joined by this mode
+func (m NetworkMode) namespacePath() (string, bool) {
+	path, ok := strings.CutPrefix(string(m), networkNamespacePrefix)
+	if !ok {
+		return "", false
+	}
+
+	return path, true
+}
+
+// macvlanParent returns the host interface the container's macvlan is created on
+func (m NetworkMode) macvlanParent() (string, bool) {
+	return strings.CutPrefix(string(m), networkMacvlanPrefix)
+}
+
+// initNetworkConfig describes what the container init has to configure inside its namespace
+type initNetworkConfig struct {
+	Mode      NetworkMode `json:"mode"`
+	Interface string      `json:"interface,omitempty"`
+	Address   string      `json:"address,omitempty"`
+	Gateway   string      `json:"gateway,omitempty"`
+	Namespace string      `json:"namespace,omitempty"`
+}
+
+// containerNetwork holds the host-side resources allocated for a container's network
+type containerNetwork struct {
+	mode      NetworkMode
+	address   *net.IPNet
+	gateway   net.IP
+	hostVeth  string
+	leasePath string
+	// dhcp keeps the lease of a macvlan, in the namespace of the shim's container
+	dhcp *dhcpClient
+}
+
+// newContainerNetwork prepares the host side of the selected network mode
+func newContainerNetwork(mode NetworkMode) (*containerNetwork, error) {
+	n := &containerNetwork{mode: mode}
+	if path, ok := mode.namespacePath(); ok {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("invalid network namespace: %w", err)
+		}
+		return n, nil
+	}
+	if parent, ok := mode.macvlanParent(); ok {
+		if _, err := net.InterfaceByName(parent); err != nil {
+			return nil, fmt.Errorf("invalid macvlan parent: %w", err)
+		}
+		return n, nil
+	}
+
+	if mode != NetworkBridge {
+		return n, nil
+	}
+
+	gateway, subnet, err := ensureBridge()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.allocateAddress(gateway, subnet); err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		n.release()
+		return nil, fmt.Errorf("failed to generate veth name: %w", err)
+	}
+	n.hostVeth = "veth" + hex.EncodeToString(suffix)
+	n.gateway = gateway
+
+	return n, nil
+}
+
+// cloneFlags returns the namespace flags needed by this network mode
+func (n *containerNetwork) cloneFlags() uintptr {
+	if _, ok := n.mode.namespacePath(); ok || n.mode == NetworkHost {
+		// Pre-created namespaces are joined by the init instead
+		return 0
+	}
+
+	return syscall.CLONE_NEWNET
+}
+
+// attach connects the network namespace of the container process to the bridge and installs
+// its firewall rules. If any step fails, the rules are removed again. A macvlan is configured
+// with a DHCP lease instead, which the shim keeps renewing.
+func (n *containerNetwork) attach(pid int) (err error) {
+	if parent, ok := n.mode.macvlanParent(); ok {
+		if err := createMacvlan(containerInterface, parent, pid); err != nil {
+			return err
+		}
+		n.dhcp, err = startDHCPClient(fmt.Sprintf("/proc/%d/ns/net", pid), containerInterface)
+		if err == nil {
+			debugf(eventTypeNetwork, "attached container to macvlan", "pid", pid, "parent", parent, "address", n.dhcp.lease.address)
+		}
+		return err
+	}
+
+	if n.mode != NetworkBridge {
+		return nil
+	}
+
+	// Without the masquerade rule the container still works, it just can't get out
+	firewall := true
+	if err := applyFirewall(n.address.IP); err != nil {
+		firewall = false
+		warnf(eventTypeNetwork, "containers may have no outbound access: %v", err)
+	}
+	defer func() {
+		if err != nil && firewall {
+			if err := removeFirewall(n.address.IP); err != nil {
+				warnf(eventTypeNetwork, "%v", err)
+			}
+		}
+	}()
+
+	if err := createVethPair(n.hostVeth, containerInterface, pid); err != nil {
+		return err
+	}
+
+	if err := setLinkMaster(n.hostVeth, bridgeName); err != nil {
+		return err
+	}
+
+	if err := setLinkUp(n.hostVeth); err != nil {
+		return err
+	}
+	debugf(eventTypeNetwork, "attached container to bridge", "pid", pid, "veth", n.hostVeth, "address", n.address, "firewall", firewall)
+
+	return nil
+}
+
+// initConfig returns the settings the container init applies inside the namespace
+func (n *containerNetwork) initConfig() initNetworkConfig {
+	cfg := initNetworkConfig{Mode: n.mode}
+	cfg.Namespace, _ = n.mode.namespacePath()
+	if n.mode == NetworkBridge {
+		cfg.Interface = containerInterface
+		cfg.Address = n.address.String()
+		cfg.Gateway = n.gateway.String()
+	}
+
+	return cfg
+}
+
+// stopDHCP gives the lease of a macvlan back once the container exited
+func (n *containerNetwork) stopDHCP() {
+	if n != nil {
+		n.dhcp.close()
+		n.dhcp = nil
+	}
+}
+
+// release frees the allocated address, the firewall rules and any veth left behind by a
+// failed start
+func (n *containerNetwork) release() error {
+	if n.hostVeth != "" {
+		// Normally the pair is already gone together with the container's namespace
+		_ = deleteLink(n.hostVeth)
+	}
+
+	// A table left behind is replaced when the address is handed out again
+	if n.address != nil {
+		if err := removeFirewall(n.address.IP); err != nil {
+			warnf(eventTypeNetwork, "%v", err)
+		}
+	}
+
+	if n.leasePath == "" {
+		return nil
+	}
+
+	if err := os.Remove(n.leasePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to release address %s: %w", n.address.IP, err)
+	}
+
+	return nil
+}
+
+// allocateAddress reserves a free address in the bridge subnet using one lease file per address
+func (n *containerNetwork) allocateAddress(gateway net.IP, subnet *net.IPNet) error {
+	leaseDir := filepath.Join(networkStateDir, bridgeName)
+	if err := os.MkdirAll(leaseDir, 0755); err != nil {
+		return fmt.Errorf("failed to create lease directory: %w", err)
+	}
+
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	ones, bits := subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+
+	// Skip the network address, the gateway and the broadcast address
+	for offset := uint32(2); offset < size-1; offset++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+offset)
+		if ip.Equal(gateway) {
+			continue
+		}
+
+		leasePath := filepath.Join(leaseDir, ip.String())
+		f, err := os.OpenFile(leasePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create lease %s: %w", leasePath, err)
+		}
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+		f.Close()
+
+		n.address = &net.IPNet{IP: ip, Mask: subnet.Mask}
+		n.leasePath = leasePath
+		return nil
+	}
+
+	return fmt.Errorf("no free addresses left in %s", subnet)
+}
+
+// ensureBridge creates and configures the managed bridge if it doesn't exist yet
+func ensureBridge() (net.IP, *net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(bridgeSubnet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gateway := make(net.IP, 4)
+	binary.BigEndian.PutUint32(gateway, binary.BigEndian.Uint32(subnet.IP.To4())+1)
+
+	if _, err := net.InterfaceByName(bridgeName); err != nil {
+		if err := createBridge(bridgeName); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return nil, nil, err
+		}
+	}
+
+	if err := addAddress(bridgeName, &net.IPNet{IP: gateway, Mask: subnet.Mask}); err != nil {
+		return nil, nil, err
+	}
+
+	if err := setLinkUp(bridgeName); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		warnf(eventTypeNetwork, "failed to enable IP forwarding: %v", err)
+	}
+
+	return gateway, subnet, nil
+}
+
+// configureContainerNetwork runs inside the container's network namespace before the command starts
+func configureContainerNetwork(cfg initNetworkConfig) error {
+	if cfg.Mode == NetworkHost {
+		return nil
+	}
+
+	if cfg.Namespace != "" {
+		if err := joinNetworkNamespace(cfg.Namespace); err != nil {
+			return err
+		}
+	}
+
+	if err := setLinkUp("lo"); err != nil {
+		return err
+	}
+
+	if cfg.Mode != NetworkBridge {
+		return nil
+	}
+
+	ip, subnet, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return fmt.Errorf("invalid container address %q: %w", cfg.Address, err)
+	}
+
+	if err := addAddress(cfg.Interface, &net.IPNet{IP: ip, Mask: subnet.Mask}); err != nil {
+		return err
+	}
+
+	if err := setLinkUp(cfg.Interface); err != nil {
+		return err
+	}
+
+	return addDefaultRoute(net.ParseIP(cfg.Gateway))
+}
+
+// joinNetworkNamespace moves the calling thread into an existing network namespace
+func joinNetworkNamespace(path string) error {
+	// The syscall package doesn't define SYS_SETNS everywhere, but the seccomp tables do
+	nr, ok := seccompSyscallNumbers["setns"]
+	if !ok {
+		return errors.New("joining a network namespace is not supported on this architecture")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer f.Close()
+
+	if _, _, errno := syscall.Syscall(uintptr(nr), f.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("failed to join network namespace %s: %w", path, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// networkConfigPath keeps the DNS and hosts settings of networks, which outlive reboots unlike
+// the leases in networkStateDir
+const networkConfigPath = "/var/lib/your-docker/networks.json"
+
+// DNSPolicy selects where the nameservers in a container's resolv.conf come from
+type DNSPolicy string
+
+const (
+	// DNSPolicyHost passes the host's resolv.conf through, without the nameservers that only
+	// work in the host's network namespace
+	DNSPolicyHost DNSPolicy = "host"
+	// DNSPolicyStatic uses only the servers configured for the network
+	DNSPolicyStatic DNSPolicy = "static"
+	// DNSPolicyEmbedded points the container at a resolver the shim runs on
+	// embeddedResolverAddress, which forwards queries from the host's network namespace
+	DNSPolicyEmbedded DNSPolicy = "embedded"
+)
+
+// HostsPolicy selects what a container's /etc/hosts starts from
+type HostsPolicy string
+
+const (
+	// HostsPolicyHost copies the host's /etc/hosts, the default with the host network
+	HostsPolicyHost HostsPolicy = "host"
+	// HostsPolicyPrivate generates one with only localhost, the default otherwise
+	HostsPolicyPrivate HostsPolicy = "private"
+)
+
+// NetworkDNSConfig is how the containers of a network resolve names. Servers are the
+// nameservers of the static policy and the upstreams of the embedded resolver; search domains
+// and options replace those of the host when set. The --dns and --dns-search of a container
+// still take precedence.
+type NetworkDNSConfig struct {
+	Policy     DNSPolicy   `json:"policy,omitempty"`
+	Servers    []string    `json:"servers,omitempty"`
+	Search     []string    `json:"search,omitempty"`
+	Options    []string    `json:"options,omitempty"`
+	Hosts      HostsPolicy `json:"hosts,omitempty"`
+	ExtraHosts []string    `json:"extraHosts,omitempty"`
+}
+
+// networkConfigs is the file at networkConfigPath, keyed by network mode
+type networkConfigs struct {
+	Networks map[string]NetworkDNSConfig `json:"networks"`
+}
+
+// policy returns the DNS policy, the host's resolv.conf unless another one was chosen
+func (c NetworkDNSConfig) policy() DNSPolicy {
+	if c.Policy == "" {
+		return DNSPolicyHost
+	}
+
+	return c.Policy
+}
+
+// hostsPolicy returns what /etc/hosts starts from on the network
+func (c NetworkDNSConfig) hostsPolicy(mode NetworkMode) HostsPolicy {
+	if c.Hosts != "" {
+		return c.Hosts
+	}
+	if mode == NetworkHost {
+		return HostsPolicyHost
+	}
+
+	return HostsPolicyPrivate
+}
+
+// validate checks that the settings make sense for the network
+func (c NetworkDNSConfig) validate(mode NetworkMode) error {
+	switch c.policy() {
+	case DNSPolicyHost:
+		if len(c.Servers) > 0 {
+			return errors.New("--dns servers need the static or embedded policy, the host policy uses the host's")
+		}
+	case DNSPolicyStatic:
+		if len(c.Servers) == 0 {
+			return errors.New("the static policy needs at least one --dns server")
+		}
+	case DNSPolicyEmbedded:
+		// The resolver forwards from the host, which would give containers without a
+		// network a way out, and on the host network it would fight over the address
+		if mode == NetworkHost || mode == NetworkNone {
+			return fmt.Errorf("the embedded policy needs a network with its own namespace, not %s", mode)
+		}
+	default:
+		return fmt.Errorf("invalid DNS policy %q: expected host, static or embedded", c.Policy)
+	}
+
+	for _, server := range c.Servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid --dns %q: not an IP address", server)
+		}
+	}
+
+	for _, option := range c.Options {
+		if option == "" || strings.ContainsAny(option, " \t\n") {
+			return fmt.Errorf("invalid --dns-option %q", option)
+		}
+	}
+
+	switch c.Hosts {
+	case "", HostsPolicyHost, HostsPolicyPrivate:
+	default:
+		return fmt.Errorf("invalid hosts policy %q: expected host or private", c.Hosts)
+	}
+
+	for _, h := range c.ExtraHosts {
+		// The gateway is only known once a container is attached, any will do to check the syntax
+		if _, err := parseExtraHost(h, net.IPv4zero); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readNetworkConfigs returns the saved settings of every network
+func readNetworkConfigs() (networkConfigs, error) {
+	configs := networkConfigs{Networks: map[string]NetworkDNSConfig{}}
+
+	data, err := os.ReadFile(networkConfigPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return configs, nil
+	}
+	if err != nil {
+		return configs, fmt.Errorf("failed to read network settings: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return configs, fmt.Errorf("failed to parse %s: %w", networkConfigPath, err)
+	}
+	if configs.Networks == nil {
+		configs.Networks = map[string]NetworkDNSConfig{}
+	}
+
+	return configs, nil
+}
+
+// networkDNSConfig returns the settings of a network, the defaults if none were saved
+func networkDNSConfig(mode NetworkMode) (NetworkDNSConfig, error) {
+	configs, err := readNetworkConfigs()
+	if err != nil {
+		return NetworkDNSConfig{}, err
+	}
+
+	return configs.Networks[string(mode)], nil
+}
+
+// updateNetworkDNSConfig applies update to the settings of a network while holding the lock,
+// so concurrent changes to other networks aren't lost. Settings that end up empty are removed.
+func updateNetworkDNSConfig(mode NetworkMode, update func(*NetworkDNSConfig) error) (NetworkDNSConfig, error) {
+	if err := os.MkdirAll(filepath.Dir(networkConfigPath), 0755); err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to create %s: %w", filepath.Dir(networkConfigPath), err)
+	}
+
+	lock, err := os.OpenFile(strings.TrimSuffix(networkConfigPath, ".json")+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to open network settings lock: %w", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to lock network settings: %w", err)
+	}
+
+	configs, err := readNetworkConfigs()
+	if err != nil {
+		return NetworkDNSConfig{}, err
+	}
+
+	config := configs.Networks[string(mode)]
+	if err := update(&config); err != nil {
+		return NetworkDNSConfig{}, err
+	}
+	if err := config.validate(mode); err != nil {
+		return NetworkDNSConfig{}, err
+	}
+
+	if config.isZero() {
+		delete(configs.Networks, string(mode))
+	} else {
+		configs.Networks[string(mode)] = config
+	}
+
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to encode network settings: %w", err)
+	}
+
+	// Containers read the file without the lock, so replace it atomically
+	if err := os.WriteFile(networkConfigPath+".tmp", data, 0644); err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to write network settings: %w", err)
+	}
+	if err := os.Rename(networkConfigPath+".tmp", networkConfigPath); err != nil {
+		return NetworkDNSConfig{}, fmt.Errorf("failed to write network settings: %w", err)
+	}
+
+	return config, nil
+}
+
+// isZero reports whether nothing is configured, leaving every setting at its default
+func (c NetworkDNSConfig) isZero() bool {
+	return c.Policy == "" && len(c.Servers) == 0 && len(c.Search) == 0 && len(c.Options) == 0 &&
+		c.Hosts == "" && len(c.ExtraHosts) == 0
+}
+
+// networkSummary is a row of network ls
+type networkSummary struct {
+	Name   string           `json:"Name"`
+	Config NetworkDNSConfig `json:"DNS"`
+}
+
+// listNetworks returns the built-in networks and the namespaces and macvlans that have
+// settings, with the settings of each
+func listNetworks() ([]networkSummary, error) {
+	configs, err := readNetworkConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{string(NetworkBridge), string(NetworkHost), string(NetworkNone)}
+	var namespaces []string
+	for name := range configs.Networks {
+		_, namespace := NetworkMode(name).namespacePath()
+		_, macvlan := NetworkMode(name).macvlanParent()
+		if namespace || macvlan {
+			namespaces = append(namespaces, name)
+		}
+	}
+	sort.Strings(namespaces)
+
+	var networks []networkSummary
+	for _, name := range append(names, namespaces...) {
+		networks = append(networks, networkSummary{Name: name, Config: configs.Networks[name]})
+	}
+
+	return networks, nil
+}
+
+// printNetworks writes the network listing as a table or, for --format json, one JSON
+// object per line
+func printNetworks(w io.Writer, networks []networkSummary, format string) error {
+	switch format {
+	case "", "table":
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, n := range networks {
+			if err := enc.Encode(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid --format %q: expected table or json", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDNS POLICY\tSERVERS\tSEARCH\tOPTIONS\tHOSTS")
+	for _, n := range networks {
+		mode := NetworkMode(n.Name)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", n.Name, n.Config.policy(), listOrDash(n.Config.Servers),
+			listOrDash(n.Config.Search), listOrDash(n.Config.Options), n.Config.hostsPolicy(mode))
+	}
+
+	return tw.Flush()
+}
+
+// printNetworkDNSConfig writes the settings of a network as indented JSON, the defaults
+// filled in
+func printNetworkDNSConfig(w io.Writer, n networkSummary) error {
+	n.Config.Policy = n.Config.policy()
+	n.Config.Hosts = n.Config.hostsPolicy(NetworkMode(n.Name))
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(n)
+}
+
+// listOrDash joins a list for a table cell, with a dash when it is empty
+func listOrDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+
+	return strings.Join(values, ",")
+}
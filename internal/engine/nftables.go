@@ -0,0 +1,249 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// nf_tables netlink constants missing from the syscall package, see linux/netfilter/nf_tables.h
+const (
+	netlinkNetfilter = 12
+
+	nfnlSubsysNftables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+	nfprotoIPv4        = 2
+
+	nftMsgNewTable = 0
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+
+	nftaTableName = 1
+
+	nftaChainTable = 1
+	nftaChainName  = 3
+	nftaChainHook  = 4
+	nftaChainType  = 7
+	nftaHookNum    = 1
+	nftaHookPrio   = 2
+
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaListElem        = 1
+	nftaExprName        = 1
+	nftaExprData        = 2
+
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+	nftaCmpSreg       = 1
+	nftaCmpOp         = 2
+	nftaCmpData       = 3
+	nftaDataValue     = 1
+	nftaMetaDreg      = 1
+	nftaMetaKey       = 2
+
+	nftReg1                 = 1
+	nftPayloadNetworkHeader = 1
+	nftCmpEq                = 0
+	nftCmpNeq               = 1
+	nftMetaOifname          = 7
+
+	nfInetPostRouting = 4
+	nfIPPriNatSrc     = 100
+
+	nlaFNested = 0x8000
+	ifNameSize = 16
+)
+
+// firewallTablePrefix names the nftables table holding the rules of a container, which is
+// followed by the container's address
+const firewallTablePrefix = "your-docker-"
+
+// nftBatch is a list of nf_tables changes that the kernel applies as a single transaction:
+// either all of them take effect or, if any fails, none does
+type nftBatch struct {
+	msgs []*netlinkRequest
+}
+
+// add queues a change to a table of the IPv4 family
+func (b *nftBatch) add(msgType, flags int, attrs ...[]byte) {
+	req := newNetlinkRequest(nfnlSubsysNftables<<8|msgType, flags)
+	req.add(nfgenMsg(nfprotoIPv4, 0))
+	req.add(attrs...)
+	b.msgs = append(b.msgs, req)
+}
+
+// commit sends the batch over a NETLINK_NETFILTER socket and waits for the kernel to
+// acknowledge every change, returning the first error it reports
+func (b *nftBatch) commit() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return fmt.Errorf("failed to open netfilter socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netfilter socket: %w", err)
+	}
+
+	// The batch markers carry the subsystem in place of a resource ID and aren't acknowledged
+	marker := func(msgType int) *netlinkRequest {
+		req := &netlinkRequest{msgType: uint16(msgType), flags: syscall.NLM_F_REQUEST}
+		req.add(nfgenMsg(syscall.AF_UNSPEC, nfnlSubsysNftables))
+		return req
+	}
+
+	pending := make(map[uint32]bool)
+	var buf []byte
+	for _, req := range append(append([]*netlinkRequest{marker(nfnlMsgBatchBegin)}, b.msgs...), marker(nfnlMsgBatchEnd)) {
+		seq := atomic.AddUint32(&netlinkSeq, 1)
+		if req.flags&syscall.NLM_F_ACK != 0 {
+			pending[seq] = true
+		}
+		buf = append(buf, req.serialize(seq)...)
+	}
+
+	if err := syscall.Sendto(fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send netfilter batch: %w", err)
+	}
+
+	resp := make([]byte, syscall.Getpagesize())
+	for len(pending) > 0 {
+		n, _, err := syscall.Recvfrom(fd, resp, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read netfilter response: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(resp[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse netfilter response: %w", err)
+		}
+
+		for _, m := range msgs {
+			if !pending[m.Header.Seq] || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("truncated netlink error message")
+			}
+			if code := int32(binary.NativeEndian.Uint32(m.Data[0:4])); code != 0 {
+				return syscall.Errno(-code)
+			}
+			delete(pending, m.Header.Seq)
+		}
+	}
+
+	return nil
+}
+
+// nfgenMsg encodes the header that follows the netlink header of netfilter messages
+func nfgenMsg(family uint8, resID uint16) []byte {
+	buf := make([]byte, 4)
+	buf[0] = family
+	binary.BigEndian.PutUint16(buf[2:4], resID)
+
+	return buf
+}
+
+// nftNested encodes a nested attribute, which nf_tables expects to be flagged as such
+func nftNested(attrType int, children ...[]byte) []byte {
+	return netlinkNested(attrType|nlaFNested, children...)
+}
+
+// nftUint32 encodes an integer attribute, which nf_tables expects in network byte order
+func nftUint32(attrType int, v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+
+	return netlinkAttr(attrType, buf)
+}
+
+// nftExpr encodes a rule expression with its attributes
+func nftExpr(name string, data ...[]byte) []byte {
+	attrs := [][]byte{netlinkString(nftaExprName, name)}
+	if len(data) > 0 {
+		attrs = append(attrs, nftNested(nftaExprData, data...))
+	}
+
+	return nftNested(nftaListElem, attrs...)
+}
+
+// nftCmp encodes an expression comparing register 1 with value
+func nftCmp(op uint32, value []byte) []byte {
+	return nftExpr("cmp",
+		nftUint32(nftaCmpSreg, nftReg1),
+		nftUint32(nftaCmpOp, op),
+		nftNested(nftaCmpData, netlinkAttr(nftaDataValue, value)))
+}
+
+// firewallTable returns the name of the table holding the rules of the container with addr
+func firewallTable(addr net.IP) string {
+	return firewallTablePrefix + addr.String()
+}
+
+// applyFirewall installs the rules of a container on the bridge in a table of its own: outbound
+// traffic from its address is masqueraded behind the host's. A table left over from an
+// earlier container with the same address is replaced in the same transaction, so the rules
+// exist exactly once or not at all.
+func applyFirewall(addr net.IP) error {
+	table := firewallTable(addr)
+	name := netlinkString(nftaTableName, table)
+
+	var b nftBatch
+	// Creating the table first makes deleting it succeed whether or not it existed
+	b.add(nftMsgNewTable, syscall.NLM_F_CREATE, name)
+	b.add(nftMsgDelTable, 0, name)
+	b.add(nftMsgNewTable, syscall.NLM_F_CREATE, name)
+	b.add(nftMsgNewChain, syscall.NLM_F_CREATE,
+		netlinkString(nftaChainTable, table),
+		netlinkString(nftaChainName, "postrouting"),
+		nftNested(nftaChainHook,
+			nftUint32(nftaHookNum, nfInetPostRouting),
+			nftUint32(nftaHookPrio, nfIPPriNatSrc)),
+		netlinkString(nftaChainType, "nat"))
+
+	// ip saddr <addr> oifname != <bridge> masquerade
+	oifname := make([]byte, ifNameSize)
+	copy(oifname, bridgeName)
+	b.add(nftMsgNewRule, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND,
+		netlinkString(nftaRuleTable, table),
+		netlinkString(nftaRuleChain, "postrouting"),
+		nftNested(nftaRuleExpressions,
+			nftExpr("payload",
+				nftUint32(nftaPayloadDreg, nftReg1),
+				nftUint32(nftaPayloadBase, nftPayloadNetworkHeader),
+				nftUint32(nftaPayloadOffset, 12),
+				nftUint32(nftaPayloadLen, net.IPv4len)),
+			nftCmp(nftCmpEq, addr.To4()),
+			nftExpr("meta",
+				nftUint32(nftaMetaDreg, nftReg1),
+				nftUint32(nftaMetaKey, nftMetaOifname)),
+			nftCmp(nftCmpNeq, oifname),
+			nftExpr("masq")))
+
+	if err := b.commit(); err != nil {
+		return fmt.Errorf("failed to install firewall rules for %s: %w", addr, err)
+	}
+
+	return nil
+}
+
+// removeFirewall deletes the rules of the container with addr, if there are any
+func removeFirewall(addr net.IP) error {
+	var b nftBatch
+	b.add(nftMsgDelTable, 0, netlinkString(nftaTableName, firewallTable(addr)))
+
+	if err := b.commit(); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to remove firewall rules for %s: %w", addr, err)
+	}
+
+	return nil
+}
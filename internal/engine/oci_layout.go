@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OCI image layout files, see the image-layout part of the OCI image spec
+const (
+	ociLayoutFile    = "oci-layout"
+	ociIndexFile     = "index.json"
+	ociLayoutVersion = "1.0.0"
+)
+
+// Annotations of the images in an OCI layout's index: the tag skopeo and podman address them
+// by, and the full reference containerd imports them under
+const (
+	ociRefNameAnnotation     = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+)
+
+// ociLayout is the oci-layout file that marks a directory as an image layout
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ociIndex is the index.json of an image layout
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociDescriptor points at a manifest of an image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// SaveOCILayout writes images to dir in the OCI image layout: their manifests, configs and
+// layers as blobs/sha256/<hash> and an index.json tagging them. An existing layout in dir is
+// added to, with images of the same name replaced; the index is written last, so an
+// interrupted save leaves the earlier one intact.
+func (s *ImageStore) SaveOCILayout(dir string, images []*StoredImage) error {
+	lock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	index, err := readOCIIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	for _, img := range images {
+		descriptor, err := s.saveImageBlobs(dir, img)
+		if err != nil {
+			return fmt.Errorf("failed to save %s: %w", img.Reference(), err)
+		}
+
+		name := descriptor.Annotations[containerdNameAnnotation]
+		kept := index.Manifests[:0]
+		for _, m := range index.Manifests {
+			if name == "" || m.Annotations[containerdNameAnnotation] != name {
+				kept = append(kept, m)
+			}
+		}
+		index.Manifests = append(kept, descriptor)
+	}
+
+	data, err := json.Marshal(ociLayout{ImageLayoutVersion: ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ociLayoutFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ociLayoutFile, err)
+	}
+
+	if data, err = json.MarshalIndent(index, "", "  "); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", ociIndexFile, err)
+	}
+	path := filepath.Join(dir, ociIndexFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ociIndexFile, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ociIndexFile, err)
+	}
+
+	return nil
+}
+
+// readOCIIndex returns the index of the layout in dir, an empty one if there is none yet.
+// Directories that have files but aren't a layout are refused rather than mixed into one.
+func readOCIIndex(dir string) (ociIndex, error) {
+	index := ociIndex{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return index, nil
+		}
+		if err != nil {
+			return index, err
+		}
+		for _, entry := range entries {
+			if entry.Name() != "blobs" && entry.Name() != ociLayoutFile {
+				return index, fmt.Errorf("%s is neither empty nor an OCI image layout", dir)
+			}
+		}
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to read %s: %w", ociIndexFile, err)
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to parse %s in %s: %w", ociIndexFile, dir, err)
+	}
+
+	return index, nil
+}
+
+// saveImageBlobs copies the blobs of an image into the layout and returns the descriptor of
+// its manifest for the index
+func (s *ImageStore) saveImageBlobs(dir string, img *StoredImage) (ociDescriptor, error) {
+	descriptor, err := s.ociDescriptor(img)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	for _, digest := range imageBlobs(img) {
+		if err := s.copyBlobTo(dir, digest); err != nil {
+			return ociDescriptor{}, err
+		}
+	}
+
+	return descriptor, nil
+}
+
+// imageBlobs returns the digests of an image's blobs, layers first and the manifest last like
+// a pull, so a blob written in this order is only referenced once everything below it is there
+func imageBlobs(img *StoredImage) []string {
+	var digests []string
+	for _, layer := range img.Manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	return append(digests, img.Manifest.Config.Digest, img.Digest)
+}
+
+// ociDescriptor returns the descriptor of an image's manifest for the index of a layout
+func (s *ImageStore) ociDescriptor(img *StoredImage) (ociDescriptor, error) {
+	manifest, err := s.readBlob(img.Digest)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	mediaType, err := manifestMediaType(manifest, "")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	descriptor := ociDescriptor{MediaType: mediaType, Digest: img.Digest, Size: int64(len(manifest))}
+	if config, err := s.Config(img); err == nil && config.Architecture != "" {
+		descriptor.Platform = &Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	}
+
+	// Images pulled by digest and tarballs have no tag to address them by
+	if img.Tag != "" && pinnedDigest(img.Tag) == "" {
+		descriptor.Annotations = map[string]string{ociRefNameAnnotation: img.Tag}
+		if ref, err := ParseReference(img.Reference()); err == nil {
+			descriptor.Annotations[containerdNameAnnotation] = ref.String()
+		}
+	}
+
+	return descriptor, nil
+}
+
+// copyBlobTo copies a stored blob into the layout in dir unless it is there already
+func (s *ImageStore) copyBlobTo(dir, digest string) error {
+	src, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	hash := strings.TrimPrefix(digest, "sha256:")
+	dst := filepath.Join(dir, "blobs", "sha256", hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", shortDigest(digest), err)
+	}
+	defer in.Close()
+
+	// Copied next to the destination first, so a layout never has a truncated blob
+	out, err := os.CreateTemp(filepath.Dir(dst), hash+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy blob %s: %w", shortDigest(digest), err)
+	}
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+}
@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// layerCacheDir holds every layer of the stored images extracted once, to be stacked into
+// root filesystems with overlayfs. The storage root of the config file moves it.
+var layerCacheDir = "/var/lib/your-docker/layers"
+
+// Whiteouts as they appear in layer tarballs. A file named .wh.<name> deletes <name> from the
+// layers below, and .wh..wh..opq in a directory hides everything below it.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// errOverlayUnavailable is returned when the root filesystem can't be an overlay, and the
+// image has to be copied instead
+var errOverlayUnavailable = errors.New("overlayfs unavailable")
+
+// prepareOverlayRootfs mounts the image's cached layers as the root filesystem, pulling the
+// image into the store first if it isn't there. Nothing is copied, the container's writes go
+// to an upper directory of its own.
+func (env *ContainerEnvironment) prepareOverlayRootfs(ctx context.Context, image, platform string) (imageConfig, error) {
+	want, err := parsePlatformOption(platform)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	store := NewImageStore(imageStoreDir)
+	img, config, err := storedImage(store, image, want)
+	if errors.Is(err, errImageNotFound) {
+		dl, derr := NewDockerImageDownloader(image, nil)
+		if derr != nil {
+			return imageConfig{}, fmt.Errorf("failed to create image downloader: %w", derr)
+		}
+		dl.platform = want
+
+		if err := dl.Pull(ctx, store); err != nil {
+			return imageConfig{}, fmt.Errorf("failed to pull image: %w", err)
+		}
+		img, config, err = storedImage(store, image, want)
+	}
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	layers, err := store.layerDirs(img, env.userns, env.steps)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	if err := mountOverlayRootfs(env.rootPath, layers); err != nil {
+		return imageConfig{}, fmt.Errorf("%w: %v", errOverlayUnavailable, err)
+	}
+	env.layers = layers
+
+	root := env.rootfs()
+	if err := env.setupDevices(root); err != nil {
+		return imageConfig{}, err
+	}
+
+	if env.userns {
+		if err := shiftOwnership(overlayUpperDir(env.rootPath)); err != nil {
+			return imageConfig{}, fmt.Errorf("failed to prepare rootfs for the user namespace: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// layerDirs returns the extracted layers of an image in the order overlayfs stacks them,
+// topmost first, extracting those that aren't cached yet
+func (s *ImageStore) layerDirs(img *StoredImage, userns bool, steps *setupSteps) ([]string, error) {
+	layers := make([]string, len(img.Manifest.Layers))
+	for i, layer := range img.Manifest.Layers {
+		dir, err := s.cachedLayer(layer, userns, steps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract layer %s: %w", shortDigest(layer.Digest), err)
+		}
+		layers[len(layers)-1-i] = dir
+	}
+
+	return layers, nil
+}
+
+// cachedLayer returns the directory the layer is extracted in, extracting it on first use.
+// Concurrent creates wait for a single extraction, like prepareSharedRootfs. Copies for user
+// namespaces are kept separately because their files are owned by the mapped IDs.
+func (s *ImageStore) cachedLayer(layer layerEntry, userns bool, steps *setupSteps) (string, error) {
+	blob, err := s.blobPath(layer.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	// The key is only the hash, lower directories add up against the mount's option size limit
+	_, key, _ := strings.Cut(layer.Digest, ":")
+	if userns {
+		key += "_userns"
+	}
+	dir := filepath.Join(layerCacheDir, key)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, steps.reuse(readSkippedSteps(dir), true)
+	}
+
+	if err := os.MkdirAll(layerCacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", layerCacheDir, err)
+	}
+
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open lock: %w", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return "", fmt.Errorf("failed to lock: %w", err)
+	}
+
+	// Another create may have finished extracting while we waited for the lock
+	if _, err := os.Stat(dir); err == nil {
+		return dir, steps.reuse(readSkippedSteps(dir), true)
+	}
+
+	tmp, err := os.MkdirTemp(layerCacheDir, key+".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	// The layer is for every container, so it is extracted leniently and what was skipped is
+	// kept next to it, for strict containers to fail on however they find it
+	extraction := &setupSteps{}
+	if err := extractLayer(tmp, blob, layer, userns, extraction); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := writeSkippedSteps(dir, extraction.skipped); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("failed to publish layer: %w", err)
+	}
+
+	return dir, steps.reuse(extraction.skipped, false)
+}
+
+// extractLayer extracts a layer tarball into dir and prepares it to be a lower directory
+func extractLayer(dir, blob string, layer layerEntry, userns bool, steps *setupSteps) error {
+	// MkdirTemp creates the directory as 0700, which would hide the root from non-root users
+	if err := os.Chmod(dir, 0755); err != nil {
+		return fmt.Errorf("failed to change permissions of %s: %w", dir, err)
+	}
+
+	if err := extractTarball(dir, blob, layer, steps); err != nil {
+		return err
+	}
+
+	if err := convertWhiteouts(dir); err != nil {
+		return fmt.Errorf("failed to convert whiteouts: %w", err)
+	}
+
+	if userns {
+		if err := shiftOwnership(dir); err != nil {
+			return fmt.Errorf("failed to prepare layer for the user namespace: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// convertWhiteouts turns the whiteout files of an extracted layer into the form overlayfs
+// understands: a 0:0 character device in place of each deleted file, and the opaque xattr on
+// directories that hide the layers below
+func convertWhiteouts(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := d.Name()
+		if !strings.HasPrefix(name, whiteoutPrefix) {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		if name == whiteoutOpaque {
+			if err := syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to mark %s opaque: %w", dir, err)
+			}
+			return nil
+		}
+
+		target := filepath.Join(dir, strings.TrimPrefix(name, whiteoutPrefix))
+		if err := syscall.Mknod(target, syscall.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create whiteout for %s: %w", target, err)
+		}
+
+		return nil
+	})
+}
+
+// overlayUpperDir is where the writes of a container with an overlay rootfs in dir go
+func overlayUpperDir(dir string) string {
+	return filepath.Join(dir, "upper")
+}
+
+// overlayMergedDir is where the overlay rootfs in dir is mounted
+func overlayMergedDir(dir string) string {
+	return filepath.Join(dir, "merged")
+}
+
+// mountOverlayRootfs mounts the layers with a writable upper directory at dir/merged. The
+// mount is on the host, so the root filesystem can be prepared before the container starts,
+// and stays until the container is removed. Mounting an overlay that is already mounted does
+// nothing.
+func mountOverlayRootfs(dir string, layers []string) error {
+	upper := overlayUpperDir(dir)
+	work := filepath.Join(dir, "work")
+	merged := overlayMergedDir(dir)
+
+	if isMountPoint(merged) {
+		return nil
+	}
+
+	for _, d := range []string{upper, work, merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", d, err)
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(layers, ":"), upper, work)
+	if len(data) >= os.Getpagesize() {
+		return fmt.Errorf("too many layers (%d) for one overlay mount", len(layers))
+	}
+
+	if err := syscall.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		// Leave the directory empty for the image to be copied into instead
+		for _, d := range []string{upper, work, merged} {
+			os.RemoveAll(d)
+		}
+		return fmt.Errorf("failed to mount overlay on %s: %w", merged, err)
+	}
+	debugf(eventTypeContainer, "mounted overlay rootfs", "target", merged, "layers", len(layers), "upper", upper)
+
+	return nil
+}
+
+// unmountOverlayRootfs unmounts the overlay rootfs in dir. Processes still using it, e.g.
+// those of exec sessions, keep it alive until they exit.
+func unmountOverlayRootfs(dir string) error {
+	merged := overlayMergedDir(dir)
+	if !isMountPoint(merged) {
+		return nil
+	}
+
+	if err := syscall.Unmount(merged, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", merged, err)
+	}
+
+	return nil
+}
+
+// isMountPoint reports whether something is mounted on path, which then is on another
+// device than its parent
+func isMountPoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	if err := syscall.Lstat(filepath.Dir(path), &parent); err != nil {
+		return false
+	}
+
+	return st.Dev != parent.Dev
+}
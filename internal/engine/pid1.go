@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runAsPid1 runs the command as a child of the container's init instead of replacing it, and
+// does what PID 1 has to: the signals we receive are forwarded to the command, and the
+// orphaned processes the kernel reparents to us are reaped so they don't pile up as zombies.
+// It returns the exit code of the command, 128 plus the signal number if a signal killed it.
+// The command gets environ as its environment, a non-nil cred is the user it runs as, extra are
+// passed on after its standard streams, and started is called once it runs.
+func runAsPid1(path string, argv, environ []string, tty bool, cred *syscall.Credential, extra []*os.File, started func()) (int, error) {
+	// Registered before the command starts so that neither its exit nor an early signal is lost
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	attr := &os.ProcAttr{
+		Env:   environ,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, extra...),
+	}
+	if tty {
+		// The command's process group gets the terminal, so keys like ctrl-c signal it
+		// directly rather than through us
+		attr.Sys = &syscall.SysProcAttr{Setpgid: true, Foreground: true, Ctty: 0}
+	}
+	if cred != nil {
+		if attr.Sys == nil {
+			attr.Sys = &syscall.SysProcAttr{}
+		}
+		attr.Sys.Credential = cred
+	}
+
+	proc, err := os.StartProcess(path, argv, attr)
+	if err != nil {
+		return 0, err
+	}
+	// Our copies would keep pipes among them open after the command closes its own
+	for _, f := range extra {
+		f.Close()
+	}
+	started()
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, exited, err := reapChildren(proc.Pid); err != nil {
+				return 0, err
+			} else if exited {
+				return exitCodeOfStatus(status), nil
+			}
+		case syscall.SIGURG:
+			// Used by the Go runtime to preempt goroutines
+		default:
+			syscall.Kill(proc.Pid, sig.(syscall.Signal))
+		}
+	}
+
+	return 0, errors.New("signal channel closed")
+}
+
+// reapChildren collects every child that has exited and reports whether the command was one
+// of them, along with its status
+func reapChildren(command int) (syscall.WaitStatus, bool, error) {
+	var commandStatus syscall.WaitStatus
+	exited := false
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.ECHILD) || pid == 0 {
+			return commandStatus, exited, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to reap children: %w", err)
+		}
+
+		if pid == command {
+			commandStatus, exited = status, true
+		}
+	}
+}
+
+// exitCodeOfStatus converts a wait status into an exit code the way exitCodeOf does
+func exitCodeOfStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
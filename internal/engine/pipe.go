@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// splitPipeline splits a pipeline like "alpine ls / | alpine wc -l" at the pipes that aren't
+// quoted and returns the words of every stage
+func splitPipeline(s string) ([][]string, error) {
+	var stages [][]string
+	var quote rune
+	start := 0
+
+	split := func(end int) error {
+		words, err := splitShellWords(s[start:end])
+		if err != nil {
+			return err
+		}
+		if len(words) == 0 {
+			return fmt.Errorf("empty stage in pipeline %q", s)
+		}
+		stages = append(stages, words)
+		return nil
+	}
+
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '|':
+			if err := split(i); err != nil {
+				return nil, err
+			}
+			start = i + 1
+		}
+	}
+
+	if err := split(len(s)); err != nil {
+		return nil, err
+	}
+
+	return stages, nil
+}
+
+// parsePipeline returns the options of every stage of a pipeline. Each stage is written like
+// the arguments of run and takes the same options, apart from -t and -d.
+func parsePipeline(s string) ([]RunOptions, error) {
+	stages, err := splitPipeline(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipeline []RunOptions
+	for _, words := range stages {
+		fs := newFlagSet("pipe", pipeUsage)
+		flags := defineRunFlags(fs, pipeUsage)
+		if err := fs.Parse(withDefaultRunFlags(words)); err != nil {
+			return nil, err
+		}
+
+		opts, err := flags.options(fs.Args())
+		if err != nil {
+			return nil, err
+		}
+		if opts.TTY || opts.Detach {
+			return nil, fmt.Errorf("pipeline stage %q: -t and -d can't be used in a pipeline", strings.Join(words, " "))
+		}
+
+		// Stages are as short-lived as the pipeline, nobody refers to them afterwards
+		opts.AutoRemove = true
+		pipeline = append(pipeline, opts)
+	}
+
+	return pipeline, nil
+}
+
+// runPipeline runs the stages of a pipeline in containers, connecting the stdout of each one
+// to the stdin of the next. Like a shell, it returns the exit code of the last stage, or with
+// pipefail that of the last stage that failed.
+func runPipeline(pipeline []RunOptions, pipefail bool) (int, error) {
+	envs := make([]*ContainerEnvironment, 0, len(pipeline))
+	for _, opts := range pipeline {
+		env, err := NewContainerEnvironment(context.Background(), opts)
+		if err != nil {
+			for _, env := range envs {
+				env.remove()
+			}
+			return 0, err
+		}
+		envs = append(envs, env)
+	}
+
+	var shims []*shimClient
+	var startErr error
+	var stdin *os.File
+	if pipeline[0].Interactive {
+		stdin = os.Stdin
+	}
+
+	for i, env := range envs {
+		if startErr != nil {
+			// Never started, so no shim removes it
+			env.remove()
+			continue
+		}
+
+		// The last stage writes to our stdout, the others to the next stage
+		stdout, next := os.Stdout, (*os.File)(nil)
+		if i < len(envs)-1 {
+			var err error
+			if next, stdout, err = os.Pipe(); err != nil {
+				startErr = fmt.Errorf("failed to create pipe: %w", err)
+				env.remove()
+				continue
+			}
+		}
+
+		shim, err := env.startShim([3]*os.File{stdin, stdout, os.Stderr}, nil, true)
+		// Only the containers hold the pipes from now on, so each stage sees EOF once the
+		// previous one is done
+		if stdin != nil && stdin != os.Stdin {
+			stdin.Close()
+		}
+		if stdout != os.Stdout {
+			stdout.Close()
+		}
+		stdin = next
+
+		if err != nil {
+			startErr = err
+			continue
+		}
+		shims = append(shims, shim)
+
+		stop := proxySignals(shim.pid)
+		defer stop()
+	}
+	if stdin != nil && stdin != os.Stdin {
+		stdin.Close()
+	}
+
+	exitCode := 0
+	var waitErr error
+	for i, shim := range shims {
+		code, err := envs[i].wait(shim)
+		if err != nil {
+			waitErr = errors.Join(waitErr, err)
+			continue
+		}
+		if !pipefail || code != 0 {
+			exitCode = code
+		}
+	}
+
+	if startErr != nil {
+		return 0, startErr
+	}
+
+	return exitCode, waitErr
+}
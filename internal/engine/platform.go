@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Platform is the OS, architecture and optional variant an image is built for, with the
+// field names of manifest lists
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses a platform like linux/arm64 or linux/arm/v7
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch or os/arch/variant, e.g. linux/arm64", s)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		if parts[2] == "" {
+			return Platform{}, fmt.Errorf("invalid platform %q: empty variant", s)
+		}
+		p.Variant = parts[2]
+	}
+
+	return p, nil
+}
+
+// hostPlatform returns the platform we run on. On ARM the variant is that of the CPU, so the
+// images picked for it are ones it can run; elsewhere it is left open, since the CPU features
+// it stands for are checked when the image is run.
+func hostPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	switch p.Architecture {
+	case "arm64":
+		p.Variant = "v8"
+	case "arm":
+		if v := armVersion(); v > 0 {
+			p.Variant = "v" + strconv.Itoa(v)
+		}
+	}
+
+	return p
+}
+
+// armVariants are the variants of 32-bit ARM images, newest first. A CPU runs images of its
+// own variant and of those after it.
+var armVariants = []string{"v8", "v7", "v6", "v5"}
+
+// normalized fills in the variant of ARM platforms that don't name one: arm64 only has v8,
+// and arm images without a variant are taken to be v7 like Docker does
+func (p Platform) normalized() Platform {
+	if p.Variant != "" {
+		return p
+	}
+
+	switch p.Architecture {
+	case "arm64":
+		p.Variant = "v8"
+	case "arm":
+		p.Variant = "v7"
+	}
+
+	return p
+}
+
+// variantRank orders images of the same architecture by preference, the lowest rank first:
+// the newest ARM variant a CPU runs makes the most of it
+func (p Platform) variantRank() int {
+	if p.Architecture != "arm" {
+		return 0
+	}
+
+	for i, v := range armVariants {
+		if v == p.normalized().Variant {
+			return i
+		}
+	}
+
+	return len(armVariants)
+}
+
+// String formats the platform the way ParsePlatform reads it
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// matches reports whether an image for other runs on the platform p. Without a variant, p
+// accepts any; an ARM variant accepts older ones too, v7 runs v6 and v5 images.
+func (p Platform) matches(other Platform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	if p.Variant == "" {
+		return true
+	}
+
+	want, have := p.normalized(), other.normalized()
+	// Variants we don't know the order of only run their own images
+	if p.Architecture == "arm" && want.variantRank() < len(armVariants) && have.variantRank() < len(armVariants) {
+		return have.variantRank() >= want.variantRank()
+	}
+
+	return want.Variant == have.Variant
+}
+
+// selectManifest picks the manifest for the wanted platform from a manifest list, preferring
+// the newest ARM variant the platform runs. When the platform wasn't asked for explicitly and
+// the image isn't built for the host, one the host still runs is picked instead: 32-bit x86
+// on amd64, or an architecture qemu-user emulates.
+func selectManifest(manifests []manifestEntry, want Platform, explicit bool) (manifestEntry, error) {
+	var available, variants []string
+	var candidates []manifestEntry
+	for _, m := range manifests {
+		// Attestation manifests and the like have no platform of their own
+		if m.Platform.OS == "unknown" || m.Platform.Architecture == "unknown" {
+			continue
+		}
+		candidates = append(candidates, m)
+		available = append(available, m.Platform.String())
+		if m.Platform.OS == want.OS && m.Platform.Architecture == want.Architecture {
+			variants = append(variants, m.Platform.normalized().Variant)
+		}
+	}
+
+	if m, ok := bestManifest(candidates, want.matches); ok {
+		return m, nil
+	}
+
+	if !explicit {
+		if m, ok := bestManifest(candidates, func(p Platform) bool {
+			// Images of the host's own architecture didn't match, they need a newer CPU
+			return p.OS == want.OS && p.Architecture != want.Architecture && runsNatively(p.Architecture)
+		}); ok {
+			return m, nil
+		}
+		for _, m := range candidates {
+			if m.Platform.OS == want.OS && qemuRegistered(m.Platform.Architecture) {
+				warnf(eventTypeImage, "image has no %s variant, using %s under qemu emulation", want, m.Platform)
+				return m, nil
+			}
+		}
+	}
+
+	if len(available) == 0 {
+		return manifestEntry{}, errors.New("manifest list has no images")
+	}
+
+	// The architecture is there, just not in a variant this platform runs
+	if len(variants) > 0 {
+		return manifestEntry{}, fmt.Errorf("no image for %s in manifest list, available %s/%s variants: %s",
+			want, want.OS, want.Architecture, strings.Join(variants, ", "))
+	}
+
+	return manifestEntry{}, fmt.Errorf("no image for %s in manifest list, available platforms: %s", want, strings.Join(available, ", "))
+}
+
+// bestManifest returns the manifest whose platform is accepted with the lowest variant rank,
+// the first of those in the list on a tie
+func bestManifest(manifests []manifestEntry, accept func(Platform) bool) (manifestEntry, bool) {
+	best, found := manifestEntry{}, false
+	for _, m := range manifests {
+		if !accept(m.Platform) {
+			continue
+		}
+		if !found || m.Platform.variantRank() < best.Platform.variantRank() {
+			best, found = m, true
+		}
+	}
+
+	return best, found
+}
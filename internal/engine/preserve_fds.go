@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// preservedFdsStart is the first of the file descriptors --preserve-fds passes on, numbered
+// right after stderr like runc does
+const preservedFdsStart = 3
+
+// Where the shim and the container init get the preserved descriptors, after their own
+const (
+	shimPreservedFd          = shimPtyFd + 1
+	containerInitPreservedFd = ipcNamespaceFd + 1
+)
+
+// shimPreservedFdsEnv tells the shim how many descriptors were preserved, which it removes
+// again like shimLogLevelEnv
+const shimPreservedFdsEnv = "_YOUR_DOCKER_PRESERVED_FDS"
+
+// maxPreservedFds bounds how many descriptors recordInheritedFds looks for
+const maxPreservedFds = 1024
+
+// inheritedFds is how many consecutive descriptors from preservedFdsStart on we were started
+// with
+var inheritedFds int
+
+// preservedFileCache holds the one os.File of each preserved descriptor, whose finalizer
+// would otherwise close it under the others
+var preservedFileCache = struct {
+	sync.Mutex
+	files map[int]*os.File
+}{files: map[int]*os.File{}}
+
+// recordInheritedFds counts the descriptors we were started with that --preserve-fds can pass
+// on. The Go runtime opens its own in the first gap before we run, but unlike inherited ones
+// they are closed on exec.
+func recordInheritedFds() {
+	for inheritedFds < maxPreservedFds {
+		fd := preservedFdsStart + inheritedFds
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 || flags&syscall.FD_CLOEXEC != 0 {
+			return
+		}
+		inheritedFds++
+	}
+}
+
+// checkPreservedFds checks that the n descriptors --preserve-fds passes on were open when we
+// started
+func checkPreservedFds(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid --preserve-fds %d: must not be negative", n)
+	}
+	if n > inheritedFds {
+		return fmt.Errorf("invalid --preserve-fds %d: file descriptor %d isn't open", n, preservedFdsStart+inheritedFds)
+	}
+
+	return nil
+}
+
+// preservedFiles returns the n preserved descriptors from fd on. They are closed on exec, so
+// they only reach the processes they are explicitly passed to.
+func preservedFiles(fd, n int) []*os.File {
+	preservedFileCache.Lock()
+	defer preservedFileCache.Unlock()
+
+	var files []*os.File
+	for i := fd; i < fd+n; i++ {
+		f, ok := preservedFileCache.files[i]
+		if !ok {
+			syscall.CloseOnExec(i)
+			f = os.NewFile(uintptr(i), "preserved-fd-"+strconv.Itoa(i))
+			preservedFileCache.files[i] = f
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+// closePreservedFds closes the shim's copies of the preserved descriptors once the container
+// holds them, so that pipes and connections among them see EOF when the container is done
+func (env *ContainerEnvironment) closePreservedFds() {
+	for _, f := range env.preservedFds {
+		f.Close()
+	}
+	env.preservedFds = nil
+}
+
+// movePreservedFds puts the preserved descriptors at preservedFdsStart and up for the command
+// the init execs itself into. Whatever is there is closed on exec anyway, except the failure
+// pipe, which is moved out of their way first.
+func movePreservedFds(files []*os.File) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	if initFailures != nil {
+		above := containerInitPreservedFd + len(files)
+		fd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, initFailures.Fd(), syscall.F_DUPFD_CLOEXEC, uintptr(above))
+		if errno != 0 {
+			return fmt.Errorf("failed to move init failure pipe: %w", errno)
+		}
+		initFailures.Close()
+		initFailures = os.NewFile(fd, "init-failures")
+	}
+
+	// The sources are all above the targets, so each is copied before a later one replaces it
+	for i, f := range files {
+		if err := syscall.Dup3(int(f.Fd()), preservedFdsStart+i, 0); err != nil {
+			return fmt.Errorf("failed to pass on file descriptor %d: %w", preservedFdsStart+i, err)
+		}
+	}
+
+	return nil
+}
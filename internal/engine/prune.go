@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pruneGracePeriod keeps blobs and layers written this recently. The store lock covers the
+// pulls and creates under way, this spares what a failed one left for a retry to pick up.
+const pruneGracePeriod = time.Hour
+
+// pruneReport is what system prune removed
+type pruneReport struct {
+	Containers []string
+	Layers     []string
+	Reclaimed  int64
+}
+
+// pruneSystem removes every container that isn't running, then the blobs no tagged image
+// refers to and the cached layers neither a stored image nor a remaining container uses
+func pruneSystem(store *ImageStore) (pruneReport, error) {
+	var report pruneReport
+
+	states, err := listContainerStates()
+	if err != nil {
+		return report, err
+	}
+	for _, state := range states {
+		freed, removed, err := pruneContainer(state.ID)
+		if err != nil {
+			warnf(eventTypeContainer, "%v", err)
+			continue
+		}
+		if removed {
+			report.Containers = append(report.Containers, state.ID)
+			report.Reclaimed += freed
+		}
+	}
+
+	// Pulls and creates that are under way may be about to tag blobs or mount layers
+	lock, err := store.lock(true)
+	if err != nil {
+		return report, err
+	}
+	defer lock.Close()
+
+	referenced, layers, err := store.referencedBlobs()
+	if err != nil {
+		return report, err
+	}
+
+	freed, err := store.pruneBlobs(referenced)
+	report.Reclaimed += freed
+	if err != nil {
+		return report, err
+	}
+	if err := store.pruneBuildCache(); err != nil {
+		return report, err
+	}
+
+	// Containers that are left, e.g. running ones, still have their layers mounted
+	states, err = listContainerStates()
+	if err != nil {
+		return report, err
+	}
+	mounted := map[string]bool{}
+	for _, state := range states {
+		for _, dir := range state.Layers {
+			mounted[dir] = true
+		}
+	}
+
+	pruned, freed, err := pruneLayers(layers, mounted)
+	report.Layers = pruned
+	report.Reclaimed += freed
+
+	return report, err
+}
+
+// pruneContainer removes a container unless it is running, returning the space it took up.
+// The state lock keeps a concurrent start from running it while it goes.
+func pruneContainer(id string) (int64, bool, error) {
+	lock, err := lockState(id)
+	if errors.Is(err, errContainerNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if errors.Is(err, errContainerNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if state.Status == statusRunning || state.running() || state.restarting() {
+		return 0, false, nil
+	}
+
+	// Only the container's own writes are freed when it runs on the image's layers
+	var freed int64
+	if size, err := measureContainerSize(state); err == nil {
+		freed = size.RootFs
+		if len(state.Layers) > 0 || state.LowerDir != "" {
+			freed = size.RW
+		}
+	}
+
+	env := &ContainerEnvironment{id: state.ID, state: state, rootPath: state.RootPath, layers: state.Layers}
+	if err := env.Remove(); err != nil {
+		return 0, false, fmt.Errorf("failed to remove container %s: %w", shortID(id), err)
+	}
+
+	return freed, true, nil
+}
+
+// referencedBlobs returns the digests of the manifests, configs and layers of the tagged
+// images, and the layers among them
+func (s *ImageStore) referencedBlobs() (blobs, layers map[string]bool, err error) {
+	index, err := s.readIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blobs, layers = map[string]bool{}, map[string]bool{}
+	for name, tags := range index.Repositories {
+		for tag, digest := range tags {
+			blobs[digest] = true
+
+			data, err := s.readBlob(digest)
+			if err != nil {
+				return nil, nil, err
+			}
+			var manifest layersList
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse manifest of %s: %w", formatImageReference(name, tag), err)
+			}
+
+			blobs[manifest.Config.Digest] = true
+			for _, layer := range manifest.Layers {
+				blobs[layer.Digest] = true
+				layers[layer.Digest] = true
+			}
+		}
+	}
+
+	return blobs, layers, nil
+}
+
+// pruneBlobs removes the stored blobs that aren't referenced, returning the space freed
+func (s *ImageStore) pruneBlobs(referenced map[string]bool) (int64, error) {
+	dir := filepath.Join(s.root, "blobs", "sha256")
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	var freed int64
+	for _, e := range entries {
+		if referenced["sha256:"+e.Name()] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < pruneGracePeriod {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			warnf(eventTypeImage, "failed to remove blob sha256:%s: %v", e.Name(), err)
+			continue
+		}
+		freed += info.Size()
+	}
+
+	return freed, nil
+}
+
+// pruneLayers removes the cached layers that aren't layers of a stored image or mounted by a
+// container, returning their digests and the space freed
+func pruneLayers(layers, mounted map[string]bool) ([]string, int64, error) {
+	entries, err := os.ReadDir(layerCacheDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list cached layers: %w", err)
+	}
+
+	var pruned []string
+	var freed int64
+	for _, e := range entries {
+		// Locks, sizes and interrupted extractions aren't layers, the watchdog takes care of
+		// the latter
+		if !e.IsDir() || strings.Contains(e.Name(), ".") {
+			continue
+		}
+
+		dir := filepath.Join(layerCacheDir, e.Name())
+		hash, _ := strings.CutSuffix(e.Name(), "_userns")
+		digest := "sha256:" + hash
+		if layers[digest] || mounted[dir] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < pruneGracePeriod {
+			continue
+		}
+
+		size, err := dirSize(dir)
+		if err != nil {
+			warnf(eventTypeImage, "%v", err)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			warnf(eventTypeImage, "failed to remove cached layer %s: %v", digest, err)
+			continue
+		}
+		os.Remove(dir + ".lock")
+		os.Remove(dir + ".size")
+		os.Remove(dir + ".skipped")
+
+		pruned = append(pruned, digest)
+		freed += size
+	}
+
+	return pruned, freed, nil
+}
+
+// printPruneReport lists what was removed like docker system prune
+func printPruneReport(w io.Writer, report pruneReport) {
+	if len(report.Containers) > 0 {
+		fmt.Fprintln(w, "Deleted Containers:")
+		for _, id := range report.Containers {
+			fmt.Fprintln(w, id)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(report.Layers) > 0 {
+		fmt.Fprintln(w, "Deleted Layers:")
+		for _, digest := range report.Layers {
+			fmt.Fprintln(w, digest)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Total reclaimed space: %s\n", formatSize(report.Reclaimed))
+}
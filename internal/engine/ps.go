@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// psCommandWidth is how much of the command ps shows before truncating it, like Docker
+const psCommandWidth = 20
+
+// ContainerSummary is a row of the container listing, with the field names of
+// `docker ps --format json`
+type ContainerSummary struct {
+	ID        string    `json:"ID"`
+	Image     string    `json:"Image"`
+	Command   string    `json:"Command"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	State     string    `json:"State"`
+	Status    string    `json:"Status"`
+	// Ports are the ports the container's processes listen on, since it publishes none
+	Ports string `json:"Ports"`
+	Names string `json:"Names"`
+	// Size is only measured for ps --size, since that walks every rootfs
+	Size *containerSize `json:"Size,omitempty"`
+}
+
+// psOptions select which containers ps lists and what it shows about them
+type psOptions struct {
+	all     bool
+	size    bool
+	quiet   bool
+	noTrunc bool
+	format  string
+	// match limits the listing to the containers it returns true for
+	match func(*ContainerState) bool
+}
+
+// listContainers returns the summaries of the running containers, or of all with all
+func listContainers(opts psOptions) ([]ContainerSummary, error) {
+	states, err := listContainerStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []ContainerSummary
+	// Newest first, like docker ps
+	for i := len(states) - 1; i >= 0; i-- {
+		state := states[i]
+		running := state.running()
+		// Like docker ps, containers waiting to be restarted are listed with the running ones
+		if !running && !state.restarting() && !opts.all || opts.match != nil && !opts.match(state) {
+			continue
+		}
+
+		c := ContainerSummary{
+			ID:        shortID(state.ID),
+			Image:     state.Config.Image,
+			Command:   strconv.Quote(strings.Join(append([]string{state.Config.Command}, state.Config.Args...), " ")),
+			CreatedAt: state.Created,
+			State:     state.Status,
+			Status:    containerStatus(state, running),
+			Names:     state.Name,
+		}
+		if opts.noTrunc {
+			c.ID = state.ID
+		}
+		if !running && state.Status == statusRunning || state.Status == statusRestarting && !state.restarting() {
+			// The shim died before it could record the exit or restart the container
+			c.State = statusExited
+		}
+
+		if running {
+			// Listing the sockets races with the container's processes, which it can do without
+			if ports, err := listeningPorts(state); err == nil {
+				c.Ports = strings.Join(ports, ", ")
+			}
+		}
+
+		if opts.size {
+			size, err := measureContainerSize(state)
+			if err != nil {
+				return nil, fmt.Errorf("failed to measure %s: %w", state.ID, err)
+			}
+			c.Size = &size
+		}
+
+		containers = append(containers, c)
+	}
+
+	return containers, nil
+}
+
+// containerStatus describes the state of a container the way docker ps does, with the health
+// of a running one that has a healthcheck
+func containerStatus(state *ContainerState, running bool) string {
+	switch {
+	case running && state.Health != nil:
+		return fmt.Sprintf("Up %s (%s)", humanDuration(time.Since(state.Started)), state.Health.summary())
+	case running:
+		return "Up " + humanDuration(time.Since(state.Started))
+	case state.restarting():
+		return fmt.Sprintf("Restarting (%d) %s ago", state.ExitCode, humanDuration(time.Since(state.Finished)))
+	case state.Status == statusCreated:
+		return "Created"
+	case state.Finished.IsZero():
+		return "Exited"
+	}
+
+	return fmt.Sprintf("Exited (%d) %s ago", state.ExitCode, humanDuration(time.Since(state.Finished)))
+}
+
+// printContainers writes the container listing as a table, only the IDs with quiet or, for
+// --format json, one JSON object per line
+func printContainers(w io.Writer, containers []ContainerSummary, opts psOptions) error {
+	if opts.quiet {
+		for _, c := range containers {
+			fmt.Fprintln(w, c.ID)
+		}
+		return nil
+	}
+
+	switch opts.format {
+	case "", "table":
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, c := range containers {
+			if err := enc.Encode(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid --format %q: expected table or json", opts.format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	header := "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tPORTS\tNAMES"
+	if opts.size {
+		header += "\tSIZE"
+	}
+	fmt.Fprintln(tw, header)
+
+	for _, c := range containers {
+		command := c.Command
+		if len(command) > psCommandWidth && !opts.noTrunc {
+			command = command[:psCommandWidth-1] + "…\""
+		}
+
+		row := fmt.Sprintf("%s\t%s\t%s\t%s ago\t%s\t%s\t%s", c.ID, c.Image, command, humanDuration(time.Since(c.CreatedAt)), c.Status, c.Ports, c.Names)
+		if c.Size != nil {
+			row += "\t" + c.Size.String()
+		}
+		fmt.Fprintln(tw, row)
+	}
+
+	return tw.Flush()
+}
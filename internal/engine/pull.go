@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pull downloads the image into the store, publishing per-layer progress as image events.
+// Blobs that are already stored, e.g. layers shared with another image, aren't downloaded
+// again.
+func (dl *DockerImageDownloader) Pull(ctx context.Context, store *ImageStore) error {
+	lock, err := store.lock(false)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	imageProgress(strings.TrimPrefix(dl.tag, "@"), "Pulling from %s", dl.repository())
+
+	manifest, raw, err := dl.getDigests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get image digests: %w", err)
+	}
+	if manifest.Config.Digest == "" {
+		return errors.New("manifest has no image config")
+	}
+
+	if err := dl.fetchBlob(ctx, store, manifest.Config); err != nil {
+		return fmt.Errorf("failed to download image config: %w", err)
+	}
+	data, err := store.readBlob(manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	config, err := parseImageConfig(data, manifest)
+	if err != nil {
+		return err
+	}
+	if err := dl.checkPlatform(config); err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.Layers {
+		id := shortDigest(layer.Digest)
+		if store.hasBlob(layer.Digest) {
+			imageProgress(id, "Already exists")
+			dl.stats.cached(layer)
+			continue
+		}
+
+		start, received := time.Now(), dl.received
+		if err := dl.fetchBlob(ctx, store, layer); err != nil {
+			return fmt.Errorf("failed to download layer %s: %w", id, err)
+		}
+		dl.stats.downloaded(layer, dl.received-received, time.Since(start))
+		imageProgress(id, "Pull complete")
+	}
+
+	// The manifest goes in last, so a tag never points at missing blobs
+	digest, err := store.writeBlob(raw)
+	if err != nil {
+		return err
+	}
+
+	changed, err := store.tag(dl.image, dl.tag, digest)
+	if err != nil {
+		return err
+	}
+
+	imageProgress("", "Digest: %s", digest)
+	status := "Image is up to date"
+	if changed {
+		status = "Downloaded newer image"
+	}
+
+	ref := formatImageReference(dl.image, dl.tag)
+	bus.Publish(Event{
+		Type:       eventTypeImage,
+		Action:     eventActionPull,
+		ID:         ref,
+		Message:    fmt.Sprintf("Status: %s for %s", status, ref),
+		Attributes: map[string]string{"digest": digest},
+	})
+
+	return nil
+}
+
+// imageProgress publishes the status of a pull or unpack, or of one of its layers if id is a
+// layer ID
+func imageProgress(id, format string, args ...any) {
+	bus.Publish(Event{Type: eventTypeImage, Action: eventActionProgress, ID: id, Message: fmt.Sprintf(format, args...)})
+}
+
+// fetchBlob downloads a verified blob into the store unless it is already there, resuming
+// what an earlier pull left of it
+func (dl *DockerImageDownloader) fetchBlob(ctx context.Context, store *ImageStore, blob layerEntry) error {
+	if store.hasBlob(blob.Digest) {
+		return nil
+	}
+
+	partial, lock, err := store.partialBlob(blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The lock file goes last, so nobody locks a file that is about to disappear
+		os.Remove(partial + ".lock")
+		lock.Close()
+	}()
+
+	// A concurrent pull may have stored it while we waited for the lock
+	if store.hasBlob(blob.Digest) {
+		return nil
+	}
+
+	if err := dl.fetchLayer(ctx, blob, partial); err != nil {
+		return err
+	}
+
+	return store.commitBlob(blob.Digest, partial)
+}
+
+// unpackImage fills dir with the image's layers and returns its config. Images pulled
+// beforehand come from the local store without contacting the registry, unless they are for
+// another platform than the one asked for; others are downloaded straight into dir.
+func unpackImage(ctx context.Context, image, platform, dir string, steps *setupSteps) (imageConfig, error) {
+	want, err := parsePlatformOption(platform)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	store := NewImageStore(imageStoreDir)
+	img, config, err := storedImage(store, image, want)
+	if err == nil {
+		if err := store.unpack(img, dir, steps); err != nil {
+			return imageConfig{}, err
+		}
+		return config, nil
+	}
+	if !errors.Is(err, errImageNotFound) {
+		return imageConfig{}, err
+	}
+
+	dl, err := NewDockerImageDownloader(image, nil)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed to create image downloader: %w", err)
+	}
+	dl.platform = want
+	dl.steps = steps
+
+	config, err = dl.DownloadAndUnpackLayers(ctx, dir)
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed to download and unpack image: %w", err)
+	}
+
+	return config, nil
+}
+
+// parsePlatformOption parses a --platform value, nil when none was given
+func parsePlatformOption(platform string) (*Platform, error) {
+	if platform == "" {
+		return nil, nil
+	}
+
+	p, err := ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// storedImage returns the image and its config from the store, or errImageNotFound if it
+// hasn't been pulled for the platform asked for. Configs without an architecture match any.
+func storedImage(store *ImageStore, image string, want *Platform) (*StoredImage, imageConfig, error) {
+	img, err := store.Lookup(image)
+	if err != nil {
+		return nil, imageConfig{}, err
+	}
+
+	config, err := store.Config(img)
+	if err != nil {
+		return nil, imageConfig{}, err
+	}
+
+	stored := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+	if want != nil && config.Architecture != "" && !want.matches(stored) {
+		return nil, imageConfig{}, fmt.Errorf("%w for %s", errImageNotFound, want)
+	}
+
+	return img, config, nil
+}
+
+// shortDigest abbreviates a digest the way Docker shows layer IDs
+func shortDigest(digest string) string {
+	_, hash, _ := strings.Cut(digest, ":")
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+
+	return hash
+}
+
+// progressReader publishes how much of a layer has been read, with message describing what it
+// is read for
+type progressReader struct {
+	r       io.Reader
+	id      string
+	message string
+	total   int64
+	done    int64
+	last    time.Time
+}
+
+func newProgressReader(r io.Reader, layer layerEntry, message string) *progressReader {
+	return &progressReader{r: r, id: shortDigest(layer.Digest), message: message, total: layer.Size}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.done += int64(n)
+
+	// Sinks only need a few updates per second, not one per read
+	if time.Since(p.last) >= 100*time.Millisecond || err == io.EOF {
+		p.last = time.Now()
+		bus.Publish(Event{
+			Type:     eventTypeImage,
+			Action:   eventActionProgress,
+			ID:       p.id,
+			Message:  p.message,
+			Progress: &EventProgress{Current: p.done, Total: p.total},
+		})
+	}
+
+	return n, err
+}
+
+// formatSize formats a byte count with decimal units like the Docker CLI, e.g. 3.4MB
+func formatSize(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1000 && i < len(units)-1 {
+		size /= 1000
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	return fmt.Sprintf("%.3g%s", size, units[i])
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// pullStats records how each layer of a pull was obtained, for the summary pull prints at
+// the end. A nil pullStats records nothing.
+type pullStats struct {
+	start  time.Time
+	layers []layerPullStats
+}
+
+// layerPullStats is how one layer of a pull was obtained
+type layerPullStats struct {
+	digest string
+	size   int64
+	// cached is set when the layer was stored already and nothing was downloaded
+	cached bool
+	// received is what was downloaded of the layer, less than its size when an interrupted
+	// pull was resumed
+	received int64
+	download time.Duration
+}
+
+func newPullStats() *pullStats {
+	return &pullStats{start: time.Now()}
+}
+
+// cached records a layer that was already in the store
+func (p *pullStats) cached(layer layerEntry) {
+	if p == nil {
+		return
+	}
+
+	p.layers = append(p.layers, layerPullStats{digest: layer.Digest, size: layer.Size, cached: true})
+}
+
+// downloaded records a layer that was downloaded in duration
+func (p *pullStats) downloaded(layer layerEntry, received int64, duration time.Duration) {
+	if p == nil {
+		return
+	}
+
+	p.layers = append(p.layers, layerPullStats{
+		digest:   layer.Digest,
+		size:     layer.Size,
+		received: received,
+		download: duration,
+	})
+}
+
+// write prints a table of the layers followed by a line of totals
+func (p *pullStats) write(w io.Writer) error {
+	var received int64
+	var download time.Duration
+	cached := 0
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tCACHE\tDOWNLOADED\tTIME\tTHROUGHPUT")
+	for _, l := range p.layers {
+		if l.cached {
+			cached++
+			fmt.Fprintf(tw, "%s\t%s\thit\t-\t-\t-\n", shortDigest(l.digest), formatSize(l.size))
+			continue
+		}
+		received += l.received
+		download += l.download
+		fmt.Fprintf(tw, "%s\t%s\tmiss\t%s\t%s\t%s\n", shortDigest(l.digest), formatSize(l.size), formatSize(l.received), formatDuration(l.download), formatThroughput(l.received, l.download))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	layers := fmt.Sprintf("%d layers", len(p.layers))
+	if len(p.layers) == 1 {
+		layers = "1 layer"
+	}
+	transfer := "nothing downloaded"
+	if received > 0 {
+		transfer = fmt.Sprintf("%s downloaded at %s", formatSize(received), formatThroughput(received, download))
+	}
+
+	_, err := fmt.Fprintf(w, "%s, %d cached, %s, pulled in %s\n", layers, cached, transfer, formatDuration(time.Since(p.start)))
+	return err
+}
+
+// formatDuration rounds a duration for a summary, e.g. 1.234s or 56ms
+func formatDuration(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+
+	return d.Round(time.Millisecond).String()
+}
+
+// formatThroughput formats n bytes transferred in d as a rate, e.g. 12.3MB/s
+func formatThroughput(n int64, d time.Duration) string {
+	if n == 0 || d <= 0 {
+		return "-"
+	}
+
+	return formatSize(int64(float64(n)/d.Seconds())) + "/s"
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Defaults filled in for the parts a reference leaves out, like Docker does
+const (
+	// defaultDomain is where images without a registry host come from
+	defaultDomain = "docker.io"
+	// legacyDefaultDomain is an older name of Docker Hub, normalized to defaultDomain
+	legacyDefaultDomain = "index.docker.io"
+	// officialRepositoryPrefix holds the official images on Docker Hub, those named without a
+	// namespace
+	officialRepositoryPrefix = "library/"
+	// defaultTag is the tag of references with neither a tag nor a digest
+	defaultTag = "latest"
+)
+
+// maxReferenceNameLength bounds the name of a reference, registry host included
+const maxReferenceNameLength = 255
+
+var (
+	// pathComponentPattern is a component of a repository path: lowercase letters and digits,
+	// with single periods or underscores, double underscores or runs of dashes in between
+	pathComponentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	// tagPattern is a tag, at most 128 characters that don't start with a period or dash
+	tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// hostnamePattern is a registry host name without its port
+	hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+)
+
+// Reference is a parsed image reference, such as alpine, ghcr.io/org/app:1.2 or
+// localhost:5000/app@sha256:<hash>, with the parts it left out filled in
+type Reference struct {
+	// Domain is the registry host with its port, if any. Docker Hub is docker.io.
+	Domain string
+	// Path is the repository on the registry. Official Docker Hub images are under library/.
+	Path string
+	// Tag is the tag, latest unless there is a digest
+	Tag string
+	// Digest pins the manifest, in which case any tag is ignored
+	Digest string
+}
+
+// ParseReference parses an image reference of the form [host[:port]/]path[:tag][@digest]. The
+// first component of the path is taken for a registry host when it contains a period or a port,
+// or is localhost, like Docker does; otherwise the image is on Docker Hub.
+func ParseReference(s string) (Reference, error) {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("invalid image reference %q: %s", s, fmt.Sprintf(format, args...))
+	}
+
+	if s == "" {
+		return Reference{}, invalid("empty")
+	}
+
+	var ref Reference
+	name, digest, pinned := strings.Cut(s, "@")
+	if pinned {
+		if err := validateDigest(digest); err != nil {
+			return Reference{}, invalid("%v", err)
+		}
+		ref.Digest = digest
+	}
+
+	// The tag is after the last colon, unless that is the port of the registry host
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, invalid("tag %q must be at most 128 letters, digits, underscores, periods and dashes, not starting with a period or dash", ref.Tag)
+		}
+	}
+
+	if len(name) > maxReferenceNameLength {
+		return Reference{}, invalid("name is longer than %d characters", maxReferenceNameLength)
+	}
+
+	ref.Domain, ref.Path = splitDomain(name)
+	if ref.Domain == "" {
+		ref.Domain = defaultDomain
+	} else if err := validateDomain(ref.Domain); err != nil {
+		return Reference{}, invalid("%v", err)
+	}
+	if ref.Domain == legacyDefaultDomain {
+		ref.Domain = defaultDomain
+	}
+
+	if ref.Path == "" {
+		return Reference{}, invalid("no repository name")
+	}
+	for _, component := range strings.Split(ref.Path, "/") {
+		if pathComponentPattern.MatchString(component) {
+			continue
+		}
+		if strings.ToLower(component) != component && pathComponentPattern.MatchString(strings.ToLower(component)) {
+			return Reference{}, invalid("repository name must be lowercase")
+		}
+		return Reference{}, invalid("%q is not a valid repository name component", component)
+	}
+
+	if ref.Domain == defaultDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = officialRepositoryPrefix + ref.Path
+	}
+
+	if ref.Digest != "" {
+		// Like Docker, the digest alone decides which image this is
+		ref.Tag = ""
+	} else if ref.Tag == "" {
+		ref.Tag = defaultTag
+	}
+
+	return ref, nil
+}
+
+// splitDomain splits the registry host off a name, "" when the name has none
+func splitDomain(name string) (domain, path string) {
+	first, rest, ok := strings.Cut(name, "/")
+	if !ok || !(strings.ContainsAny(first, ".:") || first == "localhost") {
+		return "", name
+	}
+
+	return first, rest
+}
+
+// validateDomain checks a registry host with an optional port, an IPv6 address in brackets
+func validateDomain(domain string) error {
+	host := domain
+	if h, port, err := net.SplitHostPort(domain); err == nil {
+		if port == "" || strings.Trim(port, "0123456789") != "" {
+			return fmt.Errorf("invalid port in registry host %q", domain)
+		}
+		host = h
+	} else if strings.HasPrefix(domain, "[") {
+		host = strings.TrimSuffix(strings.TrimPrefix(domain, "["), "]")
+	}
+
+	if strings.Contains(host, ":") {
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid registry host %q", domain)
+		}
+		return nil
+	}
+	if !hostnamePattern.MatchString(host) {
+		return fmt.Errorf("invalid registry host %q", domain)
+	}
+
+	return nil
+}
+
+// Name returns the fully qualified repository, e.g. docker.io/library/alpine
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// String returns the normalized reference, e.g. docker.io/library/alpine:latest
+func (r Reference) String() string {
+	return r.Name() + r.suffix()
+}
+
+// FamiliarName returns the repository the way Docker shows it, without docker.io/ and the
+// library/ of official images
+func (r Reference) FamiliarName() string {
+	if r.Domain != defaultDomain {
+		return r.Name()
+	}
+	if name, ok := strings.CutPrefix(r.Path, officialRepositoryPrefix); ok && !strings.Contains(name, "/") {
+		return name
+	}
+
+	return r.Path
+}
+
+// FamiliarString returns the reference the way Docker shows it, e.g. alpine:latest
+func (r Reference) FamiliarString() string {
+	return r.FamiliarName() + r.suffix()
+}
+
+// suffix is the tag or digest part of the reference
+func (r Reference) suffix() string {
+	if r.Digest != "" {
+		return "@" + r.Digest
+	}
+
+	return ":" + r.Tag
+}
+
+// storeTag returns what the image store keeps the image under next to its familiar name: the
+// tag, or "@" and the digest for an image pinned by digest
+func (r Reference) storeTag() string {
+	if r.Digest != "" {
+		return "@" + r.Digest
+	}
+
+	return r.Tag
+}
@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubServers are the keys Docker Hub credentials may be stored under in the Docker CLI
+// config, the first being the one docker login uses
+var dockerHubServers = []string{
+	"https://index.docker.io/v1/",
+	"index.docker.io",
+	"docker.io",
+	"registry-1.docker.io",
+	"registry.hub.docker.com",
+}
+
+// registryCredentials are the username and password sent to the token endpoint, or to the
+// registry itself if it uses basic authentication
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// dockerConfig is the part of the Docker CLI config that holds registry credentials
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerConfigPath returns the path of the Docker CLI config, which $DOCKER_CONFIG moves the
+// same way it does for docker, and otherwise the credentials file of the config file
+func dockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	if settings.CredentialsFile != "" {
+		return settings.CredentialsFile, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// registryServers returns the keys the credentials of a registry domain may be stored under,
+// the first being the one docker login uses
+func registryServers(domain string) []string {
+	if domain == defaultDomain {
+		return dockerHubServers
+	}
+
+	return []string{domain, "https://" + domain, "http://" + domain}
+}
+
+// lookupRegistryCredentials returns the credentials stored by docker login for the registry
+// known under servers, or nil if there are none. A credential helper configured for the
+// registry takes precedence over the auths, and the global credsStore is used if neither has
+// an entry.
+func lookupRegistryCredentials(servers []string) (*registryCredentials, error) {
+	path, err := dockerConfigPath()
+	if err != nil {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, server := range servers {
+		if helper, ok := config.CredHelpers[server]; ok {
+			return credentialHelper(helper, server)
+		}
+	}
+
+	for _, server := range servers {
+		auth, ok := config.Auths[server]
+		if !ok {
+			continue
+		}
+
+		creds := &registryCredentials{Username: auth.Username, Password: auth.Password}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s in %s: %w", server, path, err)
+			}
+			user, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth for %s in %s: expected user:password", server, path)
+			}
+			creds = &registryCredentials{Username: user, Password: password}
+		}
+		if creds.Username != "" {
+			return creds, nil
+		}
+	}
+
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, servers[0])
+	}
+
+	return nil, nil
+}
+
+// credentialHelper asks docker-credential-<helper> for the credentials of server, following
+// the protocol of the Docker credential helpers. A helper that has none returns nil.
+func credentialHelper(helper, server string) (*registryCredentials, error) {
+	program := "docker-credential-" + helper
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return nil, nil
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("failed to get credentials from %s: %w: %s", program, err, msg)
+		}
+		return nil, fmt.Errorf("failed to get credentials from %s: %w", program, err)
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials from %s: %w", program, err)
+	}
+
+	return &registryCredentials{Username: resp.Username, Password: resp.Secret}, nil
+}
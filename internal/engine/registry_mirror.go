@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// registryMirrorArg is the global option for a Docker Hub mirror
+const registryMirrorArg = "--registry-mirror"
+
+// daemonConfigPath is the host-wide config, which has the same registry-mirrors setting as
+// dockerd's daemon.json
+const daemonConfigPath = "/etc/your-docker/daemon.json"
+
+// registryMirrorFlags are the mirrors given with registryMirrorArg, which replace those of
+// the daemon config
+var registryMirrorFlags []string
+
+// daemonConfig is the file at daemonConfigPath
+type daemonConfig struct {
+	RegistryMirrors []string `json:"registry-mirrors"`
+}
+
+// addRegistryMirror records a mirror given with registryMirrorArg
+func addRegistryMirror(mirror string) error {
+	normalized, err := parseRegistryMirror(mirror)
+	if err != nil {
+		return fmt.Errorf("%w %s %q: %v", errInvalidGlobalOption, registryMirrorArg, mirror, err)
+	}
+	registryMirrorFlags = append(registryMirrorFlags, normalized)
+
+	return nil
+}
+
+// parseRegistryMirror checks that a mirror is the URL of a registry's root, without a path,
+// and returns it without a trailing slash
+func parseRegistryMirror(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", errors.New("expected a URL like https://mirror.example.com")
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", errors.New("a mirror is the root of a registry, without a path")
+	}
+
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// registryMirrors returns the mirrors Docker Hub images are pulled from before Docker Hub
+// itself, in the order they are tried: those of the global options, else of the config file,
+// else of the daemon config
+func registryMirrors() ([]string, error) {
+	if len(registryMirrorFlags) > 0 {
+		return registryMirrorFlags, nil
+	}
+	if len(settings.RegistryMirrors) > 0 {
+		return settings.RegistryMirrors, nil
+	}
+
+	data, err := os.ReadFile(daemonConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config daemonConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", daemonConfigPath, err)
+	}
+
+	mirrors := make([]string, 0, len(config.RegistryMirrors))
+	for _, mirror := range config.RegistryMirrors {
+		normalized, err := parseRegistryMirror(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry mirror %q in %s: %w", mirror, daemonConfigPath, err)
+		}
+		mirrors = append(mirrors, normalized)
+	}
+
+	return mirrors, nil
+}
+
+// registry returns the registry the downloader's requests go to, a mirror until they have
+// all failed
+func (dl *DockerImageDownloader) registry() string {
+	return dl.sources[dl.source]
+}
+
+// fallBack gives up the mirror that failed a request for the next one, or Docker Hub, and
+// reports whether there was one left. A cancelled pull isn't the mirror's fault.
+func (dl *DockerImageDownloader) fallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || dl.source == len(dl.sources)-1 {
+		return false
+	}
+
+	failed := dl.registry()
+	dl.source++
+	warnf(eventTypeImage, "registry mirror %s failed: %v, falling back to %s", registryHost(failed), err, registryHost(dl.registry()))
+
+	return true
+}
+
+// fallBackToUpstream gives up every mirror left for Docker Hub after one served corrupt data,
+// since the others may well cache the same blob, and reports whether there was a mirror to
+// give up
+func (dl *DockerImageDownloader) fallBackToUpstream(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || dl.source == len(dl.sources)-1 {
+		return false
+	}
+
+	failed := dl.registry()
+	dl.source = len(dl.sources) - 1
+	warnf(eventTypeImage, "registry mirror %s served corrupt data: %v, falling back to %s", registryHost(failed), err, registryHost(dl.registry()))
+
+	return true
+}
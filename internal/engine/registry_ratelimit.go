@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retries of requests a registry answered with 429 Too Many Requests. Without a Retry-After
+// the delay doubles from rateLimitRetryDelay with up to half of it added at random, so that
+// parallel pulls, e.g. of a CI fleet, don't come back all at once.
+const (
+	maxRateLimitAttempts = 4
+	rateLimitRetryDelay  = 2 * time.Second
+	// maxRateLimitWait is the longest Retry-After that is waited out rather than reported,
+	// which keeps the retries within the timeout of the registry client
+	maxRateLimitWait = 20 * time.Second
+	// lowRateLimitShare is the share of the pull limit left below which pulls warn about it
+	lowRateLimitShare = 0.1
+)
+
+// rateLimit is what the RateLimit-Limit and RateLimit-Remaining headers of Docker Hub say,
+// e.g. "100;w=21600": that many pulls per window
+type rateLimit struct {
+	limit     int
+	remaining int
+	window    time.Duration
+	// source is who the limit applies to, the client's IP address for anonymous pulls
+	source string
+}
+
+// parseRateLimit reads the rate limit headers of a response, reporting whether there were any
+func parseRateLimit(header http.Header) (rateLimit, bool) {
+	limit, window, okLimit := parseRateLimitHeader(header.Get("RateLimit-Limit"))
+	remaining, _, okRemaining := parseRateLimitHeader(header.Get("RateLimit-Remaining"))
+	if !okLimit || !okRemaining {
+		return rateLimit{}, false
+	}
+
+	return rateLimit{limit: limit, remaining: remaining, window: window, source: header.Get("Docker-RateLimit-Source")}, true
+}
+
+// parseRateLimitHeader parses a value like "100;w=21600" into the count and the window
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	count, params, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, param := range strings.Split(params, ";") {
+		if w, ok := strings.CutPrefix(strings.TrimSpace(param), "w="); ok {
+			if seconds, err := strconv.Atoi(w); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return n, window, true
+}
+
+// String describes the limit like "0 of 100 pulls left per 6h0m0s for 192.0.2.1"
+func (l rateLimit) String() string {
+	s := fmt.Sprintf("%d of %d pulls left", l.remaining, l.limit)
+	if l.window > 0 {
+		s += " per " + l.window.String()
+	}
+	if l.source != "" {
+		s += " for " + l.source
+	}
+
+	return s
+}
+
+// parseRetryAfter reads the Retry-After header, in seconds or as a date
+func parseRetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+// rateLimitError reports a request the registry kept refusing with 429 Too Many Requests
+type rateLimitError struct {
+	host string
+	// limit is set if the registry said how many pulls are left
+	limit      *rateLimit
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s is rate limiting pulls", e.host)
+	if e.limit != nil {
+		fmt.Fprintf(&b, " (%s)", e.limit)
+	}
+	if e.retryAfter > 0 {
+		fmt.Fprintf(&b, ", retry in %s", e.retryAfter.Round(time.Second))
+	} else {
+		b.WriteString(", retry later")
+	}
+	b.WriteString("; logging in with docker login or pull -u raises Docker Hub's limit, and --registry-mirror avoids it")
+
+	return b.String()
+}
+
+// rateLimitTransport retries requests answered with 429 Too Many Requests after the
+// registry's Retry-After or a backoff with jitter, and fails them with a rateLimitError once
+// that would take too long. A limit that is used up for its window isn't retried at all.
+type rateLimitTransport struct {
+	base http.RoundTripper
+	// lowWarning warns about the pulls that are left once
+	lowWarning sync.Once
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		limit, hasLimit := parseRateLimit(resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			if hasLimit && limit.limit > 0 && float64(limit.remaining) < lowRateLimitShare*float64(limit.limit) {
+				t.lowWarning.Do(func() {
+					warnf(eventTypeImage, "%s: only %s", req.URL.Host, limit)
+				})
+			}
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+
+		rateErr := &rateLimitError{host: req.URL.Host}
+		if hasLimit {
+			rateErr.limit = &limit
+		}
+		delay, hasRetryAfter := parseRetryAfter(resp.Header, time.Now())
+		if !hasRetryAfter {
+			delay = rateLimitRetryDelay << (attempt - 1)
+			delay += rand.N(delay/2 + 1)
+		}
+		rateErr.retryAfter = delay
+
+		exhausted := hasLimit && limit.remaining == 0 && !hasRetryAfter
+		// Requests without a body can be sent again as they are, uploads can't
+		if exhausted || attempt >= maxRateLimitAttempts || delay > maxRateLimitWait || req.Body != nil && req.Body != http.NoBody {
+			if exhausted {
+				rateErr.retryAfter = 0
+			}
+			return nil, rateErr
+		}
+
+		warnf(eventTypeImage, "%s answered 429 Too Many Requests, retrying in %s", req.URL.Host, delay.Round(100*time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
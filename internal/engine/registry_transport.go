@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Global options for registries behind corporate proxies and CAs
+const (
+	registryCAArg       = "--registry-ca"
+	insecureRegistryArg = "--insecure-registry"
+)
+
+// dockerHubHosts are the hosts --insecure-registry docker.io stands for
+var dockerHubHosts = []string{"registry.hub.docker.com", "auth.docker.io", "registry-1.docker.io", "index.docker.io"}
+
+// registryCAFiles are the PEM files given with registryCAArg, trusted on top of the host's CAs
+var registryCAFiles []string
+
+// insecureRegistries are the hosts given with insecureRegistryArg
+var insecureRegistries []string
+
+// addInsecureRegistry records a host, with an optional port, that isn't verified
+func addInsecureRegistry(host string) error {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return fmt.Errorf("%w %s %q: expected a host name with an optional port", errInvalidGlobalOption, insecureRegistryArg, host)
+	}
+
+	if host == defaultDomain {
+		insecureRegistries = append(insecureRegistries, dockerHubHosts...)
+		return nil
+	}
+	insecureRegistries = append(insecureRegistries, host)
+
+	return nil
+}
+
+// newRegistryTransport returns the transport registry requests go through: the proxy from
+// $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY or the config file, the host's CAs plus
+// registryCAFiles and, for insecureRegistries, no verification and a fallback to plain HTTP
+func newRegistryTransport() (http.RoundTripper, error) {
+	secure := http.DefaultTransport.(*http.Transport).Clone()
+	secure.Proxy = registryProxy
+
+	if len(registryCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range registryCAFiles {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read registry CA: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("failed to read registry CA: no PEM certificates in %s", file)
+			}
+		}
+		secure.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if len(insecureRegistries) == 0 {
+		return secure, nil
+	}
+
+	insecure := secure.Clone()
+	insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	t := &insecureRegistryTransport{secure: secure, insecure: insecure, hosts: map[string]bool{}}
+	for _, host := range insecureRegistries {
+		t.hosts[host] = true
+	}
+
+	return t, nil
+}
+
+// insecureRegistryTransport sends the requests to insecure registries without verifying
+// their certificates, and over plain HTTP once they turn out not to speak HTTPS, like
+// Docker's insecure-registries
+type insecureRegistryTransport struct {
+	secure   http.RoundTripper
+	insecure http.RoundTripper
+	hosts    map[string]bool
+	// plainHTTP are the hosts that answered HTTPS with HTTP
+	plainHTTP sync.Map
+}
+
+func (t *insecureRegistryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !t.hosts[host] && !t.hosts[req.URL.Hostname()] {
+		return t.secure.RoundTrip(req)
+	}
+
+	if _, ok := t.plainHTTP.Load(host); ok && req.URL.Scheme == "https" {
+		return t.insecure.RoundTrip(plainHTTPRequest(req))
+	}
+
+	resp, err := t.insecure.RoundTrip(req)
+	if answeredWithHTTP(err) && req.URL.Scheme == "https" {
+		warnf(eventTypeImage, "%s doesn't speak HTTPS, falling back to plain HTTP", host)
+		t.plainHTTP.Store(host, true)
+		return t.insecure.RoundTrip(plainHTTPRequest(req))
+	}
+
+	return resp, err
+}
+
+// answeredWithHTTP reports whether a TLS handshake failed because the server answered it
+// with plain HTTP
+func answeredWithHTTP(err error) bool {
+	var record tls.RecordHeaderError
+	return errors.Is(err, http.ErrSchemeMismatch) || errors.As(err, &record) && string(record.RecordHeader[:]) == "HTTP/"
+}
+
+// plainHTTPRequest returns a copy of an HTTPS request sent over HTTP instead
+func plainHTTPRequest(req *http.Request) *http.Request {
+	plain := req.Clone(req.Context())
+	plain.URL.Scheme = "http"
+
+	return plain
+}
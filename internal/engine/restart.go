@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies, as in Docker
+const (
+	restartNo            = "no"
+	restartAlways        = "always"
+	restartOnFailure     = "on-failure"
+	restartUnlessStopped = "unless-stopped"
+)
+
+// Like Docker, the shim waits restartDelayMin before the first restart and twice as long
+// before each next one, up to restartDelayMax. A container that ran restartResetAfter or
+// longer before it exited starts over.
+const (
+	restartDelayMin   = 100 * time.Millisecond
+	restartDelayMax   = time.Minute
+	restartResetAfter = 10 * time.Second
+)
+
+// restartPollInterval is how often a shim waiting to restart its container checks whether
+// it was stopped meanwhile
+const restartPollInterval = 100 * time.Millisecond
+
+// RestartPolicy decides whether the shim restarts a detached container that exited
+type RestartPolicy struct {
+	// Name is no, always, on-failure or unless-stopped
+	Name string `json:"name"`
+	// MaximumRetryCount bounds the restarts of on-failure, 0 for no limit
+	MaximumRetryCount int `json:"maximumRetryCount,omitempty"`
+}
+
+// ParseRestartPolicy parses a --restart value: no, always, unless-stopped or
+// on-failure[:max-retries]
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	name, retries, hasRetries := strings.Cut(s, ":")
+	switch name {
+	case "", restartNo, restartAlways, restartUnlessStopped:
+		if hasRetries {
+			return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: only on-failure takes a maximum retry count", s)
+		}
+		if name == "" {
+			name = restartNo
+		}
+		return RestartPolicy{Name: name}, nil
+	case restartOnFailure:
+		policy := RestartPolicy{Name: name}
+		if hasRetries {
+			n, err := strconv.Atoi(retries)
+			if err != nil || n < 0 {
+				return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: the maximum retry count must be a number of 0 or more", s)
+			}
+			policy.MaximumRetryCount = n
+		}
+		return policy, nil
+	}
+
+	return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: expected no, always, unless-stopped or on-failure[:max-retries]", s)
+}
+
+// enabled reports whether the policy restarts containers at all
+func (p RestartPolicy) enabled() bool {
+	return p.Name != "" && p.Name != restartNo
+}
+
+// shouldRestart reports whether a container restarted restarts times so far is restarted
+// after exiting with code
+func (p RestartPolicy) shouldRestart(code, restarts int) bool {
+	switch p.Name {
+	case restartAlways, restartUnlessStopped:
+		return true
+	case restartOnFailure:
+		return code != 0 && (p.MaximumRetryCount == 0 || restarts < p.MaximumRetryCount)
+	}
+
+	return false
+}
+
+// restartDelay returns how long to wait before restarting a container that ran for ran, when
+// the wait before its last restart was previous
+func restartDelay(previous, ran time.Duration) time.Duration {
+	if previous == 0 || ran >= restartResetAfter {
+		return restartDelayMin
+	}
+
+	return min(previous*2, restartDelayMax)
+}
+
+// restarting reports whether the container exited and its shim is waiting to restart it
+func (s *ContainerState) restarting() bool {
+	return s.Status == statusRestarting && processAlive(s.ShimPid)
+}
+
+// stopRestarts keeps the restart policy from restarting the container until it is started
+// again, because it is being stopped on purpose. It returns the container's state.
+func stopRestarts(id string) (*ContainerState, error) {
+	lock, err := lockState(id)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if err != nil || !state.Config.Restart.enabled() || state.StoppedByUser {
+		return state, err
+	}
+
+	state.StoppedByUser = true
+	return state, state.save()
+}
+
+// restart waits before restarting the exited container under a new shim, as long as the
+// restart policy says, unless it is stopped meanwhile. Starts that fail are retried the same
+// way. It reports whether the container was restarted; if not, its exit is recorded.
+func (env *ContainerEnvironment) restart() bool {
+	delay := restartDelay(env.state.RestartDelay, env.state.Finished.Sub(env.state.Started))
+	for {
+		deadline := time.Now().Add(delay)
+		for time.Now().Before(deadline) {
+			if state, err := loadContainerState(env.id); err != nil || state.StoppedByUser {
+				break
+			}
+			time.Sleep(min(restartPollInterval, time.Until(deadline)))
+		}
+
+		// A container removed meanwhile has nothing left to record
+		restarted, err := restartContainer(env.id, delay)
+		if err == nil || errors.Is(err, errContainerNotFound) {
+			return restarted
+		}
+		warnf(eventTypeContainer, "failed to restart %s: %v", shortID(env.id), err)
+		delay = restartDelay(delay, 0)
+	}
+}
+
+// restartContainer starts a container whose shim is waiting to restart it, after it waited
+// delay, unless it was stopped or started by hand meanwhile
+func restartContainer(id string, delay time.Duration) (bool, error) {
+	lock, err := lockState(id)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	env, err := loadContainerEnvironment(id)
+	if err != nil || env.state.Status != statusRestarting {
+		return false, err
+	}
+	if env.state.StoppedByUser {
+		env.state.Status = statusExited
+		return false, env.state.save()
+	}
+
+	env.state.RestartCount++
+	env.state.RestartDelay = delay
+	if err := env.state.save(); err != nil {
+		return false, err
+	}
+	containerEvent(eventActionRestart, id, map[string]string{"restartCount": strconv.Itoa(env.state.RestartCount)})
+
+	return true, env.start()
+}
@@ -0,0 +1,25 @@
+package engine
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Rlimit is a process resource limit applied with setrlimit before the command starts
+type Rlimit struct {
+	Resource int    `json:"resource"`
+	Soft     uint64 `json:"soft"`
+	Hard     uint64 `json:"hard"`
+}
+
+// applyRlimits sets the limits on the current process, so the command inherits them on exec
+func applyRlimits(limits []Rlimit) error {
+	for _, l := range limits {
+		rlim := syscall.Rlimit{Cur: l.Soft, Max: l.Hard}
+		if err := syscall.Setrlimit(l.Resource, &rlim); err != nil {
+			return fmt.Errorf("failed to set resource limit %d: %w", l.Resource, err)
+		}
+	}
+
+	return nil
+}
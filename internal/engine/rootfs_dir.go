@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskRootfsDir is where container root filesystems are unpacked when the temporary
+// directory is backed by memory. The storage root of the config file moves it.
+var diskRootfsDir = "/var/lib/your-docker/containers"
+
+// Magic numbers of memory-backed filesystems, see statfs(2)
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// rootfsParentDir returns the directory new root filesystems are created in. That is the
+// temporary directory, unless it is on tmpfs: unpacking images there quietly uses up memory,
+// so diskRootfsDir is preferred if it is on disk. Otherwise the temporary directory is used
+// anyway, with a warning about how much memory it can take.
+func rootfsParentDir() string {
+	tmp := os.TempDir()
+	fs, onMemory := memoryBacked(tmp)
+	if !onMemory {
+		return tmp
+	}
+
+	if err := os.MkdirAll(diskRootfsDir, 0700); err == nil {
+		if _, onMemory := memoryBacked(diskRootfsDir); !onMemory {
+			return diskRootfsDir
+		}
+	}
+
+	free := int64(uint64(fs.Bavail) * uint64(fs.Bsize))
+	total := int64(uint64(fs.Blocks) * uint64(fs.Bsize))
+	warnf(eventTypeContainer, "%s is on tmpfs with %s free of %s, so the unpacked image takes up memory; set TMPDIR to a directory on disk to avoid it",
+		tmp, formatSize(free), formatSize(total))
+
+	return tmp
+}
+
+// memoryBacked returns the statfs of the filesystem at path and whether it keeps its files
+// in memory. Filesystems that can't be inspected are assumed to be on disk.
+func memoryBacked(path string) (syscall.Statfs_t, bool) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return fs, false
+	}
+
+	magic := uint32(fs.Type)
+	return fs, magic == tmpfsMagic || magic == ramfsMagic
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"syscall"
+	"time"
+)
+
+// Defaults of the sandbox preset, sized for short snippets of untrusted code
+const (
+	sandboxTimeout    = 10 * time.Second
+	sandboxMemory     = 256 << 20
+	sandboxCPUs       = 1
+	sandboxPidsLimit  = 64
+	sandboxTmpSize    = 64 << 20
+	sandboxMaxFiles   = 256
+	sandboxMaxFileLen = 64 << 20
+)
+
+// sandboxRlimits cap open files and written file sizes and disable core dumps
+var sandboxRlimits = []Rlimit{
+	{Resource: syscall.RLIMIT_NOFILE, Soft: sandboxMaxFiles, Hard: sandboxMaxFiles},
+	{Resource: syscall.RLIMIT_FSIZE, Soft: sandboxMaxFileLen, Hard: sandboxMaxFileLen},
+	{Resource: syscall.RLIMIT_CORE, Soft: 0, Hard: 0},
+}
+
+// applySandboxPreset locks opts down for running untrusted code. Resource limits that were set
+// explicitly are kept, the isolation settings always apply.
+func applySandboxPreset(opts *RunOptions, timeout time.Duration) {
+	opts.Network = NetworkNone
+	opts.SecurityOpts = []string{"seccomp=strict"}
+	opts.UserNamespace = true
+	opts.ReadOnlyRootfs = true
+	// Avoid a fresh download per snippet, the rootfs is read-only anyway
+	opts.SharedRootfs = true
+	opts.Tmpfs = append(opts.Tmpfs, TmpfsMount{Target: "/tmp", Size: sandboxTmpSize})
+	opts.Rlimits = sandboxRlimits
+	opts.Timeout = timeout
+	// Nothing a snippet leaves behind is kept
+	opts.AutoRemove = true
+
+	if opts.Limits.Memory == 0 {
+		opts.Limits.Memory = sandboxMemory
+	}
+	if opts.Limits.CPUs == 0 {
+		opts.Limits.CPUs = sandboxCPUs
+	}
+	if opts.Limits.PidsLimit == 0 {
+		opts.Limits.PidsLimit = sandboxPidsLimit
+	}
+}
@@ -0,0 +1,500 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs         = 38
+	seccompSetModeFilter    = 1
+	seccompFilterFlagTSync  = 1
+	seccompDataNrOffset     = 0
+	seccompDataArchOffset   = 4
+	seccompDataArgsOffset   = 16
+	seccompRetKillProcess   = 0x80000000
+	seccompRetKillThread    = 0x00000000
+	seccompRetTrap          = 0x00030000
+	seccompRetErrno         = 0x00050000
+	seccompRetTrace         = 0x7ff00000
+	seccompRetLog           = 0x7ffc0000
+	seccompRetAllow         = 0x7fff0000
+	seccompX32SyscallBit    = 0x40000000
+	seccompMaxJumpOffset    = 255
+	seccompMaxProgramLength = 4096
+)
+
+// The syscall tables are picked at runtime rather than with GOARCH file suffixes, because
+// your_docker.sh builds the listed files and build constraints don't apply to those
+var seccompNativeArch, seccompArchName, seccompSyscallNumbers = nativeSeccompArch()
+
+// nativeSeccompArch returns the AUDIT_ARCH value, libseccomp name and syscall table of the
+// architecture we run on. The table is empty on unsupported architectures.
+func nativeSeccompArch() (uint32, string, map[string]uint32) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return auditArchX86_64, "SCMP_ARCH_X86_64", seccompX86_64Syscalls
+	case "arm64":
+		return auditArchAarch64, "SCMP_ARCH_AARCH64", seccompAarch64Syscalls
+	default:
+		return 0, "", map[string]uint32{}
+	}
+}
+
+// dockerDefaultCapabilities is the capability set Docker grants containers by default, and
+// ours keep unless the security policy or --cap-add and --cap-drop change it
+var dockerDefaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// seccompProfile mirrors the JSON layout of Docker seccomp profiles
+type seccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	Syscalls        []seccompSyscall `json:"syscalls"`
+}
+
+// seccompSyscall is a single rule of a seccomp profile
+type seccompSyscall struct {
+	Name     string        `json:"name,omitempty"`
+	Names    []string      `json:"names,omitempty"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint         `json:"errnoRet,omitempty"`
+	Args     []seccompArg  `json:"args,omitempty"`
+	Includes seccompFilter `json:"includes,omitempty"`
+	Excludes seccompFilter `json:"excludes,omitempty"`
+}
+
+// seccompFilter restricts a rule to particular architectures, capabilities or kernels
+type seccompFilter struct {
+	Arches    []string `json:"arches,omitempty"`
+	Caps      []string `json:"caps,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// seccompArg is a condition on a syscall argument
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// ParseSeccompOption resolves the value of a `seccomp=` security option into a profile.
+// A nil profile with a nil error means the container runs unconfined.
+func ParseSeccompOption(value string) (*seccompProfile, error) {
+	switch value {
+	case "unconfined":
+		return nil, nil
+	case "", "default", "builtin":
+		return defaultSeccompProfile(), nil
+	case "strict":
+		return strictSeccompProfile(), nil
+	}
+
+	return loadSeccompProfile(value)
+}
+
+// loadSeccompProfile reads a Docker-format seccomp profile from disk
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile %s: %w", path, err)
+	}
+
+	var profile seccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile %s: %w", path, err)
+	}
+
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("seccomp profile %s has no defaultAction", path)
+	}
+
+	return &profile, nil
+}
+
+// compile translates the profile into a BPF program for the native architecture
+func (p *seccompProfile) compile(capabilities capabilitySet) ([]syscall.SockFilter, error) {
+	if len(seccompSyscallNumbers) == 0 {
+		return nil, errors.New("seccomp is not supported on this architecture")
+	}
+
+	if len(p.Architectures) > 0 && !containsString(p.Architectures, seccompArchName) {
+		return nil, fmt.Errorf("seccomp profile does not support architecture %s", seccompArchName)
+	}
+
+	defaultAction, err := seccompActionValue(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	asm := &bpfAssembler{}
+	asm.load(seccompDataArchOffset)
+	asm.jumpIf(syscall.BPF_JEQ, seccompNativeArch, "arch", "")
+	asm.ret(seccompRetKillProcess)
+	asm.label("arch")
+	asm.load(seccompDataNrOffset)
+	if seccompNativeArch == auditArchX86_64 {
+		// Reject the x32 ABI, which shares the audit arch with x86_64
+		asm.jumpIf(syscall.BPF_JGE, seccompX32SyscallBit, "", "native")
+		asm.ret(defaultAction)
+		asm.label("native")
+	}
+
+	for i, rule := range p.Syscalls {
+		if !rule.applies(kernel, capabilities) {
+			continue
+		}
+
+		action, err := seccompActionValue(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+
+		for j, name := range names {
+			// Syscalls that don't exist on this architecture are skipped, as libseccomp does
+			nr, ok := seccompSyscallNumbers[name]
+			if !ok {
+				continue
+			}
+
+			next := fmt.Sprintf("rule%d.%d", i, j)
+			asm.jumpIf(syscall.BPF_JEQ, nr, "", next)
+			if err := asm.argChecks(rule.Args, next); err != nil {
+				return nil, fmt.Errorf("syscall %s: %w", name, err)
+			}
+			asm.ret(action)
+			asm.label(next)
+			if len(rule.Args) > 0 {
+				asm.load(seccompDataNrOffset)
+			}
+		}
+	}
+
+	asm.ret(defaultAction)
+
+	return asm.assemble()
+}
+
+// applies reports whether the rule's includes/excludes match the running container and the
+// capabilities it keeps
+func (r seccompSyscall) applies(kernel [2]int, capabilities capabilitySet) bool {
+	if len(r.Includes.Arches) > 0 && !matchesSeccompArch(r.Includes.Arches) {
+		return false
+	}
+	if len(r.Excludes.Arches) > 0 && matchesSeccompArch(r.Excludes.Arches) {
+		return false
+	}
+
+	for _, c := range r.Includes.Caps {
+		if !capabilities.has(c) {
+			return false
+		}
+	}
+	for _, c := range r.Excludes.Caps {
+		if capabilities.has(c) {
+			return false
+		}
+	}
+
+	if r.Includes.MinKernel != "" && !kernelAtLeast(kernel, r.Includes.MinKernel) {
+		return false
+	}
+	if r.Excludes.MinKernel != "" && kernelAtLeast(kernel, r.Excludes.MinKernel) {
+		return false
+	}
+
+	return true
+}
+
+// matchesSeccompArch reports whether the native architecture is in the given list
+func matchesSeccompArch(arches []string) bool {
+	short := map[string]string{
+		"SCMP_ARCH_X86_64":  "amd64",
+		"SCMP_ARCH_AARCH64": "arm64",
+	}[seccompArchName]
+
+	for _, a := range arches {
+		if a == seccompArchName || a == short {
+			return true
+		}
+	}
+
+	return false
+}
+
+// seccompActionValue converts a profile action name into a seccomp return value
+func seccompActionValue(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		return seccompRetErrno | (errno & 0xffff), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_TRACE":
+		return seccompRetTrace | (errno & 0xffff), nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	default:
+		return 0, fmt.Errorf("unsupported seccomp action %q", action)
+	}
+}
+
+// installSeccompFilter loads the program into the kernel for every thread of this process.
+// Children created afterwards, including the container command, inherit the filter.
+func installSeccompFilter(filter []syscall.SockFilter) error {
+	if len(filter) == 0 {
+		return errors.New("empty seccomp filter")
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %w", errno)
+	}
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	nr := uintptr(seccompSyscallNumbers["seccomp"])
+	_, _, errno := syscall.RawSyscall(nr, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+
+	return nil
+}
+
+// bpfInstruction is a BPF instruction whose jump targets may still be symbolic
+type bpfInstruction struct {
+	filter    syscall.SockFilter
+	jumpTrue  string
+	jumpFalse string
+}
+
+// bpfAssembler builds classic BPF programs with label-based jumps
+type bpfAssembler struct {
+	insns  []bpfInstruction
+	labels map[string]int
+}
+
+// load loads a 32-bit word of struct seccomp_data into the accumulator
+func (a *bpfAssembler) load(offset uint32) {
+	a.emit(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, offset, "", "")
+}
+
+// jumpIf emits a conditional jump; an empty label falls through to the next instruction
+func (a *bpfAssembler) jumpIf(op uint16, k uint32, jumpTrue, jumpFalse string) {
+	a.emit(syscall.BPF_JMP|op|syscall.BPF_K, k, jumpTrue, jumpFalse)
+}
+
+// ret emits a return with the given seccomp action
+func (a *bpfAssembler) ret(action uint32) {
+	a.emit(syscall.BPF_RET|syscall.BPF_K, action, "", "")
+}
+
+// label marks the position of the next instruction
+func (a *bpfAssembler) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAssembler) emit(code uint16, k uint32, jumpTrue, jumpFalse string) {
+	a.insns = append(a.insns, bpfInstruction{
+		filter:    syscall.SockFilter{Code: code, K: k},
+		jumpTrue:  jumpTrue,
+		jumpFalse: jumpFalse,
+	})
+}
+
+// argChecks emits comparisons for every argument condition, jumping to fail on mismatch
+func (a *bpfAssembler) argChecks(args []seccompArg, fail string) error {
+	for i, arg := range args {
+		if arg.Index > 5 {
+			return fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+
+		lo := seccompDataArgsOffset + uint32(arg.Index)*8
+		hi := lo + 4
+		pass := fmt.Sprintf("%s.arg%d", fail, i)
+
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			a.load(hi)
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.Value>>32), "", fail)
+			a.load(lo)
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.Value), "", fail)
+		case "SCMP_CMP_NE":
+			a.load(hi)
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.Value>>32), "", pass)
+			a.load(lo)
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.Value), fail, "")
+		case "SCMP_CMP_MASKED_EQ":
+			a.load(hi)
+			a.emit(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, uint32(arg.Value>>32), "", "")
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.ValueTwo>>32), "", fail)
+			a.load(lo)
+			a.emit(syscall.BPF_ALU|syscall.BPF_AND|syscall.BPF_K, uint32(arg.Value), "", "")
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.ValueTwo), "", fail)
+		case "SCMP_CMP_GE", "SCMP_CMP_GT", "SCMP_CMP_LT", "SCMP_CMP_LE":
+			// Compare high words first; only equal high words defer to the low word
+			onTrue, onFalse := pass, fail
+			op := uint16(syscall.BPF_JGE)
+			if arg.Op == "SCMP_CMP_GT" || arg.Op == "SCMP_CMP_LE" {
+				op = syscall.BPF_JGT
+			}
+			if arg.Op == "SCMP_CMP_LT" || arg.Op == "SCMP_CMP_LE" {
+				onTrue, onFalse = fail, pass
+			}
+			a.load(hi)
+			a.jumpIf(syscall.BPF_JGT, uint32(arg.Value>>32), onTrue, "")
+			a.jumpIf(syscall.BPF_JEQ, uint32(arg.Value>>32), "", onFalse)
+			a.load(lo)
+			a.jumpIf(op, uint32(arg.Value), onTrue, onFalse)
+		default:
+			return fmt.Errorf("unsupported seccomp operator %q", arg.Op)
+		}
+
+		a.label(pass)
+	}
+
+	return nil
+}
+
+// assemble resolves labels into relative jump offsets
+func (a *bpfAssembler) assemble() ([]syscall.SockFilter, error) {
+	if len(a.insns) > seccompMaxProgramLength {
+		return nil, fmt.Errorf("seccomp program too long: %d instructions", len(a.insns))
+	}
+
+	resolve := func(pc int, name string) (uint8, error) {
+		if name == "" {
+			return 0, nil
+		}
+		target, ok := a.labels[name]
+		if !ok {
+			return 0, fmt.Errorf("undefined BPF label %q", name)
+		}
+		offset := target - pc - 1
+		if offset < 0 || offset > seccompMaxJumpOffset {
+			return 0, fmt.Errorf("BPF jump to %q out of range", name)
+		}
+		return uint8(offset), nil
+	}
+
+	out := make([]syscall.SockFilter, len(a.insns))
+	for pc, insn := range a.insns {
+		out[pc] = insn.filter
+		if insn.filter.Code&0x07 != syscall.BPF_JMP {
+			continue
+		}
+
+		jt, err := resolve(pc, insn.jumpTrue)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := resolve(pc, insn.jumpFalse)
+		if err != nil {
+			return nil, err
+		}
+		out[pc].Jt, out[pc].Jf = jt, jf
+	}
+
+	return out, nil
+}
+
+// kernelVersion returns the major and minor version of the running kernel
+func kernelVersion() ([2]int, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return [2]int{}, fmt.Errorf("uname failed: %w", err)
+	}
+
+	var release strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+
+	return parseKernelVersion(release.String())
+}
+
+// parseKernelVersion extracts major.minor from a kernel release string like 6.1.0-13-amd64
+func parseKernelVersion(release string) ([2]int, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return [2]int{}, fmt.Errorf("unrecognized kernel version %q", release)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return [2]int{}, fmt.Errorf("unrecognized kernel version %q", release)
+	}
+
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	minorNum, err := strconv.Atoi(minor)
+	if err != nil {
+		return [2]int{}, fmt.Errorf("unrecognized kernel version %q", release)
+	}
+
+	return [2]int{major, minorNum}, nil
+}
+
+// kernelAtLeast reports whether kernel is at least the version given as "major.minor"
+func kernelAtLeast(kernel [2]int, version string) bool {
+	want, err := parseKernelVersion(version)
+	if err != nil {
+		return false
+	}
+
+	return kernel[0] > want[0] || (kernel[0] == want[0] && kernel[1] >= want[1])
+}
+
+// containsString reports whether s is present in list
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// securityPolicyPath is the host's policy of capabilities and seccomp profiles by image label
+// and registry, next to daemonConfigPath
+const securityPolicyPath = "/etc/your-docker/policy.json"
+
+// securityPolicy is the file at securityPolicyPath
+type securityPolicy struct {
+	// TrustedRegistries are the registries untrustedRegistry rules don't match
+	TrustedRegistries []string             `json:"trustedRegistries,omitempty"`
+	Rules             []securityPolicyRule `json:"rules"`
+}
+
+// securityPolicyRule changes the security defaults of the images it matches. Its conditions
+// must all hold, a rule without any matches every image.
+type securityPolicyRule struct {
+	Name string `json:"name,omitempty"`
+	// Label is a label the image's config must have, as key or key=value
+	Label string `json:"label,omitempty"`
+	// Registry is the host the image is from, or *.example.com for the hosts below one
+	Registry string `json:"registry,omitempty"`
+	// UntrustedRegistry matches images from registries that aren't TrustedRegistries
+	UntrustedRegistry bool `json:"untrustedRegistry,omitempty"`
+
+	CapAdd  []string `json:"capAdd,omitempty"`
+	CapDrop []string `json:"capDrop,omitempty"`
+	// Seccomp is the profile like seccomp= of --security-opt takes it
+	Seccomp string `json:"seccomp,omitempty"`
+}
+
+// PolicyDefaults is what the security policy decided for a container's image when it was
+// created. Its seccomp profile applies unless --security-opt sets one, and --cap-add and
+// --cap-drop go on top of its capabilities.
+type PolicyDefaults struct {
+	// Rules are the names of the rules that matched, in order
+	Rules []string `json:"rules"`
+	// Capabilities replace Docker's default set
+	Capabilities []string `json:"capabilities"`
+	Seccomp      string   `json:"seccomp,omitempty"`
+}
+
+// readSecurityPolicy returns the host's policy, nil if there is none. A policy that doesn't
+// parse fails container creation rather than leaving images without the confinement it asks
+// for.
+func readSecurityPolicy() (*securityPolicy, error) {
+	data, err := os.ReadFile(securityPolicyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read security policy: %w", err)
+	}
+
+	var policy securityPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", securityPolicyPath, err)
+	}
+
+	for i, rule := range policy.Rules {
+		if _, err := defaultCapabilities().apply(rule.CapAdd, rule.CapDrop); err != nil {
+			return nil, fmt.Errorf("invalid rule %s in %s: %w", rule.name(i), securityPolicyPath, err)
+		}
+		if rule.Seccomp != "" {
+			if _, err := ParseSeccompOption(rule.Seccomp); err != nil {
+				return nil, fmt.Errorf("invalid rule %s in %s: %w", rule.name(i), securityPolicyPath, err)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// name returns the name of the i-th rule, its position if it has none
+func (r securityPolicyRule) name(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// evaluate returns the defaults of the rules that match an image, nil if none does. The rules
+// change Docker's default capabilities in order, and the seccomp profile of the last one that
+// has one wins.
+func (p *securityPolicy) evaluate(image string, config imageConfig) *PolicyDefaults {
+	registry := imageRegistry(image)
+
+	var defaults *PolicyDefaults
+	caps := defaultCapabilities()
+	for i, rule := range p.Rules {
+		if rule.Label != "" && !hasLabel(config.Config.Labels, rule.Label) {
+			continue
+		}
+		if rule.Registry != "" && !matchesRegistry(registry, rule.Registry) {
+			continue
+		}
+		if rule.UntrustedRegistry && p.trusts(registry) {
+			continue
+		}
+
+		if defaults == nil {
+			defaults = &PolicyDefaults{}
+		}
+		defaults.Rules = append(defaults.Rules, rule.name(i))
+		// The names were checked when the policy was read
+		caps, _ = caps.apply(rule.CapAdd, rule.CapDrop)
+		if rule.Seccomp != "" {
+			defaults.Seccomp = rule.Seccomp
+		}
+	}
+	if defaults != nil {
+		defaults.Capabilities = caps.names()
+	}
+
+	return defaults
+}
+
+// trusts reports whether registry is one of the trusted registries
+func (p *securityPolicy) trusts(registry string) bool {
+	for _, trusted := range p.TrustedRegistries {
+		if matchesRegistry(registry, trusted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageRegistry returns the host an image comes from: the registry of a reference, docker.io
+// for Docker Hub, or the host of a tarball URL
+func imageRegistry(image string) string {
+	if isTarballURL(image) {
+		if u, err := url.Parse(image); err == nil {
+			return u.Host
+		}
+		return ""
+	}
+
+	ref, err := ParseReference(image)
+	if err != nil {
+		return ""
+	}
+
+	return ref.Domain
+}
+
+// matchesRegistry reports whether registry is pattern, or below it for *.example.com
+func matchesRegistry(registry, pattern string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(registry, "."+suffix)
+	}
+
+	return registry == pattern
+}
+
+// hasLabel reports whether labels has the key of a key or key=value condition, with that value
+func hasLabel(labels map[string]string, condition string) bool {
+	key, value, hasValue := strings.Cut(condition, "=")
+	actual, ok := labels[key]
+
+	return ok && (!hasValue || actual == value)
+}
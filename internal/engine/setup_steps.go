@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errSetupStepFailed is returned by strict runs when a setup step the container could do
+// without fails
+var errSetupStepFailed = errors.New("optional setup step failed")
+
+// setupSteps decides what the failure of a step of a container's setup means. Required steps
+// return their errors, which fail the setup. Optional ones, for features the container works
+// without such as a device only some images use, are warned about and skipped, unless strict
+// makes them fail the setup too, like the image compatibility check.
+type setupSteps struct {
+	strict bool
+	// skipped describes the optional steps that failed, for the container's state
+	skipped []string
+}
+
+// optional reports the result of an optional step, returning the error that fails a strict
+// setup and nil otherwise. A nil setupSteps warns like a lenient one, for unpacking that
+// isn't done for a container.
+func (s *setupSteps) optional(step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if s != nil && s.strict {
+		return fmt.Errorf("%w: %s: %w", errSetupStepFailed, step, err)
+	}
+
+	warnf(eventTypeContainer, "%s failed, continuing without it (--strict makes this an error): %v", step, err)
+	if s != nil {
+		s.skipped = append(s.skipped, fmt.Sprintf("%s: %v", step, err))
+	}
+
+	return nil
+}
+
+// reuse takes over the optional steps another setup skipped for something this one reuses,
+// such as a cached layer: strict setups fail, others warn again unless it was just prepared
+// for them and has been warned about already
+func (s *setupSteps) reuse(skipped []string, warn bool) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	if s != nil && s.strict {
+		return fmt.Errorf("%w: %s", errSetupStepFailed, strings.Join(skipped, "; "))
+	}
+
+	if warn {
+		for _, step := range skipped {
+			warnf(eventTypeContainer, "%s, skipped when it was first prepared", step)
+		}
+	}
+	if s != nil {
+		s.skipped = append(s.skipped, skipped...)
+	}
+
+	return nil
+}
+
+// writeSkippedSteps keeps the optional steps skipped while preparing dir, a cached layer or a
+// shared root filesystem, next to it
+func writeSkippedSteps(dir string, skipped []string) error {
+	if len(skipped) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(dir+".skipped", []byte(strings.Join(skipped, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record the skipped setup steps of %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// readSkippedSteps returns the optional steps skipped while preparing dir
+func readSkippedSteps(dir string) []string {
+	data, err := os.ReadFile(dir + ".skipped")
+	if err != nil {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
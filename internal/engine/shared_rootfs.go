@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sharedRootfsDir holds images unpacked once for --shared-rootfs runs. The storage root of
+// the config file moves it.
+var sharedRootfsDir = "/var/lib/your-docker/rootfs"
+
+// prepareSharedRootfs returns the directory holding the unpacked image and the image's config,
+// downloading it on first use. Concurrent runs of the same image wait for a single download
+// instead of racing. Copies for user namespaces are kept separately because their files are
+// owned by the mapped IDs.
+func (env *ContainerEnvironment) prepareSharedRootfs(ctx context.Context, image, platform string, userns bool) (string, imageConfig, error) {
+	name, tag, err := parseImageReference(image)
+	if err != nil {
+		return "", imageConfig{}, err
+	}
+
+	// Commas would end the directory in the overlay options, which the URLs of tarballs may have
+	key := strings.NewReplacer("/", "_", ":", "_", ",", "_").Replace(name + ":" + tag)
+	if platform != "" {
+		key += "_" + strings.ReplaceAll(platform, "/", "_")
+	}
+	if userns {
+		key += "_userns"
+	}
+	dir := filepath.Join(sharedRootfsDir, key)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, readSharedRootfsConfig(dir), env.steps.reuse(readSkippedSteps(dir), true)
+	}
+
+	if err := os.MkdirAll(sharedRootfsDir, 0755); err != nil {
+		return "", imageConfig{}, fmt.Errorf("failed to create %s: %w", sharedRootfsDir, err)
+	}
+
+	lock, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return "", imageConfig{}, fmt.Errorf("failed to open lock for %s: %w", image, err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return "", imageConfig{}, fmt.Errorf("failed to lock %s: %w", image, err)
+	}
+
+	// Another run may have finished unpacking while we waited for the lock
+	if _, err := os.Stat(dir); err == nil {
+		return dir, readSharedRootfsConfig(dir), env.steps.reuse(readSkippedSteps(dir), true)
+	}
+
+	// An unpack that was interrupted is picked up where it stopped, its layer journal tells
+	// how far it got
+	partial := dir + ".partial"
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		return "", imageConfig{}, fmt.Errorf("failed to create %s: %w", partial, err)
+	}
+
+	// Like cached layers, the copy is unpacked leniently, strict containers fail on what it skipped
+	unpacking := &setupSteps{}
+	config, err := env.unpackSharedRootfs(ctx, image, platform, partial, userns, unpacking)
+	if err != nil {
+		return "", imageConfig{}, err
+	}
+	if err := writeSkippedSteps(dir, unpacking.skipped); err != nil {
+		os.RemoveAll(partial)
+		return "", imageConfig{}, err
+	}
+
+	// The config is kept next to the directory, inside it would show up in containers. It
+	// goes in first, so whoever sees the directory also finds its config.
+	data, err := json.Marshal(config)
+	if err != nil {
+		os.RemoveAll(partial)
+		return "", imageConfig{}, err
+	}
+	if err := os.WriteFile(dir+".json", data, 0644); err != nil {
+		os.RemoveAll(partial)
+		return "", imageConfig{}, fmt.Errorf("failed to save config of shared rootfs: %w", err)
+	}
+
+	if err := os.Rename(partial, dir); err != nil {
+		os.RemoveAll(partial)
+		return "", imageConfig{}, fmt.Errorf("failed to publish shared rootfs: %w", err)
+	}
+
+	return dir, config, env.steps.reuse(unpacking.skipped, false)
+}
+
+// readSharedRootfsConfig returns the config saved with a shared rootfs. Those unpacked before
+// configs were saved get an empty one.
+func readSharedRootfsConfig(dir string) imageConfig {
+	var config imageConfig
+	if data, err := os.ReadFile(dir + ".json"); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			warnf(eventTypeImage, "failed to parse config of shared rootfs %s: %v", dir, err)
+		}
+	}
+
+	return config
+}
+
+// unpackSharedRootfs unpacks the image into dir and prepares it to be used as a lower layer
+func (env *ContainerEnvironment) unpackSharedRootfs(ctx context.Context, image, platform, dir string, userns bool, steps *setupSteps) (imageConfig, error) {
+	config, err := unpackImage(ctx, image, platform, dir, steps)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	// Only now, a resumed unpack may have started over from an empty directory
+	if err := env.setupDevices(dir); err != nil {
+		return imageConfig{}, err
+	}
+
+	if userns {
+		if err := shiftOwnership(dir); err != nil {
+			return imageConfig{}, fmt.Errorf("failed to prepare rootfs for the user namespace: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// mountSharedRootfs stacks an overlay with a tmpfs upper layer on top of the shared image and
+// returns the merged root. It runs inside the container's mount namespace, so the mounts go
+// away with the container and nothing has to be cleaned up on the host.
+func mountSharedRootfs(scratch, lower string) (string, error) {
+	if err := syscall.Mount("tmpfs", scratch, "tmpfs", 0, "mode=755"); err != nil {
+		return "", fmt.Errorf("failed to mount tmpfs on %s: %w", scratch, err)
+	}
+
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	merged := filepath.Join(scratch, "merged")
+	for _, dir := range []string{upper, work, merged} {
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return "", fmt.Errorf("failed to mount overlay on %s: %w", merged, err)
+	}
+
+	return merged, nil
+}
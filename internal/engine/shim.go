@@ -0,0 +1,526 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// containerShimArg is the hidden argument that makes the binary supervise a container. The
+// shim is the parent of the container's init, so it outlives the command that started the
+// container and is the one to record its exit.
+const containerShimArg = "shim"
+
+// shimDetachedArg tells the shim that nobody attaches to the container's output, so it logs it
+const shimDetachedArg = "detached"
+
+// File descriptors passed to the shim besides the container's standard streams
+const (
+	// shimEventsFd carries shimEvents to whoever started the shim
+	shimEventsFd = 3
+	// shimClientFd reaches EOF once the attached client is gone
+	shimClientFd = 4
+	// shimPtyFd is the master side of the container's terminal, if it has one
+	shimPtyFd = 5
+)
+
+// Events reported by the shim
+const (
+	shimEventStarted = "started"
+	shimEventExited  = "exited"
+)
+
+// shimEvent is a message from the shim about the container
+type shimEvent struct {
+	Event    string `json:"event,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Pid      int    `json:"pid,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+	// Diagnosis classifies Error for --error-json, which only the shim still has the cause for
+	Diagnosis *errorDiagnosis `json:"diagnosis,omitempty"`
+}
+
+// shimClient is our end of a running shim
+type shimClient struct {
+	pid    int
+	events *json.Decoder
+	client *os.File
+}
+
+// startShim starts a shim for the container with stdio as its standard streams and waits
+// until the container runs, after waiting for the container's host dependencies. An attached
+// client keeps receiving events until it detaches; otherwise the shim is left on its own
+// right away.
+func (env *ContainerEnvironment) startShim(stdio [3]*os.File, pty *os.File, attached bool) (*shimClient, error) {
+	if err := waitForHostDependencies(env.state.Config.Requires, env.state.Config.RequireTimeout); err != nil {
+		return nil, err
+	}
+
+	eventsR, eventsW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shim pipe: %w", err)
+	}
+
+	clientR, clientW, err := os.Pipe()
+	if err != nil {
+		eventsR.Close()
+		eventsW.Close()
+		return nil, fmt.Errorf("failed to create shim pipe: %w", err)
+	}
+
+	shim := exec.Command("/proc/self/exe", containerShimArg, env.id)
+	if !attached {
+		shim.Args = append(shim.Args, shimDetachedArg)
+	}
+	shim.Stdin, shim.Stdout, shim.Stderr = stdio[0], stdio[1], stdio[2]
+	shim.ExtraFiles = []*os.File{eventsW, clientR}
+	if pty != nil || len(env.preservedFds) > 0 {
+		// The preserved descriptors follow the pty's slot, which stays closed without one
+		shim.ExtraFiles = append(shim.ExtraFiles, pty)
+		shim.ExtraFiles = append(shim.ExtraFiles, env.preservedFds...)
+	}
+	// Its own session keeps the shim alive when our terminal goes away
+	shim.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if level := logLevel.Level(); level != slog.LevelWarn {
+		shim.Env = append(os.Environ(), shimLogLevelEnv+"="+level.String())
+	}
+	if storageRoot != defaultStorageRoot {
+		if shim.Env == nil {
+			shim.Env = os.Environ()
+		}
+		shim.Env = append(shim.Env, shimStorageRootEnv+"="+storageRoot)
+	}
+	if len(env.preservedFds) > 0 {
+		if shim.Env == nil {
+			shim.Env = os.Environ()
+		}
+		shim.Env = append(shim.Env, shimPreservedFdsEnv+"="+strconv.Itoa(len(env.preservedFds)))
+	}
+	shim.Dir = "/"
+
+	err = shim.Start()
+	// Only the shim holds these ends, so a shim that dies without a word is read as EOF
+	eventsW.Close()
+	clientR.Close()
+	if err != nil {
+		eventsR.Close()
+		clientW.Close()
+		return nil, fmt.Errorf("failed to start shim: %w", err)
+	}
+	// We don't wait for the shim, it is reparented once we exit. The daemon doesn't exit, so
+	// it reaps its shims.
+	if reapShims {
+		go shim.Wait()
+	} else {
+		shim.Process.Release()
+	}
+
+	c := &shimClient{events: json.NewDecoder(eventsR), client: clientW}
+	if !attached {
+		defer c.detach()
+	}
+
+	var ev shimEvent
+	if err := c.events.Decode(&ev); err != nil {
+		c.detach()
+		return nil, fmt.Errorf("container shim exited unexpectedly: %w", err)
+	}
+	if ev.Error != "" {
+		c.detach()
+		return nil, ev.err()
+	}
+	c.pid = ev.Pid
+
+	return c, nil
+}
+
+// wait returns the shim's exit event
+func (c *shimClient) wait() (shimEvent, error) {
+	var ev shimEvent
+	if err := c.events.Decode(&ev); err != nil {
+		return ev, fmt.Errorf("container shim exited unexpectedly: %w", err)
+	}
+	if ev.Error != "" {
+		return ev, ev.err()
+	}
+
+	return ev, nil
+}
+
+// detach leaves the container to the shim
+func (c *shimClient) detach() {
+	c.client.Close()
+}
+
+// runContainerShim supervises the container given as argument until it exits
+func runContainerShim() {
+	// The container inherits our environment
+	if level, err := parseLogLevel(os.Getenv(shimLogLevelEnv)); err == nil {
+		logLevel.Set(level)
+	}
+	os.Unsetenv(shimLogLevelEnv)
+	if root := os.Getenv(shimStorageRootEnv); root != "" {
+		setStorageRoot(root)
+	}
+	os.Unsetenv(shimStorageRootEnv)
+
+	eventsFile := os.NewFile(shimEventsFd, "shim-events")
+	events := json.NewEncoder(eventsFile)
+	if len(os.Args) < 3 {
+		events.Encode(shimEvent{Error: "no container given to the shim"})
+		os.Exit(1)
+	}
+
+	env, err := loadContainerEnvironment(os.Args[2])
+	if err != nil {
+		events.Encode(shimFailure(err))
+		os.Exit(1)
+	}
+	if n, err := strconv.Atoi(os.Getenv(shimPreservedFdsEnv)); err == nil {
+		env.preservedFds = preservedFiles(shimPreservedFd, n)
+	}
+	os.Unsetenv(shimPreservedFdsEnv)
+
+	// Our standard streams belong to the container, so the shim logs into its state directory
+	logFile, err := os.OpenFile(filepath.Join(containerDir(env.id), "shim.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		log.SetOutput(logFile)
+	}
+
+	detached := len(os.Args) > 3 && os.Args[3] == shimDetachedArg
+	client := os.NewFile(shimClientFd, "shim-client")
+	code := env.supervise(events, client, detached)
+
+	// Whoever started us has the exit, the shim only stays to restart the container or to
+	// remove it once it has been kept for long enough
+	eventsFile.Close()
+	client.Close()
+	if code == 0 && env.state.Status == statusRestarting && env.restart() {
+		os.Exit(0)
+	}
+	if code == 0 {
+		env.awaitRemoval()
+	}
+	os.Exit(code)
+}
+
+// supervise starts the container, reports it to the client and records its exit. The output
+// of a detached container goes to its log, as does that of a terminal once the client is gone.
+func (env *ContainerEnvironment) supervise(events *json.Encoder, client *os.File, detached bool) int {
+	logs, err := openContainerLog(env.id)
+	if err != nil {
+		events.Encode(shimFailure(err))
+		return 1
+	}
+	defer logs.Close()
+
+	var pty *os.File
+	if env.tty {
+		pty = os.NewFile(shimPtyFd, "pty")
+	}
+	// Clients can attach to the output the shim has, which a terminal's is once the client is gone
+	var attach *attachServer
+	if detached || env.tty {
+		input := pty
+		if detached && !env.tty && env.interactive {
+			if input, err = openStdin(); err != nil {
+				events.Encode(shimFailure(err))
+				return 1
+			}
+			defer input.Close()
+		}
+		if attach, err = env.listenAttach(input, pty); err != nil {
+			events.Encode(shimFailure(err))
+			return 1
+		}
+	}
+
+	var logging sync.WaitGroup
+	if detached && !env.tty {
+		if err := env.logStdio(logs, attach, &logging); err != nil {
+			attach.close(nil)
+			events.Encode(shimFailure(err))
+			return 1
+		}
+	}
+
+	// Until the container is recorded as running, nothing else knows to free what it holds
+	defer env.cleanups.onPanic()
+	stop := env.cleanups.onSignal(nil)
+	defer stop()
+
+	// The identity token tells when the container started and has to be there before it does
+	started := time.Now().UTC()
+	identityKey, err := env.issueIdentity(started)
+	var cmd *exec.Cmd
+	if err == nil {
+		cmd, err = env.launch()
+	}
+	if err != nil {
+		if attach != nil {
+			attach.close(nil)
+		}
+		env.cleanups.run()
+		if env.state.Config.AutoRemove {
+			if rerr := env.Remove(); rerr != nil {
+				warnf(eventTypeContainer, "%v", rerr)
+			}
+		}
+		events.Encode(shimFailure(err))
+		return 1
+	}
+
+	// Only the container holds its streams from now on, so readers see EOF when it exits
+	releaseStdio()
+
+	pid := cmd.Process.Pid
+	env.state.Status = statusRunning
+	env.state.Pid = pid
+	env.state.ShimPid = os.Getpid()
+	env.state.Started = started
+	env.state.Finished = time.Time{}
+	env.state.ExitCode = 0
+	env.state.Health = nil
+	if !env.state.Config.Healthcheck.disabled() {
+		env.state.Health = &healthState{Status: healthStarting}
+	}
+	if env.state.PidStartTime, err = processStartTime(pid); err != nil {
+		warnf(eventTypeContainer, "%v", err)
+	}
+	if err := env.state.save(); err != nil {
+		// Without a state the container can't be managed, don't leave it running
+		if attach != nil {
+			attach.close(nil)
+		}
+		env.cleanups.run()
+		events.Encode(shimFailure(err))
+		return 1
+	}
+
+	env.cleanups.forget()
+	events.Encode(shimEvent{Event: shimEventStarted, Pid: pid})
+	containerEvent(eventActionStart, env.id, nil)
+
+	// A shim told to go passes it on, the container's exit then frees its resources as usual
+	stop()
+	defer proxySignals(pid)()
+	if identityKey != nil {
+		defer env.refreshIdentityTokens(identityKey, started)()
+	}
+	stopHealth := env.monitorHealth()
+
+	go func() {
+		io.Copy(io.Discard, client)
+		// Nobody reads the terminal anymore, but the container blocks once its buffer fills
+		if env.tty {
+			logs.copy(io.TeeReader(pty, attach.output(logStreamStdout)), logStreamStdout)
+		}
+	}()
+
+	var timedOut atomic.Bool
+	if env.timeout > 0 {
+		// Like stop, the command gets to exit first. Killing the namespace's init takes every
+		// other process in the container with it.
+		timer := time.AfterFunc(env.timeout, func() {
+			timedOut.Store(true)
+			cmd.Process.Signal(syscall.SIGTERM)
+			time.AfterFunc(timeoutKillDelay, func() { cmd.Process.Kill() })
+		})
+		defer timer.Stop()
+	}
+
+	exitCode, err := exitCodeOf(cmd.Wait())
+	if err != nil {
+		errorf(eventTypeContainer, "%v", err)
+		exitCode = 1
+	}
+	// The last probe is recorded before the exit, which keeps the health as it was
+	stopHealth()
+	if timedOut.Load() {
+		exitCode = timeoutExitCode
+	}
+	// Processes of the container are gone with its init, so its output is complete
+	logging.Wait()
+
+	// Like Docker, an oom event precedes the die of a container the kernel killed processes of
+	if env.state.Cgroup != "" && readCgroupOOMKills(env.state.Cgroup) > 0 {
+		containerEvent(eventActionOOM, env.id, nil)
+	}
+	env.release()
+	containerEvent(eventActionDie, env.id, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	env.state.Status = statusExited
+	env.state.ExitCode = exitCode
+	env.state.Finished = time.Now().UTC()
+
+	if env.state.Config.AutoRemove {
+		err = env.Remove()
+	} else {
+		err = env.saveExitState(!timedOut.Load())
+	}
+	if err != nil {
+		warnf(eventTypeContainer, "%v", err)
+	}
+	// Attached clients return its exit code once it is recorded
+	if attach != nil {
+		attach.close(&exitCode)
+	}
+
+	events.Encode(shimEvent{Event: shimEventExited, ExitCode: exitCode, TimedOut: timedOut.Load()})
+	return 0
+}
+
+// saveExitState records the exit of the container, keeping the limits update may have changed
+// while it ran and the health its healthcheck found. A restartable container that wasn't
+// stopped on purpose is recorded as restarting when its restart policy says so.
+func (env *ContainerEnvironment) saveExitState(restartable bool) error {
+	lock, err := lockState(env.id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if saved, err := loadContainerState(env.id); err == nil {
+		env.state.Config.Limits = saved.Config.Limits
+		env.state.StoppedByUser = saved.StoppedByUser
+		env.state.Health = saved.Health
+	}
+	if restartable && !env.state.StoppedByUser && env.state.Config.Restart.shouldRestart(env.state.ExitCode, env.state.RestartCount) {
+		env.state.Status = statusRestarting
+	}
+
+	return env.state.save()
+}
+
+// logStdio points our stdout and stderr, which launch passes on to the container, at pipes
+// whose output is logged and sent to attached clients
+func (env *ContainerEnvironment) logStdio(logs *containerLog, attach *attachServer, logging *sync.WaitGroup) error {
+	for fd, stream := range map[int]string{1: logStreamStdout, 2: logStreamStderr} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create log pipe: %w", err)
+		}
+		err = syscall.Dup3(int(w.Fd()), fd, 0)
+		w.Close()
+		if err != nil {
+			r.Close()
+			return fmt.Errorf("failed to redirect %s: %w", stream, err)
+		}
+
+		logging.Add(1)
+		go func() {
+			defer logging.Done()
+			defer r.Close()
+			logs.copy(io.TeeReader(r, attach.output(stream)), stream)
+		}()
+	}
+
+	return nil
+}
+
+// exitCodeOf returns the exit code of a process from the error of its Wait. Like Docker, a
+// process killed by a signal exits with 128 plus its number.
+func exitCodeOf(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, fmt.Errorf("failed to wait for command: %w", err)
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+
+	return exitErr.ExitCode(), nil
+}
+
+// releaseStdio points our standard streams at /dev/null
+func releaseStdio() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		warnf(eventTypeContainer, "%v", err)
+		return
+	}
+	defer devNull.Close()
+
+	for fd := 0; fd < 3; fd++ {
+		if err := syscall.Dup3(int(devNull.Fd()), fd, 0); err != nil {
+			warnf(eventTypeContainer, "failed to release stdio: %v", err)
+		}
+	}
+}
+
+// pidfdOpen returns a file descriptor referring to the process
+func pidfdOpen(pid int) (*os.File, error) {
+	nr, ok := seccompSyscallNumbers["pidfd_open"]
+	if !ok {
+		return nil, fmt.Errorf("pidfd_open is not supported on %s", seccompArchName)
+	}
+
+	fd, _, errno := syscall.Syscall(uintptr(nr), uintptr(pid), 0, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to open pidfd for %d: %w", pid, errno)
+	}
+
+	return os.NewFile(fd, "pidfd"), nil
+}
+
+// pidfdSendSignal signals the process behind a pidfd
+func pidfdSendSignal(pidfd *os.File, sig syscall.Signal) error {
+	nr, ok := seccompSyscallNumbers["pidfd_send_signal"]
+	if !ok {
+		return fmt.Errorf("pidfd_send_signal is not supported on %s", seccompArchName)
+	}
+
+	if _, _, errno := syscall.Syscall6(uintptr(nr), pidfd.Fd(), uintptr(sig), 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to signal container: %w", errno)
+	}
+
+	return nil
+}
+
+// waitForPidfd waits up to timeout for the process behind the pidfd to exit, which makes it
+// readable, and reports whether it did. A zero timeout waits forever.
+func waitForPidfd(pidfd *os.File, timeout time.Duration) (bool, error) {
+	fd := int(pidfd.Fd())
+	deadline := time.Now().Add(timeout)
+
+	for {
+		// FdSet words are 32 or 64 bits depending on the architecture
+		var set syscall.FdSet
+		bits := int(unsafe.Sizeof(set.Bits[0])) * 8
+		set.Bits[fd/bits] |= 1 << uint(fd%bits)
+
+		var tv *syscall.Timeval
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining < 0 {
+				remaining = 0
+			}
+			t := syscall.NsecToTimeval(remaining.Nanoseconds())
+			tv = &t
+		}
+
+		n, err := syscall.Select(fd+1, &set, nil, nil, tv)
+		if err == nil {
+			return n > 0, nil
+		}
+		if !errors.Is(err, syscall.EINTR) {
+			return false, fmt.Errorf("failed to wait for container: %w", err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The real-time signals, which have numbers rather than names. glibc keeps the first two to
+// itself, so SIGRTMIN is 34 like kill(1) shows it.
+const (
+	sigRTMin = 34
+	sigRTMax = 64
+)
+
+// signalNames are the signals of the Linux signal table by name, without the SIG prefix
+var signalNames = map[string]syscall.Signal{
+	"ABRT":   syscall.SIGABRT,
+	"ALRM":   syscall.SIGALRM,
+	"BUS":    syscall.SIGBUS,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"FPE":    syscall.SIGFPE,
+	"HUP":    syscall.SIGHUP,
+	"ILL":    syscall.SIGILL,
+	"INT":    syscall.SIGINT,
+	"IO":     syscall.SIGIO,
+	"KILL":   syscall.SIGKILL,
+	"PIPE":   syscall.SIGPIPE,
+	"PROF":   syscall.SIGPROF,
+	"PWR":    syscall.SIGPWR,
+	"QUIT":   syscall.SIGQUIT,
+	"SEGV":   syscall.SIGSEGV,
+	"STKFLT": syscall.SIGSTKFLT,
+	"STOP":   syscall.SIGSTOP,
+	"SYS":    syscall.SIGSYS,
+	"TERM":   syscall.SIGTERM,
+	"TRAP":   syscall.SIGTRAP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"USR1":   syscall.SIGUSR1,
+	"USR2":   syscall.SIGUSR2,
+	"VTALRM": syscall.SIGVTALRM,
+	"WINCH":  syscall.SIGWINCH,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+}
+
+// signalAliases are other names of signals in the table
+var signalAliases = map[string]syscall.Signal{
+	"CLD":  syscall.SIGCHLD,
+	"IOT":  syscall.SIGABRT,
+	"POLL": syscall.SIGIO,
+}
+
+// unproxiedSignals are the signals a foreground run and the shim keep rather than forward to
+// the container: those about our own children, pipes and terminal, which mean nothing to its
+// processes, and those that can't be caught
+var unproxiedSignals = map[syscall.Signal]bool{
+	syscall.SIGCHLD:  true,
+	syscall.SIGPIPE:  true,
+	syscall.SIGURG:   true,
+	syscall.SIGWINCH: true,
+	syscall.SIGTSTP:  true,
+	syscall.SIGTTIN:  true,
+	syscall.SIGTTOU:  true,
+	syscall.SIGCONT:  true,
+	syscall.SIGKILL:  true,
+	syscall.SIGSTOP:  true,
+}
+
+// proxiedSignals returns the named signals that are forwarded to a container's init
+func proxiedSignals() []os.Signal {
+	var signals []os.Signal
+	for _, sig := range signalNames {
+		if !unproxiedSignals[sig] && !faultSignal(sig) {
+			signals = append(signals, sig)
+		}
+	}
+
+	return signals
+}
+
+// faultSignal reports whether sig is raised by the kernel for a fault of the process itself,
+// which the Go runtime handles and aren't ours to forward
+func faultSignal(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGBUS, syscall.SIGFPE, syscall.SIGILL, syscall.SIGSEGV, syscall.SIGTRAP, syscall.SIGSYS:
+		return true
+	}
+
+	return false
+}
+
+// parseSignal parses a signal like kill(1) does: by name with or without the SIG prefix, in
+// any case, by number, or as RTMIN+n and RTMAX-n
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || n > sigRTMax || n > int(syscall.SIGSYS) && n < sigRTMin {
+			return 0, fmt.Errorf("invalid signal %q: no such signal number", s)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	if sig, ok := signalAliases[name]; ok {
+		return sig, nil
+	}
+
+	for _, rt := range []struct {
+		prefix string
+		base   int
+		sign   int
+	}{{"RTMIN", sigRTMin, 1}, {"RTMAX", sigRTMax, -1}} {
+		rest, ok := strings.CutPrefix(name, rt.prefix)
+		if !ok {
+			continue
+		}
+		offset := 0
+		if rest != "" {
+			op := "+"
+			if rt.sign < 0 {
+				op = "-"
+			}
+			digits, ok := strings.CutPrefix(rest, op)
+			n, err := strconv.Atoi(digits)
+			if !ok || err != nil || n < 0 || n > sigRTMax-sigRTMin {
+				break
+			}
+			offset = n
+		}
+		return syscall.Signal(rt.base + rt.sign*offset), nil
+	}
+
+	return 0, fmt.Errorf("invalid signal %q: expected a name like HUP or SIGHUP, or a number", s)
+}
+
+// signalName returns the name of a signal with the SIG prefix, the way events, cores and
+// kill -l show it, or "" for numbers that aren't signals
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+
+	switch n := int(sig); {
+	case n == sigRTMin:
+		return "SIGRTMIN"
+	case n == sigRTMax:
+		return "SIGRTMAX"
+	case n > sigRTMin && n < sigRTMax:
+		return fmt.Sprintf("SIGRTMIN+%d", n-sigRTMin)
+	}
+
+	return ""
+}
+
+// printSignals lists the signal table by number, like kill -l
+func printSignals(w io.Writer) {
+	var numbers []int
+	for _, sig := range signalNames {
+		numbers = append(numbers, int(sig))
+	}
+	for n := sigRTMin; n <= sigRTMax; n++ {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	for _, n := range numbers {
+		fmt.Fprintf(w, "%2d %s\n", n, signalName(syscall.Signal(n)))
+	}
+}
@@ -0,0 +1,786 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// specNodeKind is the type of a node in a parsed definition file
+type specNodeKind int
+
+const (
+	scalarNode specNodeKind = iota
+	mappingNode
+	sequenceNode
+)
+
+// specNode is a YAML or JSON value together with its position in the source file
+type specNode struct {
+	kind   specNodeKind
+	value  string
+	null   bool
+	keys   []*specNode
+	values []*specNode
+	items  []*specNode
+	line   int
+	col    int
+}
+
+// specError is an error pointing at a position in a definition file
+type specError struct {
+	file string
+	line int
+	col  int
+	msg  string
+}
+
+func (e *specError) Error() string {
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %s", e.file, e.msg)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", e.file, e.line, e.col, e.msg)
+}
+
+// describe returns a human readable name for the node's kind
+func (n *specNode) describe() string {
+	switch {
+	case n.kind == mappingNode:
+		return "mapping"
+	case n.kind == sequenceNode:
+		return "list"
+	case n.null:
+		return "null"
+	default:
+		return "scalar"
+	}
+}
+
+// parseSpecDocument parses YAML or JSON, choosing JSON when the document starts with { or [
+func parseSpecDocument(file string, data []byte) (*specNode, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return parseJSONDocument(file, data)
+	}
+
+	return parseYAMLDocument(file, data)
+}
+
+// parseJSONDocument builds a node tree from JSON, tracking token positions
+func parseJSONDocument(file string, data []byte) (*specNode, error) {
+	p := &jsonSpecParser{file: file, data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.UseNumber()
+
+	root, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.dec.Token(); err != io.EOF {
+		line, col := offsetPosition(data, int(p.dec.InputOffset()))
+		return nil, &specError{file: file, line: line, col: col, msg: "unexpected data after top-level value"}
+	}
+
+	return root, nil
+}
+
+// jsonSpecParser walks a JSON token stream into spec nodes
+type jsonSpecParser struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+}
+
+// tokenStart returns the position of the next token in the input
+func (p *jsonSpecParser) tokenStart() (int, int) {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.ContainsRune(" \t\r\n,:", rune(p.data[offset])) {
+		offset++
+	}
+
+	return offsetPosition(p.data, offset)
+}
+
+func (p *jsonSpecParser) token() (json.Token, int, int, error) {
+	line, col := p.tokenStart()
+	tok, err := p.dec.Token()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col = offsetPosition(p.data, int(syntaxErr.Offset))
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, line, col, &specError{file: p.file, line: line, col: col, msg: err.Error()}
+	}
+
+	return tok, line, col, nil
+}
+
+func (p *jsonSpecParser) parseValue() (*specNode, error) {
+	tok, line, col, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &specNode{line: line, col: col}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			node.kind = mappingNode
+			for p.dec.More() {
+				keyTok, kl, kc, err := p.token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				key := &specNode{kind: scalarNode, value: keyTok.(string), line: kl, col: kc}
+				if err := node.addKey(p.file, key, value); err != nil {
+					return nil, err
+				}
+			}
+		case '[':
+			node.kind = sequenceNode
+			for p.dec.More() {
+				item, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				node.items = append(node.items, item)
+			}
+		}
+		// Consume the closing delimiter
+		if _, _, _, err := p.token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.value = t
+	case json.Number:
+		node.value = t.String()
+	case bool:
+		node.value = strconv.FormatBool(t)
+	case nil:
+		node.null = true
+	}
+
+	return node, nil
+}
+
+// addKey appends a key/value pair to a mapping, rejecting duplicates
+func (n *specNode) addKey(file string, key, value *specNode) error {
+	for _, k := range n.keys {
+		if k.value == key.value {
+			return &specError{file: file, line: key.line, col: key.col, msg: fmt.Sprintf("duplicate key %q", key.value)}
+		}
+	}
+
+	n.keys = append(n.keys, key)
+	n.values = append(n.values, value)
+	return nil
+}
+
+// offsetPosition converts a byte offset into a 1-based line and column
+func offsetPosition(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := offset - bytes.LastIndexByte(data[:offset], '\n')
+
+	return line, col
+}
+
+// yamlLine is a significant line of a YAML document
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlParser parses the block-style YAML subset used by definition files: mappings,
+// sequences, quoted, plain and block scalars, single-line flow collections and comments
+type yamlParser struct {
+	file  string
+	lines []yamlLine
+	pos   int
+	// blocks are the values of the block scalars, by the number of the line of their header
+	blocks map[int]string
+}
+
+// parseYAMLDocument builds a node tree from YAML
+func parseYAMLDocument(file string, data []byte) (*specNode, error) {
+	p := &yamlParser{file: file, blocks: map[int]string{}}
+
+	raws := strings.Split(string(data), "\n")
+	for i := 0; i < len(raws); i++ {
+		raw := strings.TrimRight(raws[i], "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+
+		if strings.HasPrefix(text, "\t") {
+			return nil, &specError{file: file, line: i + 1, col: indent + 1, msg: "tabs are not allowed for indentation"}
+		}
+
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" || text == "---" {
+			continue
+		}
+		if text == "..." {
+			break
+		}
+
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: indent, text: text})
+
+		// The content of a block scalar is taken as it is, comments and blank lines included
+		if owner, header, ok := yamlBlockScalarHeader(text); ok {
+			value, consumed := foldYAMLBlockScalar(raws[i+1:], indent+owner, header)
+			p.blocks[i+1] = value
+			i += consumed
+		}
+	}
+
+	if len(p.lines) == 0 {
+		return &specNode{kind: mappingNode, line: 1, col: 1}, nil
+	}
+
+	root, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.lines) {
+		return nil, p.errorAt(p.lines[p.pos], 0, "unexpected indentation")
+	}
+
+	return root, nil
+}
+
+func (p *yamlParser) errorAt(l yamlLine, offset int, msg string) error {
+	return &specError{file: p.file, line: l.number, col: l.indent + offset + 1, msg: msg}
+}
+
+// parseBlock parses a mapping or sequence whose entries start at the given indentation
+func (p *yamlParser) parseBlock(indent int) (*specNode, error) {
+	if isYAMLSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (*specNode, error) {
+	first := p.lines[p.pos]
+	node := &specNode{kind: mappingNode, line: first.number, col: first.indent + 1}
+
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorAt(l, 0, "unexpected indentation")
+		}
+		if isYAMLSequenceItem(l.text) {
+			return nil, p.errorAt(l, 0, "unexpected list item in mapping")
+		}
+
+		keyText, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, p.errorAt(l, 0, fmt.Sprintf("expected \"key: value\", found %q", l.text))
+		}
+
+		keyValue, err := unquoteYAMLScalar(keyText)
+		if err != nil {
+			return nil, p.errorAt(l, 0, err.Error())
+		}
+		key := &specNode{kind: scalarNode, value: keyValue, line: l.number, col: l.indent + 1}
+		p.pos++
+
+		var value *specNode
+		if rest != "" {
+			offset := len(l.text) - len(rest)
+			value, err = p.parseInline(l, offset, rest)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value, err = p.parseNested(l, indent)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := node.addKey(p.file, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// parseNested parses the value of a key or list item that continues on the following lines
+func (p *yamlParser) parseNested(parent yamlLine, indent int) (*specNode, error) {
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.indent > indent {
+			return p.parseBlock(next.indent)
+		}
+		// Sequences may be written at the same indentation as their key
+		if next.indent == indent && isYAMLSequenceItem(next.text) && !isYAMLSequenceItem(parent.text) {
+			return p.parseSequence(indent)
+		}
+	}
+
+	return &specNode{kind: scalarNode, null: true, line: parent.number, col: len(parent.text) + parent.indent + 1}, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (*specNode, error) {
+	first := p.lines[p.pos]
+	node := &specNode{kind: sequenceNode, line: first.number, col: first.indent + 1}
+
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isYAMLSequenceItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorAt(l, 0, "unexpected indentation")
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		offset := len(l.text) - len(rest)
+
+		if rest == "" {
+			p.pos++
+			item, err := p.parseNested(l, indent)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+			continue
+		}
+
+		if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, "[") {
+			// A mapping starting on the item line: treat its first key as if it were on its own line
+			p.lines[p.pos] = yamlLine{number: l.number, indent: l.indent + offset, text: rest}
+			item, err := p.parseMapping(l.indent + offset)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+			continue
+		}
+
+		p.pos++
+		item, err := p.parseInline(l, offset, rest)
+		if err != nil {
+			return nil, err
+		}
+		node.items = append(node.items, item)
+	}
+
+	return node, nil
+}
+
+// parseInline parses a scalar or flow collection that appears on a single line, or the
+// header of a block scalar, whose content follows it
+func (p *yamlParser) parseInline(l yamlLine, offset int, text string) (*specNode, error) {
+	if value, ok := p.blocks[l.number]; ok && isYAMLBlockScalarHeader(text) {
+		return &specNode{kind: scalarNode, value: value, line: l.number, col: l.indent + offset + 1}, nil
+	}
+
+	fp := &yamlFlowParser{text: text}
+	node, err := fp.parseValue(true)
+	if err == nil {
+		fp.skipSpaces()
+		if fp.pos < len(fp.text) {
+			err = fmt.Errorf("unexpected %q after value", fp.text[fp.pos:])
+		}
+	}
+	if err != nil {
+		return nil, p.errorAt(l, offset+fp.pos, err.Error())
+	}
+
+	setYAMLPositions(node, l, offset)
+	return node, nil
+}
+
+// setYAMLPositions converts flow parser offsets into file positions
+func setYAMLPositions(n *specNode, l yamlLine, offset int) {
+	n.line = l.number
+	n.col += l.indent + offset + 1
+	for _, c := range n.keys {
+		setYAMLPositions(c, l, offset)
+	}
+	for _, c := range n.values {
+		setYAMLPositions(c, l, offset)
+	}
+	for _, c := range n.items {
+		setYAMLPositions(c, l, offset)
+	}
+}
+
+// yamlFlowParser parses [a, b] and {k: v} collections and scalars within one line
+type yamlFlowParser struct {
+	text string
+	pos  int
+}
+
+func (f *yamlFlowParser) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+// parseValue parses the next value; top-level plain scalars may contain flow indicators
+func (f *yamlFlowParser) parseValue(top bool) (*specNode, error) {
+	f.skipSpaces()
+	start := f.pos
+	if f.pos >= len(f.text) {
+		return &specNode{kind: scalarNode, null: true, col: start}, nil
+	}
+
+	switch f.text[f.pos] {
+	case '[':
+		f.pos++
+		node := &specNode{kind: sequenceNode, col: start}
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == ']' {
+				f.pos++
+				return node, nil
+			}
+			item, err := f.parseValue(false)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+			if err := f.expectSeparator(']'); err != nil {
+				return nil, err
+			}
+			if f.text[f.pos-1] == ']' {
+				return node, nil
+			}
+		}
+	case '{':
+		f.pos++
+		node := &specNode{kind: mappingNode, col: start}
+		for {
+			f.skipSpaces()
+			if f.pos < len(f.text) && f.text[f.pos] == '}' {
+				f.pos++
+				return node, nil
+			}
+			key, err := f.parseValue(false)
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpaces()
+			if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+				return nil, errors.New("expected ':' in flow mapping")
+			}
+			f.pos++
+			value, err := f.parseValue(false)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range node.keys {
+				if k.value == key.value {
+					return nil, fmt.Errorf("duplicate key %q", key.value)
+				}
+			}
+			node.keys = append(node.keys, key)
+			node.values = append(node.values, value)
+			if err := f.expectSeparator('}'); err != nil {
+				return nil, err
+			}
+			if f.text[f.pos-1] == '}' {
+				return node, nil
+			}
+		}
+	case '"', '\'':
+		end := f.quotedEnd()
+		if end < 0 {
+			return nil, errors.New("unterminated quoted string")
+		}
+		value, err := unquoteYAMLScalar(f.text[f.pos:end])
+		if err != nil {
+			return nil, err
+		}
+		f.pos = end
+		return &specNode{kind: scalarNode, value: value, col: start}, nil
+	}
+
+	end := len(f.text)
+	if !top {
+		if i := strings.IndexAny(f.text[f.pos:], ",]}:"); i >= 0 {
+			end = f.pos + i
+		}
+	}
+	value := strings.TrimRight(f.text[f.pos:end], " ")
+	f.pos = end
+
+	node := &specNode{kind: scalarNode, value: value, col: start}
+	if value == "~" || value == "null" {
+		node.value, node.null = "", true
+	}
+	return node, nil
+}
+
+// quotedEnd returns the offset just past the closing quote of the string at the current position
+func (f *yamlFlowParser) quotedEnd() int {
+	quote := f.text[f.pos]
+	for i := f.pos + 1; i < len(f.text); i++ {
+		switch {
+		case quote == '"' && f.text[i] == '\\':
+			i++
+		case quote == '\'' && f.text[i] == '\'' && i+1 < len(f.text) && f.text[i+1] == '\'':
+			i++
+		case f.text[i] == quote:
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// expectSeparator consumes a comma or the closing delimiter of a flow collection
+func (f *yamlFlowParser) expectSeparator(closing byte) error {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("missing closing %q", closing)
+	}
+	if c := f.text[f.pos]; c == ',' || c == closing {
+		f.pos++
+		return nil
+	}
+
+	return fmt.Errorf("expected ',' or %q", closing)
+}
+
+// isYAMLBlockScalarHeader reports whether a value is the header of a literal (|) or folded
+// (>) block scalar, with an optional indentation indicator and chomping indicator
+func isYAMLBlockScalarHeader(value string) bool {
+	if value == "" || value[0] != '|' && value[0] != '>' || len(value) > 3 {
+		return false
+	}
+
+	var indentation, chomping bool
+	for _, c := range value[1:] {
+		switch {
+		case c >= '1' && c <= '9' && !indentation:
+			indentation = true
+		case (c == '-' || c == '+') && !chomping:
+			chomping = true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// yamlBlockScalarHeader finds the header of a block scalar ending a line, returning it with
+// the offset of the key or list item whose value it is, which its content is indented from
+func yamlBlockScalarHeader(text string) (int, string, bool) {
+	offset := 0
+	for isYAMLSequenceItem(text) {
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		if isYAMLBlockScalarHeader(rest) {
+			return offset, rest, true
+		}
+		offset += len(text) - len(rest)
+		text = rest
+	}
+
+	if _, value, ok := splitYAMLKey(text); ok && isYAMLBlockScalarHeader(value) {
+		return offset, value, true
+	}
+
+	return 0, "", false
+}
+
+// foldYAMLBlockScalar returns the value of a block scalar whose content starts at lines and is
+// indented more than parent, and how many of the lines it takes up. Literal scalars keep their
+// line breaks, folded ones join lines with spaces except around blank and more indented lines.
+// The final line break is kept once by default, dropped with the - indicator and kept with the
+// blank lines after it with +.
+func foldYAMLBlockScalar(lines []string, parent int, header string) (string, int) {
+	literal := header[0] == '|'
+	chomping := byte(0)
+	indent := 0
+	for _, c := range []byte(header[1:]) {
+		if c == '-' || c == '+' {
+			chomping = c
+		} else {
+			indent = parent + int(c-'0')
+		}
+	}
+
+	var content []string
+	consumed := 0
+	for _, raw := range lines {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" {
+			content = append(content, "")
+			consumed++
+			continue
+		}
+
+		lineIndent := len(raw) - len(text)
+		if indent == 0 {
+			if lineIndent <= parent {
+				break
+			}
+			indent = lineIndent
+		}
+		if lineIndent < indent {
+			break
+		}
+		content = append(content, raw[indent:])
+		consumed++
+	}
+
+	// Blank lines after the block belong to the document unless the block keeps them
+	trailing := 0
+	for len(content) > 0 && content[len(content)-1] == "" {
+		content = content[:len(content)-1]
+		trailing++
+	}
+	if chomping != '+' {
+		consumed -= trailing
+	}
+
+	var b strings.Builder
+	breaks := 0
+	prev := ""
+	for i, line := range content {
+		if line == "" {
+			breaks++
+			continue
+		}
+
+		switch {
+		case i == breaks:
+			// Leading blank lines are line breaks of their own
+			b.WriteString(strings.Repeat("\n", breaks))
+		case literal:
+			b.WriteString(strings.Repeat("\n", breaks+1))
+		case prev[0] == ' ' || prev[0] == '\t' || line[0] == ' ' || line[0] == '\t':
+			// More indented lines aren't folded
+			b.WriteString(strings.Repeat("\n", breaks+1))
+		case breaks == 0:
+			b.WriteByte(' ')
+		default:
+			b.WriteString(strings.Repeat("\n", breaks))
+		}
+		b.WriteString(line)
+		prev, breaks = line, 0
+	}
+
+	switch {
+	case chomping == '-':
+	case chomping == '+':
+		b.WriteString(strings.Repeat("\n", breaks+trailing))
+		if prev != "" {
+			b.WriteByte('\n')
+		}
+	case prev != "":
+		b.WriteByte('\n')
+	}
+
+	return b.String(), consumed
+}
+
+// isYAMLSequenceItem reports whether a line starts a block sequence entry
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" outside of quotes and flow collections
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 {
+				quote = c
+			}
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return strings.TrimRight(text[:i], " "), strings.TrimLeft(text[i+1:], " "), true
+		}
+	}
+
+	return "", "", false
+}
+
+// stripYAMLComment removes a trailing # comment that isn't inside quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || text[i-1] == ' ' || strings.ContainsRune("[{,:-", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return text[:i]
+		}
+	}
+
+	return text
+}
+
+// unquoteYAMLScalar removes YAML quoting from a scalar, leaving plain scalars untouched
+func unquoteYAMLScalar(s string) (string, error) {
+	if len(s) < 2 {
+		return s, nil
+	}
+
+	switch s[0] {
+	case '"':
+		if s[len(s)-1] != '"' {
+			return "", errors.New("unterminated quoted string")
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if s[len(s)-1] != '\'' {
+			return "", errors.New("unterminated quoted string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+
+	return s, nil
+}
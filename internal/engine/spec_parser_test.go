@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// specValue converts a node tree into maps, slices, strings and nils to compare it with
+func specValue(n *specNode) any {
+	switch {
+	case n.kind == mappingNode:
+		m := map[string]any{}
+		for i, k := range n.keys {
+			m[k.value] = specValue(n.values[i])
+		}
+		return m
+	case n.kind == sequenceNode:
+		items := []any{}
+		for _, item := range n.items {
+			items = append(items, specValue(item))
+		}
+		return items
+	case n.null:
+		return nil
+	default:
+		return n.value
+	}
+}
+
+func TestParseYAMLDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want any
+	}{
+		{
+			name: "empty",
+			yaml: "# nothing here\n",
+			want: map[string]any{},
+		},
+		{
+			name: "mappings and sequences",
+			yaml: "image: alpine\ncommand:\n  - echo\n  - hi\nlimits:\n  memory: 64m\n",
+			want: map[string]any{"image": "alpine", "command": []any{"echo", "hi"}, "limits": map[string]any{"memory": "64m"}},
+		},
+		{
+			name: "sequence at the indentation of its key",
+			yaml: "env:\n- A=1\n- B=2\n",
+			want: map[string]any{"env": []any{"A=1", "B=2"}},
+		},
+		{
+			name: "mappings in a sequence",
+			yaml: "mounts:\n  - source: /data\n    target: /mnt\n  - source: /logs\n",
+			want: map[string]any{"mounts": []any{map[string]any{"source": "/data", "target": "/mnt"}, map[string]any{"source": "/logs"}}},
+		},
+		{
+			name: "scalars",
+			yaml: "a: \"quoted: # not a comment\"\nb: 'it''s'\nc: plain # comment\nd: ~\ne:\nf: \"tab\\tescape\"\n",
+			want: map[string]any{"a": "quoted: # not a comment", "b": "it's", "c": "plain", "d": nil, "e": nil, "f": "tab\tescape"},
+		},
+		{
+			name: "flow collections",
+			yaml: "command: [sh, -c, \"echo a, b\"]\nlabels: {tier: web, \"app\": api}\nempty: []\n",
+			want: map[string]any{"command": []any{"sh", "-c", "echo a, b"}, "labels": map[string]any{"tier": "web", "app": "api"}, "empty": []any{}},
+		},
+		{
+			name: "document markers",
+			yaml: "---\nimage: alpine\n...\nignored: after the end\n",
+			want: map[string]any{"image": "alpine"},
+		},
+		{
+			name: "literal block scalar",
+			yaml: "script: |\n  echo one\n  # not a comment\n\n  echo two\nnext: value\n",
+			want: map[string]any{"script": "echo one\n# not a comment\n\necho two\n", "next": "value"},
+		},
+		{
+			name: "literal block scalar keeping its indentation",
+			yaml: "script: |\n  if true; then\n    echo yes\n  fi\n",
+			want: map[string]any{"script": "if true; then\n  echo yes\nfi\n"},
+		},
+		{
+			name: "strip chomping",
+			yaml: "a: |-\n  line\n\nb: x\n",
+			want: map[string]any{"a": "line", "b": "x"},
+		},
+		{
+			name: "keep chomping",
+			yaml: "a: |+\n  line\n\n\nb: x\n",
+			want: map[string]any{"a": "line\n\n\n", "b": "x"},
+		},
+		{
+			name: "folded block scalar",
+			yaml: "description: >\n  a long\n  sentence\n\n  new paragraph\n    kept as is\n  end\n",
+			want: map[string]any{"description": "a long sentence\nnew paragraph\n  kept as is\nend\n"},
+		},
+		{
+			name: "folded and stripped",
+			yaml: "description: >-\n  one\n  two\n",
+			want: map[string]any{"description": "one two"},
+		},
+		{
+			name: "indentation indicator",
+			yaml: "a: |2\n     indented\n  less\n",
+			want: map[string]any{"a": "   indented\nless\n"},
+		},
+		{
+			name: "block scalars in sequences",
+			yaml: "command:\n  - sh\n  - -c\n  - |\n    echo a\n    echo b\nhealthcheck:\n  - test: >\n      curl -f\n      localhost\n    interval: 5s\n",
+			want: map[string]any{
+				"command":     []any{"sh", "-c", "echo a\necho b\n"},
+				"healthcheck": []any{map[string]any{"test": "curl -f localhost\n", "interval": "5s"}},
+			},
+		},
+		{
+			name: "empty block scalar",
+			yaml: "a: |\nb: x\n",
+			want: map[string]any{"a": "", "b": "x"},
+		},
+		{
+			name: "block scalar header after a comment is still one",
+			yaml: "a: | # the script\n  echo\n",
+			want: map[string]any{"a": "echo\n"},
+		},
+		{
+			name: "quoted pipe is a plain string",
+			yaml: "a: \"|\"\nb: '>'\n",
+			want: map[string]any{"a": "|", "b": ">"},
+		},
+		{
+			name: "tabs inside a block scalar",
+			yaml: "a: |\n  col1\tcol2\n  \tindented by a tab\n",
+			want: map[string]any{"a": "col1\tcol2\n\tindented by a tab\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseSpecDocument("test.yaml", []byte(tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := specValue(root); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSONDocument(t *testing.T) {
+	root, err := parseSpecDocument("test.json", []byte(`{"image": "alpine", "command": ["echo", "hi"], "tty": true, "memory": 64, "user": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{"image": "alpine", "command": []any{"echo", "hi"}, "tty": "true", "memory": "64", "user": nil}
+	if got := specValue(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %#v, want %#v", got, want)
+	}
+}
+
+func TestParseSpecDocumentPositions(t *testing.T) {
+	root, err := parseSpecDocument("test.yaml", []byte("image: alpine\nlimits:\n  memory: 64m\nscript: |\n  echo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory := root.values[1].values[0]
+	if memory.line != 3 || memory.col != 11 {
+		t.Errorf("memory is at %d:%d, want 3:11", memory.line, memory.col)
+	}
+	script := root.values[2]
+	if script.line != 4 || script.col != 9 {
+		t.Errorf("script is at %d:%d, want 4:9", script.line, script.col)
+	}
+}
+
+func TestParseSpecDocumentErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "tab indentation", doc: "limits:\n\tmemory: 64m\n", wantErr: "test.yaml:2:1: tabs are not allowed for indentation"},
+		{name: "duplicate key", doc: "image: a\nimage: b\n", wantErr: "test.yaml:2:1: duplicate key \"image\""},
+		{name: "unexpected indentation", doc: "image: a\n  tty: true\n", wantErr: "test.yaml:2:3: unexpected indentation"},
+		{name: "list item in mapping", doc: "image: a\n- b\n", wantErr: "test.yaml:2:1: unexpected list item in mapping"},
+		{name: "not a key", doc: "image\n", wantErr: "test.yaml:1:1: expected \"key: value\""},
+		{name: "unterminated flow", doc: "command: [a, b\n", wantErr: "missing closing"},
+		{name: "block scalar ended by less indentation", doc: "a:\n  b: |\n    text\n   c: d\n", wantErr: "test.yaml:4:4: unexpected indentation"},
+		{name: "json", doc: `{"image": "a",}`, wantErr: "test.yaml:1:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSpecDocument("test.yaml", []byte(tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// containerStateDir holds a directory per container with its state.json
+const containerStateDir = "/run/your-docker"
+
+// Container statuses as shown by Docker
+const (
+	statusCreated = "created"
+	statusRunning = "running"
+	statusExited  = "exited"
+	// statusRestarting is that of an exited container the restart policy restarts
+	statusRestarting = "restarting"
+)
+
+// errContainerNotFound is returned for IDs without a state directory
+var errContainerNotFound = errors.New("no such container")
+
+// ContainerState is what is persisted about a container between commands
+type ContainerState struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name,omitempty"`
+	Status   string     `json:"status"`
+	Config   RunOptions `json:"config"`
+	RootPath string     `json:"rootPath"`
+	LowerDir string     `json:"lowerDir,omitempty"`
+	// Layers are the lower directories of the overlay mounted at RootPath/merged, topmost
+	// first, for root filesystems that aren't a copy of the image
+	Layers   []string  `json:"layers,omitempty"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+	// HostCA is the host's CA bundle that is mounted into an image without one
+	HostCA string `json:"hostCA,omitempty"`
+	// ImageDigest is the manifest digest of the stored image the container was created from,
+	// empty for images that were downloaded without being stored
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// ImageSize is the disk usage of the image's files, which ps --size compares against
+	ImageSize int64 `json:"imageSize,omitempty"`
+	// SkippedSetup are the optional setup steps that failed, with why
+	SkippedSetup []string `json:"skippedSetup,omitempty"`
+
+	Pid int `json:"pid,omitempty"`
+	// PidStartTime tells our process apart from a later one that reused the pid
+	PidStartTime uint64    `json:"pidStartTime,omitempty"`
+	ShimPid      int       `json:"shimPid,omitempty"`
+	Started      time.Time `json:"started,omitempty"`
+	Finished     time.Time `json:"finished,omitempty"`
+	ExitCode     int       `json:"exitCode"`
+
+	// RestartCount is how often the restart policy restarted the container since it was last
+	// started by hand, RestartDelay how long its shim waited before the last restart
+	RestartCount int           `json:"restartCount,omitempty"`
+	RestartDelay time.Duration `json:"restartDelay,omitempty"`
+	// StoppedByUser keeps the restart policy from restarting a container that was stopped or
+	// killed, until it is started again
+	StoppedByUser bool `json:"stoppedByUser,omitempty"`
+	// Health is what the healthcheck found since the container last started, nil without one
+	Health *healthState `json:"health,omitempty"`
+
+	// Resources held while the container runs
+	Cgroup  string       `json:"cgroup,omitempty"`
+	Network networkState `json:"network,omitempty"`
+	// IPCShm is the host mount of a shareable container's /dev/shm
+	IPCShm string `json:"ipcShm,omitempty"`
+}
+
+// networkState is the host side of a running container's network
+type networkState struct {
+	LeasePath string `json:"leasePath,omitempty"`
+	Address   string `json:"address,omitempty"`
+	HostVeth  string `json:"hostVeth,omitempty"`
+}
+
+// newContainerID generates a random 64 character ID like Docker's, which listings shorten to
+// its first 12
+func newContainerID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate container ID: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// containerDir returns the state directory of a container
+func containerDir(id string) string {
+	return filepath.Join(containerStateDir, id)
+}
+
+// loadContainerState reads the state of a container
+func loadContainerState(id string) (*ContainerState, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, fmt.Errorf("%w: %s", errContainerNotFound, id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(containerDir(id), "state.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errContainerNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state of %s: %w", id, err)
+	}
+
+	var state ContainerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state of %s: %w", id, err)
+	}
+
+	return &state, nil
+}
+
+// listContainerStates returns the state of every container, oldest first
+func listContainerStates() ([]*ContainerState, error) {
+	entries, err := os.ReadDir(containerStateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var states []*ContainerState
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		state, err := loadContainerState(e.Name())
+		if errors.Is(err, errContainerNotFound) {
+			// Removed while we were listing, or still being created
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Created.Before(states[j].Created) })
+
+	return states, nil
+}
+
+// save writes the state atomically, so readers never see a partial file
+func (s *ContainerState) save() error {
+	dir := containerDir(s.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state of %s: %w", s.ID, err)
+	}
+
+	tmp := filepath.Join(dir, "state.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state of %s: %w", s.ID, err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, "state.json")); err != nil {
+		return fmt.Errorf("failed to write state of %s: %w", s.ID, err)
+	}
+
+	return nil
+}
+
+// lockState serializes changes to a container's state between commands and its shim, which
+// would otherwise overwrite each other's. The lock is held until the file is closed.
+func lockState(id string) (*os.File, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, fmt.Errorf("%w: %s", errContainerNotFound, id)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(containerDir(id), "state.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errContainerNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state lock of %s: %w", id, err)
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock state of %s: %w", id, err)
+	}
+
+	return lock, nil
+}
+
+// running reports whether the container's init is still alive. A container whose shim
+// died without recording the exit counts as exited.
+func (s *ContainerState) running() bool {
+	if s.Status != statusRunning || s.Pid == 0 {
+		return false
+	}
+
+	start, err := processStartTime(s.Pid)
+	return err == nil && start == s.PidStartTime
+}
+
+// waitForExit polls until the shim has recorded the container's exit
+func waitForExit(id string, timeout time.Duration) (*ContainerState, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := loadContainerState(id)
+		if err != nil {
+			return nil, err
+		}
+		if (state.Status != statusRunning && !state.restarting()) || (!state.running() && !processAlive(state.ShimPid)) {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s to exit", id)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// processStartTime returns when a process started, in clock ticks since boot
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name may contain spaces and parentheses, the fields after it don't
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	// starttime is field 22, the 20th after the command name
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// processAlive reports whether a process with the pid exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return err == nil
+}
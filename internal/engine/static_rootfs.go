@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// staticELFHeadSize is how much of the command is read to find its program headers, which
+// follow the ELF header
+const staticELFHeadSize = 4096
+
+// errNotStaticImage makes the static binary fast path fall back to assembling the image
+var errNotStaticImage = errors.New("not a single static binary image")
+
+// staticImageDirs are the files a static binary may need besides itself, extracted with it
+var staticImageDirs = []string{"etc/", "usr/share/zoneinfo/", "usr/share/ca-certificates/"}
+
+// staticImageSkipped are files that aren't needed to run anything, like package databases,
+// and aren't extracted
+var staticImageSkipped = []string{"var/lib/dpkg/", "usr/share/doc/", "usr/share/man/", "usr/lib/os-release"}
+
+// prepareStaticRootfs is the fast path for images that are a single static binary, like
+// tools shipped as scratch images: the binary and the files it may need are extracted from the
+// stored layers straight into the root filesystem, in-process and without a layer cache or
+// overlay. errNotStaticImage is returned, with the root filesystem left empty, for any other
+// image, including those that aren't stored.
+func (env *ContainerEnvironment) prepareStaticRootfs(ctx context.Context, opts RunOptions) (imageConfig, error) {
+	want, err := parsePlatformOption(opts.Platform)
+	if err != nil {
+		return imageConfig{}, err
+	}
+
+	store := NewImageStore(imageStoreDir)
+	img, config, err := storedImage(store, opts.Image, want)
+	if err != nil {
+		return imageConfig{}, errNotStaticImage
+	}
+
+	// What runs has to be known from the config and the flags alone, a shell or $PATH
+	// lookup isn't
+	argv0 := opts.Command
+	if argv0 == "" {
+		if argv := imageCommand(config); len(argv) > 0 {
+			argv0 = argv[0]
+		}
+	}
+	if !path.IsAbs(argv0) {
+		return imageConfig{}, errNotStaticImage
+	}
+
+	start := time.Now()
+	x := &staticExtraction{root: env.rootPath, binary: strings.TrimPrefix(path.Clean(argv0), "/"), symlinks: map[string]bool{}}
+	for _, layer := range img.Manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return imageConfig{}, err
+		}
+
+		blob, err := store.blobPath(layer.Digest)
+		if err != nil {
+			return imageConfig{}, err
+		}
+		if err := x.extractLayer(blob); err != nil {
+			if cerr := clearDir(env.rootPath, true); cerr != nil {
+				return imageConfig{}, cerr
+			}
+			return imageConfig{}, err
+		}
+	}
+	if !x.static {
+		if err := clearDir(env.rootPath, true); err != nil {
+			return imageConfig{}, err
+		}
+		return imageConfig{}, errNotStaticImage
+	}
+
+	if err := env.setupDevices(env.rootPath); err != nil {
+		return imageConfig{}, err
+	}
+	if env.userns {
+		if err := shiftOwnership(env.rootPath); err != nil {
+			return imageConfig{}, fmt.Errorf("failed to prepare rootfs for the user namespace: %w", err)
+		}
+	}
+
+	debugf(eventTypeImage, "extracted static binary", "binary", argv0, "files", x.files, "duration", time.Since(start).Round(time.Millisecond))
+
+	return config, nil
+}
+
+// staticExtraction extracts the layers of a static binary image, refusing anything else
+type staticExtraction struct {
+	root   string
+	binary string
+	// static is set once the binary was found to be a static ELF executable
+	static bool
+	files  int
+	// symlinks are the links extracted so far, which nothing may be extracted through
+	symlinks map[string]bool
+}
+
+// extractLayer extracts the files of a layer tarball that a static binary needs, or returns
+// errNotStaticImage at the first that doesn't belong in such an image
+func (x *staticExtraction) extractLayer(blob string) error {
+	f, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressLayer(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer: %w", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			// The layer's root, which tar would give its mode
+			if hdr.Typeflag == tar.TypeDir {
+				if err := os.Chmod(x.root, hdr.FileInfo().Mode().Perm()); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// Whiteouts would need the assembly
+		if strings.HasPrefix(path.Base(name), whiteoutPrefix) || x.throughSymlink(name) {
+			return errNotStaticImage
+		}
+
+		if err := x.extract(tr, hdr, name); err != nil {
+			return err
+		}
+	}
+}
+
+// throughSymlink reports whether a parent directory of name is a symlink
+func (x *staticExtraction) throughSymlink(name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if x.symlinks[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extract writes a tar entry into the root filesystem if the image needs it
+func (x *staticExtraction) extract(tr *tar.Reader, hdr *tar.Header, name string) error {
+	dst := filepath.Join(x.root, filepath.FromSlash(name))
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	switch {
+	case hdr.Typeflag == tar.TypeDir:
+		if x.symlinks[name] {
+			return errNotStaticImage
+		}
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(dst, mode); err != nil {
+			return err
+		}
+		return os.Lchown(dst, hdr.Uid, hdr.Gid)
+	case hasAnyPrefix(name, staticImageSkipped):
+		return nil
+	case name == x.binary:
+		if hdr.Typeflag != tar.TypeReg {
+			return errNotStaticImage
+		}
+		head := make([]byte, staticELFHeadSize)
+		n, err := io.ReadFull(tr, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if !staticELF(head[:n]) {
+			return errNotStaticImage
+		}
+		x.static = true
+		delete(x.symlinks, name)
+		return x.writeFile(dst, io.MultiReader(bytes.NewReader(head[:n]), tr), mode, hdr)
+	case !hasAnyPrefix(name, staticImageDirs):
+		return errNotStaticImage
+	case hdr.Typeflag == tar.TypeReg:
+		delete(x.symlinks, name)
+		return x.writeFile(dst, tr, mode, hdr)
+	case hdr.Typeflag == tar.TypeSymlink:
+		if err := x.replace(dst); err != nil {
+			return err
+		}
+		x.symlinks[name] = true
+		x.files++
+		if err := os.Symlink(hdr.Linkname, dst); err != nil {
+			return err
+		}
+		return os.Lchown(dst, hdr.Uid, hdr.Gid)
+	}
+
+	// Hard links and devices aren't worth handling here
+	return errNotStaticImage
+}
+
+// replace removes what an earlier layer put at dst, without following it if it is a link
+func (x *staticExtraction) replace(dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// Not a directory with files in it, which an image like this doesn't replace
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errNotStaticImage
+	}
+
+	return nil
+}
+
+// writeFile writes a regular file of the image into the root filesystem
+func (x *staticExtraction) writeFile(dst string, r io.Reader, mode os.FileMode, hdr *tar.Header) error {
+	if err := x.replace(dst); err != nil {
+		return err
+	}
+	x.files++
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+	}
+	// Chown clears the setuid bits, so it goes first
+	if err := f.Chown(hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// hasAnyPrefix reports whether name starts with one of prefixes
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticELF reports whether head, the start of a file, is an ELF executable that doesn't
+// need a dynamic loader
+func staticELF(head []byte) bool {
+	if len(head) < 64 || !bytes.HasPrefix(head, []byte(elf.ELFMAG)) {
+		return false
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if elf.Data(head[elf.EI_DATA]) == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+
+	var phoff uint64
+	var phentsize, phnum uint16
+	switch elf.Class(head[elf.EI_CLASS]) {
+	case elf.ELFCLASS32:
+		phoff = uint64(order.Uint32(head[28:]))
+		phentsize, phnum = order.Uint16(head[42:]), order.Uint16(head[44:])
+	case elf.ELFCLASS64:
+		phoff = order.Uint64(head[32:])
+		phentsize, phnum = order.Uint16(head[54:]), order.Uint16(head[56:])
+	default:
+		return false
+	}
+
+	// Static PIE executables are ET_DYN, but don't have an interpreter either
+	if typ := elf.Type(order.Uint16(head[16:])); typ != elf.ET_EXEC && typ != elf.ET_DYN {
+		return false
+	}
+
+	for i := uint64(0); i < uint64(phnum); i++ {
+		off := phoff + i*uint64(phentsize)
+		if off+4 > uint64(len(head)) {
+			// The program headers aren't where they normally are
+			return false
+		}
+		if elf.ProgType(order.Uint32(head[off:])) == elf.PT_INTERP {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLayer writes an uncompressed layer tarball of the given entries to a file in dir
+func writeLayer(t *testing.T, dir string, headers ...*tar.Header) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := filepath.Join(dir, "layer.tar")
+	if err := os.WriteFile(blob, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestStaticExtractionAppliesLayerRootMode(t *testing.T) {
+	tests := []struct {
+		name string
+		root *tar.Header
+		want os.FileMode
+	}{
+		{name: "without a root entry", want: 0755},
+		{name: "with a root entry", root: &tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0750}, want: 0750},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.Chmod(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			headers := []*tar.Header{{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0755}}
+			if tt.root != nil {
+				headers = append([]*tar.Header{tt.root}, headers...)
+			}
+			blob := writeLayer(t, t.TempDir(), headers...)
+
+			x := &staticExtraction{root: root, binary: "bin/tool", symlinks: map[string]bool{}}
+			if err := x.extractLayer(blob); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != tt.want {
+				t.Errorf("root has mode %o, want %o", mode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// statsInterval is how often stats refreshes its table, and what CPU usage is measured over
+const statsInterval = time.Second
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat on every architecture
+// Linux runs containers on
+const clockTicks = 100
+
+// Where the usage of a container was read from
+const (
+	statsSourceCgroup    = "cgroup"
+	statsSourceProcesses = "processes"
+)
+
+// ContainerStats is the resource usage of a running container, as stats shows it
+type ContainerStats struct {
+	ID   string `json:"ID"`
+	Name string `json:"Name"`
+	// CPUPercent is the share of one CPU used since the previous sample, so above 100 for
+	// containers using several
+	CPUPercent    float64 `json:"CPUPerc"`
+	MemoryUsage   int64   `json:"MemUsage"`
+	MemoryLimit   int64   `json:"MemLimit"`
+	MemoryPercent float64 `json:"MemPerc"`
+	// NetworkRx and NetworkTx are missing for containers on the host's network, whose
+	// counters are the host's
+	NetworkRx *int64 `json:"NetRx,omitempty"`
+	NetworkTx *int64 `json:"NetTx,omitempty"`
+	PIDs      int64  `json:"PIDs"`
+	// Source is where the usage was read from: the container's cgroup, or its processes for
+	// containers started without one
+	Source string `json:"Source"`
+}
+
+// statsSample is what a container has used up to a point in time
+type statsSample struct {
+	at          time.Time
+	cpu         time.Duration
+	memory      int64
+	memoryLimit int64
+	pids        int64
+	network     bool
+	rx, tx      int64
+	source      string
+}
+
+// sampleContainer reads what the running container has used so far
+func sampleContainer(state *ContainerState) (statsSample, error) {
+	var sample statsSample
+	var err error
+	if state.Cgroup != "" {
+		sample, err = sampleCgroup(state.Cgroup)
+	} else {
+		sample, err = sampleNamespaceProcesses(state)
+	}
+	if err != nil {
+		return statsSample{}, fmt.Errorf("failed to read usage of %s: %w", shortID(state.ID), err)
+	}
+
+	if sample.memoryLimit == 0 {
+		if sample.memoryLimit, err = hostMemory(); err != nil {
+			return statsSample{}, fmt.Errorf("failed to read usage of %s: %w", shortID(state.ID), err)
+		}
+	}
+	if state.Config.Network != NetworkHost {
+		if sample.rx, sample.tx, err = networkCounters(state.Pid); err != nil {
+			return statsSample{}, fmt.Errorf("failed to read network usage of %s: %w", shortID(state.ID), err)
+		}
+		sample.network = true
+	}
+	sample.at = time.Now()
+
+	return sample, nil
+}
+
+// sampleCgroup reads the usage of a container's cgroup. Its memory limit is left 0 when it
+// has none.
+func sampleCgroup(dir string) (statsSample, error) {
+	sample := statsSample{source: statsSourceCgroup}
+
+	var err error
+	if sample.memory, err = readCgroupInt(dir, "memory.current"); err != nil {
+		return statsSample{}, err
+	}
+	if sample.pids, err = readCgroupInt(dir, "pids.current"); err != nil {
+		return statsSample{}, err
+	}
+	if max, err := os.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+		// "max" when the container has no memory limit
+		sample.memoryLimit, _ = strconv.ParseInt(strings.TrimSpace(string(max)), 10, 64)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return statsSample{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "usage_usec "); ok {
+			usec, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return statsSample{}, fmt.Errorf("invalid usage_usec in %s: %q", filepath.Join(dir, "cpu.stat"), value)
+			}
+			sample.cpu = time.Duration(usec) * time.Microsecond
+		}
+	}
+
+	return sample, scanner.Err()
+}
+
+// readCgroupInt reads a cgroup file holding a single number
+func readCgroupInt(dir, file string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", filepath.Join(dir, file), strings.TrimSpace(string(data)))
+	}
+
+	return n, nil
+}
+
+// sampleNamespaceProcesses adds up the usage of the processes in the container's PID
+// namespace, for containers without a cgroup to read it from. Memory is their resident set,
+// which counts pages they share twice.
+func sampleNamespaceProcesses(state *ContainerState) (statsSample, error) {
+	sample := statsSample{source: statsSourceProcesses}
+
+	pids, err := namespaceProcesses(state.Pid)
+	if err != nil {
+		return statsSample{}, err
+	}
+
+	pageSize := int64(os.Getpagesize())
+	for _, pid := range pids {
+		// The process may have exited since
+		cpu, err := processCPUTime(pid)
+		if err != nil {
+			continue
+		}
+		statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(statm))
+		if len(fields) < 2 {
+			continue
+		}
+		resident, _ := strconv.ParseInt(fields[1], 10, 64)
+
+		sample.cpu += cpu
+		sample.memory += resident * pageSize
+		sample.pids++
+	}
+
+	return sample, nil
+}
+
+// processCPUTime returns the user and system time a process has used
+func processCPUTime(pid int) (time.Duration, error) {
+	fields, err := processStatFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(utime+stime) * time.Second / clockTicks, nil
+}
+
+// hostMemory returns the memory of the host, the limit of containers without one of their own
+func hostMemory() (int64, error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, err
+	}
+
+	return int64(info.Totalram) * int64(info.Unit), nil
+}
+
+// networkCounters returns the bytes received and sent on the interfaces of the network
+// namespace of pid, loopback aside
+func networkCounters(pid int) (rx, tx int64, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		// Received bytes come first, sent bytes are the ninth field
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		received, _ := strconv.ParseInt(fields[0], 10, 64)
+		sent, _ := strconv.ParseInt(fields[8], 10, 64)
+		rx += received
+		tx += sent
+	}
+
+	return rx, tx, scanner.Err()
+}
+
+// containerStats works out the usage of a container from two of its samples
+func containerStats(state *ContainerState, previous, current statsSample) ContainerStats {
+	stats := ContainerStats{
+		ID:          shortID(state.ID),
+		Name:        state.Name,
+		MemoryUsage: current.memory,
+		MemoryLimit: current.memoryLimit,
+		PIDs:        current.pids,
+		Source:      current.source,
+	}
+	if elapsed := current.at.Sub(previous.at); elapsed > 0 && current.cpu >= previous.cpu {
+		stats.CPUPercent = float64(current.cpu-previous.cpu) / float64(elapsed) * 100
+	}
+	if current.memoryLimit > 0 {
+		stats.MemoryPercent = float64(current.memory) / float64(current.memoryLimit) * 100
+	}
+	if current.network {
+		stats.NetworkRx, stats.NetworkTx = &current.rx, &current.tx
+	}
+
+	return stats
+}
+
+// statsCollector samples containers and keeps each one's last sample to measure the next
+// against
+type statsCollector struct {
+	// ids are the containers asked for, or nil for every running one
+	ids     []string
+	samples map[string]statsSample
+}
+
+// collect samples the containers that are running. It returns their usage since the last
+// call, an exited container stops being sampled.
+func (c *statsCollector) collect() ([]ContainerStats, error) {
+	var states []*ContainerState
+	if c.ids == nil {
+		all, err := listContainerStates()
+		if err != nil {
+			return nil, err
+		}
+		states = all
+	} else {
+		for _, id := range c.ids {
+			state, err := loadContainerState(id)
+			if errors.Is(err, errContainerNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+	}
+
+	samples := make(map[string]statsSample, len(states))
+	var stats []ContainerStats
+	for _, state := range states {
+		if !state.running() {
+			continue
+		}
+		sample, err := sampleContainer(state)
+		if err != nil {
+			// Exiting since it was listed
+			if !state.running() {
+				continue
+			}
+			return nil, err
+		}
+		samples[state.ID] = sample
+		if previous, ok := c.samples[state.ID]; ok {
+			stats = append(stats, containerStats(state, previous, sample))
+		}
+	}
+	c.samples = samples
+
+	return stats, nil
+}
+
+// printStatsTable writes the usage of containers as a table like docker stats
+func printStatsTable(w io.Writer, stats []ContainerStats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tNET I/O\tPIDS")
+	for _, s := range stats {
+		network := "-"
+		if s.NetworkRx != nil {
+			network = formatSize(*s.NetworkRx) + " / " + formatSize(*s.NetworkTx)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%s\t%d\n", s.ID, s.Name, s.CPUPercent, formatSize(s.MemoryUsage), formatSize(s.MemoryLimit), s.MemoryPercent, network, s.PIDs)
+	}
+
+	return tw.Flush()
+}
+
+// printStatsJSON writes the usage of each container as a JSON object per line
+func printStatsJSON(w io.Writer, stats []ContainerStats) error {
+	enc := json.NewEncoder(w)
+	for _, s := range stats {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,559 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The layouts of a root filesystem: an overlay of the image's cached layers with the
+// container's writes in an upper directory, or a copy of the image
+const (
+	storageOverlay = "overlay"
+	storageCopy    = "copy"
+)
+
+// Next to a root filesystem being migrated, the new layout is built in the staging directory
+// and the old one is moved aside until the state refers to the new one
+const (
+	migrateStagingSuffix = ".migrate"
+	migrateOldSuffix     = ".migrate-old"
+)
+
+// errAlreadyMigrated is returned for containers that already have the layout asked for
+var errAlreadyMigrated = errors.New("already has the requested layout")
+
+// migration is what migrating a root filesystem did
+type migration struct {
+	// files are those copied, or kept in the upper directory as changed by the container
+	files int
+	// whiteouts are the image's files the container deleted
+	whiteouts int
+	before    int64
+	after     int64
+}
+
+// storageLayout returns the layout of a container's root filesystem
+func storageLayout(state *ContainerState) string {
+	if len(state.Layers) > 0 {
+		return storageOverlay
+	}
+
+	return storageCopy
+}
+
+// migrateContainer converts the root filesystem of a container that isn't running to
+// layout. The new layout is built next to the old one, which is only replaced once it is
+// complete and removed once the state refers to the new one, so a failure leaves the
+// container as it was.
+func migrateContainer(id, layout string) (migration, error) {
+	lock, err := lockState(id)
+	if err != nil {
+		return migration{}, err
+	}
+	defer lock.Close()
+
+	state, err := loadContainerState(id)
+	if err != nil {
+		return migration{}, err
+	}
+	if state.LowerDir != "" {
+		return migration{}, fmt.Errorf("container %s runs on a shared rootfs, which has no other layout", shortID(id))
+	}
+	if storageLayout(state) == layout {
+		return migration{}, errAlreadyMigrated
+	}
+	if state.Status == statusRunning || state.running() || state.restarting() {
+		return migration{}, fmt.Errorf("container %s is running, stop it first", shortID(id))
+	}
+
+	// Left over from a migration that was killed before it got to replace the old layout
+	staging := state.RootPath + migrateStagingSuffix
+	if err := removeStaging(staging); err != nil {
+		return migration{}, err
+	}
+
+	before, err := dirSize(state.RootPath)
+	if err != nil {
+		return migration{}, err
+	}
+
+	var m migration
+	var layers []string
+	if layout == storageOverlay {
+		m, layers, err = migrateToOverlay(state, staging)
+	} else {
+		m, err = migrateToCopy(state, staging)
+	}
+	if err != nil {
+		if rerr := removeStaging(staging); rerr != nil {
+			warnf(eventTypeContainer, "failed to roll back the migration of %s: %v", shortID(id), rerr)
+		}
+		return migration{}, err
+	}
+	m.before = before
+	if m.after, err = dirSize(staging); err != nil {
+		removeStaging(staging)
+		return migration{}, err
+	}
+
+	if err := replaceRootfs(state, staging, layers); err != nil {
+		removeStaging(staging)
+		return migration{}, err
+	}
+
+	return m, nil
+}
+
+// removeStaging removes a staging directory along with the overlays a migration may have
+// left mounted in and next to it
+func removeStaging(staging string) error {
+	if err := unmountOverlayRootfs(staging); err != nil {
+		return err
+	}
+	if lower := staging + ".lower"; isMountPoint(lower) {
+		if err := syscall.Unmount(lower, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", lower, err)
+		}
+		os.Remove(lower)
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", staging, err)
+	}
+
+	return nil
+}
+
+// replaceRootfs moves the layout built in staging into place and records its layers, nil for
+// a copy, in the state. Until the state is saved the old layout can be moved back.
+func replaceRootfs(state *ContainerState, staging string, layers []string) error {
+	root := state.RootPath
+	old := root + migrateOldSuffix
+
+	// An overlay can't be moved, nor the old layout removed, while it is mounted
+	if err := unmountOverlayRootfs(root); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", old, err)
+	}
+
+	if err := os.Rename(root, old); err != nil {
+		return fmt.Errorf("failed to move the root filesystem aside: %w", err)
+	}
+	if err := os.Rename(staging, root); err != nil {
+		os.Rename(old, root)
+		return fmt.Errorf("failed to move the migrated root filesystem into place: %w", err)
+	}
+
+	previous := state.Layers
+	state.Layers = layers
+	if err := state.save(); err != nil {
+		state.Layers = previous
+		os.Rename(root, staging)
+		os.Rename(old, root)
+		return err
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		warnf(eventTypeContainer, "failed to remove the old root filesystem of %s: %v", shortID(state.ID), err)
+	}
+
+	return nil
+}
+
+// migrateToOverlay builds an overlay layout in staging for a container whose root
+// filesystem is a copy of its image: what differs from the image's layers goes into the upper
+// directory, hard linked rather than copied, and the image's files the container deleted
+// become whiteouts
+func migrateToOverlay(state *ContainerState, staging string) (migration, []string, error) {
+	if !hasFilesystem("overlay") {
+		return migration{}, nil, errors.New("overlayfs isn't available on this host")
+	}
+	if state.ImageDigest == "" {
+		return migration{}, nil, fmt.Errorf("container %s wasn't created from a stored image, so its layers aren't known", shortID(state.ID))
+	}
+
+	store := NewImageStore(imageStoreDir)
+	img, err := store.imageByDigest(state.ImageDigest)
+	if err != nil {
+		return migration{}, nil, err
+	}
+	layers, err := store.layerDirs(img, state.Config.UserNamespace, nil)
+	if err != nil {
+		return migration{}, nil, err
+	}
+
+	lower, release, err := mountLowerView(layers, staging+".lower")
+	if err != nil {
+		return migration{}, nil, err
+	}
+	defer release()
+
+	upper := overlayUpperDir(staging)
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return migration{}, nil, err
+	}
+	if err := copyDirMetadata(state.RootPath, upper); err != nil {
+		return migration{}, nil, err
+	}
+
+	d := &upperDiff{copy: state.RootPath, lower: lower, upper: upper, made: map[string]bool{}}
+	if err := d.addChanges(); err != nil {
+		return migration{}, nil, fmt.Errorf("failed to collect the container's changes: %w", err)
+	}
+	if err := d.addWhiteouts(); err != nil {
+		return migration{}, nil, fmt.Errorf("failed to collect the container's deletions: %w", err)
+	}
+
+	// The kernel has the last word on whether the layout works, e.g. with many layers
+	if err := mountOverlayRootfs(staging, layers); err != nil {
+		return migration{}, nil, err
+	}
+	if err := unmountOverlayRootfs(staging); err != nil {
+		return migration{}, nil, err
+	}
+
+	return migration{files: d.files, whiteouts: d.whiteouts}, layers, nil
+}
+
+// mountLowerView returns a directory showing the layers stacked, like an overlay rootfs
+// without the container's writes. A single layer is that already, more are mounted read-only
+// at dir until the returned function is called.
+func mountLowerView(layers []string, dir string) (string, func(), error) {
+	if len(layers) == 0 {
+		return "", nil, errors.New("the image has no layers to stack")
+	}
+	if len(layers) == 1 {
+		return layers[0], func() {}, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+	data := "lowerdir=" + strings.Join(layers, ":")
+	if len(data) >= os.Getpagesize() {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("too many layers (%d) for one overlay mount", len(layers))
+	}
+	if err := syscall.Mount("overlay", dir, "overlay", syscall.MS_RDONLY, data); err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("failed to mount the image's layers: %w", err)
+	}
+
+	return dir, func() {
+		if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+			warnf(eventTypeContainer, "failed to unmount %s: %v", dir, err)
+			return
+		}
+		os.Remove(dir)
+	}, nil
+}
+
+// upperDiff fills the upper directory of an overlay with how the copy differs from lower
+type upperDiff struct {
+	copy  string
+	lower string
+	upper string
+	// made are the directories created in upper so far
+	made      map[string]bool
+	files     int
+	whiteouts int
+}
+
+// addChanges links everything of the copy that isn't in lower, or differs from it, into upper
+func (d *upperDiff) addChanges() error {
+	return filepath.WalkDir(d.copy, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.copy, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		lowerPath := filepath.Join(d.lower, rel)
+		lowerInfo, err := os.Lstat(lowerPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil && sameEntry(path, info, lowerPath, lowerInfo) {
+			return nil
+		}
+
+		if err := d.makeParents(rel); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return d.makeDir(rel)
+		}
+		d.files++
+		return os.Link(path, filepath.Join(d.upper, rel))
+	})
+}
+
+// addWhiteouts hides what lower has and the copy doesn't anymore
+func (d *upperDiff) addWhiteouts() error {
+	return filepath.WalkDir(d.lower, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.lower, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := os.Lstat(filepath.Join(d.copy, rel))
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := d.makeParents(rel); err != nil {
+				return err
+			}
+			if err := syscall.Mknod(filepath.Join(d.upper, rel), syscall.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("failed to create whiteout for %s: %w", rel, err)
+			}
+			d.whiteouts++
+			return skipDir(entry)
+		}
+		if err != nil {
+			return err
+		}
+
+		// What the copy has here instead is in upper already and hides everything below
+		if entry.IsDir() && !info.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// makeParents creates the parent directories of rel in upper, like the copy has them
+func (d *upperDiff) makeParents(rel string) error {
+	var missing []string
+	for dir := filepath.Dir(rel); dir != "." && !d.made[dir]; dir = filepath.Dir(dir) {
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := d.makeDir(missing[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeDir creates the directory rel in upper with the owner and mode it has in the copy
+func (d *upperDiff) makeDir(rel string) error {
+	dst := filepath.Join(d.upper, rel)
+	if err := os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	d.made[rel] = true
+
+	return copyDirMetadata(filepath.Join(d.copy, rel), dst)
+}
+
+// skipDir skips the rest of a directory entry's tree while walking
+func skipDir(entry fs.DirEntry) error {
+	if entry.IsDir() {
+		return fs.SkipDir
+	}
+
+	return nil
+}
+
+// sameEntry reports whether two files are the same as far as their type, owner, mode and,
+// like docker diff, size and modification time tell. Directories only compare the former,
+// their modification time changes with what is in them.
+func sameEntry(aPath string, a fs.FileInfo, bPath string, b fs.FileInfo) bool {
+	if a.Mode() != b.Mode() {
+		return false
+	}
+	sa, okA := a.Sys().(*syscall.Stat_t)
+	sb, okB := b.Sys().(*syscall.Stat_t)
+	if !okA || !okB || sa.Uid != sb.Uid || sa.Gid != sb.Gid {
+		return false
+	}
+
+	switch mode := a.Mode(); {
+	case mode.IsDir():
+		return true
+	case mode.IsRegular():
+		return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+	case mode&fs.ModeSymlink != 0:
+		aTarget, errA := os.Readlink(aPath)
+		bTarget, errB := os.Readlink(bPath)
+		return errA == nil && errB == nil && aTarget == bTarget
+	case mode&fs.ModeDevice != 0:
+		return sa.Rdev == sb.Rdev
+	}
+
+	return true
+}
+
+// migrateToCopy copies the merged overlay of a container into staging, which then holds the
+// image with the container's changes applied, like a root filesystem the image was copied into
+func migrateToCopy(state *ContainerState, staging string) (migration, error) {
+	if err := mountOverlayRootfs(state.RootPath, state.Layers); err != nil {
+		return migration{}, err
+	}
+	defer unmountOverlayRootfs(state.RootPath)
+
+	files, err := copyTree(overlayMergedDir(state.RootPath), staging)
+	if err != nil {
+		return migration{}, fmt.Errorf("failed to copy the root filesystem: %w", err)
+	}
+
+	return migration{files: files}, nil
+}
+
+// copyTree copies the files below src into dst with their owners, modes and modification
+// times, keeping hard links, and returns how many it copied
+func copyTree(src, dst string) (int, error) {
+	type inode struct{ dev, ino uint64 }
+	links := map[inode]string{}
+	var dirs []string
+	files := 0
+
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to stat %s", path)
+		}
+
+		if info.IsDir() {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			// Set once the directory is filled, which changes its modification time
+			dirs = append(dirs, rel)
+			return nil
+		}
+
+		key := inode{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := links[key]; ok && st.Nlink > 1 {
+			return os.Link(first, target)
+		}
+		links[key] = target
+		files++
+
+		switch mode := info.Mode(); {
+		case mode.IsRegular():
+			return copyRegularFile(path, target, info, st)
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, int(st.Uid), int(st.Gid))
+		case mode&fs.ModeSocket != 0:
+			// Sockets only mean something to the process listening on them
+			files--
+			return nil
+		}
+
+		// Devices and FIFOs
+		if err := syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+			return fmt.Errorf("failed to create %s: %w", rel, err)
+		}
+		if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyDirMetadata(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i])); err != nil {
+			return 0, err
+		}
+	}
+
+	return files, nil
+}
+
+// copyRegularFile copies the content, owner, mode and modification time of a regular file
+func copyRegularFile(src, dst string, info fs.FileInfo, st *syscall.Stat_t) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	// Chown clears the setuid bits, so it goes first
+	if err := out.Chown(int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if err := out.Chmod(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// cacheStoredImages extracts the layers of every stored image into the layer cache, so that
+// containers created from them are overlays right away, and returns how many images it did
+func cacheStoredImages(store *ImageStore, userns bool) (int, error) {
+	index, err := store.readIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	done := map[string]bool{}
+	for name, tags := range index.Repositories {
+		for tag, digest := range tags {
+			if done[digest] {
+				continue
+			}
+			done[digest] = true
+
+			img, err := store.lookup(name, tag)
+			if err != nil {
+				return len(done) - 1, err
+			}
+			if _, err := store.layerDirs(img, userns, nil); err != nil {
+				return len(done) - 1, fmt.Errorf("failed to cache the layers of %s: %w", formatImageReference(name, tag), err)
+			}
+		}
+	}
+
+	return len(done), nil
+}
@@ -0,0 +1,294 @@
+package engine
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// tarballSourceLabel is the label the config of a tarball image records its URL in
+const tarballSourceLabel = "org.opencontainers.image.source"
+
+// isTarballURL reports whether an image argument is the URL of a root filesystem tarball
+// rather than an image reference
+func isTarballURL(image string) bool {
+	return strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "http://")
+}
+
+// parseTarballURL checks the URL of a tarball image and returns it the way the store keeps
+// it, without a fragment
+func parseTarballURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid tarball URL %q: %w", s, err)
+	}
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return "", fmt.Errorf("invalid tarball URL %q: expected a URL like https://example.com/rootfs.tar.gz", s)
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	return u.String(), nil
+}
+
+// parseSHA256Option parses a --sha256 checksum, given as 64 hex digits with an optional
+// sha256: prefix, into a digest
+func parseSHA256Option(checksum string) (string, error) {
+	digest := "sha256:" + strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if err := validateDigest(digest); err != nil {
+		return "", fmt.Errorf("invalid --sha256 %q: expected 64 hex digits", checksum)
+	}
+
+	return digest, nil
+}
+
+// tarballManifest is the manifest written for a tarball image, an OCI manifest of one layer
+type tarballManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        layerEntry   `json:"config"`
+	Layers        []layerEntry `json:"layers"`
+}
+
+// tarballConfig is the config written for a tarball image. A root filesystem doesn't say
+// what it is built for, so it has no architecture and matches any platform.
+type tarballConfig struct {
+	Created time.Time `json:"created"`
+	OS      string    `json:"os"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// pullTarballImage stores the root filesystem tarball at rawURL as an image of a single
+// layer, tagged with the URL, and returns it. A stored image is used as it is if its layer has
+// the checksum asked for, or for no checksum unless refresh is set, like pull updates a tag.
+func pullTarballImage(ctx context.Context, store *ImageStore, rawURL, checksum string, refresh bool) (*StoredImage, error) {
+	name, err := parseTarballURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var want string
+	if checksum != "" {
+		if want, err = parseSHA256Option(checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	lock, err := store.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	img, err := store.lookup(name, "")
+	if err != nil && !errors.Is(err, errImageNotFound) {
+		return nil, err
+	}
+	if img != nil && len(img.Manifest.Layers) == 1 {
+		if want != "" && img.Manifest.Layers[0].Digest == want || want == "" && !refresh {
+			return img, nil
+		}
+	}
+
+	layer, diffID, lastModified, err := downloadTarball(ctx, store, name, want)
+	if err != nil {
+		return nil, err
+	}
+
+	var config tarballConfig
+	config.Created = lastModified
+	config.OS = "linux"
+	config.Config.Labels = map[string]string{tarballSourceLabel: name}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{diffID}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image config: %w", err)
+	}
+	configDigest, err := store.writeBlob(data)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = json.Marshal(tarballManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        layerEntry{MediaType: mediaTypeOCIConfig, Digest: configDigest, Size: int64(len(data))},
+		Layers:        []layerEntry{layer},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image manifest: %w", err)
+	}
+	digest, err := store.writeBlob(data)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := store.tag(name, "", digest)
+	if err != nil {
+		return nil, err
+	}
+
+	status := "Image is up to date"
+	if changed {
+		status = "Downloaded newer image"
+	}
+	bus.Publish(Event{
+		Type:       eventTypeImage,
+		Action:     eventActionPull,
+		ID:         name,
+		Message:    fmt.Sprintf("Status: %s for %s", status, name),
+		Attributes: map[string]string{"digest": digest},
+	})
+
+	return store.lookup(name, "")
+}
+
+// downloadTarball downloads the tarball into the store as a layer blob, verifying it against
+// the digest want if there is one, and returns the layer along with the digest of its
+// uncompressed tar stream and the time the server says the tarball was last modified
+func downloadTarball(ctx context.Context, store *ImageStore, rawURL, want string) (layerEntry, string, time.Time, error) {
+	transport, err := newRegistryTransport()
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+	// Root filesystems can be large, so only the context bounds the download
+	client := &http.Client{Transport: &clockCheckingTransport{base: loggingTransport{base: transport}}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+	req.Header.Set("User-Agent", "go-docker-client/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return layerEntry{}, "", time.Time{}, fmt.Errorf("failed to download %s: %s", rawURL, resp.Status)
+	}
+
+	tmp, err := store.tempBlob()
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+	defer os.Remove(tmp)
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+	defer out.Close()
+
+	id := path.Base(req.URL.Path)
+	hash := sha256.New()
+	body := &progressReader{r: resp.Body, id: id, message: "Downloading", total: resp.ContentLength}
+	size, err := io.Copy(io.MultiWriter(out, hash), body)
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, fmt.Errorf("failed to download %s: %w", rawURL, err)
+	}
+	if err := out.Close(); err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if want != "" && digest != want {
+		return layerEntry{}, "", time.Time{}, &digestMismatchError{digest: want, actual: digest, source: req.URL.Host}
+	}
+
+	mediaType, diffID, err := inspectTarball(tmp)
+	if err != nil {
+		return layerEntry{}, "", time.Time{}, fmt.Errorf("%s: %w", id, err)
+	}
+
+	if err := store.commitBlob(digest, tmp); err != nil {
+		return layerEntry{}, "", time.Time{}, err
+	}
+	imageProgress(id, "Pull complete")
+
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Now().UTC()
+	}
+
+	return layerEntry{MediaType: mediaType, Digest: digest, Size: size}, diffID, lastModified, nil
+}
+
+// inspectTarball checks that a downloaded file is a tar archive, compressed or not, and
+// returns its layer media type and the digest of the uncompressed archive
+func inspectTarball(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	mediaType, err := layerMediaType(f)
+	if err != nil {
+		return "", "", err
+	}
+
+	r, err := decompressLayer(f)
+	if err != nil {
+		return "", "", err
+	}
+	hash := sha256.New()
+	tr := tar.NewReader(io.TeeReader(r, hash))
+	entries := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("not a root filesystem tarball: %w", err)
+		}
+		entries++
+	}
+	if entries == 0 {
+		return "", "", errors.New("not a root filesystem tarball: it is empty")
+	}
+	// The padding after the end of the archive is part of the layer's digest too
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", "", err
+	}
+
+	return mediaType, "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// layerMediaType returns the OCI layer media type of a tar file by its compression, leaving
+// the file at its start
+func layerMediaType(f *os.File) (string, error) {
+	head := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(f, head)
+	mediaType := "application/vnd.oci.image.layer.v1.tar"
+	switch {
+	case bytes.HasPrefix(head[:n], gzipMagic):
+		mediaType += "+gzip"
+	case bytes.HasPrefix(head[:n], zstdMagic):
+		mediaType += "+zstd"
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return mediaType, nil
+}
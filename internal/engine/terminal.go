@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// defaultDetachKeys is Docker's escape sequence for detaching from a container
+const defaultDetachKeys = "ctrl-p,ctrl-q"
+
+// errDetached is returned by the escape proxy once the full detach sequence was typed
+var errDetached = errors.New("read escape sequence")
+
+// winsize mirrors struct winsize from <sys/ioctl.h>
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// controlKeys are the names accepted in --detach-keys, indexed by the byte they produce
+var controlKeys = []string{
+	"ctrl-@", "ctrl-a", "ctrl-b", "ctrl-c", "ctrl-d", "ctrl-e", "ctrl-f", "ctrl-g",
+	"ctrl-h", "ctrl-i", "ctrl-j", "ctrl-k", "ctrl-l", "ctrl-m", "ctrl-n", "ctrl-o",
+	"ctrl-p", "ctrl-q", "ctrl-r", "ctrl-s", "ctrl-t", "ctrl-u", "ctrl-v", "ctrl-w",
+	"ctrl-x", "ctrl-y", "ctrl-z", "ctrl-[", "ctrl-\\", "ctrl-]", "ctrl-^", "ctrl-_",
+}
+
+// ParseDetachKeys converts a --detach-keys value such as "ctrl-p,ctrl-q" into the bytes the
+// terminal sends. Like Docker, single characters stand for themselves.
+func ParseDetachKeys(keys string) ([]byte, error) {
+	var codes []byte
+
+next:
+	for _, key := range strings.Split(keys, ",") {
+		if len(key) == 1 {
+			codes = append(codes, key[0])
+			continue
+		}
+
+		for code, name := range controlKeys {
+			if key == name {
+				codes = append(codes, byte(code))
+				continue next
+			}
+		}
+
+		if key != "DEL" {
+			return nil, fmt.Errorf("invalid --detach-keys %q: unknown key %q", keys, key)
+		}
+		codes = append(codes, 127)
+	}
+
+	return codes, nil
+}
+
+// escapeProxy forwards terminal input while watching for the detach sequence. Keys that
+// start the sequence are held back, and so not echoed by the container's terminal, until
+// it is either completed or broken, in which case they are passed on after all.
+type escapeProxy struct {
+	r       io.Reader
+	keys    []byte
+	pos     int
+	pending []byte
+}
+
+func newEscapeProxy(r io.Reader, keys []byte) *escapeProxy {
+	return &escapeProxy{r: r, keys: keys}
+}
+
+func (p *escapeProxy) Read(buf []byte) (int, error) {
+	if len(p.pending) > 0 {
+		n := copy(buf, p.pending)
+		p.pending = p.pending[n:]
+		return n, nil
+	}
+
+	n, err := p.r.Read(buf)
+	if len(p.keys) == 0 {
+		return n, err
+	}
+
+	// The sequence only counts when typed, which arrives one key per read
+	if n != 1 || err != nil || buf[0] != p.keys[p.pos] {
+		return p.release(buf, n), err
+	}
+
+	if p.pos == len(p.keys)-1 {
+		return 0, errDetached
+	}
+
+	p.pos++
+	return 0, nil
+}
+
+// release puts the held keys back in front of the data just read. Whatever doesn't fit is
+// returned by the next Read.
+func (p *escapeProxy) release(buf []byte, n int) int {
+	if p.pos == 0 {
+		return n
+	}
+
+	data := append(append([]byte{}, p.keys[:p.pos]...), buf[:n]...)
+	p.pos = 0
+
+	copied := copy(buf, data)
+	p.pending = data[copied:]
+
+	return copied
+}
+
+// openPty allocates a pseudo-terminal pair
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty: %w", err)
+	}
+
+	return master, slave, nil
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&t)) == nil
+}
+
+// makeRaw puts the terminal into raw mode like cfmakeraw(3) and returns the previous state
+func makeRaw(f *os.File) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, fmt.Errorf("failed to read terminal state: %w", err)
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, fmt.Errorf("failed to set raw mode: %w", err)
+	}
+
+	return &old, nil
+}
+
+// restoreTerminal puts back a state saved by makeRaw
+func restoreTerminal(f *os.File, state *syscall.Termios) error {
+	return ioctl(f.Fd(), syscall.TCSETS, unsafe.Pointer(state))
+}
+
+// copyWindowSize gives the pty the size of our terminal
+func copyWindowSize(from, to *os.File) error {
+	var ws winsize
+	if err := ioctl(from.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return err
+	}
+
+	return ioctl(to.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ContainerProcess is a process in a container's PID namespace, as top shows it
+type ContainerProcess struct {
+	UID  int `json:"UID"`
+	PID  int `json:"PID"`
+	PPID int `json:"PPID"`
+	// NSPID is the PID the container itself sees
+	NSPID   int           `json:"NSPID"`
+	Started time.Time     `json:"Started"`
+	CPUTime time.Duration `json:"CPUTime"`
+	Command string        `json:"Command"`
+}
+
+// namespaceProcesses returns the host PIDs of the processes in the PID namespace of pid,
+// lowest first
+func namespaceProcesses(pid int) ([]int, error) {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the container's processes: %w", err)
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the container's processes: %w", err)
+	}
+	var pids []int
+	for _, entry := range entries {
+		p, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// The process may have exited since
+		if procNs, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/pid", p)); err == nil && procNs == ns {
+			pids = append(pids, p)
+		}
+	}
+	sort.Ints(pids)
+
+	return pids, nil
+}
+
+// processStatFields returns the fields of /proc/<pid>/stat after the command name, which may
+// contain spaces and parentheses itself. Field n of proc(5) is at n-3.
+func processStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	i := strings.LastIndexByte(string(data), ')')
+	fields := strings.Fields(string(data[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	return fields, nil
+}
+
+// bootTime returns when the host booted, which process start times count from
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid btime in /proc/stat: %q", value)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+// listContainerProcesses describes the processes in the running container's PID namespace
+func listContainerProcesses(state *ContainerState) ([]ContainerProcess, error) {
+	if !state.running() {
+		return nil, fmt.Errorf("container %s is not running", shortID(state.ID))
+	}
+
+	pids, err := namespaceProcesses(state.Pid)
+	if err != nil {
+		return nil, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the host's boot time: %w", err)
+	}
+
+	var processes []ContainerProcess
+	for _, pid := range pids {
+		// Processes that exited since are left out
+		if p, err := readContainerProcess(pid, boot); err == nil {
+			processes = append(processes, p)
+		}
+	}
+
+	return processes, nil
+}
+
+// readContainerProcess reads what top shows about a process from /proc
+func readContainerProcess(pid int, boot time.Time) (ContainerProcess, error) {
+	fields, err := processStatFields(pid)
+	if err != nil {
+		return ContainerProcess{}, err
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	start, _ := strconv.ParseInt(fields[19], 10, 64)
+
+	p := ContainerProcess{
+		PID:     pid,
+		PPID:    ppid,
+		Started: boot.Add(time.Duration(start) * time.Second / clockTicks),
+		CPUTime: time.Duration(utime+stime) * time.Second / clockTicks,
+	}
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return ContainerProcess{}, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		values := strings.Fields(value)
+		if len(values) == 0 {
+			continue
+		}
+		switch name {
+		case "Uid":
+			p.UID, _ = strconv.Atoi(values[0])
+		case "NSpid":
+			// The PIDs from the host's namespace down to the process's own
+			p.NSPID, _ = strconv.Atoi(values[len(values)-1])
+		}
+	}
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ContainerProcess{}, err
+	}
+	p.Command = strings.Join(strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"), " ")
+	if p.Command == "" {
+		// Kernel threads and zombies have no command line, ps shows their name instead
+		comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		p.Command = "[" + strings.TrimSpace(string(comm)) + "]"
+	}
+
+	return p, nil
+}
+
+// printContainerProcesses writes the processes of a container as a table like docker top, or
+// one JSON object per line
+func printContainerProcesses(w io.Writer, processes []ContainerProcess, format string) error {
+	switch format {
+	case "", "table":
+	case "json":
+		enc := json.NewEncoder(w)
+		for _, p := range processes {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid --format %q: expected table or json", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "UID\tPID\tPPID\tNSPID\tSTIME\tTIME\tCMD")
+	for _, p := range processes {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t%s\t%s\n", p.UID, p.PID, p.PPID, p.NSPID, p.Started.Local().Format("15:04:05"), formatCPUTime(p.CPUTime), p.Command)
+	}
+
+	return tw.Flush()
+}
+
+// formatCPUTime formats CPU time like ps, e.g. 00:01:02
+func formatCPUTime(d time.Duration) string {
+	secs := int64(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+// listeningPorts returns the ports the processes of a running container listen on, e.g.
+// 0.0.0.0:8080/tcp. Their sockets are looked up in the tables of the container's network
+// namespace, which is the host's for --network host.
+func listeningPorts(state *ContainerState) ([]string, error) {
+	pids, err := namespaceProcesses(state.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := map[string]bool{}
+	for _, pid := range pids {
+		entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, entry.Name()))
+			if inode, ok := strings.CutPrefix(link, "socket:["); err == nil && ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, nil
+	}
+
+	var ports []string
+	seen := map[string]bool{}
+	// TCP sockets listen in state 0A, UDP ones are bound in state 07
+	for _, table := range []struct{ file, proto, state string }{
+		{"tcp", "tcp", "0A"}, {"tcp6", "tcp", "0A"}, {"udp", "udp", "07"}, {"udp6", "udp", "07"},
+	} {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/%s", state.Pid, table.file))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 10 || fields[3] != table.state || !inodes[fields[9]] {
+				continue
+			}
+			addr, ok := parseProcNetAddress(fields[1])
+			if !ok {
+				continue
+			}
+			port := addr + "/" + table.proto
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Strings(ports)
+
+	return ports, nil
+}
+
+// parseProcNetAddress parses a local address of /proc/net/tcp and the like: the IP in hex as
+// 32-bit words in host byte order, then the port, e.g. 0100007F:1F90
+func parseProcNetAddress(s string) (string, bool) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	ip, err := hex.DecodeString(ipHex)
+	if !ok || err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return "", false
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return "", false
+	}
+
+	// /proc is written on little-endian hosts in the order every architecture we run on uses
+	for i := 0; i < len(ip); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+	}
+
+	return net.JoinHostPort(net.IP(ip).String(), strconv.FormatUint(port, 10)), true
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// passwdFile and groupFile are read inside the container's root
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+// containerUser is who the command runs as, resolved against the image's user database
+type containerUser struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+}
+
+// validateUser checks a --user value of the form user[:group], where both may be names or IDs
+func validateUser(spec string) error {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	if name == "" || (hasGroup && group == "") || strings.Contains(group, ":") {
+		return fmt.Errorf("invalid user %q: expected user[:group]", spec)
+	}
+
+	return nil
+}
+
+// resolveUser looks up a user[:group] in the container's /etc/passwd and /etc/group, which
+// must be the root by now. Like Docker, numeric IDs don't have to exist in the files, and the
+// user also gets the groups /etc/group lists them in.
+func resolveUser(spec string) (containerUser, error) {
+	if err := validateUser(spec); err != nil {
+		return containerUser{}, err
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+
+	passwd, err := readUserDatabase(passwdFile)
+	if err != nil {
+		return containerUser{}, err
+	}
+
+	u := containerUser{home: "/"}
+	uid, numeric := parseID(name)
+	i := slices.IndexFunc(passwd, func(entry []string) bool {
+		if numeric {
+			id, ok := parseID(entry[2])
+			return ok && id == uid
+		}
+		return entry[0] == name
+	})
+	switch {
+	case i >= 0 && len(passwd[i]) >= 6:
+		id, uidOK := parseID(passwd[i][2])
+		gid, gidOK := parseID(passwd[i][3])
+		if !uidOK || !gidOK {
+			return containerUser{}, fmt.Errorf("invalid entry for user %s in %s", name, passwdFile)
+		}
+		u.uid, u.gid, name = id, gid, passwd[i][0]
+		if passwd[i][5] != "" {
+			u.home = passwd[i][5]
+		}
+	case numeric:
+		// Not a user the image knows, which only gets root's group
+		u.uid, name = uid, ""
+	default:
+		return containerUser{}, fmt.Errorf("unable to find user %s: no matching entries in %s", name, passwdFile)
+	}
+
+	groups, err := readUserDatabase(groupFile)
+	if err != nil {
+		return containerUser{}, err
+	}
+
+	if hasGroup {
+		gid, numeric := parseID(group)
+		i := slices.IndexFunc(groups, func(entry []string) bool { return entry[0] == group })
+		switch {
+		case numeric:
+			u.gid = gid
+		case i >= 0 && len(groups[i]) >= 3:
+			if u.gid, numeric = parseID(groups[i][2]); !numeric {
+				return containerUser{}, fmt.Errorf("invalid entry for group %s in %s", group, groupFile)
+			}
+		default:
+			return containerUser{}, fmt.Errorf("unable to find group %s: no matching entries in %s", group, groupFile)
+		}
+	}
+
+	u.groups = []uint32{u.gid}
+	for _, entry := range groups {
+		if name == "" || len(entry) < 4 || !slices.Contains(strings.Split(entry[3], ","), name) {
+			continue
+		}
+		if gid, ok := parseID(entry[2]); ok && !slices.Contains(u.groups, gid) {
+			u.groups = append(u.groups, gid)
+		}
+	}
+
+	return u, nil
+}
+
+// readUserDatabase returns the colon separated fields of each entry of a passwd or group
+// file. Images without the file have no users or groups besides numeric IDs.
+func readUserDatabase(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return entries, nil
+}
+
+// parseID parses a numeric user or group ID
+func parseID(s string) (uint32, bool) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err == nil
+}
+
+// credential returns the credential to run the command with, its IDs shifted by offset for
+// processes that run outside the user namespace they are mapped into
+func (u containerUser) credential(offset uint32) *syscall.Credential {
+	cred := &syscall.Credential{Uid: u.uid + offset, Gid: u.gid + offset}
+	for _, gid := range u.groups {
+		cred.Groups = append(cred.Groups, gid+offset)
+	}
+
+	return cred
+}
+
+// mapped reports whether the user and its groups exist in the container's user namespace
+func (u containerUser) mapped() error {
+	if u.uid >= userNamespaceSize {
+		return fmt.Errorf("user %d isn't mapped into the user namespace", u.uid)
+	}
+	for _, gid := range u.groups {
+		if gid >= userNamespaceSize {
+			return fmt.Errorf("group %d isn't mapped into the user namespace", gid)
+		}
+	}
+
+	return nil
+}
+
+// switchCredential changes every thread to cred before the command is exec'd
+func switchCredential(cred *syscall.Credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, gid := range cred.Groups {
+		groups[i] = int(gid)
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to change group: %w", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("failed to change user: %w", err)
+	}
+
+	return nil
+}
+
+// hasEnv reports whether an environment sets name
+func hasEnv(env []string, name string) bool {
+	return slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, name+"=") })
+}
@@ -0,0 +1,423 @@
+package engine
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configArg is the global option for a config file other than the user's
+const configArg = "--config"
+
+// userConfigEnv names a config file other than the user's, like configArg
+const userConfigEnv = "YOUR_DOCKER_CONFIG"
+
+// defaultStorageRoot holds the image store, the layer cache and unpacked root filesystems
+// unless the config file moves them
+const defaultStorageRoot = "/var/lib/your-docker"
+
+// shimStorageRootEnv hands a storage root other than the default to the shim, which removes
+// it again like shimLogLevelEnv
+const shimStorageRootEnv = "_YOUR_DOCKER_STORAGE_ROOT"
+
+// userConfig holds the defaults of the config file, which is
+// ~/.config/your-docker/config.yaml unless configArg or userConfigEnv name another
+type userConfig struct {
+	// StorageRoot replaces defaultStorageRoot
+	StorageRoot string
+	// RegistryMirrors replace those of the daemon config, and registryMirrorArg them
+	RegistryMirrors []string
+	// InsecureRegistries and RegistryCAs are added to those of the global options
+	InsecureRegistries []string
+	RegistryCAs        []string
+	// LogLevel applies unless --debug or --log-level is given
+	LogLevel *slog.Level
+	// Proxy is used for registry requests unless the proxy environment variables are set
+	Proxy *proxyConfig
+	// CredentialsFile replaces ~/.docker/config.json unless $DOCKER_CONFIG is set
+	CredentialsFile string
+	// RunFlags come before the flags of run, create, pipe and dev, which override them
+	RunFlags []string
+}
+
+// proxyConfig is the proxy setting of the config file
+type proxyConfig struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy []string
+}
+
+// configFile is the config file given with configArg
+var configFile string
+
+// logLevelFlag records that --debug or --log-level set the log level, which the config
+// file's then doesn't change
+var logLevelFlag bool
+
+// settings is the loaded config file, the zero value without one
+var settings userConfig
+
+// userConfigPath returns the config file to load and whether it was asked for, which makes
+// it an error for it to be missing
+func userConfigPath() (string, bool, error) {
+	if configFile != "" {
+		return configFile, true, nil
+	}
+	if path := os.Getenv(userConfigEnv); path != "" {
+		return path, true, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		// Without $HOME there is no config file to look for
+		return "", false, nil
+	}
+
+	return filepath.Join(dir, "your-docker", "config.yaml"), false, nil
+}
+
+// applyUserConfig loads the config file and applies its settings that the global options
+// haven't set
+func applyUserConfig() error {
+	path, explicit, err := userConfigPath()
+	if err != nil || path == "" {
+		return err
+	}
+
+	config, err := loadUserConfig(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	settings = config
+
+	if config.LogLevel != nil && !logLevelFlag {
+		logLevel.Set(*config.LogLevel)
+	}
+	for _, host := range config.InsecureRegistries {
+		if err := addInsecureRegistry(host); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	registryCAFiles = append(registryCAFiles, config.RegistryCAs...)
+	if config.StorageRoot != "" {
+		setStorageRoot(config.StorageRoot)
+	}
+	debugf(eventTypeContainer, "loaded the config file", "path", path)
+
+	return nil
+}
+
+// loadUserConfig reads and validates a YAML or JSON config file. Relative paths in it are
+// relative to its directory.
+func loadUserConfig(path string) (userConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return userConfig{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	root, err := parseSpecDocument(path, data)
+	if err != nil {
+		return userConfig{}, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return userConfig{}, err
+	}
+
+	d := &specDecoder{file: path, dir: filepath.Dir(abs)}
+	return d.decodeUserConfig(root)
+}
+
+// decodeUserConfig validates the top-level mapping of a config file
+func (d *specDecoder) decodeUserConfig(root *specNode) (userConfig, error) {
+	var config userConfig
+	if root.kind == scalarNode && root.null {
+		// An empty file, or one that is all comments
+		return config, nil
+	}
+	if root.kind != mappingNode {
+		return config, d.errorf(root, "", "expected a mapping at the top level, found %s", root.describe())
+	}
+
+	for i, key := range root.keys {
+		value := root.values[i]
+		var err error
+
+		switch key.value {
+		case "storageRoot", "storage_root":
+			config.StorageRoot, err = d.path(value, key.value)
+		case "registryMirrors", "registry_mirrors", "registry-mirrors":
+			config.RegistryMirrors, err = d.registryMirrors(value, key.value)
+		case "insecureRegistries", "insecure_registries", "insecure-registries":
+			config.InsecureRegistries, err = d.stringList(value, key.value)
+		case "registryCAs", "registry_cas":
+			config.RegistryCAs, err = d.paths(value, key.value)
+		case "logLevel", "log_level":
+			config.LogLevel, err = d.logLevel(value, key.value)
+		case "proxy":
+			config.Proxy, err = d.proxy(value, "proxy")
+		case "credentialsFile", "credentials_file":
+			config.CredentialsFile, err = d.path(value, key.value)
+		case "runFlags", "run_flags":
+			config.RunFlags, err = d.runFlags(value, key.value)
+		default:
+			err = d.errorf(key, "", "unknown setting %q", key.value)
+		}
+
+		if err != nil {
+			return userConfig{}, err
+		}
+	}
+
+	return config, nil
+}
+
+// path accepts a path, made absolute relative to the file's directory. A leading ~/ is the
+// home directory.
+func (d *specDecoder) path(n *specNode, path string) (string, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return "", err
+	}
+	if s == "" {
+		return "", d.errorf(n, path, "must not be empty")
+	}
+
+	if rest, ok := strings.CutPrefix(s, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", d.errorf(n, path, "%v", err)
+		}
+		return filepath.Join(home, rest), nil
+	}
+	if !filepath.IsAbs(s) {
+		s = filepath.Join(d.dir, s)
+	}
+
+	return filepath.Clean(s), nil
+}
+
+func (d *specDecoder) paths(n *specNode, path string) ([]string, error) {
+	if n.kind != sequenceNode {
+		return nil, d.errorf(n, path, "expected a list, found %s", n.describe())
+	}
+
+	paths := make([]string, 0, len(n.items))
+	for i, item := range n.items {
+		p, err := d.path(item, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+func (d *specDecoder) registryMirrors(n *specNode, path string) ([]string, error) {
+	if n.kind != sequenceNode {
+		return nil, d.errorf(n, path, "expected a list, found %s", n.describe())
+	}
+
+	mirrors := make([]string, 0, len(n.items))
+	for i, item := range n.items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		s, err := d.string(item, itemPath)
+		if err != nil {
+			return nil, err
+		}
+		mirror, err := parseRegistryMirror(s)
+		if err != nil {
+			return nil, d.errorf(item, itemPath, "invalid registry mirror %q: %v", s, err)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+
+	return mirrors, nil
+}
+
+func (d *specDecoder) logLevel(n *specNode, path string) (*slog.Level, error) {
+	s, err := d.string(n, path)
+	if err != nil {
+		return nil, err
+	}
+
+	level, err := parseLogLevel(s)
+	if err != nil {
+		return nil, d.errorf(n, path, "expected debug, info, warn or error, found %q", s)
+	}
+
+	return &level, nil
+}
+
+// proxy accepts a mapping of http, https and noProxy, or a single URL for both schemes
+func (d *specDecoder) proxy(n *specNode, path string) (*proxyConfig, error) {
+	proxyURL := func(n *specNode, path string) (string, error) {
+		s, err := d.string(n, path)
+		if err != nil {
+			return "", err
+		}
+		if u, err := url.Parse(s); err != nil || u.Host == "" {
+			return "", d.errorf(n, path, "expected a URL like http://proxy.example.com:3128, found %q", s)
+		}
+		return s, nil
+	}
+
+	if n.kind == scalarNode {
+		s, err := proxyURL(n, path)
+		return &proxyConfig{HTTP: s, HTTPS: s}, err
+	}
+	if n.kind != mappingNode {
+		return nil, d.errorf(n, path, "expected a URL or a mapping, found %s", n.describe())
+	}
+
+	proxy := &proxyConfig{}
+	for i, key := range n.keys {
+		value := n.values[i]
+		keyPath := path + "." + key.value
+		var err error
+
+		switch key.value {
+		case "http", "httpProxy", "http_proxy":
+			proxy.HTTP, err = proxyURL(value, keyPath)
+		case "https", "httpsProxy", "https_proxy":
+			proxy.HTTPS, err = proxyURL(value, keyPath)
+		case "noProxy", "no_proxy":
+			if value.kind == sequenceNode {
+				proxy.NoProxy, err = d.stringList(value, keyPath)
+			} else {
+				var s string
+				s, err = d.string(value, keyPath)
+				proxy.NoProxy = strings.Split(s, ",")
+			}
+		default:
+			err = d.errorf(key, path, "unknown field %q", key.value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return proxy, nil
+}
+
+// runFlags accepts a list of flags or a string split like a shell would, checking that they
+// are flags of run
+func (d *specDecoder) runFlags(n *specNode, path string) ([]string, error) {
+	flags, err := d.command(n, path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineRunFlags(fs, runUsage)
+	if err := fs.Parse(flags); err != nil {
+		return nil, d.errorf(n, path, "%v", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, d.errorf(n, path, "expected only flags, found %q", fs.Arg(0))
+	}
+
+	return flags, nil
+}
+
+// withDefaultRunFlags puts the run flags of the config file before args, so that those given
+// on the command line override them
+func withDefaultRunFlags(args []string) []string {
+	if len(settings.RunFlags) == 0 {
+		return args
+	}
+
+	return append(append([]string{}, settings.RunFlags...), args...)
+}
+
+// storageRoot is where setStorageRoot last moved the storage to
+var storageRoot = defaultStorageRoot
+
+// setStorageRoot moves the image store, the layer cache and the root filesystems below root
+func setStorageRoot(root string) {
+	imageStoreDir = filepath.Join(root, "images")
+	layerCacheDir = filepath.Join(root, "layers")
+	diskRootfsDir = filepath.Join(root, "containers")
+	sharedRootfsDir = filepath.Join(root, "rootfs")
+	storageRoot = root
+}
+
+// registryProxy returns the proxy of a registry request: that of the environment if it has
+// one, like ProxyFromEnvironment, otherwise that of the config file
+func registryProxy(req *http.Request) (*url.URL, error) {
+	if settings.Proxy == nil || proxyEnvironmentSet() {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	proxy := settings.Proxy.HTTPS
+	if req.URL.Scheme == "http" {
+		proxy = settings.Proxy.HTTP
+	}
+	if proxy == "" || bypassesProxy(req.URL.Hostname(), settings.Proxy.NoProxy) {
+		return nil, nil
+	}
+
+	return url.Parse(proxy)
+}
+
+// proxyEnvironmentSet reports whether any of the variables ProxyFromEnvironment reads is set
+func proxyEnvironmentSet() bool {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bypassesProxy reports whether requests to host go around the proxy: those to localhost, like
+// ProxyFromEnvironment, and to hosts of noProxy, which are names that also match their
+// subdomains, IP addresses or CIDR ranges, or * for every host
+func bypassesProxy(host string, noProxy []string) bool {
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			host := strings.ToLower(host)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// userNamespaceHostID is the first host ID that container IDs are mapped to
+	userNamespaceHostID = 100000
+	// userNamespaceSize is the number of IDs mapped into the container
+	userNamespaceSize = 65536
+)
+
+// userNamespaceMappings maps container IDs 0-65535 onto an unprivileged host range, so root in
+// the container has no privileges over the host
+func userNamespaceMappings() []syscall.SysProcIDMap {
+	return []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: userNamespaceHostID, Size: userNamespaceSize},
+	}
+}
+
+// shiftOwnership moves the owners of every file under root into the user namespace's range,
+// so files owned by root in the image are owned by root in the container
+func shiftOwnership(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || st.Uid >= userNamespaceSize || st.Gid >= userNamespaceSize {
+			// IDs outside the mapped range stay unmapped, they show up as nobody
+			return nil
+		}
+
+		uid := int(st.Uid) + userNamespaceHostID
+		gid := int(st.Gid) + userNamespaceHostID
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to change owner of %s: %w", path, err)
+		}
+
+		// chown clears the setuid and setgid bits, put them back
+		if mode := info.Mode(); mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 && mode&fs.ModeSymlink == 0 {
+			if err := os.Chmod(path, mode); err != nil {
+				return fmt.Errorf("failed to restore mode of %s: %w", path, err)
+			}
+		}
+
+		return nil
+	})
+}
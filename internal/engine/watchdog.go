@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// createLockPath is held shared by every container being created and exclusively by the
+// watchdog, so it never takes a root filesystem that is still being unpacked for a leftover
+var createLockPath = filepath.Join(containerStateDir, "create.lock")
+
+// rootfsDirPattern matches the names initFS gives root filesystems
+var rootfsDirPattern = regexp.MustCompile(`^container-[0-9]+$`)
+
+// lockCreation marks a container as being created until the returned file is closed
+func lockCreation() (*os.File, error) {
+	if err := os.MkdirAll(containerStateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", containerStateDir, err)
+	}
+
+	lock, err := os.OpenFile(createLockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", createLockPath, err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", createLockPath, err)
+	}
+
+	return lock, nil
+}
+
+// sweepLeftovers cleans up after containers that crashed or whose removal was interrupted:
+// mounts below directories of ours that no running container uses, root filesystems no
+// container refers to any more, names of removed containers and half-unpacked shared root
+// filesystems and layers. It runs at the start of every command, so these don't pile up.
+// Everything it does is reported as a warning, and nothing it fails to clean up fails the
+// command.
+func sweepLeftovers() {
+	lock, err := os.OpenFile(createLockPath, os.O_RDWR, 0)
+	if err != nil {
+		// Nothing was ever created here, or we aren't allowed to clean up
+		return
+	}
+	defer lock.Close()
+
+	// Leftovers can't be told apart from containers being created, so wait for another time
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return
+	}
+
+	states, err := listContainerStates()
+	if err != nil {
+		warnf(eventTypeContainer, "failed to look for leftovers of removed containers: %v", err)
+		return
+	}
+
+	known := make(map[string]bool)
+	busy := make(map[string]bool)
+	for _, state := range states {
+		if state.RootPath == "" {
+			continue
+		}
+		known[filepath.Clean(state.RootPath)] = true
+		// Overlays over cached layers are mounted on the host for as long as the container exists
+		if state.running() || len(state.Layers) > 0 {
+			busy[filepath.Clean(state.RootPath)] = true
+		}
+	}
+
+	sweepMounts(busy)
+	sweepRootfsDirs(known)
+	sweepContainerNames()
+	sweepInterruptedUnpacks()
+}
+
+// sweepMounts detaches the mounts in our directories that no running container needs. The
+// containers' mounts live in their own mount namespaces, so those showing up here leaked from
+// a namespace they were propagated out of.
+func sweepMounts(busy map[string]bool) {
+	mounts, err := readMountPoints("/proc/self/mountinfo")
+	if err != nil {
+		warnf(eventTypeContainer, "failed to look for leaked mounts: %v", err)
+		return
+	}
+
+	parents := []string{sharedRootfsDir, layerCacheDir, diskRootfsDir, os.TempDir()}
+
+	var leaked []string
+	for _, m := range mounts {
+		root, ours := ownedPath(m, parents)
+		if !ours || busy[root] {
+			continue
+		}
+		leaked = append(leaked, m)
+	}
+
+	// Nested mounts go first, their parents can't be detached while they are busy
+	sort.Slice(leaked, func(i, j int) bool { return len(leaked[i]) > len(leaked[j]) })
+	for _, m := range leaked {
+		if err := syscall.Unmount(m, syscall.MNT_DETACH); err != nil && !errors.Is(err, syscall.EINVAL) {
+			warnf(eventTypeContainer, "failed to unmount leaked mount %s: %v", m, err)
+			continue
+		}
+		warnf(eventTypeContainer, "unmounted leaked mount %s", m)
+	}
+}
+
+// ownedPath reports whether the mount point is below a root filesystem, shared rootfs or
+// cached layer of ours and returns that directory. The parents themselves may be mount points
+// of the host, e.g. a tmpfs on /tmp, and aren't ours.
+func ownedPath(mount string, parents []string) (string, bool) {
+	for _, parent := range parents {
+		rel, err := filepath.Rel(parent, mount)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		first, _, _ := strings.Cut(rel, string(filepath.Separator))
+		if parent != sharedRootfsDir && parent != layerCacheDir && !rootfsDirPattern.MatchString(first) {
+			continue
+		}
+
+		return filepath.Join(parent, first), true
+	}
+
+	return "", false
+}
+
+// readMountPoints returns the mount points listed in a mountinfo file, see proc(5)
+func readMountPoints(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes mountinfo uses for spaces and the like
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// sweepRootfsDirs removes the root filesystems no container refers to, left by a create that
+// was killed or a removal that failed halfway
+func sweepRootfsDirs(known map[string]bool) {
+	for _, parent := range []string{diskRootfsDir, os.TempDir()} {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			dir := filepath.Join(parent, e.Name())
+			if !e.IsDir() || !rootfsDirPattern.MatchString(e.Name()) || known[dir] {
+				continue
+			}
+
+			// The temporary directory is shared, only take what we could have created
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Geteuid() {
+				continue
+			}
+
+			if err := os.RemoveAll(dir); err != nil {
+				warnf(eventTypeContainer, "failed to remove leftover root filesystem %s: %v", dir, err)
+				continue
+			}
+			warnf(eventTypeContainer, "removed leftover root filesystem %s", dir)
+		}
+	}
+}
+
+// sweepInterruptedUnpacks removes shared root filesystems and cached layers whose unpacking
+// was interrupted. Their lock is held while they are unpacked, so those that can be locked
+// were abandoned.
+func sweepInterruptedUnpacks() {
+	for _, parent := range []string{sharedRootfsDir, layerCacheDir} {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			key, _, ok := strings.Cut(e.Name(), ".tmp-")
+			if !ok || !e.IsDir() {
+				continue
+			}
+
+			dir := filepath.Join(parent, e.Name())
+			if err := removeUnlocked(dir, filepath.Join(parent, key)+".lock"); err != nil {
+				warnf(eventTypeImage, "failed to remove interrupted unpack %s: %v", dir, err)
+				continue
+			}
+		}
+	}
+}
+
+// removeUnlocked removes dir unless lockPath is locked by someone else
+func removeUnlocked(dir, lockPath string) error {
+	lock, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+		if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			// Still being unpacked
+			return nil
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	warnf(eventTypeImage, "removed interrupted unpack %s", dir)
+
+	return nil
+}
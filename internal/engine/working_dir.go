@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// validateWorkingDir checks a --workdir or WORKDIR, which like with Docker must be absolute
+func validateWorkingDir(dir string) error {
+	if dir != "" && !path.IsAbs(dir) {
+		return fmt.Errorf("invalid working directory %q: it needs to be an absolute path", dir)
+	}
+
+	return nil
+}
+
+// enterWorkingDir changes into the working directory once we are in the container's root,
+// creating it if the image doesn't have it like Docker does. Without one we stay in /.
+func enterWorkingDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	if err := syscall.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to change into working directory: %w", err)
+	}
+
+	return nil
+}
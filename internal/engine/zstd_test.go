@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// zstdRawFrame returns a frame of a single raw block holding content, with the window
+// descriptor given and no content size, so that it is what bounds the window
+func zstdRawFrame(windowDescriptor byte, content string) []byte {
+	frame := append([]byte{}, zstdMagic...)
+	frame = append(frame, 0x00, windowDescriptor)
+	// Last block, raw, of the content's size
+	header := 1 | len(content)<<3
+	frame = append(frame, byte(header), byte(header>>8), byte(header>>16))
+	return append(frame, content...)
+}
+
+func TestZstdWindowSize(t *testing.T) {
+	tests := []struct {
+		name             string
+		windowDescriptor byte
+		wantErr          string
+	}{
+		{name: "8MB", windowDescriptor: 13 << 3},
+		// What zstd --long uses
+		{name: "128MB", windowDescriptor: 17 << 3},
+		{name: "256MB", windowDescriptor: 18 << 3, wantErr: "zstd window size 268435456 exceeds supported maximum 134217728"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(newZstdReader(bytes.NewReader(zstdRawFrame(tt.windowDescriptor, "hello"))))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello" {
+				t.Errorf("decompressed %q, want hello", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,1011 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// zstdBlockMax is the most a block holds, before and after compression. RFC 3.1.1.2.3.
+const zstdBlockMax = 128 << 10
+
+// zstdMinMatch is the shortest match zstdWriter looks for
+const zstdMinMatch = 4
+
+// Compression levels of zstdWriter
+const (
+	zstdMinLevel     = 1
+	zstdMaxLevel     = len(zstdLevels)
+	zstdDefaultLevel = 3
+)
+
+// zstdLevel is how hard a compression level looks for matches: in a window of 1<<windowLog
+// bytes indexed by a hash table of 1<<hashLog entries, trying up to depth earlier positions
+// with the same hash and stopping at a match of nice bytes. A lazy level puts a match off
+// when the next position has a longer one.
+type zstdLevel struct {
+	windowLog, hashLog uint
+	depth, nice        int
+	lazy               bool
+}
+
+// zstdLevels are the levels 1 to 19, trading speed for size like those of zstd, if not as
+// far: the window stays at most 16MB
+var zstdLevels = [...]zstdLevel{
+	{windowLog: 19, hashLog: 15, depth: 1, nice: 16},
+	{windowLog: 20, hashLog: 16, depth: 2, nice: 24},
+	{windowLog: 21, hashLog: 17, depth: 4, nice: 32},
+	{windowLog: 21, hashLog: 17, depth: 8, nice: 32},
+	{windowLog: 21, hashLog: 18, depth: 8, nice: 48, lazy: true},
+	{windowLog: 22, hashLog: 18, depth: 16, nice: 64, lazy: true},
+	{windowLog: 22, hashLog: 19, depth: 24, nice: 96, lazy: true},
+	{windowLog: 22, hashLog: 19, depth: 32, nice: 128, lazy: true},
+	{windowLog: 22, hashLog: 19, depth: 48, nice: 128, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 64, nice: 192, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 96, nice: 256, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 128, nice: 256, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 192, nice: 384, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 256, nice: 512, lazy: true},
+	{windowLog: 23, hashLog: 20, depth: 384, nice: 768, lazy: true},
+	{windowLog: 24, hashLog: 21, depth: 512, nice: 1024, lazy: true},
+	{windowLog: 24, hashLog: 21, depth: 768, nice: 4096, lazy: true},
+	{windowLog: 24, hashLog: 21, depth: 1024, nice: 4096, lazy: true},
+	{windowLog: 24, hashLog: 21, depth: 1536, nice: 4096, lazy: true},
+}
+
+var errZstdWriterClosed = errors.New("zstd: write to a closed writer")
+
+// zstdWriter implements [io.WriteCloser] to write a zstd compressed stream of one frame,
+// ending with the checksum of its content. Matches are found with hash chains over a window
+// of the input before them; literals are Huffman coded and sequences use the predefined FSE
+// tables, so the frame comes out somewhat larger than zstd's own at the same level.
+type zstdWriter struct {
+	w      io.Writer
+	level  zstdLevel
+	err    error
+	header bool
+
+	// hist holds the window of input already compressed, followed at pos by input that isn't
+	// compressed yet
+	hist []byte
+	pos  int
+	// head is the last position in hist of each hash and chain the one with the same hash
+	// before each position, modulo the window size; next is the first position neither has
+	// seen yet
+	head  []int32
+	chain []int32
+	next  int
+
+	// reps are the repeated offsets, the last three offsets of matches. RFC 3.1.1.5.
+	reps [3]uint32
+
+	seqs     []zstdSequence
+	codes    []zstdSequenceCodes
+	literals []byte
+	block    []byte
+	scratch  []byte
+	checksum xxhash64
+}
+
+// zstdSequence copies litLen literals and then matchLen bytes from an offset, given as its
+// Offset_Value: 1 to 3 for a repeated offset, the offset plus 3 otherwise. RFC 3.1.1.3.2.1.1.
+type zstdSequence struct {
+	litLen, matchLen, offsetValue uint32
+}
+
+// newZstdWriter returns a writer compressing into w at level, which must be one of
+// zstdLevels
+func newZstdWriter(w io.Writer, level int) *zstdWriter {
+	l := zstdLevels[level-1]
+	z := &zstdWriter{w: w, level: l, head: make([]int32, 1<<l.hashLog), reps: [3]uint32{1, 4, 8}}
+	for i := range z.head {
+		z.head[i] = -1
+	}
+	if l.depth > 1 {
+		z.chain = make([]int32, 1<<l.windowLog)
+	}
+	z.checksum.reset()
+
+	return z
+}
+
+// Write compresses p, writing out each block once the next one has started
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.checksum.update(p)
+
+	n := len(p)
+	limit := 2<<z.level.windowLog + zstdBlockMax
+	for len(p) > 0 {
+		if len(z.hist) >= limit {
+			z.slide()
+		}
+		chunk := min(limit-len(z.hist), len(p))
+		z.hist = append(z.hist, p[:chunk]...)
+		p = p[chunk:]
+
+		for len(z.hist)-z.pos > zstdBlockMax {
+			if err := z.writeBlock(z.pos+zstdBlockMax, false); err != nil {
+				z.err = err
+				return n - len(p), err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close writes the last block and the checksum. It doesn't close the underlying writer.
+func (z *zstdWriter) Close() error {
+	if z.err == errZstdWriterClosed {
+		return nil
+	}
+	if z.err != nil {
+		return z.err
+	}
+
+	if err := z.writeBlock(len(z.hist), true); err != nil {
+		z.err = err
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.checksum.digest()))
+	if _, err := z.w.Write(sum[:]); err != nil {
+		z.err = err
+		return err
+	}
+	z.err = errZstdWriterClosed
+
+	return nil
+}
+
+// slide drops the input before the window of the next block, by a multiple of the window
+// size so that positions keep their place in chain
+func (z *zstdWriter) slide() {
+	window := 1 << z.level.windowLog
+	shift := (z.pos - window) &^ (window - 1)
+	z.hist = z.hist[:copy(z.hist, z.hist[shift:])]
+	z.pos -= shift
+	z.next -= shift
+
+	rebase := func(positions []int32) {
+		for i, p := range positions {
+			positions[i] = max(p-int32(shift), -1)
+		}
+	}
+	rebase(z.head)
+	rebase(z.chain)
+}
+
+// writeBlock compresses the input up to end into a block, RFC 3.1.1.2, or stores it as it
+// is when that comes out smaller. The frame header goes before the first block.
+func (z *zstdWriter) writeBlock(end int, last bool) error {
+	z.block = z.block[:0]
+	if !z.header {
+		// No content size, as we stream, and a content checksum. RFC 3.1.1.1.
+		z.block = binary.LittleEndian.AppendUint32(z.block, 0xfd2fb528)
+		z.block = append(z.block, 1<<2, byte(z.level.windowLog-10)<<3)
+		z.header = true
+	}
+
+	src := z.hist[z.pos:end]
+	reps := z.reps
+	z.findSequences(end)
+	start := len(z.block)
+	z.block = append(z.block, 0, 0, 0)
+	z.block = z.appendLiterals(z.block)
+	z.block = z.appendSequences(z.block)
+
+	blockType, size := uint32(2), len(z.block)-start-3
+	if size >= len(src) {
+		// Decoders don't see the offsets of a raw block
+		z.block = append(z.block[:start+3], src...)
+		blockType, size = 0, len(src)
+		z.reps = reps
+	}
+	header := blockType<<1 | uint32(size)<<3
+	if last {
+		header |= 1
+	}
+	z.block[start], z.block[start+1], z.block[start+2] = byte(header), byte(header>>8), byte(header>>16)
+
+	z.pos = end
+	_, err := z.w.Write(z.block)
+	return err
+}
+
+// findSequences splits the input from pos up to end into sequences and the literals they
+// copy, the literals after the last sequence included
+func (z *zstdWriter) findSequences(end int) {
+	z.seqs, z.literals = z.seqs[:0], z.literals[:0]
+
+	lit := z.pos
+	for i := z.pos; i+zstdMinMatch <= end; {
+		length, offset := z.findMatch(i, end)
+		if length == 0 {
+			i++
+			continue
+		}
+		if z.level.lazy && length < z.level.nice && i+1+zstdMinMatch <= end {
+			if l, o := z.findMatch(i+1, end); l > length {
+				i, length, offset = i+1, l, o
+			}
+		}
+
+		z.literals = append(z.literals, z.hist[lit:i]...)
+		z.seqs = append(z.seqs, zstdSequence{litLen: uint32(i - lit), matchLen: uint32(length), offsetValue: z.offsetValue(uint32(offset), i > lit)})
+		i += length
+		lit = i
+	}
+	z.literals = append(z.literals, z.hist[lit:end]...)
+}
+
+// findMatch returns the longest match for the input at i found within end and the window,
+// or 0 if there is none of at least zstdMinMatch bytes
+func (z *zstdWriter) findMatch(i, end int) (length, offset int) {
+	z.insertUpTo(i)
+
+	// The last offset is tried first, as it codes in the fewest bits
+	if c := i - int(z.reps[0]); c >= 0 {
+		if l := zstdMatchLen(z.hist[c:end], z.hist[i:end]); l >= zstdMinMatch {
+			length, offset = l, i-c
+			if l >= z.level.nice || i+l == end {
+				return length, offset
+			}
+		}
+	}
+
+	window := 1 << z.level.windowLog
+	mask := window - 1
+	cand := z.head[z.hash(i)]
+	for d := 0; d < z.level.depth && cand >= 0; d++ {
+		c := int(cand)
+		if i-c >= window {
+			break
+		}
+		// A longer match must differ from the best one at its end at the latest
+		if length == 0 || z.hist[c+length] == z.hist[i+length] {
+			if l := zstdMatchLen(z.hist[c:end], z.hist[i:end]); l > length {
+				length, offset = l, i-c
+				if l >= z.level.nice || i+l == end {
+					break
+				}
+			}
+		}
+		if z.chain == nil {
+			break
+		}
+		cand = z.chain[c&mask]
+	}
+
+	if length < zstdMinMatch {
+		return 0, 0
+	}
+	return length, offset
+}
+
+// offsetValue returns the Offset_Value of a match at offset and updates the repeated
+// offsets like decoders do. Without literals before the match, the values 1 to 3 stand for
+// the second and third offsets and the first one minus 1. RFC 3.1.1.5.
+func (z *zstdWriter) offsetValue(offset uint32, literals bool) uint32 {
+	r := z.reps
+	switch {
+	case literals && offset == r[0]:
+		return 1
+	case offset == r[1]:
+		z.reps = [3]uint32{r[1], r[0], r[2]}
+		if literals {
+			return 2
+		}
+		return 1
+	case offset == r[2]:
+		z.reps = [3]uint32{r[2], r[0], r[1]}
+		if literals {
+			return 3
+		}
+		return 2
+	case !literals && offset == r[0]-1:
+		z.reps = [3]uint32{offset, r[0], r[1]}
+		return 3
+	}
+	z.reps = [3]uint32{offset, r[0], r[1]}
+
+	return offset + 3
+}
+
+// insertUpTo adds the positions before i to the hash tables
+func (z *zstdWriter) insertUpTo(i int) {
+	mask := 1<<z.level.windowLog - 1
+	for ; z.next < i; z.next++ {
+		h := z.hash(z.next)
+		if z.chain != nil {
+			z.chain[z.next&mask] = z.head[h]
+		}
+		z.head[h] = int32(z.next)
+	}
+}
+
+// hash returns the hash of the zstdMinMatch bytes at i
+func (z *zstdWriter) hash(i int) uint32 {
+	return binary.LittleEndian.Uint32(z.hist[i:]) * 2654435761 >> (32 - z.level.hashLog)
+}
+
+// zstdMatchLen returns how many bytes a and b have in common at their start
+func zstdMatchLen(a, b []byte) int {
+	n := 0
+	for len(a)-n >= 8 && len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+// appendLiterals appends the Literals_Section of the block, RFC 3.1.1.3.1: a single value
+// repeated, Huffman coded literals or, if coding doesn't make them smaller, the literals as
+// they are
+func (z *zstdWriter) appendLiterals(out []byte) []byte {
+	lits := z.literals
+	if len(lits) > 0 && !slices.ContainsFunc(lits, func(b byte) bool { return b != lits[0] }) {
+		return append(appendZstdLiteralsHeader(out, 1, len(lits)), lits[0])
+	}
+
+	raw := len(appendZstdLiteralsHeader(nil, 0, len(lits))) + len(lits)
+	var ok bool
+	if z.scratch, ok = appendZstdHuffmanLiterals(z.scratch[:0], lits); ok && len(z.scratch) < raw {
+		return append(out, z.scratch...)
+	}
+
+	return append(appendZstdLiteralsHeader(out, 0, len(lits)), lits...)
+}
+
+// appendZstdLiteralsHeader appends the header of raw (0) or RLE (1) literals
+func appendZstdLiteralsHeader(out []byte, blockType byte, size int) []byte {
+	switch {
+	case size < 1<<5:
+		return append(out, blockType|byte(size)<<3)
+	case size < 1<<12:
+		return append(out, blockType|1<<2|byte(size)<<4, byte(size>>4))
+	default:
+		return append(out, blockType|3<<2|byte(size)<<4, byte(size>>4), byte(size>>12))
+	}
+}
+
+// appendZstdHuffmanLiterals appends lits as a Compressed_Literals_Block: the description of
+// a Huffman code followed by one stream of codes for few literals, four otherwise. ok is
+// false if the code can't be described. RFC 3.1.1.3.1.
+func appendZstdHuffmanLiterals(out, lits []byte) ([]byte, bool) {
+	var counts [256]int
+	for _, b := range lits {
+		counts[b]++
+	}
+	lengths, maxBits := zstdHuffmanLengths(&counts)
+	if maxBits == 0 {
+		return out, false
+	}
+	codes := zstdHuffmanCodes(&lengths, maxBits)
+
+	body, ok := appendZstdHuffmanWeights(nil, &lengths, maxBits)
+	if !ok {
+		return out, false
+	}
+	single := len(lits) <= 256
+	if single {
+		body = appendZstdHuffmanStream(body, lits, &codes, &lengths)
+	} else {
+		jump := len(body)
+		body = append(body, 0, 0, 0, 0, 0, 0)
+		size := (len(lits) + 3) / 4
+		for i := 0; i < 4; i++ {
+			streamStart := len(body)
+			body = appendZstdHuffmanStream(body, lits[i*size:min((i+1)*size, len(lits))], &codes, &lengths)
+			if i < 3 {
+				binary.LittleEndian.PutUint16(body[jump+2*i:], uint16(len(body)-streamStart))
+			}
+		}
+	}
+
+	// Both sizes take 10 bits with one stream, and 10, 14 or 18 bits with four
+	regen, comp := uint64(len(lits)), uint64(len(body))
+	var header uint64
+	var headerSize int
+	switch largest := max(regen, comp); {
+	case single:
+		header, headerSize = 2|regen<<4|comp<<14, 3
+	case largest < 1<<10:
+		header, headerSize = 2|1<<2|regen<<4|comp<<14, 3
+	case largest < 1<<14:
+		header, headerSize = 2|2<<2|regen<<4|comp<<18, 4
+	default:
+		header, headerSize = 2|3<<2|regen<<4|comp<<22, 5
+	}
+	for i := 0; i < headerSize; i++ {
+		out = append(out, byte(header>>(8*i)))
+	}
+
+	return append(out, body...), true
+}
+
+// zstdHuffmanLengths returns the lengths of a Huffman code for bytes occurring counts times,
+// at most maxHuffmanBits long, and the longest one. That is 0 if fewer than two values occur.
+func zstdHuffmanLengths(counts *[256]int) ([256]uint8, uint8) {
+	var syms []int
+	var freqs []int
+	for s, c := range counts {
+		if c > 0 {
+			syms = append(syms, s)
+			freqs = append(freqs, c)
+		}
+	}
+	var lengths [256]uint8
+	if len(syms) < 2 {
+		return lengths, 0
+	}
+
+	for {
+		// Two queues build the tree: the leaves by frequency, and the inner nodes, which come
+		// out in order of frequency too
+		order := make([]int, len(syms))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int { return freqs[a] - freqs[b] })
+
+		n := len(order)
+		weight := make([]int, 0, 2*n-1)
+		for _, i := range order {
+			weight = append(weight, freqs[i])
+		}
+		parent := make([]int, 2*n-1)
+		leaf, inner := 0, n
+		pop := func() int {
+			if leaf < n && (inner >= len(weight) || weight[leaf] <= weight[inner]) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for len(weight) < 2*n-1 {
+			a, b := pop(), pop()
+			parent[a], parent[b] = len(weight), len(weight)
+			weight = append(weight, weight[a]+weight[b])
+		}
+
+		depth := make([]uint8, 2*n-1)
+		longest := uint8(0)
+		for i := 2*n - 3; i >= 0; i-- {
+			depth[i] = depth[parent[i]] + 1
+			if i < n {
+				longest = max(longest, depth[i])
+			}
+		}
+		if longest <= maxHuffmanBits {
+			for i, s := range order {
+				lengths[syms[s]] = depth[i]
+			}
+			return lengths, longest
+		}
+
+		// Flattening the frequencies shortens the longest codes
+		for i := range freqs {
+			freqs[i] = (freqs[i] + 1) / 2
+		}
+	}
+}
+
+// zstdHuffmanCodes returns the codes of the lengths the way decoders derive them from the
+// weights: ordered by weight and then by value. RFC 4.2.1.4.
+func zstdHuffmanCodes(lengths *[256]uint8, maxBits uint8) [256]uint16 {
+	var codes [256]uint16
+	next := 0
+	for weight := uint8(1); weight <= maxBits; weight++ {
+		for s, l := range lengths {
+			if l != 0 && maxBits+1-l == weight {
+				codes[s] = uint16(next >> (weight - 1))
+				next += 1 << (weight - 1)
+			}
+		}
+	}
+
+	return codes
+}
+
+// appendZstdHuffmanWeights appends the Huffman_Tree_Description of the lengths, RFC 4.2.1:
+// the weights of the values up to the last one used, which decoders work out, either FSE
+// coded or 4 bits each. ok is false if neither works for them.
+func appendZstdHuffmanWeights(out []byte, lengths *[256]uint8, maxBits uint8) ([]byte, bool) {
+	last := 255
+	for lengths[last] == 0 {
+		last--
+	}
+	weights := make([]uint8, last)
+	for s := range weights {
+		if lengths[s] != 0 {
+			weights[s] = maxBits + 1 - lengths[s]
+		}
+	}
+
+	fse, ok := zstdFSEWeights(weights)
+	if ok && (len(weights) > 128 || len(fse) < (len(weights)+1)/2) {
+		out = append(out, byte(len(fse)))
+		return append(out, fse...), true
+	}
+	if len(weights) > 128 {
+		return out, false
+	}
+
+	out = append(out, byte(127+len(weights)))
+	for i := 0; i < len(weights); i += 2 {
+		b := weights[i] << 4
+		if i+1 < len(weights) {
+			b |= weights[i+1]
+		}
+		out = append(out, b)
+	}
+
+	return out, true
+}
+
+// zstdFSEWeights returns Huffman weights FSE coded in two interleaved states, RFC 4.2.1.2.
+// ok is false if they don't fit in the 127 bytes the header allows, or if a weight is so
+// common that decoders couldn't tell where the stream ends.
+func zstdFSEWeights(weights []uint8) ([]byte, bool) {
+	const tableLog = 6
+	if len(weights) < 2 {
+		return nil, false
+	}
+
+	counts := make([]int, slices.Max(weights)+1)
+	for _, w := range weights {
+		counts[w]++
+	}
+	norm, ok := zstdNormalizeCounts(counts, len(weights), tableLog)
+	if !ok {
+		return nil, false
+	}
+
+	enc := newZstdFSEEncoder(norm, tableLog)
+	bw := zstdBitWriter{out: appendZstdFSETable(nil, norm, tableLog)}
+	// Decoders read the first state first and alternate, ending with what the two states
+	// hold, so the even weights are coded with the first state and the last two go in first
+	n := len(weights)
+	var states [2]uint32
+	states[(n-1)&1] = enc.init(weights[n-1])
+	states[(n-2)&1] = enc.init(weights[n-2])
+	for i := n - 3; i >= 0; i-- {
+		enc.encode(&bw, &states[i&1], weights[i])
+	}
+	enc.flush(&bw, states[1])
+	enc.flush(&bw, states[0])
+	bw.close()
+
+	return bw.out, len(bw.out) < 128
+}
+
+// zstdNormalizeCounts scales the counts of symbols to probabilities summing to 1<<tableLog,
+// each symbol that occurs getting at least 1. ok is false if a symbol would get more than
+// half, whose states read no bits.
+func zstdNormalizeCounts(counts []int, total int, tableLog uint) ([]int16, bool) {
+	size := 1 << tableLog
+	norm := make([]int16, len(counts))
+	sum, common := 0, 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := max((c*size+total/2)/total, 1)
+		norm[s] = int16(n)
+		sum += n
+		if c > counts[common] {
+			common = s
+		}
+	}
+
+	for sum > size {
+		s := 0
+		for i, n := range norm {
+			if n > norm[s] {
+				s = i
+			}
+		}
+		if norm[s] <= 1 {
+			return nil, false
+		}
+		norm[s]--
+		sum--
+	}
+	norm[common] += int16(size - sum)
+
+	return norm, slices.Max(norm) <= int16(size/2)
+}
+
+// appendZstdFSETable appends the description of an FSE table with the probabilities norm,
+// the way readFSE reads it. RFC 4.1.1.
+func appendZstdFSETable(out []byte, norm []int16, tableLog uint) []byte {
+	bw := zstdBitWriter{out: out}
+	bw.add(uint64(tableLog-5), 4)
+
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	bitsNeeded := tableLog + 1
+	prev0 := false
+	for s := 0; remaining > 1; {
+		if prev0 {
+			// The zeros after a zero are counted in 2-bit repeat flags
+			zeros := 0
+			for ; norm[s] == 0; s++ {
+				zeros++
+			}
+			for ; zeros >= 3; zeros -= 3 {
+				bw.add(3, 2)
+			}
+			bw.add(uint64(zeros), 2)
+			prev0 = false
+			continue
+		}
+
+		count := int(norm[s])
+		s++
+		value := count + 1
+		max := 2*threshold - 1 - remaining
+		if value < max {
+			bw.add(uint64(value), bitsNeeded-1)
+		} else {
+			if value >= threshold {
+				value += max
+			}
+			bw.add(uint64(value), bitsNeeded)
+		}
+
+		if count >= 0 {
+			remaining -= count
+		} else {
+			remaining--
+		}
+		prev0 = count == 0
+		for remaining < threshold {
+			bitsNeeded--
+			threshold >>= 1
+		}
+	}
+	bw.flush()
+
+	return bw.out
+}
+
+// appendZstdHuffmanStream appends the codes of lits as a bit stream read backward, so the
+// last literal goes in first
+func appendZstdHuffmanStream(out, lits []byte, codes *[256]uint16, lengths *[256]uint8) []byte {
+	bw := zstdBitWriter{out: out}
+	for i := len(lits) - 1; i >= 0; i-- {
+		bw.add(uint64(codes[lits[i]]), uint(lengths[lits[i]]))
+	}
+	bw.close()
+
+	return bw.out
+}
+
+// Probabilities of the predefined FSE tables of sequence codes, RFC 3.1.1.3.2.2
+var (
+	predefinedLiteralNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	predefinedOffsetNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+	predefinedMatchNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1,
+	}
+)
+
+// zstdSequenceTable is how the sequences of a kind of code are coded: the predefined table
+// zstdWriter falls back on, with the largest table and the highest code a block may use
+type zstdSequenceTable struct {
+	predefined *zstdFSEEncoder
+	norm       []int16
+	tableLog   uint
+	maxLog     uint
+	maxSym     int
+}
+
+// Tables of literal lengths, offsets and match lengths, in the order blocks describe them
+var zstdSequenceTables = [3]zstdSequenceTable{
+	seqLiteral: {predefined: newZstdFSEEncoder(predefinedLiteralNorm, 6), norm: predefinedLiteralNorm, tableLog: 6, maxLog: 9, maxSym: 35},
+	seqOffset:  {predefined: newZstdFSEEncoder(predefinedOffsetNorm, 5), norm: predefinedOffsetNorm, tableLog: 5, maxLog: 8, maxSym: 31},
+	seqMatch:   {predefined: newZstdFSEEncoder(predefinedMatchNorm, 6), norm: predefinedMatchNorm, tableLog: 6, maxLog: 9, maxSym: 52},
+}
+
+// zstdMinSeqsForTable is the fewest sequences of a block to describe FSE tables of their
+// own for; fewer use the predefined ones
+const zstdMinSeqsForTable = 64
+
+// appendSequences appends the Sequences_Section of the block, RFC 3.1.1.3.2: each kind of
+// code uses the predefined table, an FSE table of the block's own, or the one code all its
+// sequences have, whichever is smallest
+func (z *zstdWriter) appendSequences(out []byte) []byte {
+	n := len(z.seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8)+0x80, byte(n))
+	default:
+		out = append(out, 0xff, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+
+	z.codes = z.codes[:0]
+	var counts [3][53]int
+	for _, seq := range z.seqs {
+		c := seq.codes()
+		z.codes = append(z.codes, c)
+		counts[seqLiteral][c.ll]++
+		counts[seqOffset][c.of]++
+		counts[seqMatch][c.ml]++
+	}
+
+	modes := len(out)
+	out = append(out, 0)
+	var encoders [3]*zstdFSEEncoder
+	for kind := range zstdSequenceTables {
+		var mode byte
+		mode, encoders[kind], out = zstdSequenceTables[kind].choose(out, counts[kind][:], n)
+		out[modes] |= mode << (6 - 2*kind)
+	}
+	ll, of, ml := encoders[seqLiteral], encoders[seqOffset], encoders[seqMatch]
+
+	// Decoders read the stream backward: the last sequence goes in first, and each other one
+	// with the state changes that lead to the one after it
+	bw := zstdBitWriter{out: out}
+	last := z.codes[n-1]
+	llState, mlState, ofState := ll.init(last.ll), ml.init(last.ml), of.init(last.of)
+	last.addExtraBits(&bw)
+	for i := n - 2; i >= 0; i-- {
+		c := z.codes[i]
+		of.encode(&bw, &ofState, c.of)
+		ml.encode(&bw, &mlState, c.ml)
+		ll.encode(&bw, &llState, c.ll)
+		c.addExtraBits(&bw)
+	}
+	ml.flush(&bw, mlState)
+	of.flush(&bw, ofState)
+	ll.flush(&bw, llState)
+	bw.close()
+
+	return bw.out
+}
+
+// choose returns the Compression_Mode of a kind of code occurring counts times in n
+// sequences and the encoder for it, appending the description of the table it needs.
+// RFC 3.1.1.3.2.1.
+func (t zstdSequenceTable) choose(out []byte, counts []int, n int) (byte, *zstdFSEEncoder, []byte) {
+	used := 0
+	for s, c := range counts {
+		if c == n {
+			// RLE_Mode: a table of the one code, whose states read no bits
+			norm := make([]int16, s+1)
+			norm[s] = 1
+			return 1, newZstdFSEEncoder(norm, 0), append(out, byte(s))
+		}
+		if c > 0 {
+			used = s + 1
+		}
+	}
+	if n < zstdMinSeqsForTable {
+		return 0, t.predefined, out
+	}
+
+	// Every code needs a state, and more states make the probabilities finer
+	tableLog := min(max(uint(bits.Len(uint(n)))-1, uint(bits.Len(uint(used)))+1, 5), t.maxLog)
+	norm, _ := zstdNormalizeCounts(counts[:used], n, tableLog)
+	if norm == nil {
+		return 0, t.predefined, out
+	}
+	table := appendZstdFSETable(nil, norm, tableLog)
+	if zstdCodeCost(counts, norm, tableLog)+float64(8*len(table)) >= zstdCodeCost(counts, t.norm, t.tableLog) {
+		return 0, t.predefined, out
+	}
+
+	return 2, newZstdFSEEncoder(norm, tableLog), append(out, table...)
+}
+
+// zstdCodeCost estimates the bits needed for codes occurring counts times with a table of
+// probabilities norm, or an infinite number if a code is missing from it
+func zstdCodeCost(counts []int, norm []int16, tableLog uint) float64 {
+	cost := 0.0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		cost += float64(c) * (float64(tableLog) - math.Log2(float64(max(norm[s], 1))))
+	}
+
+	return cost
+}
+
+// zstdSequenceCodes are the codes of a sequence's literal length, match length and offset,
+// and the extra bits added to the baselines of the codes
+type zstdSequenceCodes struct {
+	ll, ml, of                uint8
+	llExtra, mlExtra, ofExtra uint32
+	llBits, mlBits, ofBits    uint8
+}
+
+// codes returns the codes of the sequence, RFC 3.1.1.3.2.1.1
+func (s zstdSequence) codes() zstdSequenceCodes {
+	var c zstdSequenceCodes
+
+	if s.litLen < literalLengthOffset {
+		c.ll = uint8(s.litLen)
+	} else {
+		i := len(literalLengthBase) - 1
+		for literalLengthBase[i]&0xffffff > s.litLen {
+			i--
+		}
+		c.ll = uint8(literalLengthOffset + i)
+		c.llExtra = s.litLen - literalLengthBase[i]&0xffffff
+		c.llBits = uint8(literalLengthBase[i] >> 24)
+	}
+
+	if s.matchLen-3 < matchLengthOffset {
+		c.ml = uint8(s.matchLen - 3)
+	} else {
+		i := len(matchLengthBase) - 1
+		for matchLengthBase[i]&0xffffff > s.matchLen {
+			i--
+		}
+		c.ml = uint8(matchLengthOffset + i)
+		c.mlExtra = s.matchLen - matchLengthBase[i]&0xffffff
+		c.mlBits = uint8(matchLengthBase[i] >> 24)
+	}
+
+	c.of = uint8(bits.Len32(s.offsetValue) - 1)
+	c.ofExtra = s.offsetValue - 1<<c.of
+	c.ofBits = c.of
+
+	return c
+}
+
+// addExtraBits adds the extra bits of the codes in the reverse of the order decoders read
+// them in
+func (c zstdSequenceCodes) addExtraBits(bw *zstdBitWriter) {
+	bw.add(uint64(c.llExtra), uint(c.llBits))
+	bw.add(uint64(c.mlExtra), uint(c.mlBits))
+	bw.add(uint64(c.ofExtra), uint(c.ofBits))
+}
+
+// zstdFSEEncoder encodes symbols with an FSE table, RFC 4.1
+type zstdFSEEncoder struct {
+	tableLog uint
+	// states are the states to go to, grouped by symbol, and symbols how to find them
+	states  []uint16
+	symbols []zstdFSESymbol
+}
+
+// zstdFSESymbol tells how many bits of a state go out before a symbol, and where the state
+// coding the symbol next is
+type zstdFSESymbol struct {
+	deltaBits  uint32
+	deltaState int32
+}
+
+// newZstdFSEEncoder builds the encoder of the table with the probabilities norm, in which
+// -1 stands for less than 1. The symbols are spread like buildFSE spreads them.
+func newZstdFSEEncoder(norm []int16, tableLog uint) *zstdFSEEncoder {
+	size := 1 << tableLog
+	high := size - 1
+	spread := make([]uint8, size)
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			spread[high] = uint8(s)
+			high--
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+	pos, step := 0, size>>1+size>>3+3
+	for s, n := range norm {
+		for j := 0; j < int(n); j++ {
+			spread[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	e := &zstdFSEEncoder{tableLog: tableLog, states: make([]uint16, size), symbols: make([]zstdFSESymbol, len(norm))}
+	for u, s := range spread {
+		e.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch {
+		case n == 0:
+		case n == -1 || n == 1:
+			e.symbols[s] = zstdFSESymbol{deltaBits: uint32(tableLog<<16) - uint32(size), deltaState: int32(total - 1)}
+			total++
+		default:
+			maxBits := tableLog - uint(bits.Len16(uint16(n-1))-1)
+			e.symbols[s] = zstdFSESymbol{deltaBits: uint32(maxBits<<16) - uint32(n)<<maxBits, deltaState: int32(total - int(n))}
+			total += int(n)
+		}
+	}
+
+	return e
+}
+
+// init returns the state coding sym, the last symbol of the stream
+func (e *zstdFSEEncoder) init(sym uint8) uint32 {
+	st := e.symbols[sym]
+	nbBits := (st.deltaBits + 1<<15) >> 16
+	value := nbBits<<16 - st.deltaBits
+
+	return uint32(e.states[int32(value>>nbBits)+st.deltaState])
+}
+
+// encode writes the bits of the state that the state coding sym goes to, and moves to it
+func (e *zstdFSEEncoder) encode(bw *zstdBitWriter, state *uint32, sym uint8) {
+	st := e.symbols[sym]
+	nbBits := (*state + st.deltaBits) >> 16
+	bw.add(uint64(*state), uint(nbBits))
+	*state = uint32(e.states[int32(*state>>nbBits)+st.deltaState])
+}
+
+// flush writes the state for decoders to start from
+func (e *zstdFSEEncoder) flush(bw *zstdBitWriter, state uint32) {
+	bw.add(uint64(state), e.tableLog)
+}
+
+// zstdBitWriter writes a bit stream, filling each byte from its lowest bit
+type zstdBitWriter struct {
+	out   []byte
+	bits  uint64
+	nbits uint
+}
+
+// add writes the n low bits of v
+func (bw *zstdBitWriter) add(v uint64, n uint) {
+	bw.bits |= (v & (1<<n - 1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.out = append(bw.out, byte(bw.bits))
+		bw.bits >>= 8
+		bw.nbits -= 8
+	}
+}
+
+// flush writes the bits left, padded to a byte with zeros
+func (bw *zstdBitWriter) flush() {
+	if bw.nbits > 0 {
+		bw.out = append(bw.out, byte(bw.bits))
+		bw.bits, bw.nbits = 0, 0
+	}
+}
+
+// close ends a stream read backward with the 1 bit that marks its end, RFC 4.1
+func (bw *zstdBitWriter) close() {
+	bw.add(1, 1)
+	bw.flush()
+}
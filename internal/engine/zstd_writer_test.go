@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// zstdTestText returns n bytes of text that repeats at many distances, like the files of a
+// layer do
+func zstdTestText(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while layers of images are pulled, unpacked and committed again")
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%s %d\n", words[rng.Intn(len(words))], rng.Intn(1000))
+	}
+
+	return b.Bytes()[:n]
+}
+
+func TestZstdWriterRoundTrip(t *testing.T) {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(random)
+	// Random data between repeated text, so blocks fall back to raw ones and matches reach
+	// across them
+	mixed := append(append(zstdTestText(200<<10), random[:100<<10]...), zstdTestText(200<<10)...)
+
+	inputs := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "empty"},
+		{name: "one byte", content: []byte("a")},
+		{name: "one byte repeated", content: bytes.Repeat([]byte("a"), 1<<20)},
+		{name: "short text", content: []byte("hello, hello, hello world\n")},
+		{name: "text", content: zstdTestText(1 << 20)},
+		{name: "random", content: random},
+		{name: "mixed", content: mixed},
+		// More than twice the window of level 1, so that the history slides
+		{name: "past the window", content: zstdTestText(3 << 20)},
+	}
+
+	for _, level := range []int{zstdMinLevel, zstdDefaultLevel, 9, zstdMaxLevel} {
+		for _, in := range inputs {
+			if level == zstdMaxLevel && len(in.content) > 1<<20 {
+				continue
+			}
+			t.Run(fmt.Sprintf("level %d/%s", level, in.name), func(t *testing.T) {
+				var compressed bytes.Buffer
+				w := newZstdWriter(&compressed, level)
+				// Writes of odd sizes, so that blocks don't start where writes do
+				for rest := in.content; len(rest) > 0; {
+					n := min(len(rest), 70001)
+					if _, err := w.Write(rest[:n]); err != nil {
+						t.Fatalf("Write() error = %v", err)
+					}
+					rest = rest[n:]
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+
+				got, err := io.ReadAll(newZstdReader(&compressed))
+				if err != nil {
+					t.Fatalf("decompressing error = %v", err)
+				}
+				if !bytes.Equal(got, in.content) {
+					t.Fatalf("decompressed %d bytes that differ from the %d written", len(got), len(in.content))
+				}
+			})
+		}
+	}
+}
+
+func TestZstdWriterCompresses(t *testing.T) {
+	text := zstdTestText(1 << 20)
+	var compressed bytes.Buffer
+	w := newZstdWriter(&compressed, zstdDefaultLevel)
+	w.Write(text)
+	w.Close()
+
+	// gzip gets this text to 31%
+	if compressed.Len() > len(text)*35/100 {
+		t.Errorf("compressed %d bytes to %d, want at most 35%%", len(text), compressed.Len())
+	}
+}
+
+func TestZstdWriterClosed(t *testing.T) {
+	w := newZstdWriter(io.Discard, zstdDefaultLevel)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close() error = %v, want nil", err)
+	}
+	if _, err := w.Write([]byte("late")); err != errZstdWriterClosed {
+		t.Errorf("Write() after Close() error = %v, want %v", err, errZstdWriterClosed)
+	}
+}
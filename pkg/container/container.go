@@ -0,0 +1,122 @@
+// Package container creates and runs containers from images in the local store, the way the
+// create, start, stop and rm commands do.
+//
+// Containers run under a shim process that is the program itself started again, so programs
+// using this package must call Init first thing in main:
+//
+//	func main() {
+//		container.Init()
+//		...
+//	}
+package container
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/docker-starter-go/internal/engine"
+)
+
+// The statuses of a container
+const (
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusExited  = "exited"
+)
+
+// Options configure a container. Image and Command are required; the others default like
+// the create command's flags.
+type Options = engine.RunOptions
+
+// Mount is a bind mount of a host path into a container
+type Mount = engine.Mount
+
+// State is what is recorded about a container
+type State = engine.ContainerState
+
+// Container is a created container
+type Container struct {
+	id string
+}
+
+// Init runs the container processes this program is started as and otherwise sets up the
+// logging of warnings. It must be called before anything else in main.
+func Init() {
+	engine.Init()
+}
+
+// Create creates a container, pulling its image into the default store if it isn't there.
+// Cancelling ctx stops the pull and undoes what was set up.
+func Create(ctx context.Context, opts Options) (*Container, error) {
+	id, err := engine.CreateContainer(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Container{id: id}, nil
+}
+
+// Get returns the container with the given name, ID or ID prefix
+func Get(ref string) (*Container, error) {
+	id, err := engine.ResolveContainer(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Container{id: id}, nil
+}
+
+// List returns the state of every container
+func List() ([]*State, error) {
+	return engine.ListContainers()
+}
+
+// ID returns the container's ID
+func (c *Container) ID() string {
+	return c.id
+}
+
+// Start starts the container in the background
+func (c *Container) Start() error {
+	return engine.StartContainer(c.id)
+}
+
+// Wait waits until the container has exited and returns its exit code
+func (c *Container) Wait(ctx context.Context) (int, error) {
+	return engine.WaitContainer(ctx, c.id)
+}
+
+// Stop sends the container SIGTERM and kills it once timeout has passed
+func (c *Container) Stop(timeout time.Duration) error {
+	return engine.StopContainer(c.id, timeout)
+}
+
+// Kill kills the container's processes
+func (c *Container) Kill() error {
+	return engine.KillContainer(c.id)
+}
+
+// Signal sends sig to the container's init, or with all to each of its processes, like
+// SIGHUP to have a server reload its configuration. Unlike Kill it doesn't wait for the
+// container to exit.
+func (c *Container) Signal(sig syscall.Signal, all bool) error {
+	return engine.SignalContainer(c.id, sig, all)
+}
+
+// ParseSignal parses a signal name like HUP or SIGHUP, or a number, checking that the
+// platform has it
+func ParseSignal(s string) (syscall.Signal, error) {
+	return engine.ParseSignal(s)
+}
+
+// Remove removes the container. Running containers are only removed with force, which kills
+// them first.
+func (c *Container) Remove(force bool) error {
+	return engine.RemoveContainer(c.id, force)
+}
+
+// State returns the recorded state of the container
+func (c *Container) State() (*State, error) {
+	return engine.InspectContainer(c.id)
+}
@@ -0,0 +1,112 @@
+// Package image reads the local image store that images are pulled into and containers are
+// created from.
+package image
+
+import (
+	"io"
+
+	"github.com/codecrafters-io/docker-starter-go/internal/engine"
+)
+
+// Image is a tagged image in the store
+type Image struct {
+	Name   string
+	Tag    string
+	Digest string
+	// ID is the digest of the image's config, as docker images shows it
+	ID     string
+	Layers []Layer
+
+	stored *engine.StoredImage
+}
+
+// Layer is a layer of an image, topmost last
+type Layer struct {
+	MediaType string
+	Digest    string
+	Size      int64
+}
+
+// Config is the part of an image's config that containers are created from
+type Config = engine.ImageConfig
+
+// Summary describes a tagged image for listings
+type Summary = engine.ImageSummary
+
+// Store is a local image store
+type Store struct {
+	store *engine.ImageStore
+}
+
+// DefaultStore returns the store the your_docker.sh commands use
+func DefaultStore() *Store {
+	return &Store{store: engine.DefaultImageStore()}
+}
+
+// OpenStore returns the store rooted at dir. Nothing is created until the first pull.
+func OpenStore(dir string) *Store {
+	return &Store{store: engine.NewImageStore(dir)}
+}
+
+// Lookup returns the image ref refers to, e.g. alpine:3.19. Images that haven't been pulled
+// are an error.
+func (s *Store) Lookup(ref string) (*Image, error) {
+	img, err := s.store.Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromStored(img), nil
+}
+
+// List returns every tagged image sorted by repository and tag
+func (s *Store) List() ([]Summary, error) {
+	return s.store.List()
+}
+
+// Config returns the config of an image
+func (s *Store) Config(img *Image) (Config, error) {
+	return s.store.ImageConfig(img.stored)
+}
+
+// SaveOCILayout writes images to dir in the OCI image layout, adding them to a layout that is
+// already there, like the save command
+func (s *Store) SaveOCILayout(dir string, images ...*Image) error {
+	stored := make([]*engine.StoredImage, len(images))
+	for i, img := range images {
+		stored[i] = img.stored
+	}
+
+	return s.store.SaveOCILayout(dir, stored)
+}
+
+// LoadArchive stores the images of a docker save archive or an OCI layout tarball read from
+// r and returns them by tag, like the load command
+func (s *Store) LoadArchive(r io.Reader) ([]*Image, error) {
+	stored, err := s.store.LoadArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]*Image, len(stored))
+	for i, img := range stored {
+		images[i] = fromStored(img)
+	}
+
+	return images, nil
+}
+
+// Reference returns the reference img is looked up by, e.g. alpine:3.19
+func (img *Image) Reference() string {
+	return img.stored.Reference()
+}
+
+// fromStored converts an image of the runtime's store
+func fromStored(img *engine.StoredImage) *Image {
+	out := &Image{Name: img.Name, Tag: img.Tag, Digest: img.Digest, ID: img.Manifest.Config.Digest, stored: img}
+	for _, layer := range img.Manifest.Layers {
+		out.Layers = append(out.Layers, Layer{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+
+	return out
+}
@@ -0,0 +1,44 @@
+// Package registry pulls images from Docker Hub and other registries into the local image
+// store, with the credentials of docker login and resumable, verified layer downloads.
+//
+// Programs using it must call container.Init first thing in main, which sets up the
+// logging of warnings.
+package registry
+
+import (
+	"context"
+
+	"github.com/codecrafters-io/docker-starter-go/internal/engine"
+	"github.com/codecrafters-io/docker-starter-go/pkg/image"
+)
+
+// Reference is a parsed image reference like alpine:3.19 or docker.io/library/alpine@sha256:...
+type Reference = engine.Reference
+
+// Platform is an OS, architecture and optional variant like linux/arm/v7
+type Platform = engine.Platform
+
+// PullOptions configure PullImage
+type PullOptions = engine.PullOptions
+
+// ParseReference parses an image reference the way docker pull does
+func ParseReference(s string) (Reference, error) {
+	return engine.ParseReference(s)
+}
+
+// ParsePlatform parses a platform like linux/arm64 or linux/arm/v7
+func ParsePlatform(s string) (Platform, error) {
+	return engine.ParsePlatform(s)
+}
+
+// PullImage downloads the image ref refers to into the local store and returns it. Layers
+// that are already stored aren't downloaded again. Progress is published to the events of
+// the runtime, warnings are logged.
+func PullImage(ctx context.Context, ref string, opts PullOptions) (*image.Image, error) {
+	img, err := engine.PullImage(ctx, ref, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return image.DefaultStore().Lookup(img.Reference())
+}
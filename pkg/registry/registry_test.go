@@ -0,0 +1,70 @@
+package registry_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/docker-starter-go/pkg/registry"
+)
+
+const digest = "sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		in   string
+		want registry.Reference
+		// familiar is how Docker shows the reference
+		familiar string
+	}{
+		{in: "alpine", want: registry.Reference{Domain: "docker.io", Path: "library/alpine", Tag: "latest"}, familiar: "alpine:latest"},
+		{in: "alpine:3.19", want: registry.Reference{Domain: "docker.io", Path: "library/alpine", Tag: "3.19"}, familiar: "alpine:3.19"},
+		{in: "alice/app", want: registry.Reference{Domain: "docker.io", Path: "alice/app", Tag: "latest"}, familiar: "alice/app:latest"},
+		{in: "index.docker.io/library/alpine:edge", want: registry.Reference{Domain: "docker.io", Path: "library/alpine", Tag: "edge"}, familiar: "alpine:edge"},
+		{in: "alpine@" + digest, want: registry.Reference{Domain: "docker.io", Path: "library/alpine", Digest: digest}, familiar: "alpine@" + digest},
+		{in: "alpine:3.19@" + digest, want: registry.Reference{Domain: "docker.io", Path: "library/alpine", Digest: digest}, familiar: "alpine@" + digest},
+		{in: "ghcr.io/org/app:1.2", want: registry.Reference{Domain: "ghcr.io", Path: "org/app", Tag: "1.2"}, familiar: "ghcr.io/org/app:1.2"},
+		{in: "registry.example.com:5000/app", want: registry.Reference{Domain: "registry.example.com:5000", Path: "app", Tag: "latest"}, familiar: "registry.example.com:5000/app:latest"},
+		{in: "registry.example.com:5000/team/app:v1@" + digest, want: registry.Reference{Domain: "registry.example.com:5000", Path: "team/app", Digest: digest}, familiar: "registry.example.com:5000/team/app@" + digest},
+		{in: "localhost/app", want: registry.Reference{Domain: "localhost", Path: "app", Tag: "latest"}, familiar: "localhost/app:latest"},
+		{in: "localhost:5000/app:dev", want: registry.Reference{Domain: "localhost:5000", Path: "app", Tag: "dev"}, familiar: "localhost:5000/app:dev"},
+		{in: "[::1]:5000/app", want: registry.Reference{Domain: "[::1]:5000", Path: "app", Tag: "latest"}, familiar: "[::1]:5000/app:latest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ref, err := registry.ParseReference(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref != tt.want {
+				t.Errorf("ParseReference() = %+v, want %+v", ref, tt.want)
+			}
+			if got := ref.FamiliarString(); got != tt.familiar {
+				t.Errorf("FamiliarString() = %q, want %q", got, tt.familiar)
+			}
+		})
+	}
+}
+
+func TestParseReferenceInvalid(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{in: "", wantErr: "empty"},
+		{in: "Alpine", wantErr: "must be lowercase"},
+		{in: "alpine:-latest", wantErr: "tag"},
+		{in: "alpine@sha256:abc", wantErr: "invalid image reference"},
+		{in: "registry.example.com:port/app", wantErr: "invalid image reference"},
+		{in: "localhost:5000/", wantErr: "no repository name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := registry.ParseReference(tt.in)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseReference() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}